@@ -17,23 +17,43 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
 
 	"github.com/grammarly/rocker/src/build"
+	"github.com/grammarly/rocker/src/completion"
 	"github.com/grammarly/rocker/src/debugtrap"
+	"github.com/grammarly/rocker/src/deprecation"
 	"github.com/grammarly/rocker/src/dockerclient"
+	"github.com/grammarly/rocker/src/imagename"
+	"github.com/grammarly/rocker/src/logsink"
+	"github.com/grammarly/rocker/src/remote"
+	"github.com/grammarly/rocker/src/selfupdate"
+	"github.com/grammarly/rocker/src/server"
 	"github.com/grammarly/rocker/src/storage/s3"
 	"github.com/grammarly/rocker/src/template"
 	"github.com/grammarly/rocker/src/textformatter"
 	"github.com/grammarly/rocker/src/util"
 
 	"github.com/codegangsta/cli"
+	"github.com/docker/docker/pkg/archive"
+	"github.com/docker/docker/pkg/term"
 	"github.com/docker/docker/pkg/units"
 	"github.com/fatih/color"
 	"github.com/fsouza/go-dockerclient"
+	"github.com/go-yaml/yaml"
 
 	log "github.com/Sirupsen/logrus"
 	runconfigopts "github.com/docker/docker/runconfig/opts"
@@ -54,6 +74,9 @@ var (
 
 	// HumanVersion is a human readable app version
 	HumanVersion = fmt.Sprintf("%s - %.7s (%s) %s", Version, GitCommit, GitBranch, BuildTime)
+
+	// logSinks are the log destinations given by --log-* flags, nil if there are none
+	logSinks *logsink.Sinks
 )
 
 func init() {
@@ -87,15 +110,75 @@ func main() {
 			Name:  "json",
 			Usage: "Print output in json",
 		},
+		cli.StringFlag{
+			Name:   "tmp-dir",
+			Usage:  "directory for the temporary files, such as S3 image tarballs, defaults to the system temp dir",
+			EnvVar: "ROCKER_TMP_DIR",
+		},
+		cli.DurationFlag{
+			Name:   "cache-lock-timeout",
+			Value:  util.DefaultLockTimeout,
+			Usage:  "how long to wait for the cache entries locked by another rocker process sharing the cache dir",
+			EnvVar: "ROCKER_CACHE_LOCK_TIMEOUT",
+		},
+		cli.DurationFlag{
+			Name:   "registry-cache-ttl",
+			Usage:  "keep the tag lists of the registry repositories in the cache dir for this long, shared by the rocker processes on the host; disabled if zero",
+			EnvVar: "ROCKER_REGISTRY_CACHE_TTL",
+		},
+		cli.StringFlag{
+			Name:   "chown-output",
+			Usage:  "give the files written to the cache dir and the artifacts path, and the reports, to the numeric uid:gid, e.g. the CI user sharing the volumes",
+			EnvVar: "ROCKER_CHOWN_OUTPUT",
+		},
+		cli.BoolFlag{
+			Name:   "offline",
+			Usage:  "forbid the network operations: pulls, pushes, registry requests, url downloads and S3; the build fails before it starts if it needs any",
+			EnvVar: "ROCKER_OFFLINE",
+		},
+		cli.BoolFlag{
+			Name:   "warnings-as-errors",
+			Usage:  "fail if any deprecation warnings were raised, they are summarized at the end of the run",
+			EnvVar: "ROCKER_WARNINGS_AS_ERRORS",
+		},
 		cli.BoolTFlag{
 			Name:  "colors",
 			Usage: "Make output colored",
 		},
+		cli.StringFlag{
+			Name:   "log-file",
+			Usage:  "also append the logs, including the output of the build containers, to the file; in json with --json",
+			EnvVar: "ROCKER_LOG_FILE",
+		},
+		cli.BoolFlag{
+			Name:  "log-syslog",
+			Usage: "also send the logs to the local syslog daemon",
+		},
+		cli.StringFlag{
+			Name:   "log-fluentd",
+			Usage:  "also send the logs to the fluentd forward input at host:port",
+			EnvVar: "ROCKER_LOG_FLUENTD",
+		},
+		cli.StringFlag{
+			Name:  "log-fluentd-tag",
+			Value: logsink.DefaultFluentdTag,
+			Usage: "tag of the fluentd events",
+		},
 		cli.BoolFlag{
 			Name:   "cmd, C",
 			EnvVar: "ROCKER_PRINT_COMMAND",
 			Usage:  "Print command-line that was used to exec",
 		},
+		cli.StringFlag{
+			Name:   "rsync-image",
+			Usage:  "image of the EXPORT/IMPORT containers, it should have /opt/rsync/bin/rsync (default " + build.RsyncImage + ")",
+			EnvVar: "ROCKER_RSYNC_IMAGE",
+		},
+		cli.StringFlag{
+			Name:   "scratch-image",
+			Usage:  "image of the MOUNT and CACHE volume containers (default " + build.MountVolumeImage + ")",
+			EnvVar: "ROCKER_SCRATCH_IMAGE",
+		},
 	}, dockerclient.GlobalCliParams()...)
 
 	buildFlags := []cli.Flag{
@@ -114,6 +197,19 @@ func main() {
 			Value: &cli.StringSlice{},
 			Usage: "Set build-time variables, can pass multiple of those, format is key=value (default [])",
 		},
+		cli.BoolFlag{
+			Name:  "record-build-args",
+			Usage: "record the names of the build args consumed by ARG to the rocker.build-args label of the image",
+		},
+		cli.StringSliceFlag{
+			Name:  "record-build-arg-value",
+			Value: &cli.StringSlice{},
+			Usage: "record the value of the build arg to the rocker.build-arg.NAME label, implies --record-build-args; never recorded for secret-looking names",
+		},
+		cli.BoolFlag{
+			Name:  "record-vars",
+			Usage: "record the vars and the step keys of the Rockerfile to the rocker-data label of the tagged and pushed images, see `rocker verify`; never recorded for secret-looking names",
+		},
 		cli.StringSliceFlag{
 			Name:  "var",
 			Value: &cli.StringSlice{},
@@ -124,6 +220,11 @@ func main() {
 			Value: &cli.StringSlice{},
 			Usage: "Load variables form a file, either JSON or YAML. Can pass multiple of this.",
 		},
+		cli.StringFlag{
+			Name:   "var-from-env-prefix",
+			Usage:  "import the environment variables with the prefix as variables, stripped of the prefix, e.g. ROCKER_VAR_; --vars and --var take precedence",
+			EnvVar: "ROCKER_VAR_FROM_ENV_PREFIX",
+		},
 		cli.BoolFlag{
 			Name:  "no-cache",
 			Usage: "supresses cache for docker builds",
@@ -137,9 +238,132 @@ func main() {
 			Value: "~/.rocker_cache",
 			Usage: "Set the directory where the cache will be stored",
 		},
+		cli.StringFlag{
+			Name:  "cache-repo",
+			Usage: "(experimental) tag intermediate images as <repo>:sha256-<cache key>, so the cache can be shared through a registry",
+		},
+		cli.StringSliceFlag{
+			Name:  "cache-from",
+			Value: &cli.StringSlice{},
+			Usage: "(experimental) repositories to pull the cache tags from if they are not present locally",
+		},
+		cli.BoolFlag{
+			Name:  "cache-push",
+			Usage: "(experimental) push the cache tags made with --cache-repo",
+		},
+		cli.StringFlag{
+			Name:   "policy-file",
+			Usage:  "YAML file with the allowed FROM images and PUSH destinations, the build fails before it starts if the Rockerfile violates it",
+			EnvVar: "ROCKER_POLICY_FILE",
+		},
+		cli.StringFlag{
+			Name:  "base",
+			Usage: "image to build on top of, available to the Rockerfile as {{ .BaseOverride }}, e.g. FROM {{ .BaseOverride }}",
+		},
+		cli.StringFlag{
+			Name:  "from-override",
+			Usage: "replace the image of the first FROM, so that the Rockerfile is applied on top of an already built image",
+		},
+		cli.StringFlag{
+			Name:   "shell",
+			Usage:  "shell the shell form of RUN and TEST is run with, e.g. \"/bin/bash -euo pipefail -c\", overrides the one in .rocker.yml",
+			EnvVar: "ROCKER_SHELL",
+		},
+		cli.StringFlag{
+			Name:  "copy-stdin",
+			Usage: "tar archive for COPY --from-stdin, a file descriptor number, e.g. --copy-stdin 3 3<bundle.tar, a path or - for stdin; gzip, bzip2 and xz are decompressed",
+		},
+		cli.StringFlag{
+			Name:   "publish-channel",
+			Usage:  "rewrite the tags of TAG and PUSH targets by the channel: snapshot, release or the ones in .rocker.yml",
+			EnvVar: "ROCKER_PUBLISH_CHANNEL",
+		},
+		cli.StringFlag{
+			Name:   "hash",
+			Value:  build.DefaultHash,
+			Usage:  "hashing algorithm of the COPY/ADD tarsums, sha256 or sha512_256; the cache made with another one is not hit",
+			EnvVar: "ROCKER_HASH",
+		},
+		cli.StringSliceFlag{
+			Name:   "registry-mirror",
+			Value:  &cli.StringSlice{},
+			Usage:  "pull FROM images through the mirror of their registry, e.g. docker.io=mirror.internal; may be given multiple times",
+			EnvVar: "ROCKER_REGISTRY_MIRROR",
+		},
+		cli.StringSliceFlag{
+			Name:   "mirror-push",
+			Value:  &cli.StringSlice{},
+			Usage:  "PUSH the images of the registry to the mirror as well, e.g. quay.io=hub.internal; may be given multiple times",
+			EnvVar: "ROCKER_MIRROR_PUSH",
+		},
+		cli.BoolFlag{
+			Name:  "explain-cache-miss",
+			Usage: "print the difference against the nearest cached state when a step misses cache",
+		},
+		cli.BoolFlag{
+			Name:  "config-diff",
+			Usage: "print how every commit changes the image config: ENV, LABEL, EXPOSE, CMD, ENTRYPOINT, etc.",
+		},
+		cli.BoolFlag{
+			Name:  "auto-batch",
+			Usage: "commit ENV, LABEL, EXPOSE, WORKDIR, USER and other metadata changes along with the next RUN, COPY or ADD to produce fewer layers",
+		},
+		cli.BoolFlag{
+			Name:  "skip-noop-commits",
+			Usage: "reuse the parent image instead of committing the steps that changed neither the files nor the config",
+		},
+		cli.BoolFlag{
+			Name:  "dedupe-copy",
+			Usage: "reuse the image of the same COPY or ADD made earlier in the build on top of the same image, even with --no-cache",
+		},
+		cli.BoolFlag{
+			Name:  "fail-on-secrets",
+			Usage: "fail the build if the files added by COPY and ADD or the ENV and LABEL values of the pushed image look like they contain secrets",
+		},
+		cli.BoolFlag{
+			Name:  "args-file-mount",
+			Usage: "pass the build args and the vars given by RUN --vars to RUN as the " + build.ArgsFilePath + " JSON file instead of the environment variables",
+		},
+		cli.StringFlag{
+			Name:  "snapshot-on-failure",
+			Usage: "commit the container of the failed RUN or TEST to the image, e.g. repo/app:debug-123; debug-<container id> tag is used if not given",
+		},
+		cli.StringFlag{
+			Name:   "min-free-space",
+			Usage:  "fail the build if the docker host has less free disk space before a step, e.g. 5g",
+			EnvVar: "ROCKER_MIN_FREE_SPACE",
+		},
+		cli.StringFlag{
+			Name:   "max-step-log-bytes",
+			Usage:  "log up to this much of the output of a step container, e.g. 50m; the rest is discarded after a truncation marker",
+			EnvVar: "ROCKER_MAX_STEP_LOG_BYTES",
+		},
+		cli.StringFlag{
+			Name:   "max-context-size",
+			Usage:  "fail the build if the context is larger after .dockerignore, e.g. 500MB; the largest files and directories are listed",
+			EnvVar: "ROCKER_MAX_CONTEXT_SIZE",
+		},
+		cli.BoolFlag{
+			Name:   "max-context-size-warn",
+			Usage:  "only warn if the context is larger than --max-context-size",
+			EnvVar: "ROCKER_MAX_CONTEXT_SIZE_WARN",
+		},
+		cli.BoolFlag{
+			Name:   "no-prefetch",
+			Usage:  "resolve and pull the FROM images one by one as the FROM steps come, instead of all of them concurrently before the build",
+			EnvVar: "ROCKER_NO_PREFETCH",
+		},
+		cli.StringFlag{
+			Name:  "cgroup-parent",
+			Usage: "parent cgroup of the containers made by the build, so their resource usage can be attributed to the build",
+		},
+		cli.BoolFlag{
+			Name:  "strict",
+			Usage: "fail on the warnings about implicit behaviors, e.g. implicit context directory, PUSH without --push, unused -var",
+		},
 		cli.BoolFlag{
 			Name:  "no-reuse",
-			Usage: "suppresses reuse for all the volumes in the build",
+			Usage: "give every MOUNT volume a fresh empty one that is removed after the build, see MOUNT --seed",
 		},
 		cli.BoolFlag{
 			Name:  "push",
@@ -161,10 +385,18 @@ func main() {
 			Name:  "print",
 			Usage: "just print the Rockerfile after template processing and stop",
 		},
+		cli.BoolFlag{
+			Name:  "annotate",
+			Usage: "with --print, prefix every line with the line of the Rockerfile source it comes from",
+		},
 		cli.BoolFlag{
 			Name:  "demand-artifacts",
 			Usage: "fail if artifacts not found for {{ image }} helpers",
 		},
+		cli.BoolFlag{
+			Name:  "interactive-vars",
+			Usage: "ask for the missing variables of {{ required }} helpers if stdin is a terminal, fail otherwise",
+		},
 		cli.StringFlag{
 			Name:  "id",
 			Usage: "override the default id generation strategy for current build",
@@ -181,7 +413,152 @@ func main() {
 			Name:  "push-retry",
 			Usage: "number of retries for failed image pushes",
 		},
+		cli.BoolFlag{
+			Name:  "commit-no-pause",
+			Usage: "do not pause the containers when committing them, which lets the daemon commit the parallel builds concurrently",
+		},
+		cli.StringFlag{
+			Name:  "provenance",
+			Usage: "write the SLSA provenance of the build, an in-toto statement, to the json file",
+		},
+		cli.BoolFlag{
+			Name:  "provenance-s3",
+			Usage: "upload the --provenance document next to every image pushed to S3",
+		},
+		cli.StringFlag{
+			Name:  "save-context-snapshot",
+			Usage: "save the filtered context, the rendered Rockerfile, the vars and the resolved FROM images of the build to the .tar.gz file",
+		},
+		cli.StringFlag{
+			Name:  "context-digest",
+			Usage: "sha256:<hex> the build context archive on S3 should have, s3://<bucket>/<key>",
+		},
+		cli.StringFlag{
+			Name:   "builder",
+			Usage:  "run the build on the remote builder: k8s://namespace/selector, tcp://host:port or unix:///path/to.sock",
+			EnvVar: "ROCKER_BUILDER",
+		},
+		cli.StringFlag{
+			Name:  "matrix",
+			Usage: "build the Rockerfile for every combination of variables from the file, either JSON or YAML",
+		},
+		cli.IntFlag{
+			Name:  "matrix-parallel",
+			Value: 1,
+			Usage: "number of matrix builds to run in parallel",
+		},
+		cli.IntFlag{
+			Name:  "max-parallel-cpu",
+			Usage: "max CPUs the RUN containers of the parallel matrix builds may use, defaults to the CPUs of the docker host",
+		},
+		cli.StringFlag{
+			Name:  "max-parallel-mem",
+			Usage: "max memory the RUN containers of the parallel matrix builds may use, e.g. 8g, defaults to the memory of the docker host",
+		},
+		cli.StringFlag{
+			Name:  "matrix-artifacts",
+			Usage: "save the combined artifacts of all matrix builds to the file",
+		},
+	}
+
+	serverFlags := []cli.Flag{
+		cli.StringFlag{
+			Name:  "work-dir",
+			Value: "",
+			Usage: "directory to extract build contexts to, defaults to the system temp dir",
+		},
+		cli.StringFlag{
+			Name:  "auth, a",
+			Value: "",
+			Usage: "Username and password in user:password format",
+		},
+		cli.StringFlag{
+			Name:  "cache-dir",
+			Value: "~/.rocker_cache",
+			Usage: "Set the directory where the cache will be stored",
+		},
+		cli.IntFlag{
+			Name:  "push-retry",
+			Usage: "number of retries for failed image pushes",
+		},
+		cli.BoolFlag{
+			Name:  "commit-no-pause",
+			Usage: "do not pause the containers when committing them, which lets the daemon commit the parallel builds concurrently",
+		},
+		cli.IntFlag{
+			Name:  "queue-size",
+			Value: 100,
+			Usage: "number of builds that can wait in the queue",
+		},
+		cli.StringFlag{
+			Name:   "min-free-space",
+			Usage:  "fail the builds if the docker host has less free disk space before a step, e.g. 5g",
+			EnvVar: "ROCKER_MIN_FREE_SPACE",
+		},
+		cli.StringFlag{
+			Name:   "max-step-log-bytes",
+			Usage:  "log up to this much of the output of a step container, e.g. 50m; the rest is discarded after a truncation marker",
+			EnvVar: "ROCKER_MAX_STEP_LOG_BYTES",
+		},
+		cli.StringFlag{
+			Name:   "hash",
+			Value:  build.DefaultHash,
+			Usage:  "hashing algorithm of the COPY/ADD tarsums, sha256 or sha512_256; the cache made with another one is not hit",
+			EnvVar: "ROCKER_HASH",
+		},
+		cli.StringFlag{
+			Name:  "cgroup-parent",
+			Usage: "parent cgroup of the containers made by the builds, so their resource usage can be attributed to the builds",
+		},
+	}
+
+	// The security settings of RUN and TEST containers, for both local and server builds
+	sandboxFlags := []cli.Flag{
+		cli.StringSliceFlag{
+			Name:  "cap-drop",
+			Value: &cli.StringSlice{},
+			Usage: "drop the linux capabilities of RUN and TEST containers, e.g. ALL",
+		},
+		cli.StringSliceFlag{
+			Name:  "cap-add",
+			Value: &cli.StringSlice{},
+			Usage: "add the linux capabilities to RUN and TEST containers",
+		},
+		cli.StringSliceFlag{
+			Name:  "security-opt",
+			Value: &cli.StringSlice{},
+			Usage: "security options of RUN and TEST containers, e.g. no-new-privileges",
+		},
+		cli.BoolFlag{
+			Name:  "read-only",
+			Usage: "mount the root filesystem of RUN and TEST containers as read only",
+		},
+		cli.BoolFlag{
+			Name:  "deny-privileged",
+			Usage: "fail the builds that use RUN --privileged",
+		},
+	}
+	buildFlags = append(buildFlags, sandboxFlags...)
+	serverFlags = append(serverFlags, sandboxFlags...)
+
+	s3LayersFlag := cli.BoolFlag{
+		Name:   "s3-layers",
+		Usage:  "push the layers of S3 images as separate objects shared by the bucket, uploading only the layers it does not have yet",
+		EnvVar: "ROCKER_S3_LAYERS",
+	}
+	s3PullHelperFlag := cli.StringFlag{
+		Name:   "s3-pull-helper",
+		Usage:  "image with the aws cli and curl to load S3 images on the docker host, so the tarballs do not pass through this machine",
+		EnvVar: "ROCKER_S3_PULL_HELPER",
 	}
+	s3CompressionFlag := cli.StringFlag{
+		Name:   "s3-compression",
+		Value:  s3.CompressionNone,
+		Usage:  "compress the tarballs of the pushed S3 images: zstd (needs the zstd binary), gzip or none; they are decompressed on pull",
+		EnvVar: "ROCKER_S3_COMPRESSION",
+	}
+	buildFlags = append(buildFlags, s3LayersFlag, s3PullHelperFlag, s3CompressionFlag)
+	serverFlags = append(serverFlags, s3LayersFlag, s3PullHelperFlag, s3CompressionFlag)
 
 	app.Commands = []cli.Command{
 		{
@@ -190,6 +567,17 @@ func main() {
 			Action: buildCommand,
 			Flags:  buildFlags,
 		},
+		{
+			Name:   "rerun-step",
+			Usage:  "executes a single step on top of the cached state of the steps before it, e.g. rocker rerun-step -f Rockerfile --step 7 --attach",
+			Action: rerunStepCommand,
+			Flags: append([]cli.Flag{
+				cli.IntFlag{
+					Name:  "step",
+					Usage: "number of the instruction to execute, counting from 1",
+				},
+			}, buildFlags...),
+		},
 		{
 			Name:   "pull",
 			Usage:  "launches a pull of image (supports s3 storage driver)",
@@ -210,252 +598,2159 @@ func main() {
 					Value: "~/.rocker_cache",
 					Usage: "Set the directory where the cache will be stored",
 				},
+				cli.StringSliceFlag{
+					Name:   "registry-mirror",
+					Value:  &cli.StringSlice{},
+					Usage:  "pull the image through the mirror of its registry, e.g. docker.io=mirror.internal",
+					EnvVar: "ROCKER_REGISTRY_MIRROR",
+				},
+				s3PullHelperFlag,
 			},
 		},
-		dockerclient.InfoCommandSpec(),
-	}
-
-	app.Before = func(c *cli.Context) error {
-		initLogs(c)
-
-		if c.GlobalBool("cmd") {
-			log.Infof("rocker %s | Cmd: %s\n", HumanVersion, strings.Join(os.Args, " "))
-		}
-
-		return nil
-	}
-
-	app.CommandNotFound = func(ctx *cli.Context, command string) {
-		fmt.Printf("Command not found: %v\n", command)
-		os.Exit(1)
-	}
-
-	if err := app.Run(os.Args); err != nil {
-		fmt.Printf(err.Error())
-		os.Exit(1)
-	}
-}
-
-func buildCommand(c *cli.Context) {
-
-	var (
-		rockerfile *build.Rockerfile
-		err        error
-	)
-
-	// We don't want info level for 'print' mode
-	// So log only errors unless 'debug' is on
-	if c.Bool("print") && log.StandardLogger().Level != log.DebugLevel {
-		log.StandardLogger().Level = log.ErrorLevel
-	}
-
-	vars, err := template.VarsFromFileMulti(c.StringSlice("vars"))
-	if err != nil {
-		log.Fatal(err)
-		os.Exit(1)
-	}
-
-	cliVars, err := template.VarsFromStrings(c.StringSlice("var"))
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	vars = vars.Merge(cliVars)
-
-	if c.Bool("demand-artifacts") {
-		vars["DemandArtifacts"] = true
-	}
-
-	wd, err := os.Getwd()
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	configFilename := c.String("file")
-	contextDir := wd
-
-	if configFilename == "-" {
-
-		rockerfile, err = build.NewRockerfile(filepath.Base(wd), os.Stdin, vars, template.Funs{})
-		if err != nil {
-			log.Fatal(err)
-		}
-
-	} else {
-
-		if !filepath.IsAbs(configFilename) {
-			configFilename = filepath.Join(wd, configFilename)
-		}
-
-		rockerfile, err = build.NewRockerfileFromFile(configFilename, vars, template.Funs{})
-		if err != nil {
-			log.Fatal(err)
-		}
-
-		// Initialize context dir
-		contextDir = filepath.Dir(configFilename)
-	}
-
-	args := c.Args()
-	if len(args) > 0 {
-		contextDir = args[0]
-		if !filepath.IsAbs(contextDir) {
-			contextDir = filepath.Join(wd, args[0])
-		}
-	} else if contextDir != wd {
-		log.Warningf("Implicit context directory used: %s. You can override context directory using the last argument.", contextDir)
-	}
-
-	dir, err := os.Stat(contextDir)
-	if err != nil {
-		log.Errorf("Problem with opening directory %s, error: %s", contextDir, err)
-		os.Exit(2)
+		{
+			Name:   "push",
+			Usage:  "pushes a local image, optionally under another name (supports s3 storage driver)",
+			Action: pushCommand,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "auth, a",
+					Value: "",
+					Usage: "Username and password in user:password format",
+				},
+				cli.StringFlag{
+					Name:  "cache-dir",
+					Value: "~/.rocker_cache",
+					Usage: "Set the directory where the cache will be stored",
+				},
+				cli.IntFlag{
+					Name:  "push-retry",
+					Usage: "number of retries for failed image pushes",
+				},
+				cli.StringFlag{
+					Name:  "artifacts-path",
+					Usage: "put artifact file of the pushed image to the directory",
+				},
+				s3LayersFlag,
+				s3CompressionFlag,
+			},
+		},
+		{
+			Name:  "s3",
+			Usage: "manages the images stored on S3",
+			Subcommands: []cli.Command{
+				{
+					Name:   "ls",
+					Usage:  "lists the images stored on S3: rocker s3 ls s3.amazonaws.com/<bucket>[/<prefix>]",
+					Action: s3ListCommand,
+					Flags: []cli.Flag{
+						cli.BoolFlag{
+							Name:  "all",
+							Usage: "show the content addressable copies named by digest as well",
+						},
+					},
+				},
+				{
+					Name:   "rm",
+					Usage:  "deletes the image tags from S3, and the tarballs no other tag refers to: rocker s3 rm s3.amazonaws.com/<bucket>/<image>:<tag> [...]",
+					Action: s3RemoveCommand,
+				},
+			},
+		},
+		{
+			Name:  "artifacts",
+			Usage: "merges and validates the artifact files written with --artifacts-path, manages the artifact store of EXPORT --publish",
+			Subcommands: []cli.Command{
+				{
+					Name:   "merge",
+					Usage:  "combines the artifact files and directories into one, the same images are kept once: rocker artifacts merge <dir|file> [...] -o combined.yml",
+					Action: artifactsMergeCommand,
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "output, o",
+							Usage: "file to write the combined artifacts to, stdout by default",
+						},
+					},
+				},
+				{
+					Name:   "validate",
+					Usage:  "checks the artifact files: rocker artifacts validate <dir|file> [...]",
+					Action: artifactsValidateCommand,
+					Flags: []cli.Flag{
+						cli.BoolFlag{
+							Name:  "check-remote",
+							Usage: "check that the pushed images are present in the registry",
+						},
+						cli.StringFlag{
+							Name:  "auth, a",
+							Value: "",
+							Usage: "Username and password in user:password format",
+						},
+					},
+				},
+				{
+					Name:   "ls",
+					Usage:  "lists the artifacts published to the artifact store with EXPORT --publish",
+					Action: artifactsListCommand,
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "cache-dir",
+							Value: "~/.rocker_cache",
+							Usage: "Set the directory where the cache is stored",
+						},
+					},
+				},
+				{
+					Name:   "gc",
+					Usage:  "removes the artifacts of the artifact store that were not published or imported for a while",
+					Action: artifactsGCCommand,
+					Flags: []cli.Flag{
+						cli.DurationFlag{
+							Name:  "max-age",
+							Value: 7 * 24 * time.Hour,
+							Usage: "remove the artifacts that were not used for this long",
+						},
+						cli.StringFlag{
+							Name:  "cache-dir",
+							Value: "~/.rocker_cache",
+							Usage: "Set the directory where the cache is stored",
+						},
+					},
+				},
+			},
+		},
+		dockerclient.InfoCommandSpec(build.HelperImages),
+		{
+			Name:   "bootstrap",
+			Usage:  "pull and verify the helper images, so the first builds on the host don't stall",
+			Action: bootstrapCommand,
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "pull",
+					Usage: "pull the images even if they exist locally",
+				},
+				cli.BoolFlag{
+					Name:  "force",
+					Usage: "verify the images that were verified before, rebuild them with --rsync-binary",
+				},
+				cli.StringFlag{
+					Name:   "rsync-binary",
+					Usage:  "path to the static rsync binary, the helper images are built locally from it instead of being pulled",
+					EnvVar: "ROCKER_RSYNC_BINARY",
+				},
+				cli.StringFlag{
+					Name:  "auth, a",
+					Value: "",
+					Usage: "Username and password in user:password format",
+				},
+				cli.StringFlag{
+					Name:  "cache-dir",
+					Value: "~/.rocker_cache",
+					Usage: "Set the directory where the cache is stored, the verified images are recorded there",
+				},
+			},
+		},
+		{
+			Name:   "self-update",
+			Usage:  "updates rocker binary to the latest released version",
+			Action: selfUpdateCommand,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "channel",
+					Value: selfupdate.ChannelStable,
+					Usage: "release channel to update from, either stable or edge (includes pre-releases)",
+				},
+				cli.StringFlag{
+					Name:   "url",
+					Value:  selfupdate.DefaultURL,
+					Usage:  "url of the releases list, in the GitHub releases API format",
+					EnvVar: "ROCKER_UPDATE_URL",
+				},
+				cli.BoolFlag{
+					Name:  "force",
+					Usage: "reinstall even if the current version is the latest one",
+				},
+			},
+		},
+		{
+			Name:   "daemon",
+			Usage:  "runs the build queue server accepting builds over HTTP",
+			Action: daemonCommand,
+			Flags: append([]cli.Flag{
+				cli.StringFlag{
+					Name:  "listen",
+					Value: ":8080",
+					Usage: "address to serve the HTTP API on",
+				},
+			}, serverFlags...),
+		},
+		{
+			Name:   "serve",
+			Usage:  "runs the build queue server accepting builds over JSON-RPC, with streaming step events",
+			Action: serveCommand,
+			Flags: append([]cli.Flag{
+				cli.StringFlag{
+					Name:  "listen",
+					Value: "tcp://127.0.0.1:8081",
+					Usage: "address to serve JSON-RPC on, either tcp://host:port, unix:///path/to.sock or stdio://",
+				},
+			}, serverFlags...),
+		},
+		{
+			Name:   "lint",
+			Usage:  "checks the Rockerfile for the instructions ordering that makes the build cache ineffective",
+			Action: lintCommand,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "file, f",
+					Value: "Rockerfile",
+					Usage: "rocker build file to check",
+				},
+				cli.StringSliceFlag{
+					Name:  "var",
+					Value: &cli.StringSlice{},
+					Usage: "set variables to pass to build tasks, value is like \"key=value\"",
+				},
+				cli.StringSliceFlag{
+					Name:  "vars",
+					Value: &cli.StringSlice{},
+					Usage: "Load variables form a file, either JSON or YAML. Can pass multiple of this.",
+				},
+				cli.StringFlag{
+					Name:   "var-from-env-prefix",
+					Usage:  "import the environment variables with the prefix as variables, stripped of the prefix, e.g. ROCKER_VAR_; --vars and --var take precedence",
+					EnvVar: "ROCKER_VAR_FROM_ENV_PREFIX",
+				},
+				cli.StringFlag{
+					Name:   "policy-file",
+					Usage:  "also check the Rockerfile against the policy file",
+					EnvVar: "ROCKER_POLICY_FILE",
+				},
+			},
+		},
+		{
+			Name:   "graph",
+			Usage:  "draws the plan of the Rockerfile: the FROM sections, the cache boundaries, EXPORT/IMPORT, MOUNT, TAG and PUSH",
+			Action: graphCommand,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "file, f",
+					Value: "Rockerfile",
+					Usage: "rocker build file to draw",
+				},
+				cli.StringFlag{
+					Name:  "output, o",
+					Usage: "write the graph to the file instead of stdout",
+				},
+				cli.StringFlag{
+					Name:  "format",
+					Usage: "dot or mermaid, by default guessed by the extension of --output (.mmd or .mermaid), otherwise dot",
+				},
+				cli.StringSliceFlag{
+					Name:  "var",
+					Value: &cli.StringSlice{},
+					Usage: "set variables to pass to build tasks, value is like \"key=value\"",
+				},
+				cli.StringSliceFlag{
+					Name:  "vars",
+					Value: &cli.StringSlice{},
+					Usage: "Load variables form a file, either JSON or YAML. Can pass multiple of this.",
+				},
+				cli.StringFlag{
+					Name:   "var-from-env-prefix",
+					Usage:  "import the environment variables with the prefix as variables, stripped of the prefix, e.g. ROCKER_VAR_; --vars and --var take precedence",
+					EnvVar: "ROCKER_VAR_FROM_ENV_PREFIX",
+				},
+				cli.BoolFlag{
+					Name:  "auto-batch",
+					Usage: "draw the commits of the plan with --auto-batch",
+				},
+			},
+		},
+		{
+			Name:   "verify",
+			Usage:  "checks that the image built with --record-vars could have been produced by the Rockerfile",
+			Action: verifyCommand,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "file, f",
+					Value: "Rockerfile",
+					Usage: "rocker build file to check the image against",
+				},
+				cli.StringSliceFlag{
+					Name:  "var",
+					Value: &cli.StringSlice{},
+					Usage: "override the recorded variables or set the ones not recorded, value is like \"key=value\"",
+				},
+				cli.StringSliceFlag{
+					Name:  "vars",
+					Value: &cli.StringSlice{},
+					Usage: "Load variables form a file, either JSON or YAML. Can pass multiple of this.",
+				},
+				cli.StringFlag{
+					Name:   "var-from-env-prefix",
+					Usage:  "import the environment variables with the prefix as variables, stripped of the prefix, e.g. ROCKER_VAR_; --vars and --var take precedence",
+					EnvVar: "ROCKER_VAR_FROM_ENV_PREFIX",
+				},
+			},
+		},
+		{
+			Name:   "clean",
+			Usage:  "removes the images left by the builds",
+			Action: cleanCommand,
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "intermediates",
+					Usage: "remove the untagged images committed by rocker, whichever build made them",
+				},
+				cli.BoolFlag{
+					Name:  "dry-run",
+					Usage: "only list the images that would be removed",
+				},
+			},
+		},
+		{
+			Name:   "cache-gc",
+			Usage:  "untags the cache images made with --cache-repo that were not used for a while",
+			Action: cacheGCCommand,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "cache-repo",
+					Usage: "repository of the cache tags",
+				},
+				cli.DurationFlag{
+					Name:  "max-age",
+					Value: 7 * 24 * time.Hour,
+					Usage: "untag the cache images that were not used for this long",
+				},
+				cli.StringFlag{
+					Name:  "cache-dir",
+					Value: "~/.rocker_cache",
+					Usage: "Set the directory where the cache will be stored",
+				},
+			},
+		},
+		{
+			Name:  "cache",
+			Usage: "moves the build cache between hosts",
+			Subcommands: []cli.Command{
+				{
+					Name:   "export",
+					Usage:  "writes the cache entries and the images they refer to into the archive: rocker cache export cache.tgz",
+					Action: cacheExportCommand,
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "cache-dir",
+							Value: "~/.rocker_cache",
+							Usage: "Set the directory where the cache is stored",
+						},
+					},
+				},
+				{
+					Name:   "import",
+					Usage:  "restores the cache made by 'rocker cache export' on this host: rocker cache import cache.tgz",
+					Action: cacheImportCommand,
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "cache-dir",
+							Value: "~/.rocker_cache",
+							Usage: "Set the directory where the cache is stored",
+						},
+					},
+				},
+			},
+		},
+		{
+			Name:  "completion",
+			Usage: "generates shell completion script, e.g. 'rocker completion bash'; supports " + strings.Join(completion.Shells, ", "),
+			Action: func(c *cli.Context) {
+				completionCommand(c, app)
+			},
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "list-images",
+					Usage: "list local images, used by the completion scripts",
+				},
+			},
+		},
+	}
+
+	app.Before = func(c *cli.Context) error {
+		if err := initLogs(c); err != nil {
+			return err
+		}
+
+		if c.GlobalBool("cmd") {
+			log.Infof("rocker %s | Cmd: %s\n", HumanVersion, strings.Join(os.Args, " "))
+		}
+
+		if err := util.SetTempDir(c.GlobalString("tmp-dir")); err != nil {
+			return err
+		}
+		sweepTempFiles()
+
+		util.SetLockTimeout(c.GlobalDuration("cache-lock-timeout"))
+		util.SetOffline(c.GlobalBool("offline"))
+
+		if s := c.GlobalString("chown-output"); s != "" {
+			owner, err := util.ParseOwner(s)
+			if err != nil {
+				return err
+			}
+			util.SetOutputOwner(owner)
+		}
+
+		if c.GlobalString("rsync-image") != "" {
+			build.RsyncImage = c.GlobalString("rsync-image")
+		}
+		if c.GlobalString("scratch-image") != "" {
+			build.MountVolumeImage = c.GlobalString("scratch-image")
+		}
+
+		return build.ValidateHelperImages()
+	}
+
+	app.After = func(c *cli.Context) (err error) {
+		deprecation.PrintSummary()
+		if n := len(deprecation.Warnings()); n > 0 && c.GlobalBool("warnings-as-errors") {
+			err = fmt.Errorf("%d deprecation warning(s) raised (--warnings-as-errors)", n)
+		}
+
+		if logSinks != nil {
+			if err2 := logSinks.Close(); err == nil {
+				err = err2
+			}
+		}
+		return err
+	}
+
+	app.CommandNotFound = func(ctx *cli.Context, command string) {
+		fmt.Printf("Command not found: %v\n", command)
+		os.Exit(1)
+	}
+
+	if err := app.Run(os.Args); err != nil {
+		fmt.Printf(err.Error())
+		os.Exit(1)
+	}
+}
+
+func buildCommand(c *cli.Context) {
+
+	var (
+		source []byte
+		err    error
+	)
+
+	// We don't want info level for 'print' mode
+	// So log only errors unless 'debug' is on
+	if c.Bool("print") && log.StandardLogger().Level != log.DebugLevel {
+		log.StandardLogger().Level = log.ErrorLevel
+	}
+
+	vars, err := template.VarsFromFileMulti(c.StringSlice("vars"))
+	if err != nil {
+		log.Fatal(err)
+		os.Exit(1)
+	}
+	vars = envVars(c).Merge(vars)
+
+	cliVars, err := template.VarsFromStrings(c.StringSlice("var"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	vars = vars.Merge(cliVars)
+
+	if c.Bool("demand-artifacts") {
+		vars["DemandArtifacts"] = true
+	}
+
+	if c.String("base") != "" {
+		if c.String("from-override") != "" {
+			log.Fatal("--base and --from-override cannot be used together")
+		}
+		vars["BaseOverride"] = c.String("base")
+	}
+
+	initDigestResolver(c)
+	initVarPrompt(c)
+
+	// The context archive on S3 is fetched before the Rockerfile is rendered,
+	// since the Rockerfile is looked up in it and its digest is a var
+	s3ContextDir := ""
+	if args := c.Args(); len(args) > 0 && s3.IsContextURL(args[0]) {
+		var digest string
+		if s3ContextDir, digest, err = fetchS3Context(c, args[0]); err != nil {
+			log.Fatal(err)
+		}
+		vars["ContextDigest"] = digest
+	} else if c.String("context-digest") != "" {
+		log.Fatal("--context-digest is only supported with the build context on S3, s3://<bucket>/<key>")
+	}
+
+	// Every matrix combination is a separate build, or just one build if no matrix given;
+	// the labels name the combinations by their matrix keys only, not by all the vars
+	var (
+		variants      = []template.Vars{vars}
+		variantLabels = []string{""}
+	)
+
+	if c.String("matrix") != "" {
+		matrix, err := template.MatrixFromFile(c.String("matrix"))
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		variants, variantLabels = []template.Vars{}, []string{}
+		for _, combination := range matrix.Expand() {
+			variants = append(variants, template.Vars{}.Merge(vars, combination))
+			variantLabels = append(variantLabels, template.MatrixLabel(combination))
+		}
+	}
+
+	wd, err := os.Getwd()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	configFilename := c.String("file")
+	rockerfileName := filepath.Base(wd)
+	contextDir := wd
+
+	if configFilename == "-" {
+
+		if source, err = ioutil.ReadAll(os.Stdin); err != nil {
+			log.Fatal(err)
+		}
+
+	} else {
+
+		if !filepath.IsAbs(configFilename) {
+			if s3ContextDir != "" {
+				configFilename = filepath.Join(s3ContextDir, configFilename)
+			} else {
+				configFilename = filepath.Join(wd, configFilename)
+			}
+		}
+
+		if source, err = ioutil.ReadFile(configFilename); err != nil {
+			log.Fatal(err)
+		}
+
+		// Initialize context dir
+		rockerfileName = configFilename
+		contextDir = filepath.Dir(configFilename)
+	}
+
+	rockerfiles := make([]*build.Rockerfile, len(variants))
+	for i, variantVars := range variants {
+		if rockerfiles[i], err = build.NewRockerfile(rockerfileName, bytes.NewReader(source), variantVars, template.Funs{}); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	cliVarNames := []string{}
+	for name := range cliVars {
+		cliVarNames = append(cliVarNames, name)
+	}
+	sort.Strings(cliVarNames)
+
+	if c.String("base") != "" && len(rockerfiles[0].UnusedVars([]string{"BaseOverride"})) > 0 {
+		log.Fatal("--base is given, but the Rockerfile does not use {{ .BaseOverride }}, use --from-override to replace its first FROM")
+	}
+
+	for _, name := range rockerfiles[0].UnusedVars(cliVarNames) {
+		if c.Bool("strict") {
+			log.Fatalf("Variable %s is not used by the Rockerfile (strict mode)", name)
+		}
+		log.Warningf("Variable %s is not used by the Rockerfile", name)
+	}
+
+	args := c.Args()
+	if s3ContextDir != "" {
+		contextDir = s3ContextDir
+	} else if len(args) > 0 {
+		contextDir = args[0]
+		if !filepath.IsAbs(contextDir) {
+			contextDir = filepath.Join(wd, args[0])
+		}
+	} else if contextDir != wd {
+		if c.Bool("strict") {
+			log.Fatalf("Implicit context directory used: %s, pass the context directory as the last argument (strict mode)", contextDir)
+		}
+		deprecation.Warn(deprecation.ImplicitContextDir, contextDir)
+	}
+
+	dir, err := os.Stat(contextDir)
+	if err != nil {
+		log.Errorf("Problem with opening directory %s, error: %s", contextDir, err)
+		os.Exit(2)
+	}
+	if !dir.IsDir() {
+		log.Errorf("Context directory %s is not a directory.", contextDir)
+		os.Exit(2)
+
+	}
+	log.Debugf("Context directory: %s", contextDir)
+
+	if c.Bool("print") {
+		for i, rockerfile := range rockerfiles {
+			if len(rockerfiles) > 1 {
+				fmt.Printf("# matrix: %s\n", variantLabels[i])
+			}
+			if c.Bool("annotate") {
+				fmt.Print(rockerfile.Annotated())
+			} else {
+				fmt.Print(rockerfile.Content)
+			}
+		}
+		util.CleanupTempFiles()
+		os.Exit(0)
+	}
+
+	dockerignore := []string{}
+
+	dockerignoreFilename := filepath.Join(contextDir, ".dockerignore")
+	if _, err := os.Stat(dockerignoreFilename); err == nil {
+		if dockerignore, err = build.ReadDockerignoreFile(dockerignoreFilename); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	checkOutputPaths(c)
+
+	if c.String("builder") != "" {
+		if len(rockerfiles) > 1 {
+			log.Fatal("--matrix is not supported with --builder")
+		}
+		if c.String("save-context-snapshot") != "" || c.String("provenance") != "" {
+			log.Fatal("--save-context-snapshot and --provenance are not supported with --builder")
+		}
+		if c.String("publish-channel") != "" || c.String("from-override") != "" || c.String("copy-stdin") != "" || c.String("shell") != "" {
+			log.Fatal("--publish-channel, --from-override, --copy-stdin and --shell are not supported with --builder")
+		}
+		remoteBuild(c, rockerfiles[0], contextDir, dockerignore)
+		return
+	}
+
+	if (c.String("save-context-snapshot") != "" || c.String("provenance") != "") && len(rockerfiles) > 1 {
+		log.Fatal("--save-context-snapshot and --provenance are not supported with --matrix")
+	}
+	if c.Bool("provenance-s3") && c.String("provenance") == "" {
+		log.Fatal("--provenance-s3 requires --provenance")
+	}
+
+	projectConfig, err := build.ReadProjectConfig(contextDir)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// The helper images given by the flags or env take precedence over .rocker.yml
+	projectConfig.HelperImages.Apply()
+	if c.GlobalString("rsync-image") != "" {
+		build.RsyncImage = c.GlobalString("rsync-image")
+	}
+	if c.GlobalString("scratch-image") != "" {
+		build.MountVolumeImage = c.GlobalString("scratch-image")
+	}
+
+	mirrors, err := imagename.ParseMirrors(c.StringSlice("registry-mirror"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	pushMirrors, err := imagename.ParsePushMirrors(c.StringSlice("mirror-push"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var config *dockerclient.Config
+	config = dockerclient.NewConfigFromCli(c)
+
+	dockerClient, err := dockerclient.NewFromConfig(config)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	cacheDir, err := util.MakeAbsolute(c.String("cache-dir"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var (
+		stdoutContainerFormatter log.Formatter = textformatter.NewJSONFormatter()
+		stderrContainerFormatter log.Formatter = textformatter.NewJSONFormatter()
+	)
+	if !c.GlobalBool("json") {
+		stdoutContainerFormatter = build.NewMonochromeContainerFormatter()
+		stderrContainerFormatter = build.NewColoredContainerFormatter()
+	}
+
+	s3storage := newS3Storage(c, dockerClient, cacheDir)
+	tagCache := newTagCache(c, cacheDir)
+
+	options := build.DockerClientOptions{
+		Client:                   dockerClient,
+		Auth:                     initAuth(c),
+		Log:                      log.StandardLogger(),
+		S3storage:                s3storage,
+		StdoutContainerFormatter: stdoutContainerFormatter,
+		StderrContainerFormatter: stderrContainerFormatter,
+		PushRetryCount:           c.Int("push-retry"),
+		Host:                     config.Host,
+		LogExactSizes:            c.GlobalBool("json"),
+		Timeout:                  config.Timeout,
+		CommitTimeout:            config.CommitTimeout,
+		Retries:                  config.Retries,
+		PullTimeout:              config.PullTimeout,
+		PullRetries:              config.PullRetries,
+		LogPullProgress:          c.GlobalBool("json"),
+		CommitNoPause:            c.Bool("commit-no-pause"),
+		CgroupParent:             c.String("cgroup-parent"),
+		MaxStepLogBytes:          maxStepLogBytes(c),
+		TagCache:                 tagCache,
+	}
+	client := build.NewDockerClient(options)
+
+	var cache build.Cache
+	if !c.Bool("no-cache") {
+		cache = build.NewCacheFS(cacheDir, hashAlgorithm(c))
+
+		if c.String("cache-repo") != "" || len(c.StringSlice("cache-from")) > 0 {
+			cache = build.NewCacheTags(client, build.CacheTagsOptions{
+				Repo:     c.String("cache-repo"),
+				From:     c.StringSlice("cache-from"),
+				Push:     c.Bool("cache-push"),
+				Inner:    cache,
+				IndexDir: filepath.Join(cacheDir, "tags"),
+			})
+		}
+	}
+
+	buildConfig := build.Config{
+		InStream:      os.Stdin,
+		OutStream:     os.Stdout,
+		ContextDir:    contextDir,
+		Dockerignore:  dockerignore,
+		ArtifactsPath: c.String("artifacts-path"),
+		Pull:          c.Bool("pull"),
+		NoGarbage:     c.Bool("no-garbage"),
+		Attach:        c.Bool("attach"),
+		Verbose:       c.GlobalBool("verbose"),
+		ID:            c.String("id"),
+		NoCache:       c.Bool("no-cache"),
+		ReloadCache:   c.Bool("reload-cache"),
+		Push:          c.Bool("push"),
+		CacheDir:      cacheDir,
+		LogJSON:       c.GlobalBool("json"),
+		BuildArgs:     runconfigopts.ConvertKVStringsToMap(c.StringSlice("build-arg")),
+
+		ExplainCacheMiss: c.Bool("explain-cache-miss"),
+		ConfigDiff:       c.Bool("config-diff"),
+		Hooks:            projectConfig.Hooks,
+		AutoBatch:        c.Bool("auto-batch"),
+		SkipNoopCommits:  c.Bool("skip-noop-commits"),
+		DedupeCopy:       c.Bool("dedupe-copy"),
+		NoReuse:          c.Bool("no-reuse"),
+		ArgsFileMount:    c.Bool("args-file-mount"),
+		FailOnSecrets:    c.Bool("fail-on-secrets"),
+		Strict:           c.Bool("strict"),
+		MinFreeSpace:     minFreeSpace(c),
+		MaxContextSize:   maxContextSize(c),
+		ContextSizeWarn:  c.Bool("max-context-size-warn"),
+		Prefetch:         !c.Bool("no-prefetch"),
+		RegistryMirrors:  projectConfig.Mirrors.Merge(mirrors),
+		PushMirrors:      projectConfig.MirrorPush.Merge(pushMirrors),
+		Sandbox:          sandbox(c),
+		Hash:             hashAlgorithm(c),
+		Policy:           policy(c),
+		PublishChannel:   publishChannel(c, projectConfig),
+		FromOverride:     c.String("from-override"),
+		CopyStdin:        copyStdin(c),
+		Shell:            shell(c, projectConfig),
+
+		SnapshotOnFailure: c.String("snapshot-on-failure"),
+
+		RecordBuildArgs:      c.Bool("record-build-args") || len(c.StringSlice("record-build-arg-value")) > 0,
+		RecordBuildArgValues: c.StringSlice("record-build-arg-value"),
+		RecordVars:           c.Bool("record-vars"),
+
+		RerunStep: c.Int("step"),
+	}
+
+	// The step fields of the log sinks make sense for a single build only
+	if logSinks != nil && len(rockerfiles) == 1 {
+		buildConfig.OnStep = logSinks.OnStep
+	}
+
+	// Check the docker connection before we actually run
+	if err := dockerclient.Ping(dockerClient, 5000); err != nil {
+		log.Fatal(err)
+	}
+
+	if len(rockerfiles) == 1 {
+		var snapshot *build.ContextSnapshot
+		if fileName := c.String("save-context-snapshot"); fileName != "" {
+			if snapshot, err = build.NewContextSnapshot(fileName, contextDir, dockerignore, rockerfiles[0]); err != nil {
+				log.Fatal(err)
+			}
+		}
+
+		// The context is hashed before the build, MOUNTs may change it
+		var contextDigest string
+		if c.String("provenance") != "" {
+			if contextDigest, err = build.ContextDigest(contextDir, dockerignore, buildConfig.Hash); err != nil {
+				log.Fatal(err)
+			}
+		}
+
+		builder, err := runBuild(client, rockerfiles[0], cache, buildConfig)
+		util.CleanupTempFiles()
+
+		if snapshot != nil {
+			provenance := build.NewProvenance(builder, err)
+			provenance.RockerVersion = HumanVersion
+			if err := snapshot.Finish(provenance); err != nil {
+				log.Fatal(err)
+			}
+			log.Infof("Saved context snapshot to %s", c.String("save-context-snapshot"))
+		}
+
+		if err != nil {
+			log.Fatal(err)
+		}
+		if buildConfig.RerunStep > 0 {
+			return
+		}
+		if c.String("provenance") != "" {
+			if err := writeProvenance(c, builder, contextDigest, s3storage); err != nil {
+				log.Fatal(err)
+			}
+		}
+		logBuildSuccess(c, builder, log.Fields{})
+		logS3PushStats(s3storage)
+		logTagCacheStats(tagCache)
+		return
+	}
+
+	if c.Int("matrix-parallel") > 1 {
+		if buildConfig.Scheduler, err = newScheduler(c, dockerClient); err != nil {
+			log.Fatal(err)
+		}
+		log.Infof("Scheduling the RUN containers of the matrix builds for %s", buildConfig.Scheduler)
+	}
+
+	err = runMatrixBuild(c, client, rockerfiles, variantLabels, cache, buildConfig)
+	util.CleanupTempFiles()
+
+	if err != nil {
+		log.Fatal(err)
+	}
+	logS3PushStats(s3storage)
+	logTagCacheStats(tagCache)
+}
+
+// checkOutputPaths fails before the build starts if any of its output
+// locations can not be written, e.g. the cache dir is on a read-only volume;
+// otherwise the build would fail only when it is over
+func checkOutputPaths(c *cli.Context) {
+	check := func(flag string, isDir bool) {
+		if c.String(flag) == "" {
+			return
+		}
+		path, err := util.MakeAbsolute(c.String(flag))
+		if err == nil && isDir {
+			err = util.CheckWritableDir(path)
+		} else if err == nil {
+			err = util.CheckWritableFile(path)
+		}
+		if err != nil {
+			log.Fatalf("Cannot write to --%s %s, error: %s", flag, c.String(flag), err)
+		}
+	}
+
+	check("artifacts-path", true)
+	if c.String("builder") == "" {
+		check("cache-dir", true)
+	}
+	for _, flag := range []string{"provenance", "save-context-snapshot", "matrix-artifacts"} {
+		check(flag, false)
+	}
+}
+
+// writeProvenance writes the SLSA provenance of the build to the --provenance
+// file, and uploads it next to the images pushed to S3 with --provenance-s3
+func writeProvenance(c *cli.Context, builder *build.Build, contextDigest string, storage *s3.StorageS3) error {
+	provenance, err := build.NewProvenanceStatement(builder, HumanVersion, contextDigest)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(provenance, "", "  ")
+	if err != nil {
+		return fmt.Errorf("Failed to marshal provenance, error: %s", err)
+	}
+	data = append(data, '\n')
+
+	fileName := c.String("provenance")
+	if err := util.WriteOutputFile(fileName, data, 0644); err != nil {
+		return fmt.Errorf("Failed to write provenance %s, error: %s", fileName, err)
+	}
+	log.Infof("Saved provenance to %s", fileName)
+
+	if !c.Bool("provenance-s3") {
+		return nil
+	}
+	for _, artifact := range builder.Artifacts {
+		if artifact.Pushed && artifact.Name.Storage == imagename.StorageS3 {
+			if err := storage.PushProvenance(artifact.Name.String(), data); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// logS3PushStats reports the sizes of the S3 layers uploaded and reused by the build
+func logS3PushStats(storage *s3.StorageS3) {
+	if stats := storage.PushStats(); stats.Uploaded+stats.Reused > 0 {
+		log.Infof("S3 push: %s", stats)
+	}
+}
+
+// newTagCache makes the registry tag cache in the cache dir, if --registry-cache-ttl is given
+func newTagCache(c *cli.Context, cacheDir string) *build.TagCache {
+	ttl := c.GlobalDuration("registry-cache-ttl")
+	if ttl <= 0 {
+		return nil
+	}
+	return build.NewTagCache(filepath.Join(cacheDir, "registry"), ttl)
+}
+
+// logTagCacheStats reports the hit rate of the registry tag cache
+func logTagCacheStats(cache *build.TagCache) {
+	if cache == nil {
+		return
+	}
+	if stats := cache.Stats(); stats.Hits+stats.Misses > 0 {
+		log.WithFields(log.Fields{
+			"registry_cache_hits":   stats.Hits,
+			"registry_cache_misses": stats.Misses,
+		}).Infof("Registry cache: %s", stats)
+	}
+}
+
+// fetchS3Context downloads the build context archive from S3 and unpacks it
+// to a temp dir, which is removed when the build finishes; gives the dir
+// and the digest of the archive
+func fetchS3Context(c *cli.Context, url string) (dir, digest string, err error) {
+	cacheDir, err := util.MakeAbsolute(c.String("cache-dir"))
+	if err != nil {
+		return "", "", err
+	}
+
+	// The docker client is not needed to fetch the context
+	fileName, digest, err := newS3Storage(c, nil, cacheDir).FetchContext(url, c.String("context-digest"))
+	if err != nil {
+		return "", "", err
+	}
+
+	if dir, err = util.MkTempDir("rocker_context_"); err != nil {
+		return "", "", err
+	}
+
+	// The Rockerfile is read from the context, it should be there even if .dockerignore excludes it
+	keep := []string{}
+	if file := c.String("file"); file != "-" && !filepath.IsAbs(file) {
+		keep = append(keep, file)
+	}
+
+	if _, err := build.ExtractContext(fileName, dir, keep...); err != nil {
+		util.RemoveTempFile(dir)
+		return "", "", err
+	}
+
+	log.Infof("Unpacked build context %s (%s) to %s", url, digest, dir)
+
+	return dir, digest, nil
+}
+
+func newS3Storage(c *cli.Context, client *docker.Client, cacheDir string) *s3.StorageS3 {
+	storage := s3.New(client, cacheDir)
+	storage.Layers = c.Bool("s3-layers")
+	storage.PullHelper = c.String("s3-pull-helper")
+
+	compression, err := s3.ParseCompression(c.String("s3-compression"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	storage.Compression = compression
+
+	return storage
+}
+
+// rerunStepCommand executes a single step of the Rockerfile the same way
+// buildCommand would, with the steps before it taken from the cache
+func rerunStepCommand(c *cli.Context) {
+	if c.Int("step") < 1 {
+		log.Fatal("rocker rerun-step --step <number> [-f Rockerfile]")
+	}
+	if c.Bool("no-cache") {
+		log.Fatal("--no-cache is not supported with rerun-step, the steps before the given one are taken from the cache")
+	}
+	if c.String("builder") != "" || c.String("matrix") != "" || c.String("save-context-snapshot") != "" {
+		log.Fatal("--builder, --matrix and --save-context-snapshot are not supported with rerun-step")
+	}
+
+	buildCommand(c)
+}
+
+// remoteBuild runs the build on the builder given by --builder
+func remoteBuild(c *cli.Context, rockerfile *build.Rockerfile, contextDir string, dockerignore []string) {
+	// The Rockerfile is sent as is and rendered on the builder, the name matters
+	// only for the builds identification, so keep it relative to the context
+	file := "Rockerfile"
+	if rel, err := filepath.Rel(contextDir, rockerfile.Name); err == nil && !strings.HasPrefix(rel, "..") && filepath.IsAbs(rockerfile.Name) {
+		file = rel
+	}
+
+	job, err := remote.Build(remote.Config{
+		Builder:       c.String("builder"),
+		ContextDir:    contextDir,
+		Dockerignore:  dockerignore,
+		OutStream:     os.Stdout,
+		ArtifactsPath: c.String("artifacts-path"),
+		Request: server.BuildRequest{
+			File:      file,
+			Source:    rockerfile.Source,
+			Vars:      remote.RequestVars(rockerfile.Vars),
+			BuildArgs: runconfigopts.ConvertKVStringsToMap(c.StringSlice("build-arg")),
+			Push:      c.Bool("push"),
+			NoCache:   c.Bool("no-cache"),
+			Pull:      c.Bool("pull"),
+			AutoBatch: c.Bool("auto-batch"),
+			Strict:    c.Bool("strict"),
+
+			SkipNoopCommits:   c.Bool("skip-noop-commits"),
+			DedupeCopy:        c.Bool("dedupe-copy"),
+			NoReuse:           c.Bool("no-reuse"),
+			ArgsFileMount:     c.Bool("args-file-mount"),
+			FailOnSecrets:     c.Bool("fail-on-secrets"),
+			SnapshotOnFailure: c.String("snapshot-on-failure"),
+
+			RecordBuildArgs:      c.Bool("record-build-args"),
+			RecordBuildArgValues: c.StringSlice("record-build-arg-value"),
+			RecordVars:           c.Bool("record-vars"),
+		},
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	log.Infof("Successfully built %.12s on %s", job.ImageID, c.String("builder"))
+}
+
+// runBuild runs the build of a single Rockerfile; the builder is returned
+// even if the build fails, so what it has done can be reported
+func runBuild(client build.Client, rockerfile *build.Rockerfile, cache build.Cache, cfg build.Config) (*build.Build, error) {
+	builder := build.New(client, rockerfile, cache, cfg)
+
+	plan, err := build.NewPlan(rockerfile.Commands(), true, cfg.AutoBatch)
+	if err != nil {
+		return builder, err
+	}
+
+	if err := builder.Run(plan); err != nil {
+		return builder, err
+	}
+
+	return builder, nil
+}
+
+// runMatrixBuild runs the builds of the Rockerfile rendered with every matrix combination,
+// optionally in parallel, and saves the combined artifacts file; labels are the
+// combinations of the Rockerfiles
+func runMatrixBuild(c *cli.Context, client build.Client, rockerfiles []*build.Rockerfile, labels []string, cache build.Cache, cfg build.Config) error {
+	parallel := c.Int("matrix-parallel")
+	if parallel < 1 {
+		return fmt.Errorf("--matrix-parallel should be at least 1, got %d", parallel)
+	}
+
+	var (
+		sem      = make(chan struct{}, parallel)
+		errs     = make([]error, len(rockerfiles))
+		builders = make([]*build.Build, len(rockerfiles))
+		wg       sync.WaitGroup
+	)
+
+	for i, rockerfile := range rockerfiles {
+		wg.Add(1)
+		sem <- struct{}{}
+
+		go func(i int, rockerfile *build.Rockerfile) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+
+			label := labels[i]
+			log.Infof("Matrix build %d/%d: %s", i+1, len(rockerfiles), label)
+
+			if builders[i], errs[i] = runBuild(client, rockerfile, cache, cfg); errs[i] != nil {
+				log.WithFields(log.Fields{"matrix": label}).Errorf("Matrix build %d/%d failed: %s", i+1, len(rockerfiles), errs[i])
+				return
+			}
+
+			logBuildSuccess(c, builders[i], log.Fields{"matrix": label})
+		}(i, rockerfile)
+	}
+
+	wg.Wait()
+
+	artifacts := imagename.Artifacts{}
+	failed := 0
+
+	for i := range rockerfiles {
+		if errs[i] != nil {
+			failed++
+			continue
+		}
+		artifacts.RockerArtifacts = append(artifacts.RockerArtifacts, builders[i].Artifacts...)
+	}
+
+	if file := c.String("matrix-artifacts"); file != "" {
+		content, err := yaml.Marshal(artifacts)
+		if err != nil {
+			return err
+		}
+		if err := util.WriteOutputFile(file, content, 0644); err != nil {
+			return fmt.Errorf("Failed to write matrix artifacts file %s, error: %s", file, err)
+		}
+		log.Infof("Saved matrix artifacts file %s", file)
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d matrix builds failed", failed, len(rockerfiles))
+	}
+
+	return nil
+}
+
+func logBuildSuccess(c *cli.Context, builder *build.Build, fields log.Fields) {
+	if c.GlobalBool("json") {
+		fields["size"] = builder.VirtualSize
+		fields["delta"] = builder.ProducedSize
+		fields["cache"] = builder.CacheStats
+		fields["commit"] = builder.CommitDuration
+		if verdicts := builder.BaseDigestVerdicts(); len(verdicts) > 0 {
+			fields["base_digests"] = verdicts
+		}
+	} else {
+		if stats := builder.CacheStats; stats.Hits+stats.Misses > 0 {
+			log.WithFields(fields).Infof("| Cache: %s", stats)
+		}
+		if builder.CommitDuration > 0 {
+			log.WithFields(fields).Infof("| Commits took %.1fs", builder.CommitDuration.Seconds())
+		}
+	}
+
+	size := fmt.Sprintf("final size %s (+%s from the base image)",
+		units.HumanSize(float64(builder.VirtualSize)),
+		units.HumanSize(float64(builder.ProducedSize)),
+	)
+
+	log.WithFields(fields).Infof("Successfully built %.12s | %s", builder.GetImageID(), size)
+}
+
+// newImageClient makes the client for the pull and push commands
+func newImageClient(c *cli.Context) *build.DockerClient {
+	config := dockerclient.NewConfigFromCli(c)
+
+	dockerClient, err := dockerclient.NewFromConfig(config)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	cacheDir, err := util.MakeAbsolute(c.String("cache-dir"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	return build.NewDockerClient(build.DockerClientOptions{
+		Client:                   dockerClient,
+		Auth:                     initAuth(c),
+		Log:                      log.StandardLogger(),
+		S3storage:                newS3Storage(c, dockerClient, cacheDir),
+		StdoutContainerFormatter: log.StandardLogger().Formatter,
+		StderrContainerFormatter: log.StandardLogger().Formatter,
+		PushRetryCount:           c.Int("push-retry"),
+		Timeout:                  config.Timeout,
+		CommitTimeout:            config.CommitTimeout,
+		Retries:                  config.Retries,
+		PullTimeout:              config.PullTimeout,
+		PullRetries:              config.PullRetries,
+		TagCache:                 newTagCache(c, cacheDir),
+	})
+}
+
+func pullCommand(c *cli.Context) {
+	args := c.Args()
+	if len(args) < 1 {
+		log.Fatal("rocker pull <image>")
+	}
+
+	client := newImageClient(c)
+
+	mirrors, err := imagename.ParseMirrors(c.StringSlice("registry-mirror"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	name := args[0]
+	if mirrored, ok := mirrors.Rewrite(imagename.NewFromString(name)); ok {
+		log.Infof("Rewrite %s -> %s (registry mirror)", name, mirrored)
+		name = mirrored.String()
+	}
+
+	if err := client.PullImage(name); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func bootstrapCommand(c *cli.Context) {
+	cacheDir, err := util.MakeAbsolute(c.String("cache-dir"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// The helper images of .rocker.yml in the current directory are bootstrapped,
+	// the ones given by the flags or env take precedence as with build
+	projectConfig, err := build.ReadProjectConfig(".")
+	if err != nil {
+		log.Fatal(err)
+	}
+	projectConfig.HelperImages.Apply()
+	if c.GlobalString("rsync-image") != "" {
+		build.RsyncImage = c.GlobalString("rsync-image")
+	}
+	if c.GlobalString("scratch-image") != "" {
+		build.MountVolumeImage = c.GlobalString("scratch-image")
+	}
+
+	options := build.BootstrapOptions{
+		CacheDir:    cacheDir,
+		Pull:        c.Bool("pull"),
+		Force:       c.Bool("force"),
+		RsyncBinary: c.String("rsync-binary"),
+	}
+
+	if err := build.Bootstrap(newImageClient(c), options); err != nil {
+		log.Fatal(err)
+	}
+
+	log.Infof("Helper images are ready")
+}
+
+// pushCommand pushes a local image, e.g. the one that is not built by rocker,
+// optionally under another name, the same way PUSH does; with the S3 image
+// names it is the way to mirror images to S3
+func pushCommand(c *cli.Context) {
+	args := c.Args()
+	if len(args) < 1 || len(args) > 2 {
+		log.Fatal("rocker push <image> [<target>]")
+	}
+
+	client := newImageClient(c)
+
+	img, err := client.InspectImage(args[0])
+	if err != nil {
+		log.Fatal(err)
+	}
+	if img == nil {
+		log.Fatalf("Image %s not found locally", args[0])
+	}
+
+	target := imagename.NewFromString(args[0])
+	if len(args) == 2 {
+		target = imagename.NewFromString(args[1])
+		if err := client.TagImage(img.ID, target.String()); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	digest, err := client.PushImage(target.String())
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	artifact := imagename.Artifact{
+		Name:      target,
+		Pushed:    true,
+		Tag:       target.GetTag(),
+		ImageID:   img.ID,
+		BuildTime: time.Now(),
+		Size:      img.VirtualSize,
+	}
+	artifact.SetDigest(digest)
+
+	if dir := c.String("artifacts-path"); dir != "" {
+		filePath, err := build.WriteArtifact(dir, artifact)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Infof("Saved artifact file %s", filePath)
+	}
+
+	log.Infof("Successfully pushed %.12s as %s (%s)", img.ID, target, artifact.Digest)
+}
+
+func s3ListCommand(c *cli.Context) {
+	if len(c.Args()) != 1 {
+		log.Fatal("rocker s3 ls s3.amazonaws.com/<bucket>[/<prefix>]")
+	}
+
+	bucket, prefix, err := s3.ParseLocation(c.Args()[0])
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	objects, err := s3.New(nil, "").List(bucket, prefix, c.Bool("all"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tTAG\tDIGEST\tIMAGE ID\tSIZE\tUPLOADED")
+	for _, o := range objects {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%.12s\t%s\t%s\n", o.Name, o.Tag, o.Digest, o.ImageID,
+			units.HumanSize(float64(o.Size)), o.Uploaded.Local().Format("2006-01-02 15:04:05"))
+	}
+	w.Flush()
+}
+
+func s3RemoveCommand(c *cli.Context) {
+	if len(c.Args()) == 0 {
+		log.Fatal("rocker s3 rm s3.amazonaws.com/<bucket>/<image>:<tag> [...]")
+	}
+
+	storage := s3.New(nil, "")
+
+	for _, name := range c.Args() {
+		removed, err := storage.Delete(name)
+		for _, r := range removed {
+			log.Infof("Deleted %s", r)
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+func lintCommand(c *cli.Context) {
+	vars, err := template.VarsFromFileMulti(c.StringSlice("vars"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	vars = envVars(c).Merge(vars)
+
+	cliVars, err := template.VarsFromStrings(c.StringSlice("var"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	initDigestResolver(c)
+
+	rockerfile, err := build.NewRockerfileFromFile(c.String("file"), vars.Merge(cliVars), template.Funs{})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	warnings := build.Lint(rockerfile.Commands())
+	for _, w := range warnings {
+		log.Warn(w)
+	}
+
+	var violations []build.PolicyViolation
+	if p := policy(c); p != nil {
+		violations = p.Check(rockerfile.Commands())
+		for _, v := range violations {
+			log.Errorf("Policy violation %s", v)
+		}
+	}
+
+	if len(warnings) > 0 || len(violations) > 0 {
+		os.Exit(1)
+	}
+
+	log.Infof("No problems found in %s", c.String("file"))
+}
+
+func graphCommand(c *cli.Context) {
+	vars, err := template.VarsFromFileMulti(c.StringSlice("vars"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	vars = envVars(c).Merge(vars)
+
+	cliVars, err := template.VarsFromStrings(c.StringSlice("var"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	initDigestResolver(c)
+
+	rockerfile, err := build.NewRockerfileFromFile(c.String("file"), vars.Merge(cliVars), template.Funs{})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	plan, err := build.NewPlan(rockerfile.Commands(), false, c.Bool("auto-batch"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	format := c.String("format")
+	if format == "" {
+		format = build.GraphFormat(c.String("output"))
+	}
+
+	var buf bytes.Buffer
+	if err := build.NewGraph(plan).Write(&buf, format); err != nil {
+		log.Fatal(err)
+	}
+
+	if c.String("output") == "" {
+		os.Stdout.Write(buf.Bytes())
+		return
+	}
+	if err := util.WriteOutputFile(c.String("output"), buf.Bytes(), 0644); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func verifyCommand(c *cli.Context) {
+	if len(c.Args()) != 1 {
+		log.Fatal("rocker verify <image> [-f Rockerfile]")
+	}
+	name := c.Args().First()
+
+	fileVars, err := template.VarsFromFileMulti(c.StringSlice("vars"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	fileVars = envVars(c).Merge(fileVars)
+
+	cliVars, err := template.VarsFromStrings(c.StringSlice("var"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	dockerClient, err := dockerclient.NewFromCli(c)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	img, err := dockerClient.InspectImage(name)
+	if err == docker.ErrNoSuchImage {
+		log.Fatalf("Image %s is not found, pull it first", name)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	labels := map[string]string{}
+	if img.Config != nil {
+		labels = img.Config.Labels
+	}
+
+	data, err := build.ParseRockerData(labels)
+	if err != nil {
+		log.Fatalf("Cannot verify %s: %s", name, err)
+	}
+
+	// The given vars override the recorded ones
+	vars := fileVars.Merge(cliVars)
+	for k, v := range data.Vars {
+		if !vars.IsSet(k) {
+			vars[k] = v
+		}
+	}
+	for _, k := range data.SecretVars {
+		if !vars.IsSet(k) {
+			log.Warnf("The value of var %s is not recorded, it looks like a secret; pass it with --var if the Rockerfile depends on it", k)
+		}
+	}
+
+	initDigestResolver(c)
+
+	rockerfile, err := build.NewRockerfileFromFile(c.String("file"), vars, template.Funs{})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if err := build.VerifyRockerData(rockerfile, data); err != nil {
+		log.Fatalf("Image %s could not have been produced by %s: %s", name, rockerfile.Name, err)
+	}
+
+	log.Infof("Image %s could have been produced by %s, %d steps match (built of %s)", name, rockerfile.Name, len(data.Steps), data.Rockerfile)
+}
+
+func cacheExportCommand(c *cli.Context) {
+	if len(c.Args()) != 1 {
+		log.Fatal("rocker cache export <file.tgz>")
+	}
+
+	cacheDir, err := util.MakeAbsolute(c.String("cache-dir"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	f, err := util.CreateOutputFile(c.Args()[0])
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer f.Close()
+
+	stats, err := build.ExportCache(newImageClient(c), cacheDir, f)
+	if err != nil {
+		os.Remove(f.Name())
+		log.Fatal(err)
+	}
+
+	for _, name := range stats.Skipped {
+		log.Debugf("Skipped cache entry %s, its image does not exist", name)
+	}
+	log.Infof("Exported %d cache entries and %d images to %s, skipped %d entries of the removed images",
+		stats.Entries, stats.Images, c.Args()[0], len(stats.Skipped))
+}
+
+func cacheImportCommand(c *cli.Context) {
+	if len(c.Args()) != 1 {
+		log.Fatal("rocker cache import <file.tgz>")
+	}
+
+	cacheDir, err := util.MakeAbsolute(c.String("cache-dir"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	f, err := os.Open(c.Args()[0])
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer f.Close()
+
+	stats, err := build.ImportCache(newImageClient(c), cacheDir, f)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	log.Infof("Imported %d cache entries and %d images", stats.Entries, stats.Images)
+	if len(stats.Skipped) > 0 {
+		log.Fatalf("%d cache entries are removed, their images do not resolve after the import", len(stats.Skipped))
+	}
+}
+
+func cacheGCCommand(c *cli.Context) {
+	if c.String("cache-repo") == "" {
+		log.Fatal("rocker cache-gc --cache-repo <repo>")
+	}
+
+	dockerClient, err := dockerclient.NewFromCli(c)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	cacheDir, err := util.MakeAbsolute(c.String("cache-dir"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	options := build.DockerClientOptions{
+		Client:                   dockerClient,
+		Log:                      log.StandardLogger(),
+		StdoutContainerFormatter: log.StandardLogger().Formatter,
+		StderrContainerFormatter: log.StandardLogger().Formatter,
+	}
+	client := build.NewDockerClient(options)
+
+	cache := build.NewCacheTags(client, build.CacheTagsOptions{
+		Repo:     c.String("cache-repo"),
+		IndexDir: filepath.Join(cacheDir, "tags"),
+	})
+
+	removed, err := cache.GC(c.Duration("max-age"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	log.Infof("Untagged %d cache images", len(removed))
+}
+
+func cleanCommand(c *cli.Context) {
+	if !c.Bool("intermediates") {
+		log.Fatal("rocker clean --intermediates")
+	}
+
+	dockerClient, err := dockerclient.NewFromCli(c)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	removed, kept, err := build.CleanIntermediates(dockerClient, c.Bool("dry-run"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if c.Bool("dry-run") {
+		for _, id := range removed {
+			fmt.Println(id)
+		}
+		log.Infof("Would remove %d intermediate images", len(removed))
+		return
+	}
+
+	log.Infof("Removed %d intermediate images, kept %d that are still in use", len(removed), kept)
+}
+
+func daemonCommand(c *cli.Context) {
+	if err := newBuildServer(c).ListenAndServe(c.String("listen")); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func serveCommand(c *cli.Context) {
+	if err := newBuildServer(c).ListenAndServeRPC(c.String("listen")); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func newBuildServer(c *cli.Context) *server.Server {
+	config := dockerclient.NewConfigFromCli(c)
+
+	dockerClient, err := dockerclient.NewFromConfig(config)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if err := dockerclient.Ping(dockerClient, 5000); err != nil {
+		log.Fatal(err)
+	}
+
+	cacheDir, err := util.MakeAbsolute(c.String("cache-dir"))
+	if err != nil {
+		log.Fatal(err)
 	}
-	if !dir.IsDir() {
-		log.Errorf("Context directory %s is not a directory.", contextDir)
-		os.Exit(2)
 
+	initDigestResolver(c)
+
+	srv, err := server.New(server.Config{
+		WorkDir:      c.String("work-dir"),
+		CacheDir:     cacheDir,
+		QueueSize:    c.Int("queue-size"),
+		MinFreeSpace: minFreeSpace(c),
+		Sandbox:      sandbox(c),
+		Hash:         hashAlgorithm(c),
+		Policy:       policy(c),
+		ClientOptions: build.DockerClientOptions{
+			Client:         dockerClient,
+			Auth:           initAuth(c),
+			S3storage:      newS3Storage(c, dockerClient, cacheDir),
+			PushRetryCount: c.Int("push-retry"),
+			Host:           config.Host,
+			Timeout:        config.Timeout,
+			CommitTimeout:  config.CommitTimeout,
+			Retries:        config.Retries,
+			PullTimeout:    config.PullTimeout,
+			PullRetries:    config.PullRetries,
+			CommitNoPause:  c.Bool("commit-no-pause"),
+			CgroupParent:   c.String("cgroup-parent"),
+
+			MaxStepLogBytes: maxStepLogBytes(c),
+		},
+	})
+	if err != nil {
+		log.Fatal(err)
 	}
-	log.Debugf("Context directory: %s", contextDir)
 
-	if c.Bool("print") {
-		fmt.Print(rockerfile.Content)
-		os.Exit(0)
+	return srv
+}
+
+// sweepTempFiles removes the temporary files left by
+// the rocker processes that were killed a while ago
+func sweepTempFiles() {
+	removed, err := util.SweepTempFiles(s3.TempFilePrefix, 24*time.Hour)
+	if err != nil {
+		log.Debugf("Failed to remove orphaned temp files, error: %s", err)
+	}
+	for _, name := range removed {
+		log.Debugf("Removed orphaned temp file %s", name)
 	}
+}
 
-	dockerignore := []string{}
+// shell parses the --shell flag, or the shell of .rocker.yml if it is not given
+func shell(c *cli.Context, projectConfig *build.ProjectConfig) []string {
+	value := projectConfig.Shell
+	if c.String("shell") != "" {
+		value = c.String("shell")
+	}
+	result, err := build.ParseShell(value)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return result
+}
 
-	dockerignoreFilename := filepath.Join(contextDir, ".dockerignore")
-	if _, err := os.Stat(dockerignoreFilename); err == nil {
-		if dockerignore, err = build.ReadDockerignoreFile(dockerignoreFilename); err != nil {
-			log.Fatal(err)
+// copyStdin saves the --copy-stdin archive to a temporary file, decompressed,
+// so that every COPY --from-stdin of every matrix build can read it
+func copyStdin(c *cli.Context) string {
+	value := c.String("copy-stdin")
+	if value == "" {
+		return ""
+	}
+
+	var in *os.File
+
+	if value == "-" {
+		if c.String("file") == "-" {
+			log.Fatal("--copy-stdin - cannot be used with -f -, stdin is already the Rockerfile")
+		}
+		in = os.Stdin
+	} else if fd, err := strconv.Atoi(value); err == nil {
+		if in = os.NewFile(uintptr(fd), fmt.Sprintf("fd %d", fd)); in == nil {
+			log.Fatalf("Invalid --copy-stdin file descriptor %d", fd)
+		}
+	} else {
+		var err error
+		if in, err = os.Open(value); err != nil {
+			log.Fatalf("Failed to open --copy-stdin archive, error: %s", err)
 		}
 	}
+	defer in.Close()
 
-	var config *dockerclient.Config
-	config = dockerclient.NewConfigFromCli(c)
+	stream, err := archive.DecompressStream(in)
+	if err != nil {
+		log.Fatalf("Failed to read --copy-stdin archive from %s, error: %s", in.Name(), err)
+	}
+	defer stream.Close()
 
-	dockerClient, err := dockerclient.NewFromConfig(config)
+	out, err := util.TempFile("rocker-copy-stdin-")
 	if err != nil {
 		log.Fatal(err)
 	}
+	defer out.Close()
 
-	cacheDir, err := util.MakeAbsolute(c.String("cache-dir"))
+	size, err := io.Copy(out, stream)
+	if err != nil {
+		log.Fatalf("Failed to read --copy-stdin archive from %s, error: %s", in.Name(), err)
+	}
+
+	log.Debugf("Saved --copy-stdin archive from %s to %s (%s)", in.Name(), out.Name(), units.HumanSize(float64(size)))
+
+	return out.Name()
+}
+
+// minFreeSpace parses the --min-free-space flag, e.g. 500m or 5g
+func minFreeSpace(c *cli.Context) int64 {
+	if c.String("min-free-space") == "" {
+		return 0
+	}
+	size, err := units.RAMInBytes(c.String("min-free-space"))
+	if err != nil {
+		log.Fatalf("Invalid --min-free-space %q, error: %s", c.String("min-free-space"), err)
+	}
+	return size
+}
+
+// envVars imports the vars from the environment with --var-from-env-prefix
+func envVars(c *cli.Context) template.Vars {
+	if c.String("var-from-env-prefix") == "" {
+		return template.Vars{}
+	}
+	return template.VarsFromEnv(c.String("var-from-env-prefix"), os.Environ())
+}
+
+// maxContextSize parses the --max-context-size flag, e.g. 500MB
+func maxContextSize(c *cli.Context) int64 {
+	if c.String("max-context-size") == "" {
+		return 0
+	}
+	size, err := units.RAMInBytes(c.String("max-context-size"))
+	if err != nil {
+		log.Fatalf("Invalid --max-context-size %q, error: %s", c.String("max-context-size"), err)
+	}
+	return size
+}
+
+// maxStepLogBytes parses the --max-step-log-bytes flag, e.g. 50m
+func maxStepLogBytes(c *cli.Context) int64 {
+	if c.String("max-step-log-bytes") == "" {
+		return 0
+	}
+	size, err := units.RAMInBytes(c.String("max-step-log-bytes"))
+	if err != nil {
+		log.Fatalf("Invalid --max-step-log-bytes %q, error: %s", c.String("max-step-log-bytes"), err)
+	}
+	return size
+}
+
+// newScheduler makes the scheduler of the RUN containers of the parallel builds
+// from the resources of the docker host capped by --max-parallel-cpu and --max-parallel-mem
+func newScheduler(c *cli.Context, dockerClient *docker.Client) (*build.Scheduler, error) {
+	info, err := dockerClient.Info()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get the resources of the docker host, error: %s", err)
+	}
+
+	var maxMemory int64
+	if value := c.String("max-parallel-mem"); value != "" {
+		if maxMemory, err = units.RAMInBytes(value); err != nil {
+			return nil, fmt.Errorf("Invalid --max-parallel-mem %q, error: %s", value, err)
+		}
+	}
+
+	return build.NewScheduler(info.NCPU, info.MemTotal, c.Int("max-parallel-cpu"), maxMemory)
+}
+
+func hashAlgorithm(c *cli.Context) build.Hash {
+	hash, err := build.GetHash(c.String("hash"))
 	if err != nil {
 		log.Fatal(err)
 	}
+	return hash
+}
 
-	var cache build.Cache
-	if !c.Bool("no-cache") {
-		cache = build.NewCacheFS(cacheDir)
+// publishChannel returns the channel given by --publish-channel, nil if it is not given
+func publishChannel(c *cli.Context, projectConfig *build.ProjectConfig) *build.PublishChannel {
+	if c.String("publish-channel") == "" {
+		return nil
+	}
+	ch, err := build.GetPublishChannel(c.String("publish-channel"), projectConfig.Channels)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return ch
+}
+
+// policy reads the --policy-file, nil if it is not given
+func policy(c *cli.Context) *build.Policy {
+	if c.String("policy-file") == "" {
+		return nil
+	}
+	p, err := build.ReadPolicy(c.String("policy-file"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	return p
+}
+
+func sandbox(c *cli.Context) build.Sandbox {
+	return build.Sandbox{
+		CapDrop:        c.StringSlice("cap-drop"),
+		CapAdd:         c.StringSlice("cap-add"),
+		SecurityOpt:    c.StringSlice("security-opt"),
+		ReadOnly:       c.Bool("read-only"),
+		DenyPrivileged: c.Bool("deny-privileged"),
+	}
+}
+
+func artifactsMergeCommand(c *cli.Context) {
+	if len(c.Args()) == 0 {
+		log.Fatal("rocker artifacts merge <dir|file> [...] [-o combined.yml]")
+	}
+
+	files, err := build.ArtifactFiles(c.Args())
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	lists := [][]imagename.Artifact{}
+	for _, fileName := range files {
+		artifacts, err := build.ReadArtifacts(fileName)
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, a := range artifacts.RockerArtifacts {
+			if err := a.Validate(); err != nil {
+				log.Fatalf("Invalid artifact %s in %s, error: %s", a.Name, fileName, err)
+			}
+		}
+		lists = append(lists, artifacts.RockerArtifacts)
+	}
+
+	merged := imagename.Artifacts{RockerArtifacts: imagename.MergeArtifacts(lists...)}
+
+	content, err := yaml.Marshal(merged)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	output := c.String("output")
+	if output == "" {
+		os.Stdout.Write(content)
+		return
+	}
+
+	if err := util.WriteOutputFile(output, content, 0644); err != nil {
+		log.Fatalf("Failed to write %s, error: %s", output, err)
+	}
+
+	log.Infof("Merged %d artifacts from %d files into %s", len(merged.RockerArtifacts), len(files), output)
+}
+
+func artifactsValidateCommand(c *cli.Context) {
+	if len(c.Args()) == 0 {
+		log.Fatal("rocker artifacts validate <dir|file> [...]")
+	}
+
+	files, err := build.ArtifactFiles(c.Args())
+	if err != nil {
+		log.Fatal(err)
 	}
 
 	var (
-		stdoutContainerFormatter log.Formatter = &log.JSONFormatter{}
-		stderrContainerFormatter log.Formatter = &log.JSONFormatter{}
+		auth    = initAuth(c)
+		count   = 0
+		invalid = 0
 	)
-	if !c.GlobalBool("json") {
-		stdoutContainerFormatter = build.NewMonochromeContainerFormatter()
-		stderrContainerFormatter = build.NewColoredContainerFormatter()
+
+	for _, fileName := range files {
+		artifacts, err := build.ReadArtifacts(fileName)
+		if err != nil {
+			log.Error(err)
+			invalid++
+			continue
+		}
+
+		for _, a := range artifacts.RockerArtifacts {
+			count++
+
+			err := a.Validate()
+			if err == nil && c.Bool("check-remote") {
+				err = checkRemoteArtifact(a, auth)
+			}
+			if err != nil {
+				log.Errorf("%s: %s: %s", fileName, a.Name, err)
+				invalid++
+			}
+		}
 	}
 
-	options := build.DockerClientOptions{
-		Client:                   dockerClient,
-		Auth:                     initAuth(c),
-		Log:                      log.StandardLogger(),
-		S3storage:                s3.New(dockerClient, cacheDir),
-		StdoutContainerFormatter: stdoutContainerFormatter,
-		StderrContainerFormatter: stderrContainerFormatter,
-		PushRetryCount:           c.Int("push-retry"),
-		Host:                     config.Host,
-		LogExactSizes:            c.GlobalBool("json"),
+	if invalid > 0 {
+		log.Fatalf("Found %d problems in %d artifacts", invalid, count)
 	}
-	client := build.NewDockerClient(options)
 
-	builder := build.New(client, rockerfile, cache, build.Config{
-		InStream:      os.Stdin,
-		OutStream:     os.Stdout,
-		ContextDir:    contextDir,
-		Dockerignore:  dockerignore,
-		ArtifactsPath: c.String("artifacts-path"),
-		Pull:          c.Bool("pull"),
-		NoGarbage:     c.Bool("no-garbage"),
-		Attach:        c.Bool("attach"),
-		Verbose:       c.GlobalBool("verbose"),
-		ID:            c.String("id"),
-		NoCache:       c.Bool("no-cache"),
-		ReloadCache:   c.Bool("reload-cache"),
-		Push:          c.Bool("push"),
-		CacheDir:      cacheDir,
-		LogJSON:       c.GlobalBool("json"),
-		BuildArgs:     runconfigopts.ConvertKVStringsToMap(c.StringSlice("build-arg")),
-	})
+	log.Infof("%d artifacts in %d files are valid", count, len(files))
+}
 
-	plan, err := build.NewPlan(rockerfile.Commands(), true)
+func artifactsListCommand(c *cli.Context) {
+	store, err := artifactStore(c)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	// Check the docker connection before we actually run
-	if err := dockerclient.Ping(dockerClient, 5000); err != nil {
+	artifacts, err := store.List()
+	if err != nil {
 		log.Fatal(err)
 	}
 
-	if err := builder.Run(plan); err != nil {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tDIGEST\tFILES\tSIZE\tPUBLISHED\tUSED")
+	for _, a := range artifacts {
+		fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%s\t%s\n", a.Name, a.Digest, a.Files, units.HumanSize(float64(a.Size)),
+			a.Published.Local().Format("2006-01-02 15:04:05"), a.Used.Local().Format("2006-01-02 15:04:05"))
+	}
+	w.Flush()
+}
+
+func artifactsGCCommand(c *cli.Context) {
+	store, err := artifactStore(c)
+	if err != nil {
 		log.Fatal(err)
 	}
 
-	fields := log.Fields{}
-	if c.GlobalBool("json") {
-		fields["size"] = builder.VirtualSize
-		fields["delta"] = builder.ProducedSize
+	removed, err := store.GC(c.Duration("max-age"))
+	for _, name := range removed {
+		log.Infof("Removed artifact %s", name)
+	}
+	if err != nil {
+		log.Fatal(err)
 	}
 
-	size := fmt.Sprintf("final size %s (+%s from the base image)",
-		units.HumanSize(float64(builder.VirtualSize)),
-		units.HumanSize(float64(builder.ProducedSize)),
-	)
+	log.Infof("Removed %d artifacts", len(removed))
+}
 
-	log.WithFields(fields).Infof("Successfully built %.12s | %s", builder.GetImageID(), size)
+// artifactStore returns the artifact store of --cache-dir
+func artifactStore(c *cli.Context) (*build.ArtifactStore, error) {
+	cacheDir, err := util.MakeAbsolute(c.String("cache-dir"))
+	if err != nil {
+		return nil, err
+	}
+	return build.NewArtifactStore(filepath.Join(cacheDir, build.ArtifactStoreDir)), nil
 }
 
-func pullCommand(c *cli.Context) {
-	args := c.Args()
-	if len(args) < 1 {
-		log.Fatal("rocker pull <image>")
+// checkRemoteArtifact checks that the pushed image is present in the registry by its digest
+func checkRemoteArtifact(a imagename.Artifact, auth *docker.AuthConfigurations) error {
+	if !a.Pushed {
+		return nil
+	}
+	if a.Name.Storage == imagename.StorageS3 {
+		log.Debugf("Skip checking S3 image %s", a.Name)
+		return nil
 	}
 
-	dockerClient, err := dockerclient.NewFromCli(c)
+	exists, err := dockerclient.RegistryImageExists(a.Name, a.Digest, auth)
+	if err != nil {
+		return fmt.Errorf("Failed to check the image in the registry, error: %s", err)
+	}
+	if !exists {
+		return fmt.Errorf("%s is not found in the registry", a.Addressable)
+	}
+
+	return nil
+}
+
+func selfUpdateCommand(c *cli.Context) {
+	updater, err := selfupdate.New(selfupdate.Config{
+		URL:            c.String("url"),
+		Channel:        c.String("channel"),
+		CurrentVersion: Version,
+		Force:          c.Bool("force"),
+	})
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	cacheDir, err := util.MakeAbsolute(c.String("cache-dir"))
+	version, err := updater.Update()
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	options := build.DockerClientOptions{
-		Client:                   dockerClient,
-		Auth:                     initAuth(c),
-		Log:                      log.StandardLogger(),
-		S3storage:                s3.New(dockerClient, cacheDir),
-		StdoutContainerFormatter: log.StandardLogger().Formatter,
-		StderrContainerFormatter: log.StandardLogger().Formatter,
+	if version != "" {
+		log.Infof("Successfully updated %s -> %s", Version, version)
+	}
+}
+
+func completionCommand(c *cli.Context, app *cli.App) {
+	if c.Bool("list-images") {
+		dockerClient, err := dockerclient.NewFromCli(c)
+		if err != nil {
+			log.Fatal(err)
+		}
+		images, err := dockerClient.ListImages(docker.ListImagesOptions{})
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, image := range images {
+			for _, repoTag := range image.RepoTags {
+				if repoTag != "<none>:<none>" {
+					fmt.Println(repoTag)
+				}
+			}
+		}
+		return
+	}
+
+	args := c.Args()
+	if len(args) != 1 {
+		log.Fatalf("rocker completion <%s>", strings.Join(completion.Shells, "|"))
+	}
+
+	spec := completion.Spec{
+		App: app,
+		FlagValues: map[string]string{
+			"file":           completion.ValueRockerfile,
+			"vars":           completion.ValueFile,
+			"cache-dir":      completion.ValueDir,
+			"artifacts-path": completion.ValueDir,
+			"tlscacert":      completion.ValueFile,
+			"tlscert":        completion.ValueFile,
+			"tlskey":         completion.ValueFile,
+		},
+		ArgValues: map[string]string{
+			"build":      completion.ValueDir,
+			"pull":       completion.ValueImage,
+			"completion": "",
+		},
+		ListImagesCmd: app.Name + " completion --list-images",
 	}
-	client := build.NewDockerClient(options)
 
-	if err := client.PullImage(args[0]); err != nil {
+	if err := completion.Generate(spec, args[0], os.Stdout); err != nil {
 		log.Fatal(err)
 	}
 }
 
+// initDigestResolver makes the `digest` template helper look up images in their registries
+func initDigestResolver(c *cli.Context) {
+	var (
+		auth    = initAuth(c)
+		storage = s3.New(nil, "")
+	)
+	template.DigestResolver = func(image *imagename.ImageName) (string, error) {
+		if image.Storage == imagename.StorageS3 {
+			return storage.Digest(image)
+		}
+		return dockerclient.RegistryImageDigest(image, auth)
+	}
+}
+
+// initVarPrompt makes the `required` template helper ask for the missing variables
+// with --interactive-vars; without a terminal on stdin they stay errors, e.g. in CI
+func initVarPrompt(c *cli.Context) {
+	if !c.Bool("interactive-vars") {
+		return
+	}
+
+	fd, isTerminal := term.GetFdInfo(os.Stdin)
+	if !isTerminal || c.String("file") == "-" {
+		log.Debugf("Not asking for the missing variables, stdin is not a terminal")
+		return
+	}
+
+	var (
+		reader  = bufio.NewReader(os.Stdin)
+		answers = map[string]string{}
+	)
+
+	// the matrix builds render the Rockerfile many times, ask only once
+	template.VarPrompt = func(name string, secret bool) (string, error) {
+		if value, ok := answers[name]; ok {
+			return value, nil
+		}
+
+		fmt.Fprintf(os.Stderr, "Variable %s is required, enter the value: ", name)
+
+		if secret {
+			state, err := term.SaveState(fd)
+			if err != nil {
+				return "", fmt.Errorf("Failed to read variable %s, error: %s", name, err)
+			}
+			if err := term.DisableEcho(fd, state); err != nil {
+				return "", fmt.Errorf("Failed to read variable %s, error: %s", name, err)
+			}
+			defer func() {
+				term.RestoreTerminal(fd, state)
+				fmt.Fprintln(os.Stderr)
+			}()
+		}
+
+		line, err := reader.ReadString('\n')
+		if err != nil && line == "" {
+			return "", fmt.Errorf("Failed to read variable %s, error: %s", name, err)
+		}
+
+		answers[name] = strings.TrimRight(line, "\r\n")
+		return answers[name], nil
+	}
+}
+
 func initAuth(c *cli.Context) (auth *docker.AuthConfigurations) {
 	var err error
 	if c.IsSet("auth") {
 		// Obtain auth configuration from cli params
 		authParam := c.String("auth")
 		if strings.Contains(authParam, ":") {
+			deprecation.Warn(deprecation.AuthFlag, "--auth")
 			userPass := strings.Split(authParam, ":")
 			auth = &docker.AuthConfigurations{
 				Configs: map[string]docker.AuthConfiguration{
@@ -465,17 +2760,18 @@ func initAuth(c *cli.Context) (auth *docker.AuthConfigurations) {
 					},
 				},
 			}
+			dockerclient.SetAuthSource("*", "--auth")
 		}
 		return
 	}
-	// Obtain auth configuration from .docker/config.json
-	if auth, err = docker.NewAuthConfigurationsFromDockerCfg(); err != nil && !os.IsNotExist(err) {
+	// Obtain auth configuration from the docker config files
+	if auth, err = dockerclient.LoadAuth(c.GlobalStringSlice("docker-config")); err != nil {
 		log.Fatal(err)
 	}
 	return
 }
 
-func initLogs(ctx *cli.Context) {
+func initLogs(ctx *cli.Context) (err error) {
 	logger := log.StandardLogger()
 
 	if ctx.GlobalBool("verbose") {
@@ -495,13 +2791,28 @@ func initLogs(ctx *cli.Context) {
 	color.NoColor = !useColors
 
 	if json {
-		logger.Formatter = &log.JSONFormatter{}
+		logger.Formatter = textformatter.NewJSONFormatter()
 	} else {
 		formatter := &textformatter.TextFormatter{}
 		formatter.DisableColors = !useColors
 
 		logger.Formatter = formatter
 	}
+
+	logSinks, err = logsink.New(logsink.Options{
+		File:       ctx.GlobalString("log-file"),
+		JSON:       json,
+		Syslog:     ctx.GlobalBool("log-syslog"),
+		Fluentd:    ctx.GlobalString("log-fluentd"),
+		FluentdTag: ctx.GlobalString("log-fluentd-tag"),
+	})
+	if err != nil {
+		return err
+	}
+	if logSinks != nil {
+		logger.Hooks.Add(logSinks)
+	}
+	return nil
 }
 
 func stringOr(args ...string) string {
@@ -44,3 +44,17 @@ docker run --rm -ti \
       --tag $VERSION \
       --name rocker-$VERSION-darwin_amd64.tar.gz \
       --file ./dist/rocker_darwin_amd64.tar.gz
+
+# Checksums are verified by `rocker self-update`
+for PLATFORM in linux_amd64 darwin_amd64; do
+  docker run --rm -ti \
+    -e GITHUB_TOKEN=$GITHUB_TOKEN \
+    -v /etc/ssl/certs/ca-certificates.crt:/etc/ssl/certs/ca-certificates.crt \
+    -v `pwd`/dist:/dist \
+    dockerhub.grammarly.io/tools/github-release:master upload \
+        --user $GITHUB_USER \
+        --repo $GITHUB_REPO \
+        --tag $VERSION \
+        --name rocker-$VERSION-$PLATFORM.tar.gz.sha256 \
+        --file ./dist/rocker_$PLATFORM.tar.gz.sha256
+done
@@ -0,0 +1,79 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+const (
+	// ArgsFileDir is the tmpfs of the RUN containers the args file is
+	// written to, see Config.ArgsFileMount
+	ArgsFileDir = "/run/rocker"
+
+	// ArgsFilePath is where RUN commands find the args file
+	ArgsFilePath = ArgsFileDir + "/args.json"
+)
+
+// argsFile is the content of the args file
+type argsFile struct {
+	Args map[string]string      `json:"args"`
+	Vars map[string]interface{} `json:"vars"`
+}
+
+// argsFileTmpfs returns the tmpfs mounts of the RUN container with the args
+// file directory added, so the file is neither committed nor written to disk
+func argsFileTmpfs(tmpfs map[string]string) map[string]string {
+	result := map[string]string{ArgsFileDir: "mode=1777"}
+	for dest, options := range tmpfs {
+		result[dest] = options
+	}
+	return result
+}
+
+// argsFileCmd wraps the command of the RUN container, so that it writes the
+// args file given on stdin before it runs; docker cannot write files to the
+// tmpfs of a container that has not started yet
+func argsFileCmd(cmd []string) []string {
+	script := fmt.Sprintf(`cat > %s && chmod 0444 %s && exec "$@"`, ArgsFilePath, ArgsFilePath)
+	return append([]string{"/bin/sh", "-c", script, "sh"}, cmd...)
+}
+
+// argsFileData returns the args file with the build args consumed by ARG
+// and the vars of the Rockerfile consumed by the step, e.g. RUN --vars=Deps
+func (b *Build) argsFileData(s State, names []string) ([]byte, error) {
+	content := argsFile{
+		Args: b.runBuildArgs(s),
+		Vars: map[string]interface{}{},
+	}
+
+	vars := b.rockerfile.Vars.ToJSONMap()
+	for _, name := range names {
+		value, ok := vars[name]
+		if !ok {
+			return nil, fmt.Errorf("RUN --vars: variable %s is not defined, pass it with -var %s=...", name, name)
+		}
+		content.Vars[name] = value
+	}
+
+	data, err := json.MarshalIndent(content, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("Failed to encode the args file, error: %s", err)
+	}
+	return data, nil
+}
@@ -0,0 +1,138 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/grammarly/rocker/src/template"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestCommandRun_ArgsFileMount(t *testing.T) {
+	b, c := makeBuild(t, "", Config{ArgsFileMount: true})
+	b.rockerfile.Vars = template.Vars{
+		"Version": "1.2.3",
+		"Deps":    map[interface{}]interface{}{"node": "6"},
+		"Skip":    "skip",
+	}
+	cmd := NewCommand(ConfigCommand{
+		name:  "run",
+		args:  []string{"cat /run/rocker/args.json"},
+		flags: map[string]string{"vars": "Version,Deps"},
+	})
+
+	b.state.ImageID = "123"
+	b.state.Config.Env = []string{"FOO=env"}
+	b.state.NoCache.BuildArgs = map[string]string{"APP": "app", "FOO": "arg", "SKIP": "skip"}
+	b.allowedBuildArgs["APP"] = true
+	b.allowedBuildArgs["FOO"] = true
+
+	c.On("CreateContainer", mock.AnythingOfType("State")).Return("456", nil).Run(func(args mock.Arguments) {
+		arg := args.Get(0).(State)
+		assert.Equal(t, []string{"FOO=env"}, arg.Config.Env)
+		assert.Equal(t, argsFileCmd([]string{"/bin/sh", "-c", "cat /run/rocker/args.json"}), arg.Config.Cmd)
+		assert.True(t, arg.Config.OpenStdin)
+		assert.True(t, arg.Config.StdinOnce)
+		assert.Contains(t, arg.NoCache.HostConfig.Tmpfs, ArgsFileDir)
+		assert.Nil(t, arg.Config.Volumes)
+	}).Once()
+
+	var content argsFile
+	c.On("RunContainerWithInput", "456", mock.Anything).Return(nil).Run(func(args mock.Arguments) {
+		data, err := ioutil.ReadAll(args.Get(1).(io.Reader))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := json.Unmarshal(data, &content); err != nil {
+			t.Fatal(err)
+		}
+	}).Once()
+
+	state, err := cmd.Execute(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.AssertExpectations(t)
+	assert.Equal(t, map[string]string{"APP": "app"}, content.Args)
+	assert.Equal(t, map[string]interface{}{
+		"Version": "1.2.3",
+		"Deps":    map[string]interface{}{"node": "6"},
+	}, content.Vars)
+	assert.Equal(t, []string{"FOO=env"}, state.Config.Env)
+	assert.False(t, state.Config.OpenStdin)
+	assert.Nil(t, state.NoCache.HostConfig.Tmpfs)
+	assert.Contains(t, state.GetCommits(), "|args-file:")
+}
+
+func TestCommandRun_ArgsFileMountCacheKey(t *testing.T) {
+	b, _ := makeBuild(t, "", Config{ArgsFileMount: true})
+
+	b.rockerfile.Vars = template.Vars{"Version": "1.2.3", "Other": "a"}
+	data1, err := b.argsFileData(b.state, []string{"Version"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b.rockerfile.Vars = template.Vars{"Version": "1.2.3", "Other": "b"}
+	data2, err := b.argsFileData(b.state, []string{"Version"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, string(data1), string(data2), "the vars not consumed by the step should not change the key")
+
+	b.rockerfile.Vars = template.Vars{"Version": "1.2.4", "Other": "b"}
+	data3, err := b.argsFileData(b.state, []string{"Version"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NotEqual(t, string(data1), string(data3))
+}
+
+func TestArgsFileData_UndefinedVar(t *testing.T) {
+	b, _ := makeBuild(t, "", Config{ArgsFileMount: true})
+
+	_, err := b.argsFileData(b.state, []string{"Version"})
+	assert.EqualError(t, err, "RUN --vars: variable Version is not defined, pass it with -var Version=...")
+}
+
+func TestCommandRun_VarsWithoutArgsFile(t *testing.T) {
+	b, _ := makeBuild(t, "", Config{})
+	cmd := NewCommand(ConfigCommand{
+		name:  "run",
+		args:  []string{"make"},
+		flags: map[string]string{"vars": "Version"},
+	})
+
+	b.state.ImageID = "123"
+
+	_, err := cmd.Execute(b)
+	assert.EqualError(t, err, "RUN --vars requires --args-file-mount")
+}
+
+func TestArgsFileTmpfs(t *testing.T) {
+	tmpfs := map[string]string{"/build-tmp": "size=2g"}
+
+	assert.Equal(t, map[string]string{"/build-tmp": "size=2g", "/run/rocker": "mode=1777"}, argsFileTmpfs(tmpfs))
+	assert.Equal(t, map[string]string{"/build-tmp": "size=2g"}, tmpfs)
+}
@@ -0,0 +1,410 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/pkg/units"
+	"github.com/go-yaml/yaml"
+	"github.com/grammarly/rocker/src/dockerclient"
+	"github.com/grammarly/rocker/src/imagename"
+	"github.com/grammarly/rocker/src/util"
+	"github.com/kr/pretty"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// The media types of the OCI artifacts made by ARTIFACT
+const (
+	helmChartConfigMediaType  = "application/vnd.cncf.helm.config.v1+json"
+	helmChartContentMediaType = "application/vnd.cncf.helm.chart.content.v1.tar+gzip"
+	ociEmptyConfigMediaType   = "application/vnd.oci.empty.v1+json"
+	defaultFileMediaType      = "application/octet-stream"
+)
+
+// artifactPackagers make the OCI artifact of every ARTIFACT kind out of the source files
+var artifactPackagers = map[string]func(files []artifactFile, flags map[string]string) (dockerclient.OCIArtifact, error){
+	"chart": packageChart,
+	"file":  packageFile,
+}
+
+// artifactFile is a file of the ARTIFACT source, the name is relative to the source
+type artifactFile struct {
+	name string
+	mode int64
+	data []byte
+}
+
+// CommandArtifact implements ARTIFACT
+type CommandArtifact struct {
+	CommandBase
+}
+
+// Execute runs the command
+func (c *CommandArtifact) Execute(b *Build) (State, error) {
+	kind, src, ref, err := parseArtifactArgs(c.cfg)
+	if err != nil {
+		return b.state, err
+	}
+
+	pack, ok := artifactPackagers[kind]
+	if !ok {
+		return b.state, fmt.Errorf("Unknown ARTIFACT kind %q, expected one of: chart, file", kind)
+	}
+
+	name, err := b.publishName(ref)
+	if err != nil {
+		return b.state, err
+	}
+	if err := imagename.Validate(name); err != nil {
+		return b.state, fmt.Errorf("Invalid ARTIFACT name %s: %s", name, err)
+	}
+	image := imagename.NewFromString(name)
+
+	var files []artifactFile
+
+	switch from := c.cfg.flags["from"]; from {
+	case "", "context":
+		files, err = readContextArtifact(b.cfg.ContextDir, src)
+	case "export":
+		files, err = b.readExportedArtifact(src)
+	default:
+		return b.state, fmt.Errorf("ARTIFACT --from should be either context or export, got %q", from)
+	}
+	if err != nil {
+		return b.state, err
+	}
+
+	oci, err := pack(files, c.cfg.flags)
+	if err != nil {
+		return b.state, fmt.Errorf("Failed to package %s %s, error: %s", kind, src, err)
+	}
+
+	var size int64
+	for _, layer := range oci.Layers {
+		size += int64(len(layer.Data))
+	}
+
+	log.Infof("| Packaged %s %s (%s)", kind, src, units.HumanSize(float64(size)))
+
+	if kind == "chart" && oci.Annotations["org.opencontainers.image.version"] != image.GetTag() {
+		log.Warnf("| The chart version %s does not match the tag of %s, helm expects them to be the same",
+			oci.Annotations["org.opencontainers.image.version"], image)
+	}
+
+	artifact := imagename.Artifact{
+		Type:      kind,
+		Name:      image,
+		Pushed:    b.cfg.Push,
+		Tag:       image.GetTag(),
+		BuildTime: time.Now(),
+
+		Size:          size,
+		BuildDuration: time.Since(b.started),
+	}
+
+	if b.cfg.Push {
+		log.Infof("| Push %s %s", kind, image)
+		digest, err := b.client.PushArtifact(image.String(), oci)
+		if err != nil {
+			return b.state, err
+		}
+		artifact.SetDigest(digest)
+	} else {
+		log.Infof("| Don't push. Pass --push flag to actually push to the registry")
+	}
+
+	return b.state, b.saveArtifacts(artifact)
+}
+
+// parseArtifactArgs splits `ARTIFACT chart ./chart --push oci://registry/name:tag`
+// into its parts, the destination can be also given as the --push=... flag
+func parseArtifactArgs(cfg ConfigCommand) (kind, src, ref string, err error) {
+	ref = cfg.flags["push"]
+	args := []string{}
+
+	for i := 0; i < len(cfg.args); i++ {
+		switch arg := cfg.args[i]; {
+		case arg == "--push" && i+1 < len(cfg.args):
+			ref = cfg.args[i+1]
+			i++
+		case strings.HasPrefix(arg, "--push="):
+			ref = strings.TrimPrefix(arg, "--push=")
+		default:
+			args = append(args, arg)
+		}
+	}
+
+	if len(args) != 2 || ref == "" {
+		return "", "", "", fmt.Errorf("ARTIFACT requires the kind, the source and the destination, e.g. ARTIFACT chart ./chart --push oci://registry/charts/app:1.0.0")
+	}
+
+	return args[0], args[1], strings.TrimPrefix(ref, "oci://"), nil
+}
+
+// readContextArtifact reads the file or the directory tree from the context directory
+func readContextArtifact(contextDir, src string) (files []artifactFile, err error) {
+	root, err := util.ResolvePath(contextDir, src)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid ARTIFACT source: %s", src)
+	}
+
+	info, err := os.Stat(root)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		data, err := ioutil.ReadFile(root)
+		if err != nil {
+			return nil, err
+		}
+		return []artifactFile{{filepath.Base(root), int64(info.Mode().Perm()), data}}, nil
+	}
+
+	err = filepath.Walk(root, func(file string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() {
+			return err
+		}
+		rel, err := filepath.Rel(root, file)
+		if err != nil {
+			return err
+		}
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		files = append(files, artifactFile{filepath.ToSlash(rel), int64(info.Mode().Perm()), data})
+		return nil
+	})
+
+	return files, err
+}
+
+// readExportedArtifact reads the file or the directory tree from the exports container
+func (b *Build) readExportedArtifact(src string) ([]artifactFile, error) {
+	if b.currentExportContainerName == "" {
+		return nil, fmt.Errorf("You have to EXPORT something first to do ARTIFACT --from=export")
+	}
+
+	exportsContainer, err := b.getExportsContainer(b.currentExportContainerName)
+	if err != nil {
+		return nil, err
+	}
+
+	srcPath, err := util.ResolvePath(ExportsPath, src)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid ARTIFACT source: %s", src)
+	}
+
+	var buf bytes.Buffer
+	if err := b.client.DownloadFromContainer(exportsContainer.ID, srcPath, &buf); err != nil {
+		return nil, err
+	}
+
+	return readArtifactTar(&buf)
+}
+
+// readArtifactTar reads the regular files of the archive made by the docker of
+// a file or a directory; the directory itself is the top entry of the archive
+func readArtifactTar(r io.Reader) (files []artifactFile, err error) {
+	var (
+		tr     = tar.NewReader(r)
+		prefix string
+	)
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		name := strings.TrimPrefix(path.Clean(hdr.Name), "./")
+		if hdr.Typeflag == tar.TypeDir {
+			if prefix == "" {
+				prefix = name + "/"
+			}
+			continue
+		}
+		if hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeRegA {
+			continue
+		}
+
+		data, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, artifactFile{strings.TrimPrefix(name, prefix), hdr.Mode & 0777, data})
+	}
+
+	return files, nil
+}
+
+// chartMetadata is the part of Chart.yaml that goes to the config of the chart artifact
+type chartMetadata struct {
+	APIVersion  string `yaml:"apiVersion" json:"apiVersion,omitempty"`
+	Name        string `yaml:"name" json:"name"`
+	Version     string `yaml:"version" json:"version"`
+	AppVersion  string `yaml:"appVersion" json:"appVersion,omitempty"`
+	Description string `yaml:"description" json:"description,omitempty"`
+	Type        string `yaml:"type" json:"type,omitempty"`
+}
+
+// packageChart makes the Helm chart artifact the way `helm push` does, the
+// files are archived under the chart name like `helm package` does
+func packageChart(files []artifactFile, flags map[string]string) (a dockerclient.OCIArtifact, err error) {
+	var meta *chartMetadata
+
+	for _, f := range files {
+		if f.name == "Chart.yaml" {
+			meta = &chartMetadata{}
+			if err := yaml.Unmarshal(f.data, meta); err != nil {
+				return a, fmt.Errorf("Failed to parse Chart.yaml, error: %s", err)
+			}
+		}
+	}
+	if meta == nil {
+		return a, fmt.Errorf("Chart.yaml is not found")
+	}
+	if meta.Name == "" || meta.Version == "" {
+		return a, fmt.Errorf("Chart.yaml should have the name and the version")
+	}
+
+	config, err := json.Marshal(meta)
+	if err != nil {
+		return a, err
+	}
+
+	content, err := tarGzipFiles(meta.Name, files)
+	if err != nil {
+		return a, err
+	}
+
+	return dockerclient.OCIArtifact{
+		Config: dockerclient.OCIBlob{MediaType: helmChartConfigMediaType, Data: config},
+		Layers: []dockerclient.OCIBlob{{MediaType: helmChartContentMediaType, Data: content}},
+		Annotations: map[string]string{
+			"org.opencontainers.image.title":   meta.Name,
+			"org.opencontainers.image.version": meta.Version,
+		},
+	}, nil
+}
+
+// packageFile makes the artifact of a single file of the --media-type, the
+// artifact type is the same; the file name is kept in the layer annotations
+func packageFile(files []artifactFile, flags map[string]string) (a dockerclient.OCIArtifact, err error) {
+	if len(files) != 1 {
+		return a, fmt.Errorf("expected a single file, found %d", len(files))
+	}
+
+	mediaType := flags["media-type"]
+	if mediaType == "" {
+		mediaType = defaultFileMediaType
+	}
+
+	return dockerclient.OCIArtifact{
+		ArtifactType: mediaType,
+		Config:       dockerclient.OCIBlob{MediaType: ociEmptyConfigMediaType, Data: []byte("{}")},
+		Layers: []dockerclient.OCIBlob{{
+			MediaType:   mediaType,
+			Data:        files[0].data,
+			Annotations: map[string]string{"org.opencontainers.image.title": path.Base(files[0].name)},
+		}},
+	}, nil
+}
+
+// tarGzipFiles archives the files under the directory; the archive does not
+// depend on the file times and order, so the same files make the same digest
+func tarGzipFiles(dir string, files []artifactFile) ([]byte, error) {
+	sorted := append([]artifactFile{}, files...)
+	sort.Sort(artifactFilesByName(sorted))
+
+	var (
+		buf bytes.Buffer
+		gw  = gzip.NewWriter(&buf)
+		tw  = tar.NewWriter(gw)
+	)
+
+	for _, f := range sorted {
+		hdr := &tar.Header{
+			Name:     path.Join(dir, f.name),
+			Mode:     f.mode,
+			Size:     int64(len(f.data)),
+			Typeflag: tar.TypeReg,
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return nil, err
+		}
+		if _, err := tw.Write(f.data); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	if err := gw.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+type artifactFilesByName []artifactFile
+
+func (a artifactFilesByName) Len() int           { return len(a) }
+func (a artifactFilesByName) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a artifactFilesByName) Less(i, j int) bool { return a[i].name < a[j].name }
+
+// saveArtifacts adds the artifacts to the build results and writes
+// their artifact files if the artifacts path is given
+func (b *Build) saveArtifacts(artifacts ...imagename.Artifact) error {
+	b.Artifacts = append(b.Artifacts, artifacts...)
+
+	if b.cfg.ArtifactsPath == "" {
+		return nil
+	}
+
+	filePaths, err := WriteArtifacts(b.cfg.ArtifactsPath, artifacts)
+	if err != nil {
+		return err
+	}
+
+	for _, filePath := range filePaths {
+		log.Infof("| Saved artifact file %s", filePath)
+	}
+	for _, artifact := range artifacts {
+		log.Debugf("Artifact properties: %# v", pretty.Formatter(artifact))
+	}
+
+	return nil
+}
@@ -0,0 +1,570 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/grammarly/rocker/src/util"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// ArtifactStoreDir is the directory of the artifact store in the cache dir
+const ArtifactStoreDir = "artifacts"
+
+// artifactSourcePrefix is the prefix of IMPORT --from that takes the files
+// published to the artifact store, e.g. IMPORT --from=artifact:frontend-dist /app/static
+const artifactSourcePrefix = "artifact:"
+
+var artifactStoreNameRe = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+
+// ArtifactStore keeps the files published by EXPORT --publish in the cache
+// dir, so IMPORT --from=artifact:<name> of another build on the host takes
+// them without pushing an intermediate image. The archives are named by the
+// digest of their content, a name refers to the latest archive published
+// under it. The modification time of a name is the time it was used last.
+type ArtifactStore struct {
+	dir string
+}
+
+// StoredArtifact is the name of the artifact store and the archive it refers to
+type StoredArtifact struct {
+	Name      string    `json:"name"`
+	Digest    string    `json:"digest"`
+	Size      int64     `json:"size"`
+	Files     int       `json:"files"`
+	Published time.Time `json:"published"`
+	Used      time.Time `json:"-"`
+}
+
+// NewArtifactStore makes the artifact store in dir
+func NewArtifactStore(dir string) *ArtifactStore {
+	return &ArtifactStore{dir: dir}
+}
+
+// ValidateArtifactStoreName checks the name the files are published under
+func ValidateArtifactStoreName(name string) error {
+	if !artifactStoreNameRe.MatchString(name) {
+		return fmt.Errorf("Invalid artifact name %q, it should consist of letters, digits, '_', '.' and '-'", name)
+	}
+	return nil
+}
+
+// Publish archives the files of the tar stream made by the docker of a file
+// or a directory, all kinds of the entries, and makes the name refer to the
+// archive. The stream is written to the store as it is read; the archive does
+// not depend on the file times and owners, so the same files published by
+// different builds are stored once
+func (s *ArtifactStore) Publish(name string, r io.Reader) (a StoredArtifact, err error) {
+	if err := ValidateArtifactStoreName(name); err != nil {
+		return a, err
+	}
+
+	blobsDir := filepath.Join(s.dir, "blobs")
+	if err := util.MkdirAllOutput(blobsDir, 0755); err != nil {
+		return a, fmt.Errorf("Failed to create the artifact store dir %s, error: %s", blobsDir, err)
+	}
+
+	tmpf, err := ioutil.TempFile(blobsDir, ".tmp-")
+	if err != nil {
+		return a, err
+	}
+	defer os.Remove(tmpf.Name())
+
+	var (
+		hash = sha256.New()
+		gw   = gzip.NewWriter(io.MultiWriter(tmpf, hash))
+		tw   = tar.NewWriter(gw)
+	)
+
+	files, err := writeArtifactTar(tw, r)
+	if err == nil {
+		err = tw.Close()
+	}
+	if err == nil {
+		err = gw.Close()
+	}
+	if closeErr := tmpf.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return a, err
+	}
+
+	info, err := os.Stat(tmpf.Name())
+	if err != nil {
+		return a, err
+	}
+
+	a = StoredArtifact{
+		Name:      name,
+		Digest:    fmt.Sprintf("sha256:%x", hash.Sum(nil)),
+		Size:      info.Size(),
+		Files:     files,
+		Published: time.Now(),
+	}
+
+	lock, err := s.lock(false)
+	if err != nil {
+		return a, err
+	}
+	defer lock.Unlock()
+
+	blobFile := s.blobFile(a.Digest)
+	if _, err := os.Stat(blobFile); os.IsNotExist(err) {
+		if err := s.renameFile(tmpf.Name(), blobFile); err != nil {
+			return a, err
+		}
+	} else if err != nil {
+		return a, err
+	}
+
+	entry, err := json.Marshal(a)
+	if err != nil {
+		return a, err
+	}
+	if err := s.writeFile(s.nameFile(name), entry); err != nil {
+		return a, err
+	}
+
+	return a, nil
+}
+
+// Get returns the artifact published under the name and marks it used
+func (s *ArtifactStore) Get(name string) (a StoredArtifact, err error) {
+	if err := ValidateArtifactStoreName(name); err != nil {
+		return a, err
+	}
+
+	lock, err := s.lock(false)
+	if err != nil {
+		return a, err
+	}
+	defer lock.Unlock()
+
+	if a, err = s.read(s.nameFile(name)); os.IsNotExist(err) {
+		return a, fmt.Errorf("Artifact %s is not published to %s, EXPORT --publish=%s it first", name, s.dir, name)
+	} else if err != nil {
+		return a, err
+	}
+	if _, err := os.Stat(s.blobFile(a.Digest)); err != nil {
+		return a, fmt.Errorf("Archive %s of the artifact %s is missing, error: %s", a.Digest, name, err)
+	}
+
+	now := time.Now()
+	if err := os.Chtimes(s.nameFile(name), now, now); err != nil {
+		log.Debugf("Failed to mark the artifact %s used, error: %s", name, err)
+	}
+
+	return a, nil
+}
+
+// Open returns the tar stream of the files of the artifact
+func (s *ArtifactStore) Open(a StoredArtifact) (io.ReadCloser, error) {
+	fd, err := os.Open(s.blobFile(a.Digest))
+	if err != nil {
+		return nil, err
+	}
+	gz, err := gzip.NewReader(fd)
+	if err != nil {
+		fd.Close()
+		return nil, fmt.Errorf("Failed to read the archive %s of the artifact %s, error: %s", a.Digest, a.Name, err)
+	}
+	return &artifactStoreReader{gz, fd}, nil
+}
+
+// List returns the artifacts of the store sorted by name
+func (s *ArtifactStore) List() (artifacts []StoredArtifact, err error) {
+	fileNames, err := filepath.Glob(filepath.Join(s.dir, "names", "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	for _, fileName := range fileNames {
+		a, err := s.read(fileName)
+		if err != nil {
+			log.Debugf("Ignore the broken artifact store entry %s, error: %s", fileName, err)
+			continue
+		}
+		artifacts = append(artifacts, a)
+	}
+	sort.Sort(storedArtifactsByName(artifacts))
+	return artifacts, nil
+}
+
+// GC removes the names that were not published or imported for maxAge,
+// and then the archives no name refers to
+func (s *ArtifactStore) GC(maxAge time.Duration) (removed []string, err error) {
+	lock, err := s.lock(true)
+	if err != nil {
+		return nil, err
+	}
+	defer lock.Unlock()
+
+	artifacts, err := s.List()
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		deadline = time.Now().Add(-maxAge)
+		keep     = map[string]bool{}
+	)
+
+	for _, a := range artifacts {
+		if a.Used.After(deadline) {
+			keep[filepath.Base(s.blobFile(a.Digest))] = true
+			continue
+		}
+		if err := os.Remove(s.nameFile(a.Name)); err != nil {
+			return removed, err
+		}
+		removed = append(removed, a.Name)
+	}
+
+	blobs, err := filepath.Glob(filepath.Join(s.dir, "blobs", "*.tgz"))
+	if err != nil {
+		return removed, err
+	}
+	for _, blobFile := range blobs {
+		if keep[filepath.Base(blobFile)] {
+			continue
+		}
+		if err := os.Remove(blobFile); err != nil {
+			return removed, err
+		}
+		log.Debugf("Removed the archive %s no artifact refers to", blobFile)
+	}
+
+	return removed, nil
+}
+
+// lock takes the lock of the store, shared for publishing and importing,
+// exclusive for the GC
+func (s *ArtifactStore) lock(exclusive bool) (*util.FileLock, error) {
+	return util.LockFile(filepath.Join(s.dir, "store.lock"), exclusive)
+}
+
+func (s *ArtifactStore) nameFile(name string) string {
+	return filepath.Join(s.dir, "names", name+".json")
+}
+
+func (s *ArtifactStore) blobFile(digest string) string {
+	return filepath.Join(s.dir, "blobs", strings.Replace(digest, ":", "-", 1)+".tgz")
+}
+
+// read reads the name entry, the time it was used is the modification time
+func (s *ArtifactStore) read(fileName string) (a StoredArtifact, err error) {
+	info, err := os.Stat(fileName)
+	if err != nil {
+		return a, err
+	}
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return a, err
+	}
+	if err := json.Unmarshal(data, &a); err != nil {
+		return a, err
+	}
+	a.Used = info.ModTime()
+	return a, nil
+}
+
+// writeFile writes the file through the temporary one, so the builds
+// reading the store never see it half written
+func (s *ArtifactStore) writeFile(fileName string, data []byte) error {
+	dir := filepath.Dir(fileName)
+	if err := util.MkdirAllOutput(dir, 0755); err != nil {
+		return fmt.Errorf("Failed to create the artifact store dir %s, error: %s", dir, err)
+	}
+
+	tmpf, err := ioutil.TempFile(dir, ".tmp-")
+	if err != nil {
+		return err
+	}
+	if _, err := tmpf.Write(data); err != nil {
+		tmpf.Close()
+		os.Remove(tmpf.Name())
+		return err
+	}
+	if err := tmpf.Close(); err != nil {
+		os.Remove(tmpf.Name())
+		return err
+	}
+	if err := s.renameFile(tmpf.Name(), fileName); err != nil {
+		os.Remove(tmpf.Name())
+		return err
+	}
+	return nil
+}
+
+// renameFile moves the temporary file written in full to its place
+func (s *ArtifactStore) renameFile(tmpName, fileName string) error {
+	if err := os.Chmod(tmpName, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpName, fileName); err != nil {
+		return err
+	}
+	return util.ChownOutput(fileName)
+}
+
+// writeArtifactTar copies the entries of the archive made by the docker of a
+// file or a directory, the directory itself is the top entry and is left out.
+// The times and the owners of the entries are dropped. It returns the number
+// of the entries that are not directories.
+func writeArtifactTar(tw *tar.Writer, r io.Reader) (files int, err error) {
+	var (
+		tr     = tar.NewReader(r)
+		prefix string
+		top    = true
+	)
+
+	trim := func(name string) string {
+		return strings.TrimPrefix(strings.TrimPrefix(path.Clean(name), "./"), prefix)
+	}
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return files, err
+		}
+
+		if top && hdr.Typeflag == tar.TypeDir {
+			prefix = strings.TrimPrefix(path.Clean(hdr.Name), "./") + "/"
+			top = false
+			continue
+		}
+		top = false
+
+		hdr.Name = trim(hdr.Name)
+		if hdr.Typeflag == tar.TypeDir {
+			hdr.Name += "/"
+		} else {
+			files++
+		}
+		if hdr.Typeflag == tar.TypeLink {
+			hdr.Linkname = trim(hdr.Linkname)
+		}
+
+		hdr.ModTime, hdr.AccessTime, hdr.ChangeTime = time.Unix(0, 0), time.Time{}, time.Time{}
+		hdr.Uid, hdr.Gid, hdr.Uname, hdr.Gname = 0, 0, "", ""
+		hdr.Format = tar.FormatUnknown
+		for k := range hdr.PAXRecords {
+			if !strings.HasPrefix(k, "SCHILY.xattr.") {
+				delete(hdr.PAXRecords, k)
+			}
+		}
+
+		if err := tw.WriteHeader(hdr); err != nil {
+			return files, err
+		}
+		if _, err := io.Copy(tw, tr); err != nil {
+			return files, err
+		}
+	}
+
+	// The padding after the end of the archive is read too, so the writer
+	// of the stream is not left blocked
+	_, err = io.Copy(ioutil.Discard, r)
+	return files, err
+}
+
+// artifactStore returns the artifact store of the cache dir
+func (b *Build) artifactStore() (*ArtifactStore, error) {
+	if b.cfg.CacheDir == "" {
+		return nil, fmt.Errorf("The artifact store requires the cache dir")
+	}
+	return NewArtifactStore(filepath.Join(b.cfg.CacheDir, ArtifactStoreDir)), nil
+}
+
+// exportPublishName returns the name of EXPORT --publish, either
+// --publish=<name> or --publish=name=<name>
+func exportPublishName(flags map[string]string) (name string, ok bool, err error) {
+	if name, ok = flags["publish"]; !ok {
+		return "", false, nil
+	}
+	name = strings.TrimPrefix(name, "name=")
+	if name == "" {
+		return "", true, fmt.Errorf("EXPORT --publish requires a name, e.g. --publish=frontend-dist")
+	}
+	return name, true, ValidateArtifactStoreName(name)
+}
+
+// publishExport publishes the source of the EXPORT to the artifact store; the
+// files are read from the image the EXPORT is made from, so the ones exported
+// by the earlier EXPORTs of the build are not published along with them
+func (b *Build) publishExport(s State, name, src string) error {
+	store, err := b.artifactStore()
+	if err != nil {
+		return err
+	}
+
+	srcPath := src
+	if !path.IsAbs(srcPath) {
+		srcPath = path.Join("/", s.Config.WorkingDir, srcPath)
+	}
+
+	s.Config.Cmd = []string{"/bin/sh", "-c", "#(nop) EXPORT --publish=" + name}
+	s.Config.Entrypoint = []string{}
+	s.Config.Labels = b.containerLabels(s.Config.Labels)
+
+	containerID, err := b.client.CreateContainer(s)
+	if err != nil {
+		return err
+	}
+	defer b.client.RemoveContainer(containerID)
+
+	var (
+		pipeReader, pipeWriter = io.Pipe()
+		downloaded             = make(chan error, 1)
+	)
+
+	go func() {
+		err := b.client.DownloadFromContainer(containerID, srcPath, pipeWriter)
+		pipeWriter.CloseWithError(err)
+		downloaded <- err
+	}()
+
+	a, err := store.Publish(name, pipeReader)
+	pipeReader.Close()
+
+	// The download fails with the closed pipe if the publish failed first
+	if downloadErr := <-downloaded; downloadErr != nil && downloadErr != io.ErrClosedPipe {
+		return fmt.Errorf("Failed to read %s to publish, error: %s", srcPath, downloadErr)
+	}
+	if err != nil {
+		return fmt.Errorf("Failed to publish artifact %s, error: %s", name, err)
+	}
+
+	log.Infof("| Published %s as %s%s (%s, %d files)", srcPath, artifactSourcePrefix, name, a.Digest, a.Files)
+	return nil
+}
+
+// importArtifact copies the files published to the artifact store to the
+// destination directory; the digest of the archive is the cache key of
+// the step, so the step is rebuilt once the files are published again
+func importArtifact(b *Build, from string, args []string, flags map[string]string) (s State, err error) {
+	s = b.state
+
+	if !strings.HasPrefix(from, artifactSourcePrefix) {
+		return s, fmt.Errorf("IMPORT --from should be %s<name>, got %q", artifactSourcePrefix, from)
+	}
+	if len(args) != 1 {
+		return s, fmt.Errorf("IMPORT --from=%s requires exactly one argument, the destination directory", from)
+	}
+
+	store, err := b.artifactStore()
+	if err != nil {
+		return s, err
+	}
+
+	a, err := store.Get(strings.TrimPrefix(from, artifactSourcePrefix))
+	if err != nil {
+		return s, err
+	}
+
+	dest := filepath.FromSlash(args[0])
+	if !filepath.IsAbs(dest) {
+		dest = filepath.Join(s.Config.WorkingDir, dest)
+	}
+
+	chown, hasChown := flags["chown"]
+	if hasChown {
+		if chown, err = resolveChown(b, &s, chown); err != nil {
+			return s, err
+		}
+	}
+
+	message := fmt.Sprintf("IMPORT %s%s@%s to %s", artifactSourcePrefix, a.Name, a.Digest, dest)
+	if hasChown {
+		message += " chown " + chown
+	}
+	s.Commit("%s", message)
+
+	s, hit, err := b.probeCache(s)
+	if err != nil {
+		return s, err
+	}
+	if hit {
+		return s, nil
+	}
+
+	log.Infof("| Import %s%s (%s) to %s", artifactSourcePrefix, a.Name, a.Digest, dest)
+
+	origCmd := s.Config.Cmd
+	s.Config.Cmd = []string{"/bin/sh", "-c", "#(nop) " + message}
+
+	if s.NoCache.ContainerID, err = b.client.CreateContainer(s); err != nil {
+		return s, err
+	}
+
+	s.Config.Cmd = origCmd
+
+	archive, err := store.Open(a)
+	if err != nil {
+		return s, err
+	}
+
+	var stream = prefixTarStream(archive, dest)
+	if hasChown {
+		if stream, err = chownTarStream(stream, chown); err != nil {
+			return s, err
+		}
+	}
+	defer stream.Close()
+
+	// Upload to "/" because the destination is the prefix inside the tar archive
+	if err = b.client.UploadToContainer(s.NoCache.ContainerID, stream, "/"); err != nil {
+		return s, err
+	}
+
+	return s, nil
+}
+
+// artifactStoreReader closes both the gzip reader and the archive file
+type artifactStoreReader struct {
+	*gzip.Reader
+	fd *os.File
+}
+
+func (r *artifactStoreReader) Close() error {
+	r.Reader.Close()
+	return r.fd.Close()
+}
+
+type storedArtifactsByName []StoredArtifact
+
+func (a storedArtifactsByName) Len() int           { return len(a) }
+func (a storedArtifactsByName) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a storedArtifactsByName) Less(i, j int) bool { return a[i].Name < a[j].Name }
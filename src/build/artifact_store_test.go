@@ -0,0 +1,261 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestArtifactStore(t *testing.T) {
+	tmpDir := cacheTestTmpDir(t)
+	defer os.RemoveAll(tmpDir)
+
+	store := NewArtifactStore(tmpDir)
+
+	a1, err := store.Publish("frontend-dist", makeTestArtifactTar(t, time.Now(), 1000))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the same files with other times and owners make the same archive
+	a2, err := store.Publish("frontend-copy", makeTestArtifactTar(t, time.Now().Add(-time.Hour), 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, a1.Digest, a2.Digest)
+	assert.Equal(t, 3, a1.Files)
+
+	blobs, _ := filepath.Glob(filepath.Join(tmpDir, "blobs", "*.tgz"))
+	assert.Len(t, blobs, 1)
+
+	a, err := store.Get("frontend-dist")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, a1.Digest, a.Digest)
+
+	r, err := store.Open(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// all kinds of the entries are kept, the top directory is left out
+	tr := tar.NewReader(r)
+	var entries []string
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, 0, hdr.Uid)
+		assert.Equal(t, int64(0), hdr.ModTime.Unix())
+		entries = append(entries, fmt.Sprintf("%c %s %s", hdr.Typeflag, hdr.Name, hdr.Linkname))
+	}
+	r.Close()
+	assert.Equal(t, []string{
+		"0 index.html ",
+		"5 js/ ",
+		"0 js/app.js ",
+		"5 empty/ ",
+		"2 latest.js js/app.js",
+	}, entries)
+
+	_, err = store.Get("backend")
+	assert.EqualError(t, err, "Artifact backend is not published to "+tmpDir+", EXPORT --publish=backend it first")
+
+	_, err = store.Publish("../etc", makeTestArtifactTar(t, time.Now(), 0))
+	assert.EqualError(t, err, "Invalid artifact name \"../etc\", it should consist of letters, digits, '_', '.' and '-'")
+
+	// republishing leaves the previous archive to the GC
+	if _, err := store.Publish("frontend-copy", makeTestTar(t, []string{"index.html"})); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-48 * time.Hour)
+	if err := os.Chtimes(store.nameFile("frontend-dist"), old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	removed, err := store.GC(24 * time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []string{"frontend-dist"}, removed)
+
+	list, err := store.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Len(t, list, 1)
+	assert.Equal(t, "frontend-copy", list[0].Name)
+
+	blobs, _ = filepath.Glob(filepath.Join(tmpDir, "blobs", "*.tgz"))
+	assert.Equal(t, []string{store.blobFile(list[0].Digest)}, blobs)
+}
+
+// makeTestArtifactTar makes the archive of the dist directory the way the
+// docker does, with the given times and owners
+func makeTestArtifactTar(t *testing.T, modTime time.Time, uid int) *bytes.Buffer {
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	for _, hdr := range []*tar.Header{
+		{Name: "dist/", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "dist/index.html", Typeflag: tar.TypeReg, Mode: 0644, Size: 7},
+		{Name: "dist/js/", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "dist/js/app.js", Typeflag: tar.TypeReg, Mode: 0644, Size: 5},
+		{Name: "dist/empty/", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "dist/latest.js", Typeflag: tar.TypeSymlink, Linkname: "js/app.js", Mode: 0777},
+	} {
+		hdr.ModTime, hdr.Uid, hdr.Gid = modTime, uid, uid
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(make([]byte, hdr.Size)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf
+}
+
+func TestExportPublishName(t *testing.T) {
+	name, ok, err := exportPublishName(map[string]string{"publish": "name=frontend-dist"})
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, "frontend-dist", name)
+
+	_, ok, _ = exportPublishName(map[string]string{})
+	assert.False(t, ok)
+
+	_, _, err = exportPublishName(map[string]string{"publish": ""})
+	assert.EqualError(t, err, "EXPORT --publish requires a name, e.g. --publish=frontend-dist")
+}
+
+func TestPublishExport(t *testing.T) {
+	tmpDir := cacheTestTmpDir(t)
+	defer os.RemoveAll(tmpDir)
+
+	b, c := makeBuild(t, "", Config{CacheDir: tmpDir})
+	b.state.ImageID = "123"
+	b.state.Config.WorkingDir = "/src"
+
+	c.On("CreateContainer", mock.AnythingOfType("State")).Return("456", nil).Once()
+	c.On("DownloadFromContainer", "456", "/src/dist", mock.Anything).Run(func(args mock.Arguments) {
+		io.Copy(args.Get(2).(io.Writer), makeTestTar(t, []string{"dist/", "dist/index.html"}))
+	}).Return(nil).Once()
+	c.On("RemoveContainer", "456").Return(nil).Once()
+
+	if err := b.publishExport(b.state, "frontend-dist", "dist/"); err != nil {
+		t.Fatal(err)
+	}
+	c.AssertExpectations(t)
+
+	a, err := NewArtifactStore(filepath.Join(tmpDir, ArtifactStoreDir)).Get("frontend-dist")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 1, a.Files)
+}
+
+func TestPublishExport_DownloadFailed(t *testing.T) {
+	tmpDir := cacheTestTmpDir(t)
+	defer os.RemoveAll(tmpDir)
+
+	b, c := makeBuild(t, "", Config{CacheDir: tmpDir})
+	b.state.ImageID = "123"
+
+	c.On("CreateContainer", mock.AnythingOfType("State")).Return("456", nil).Once()
+	c.On("DownloadFromContainer", "456", "/dist", mock.Anything).Return(fmt.Errorf("no such file")).Once()
+	c.On("RemoveContainer", "456").Return(nil).Once()
+
+	err := b.publishExport(b.state, "frontend-dist", "/dist")
+	assert.EqualError(t, err, "Failed to read /dist to publish, error: no such file")
+	c.AssertExpectations(t)
+
+	_, err = NewArtifactStore(filepath.Join(tmpDir, ArtifactStoreDir)).Get("frontend-dist")
+	assert.Error(t, err)
+}
+
+func TestCommandImport_FromArtifact(t *testing.T) {
+	tmpDir := cacheTestTmpDir(t)
+	defer os.RemoveAll(tmpDir)
+
+	a, err := NewArtifactStore(filepath.Join(tmpDir, ArtifactStoreDir)).Publish("frontend-dist", makeTestTar(t, []string{"index.html"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, c := makeBuild(t, "", Config{CacheDir: tmpDir})
+	b.state.ImageID = "123"
+	b.state.Config.WorkingDir = "/app"
+
+	cmd := NewCommand(ConfigCommand{
+		name:  "import",
+		args:  []string{"static"},
+		flags: map[string]string{"from": "artifact:frontend-dist"},
+	})
+
+	var uploaded []string
+
+	c.On("CreateContainer", mock.AnythingOfType("State")).Return("dst", nil).Once()
+	c.On("UploadToContainer", "dst", mock.Anything, "/").Run(func(args mock.Arguments) {
+		uploaded = readTestTarNames(t, args.Get(1).(io.Reader))
+	}).Return(nil).Once()
+
+	state, err := cmd.Execute(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.AssertExpectations(t)
+	assert.Equal(t, []string{"app/static/index.html"}, uploaded)
+	assert.Equal(t, "IMPORT artifact:frontend-dist@"+a.Digest+" to /app/static", state.GetCommits())
+
+	// the destination is not the format of the commit
+	b.state.ImageID = "123"
+	cmd = NewCommand(ConfigCommand{
+		name:  "import",
+		args:  []string{"/static%d"},
+		flags: map[string]string{"from": "artifact:frontend-dist"},
+	})
+	c.On("CreateContainer", mock.AnythingOfType("State")).Return("dst2", nil).Once()
+	c.On("UploadToContainer", "dst2", mock.Anything, "/").Return(nil).Once()
+	if state, err = cmd.Execute(b); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "IMPORT artifact:frontend-dist@"+a.Digest+" to /static%d", state.GetCommits())
+
+	cmd = NewCommand(ConfigCommand{
+		name:  "import",
+		args:  []string{"static"},
+		flags: map[string]string{"from": "frontend-dist"},
+	})
+	_, err = cmd.Execute(b)
+	assert.EqualError(t, err, "IMPORT --from should be artifact:<name>, got \"frontend-dist\"")
+}
@@ -0,0 +1,168 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/grammarly/rocker/src/dockerclient"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+const testDigestHex = "fafa0000000000000000000000000000000000000000000000000000000000fa"
+
+func makeTestChart(t *testing.T) string {
+	tmpDir, err := ioutil.TempDir("", "rocker-artifact-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{
+		"chart/Chart.yaml":           "apiVersion: v2\nname: app\nversion: 1.2.0\n",
+		"chart/values.yaml":          "replicas: 1\n",
+		"chart/templates/deploy.yml": "kind: Deployment\n",
+	}
+	for name, content := range files {
+		file := filepath.Join(tmpDir, name)
+		if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(file, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return tmpDir
+}
+
+func TestParseArtifactArgs(t *testing.T) {
+	kind, src, ref, err := parseArtifactArgs(ConfigCommand{
+		args: []string{"chart", "./chart", "--push", "oci://registry.io/charts/app:1.2.0"},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "chart", kind)
+	assert.Equal(t, "./chart", src)
+	assert.Equal(t, "registry.io/charts/app:1.2.0", ref)
+
+	_, _, ref, err = parseArtifactArgs(ConfigCommand{
+		args:  []string{"file", "app.tgz"},
+		flags: map[string]string{"push": "registry.io/app:1"},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "registry.io/app:1", ref)
+
+	_, _, _, err = parseArtifactArgs(ConfigCommand{args: []string{"chart", "./chart"}})
+	assert.Contains(t, err.Error(), "ARTIFACT requires the kind, the source and the destination")
+}
+
+func TestCommandArtifact_Chart(t *testing.T) {
+	tmpDir := makeTestChart(t)
+	defer os.RemoveAll(tmpDir)
+
+	b, c := makeBuild(t, "", Config{ContextDir: tmpDir, Push: true})
+	cmd := NewCommand(ConfigCommand{
+		name: "artifact",
+		args: []string{"chart", "./chart", "--push", "oci://registry.io/charts/app:1.2.0"},
+	})
+
+	var pushed dockerclient.OCIArtifact
+	c.On("PushArtifact", "registry.io/charts/app:1.2.0", mock.AnythingOfType("dockerclient.OCIArtifact")).Run(func(args mock.Arguments) {
+		pushed = args.Get(1).(dockerclient.OCIArtifact)
+	}).Return("sha256:"+testDigestHex, nil).Once()
+
+	if _, err := cmd.Execute(b); err != nil {
+		t.Fatal(err)
+	}
+	c.AssertExpectations(t)
+
+	assert.Equal(t, helmChartConfigMediaType, pushed.Config.MediaType)
+	config := map[string]string{}
+	assert.NoError(t, json.Unmarshal(pushed.Config.Data, &config))
+	assert.Equal(t, map[string]string{"apiVersion": "v2", "name": "app", "version": "1.2.0"}, config)
+
+	assert.Len(t, pushed.Layers, 1)
+	assert.Equal(t, helmChartContentMediaType, pushed.Layers[0].MediaType)
+
+	gr, err := gzip.NewReader(bytes.NewReader(pushed.Layers[0].Data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{}
+	tr := tar.NewReader(gr)
+	for {
+		hdr, err := tr.Next()
+		if err != nil {
+			break
+		}
+		names = append(names, hdr.Name)
+	}
+	assert.Equal(t, []string{"app/Chart.yaml", "app/templates/deploy.yml", "app/values.yaml"}, names)
+
+	assert.Len(t, b.Artifacts, 1)
+	assert.Equal(t, "chart", b.Artifacts[0].Type)
+	assert.Equal(t, "registry.io/charts/app@sha256:"+testDigestHex, b.Artifacts[0].Addressable)
+	assert.NoError(t, b.Artifacts[0].Validate())
+}
+
+func TestCommandArtifact_NoChartYaml(t *testing.T) {
+	tmpDir := makeTestChart(t)
+	defer os.RemoveAll(tmpDir)
+
+	b, _ := makeBuild(t, "", Config{ContextDir: tmpDir})
+	cmd := NewCommand(ConfigCommand{
+		name: "artifact",
+		args: []string{"chart", "./chart/templates", "--push", "oci://registry.io/charts/app:1.2.0"},
+	})
+
+	_, err := cmd.Execute(b)
+	assert.EqualError(t, err, "Failed to package chart ./chart/templates, error: Chart.yaml is not found")
+}
+
+func TestPackageChart_Reproducible(t *testing.T) {
+	files := []artifactFile{
+		{"values.yaml", 0644, []byte("replicas: 1\n")},
+		{"Chart.yaml", 0644, []byte("name: app\nversion: 1.0.0\n")},
+	}
+	a1, err := packageChart(files, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a2, err := packageChart([]artifactFile{files[1], files[0]}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, a1.Layers[0].Data, a2.Layers[0].Data)
+}
+
+func TestReadArtifactTar(t *testing.T) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	tw.WriteHeader(&tar.Header{Name: "chart/", Typeflag: tar.TypeDir, Mode: 0755})
+	tw.WriteHeader(&tar.Header{Name: "chart/Chart.yaml", Typeflag: tar.TypeReg, Mode: 0644, Size: 4})
+	tw.Write([]byte("a: b"))
+	tw.Close()
+
+	files, err := readArtifactTar(&buf)
+	assert.NoError(t, err)
+	assert.Equal(t, []artifactFile{{"Chart.yaml", 0644, []byte("a: b")}}, files)
+}
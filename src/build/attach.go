@@ -0,0 +1,83 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package build
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/docker/docker/pkg/nat"
+	"github.com/fsouza/go-dockerclient"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// attachPorts publishes the ports of the ATTACH container to the host,
+// ATTACH --publish=8080:8080,127.0.0.1::9000 takes the port specs of
+// docker run -p, while --publish-all publishes the exposed ports of the
+// image to random host ports. The container is never committed, so the
+// ports do not leak to the image.
+func attachPorts(s State, flags map[string]string) (State, error) {
+	if v, ok := flags["publish-all"]; ok {
+		publishAll, err := parseBoolFlag(v)
+		if err != nil {
+			return s, fmt.Errorf("ATTACH --publish-all expects true or false, got %q", v)
+		}
+		s.NoCache.HostConfig.PublishAllPorts = publishAll
+		if publishAll {
+			log.Infof("| Publish all exposed ports, see docker port <container> for the host ports")
+		}
+	}
+
+	specs := splitFlagList(flags["publish"])
+	if len(specs) == 0 {
+		return s, nil
+	}
+
+	exposed, bindings, err := nat.ParsePortSpecs(specs)
+	if err != nil {
+		return s, fmt.Errorf("ATTACH --publish: %s", err)
+	}
+
+	// The maps are shared with the state restored after ATTACH, so they are copied
+	exposedPorts := map[docker.Port]struct{}{}
+	for port := range s.Config.ExposedPorts {
+		exposedPorts[port] = struct{}{}
+	}
+	for port := range exposed {
+		exposedPorts[docker.Port(port)] = struct{}{}
+	}
+
+	portBindings := map[docker.Port][]docker.PortBinding{}
+	for port, list := range s.NoCache.HostConfig.PortBindings {
+		portBindings[port] = list
+	}
+	for port, list := range bindings {
+		for _, b := range list {
+			portBindings[docker.Port(port)] = append(portBindings[docker.Port(port)], docker.PortBinding{
+				HostIP:   b.HostIP,
+				HostPort: b.HostPort,
+			})
+		}
+	}
+
+	s.Config.ExposedPorts = exposedPorts
+	s.NoCache.HostConfig.PortBindings = portBindings
+
+	log.Infof("| Publish %s", strings.Join(specs, ", "))
+
+	return s, nil
+}
@@ -0,0 +1,70 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package build
+
+import (
+	"testing"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestCommandAttach_Publish(t *testing.T) {
+	b, c := makeBuild(t, "", Config{Attach: true})
+	cmd := NewCommand(ConfigCommand{
+		name:  "attach",
+		flags: map[string]string{"publish": "8080:80,127.0.0.1::9000/udp", "publish-all": ""},
+	})
+
+	b.state.ImageID = "123"
+	b.state.Config.ExposedPorts = map[docker.Port]struct{}{"443/tcp": {}}
+
+	c.On("CreateContainer", mock.AnythingOfType("State")).Return("456", nil).Run(func(args mock.Arguments) {
+		s := args.Get(0).(State)
+		assert.Equal(t, map[docker.Port]struct{}{"443/tcp": {}, "80/tcp": {}, "9000/udp": {}}, s.Config.ExposedPorts)
+		assert.Equal(t, map[docker.Port][]docker.PortBinding{
+			"80/tcp":   {{HostPort: "8080"}},
+			"9000/udp": {{HostIP: "127.0.0.1"}},
+		}, s.NoCache.HostConfig.PortBindings)
+		assert.True(t, s.NoCache.HostConfig.PublishAllPorts)
+	}).Once()
+
+	c.On("RunContainer", "456", true).Return(nil).Once()
+
+	state, err := cmd.Execute(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.AssertExpectations(t)
+	assert.Equal(t, map[docker.Port]struct{}{"443/tcp": {}}, state.Config.ExposedPorts, "should not leak to the image")
+	assert.Nil(t, state.NoCache.HostConfig.PortBindings)
+	assert.False(t, state.NoCache.HostConfig.PublishAllPorts)
+}
+
+func TestCommandAttach_PublishInvalid(t *testing.T) {
+	b, _ := makeBuild(t, "", Config{Attach: true})
+	cmd := NewCommand(ConfigCommand{
+		name:  "attach",
+		flags: map[string]string{"publish": "8080:http"},
+	})
+
+	b.state.ImageID = "123"
+
+	_, err := cmd.Execute(b)
+	assert.Contains(t, err.Error(), "ATTACH --publish")
+}
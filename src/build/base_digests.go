@@ -0,0 +1,285 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/go-yaml/yaml"
+	"github.com/grammarly/rocker/src/imagename"
+	"github.com/grammarly/rocker/src/util"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// The actions of the base digest policy on the FROM image that is not blessed
+const (
+	BaseDigestAllow = "allow"
+	BaseDigestWarn  = "warn"
+	BaseDigestFail  = "fail"
+)
+
+// DefaultBaseDigestsRefresh is how long the blessed digests fetched from the url are used
+const DefaultBaseDigestsRefresh = 10 * time.Minute
+
+// BaseDigestPolicy verifies the digests the FROM images are resolved to
+// against the allowlist of the blessed ones, e.g. the patched bases; the
+// images that are not in the allowlist are not verified
+type BaseDigestPolicy struct {
+	// Action is warn or fail, fail by default
+	Action string `yaml:"action"`
+
+	// Images are the blessed digests by image name, e.g.
+	// ubuntu: [sha256:...]; the tags of the names are ignored
+	Images map[string][]string `yaml:"images"`
+
+	// URL or File is the allowlist in the same format as Images, the
+	// blessed digests of both are merged; URL is fetched again after Refresh
+	URL     string `yaml:"url"`
+	File    string `yaml:"file"`
+	Refresh string `yaml:"refresh"`
+
+	refresh   time.Duration
+	mu        sync.Mutex
+	fetched   map[string][]string
+	fetchedAt time.Time
+}
+
+// BaseDigestVerdict is the decision of the base digest policy on a FROM image
+type BaseDigestVerdict struct {
+	// Digest is the blessed digest of the image, or the one it was resolved
+	// to if none is blessed; empty if the image has no registry digest
+	Digest  string `json:"digest,omitempty"`
+	Blessed bool   `json:"blessed"`
+	Action  string `json:"action"`
+}
+
+// compile validates the policy and normalizes the image names
+func (p *BaseDigestPolicy) compile() error {
+	switch p.Action {
+	case "":
+		p.Action = BaseDigestFail
+	case BaseDigestWarn, BaseDigestFail:
+	default:
+		return fmt.Errorf("base-digests action should be warn or fail, got %q", p.Action)
+	}
+
+	if p.Images == nil && p.URL == "" && p.File == "" {
+		return fmt.Errorf("base-digests should have images, url or file")
+	}
+
+	p.refresh = DefaultBaseDigestsRefresh
+	if p.Refresh != "" {
+		refresh, err := time.ParseDuration(p.Refresh)
+		if err != nil {
+			return fmt.Errorf("base-digests refresh %q is malformed, error: %s", p.Refresh, err)
+		}
+		p.refresh = refresh
+	}
+
+	images, err := normalizeBaseDigests(p.Images)
+	if err != nil {
+		return err
+	}
+	p.Images = images
+
+	if p.File != "" {
+		data, err := ioutil.ReadFile(p.File)
+		if err != nil {
+			return fmt.Errorf("Failed to read base-digests file %s, error: %s", p.File, err)
+		}
+		if p.Images, err = mergeBaseDigests(p.Images, data, p.File); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Blessed returns the blessed digests of the images, fetching the url
+// if the digests fetched before are older than the refresh interval
+func (p *BaseDigestPolicy) Blessed() (map[string][]string, error) {
+	if p.URL == "" {
+		return p.Images, nil
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.fetched != nil && time.Since(p.fetchedAt) < p.refresh {
+		return p.fetched, nil
+	}
+
+	fetched, err := p.fetch()
+	if err != nil {
+		// The digests fetched before are better than none
+		if p.fetched != nil {
+			log.Warnf("Failed to refresh the blessed base digests, using the ones fetched %s ago, error: %s",
+				time.Since(p.fetchedAt).Round(time.Second), err)
+			return p.fetched, nil
+		}
+		return nil, err
+	}
+
+	p.fetched, p.fetchedAt = fetched, time.Now()
+	return p.fetched, nil
+}
+
+func (p *BaseDigestPolicy) fetch() (map[string][]string, error) {
+	if err := util.CheckOffline("fetch the blessed base digests from %s", p.URL); err != nil {
+		return nil, err
+	}
+
+	client := &http.Client{Timeout: 30 * time.Second}
+
+	resp, err := client.Get(p.URL)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to fetch the blessed base digests from %s, error: %s", p.URL, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Failed to fetch the blessed base digests from %s, status: %s", p.URL, resp.Status)
+	}
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to fetch the blessed base digests from %s, error: %s", p.URL, err)
+	}
+
+	return mergeBaseDigests(p.Images, data, p.URL)
+}
+
+// Verify returns the verdict on the image the FROM name is resolved to;
+// the second value is false if the image is not in the allowlist
+func (p *BaseDigestPolicy) Verify(name string, img *docker.Image) (BaseDigestVerdict, bool, error) {
+	blessed, err := p.Blessed()
+	if err != nil {
+		return BaseDigestVerdict{}, false, err
+	}
+
+	digests, ok := blessed[imagename.NewFromString(name).CanonicalName()]
+	if !ok {
+		return BaseDigestVerdict{}, false, nil
+	}
+
+	verdict := BaseDigestVerdict{Action: p.Action}
+	for _, repoDigest := range img.RepoDigests {
+		parts := strings.SplitN(repoDigest, "@", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		if verdict.Digest == "" {
+			verdict.Digest = parts[1]
+		}
+		for _, digest := range digests {
+			if parts[1] == digest {
+				verdict.Digest, verdict.Blessed, verdict.Action = digest, true, BaseDigestAllow
+				return verdict, true, nil
+			}
+		}
+	}
+
+	return verdict, true, nil
+}
+
+// verifyBaseDigest checks the image resolved by FROM by the base digest
+// policy, if there is one; the original name of FROM is looked up in the
+// allowlist, while the image may be pulled through a mirror
+func (b *Build) verifyBaseDigest(name string, img *docker.Image) (*BaseDigestVerdict, error) {
+	if b.cfg.Policy == nil || b.cfg.Policy.BaseDigests == nil {
+		return nil, nil
+	}
+
+	verdict, ok, err := b.cfg.Policy.BaseDigests.Verify(name, img)
+	if err != nil || !ok {
+		return nil, err
+	}
+
+	if verdict.Blessed {
+		log.Infof("| Base image %s is blessed (%s)", name, verdict.Digest)
+		return &verdict, nil
+	}
+
+	digest := verdict.Digest
+	if digest == "" {
+		digest = "no registry digest"
+	}
+	msg := fmt.Sprintf("Base image %s (%s) is not blessed by policy %s", name, digest, b.cfg.Policy.fileName)
+
+	if verdict.Action == BaseDigestFail {
+		return &verdict, fmt.Errorf("%s", msg)
+	}
+	return &verdict, b.warn("%s", msg)
+}
+
+// normalizeBaseDigests keys the blessed digests by the canonical image names
+func normalizeBaseDigests(images map[string][]string) (map[string][]string, error) {
+	result := map[string][]string{}
+	for name, digests := range images {
+		if name == "" {
+			return nil, fmt.Errorf("base-digests image name is empty")
+		}
+		key := imagename.NewFromString(name).CanonicalName()
+		for _, digest := range digests {
+			if !strings.Contains(digest, ":") {
+				return nil, fmt.Errorf("base-digests digest %q of %s is malformed, expected sha256:<hex>", digest, name)
+			}
+			result[key] = append(result[key], digest)
+		}
+	}
+	return result, nil
+}
+
+// mergeBaseDigests adds the allowlist read from the source to the blessed digests
+func mergeBaseDigests(images map[string][]string, data []byte, source string) (map[string][]string, error) {
+	list := map[string][]string{}
+	if err := yaml.Unmarshal(data, &list); err != nil {
+		return nil, fmt.Errorf("Failed to parse the blessed base digests of %s, error: %s", source, err)
+	}
+
+	normalized, err := normalizeBaseDigests(list)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid blessed base digests of %s, error: %s", source, err)
+	}
+
+	result := map[string][]string{}
+	for name, digests := range images {
+		result[name] = append(result[name], digests...)
+	}
+	for name, digests := range normalized {
+		result[name] = append(result[name], digests...)
+	}
+	return result, nil
+}
+
+// BaseDigestVerdicts returns the decisions of the base digest policy by the FROM names
+func (b *Build) BaseDigestVerdicts() map[string]BaseDigestVerdict {
+	verdicts := map[string]BaseDigestVerdict{}
+	for _, from := range b.From {
+		if from.Verdict != nil {
+			verdicts[from.Name] = *from.Verdict
+		}
+	}
+	return verdicts
+}
@@ -0,0 +1,170 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/grammarly/rocker/src/util"
+	"github.com/stretchr/testify/assert"
+)
+
+const testBaseDigestsPolicy = `
+base-digests:
+  action: fail
+  images:
+    ubuntu:16.04:
+      - sha256:blessed
+`
+
+func TestBaseDigestPolicy_Verify(t *testing.T) {
+	p, err := readPolicySource(t, testBaseDigestsPolicy)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	verdict, ok, err := p.BaseDigests.Verify("docker.io/library/ubuntu:16.10", &docker.Image{
+		RepoDigests: []string{"ubuntu@sha256:old", "mirror.internal/library/ubuntu@sha256:blessed"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, ok)
+	assert.Equal(t, BaseDigestVerdict{Digest: "sha256:blessed", Blessed: true, Action: BaseDigestAllow}, verdict)
+
+	verdict, ok, err = p.BaseDigests.Verify("ubuntu", &docker.Image{RepoDigests: []string{"ubuntu@sha256:old"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, ok)
+	assert.Equal(t, BaseDigestVerdict{Digest: "sha256:old", Action: BaseDigestFail}, verdict)
+
+	_, ok, err = p.BaseDigests.Verify("alpine", &docker.Image{})
+	assert.Nil(t, err)
+	assert.False(t, ok, "should not verify the images out of the allowlist")
+}
+
+func TestBaseDigestPolicy_URLRefresh(t *testing.T) {
+	digest := "sha256:first"
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		fmt.Fprintf(w, `{"ubuntu": ["%s"]}`, digest)
+	}))
+	defer server.Close()
+
+	p, err := readPolicySource(t, "base-digests: {url: '"+server.URL+"', refresh: 1h}")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	blessed, err := p.BaseDigests.Blessed()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []string{"sha256:first"}, blessed["docker.io/library/ubuntu"])
+
+	digest = "sha256:second"
+	blessed, _ = p.BaseDigests.Blessed()
+	assert.Equal(t, []string{"sha256:first"}, blessed["docker.io/library/ubuntu"])
+	assert.Equal(t, 1, requests)
+
+	p.BaseDigests.fetchedAt = time.Now().Add(-2 * time.Hour)
+	blessed, _ = p.BaseDigests.Blessed()
+	assert.Equal(t, []string{"sha256:second"}, blessed["docker.io/library/ubuntu"])
+
+	// The digests fetched before are used if the refresh fails
+	server.Close()
+	p.BaseDigests.fetchedAt = time.Now().Add(-2 * time.Hour)
+	blessed, err = p.BaseDigests.Blessed()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"sha256:second"}, blessed["docker.io/library/ubuntu"])
+}
+
+func TestBaseDigestPolicy_URLOffline(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		fmt.Fprint(w, `{"ubuntu": ["sha256:first"]}`)
+	}))
+	defer server.Close()
+
+	p, err := readPolicySource(t, "base-digests: {url: '"+server.URL+"'}")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	util.SetOffline(true)
+	defer util.SetOffline(false)
+
+	_, err = p.BaseDigests.Blessed()
+	assert.EqualError(t, err, "Cannot fetch the blessed base digests from "+server.URL+" in offline mode (--offline)")
+	assert.Equal(t, 0, requests)
+}
+
+func TestBaseDigestPolicy_Invalid(t *testing.T) {
+	for _, source := range []string{
+		"base-digests: {}",
+		"base-digests: {action: ignore, images: {ubuntu: ['sha256:a']}}",
+		"base-digests: {refresh: soon, url: 'http://localhost'}",
+		"base-digests: {images: {ubuntu: [abc]}}",
+	} {
+		_, err := readPolicySource(t, source)
+		assert.Error(t, err, source)
+	}
+}
+
+func TestCommandFrom_BaseDigestNotBlessed(t *testing.T) {
+	p, err := readPolicySource(t, testBaseDigestsPolicy)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, c := makeBuild(t, "", Config{Policy: p})
+	cmd := NewCommand(ConfigCommand{
+		name: "from",
+		args: []string{"ubuntu:16.04"},
+	})
+
+	c.On("InspectImage", "ubuntu:16.04").Return(&docker.Image{
+		ID:          "123",
+		RepoDigests: []string{"ubuntu@sha256:old"},
+	}, nil).Once()
+
+	_, err = cmd.Execute(b)
+	assert.Contains(t, err.Error(), "Base image ubuntu:16.04 (sha256:old) is not blessed by policy")
+
+	// With the warn action the build goes on and records the verdict
+	p.BaseDigests.Action = BaseDigestWarn
+	c.On("InspectImage", "ubuntu:16.04").Return(&docker.Image{
+		ID:          "123",
+		RepoDigests: []string{"ubuntu@sha256:old"},
+	}, nil).Once()
+
+	if _, err := cmd.Execute(b); err != nil {
+		t.Fatal(err)
+	}
+	c.AssertExpectations(t)
+	assert.Equal(t, map[string]BaseDigestVerdict{
+		"ubuntu:16.04": {Digest: "sha256:old", Action: BaseDigestWarn},
+	}, b.BaseDigestVerdicts())
+}
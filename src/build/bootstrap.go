@@ -0,0 +1,276 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+
+	"github.com/grammarly/rocker/src/imagename"
+	"github.com/grammarly/rocker/src/util"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// BootstrapFile is the file within the cache dir that records the verified helper images
+const BootstrapFile = "bootstrap.json"
+
+// BootstrapImage is the helper image verified by Bootstrap
+type BootstrapImage struct {
+	ID       string    `json:"id"`
+	Verified time.Time `json:"verified"`
+}
+
+// BootstrapOptions stores the options of Bootstrap
+type BootstrapOptions struct {
+	CacheDir string
+	Pull     bool
+	Force    bool
+	// RsyncBinary is the path to the static rsync binary, when it is set
+	// the helper images are built locally instead of being pulled
+	RsyncBinary string
+}
+
+var helperImageNameRegexp = regexp.MustCompile("^[a-z0-9][a-z0-9._/-]*$")
+
+// HelperImages returns the images used for MOUNT, CACHE and EXPORT/IMPORT containers
+func HelperImages() []string {
+	return []string{RsyncImage, MountVolumeImage}
+}
+
+// helperImageCheck returns the command that checks the helper image is usable,
+// the images without a command are only checked to exist
+func helperImageCheck(image string) []string {
+	if image == RsyncImage {
+		return []string{"/opt/rsync/bin/rsync", "--version"}
+	}
+	return nil
+}
+
+// ValidateHelperImages checks the names of the helper images, so the misconfiguration
+// is reported at startup rather than by the first MOUNT or EXPORT of the build
+func ValidateHelperImages() error {
+	for _, name := range HelperImages() {
+		if err := ValidateHelperImage(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ValidateHelperImage checks the name of a helper image
+func ValidateHelperImage(name string) error {
+	if name == "" {
+		return fmt.Errorf("Helper image name is empty")
+	}
+
+	img := imagename.NewFromString(name)
+
+	if img.Storage == imagename.StorageS3 {
+		return fmt.Errorf("Invalid helper image %s, the images stored on S3 are not supported", name)
+	}
+	if img.HasTag() && !img.IsStrict() {
+		return fmt.Errorf("Invalid helper image %s, the tag should be exact", name)
+	}
+	if !helperImageNameRegexp.MatchString(img.Name) {
+		return fmt.Errorf("Invalid helper image %s, the name should consist of lowercase letters, digits and separators", name)
+	}
+
+	return nil
+}
+
+// Bootstrap pulls the helper images if they are missing, or always if pull is set,
+// and verifies them; the images verified earlier are skipped unless they have changed
+// or force is set. With RsyncBinary the images are built locally, which is the way
+// to bootstrap the hosts that have no access to the registry.
+func Bootstrap(client Client, options BootstrapOptions) error {
+	var (
+		fileName = filepath.Join(options.CacheDir, BootstrapFile)
+		verified = map[string]BootstrapImage{}
+		local    = options.RsyncBinary != ""
+	)
+
+	if local && options.Pull {
+		return fmt.Errorf("The helper images cannot be pulled and built locally at the same time")
+	}
+
+	if err := ValidateHelperImages(); err != nil {
+		return err
+	}
+
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("Failed to read %s, error: %s", fileName, err)
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &verified); err != nil {
+			log.Warnf("Ignore malformed %s, error: %s", fileName, err)
+			verified = map[string]BootstrapImage{}
+		}
+	}
+
+	for _, name := range HelperImages() {
+		switch {
+		case local:
+			err = buildHelperImage(client, name, options.RsyncBinary, options.Force)
+		case options.Pull:
+			err = client.PullImage(name)
+		default:
+			err = client.EnsureImage(name)
+		}
+		if err != nil {
+			return fmt.Errorf("Failed to get helper image %s, error: %s", name, err)
+		}
+
+		img, err := client.InspectImage(name)
+		if err != nil {
+			return err
+		}
+		if img == nil {
+			return fmt.Errorf("Helper image %s is not found after the pull", name)
+		}
+
+		if prev, ok := verified[name]; ok && prev.ID == img.ID && !options.Force {
+			log.Infof("| %s (%.12s) is verified", name, img.ID)
+			continue
+		}
+
+		if err := verifyHelperImage(client, name, img.ID); err != nil {
+			return err
+		}
+
+		verified[name] = BootstrapImage{ID: img.ID, Verified: time.Now()}
+		log.Infof("| Verified %s (%.12s)", name, img.ID)
+	}
+
+	if data, err = json.MarshalIndent(verified, "", "  "); err != nil {
+		return err
+	}
+	if err := util.MkdirAllOutput(options.CacheDir, 0755); err != nil {
+		return fmt.Errorf("Failed to create cache dir %s, error: %s", options.CacheDir, err)
+	}
+	if err := util.WriteOutputFile(fileName, data, 0644); err != nil {
+		return fmt.Errorf("Failed to write %s, error: %s", fileName, err)
+	}
+
+	return nil
+}
+
+// verifyHelperImage runs the check command of the helper image in a temporary container
+func verifyHelperImage(client Client, name, imageID string) error {
+	cmd := helperImageCheck(name)
+	if cmd == nil {
+		return nil
+	}
+
+	s := State{ImageID: imageID}
+	s.Config.Cmd = cmd
+	s.Config.Entrypoint = []string{}
+
+	containerID, err := client.CreateContainer(s)
+	if err != nil {
+		return fmt.Errorf("Failed to create container of helper image %s, error: %s", name, err)
+	}
+	defer client.RemoveContainer(containerID)
+
+	if err := client.RunContainer(containerID, false); err != nil {
+		return fmt.Errorf("Helper image %s is not usable, error: %s", name, err)
+	}
+
+	return nil
+}
+
+// buildHelperImage imports the helper image from a local filesystem unless it
+// already exists; the rsync image gets the given binary as /opt/rsync/bin/rsync,
+// the other images are empty
+func buildHelperImage(client Client, name, rsyncBinary string, force bool) error {
+	if !force {
+		img, err := client.InspectImage(name)
+		if err != nil {
+			return err
+		}
+		if img != nil {
+			return nil
+		}
+	}
+
+	var (
+		buf = &bytes.Buffer{}
+		tw  = tar.NewWriter(buf)
+		// docker does not create the containers without a command, though
+		// the volume containers of the scratch image are never started
+		changes = []string{`CMD ["/bin/true"]`}
+	)
+
+	if name == RsyncImage {
+		if err := tarRsyncBinary(tw, rsyncBinary); err != nil {
+			return err
+		}
+		changes = []string{`CMD ["/opt/rsync/bin/rsync", "--version"]`}
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+
+	return client.ImportImage(name, buf, changes)
+}
+
+// tarRsyncBinary writes /opt/rsync/bin/rsync into the tarball
+func tarRsyncBinary(tw *tar.Writer, rsyncBinary string) error {
+	f, err := os.Open(rsyncBinary)
+	if err != nil {
+		return fmt.Errorf("Failed to open rsync binary, error: %s", err)
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("Rsync binary %s is not a regular file", rsyncBinary)
+	}
+
+	for _, dir := range []string{"opt/", "opt/rsync/", "opt/rsync/bin/"} {
+		if err := tw.WriteHeader(&tar.Header{Name: dir, Mode: 0755, Typeflag: tar.TypeDir, ModTime: info.ModTime()}); err != nil {
+			return err
+		}
+	}
+
+	hdr := &tar.Header{
+		Name:     "opt/rsync/bin/rsync",
+		Mode:     0755,
+		Size:     info.Size(),
+		Typeflag: tar.TypeReg,
+		ModTime:  info.ModTime(),
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+
+	_, err = io.Copy(tw, f)
+	return err
+}
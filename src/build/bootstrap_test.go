@@ -0,0 +1,133 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestBootstrap(t *testing.T) {
+	tmpDir := cacheTestTmpDir(t)
+	defer os.RemoveAll(tmpDir)
+
+	c := &MockClient{}
+
+	c.On("EnsureImage", RsyncImage).Return(nil).Twice()
+	c.On("EnsureImage", MountVolumeImage).Return(nil).Twice()
+	c.On("InspectImage", RsyncImage).Return(&docker.Image{ID: "111"}, nil).Twice()
+	c.On("InspectImage", MountVolumeImage).Return(&docker.Image{ID: "222"}, nil).Twice()
+
+	c.On("CreateContainer", mock.AnythingOfType("State")).Return("456", nil).Run(func(args mock.Arguments) {
+		arg := args.Get(0).(State)
+		assert.Equal(t, "111", arg.ImageID)
+		assert.Equal(t, []string{"/opt/rsync/bin/rsync", "--version"}, arg.Config.Cmd)
+	}).Once()
+	c.On("RunContainer", "456", false).Return(nil).Once()
+	c.On("RemoveContainer", "456").Return(nil).Once()
+
+	if err := Bootstrap(c, BootstrapOptions{CacheDir: tmpDir}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The images are verified already, so no containers are run the second time
+	if err := Bootstrap(c, BootstrapOptions{CacheDir: tmpDir}); err != nil {
+		t.Fatal(err)
+	}
+
+	c.AssertExpectations(t)
+}
+
+func TestBootstrap_Broken(t *testing.T) {
+	tmpDir := cacheTestTmpDir(t)
+	defer os.RemoveAll(tmpDir)
+
+	c := &MockClient{}
+
+	c.On("PullImage", RsyncImage).Return(nil).Once()
+	c.On("InspectImage", RsyncImage).Return(&docker.Image{ID: "111"}, nil).Once()
+	c.On("CreateContainer", mock.AnythingOfType("State")).Return("456", nil).Once()
+	c.On("RunContainer", "456", false).Return(fmt.Errorf("exit code 127")).Once()
+	c.On("RemoveContainer", "456").Return(nil).Once()
+
+	err := Bootstrap(c, BootstrapOptions{CacheDir: tmpDir, Pull: true})
+	assert.EqualError(t, err, "Helper image "+RsyncImage+" is not usable, error: exit code 127")
+
+	c.AssertExpectations(t)
+}
+
+func TestBootstrap_Local(t *testing.T) {
+	tmpDir := cacheTestTmpDir(t)
+	defer os.RemoveAll(tmpDir)
+
+	rsyncBinary := filepath.Join(tmpDir, "rsync")
+	if err := ioutil.WriteFile(rsyncBinary, []byte("#!rsync"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	c := &MockClient{}
+
+	c.On("InspectImage", RsyncImage).Return((*docker.Image)(nil), nil).Once()
+	c.On("ImportImage", RsyncImage, mock.Anything, []string{`CMD ["/opt/rsync/bin/rsync", "--version"]`}).Return(nil).Run(func(args mock.Arguments) {
+		files := map[string]string{}
+		tr := tar.NewReader(args.Get(1).(io.Reader))
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, _ := ioutil.ReadAll(tr)
+			files[hdr.Name] = fmt.Sprintf("%o %s", hdr.Mode, data)
+		}
+		assert.Equal(t, "755 #!rsync", files["opt/rsync/bin/rsync"])
+	}).Once()
+	c.On("InspectImage", RsyncImage).Return(&docker.Image{ID: "111"}, nil).Once()
+
+	c.On("InspectImage", MountVolumeImage).Return(&docker.Image{ID: "222"}, nil).Twice()
+
+	c.On("CreateContainer", mock.AnythingOfType("State")).Return("456", nil).Once()
+	c.On("RunContainer", "456", false).Return(nil).Once()
+	c.On("RemoveContainer", "456").Return(nil).Once()
+
+	if err := Bootstrap(c, BootstrapOptions{CacheDir: tmpDir, RsyncBinary: rsyncBinary}); err != nil {
+		t.Fatal(err)
+	}
+
+	c.AssertExpectations(t)
+}
+
+func TestValidateHelperImage(t *testing.T) {
+	assert.Nil(t, ValidateHelperImage("grammarly/rsync-static:1"))
+	assert.Nil(t, ValidateHelperImage("registry.internal:5000/tools/scratch"))
+
+	assert.EqualError(t, ValidateHelperImage(""), "Helper image name is empty")
+	assert.EqualError(t, ValidateHelperImage("tools/rsync:1.*"), "Invalid helper image tools/rsync:1.*, the tag should be exact")
+	assert.EqualError(t, ValidateHelperImage("s3:bucket/rsync:1"), "Invalid helper image s3:bucket/rsync:1, the images stored on S3 are not supported")
+	assert.EqualError(t, ValidateHelperImage("Tools/Rsync"), "Invalid helper image Tools/Rsync, the name should consist of lowercase letters, digits and separators")
+}
@@ -20,8 +20,13 @@ import (
 	"fmt"
 	"io"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/grammarly/rocker/src/deprecation"
 	"github.com/grammarly/rocker/src/imagename"
+	"github.com/grammarly/rocker/src/template"
 
 	"github.com/docker/docker/pkg/units"
 	"github.com/fatih/color"
@@ -68,6 +73,129 @@ type Config struct {
 	CacheDir      string
 	LogJSON       bool
 	BuildArgs     map[string]string
+
+	ExplainCacheMiss bool
+
+	// ConfigDiff logs how every commit changes the config of the image,
+	// e.g. the added ENV and the changed CMD
+	ConfigDiff bool
+
+	// Strict turns the warnings about implicit behaviors into errors
+	Strict bool
+
+	// RecordBuildArgs adds the names of the build args consumed by ARG
+	// instructions to the rocker.build-args label of the image
+	RecordBuildArgs bool
+
+	// RecordBuildArgValues are the build args whose values are recorded
+	// too, except the ones that look like secrets
+	RecordBuildArgValues []string
+
+	// RecordVars commits the rocker-data label with the vars and the step keys
+	// of the Rockerfile to the images before TAG and PUSH, see RockerData
+	RecordVars bool
+
+	// MinFreeSpace is the free space in bytes the docker host should have
+	// before every step, the check is disabled if it is zero
+	MinFreeSpace int64
+
+	// MaxContextSize is the largest size in bytes of the build context after
+	// .dockerignore, the check is disabled if it is zero
+	MaxContextSize int64
+
+	// ContextSizeWarn only warns if the context exceeds MaxContextSize
+	ContextSizeWarn bool
+
+	// Prefetch resolves and pulls the FROM images concurrently before the
+	// first step, instead of one by one as the FROM steps come
+	Prefetch bool
+
+	// OnStep is called before and after every executed step, optional
+	OnStep func(StepEvent)
+
+	// Hooks are the shell commands executed before and after the steps
+	Hooks Hooks
+
+	// AutoBatch commits metadata changes along with the next layer
+	AutoBatch bool
+
+	// RegistryMirrors rewrite the registries of FROM images
+	RegistryMirrors imagename.Mirrors
+
+	// PushMirrors are the registries PUSH pushes to along with the given ones
+	PushMirrors imagename.PushMirrors
+
+	// Sandbox is the security settings of the RUN and TEST containers
+	Sandbox Sandbox
+
+	// Hash is the hashing algorithm of the COPY/ADD tarsums, DefaultHash if not set
+	Hash Hash
+
+	// Policy restricts the base images and the push destinations, optional
+	Policy *Policy
+
+	// PublishChannel rewrites the tags of the TAG and PUSH targets, optional
+	PublishChannel *PublishChannel
+
+	// FromOverride replaces the image of the first FROM, optional
+	FromOverride string
+
+	// CopyStdin is the tar archive copied by COPY --from-stdin, optional
+	CopyStdin string
+
+	// Shell wraps the shell form of RUN and TEST, DefaultShell if not set
+	Shell []string
+
+	// SkipNoopCommits reuses the parent image instead of committing the
+	// containers that changed neither the files nor the config
+	SkipNoopCommits bool
+
+	// DedupeCopy reuses the images of the identical COPY and ADD steps made
+	// earlier in the build on top of the same image, even if the cache is disabled
+	DedupeCopy bool
+
+	// NoReuse gives every MOUNT volume of the build a fresh empty volume that
+	// is removed when the build ends, instead of the one kept between builds
+	NoReuse bool
+
+	// FailOnSecrets fails the build if the files added by COPY and ADD or
+	// the ENV and LABEL values of the pushed image look like they contain
+	// secrets, they are only warned about otherwise
+	FailOnSecrets bool
+
+	// ArgsFileMount passes the build args and the vars given by RUN --vars
+	// to RUN as the ArgsFilePath JSON file instead of the environment variables
+	ArgsFileMount bool
+
+	// SnapshotOnFailure is the image the container of the failed RUN or
+	// TEST is committed to, debug-<container id> tag is used if it has none
+	SnapshotOnFailure string
+
+	// Scheduler limits the RUN containers running at the same time across
+	// the builds sharing it, optional
+	Scheduler *Scheduler
+
+	// RerunStep makes Run execute only the given instruction, counting from 1,
+	// on top of the cached state of the instructions before it
+	RerunStep int
+}
+
+// StepEvent describes the progress of the build for Config.OnStep
+type StepEvent struct {
+	Time     time.Time     `json:"time"`
+	Step     int           `json:"step"`
+	Command  string        `json:"command"`
+	Done     bool          `json:"done"`
+	ImageID  string        `json:"image_id,omitempty"`
+	Duration time.Duration `json:"duration,omitempty"`
+	Cached   bool          `json:"cached,omitempty"`
+	Error    string        `json:"error,omitempty"`
+
+	// CommitDuration is the time spent committing the container of the step
+	CommitDuration time.Duration `json:"commit_duration,omitempty"`
+
+	// Exit describes the failed container of the step
+	Exit *ContainerExit `json:"exit,omitempty"`
 }
 
 // Build is the main object that processes build
@@ -75,6 +203,22 @@ type Build struct {
 	ProducedSize int64
 	VirtualSize  int64
 
+	// Artifacts of the images produced by PUSH instructions
+	Artifacts []imagename.Artifact
+
+	// From are the base images resolved by FROM instructions
+	From []FromImage
+
+	// CacheStats counts the cache hits and misses of the build
+	CacheStats CacheStats
+
+	// CommitDuration is the total time spent committing containers
+	CommitDuration time.Duration
+
+	// FailureSnapshot is the image the failed container was committed to,
+	// see Config.SnapshotOnFailure
+	FailureSnapshot string
+
 	rockerfile *Rockerfile
 	cache      Cache
 	cfg        Config
@@ -90,9 +234,76 @@ type Build struct {
 
 	urlFetcher URLFetcher
 
-	allowedBuildArgs map[string]bool
+	// allowedBuildArgs are the build args declared by ARG in the current FROM
+	// section and the predefined ones, consumedBuildArgs are the ones declared
+	// anywhere in the Rockerfile; see runBuildArgs for how they make the cache keys
+	allowedBuildArgs  map[string]bool
+	consumedBuildArgs map[string]bool
+
+	// started is when Run was called
+	started time.Time
+
+	// scopedVolumes are the names of the MOUNT volume containers made
+	// for this build with --no-reuse, they are removed when it ends
+	scopedVolumes map[string]bool
+
+	// missStarted is when the work of the last cache miss has started,
+	// it is used to store the duration of the step in the cache
+	missStarted time.Time
+	stepCached  bool
+	stepCommit  time.Duration
+
+	// step is the number of the step being executed
+	step int
+
+	// copies are the images made by the COPY and ADD steps of the build
+	// by their keys, see Config.DedupeCopy
+	copies map[string]State
+
+	// overriddenFrom is the FROM replaced by Config.FromOverride,
+	// overriddenFromName is the image it had
+	overriddenFrom     *CommandFrom
+	overriddenFromName string
+
+	// rerunning is set while rerunStep restores the state out of the cache
+	rerunning bool
+
+	// prefetched are the FROM images found by prefetchFrom by their names
+	prefetched map[string]*docker.Image
+
+	// pullLocks serialize the pulls of the same image by its name,
+	// pullMu guards the map
+	pullLocks map[string]*sync.Mutex
+	pullMu    sync.Mutex
+
+	// executed are the steps the build has executed, for the provenance
+	executed []ProvenanceStep
+
+	// produced is the final image of the last section that is not cache-only
+	produced producedImage
+
+	// readVars are the vars read by the last READVARS, they are taken by replan
+	readVars template.Vars
+
+	diskSpaceUnknown bool
+
+	// copyStdinSum is the tarsum of the Config.CopyStdin archive, once calculated
+	copyStdinSum string
+
+	// cancelled is set atomically by Cancel() from another goroutine
+	cancelled int32
 }
 
+// producedImage is the final image of a FROM section with the sizes of the build
+type producedImage struct {
+	ID           string
+	ProducedSize int64
+	VirtualSize  int64
+}
+
+// ErrCancelled is returned by Run if the build was cancelled
+var ErrCancelled = fmt.Errorf("Build cancelled")
+
 // New creates the new build object
 func New(client Client, rockerfile *Rockerfile, cache Cache, cfg Config) *Build {
 	b := &Build{
@@ -102,38 +313,74 @@ func New(client Client, rockerfile *Rockerfile, cache Cache, cfg Config) *Build
 		client:     client,
 		exports:    []string{},
 
-		// Build args allowed by Docker by default:
-		// https://docs.docker.com/engine/reference/builder/#/arg
-		allowedBuildArgs: map[string]bool{
-			"HTTP_PROXY":  true,
-			"http_proxy":  true,
-			"HTTPS_PROXY": true,
-			"https_proxy": true,
-			"FTP_PROXY":   true,
-			"ftp_proxy":   true,
-			"NO_PROXY":    true,
-			"no_proxy":    true,
-		},
+		allowedBuildArgs:  predefinedBuildArgs(),
+		consumedBuildArgs: map[string]bool{},
 	}
 
 	b.urlFetcher = NewURLFetcherFS(cfg.CacheDir, cfg.NoCache, nil)
 
 	b.state = NewState(b)
 
-	if cfg.BuildArgs != nil {
-		b.state.NoCache.BuildArgs = cfg.BuildArgs
-	}
-
 	return b
 }
 
 // Run runs the build following the given Plan
 func (b *Build) Run(plan Plan) (err error) {
 
+	b.started = time.Now()
+	defer b.removeScopedVolumes()
+
+	if b.cfg.LogJSON {
+		b.logBuildStart()
+		defer func() { b.logBuildEnd(err) }()
+	}
+	if b.cfg.FromOverride != "" {
+		if err = b.overrideFrom(plan); err != nil {
+			return err
+		}
+	}
+	if err = b.lint(plan); err != nil {
+		return err
+	}
+	if err = b.checkPolicy(untilReadVars(plan)); err != nil {
+		return err
+	}
+	if err = b.checkCopyStdin(plan); err != nil {
+		return err
+	}
+	if b.cfg.PublishChannel != nil {
+		if err = b.cfg.PublishChannel.Check(b.rockerfile.Vars); err != nil {
+			return err
+		}
+	}
+	if err = b.checkImageNames(untilReadVars(plan)); err != nil {
+		return err
+	}
+	if err = b.checkOffline(untilReadVars(plan)); err != nil {
+		return err
+	}
+
+	// The context is walked while the base images are resolved
+	waitPrefetch := b.prefetchFrom(untilReadVars(plan))
+	err = b.checkContextSize()
+	waitPrefetch()
+	if err != nil {
+		return err
+	}
+
+	if b.cfg.RerunStep > 0 {
+		return b.rerunStep(plan, b.cfg.RerunStep)
+	}
+
 	for k := 0; k < len(plan); k++ {
 		command := plan[k]
 
+		if atomic.LoadInt32(&b.cancelled) != 0 {
+			return ErrCancelled
+		}
+
 		log.Debugf("Step %d: %# v", k+1, pretty.Formatter(command))
+		b.step = k + 1
 
 		var doRun bool
 		if doRun, err = command.ShouldRun(b); err != nil {
@@ -145,50 +392,119 @@ func (b *Build) Run(plan Plan) (err error) {
 
 		// Replace env for the command if appropriate
 		if command, ok := command.(EnvReplacableCommand); ok {
+			if err = b.checkEnvRefs(plan[k]); err != nil {
+				return err
+			}
 			command.ReplaceEnv(b.state.Config.Env)
 		}
 
 		log.Infof("%s", color.New(color.FgWhite, color.Bold).SprintFunc()(command))
 
+		if err = b.checkDiskSpace(k + 1); err != nil {
+			return err
+		}
+
+		if err = b.runHook("pre", k+1, command); err != nil {
+			return err
+		}
+
+		event := StepEvent{Step: k + 1, Command: fmt.Sprintf("%s", command)}
+		b.emitStep(event)
+		started := time.Now()
+		b.stepCached = false
+		b.stepCommit = 0
+
 		if b.state, err = command.Execute(b); err != nil {
+			event.Done, event.Duration, event.Error = true, time.Since(started), err.Error()
+			if exit, ok := err.(*ContainerExitError); ok {
+				event.Exit = &exit.ContainerExit
+			}
+			b.emitStep(event)
+			return b.stepError(command, err)
+		}
+
+		event.Done, event.Duration, event.ImageID = true, time.Since(started), b.state.ImageID
+		event.Cached, event.CommitDuration = b.stepCached, b.stepCommit
+		b.emitStep(event)
+		b.CacheStats.Steps++
+		b.recordStep(command)
+
+		if err = b.runHook("post", k+1, command); err != nil {
 			return err
 		}
 
 		log.Debugf("State after step %d: %# v", k+1, pretty.Formatter(b.state))
 
-		// Here we need to inject ONBUILD commands on the fly,
-		// build sub plan and merge it with the main plan.
-		// Not very beautiful, because Run uses Plan as the argument
-		// and then it builds its own. But.
-		if len(b.state.InjectCommands) > 0 {
-			commands, err := parseOnbuildCommands(b.state.InjectCommands)
-			if err != nil {
-				return err
-			}
-			subPlan, err := NewPlan(commands, false)
-			if err != nil {
+		if plan, _, err = b.injectOnbuild(plan, k); err != nil {
+			return err
+		}
+
+		if b.readVars != nil {
+			if plan, err = b.replan(plan, k); err != nil {
 				return err
 			}
-			tail := append(subPlan, plan[k+1:]...)
-			plan = append(plan[:k+1], tail...)
-
-			b.state.InjectCommands = []string{}
 		}
 	}
 
-	// check if there are any leftover build-args that were passed but not
-	// consumed during build. Return an error, if there are any.
-	leftoverArgs := []string{}
-	for arg := range b.cfg.BuildArgs {
-		if !b.allowedBuildArgs[arg] {
-			leftoverArgs = append(leftoverArgs, arg)
-		}
+	return b.checkLeftoverBuildArgs()
+}
+
+// injectOnbuild injects the ONBUILD commands of the image made by step k
+// on the fly: builds a sub plan and merges it with the main plan right after k.
+// Not very beautiful, because Run uses Plan as the argument
+// and then it builds its own. But.
+func (b *Build) injectOnbuild(plan Plan, k int) (Plan, int, error) {
+	if len(b.state.InjectCommands) == 0 {
+		return plan, 0, nil
+	}
+
+	commands, err := parseOnbuildCommands(b.state.InjectCommands)
+	if err != nil {
+		return plan, 0, err
+	}
+	subPlan, err := NewPlan(commands, false, b.cfg.AutoBatch)
+	if err != nil {
+		return plan, 0, err
+	}
+	tail := append(subPlan, plan[k+1:]...)
+	plan = append(plan[:k+1], tail...)
+
+	b.state.InjectCommands = []string{}
+
+	return plan, len(subPlan), nil
+}
+
+// emitStep passes the step event to the OnStep callback if there is one
+func (b *Build) emitStep(event StepEvent) {
+	event.Time = time.Now()
+	if b.cfg.LogJSON {
+		logStepEvent(event)
+	}
+	if b.cfg.OnStep != nil {
+		b.cfg.OnStep(event)
+	}
+}
+
+// stepError points the error of the step at the line of the Rockerfile
+// the instruction comes from, if it is known
+func (b *Build) stepError(command Command, err error) error {
+	cfg, ok := commandConfig(command)
+	if !ok || cfg.line == 0 || b.rockerfile == nil {
+		return err
 	}
-	if len(leftoverArgs) > 0 {
-		return fmt.Errorf("One or more build-args %v were not consumed, failing build.", leftoverArgs)
+	location := fmt.Sprintf("%s:%d", b.rockerfile.Name, cfg.line)
+
+	// The exit error keeps its type, so the callers can tell why the container failed
+	if exit, ok := err.(*ContainerExitError); ok {
+		exit.Location = location
+		return exit
 	}
+	return fmt.Errorf("%s: %s", location, err)
+}
 
-	return nil
+// Cancel stops the build before the next step; it is safe to call from another goroutine
+func (b *Build) Cancel() {
+	atomic.StoreInt32(&b.cancelled, 1)
 }
 
 // GetState returns current build state object
@@ -211,7 +527,14 @@ func (b *Build) probeCache(s State) (cachedState State, hit bool, err error) {
 
 func (b *Build) probeCacheAndPreserveCommits(s State) (cachedState State, hit bool, err error) {
 
-	if b.cache == nil || s.NoCache.CacheBusted {
+	if b.cache == nil {
+		return s, false, nil
+	}
+
+	b.missStarted = time.Now()
+
+	if s.NoCache.CacheBusted {
+		b.CacheStats.miss(CacheMissBusted)
 		return s, false, nil
 	}
 
@@ -219,9 +542,32 @@ func (b *Build) probeCacheAndPreserveCommits(s State) (cachedState State, hit bo
 	if s2, err = b.cache.Get(s); err != nil {
 		return s, false, err
 	}
+	if s2 == nil && b.rerunning {
+		return s, false, errNotCached
+	}
 	if s2 == nil {
 		s.NoCache.CacheBusted = true
 		log.Info(color.New(color.FgYellow).SprintFunc()("| Not cached"))
+		// Looking up the nearest state reads the whole cache dir,
+		// so the miss is only looked into when it is to be explained
+		if !b.cfg.ExplainCacheMiss {
+			b.CacheStats.miss(b.cacheMissReason(s))
+			return s, false, nil
+		}
+		nearest, found := b.nearestCached(s)
+		switch {
+		case !found:
+			b.CacheStats.miss(b.cacheMissReason(s))
+		case nearest == nil:
+			b.CacheStats.miss(CacheMissNew)
+		default:
+			b.CacheStats.miss(CacheMissChanged)
+		}
+		if found {
+			for _, line := range ExplainCacheMiss(NewCacheKey(s), nearest) {
+				log.Infof("| Cache miss: %s", line)
+			}
+		}
 		return s, false, nil
 	}
 
@@ -229,6 +575,7 @@ func (b *Build) probeCacheAndPreserveCommits(s State) (cachedState State, hit bo
 		defer b.cache.Del(*s2)
 		s.NoCache.CacheBusted = true
 		log.Info(color.New(color.FgYellow).SprintFunc()("| Reload cache"))
+		b.CacheStats.miss(CacheMissReload)
 		return s, false, nil
 	}
 
@@ -236,10 +583,17 @@ func (b *Build) probeCacheAndPreserveCommits(s State) (cachedState State, hit bo
 	if img, err = b.client.InspectImage(s2.ImageID); err != nil {
 		return s, true, err
 	}
+	if img == nil && b.rerunning {
+		return s, false, errNotCached
+	}
 	if img == nil {
 		defer b.cache.Del(*s2)
 		s.NoCache.CacheBusted = true
 		log.Info(color.New(color.FgYellow).SprintFunc()("| Not cached"))
+		b.CacheStats.miss(CacheMissRemoved)
+		if b.cfg.ExplainCacheMiss {
+			log.Infof("| Cache miss: cached image %.12s no longer exists", s2.ImageID)
+		}
 		return s, false, nil
 	}
 
@@ -269,22 +623,74 @@ func (b *Build) probeCacheAndPreserveCommits(s State) (cachedState State, hit bo
 	// Store some stuff to the build
 	b.ProducedSize += s2.Size - s2.ParentSize
 	b.VirtualSize = s2.Size
+	b.CacheStats.hit(s2.Duration)
+	b.stepCached = true
 
 	// Keep items that should not be cached from the previous state
 	s2.NoCache = s.NoCache
+	s2.CacheKey = nil
+
+	// The skipped commit is cached on top of the image itself,
+	// which still has the parent of the previous state
+	if s2.ImageID == s.ImageID {
+		s2.ParentID = s.ParentID
+	}
 
 	return *s2, true, nil
 }
 
+// cacheMissReason tells the first build on top of the image from the content
+// change by the states cached on top of it; the reason is unknown if the
+// cache backend cannot tell
+func (b *Build) cacheMissReason(s State) string {
+	checker, ok := b.cache.(CacheParentChecker)
+	if !ok {
+		return CacheMissUnknown
+	}
+
+	cached, err := checker.HasParent(s.ImageID)
+	if err != nil {
+		log.Errorf("| Failed to look up the cached states, error: %s", err)
+		return CacheMissUnknown
+	}
+	if !cached {
+		return CacheMissNew
+	}
+	return CacheMissChanged
+}
+
+// nearestCached returns the state found in the cache that is the nearest
+// to the given one, it is nil if nothing similar was cached; found is false
+// if the cache backend cannot look it up
+func (b *Build) nearestCached(s State) (nearest *State, found bool) {
+	finder, ok := b.cache.(CacheNearestFinder)
+	if !ok {
+		return nil, false
+	}
+
+	nearest, err := finder.Nearest(s)
+	if err != nil {
+		log.Errorf("| Failed to look up the nearest cached state, error: %s", err)
+		return nil, false
+	}
+
+	return nearest, true
+}
+
 func (b *Build) getVolumeContainer(path string) (c *docker.Container, err error) {
+	return b.ensureVolumeContainer(b.mountsContainerName(path), path)
+}
 
-	name := b.mountsContainerName(path)
+// ensureVolumeContainer makes the named volume container for the path
+// unless it already exists
+func (b *Build) ensureVolumeContainer(name, path string) (c *docker.Container, err error) {
 
 	config := &docker.Config{
 		Image: MountVolumeImage,
 		Volumes: map[string]struct{}{
 			path: struct{}{},
 		},
+		Labels: b.containerLabels(nil),
 	}
 
 	log.Debugf("Make MOUNT volume container %s with options %# v", name, config)
@@ -308,6 +714,7 @@ func (b *Build) getExportsContainerWithBinds(name string, binds []string) (c *do
 		},
 		Cmd:        []string{"/opt/rsync/bin/rsync", "-a", "--delete-during", "/.rocker_exports_source/", "/.rocker_exports/"},
 		Entrypoint: []string{},
+		Labels:     b.containerLabels(nil),
 	}
 
 	var hostConfig *docker.HostConfig
@@ -391,7 +798,10 @@ func (b *Build) lookupImage(name string) (img *docker.Image, err error) {
 	// If hub is true, then there is no sense to inspect the local image
 	if !hub || isSha {
 		if isOld, warning := imagename.WarnIfOldS3ImageName(name); isOld {
-			log.Warn(warning)
+			if b.cfg.Strict {
+				return nil, b.warn("%s", warning)
+			}
+			deprecation.Warn(deprecation.OldS3Name, name)
 		}
 		// Try to inspect image as is, without version resolution
 		if img, err := b.client.InspectImage(imgName.String()); err != nil || img != nil {
@@ -460,10 +870,30 @@ func (b *Build) lookupImage(name string) (img *docker.Image, err error) {
 	}
 
 	if pull {
-		if err = b.client.PullImage(candidate.String()); err != nil {
+		// The same image is pulled once at a time, the other images
+		// are pulled concurrently
+		lock := b.pullLock(candidate.String())
+		lock.Lock()
+		err = b.client.PullImage(candidate.String())
+		lock.Unlock()
+		if err != nil {
 			return
 		}
 	}
 
 	return b.client.InspectImage(candidate.String())
 }
+
+// pullLock returns the lock of the pulls of the image by its name
+func (b *Build) pullLock(name string) *sync.Mutex {
+	b.pullMu.Lock()
+	defer b.pullMu.Unlock()
+
+	if b.pullLocks == nil {
+		b.pullLocks = map[string]*sync.Mutex{}
+	}
+	if _, ok := b.pullLocks[name]; !ok {
+		b.pullLocks[name] = &sync.Mutex{}
+	}
+	return b.pullLocks[name]
+}
@@ -109,7 +109,7 @@ func runBuildInteg(t *testing.T, rockerfileContent string, cfg Config) (*Build,
 		})
 	}()
 
-	p, err := NewPlan(r.Commands(), true)
+	p, err := NewPlan(r.Commands(), true, false)
 	if err != nil {
 		t.Fatal(err)
 	}
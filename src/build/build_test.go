@@ -17,6 +17,8 @@
 package build
 
 import (
+	"fmt"
+	"github.com/grammarly/rocker/src/dockerclient"
 	"github.com/grammarly/rocker/src/imagename"
 	"github.com/grammarly/rocker/src/template"
 	"io"
@@ -244,6 +246,20 @@ func TestBuild_LookupImage_ShaNotExistLocally(t *testing.T) {
 	}
 }
 
+func TestBuild_Run_ErrorLine(t *testing.T) {
+	b, c := makeBuild(t, "# comment\n\nFROM ubuntu\n", Config{})
+	plan, err := NewPlan(b.rockerfile.Commands(), true, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.On("InspectImage", "ubuntu:latest").Return((*docker.Image)(nil), fmt.Errorf("daemon is down")).Once()
+
+	err = b.Run(plan)
+	assert.EqualError(t, err, b.rockerfile.Name+":3: FROM error: daemon is down")
+	c.AssertExpectations(t)
+}
+
 // internal helpers
 
 func makeBuild(t *testing.T, rockerfileContent string, cfg Config) (*Build, *MockClient) {
@@ -274,6 +290,21 @@ func (m *MockClient) InspectImage(name string) (*docker.Image, error) {
 	return args.Get(0).(*docker.Image), args.Error(1)
 }
 
+func (m *MockClient) ImportImage(imageName string, tarball io.Reader, changes []string) error {
+	args := m.Called(imageName, tarball, changes)
+	return args.Error(0)
+}
+
+func (m *MockClient) SaveImages(imageIDs []string, w io.Writer) error {
+	args := m.Called(imageIDs, w)
+	return args.Error(0)
+}
+
+func (m *MockClient) LoadImages(r io.Reader) error {
+	args := m.Called(r)
+	return args.Error(0)
+}
+
 func (m *MockClient) PullImage(name string) error {
 	args := m.Called(name)
 	return args.Error(0)
@@ -304,6 +335,11 @@ func (m *MockClient) PushImage(imageName string) (string, error) {
 	return args.String(0), args.Error(1)
 }
 
+func (m *MockClient) PushArtifact(name string, artifact dockerclient.OCIArtifact) (string, error) {
+	args := m.Called(name, artifact)
+	return args.String(0), args.Error(1)
+}
+
 func (m *MockClient) CreateContainer(state State) (string, error) {
 	args := m.Called(state)
 	return args.String(0), args.Error(1)
@@ -314,6 +350,11 @@ func (m *MockClient) RunContainer(containerID string, attach bool) error {
 	return args.Error(0)
 }
 
+func (m *MockClient) RunContainerWithInput(containerID string, input io.Reader) error {
+	args := m.Called(containerID, input)
+	return args.Error(0)
+}
+
 func (m *MockClient) CommitContainer(state *State) (*docker.Image, error) {
 	args := m.Called(*state)
 	return args.Get(0).(*docker.Image), args.Error(1)
@@ -329,11 +370,21 @@ func (m *MockClient) UploadToContainer(containerID string, stream io.Reader, pat
 	return args.Error(0)
 }
 
+func (m *MockClient) DownloadFromContainer(containerID string, path string, w io.Writer) error {
+	args := m.Called(containerID, path, w)
+	return args.Error(0)
+}
+
 func (m *MockClient) ResolveHostPath(path string) (resultPath string, err error) {
 	args := m.Called(path)
 	return args.String(0), args.Error(1)
 }
 
+func (m *MockClient) FreeDiskSpace() (free int64, err error) {
+	args := m.Called()
+	return args.Get(0).(int64), args.Error(1)
+}
+
 func (m *MockClient) EnsureImage(imageName string) error {
 	args := m.Called(imageName)
 	return args.Error(0)
@@ -349,6 +400,11 @@ func (m *MockClient) InspectContainer(containerName string) (container *docker.C
 	return args.Get(0).(*docker.Container), args.Error(1)
 }
 
+func (m *MockClient) ContainerChanges(containerID string) ([]docker.Change, error) {
+	args := m.Called(containerID)
+	return args.Get(0).([]docker.Change), args.Error(1)
+}
+
 // type MockCache struct {
 // 	mock.Mock
 // }
@@ -0,0 +1,126 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+const (
+	// BuildArgsLabel is the label listing the names of the build args
+	// consumed by the image, see Config.RecordBuildArgs
+	BuildArgsLabel = "rocker.build-args"
+
+	// BuildArgValueLabelPrefix is the prefix of the labels keeping the values
+	// of the build args listed in Config.RecordBuildArgValues
+	BuildArgValueLabelPrefix = "rocker.build-arg."
+)
+
+var secretNameRegexp = regexp.MustCompile(`(?i)(PASSW(OR)?D|SECRET|TOKEN|KEY|CREDENTIAL|AUTH)`)
+
+// IsSecretName returns true if the name of the variable looks like it holds
+// a secret, e.g. NPM_TOKEN or AWS_SECRET_ACCESS_KEY; values of such variables
+// are never recorded to the images
+func IsSecretName(name string) bool {
+	return secretNameRegexp.MatchString(name)
+}
+
+// recordBuildArg adds the name of the consumed build arg, and its value if
+// it is allowed, to the labels of the state
+func (b *Build) recordBuildArg(s *State, name string) error {
+	if !b.cfg.RecordBuildArgs {
+		return nil
+	}
+
+	value, ok := s.NoCache.BuildArgs[name]
+	if !ok {
+		return nil
+	}
+
+	if s.Config.Labels == nil {
+		s.Config.Labels = map[string]string{}
+	}
+
+	names := []string{}
+	if recorded := s.Config.Labels[BuildArgsLabel]; recorded != "" {
+		names = strings.Split(recorded, ",")
+	}
+	if !containsString(names, name) {
+		names = append(names, name)
+		sort.Strings(names)
+	}
+	s.Config.Labels[BuildArgsLabel] = strings.Join(names, ",")
+	s.Commit("LABEL %s=%s", BuildArgsLabel, s.Config.Labels[BuildArgsLabel])
+
+	if !containsString(b.cfg.RecordBuildArgValues, name) {
+		return nil
+	}
+
+	if IsSecretName(name) {
+		return b.warn("Not recording the value of build arg %s, it looks like a secret", name)
+	}
+
+	s.Config.Labels[BuildArgValueLabelPrefix+name] = value
+	s.Commit("LABEL %s%s=%q", BuildArgValueLabelPrefix, name, value)
+
+	return nil
+}
+
+// predefinedBuildArgs returns the build args allowed by Docker without ARG:
+// https://docs.docker.com/engine/reference/builder/#/arg
+func predefinedBuildArgs() map[string]bool {
+	return map[string]bool{
+		"HTTP_PROXY":  true,
+		"http_proxy":  true,
+		"HTTPS_PROXY": true,
+		"https_proxy": true,
+		"FTP_PROXY":   true,
+		"ftp_proxy":   true,
+		"NO_PROXY":    true,
+		"no_proxy":    true,
+	}
+}
+
+// checkLeftoverBuildArgs fails the build if some of the passed build args were
+// not declared by ARG in any FROM section of the Rockerfile
+func (b *Build) checkLeftoverBuildArgs() error {
+	predefined := predefinedBuildArgs()
+
+	leftoverArgs := []string{}
+	for arg := range b.cfg.BuildArgs {
+		if !b.consumedBuildArgs[arg] && !predefined[arg] {
+			leftoverArgs = append(leftoverArgs, arg)
+		}
+	}
+	if len(leftoverArgs) > 0 {
+		sort.Strings(leftoverArgs)
+		return fmt.Errorf("One or more build-args %v were not consumed, failing build.", leftoverArgs)
+	}
+	return nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,166 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestIsSecretName(t *testing.T) {
+	assert.True(t, IsSecretName("NPM_TOKEN"))
+	assert.True(t, IsSecretName("AWS_SECRET_ACCESS_KEY"))
+	assert.True(t, IsSecretName("db_password"))
+	assert.True(t, IsSecretName("GITHUB_AUTH"))
+	assert.False(t, IsSecretName("VERSION"))
+	assert.False(t, IsSecretName("http_proxy"))
+}
+
+func TestCommandArg_RecordBuildArgs(t *testing.T) {
+	b, _ := makeBuild(t, "", Config{
+		RecordBuildArgs: true,
+		BuildArgs:       map[string]string{"VERSION": "1.2", "NPM_TOKEN": "xxx"},
+	})
+
+	for _, arg := range []string{"VERSION", "NPM_TOKEN", "UNSET", "MODE=release"} {
+		state, err := NewCommand(ConfigCommand{name: "arg", args: []string{arg}}).Execute(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b.state = state
+	}
+
+	assert.Equal(t, "MODE,NPM_TOKEN,VERSION", b.state.Config.Labels[BuildArgsLabel])
+	assert.NotContains(t, b.state.Config.Labels, BuildArgValueLabelPrefix+"VERSION")
+	assert.Contains(t, b.state.GetCommits(), "LABEL rocker.build-args=MODE,NPM_TOKEN,VERSION")
+}
+
+func TestCommandArg_RecordBuildArgValues(t *testing.T) {
+	b, _ := makeBuild(t, "", Config{
+		RecordBuildArgs:      true,
+		RecordBuildArgValues: []string{"VERSION", "NPM_TOKEN"},
+		BuildArgs:            map[string]string{"VERSION": "1.2", "NPM_TOKEN": "xxx"},
+	})
+
+	for _, arg := range []string{"VERSION", "NPM_TOKEN"} {
+		state, err := NewCommand(ConfigCommand{name: "arg", args: []string{arg}}).Execute(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b.state = state
+	}
+
+	assert.Equal(t, "1.2", b.state.Config.Labels[BuildArgValueLabelPrefix+"VERSION"])
+	assert.NotContains(t, b.state.Config.Labels, BuildArgValueLabelPrefix+"NPM_TOKEN")
+	assert.NotContains(t, b.state.GetCommits(), "xxx")
+}
+
+func TestCommandArg_RecordBuildArgValues_Strict(t *testing.T) {
+	b, _ := makeBuild(t, "", Config{
+		Strict:               true,
+		RecordBuildArgs:      true,
+		RecordBuildArgValues: []string{"NPM_TOKEN"},
+		BuildArgs:            map[string]string{"NPM_TOKEN": "xxx"},
+	})
+
+	_, err := NewCommand(ConfigCommand{name: "arg", args: []string{"NPM_TOKEN"}}).Execute(b)
+	assert.EqualError(t, err, "Not recording the value of build arg NPM_TOKEN, it looks like a secret (strict mode)")
+}
+
+func TestCommandArg_RecordBuildArgs_Disabled(t *testing.T) {
+	b, _ := makeBuild(t, "", Config{BuildArgs: map[string]string{"VERSION": "1.2"}})
+
+	state, err := NewCommand(ConfigCommand{name: "arg", args: []string{"VERSION"}}).Execute(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.NotContains(t, state.Config.Labels, BuildArgsLabel)
+	assert.Equal(t, "ARG VERSION", state.GetCommits())
+}
+
+// runKey executes the Rockerfile with the build args and returns the commits
+// of its last RUN, which make the cache key of the step; every FROM starts
+// a new section on top of the same image
+func runKey(t *testing.T, rockerfile string, args map[string]string) (key string) {
+	b, c := makeBuild(t, rockerfile, Config{BuildArgs: args})
+	c.On("CreateContainer", mock.AnythingOfType("State")).Return("456", nil)
+	c.On("RunContainer", "456", false).Return(nil)
+
+	var err error
+	for i, cfg := range b.rockerfile.Commands() {
+		if cfg.name == "from" {
+			if i > 0 {
+				if b.state, err = (&CommandCleanup{}).Execute(b); err != nil {
+					t.Fatal(err)
+				}
+			}
+			b.state.ImageID = "123"
+			continue
+		}
+		if b.state, err = NewCommand(cfg).Execute(b); err != nil {
+			t.Fatal(err)
+		}
+		if cfg.name == "run" {
+			key = b.state.GetCommits()
+		}
+		b.state.CleanCommits()
+	}
+
+	return key
+}
+
+func TestBuildArgs_CacheKey(t *testing.T) {
+	var (
+		used       = "FROM ubuntu\nARG VERSION\nRUN make\n"
+		undeclared = "FROM ubuntu\nARG OTHER\nRUN make\n"
+		afterRun   = "FROM ubuntu\nRUN make\nARG VERSION\n"
+		overridden = "FROM ubuntu\nARG VERSION\nENV VERSION=1\nRUN make\n"
+		otherFrom  = "FROM ubuntu\nARG VERSION\nRUN make\nFROM ubuntu\nARG OTHER\nRUN make\n"
+		bothFroms  = "FROM ubuntu\nARG VERSION\nRUN make\nFROM ubuntu\nARG VERSION\nRUN make\n"
+	)
+
+	v1 := map[string]string{"VERSION": "1", "OTHER": "x"}
+	v2 := map[string]string{"VERSION": "2", "OTHER": "x"}
+
+	// Changing the arg declared before RUN busts its cache
+	assert.NotEqual(t, runKey(t, used, v1), runKey(t, used, v2))
+	assert.Contains(t, runKey(t, used, v1), `"VERSION=1"`)
+
+	// Changing the arg that RUN does not see does not
+	assert.Equal(t, runKey(t, undeclared, v1), runKey(t, undeclared, v2))
+	assert.Equal(t, runKey(t, afterRun, v1), runKey(t, afterRun, v2))
+	assert.Equal(t, runKey(t, overridden, v1), runKey(t, overridden, v2))
+
+	// ARG is scoped to its FROM section, the passed value reaches every section
+	assert.Equal(t, runKey(t, otherFrom, v1), runKey(t, otherFrom, v2))
+	assert.NotEqual(t, runKey(t, bothFroms, v1), runKey(t, bothFroms, v2))
+}
+
+func TestBuildArgs_DefaultScopedToSection(t *testing.T) {
+	key := runKey(t, "FROM ubuntu\nARG MODE=dev\nRUN make\nFROM ubuntu\nARG MODE\nRUN make\n", nil)
+	assert.NotContains(t, key, "MODE")
+}
+
+func TestCheckLeftoverBuildArgs(t *testing.T) {
+	b, _ := makeBuild(t, "", Config{BuildArgs: map[string]string{"VERSION": "1", "http_proxy": "proxy", "NOPE": "1"}})
+	b.consumedBuildArgs["VERSION"] = true
+
+	assert.EqualError(t, b.checkLeftoverBuildArgs(), "One or more build-args [NOPE] were not consumed, failing build.")
+}
@@ -22,11 +22,19 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
 	"time"
 
+	"github.com/grammarly/rocker/src/util"
+
 	log "github.com/Sirupsen/logrus"
 )
 
+// cacheLocksDir is the directory within the cache dir that keeps the lock
+// files coordinating the rocker processes that share the cache
+const cacheLocksDir = ".locks"
+
 // Cache interface describes a cache backend
 type Cache interface {
 	Get(s State) (s2 *State, err error)
@@ -34,20 +42,64 @@ type Cache interface {
 	Del(s State) error
 }
 
+// CacheNearestFinder describes a cache backend that can find the stored state
+// most similar to the given one; it is used to explain cache misses
+type CacheNearestFinder interface {
+	Nearest(s State) (s2 *State, err error)
+}
+
+// CacheParentChecker describes a cache backend that can tell cheaply if any
+// state is cached on top of the image; it is used to classify cache misses
+type CacheParentChecker interface {
+	HasParent(imageID string) (bool, error)
+}
+
+// CacheKey holds the components the cache key of a state is made of.
+// It is stored along with the cached state, so a cache miss can be explained
+// by comparing the components rather than the resulting commit string only.
+type CacheKey struct {
+	ParentID string
+	Commits  []string
+	Env      []string
+
+	// Hash is the ID of the hashing algorithm the key was made with,
+	// it is empty for the keys made by earlier rocker versions
+	Hash string `json:",omitempty"`
+}
+
+// NewCacheKey returns cache key components of the state that
+// is being looked up in the cache
+func NewCacheKey(s State) CacheKey {
+	return CacheKey{
+		ParentID: s.ImageID,
+		Commits:  s.Commits,
+		Env:      s.Config.Env,
+	}
+}
+
 // CacheFS implements file based cache backend
 type CacheFS struct {
 	root string
+	hash Hash
 }
 
-// NewCacheFS creates a file based cache backend
-func NewCacheFS(root string) *CacheFS {
+// NewCacheFS creates a file based cache backend, the states are
+// only hit if they were stored with the same hashing algorithm
+func NewCacheFS(root string, hash Hash) *CacheFS {
 	return &CacheFS{
 		root: root,
+		hash: hash.orDefault(),
 	}
 }
 
 // Get fetches cache
 func (c *CacheFS) Get(s State) (res *State, err error) {
+	lock, err := lockCacheKey(c.root, s.ImageID, false)
+	if err != nil {
+		return nil, err
+	}
+	defer lock.Unlock()
+
 	pattern := filepath.Join(c.root, s.ImageID, "*.json")
 
 	latestTime := time.Unix(0, 0)
@@ -74,6 +126,11 @@ func (c *CacheFS) Get(s State) (res *State, err error) {
 
 		log.Debugf("CACHE COMPARE %s %s %q %q", s.ImageID, s2.ImageID, s.Commits, s2.Commits)
 
+		if !c.sameHash(s2) {
+			log.Debugf("CACHE SKIP %s made with hash %s", path, cacheItem{state: &s2}.key().Hash)
+			continue
+		}
+
 		if s.Equals(s2) && info.ModTime().After(latestTime) {
 			latestTime = info.ModTime()
 			res = &s2
@@ -83,25 +140,275 @@ func (c *CacheFS) Get(s State) (res *State, err error) {
 	return
 }
 
+// HasParent returns true if any state is cached on top of the image
+func (c *CacheFS) HasParent(imageID string) (bool, error) {
+	matches, err := filepath.Glob(filepath.Join(c.root, imageID, "*.json"))
+	if err != nil {
+		return false, err
+	}
+	return len(matches) > 0, nil
+}
+
 // Put stores cache
 func (c *CacheFS) Put(s State) error {
 	log.Debugf("CACHE PUT %s %s %q", s.ParentID, s.ImageID, s.Commits)
 
+	lock, err := lockCacheKey(c.root, s.ParentID, true)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
 	fileName := filepath.Join(c.root, s.ParentID, s.ImageID) + ".json"
-	if err := os.MkdirAll(filepath.Dir(fileName), 0755); err != nil {
+	if err := util.MkdirAllOutput(filepath.Dir(fileName), 0755); err != nil {
 		return err
 	}
+
+	// Keep the key components; the state was committed on top of its ParentID
+	s.CacheKey = &CacheKey{
+		ParentID: s.ParentID,
+		Commits:  s.Commits,
+		Env:      s.Config.Env,
+		Hash:     c.hash.ID(),
+	}
+
 	data, err := json.Marshal(s)
 	if err != nil {
 		return err
 	}
-	return ioutil.WriteFile(fileName, data, 0644)
+	return util.WriteOutputFile(fileName, data, 0644)
+}
+
+// Nearest finds the cached state that is most similar to the given one:
+// first, among the states made on top of the same parent image, the one that
+// has the most key components in common; otherwise the latest state made of
+// the same commits on top of a different parent image.
+func (c *CacheFS) Nearest(s State) (res *State, err error) {
+	var (
+		key       = NewCacheKey(s)
+		bestScore = -1
+		latest    = time.Unix(0, 0)
+	)
+
+	siblings, err := c.list(filepath.Join(c.root, s.ImageID, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, item := range siblings {
+		if !c.sameHash(*item.state) {
+			continue
+		}
+		score := countCommon(key.Commits, item.key().Commits) + countCommon(key.Env, item.key().Env)
+		if score > bestScore || (score == bestScore && item.modTime.After(latest)) {
+			bestScore = score
+			latest = item.modTime
+			res = item.state
+		}
+	}
+
+	if res != nil {
+		return res, nil
+	}
+
+	all, err := c.list(filepath.Join(c.root, "*", "*.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, item := range all {
+		if c.sameHash(*item.state) && s.Equals(*item.state) && item.modTime.After(latest) {
+			latest = item.modTime
+			res = item.state
+		}
+	}
+
+	return res, nil
+}
+
+// sameHash returns true if the cached state was made with the hashing
+// algorithm of the cache, the states stored by earlier rocker versions
+// are made with the default one
+func (c *CacheFS) sameHash(s State) bool {
+	id := cacheItem{state: &s}.key().Hash
+	if id == "" {
+		id = Hashes[DefaultHash].ID()
+	}
+	return id == c.hash.ID()
+}
+
+// ExplainCacheMiss returns the human readable differences between
+// the cache key components of the state being looked up and the nearest
+// state found in the cache
+func ExplainCacheMiss(key CacheKey, nearest *State) (lines []string) {
+	if nearest == nil {
+		return []string{fmt.Sprintf("no cached states found on top of image %.12s and no same step cached on top of other images", key.ParentID)}
+	}
+
+	cached := cacheItem{state: nearest}.key()
+
+	if cached.ParentID != key.ParentID {
+		lines = append(lines, fmt.Sprintf("parent image differs: cached %.12s, current %.12s", cached.ParentID, key.ParentID))
+	}
+
+	removed, added := diffStrings(cached.Commits, key.Commits)
+	for _, c := range removed {
+		lines = append(lines, fmt.Sprintf("- %s", c))
+	}
+	for _, c := range added {
+		lines = append(lines, fmt.Sprintf("+ %s", c))
+	}
+
+	var (
+		cachedEnv  = envToMap(cached.Env)
+		currentEnv = envToMap(key.Env)
+		names      = []string{}
+	)
+	for name := range cachedEnv {
+		names = append(names, name)
+	}
+	for name := range currentEnv {
+		if _, ok := cachedEnv[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		cachedVal, inCached := cachedEnv[name]
+		currentVal, inCurrent := currentEnv[name]
+		switch {
+		case !inCached:
+			lines = append(lines, fmt.Sprintf("env %s added: %q", name, currentVal))
+		case !inCurrent:
+			lines = append(lines, fmt.Sprintf("env %s removed: %q", name, cachedVal))
+		case cachedVal != currentVal:
+			lines = append(lines, fmt.Sprintf("env %s changed: %q -> %q", name, cachedVal, currentVal))
+		}
+	}
+
+	if len(lines) == 0 {
+		lines = append(lines, fmt.Sprintf("cache key is the same as of the cached image %.12s", nearest.ImageID))
+	}
+
+	return lines
+}
+
+// cacheItem is a cached state read from file
+type cacheItem struct {
+	state   *State
+	modTime time.Time
+}
+
+// key returns cache key components of the cached state, the states
+// made by earlier rocker versions have no key stored, so we restore
+// what we can out of the state itself
+func (i cacheItem) key() CacheKey {
+	if i.state.CacheKey != nil {
+		return *i.state.CacheKey
+	}
+	return CacheKey{
+		ParentID: i.state.ParentID,
+		Commits:  i.state.Commits,
+		Env:      i.state.Config.Env,
+	}
+}
+
+// list reads all cached states matching the glob pattern
+func (c *CacheFS) list(pattern string) (items []cacheItem, err error) {
+	matches, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, path := range matches {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to stat cache file %s, error: %s", path, err)
+		}
+
+		s := State{}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read cache file %s content, error: %s", path, err)
+		}
+		if err := json.Unmarshal(data, &s); err != nil {
+			return nil, fmt.Errorf("Failed to parse cache file %s json, error: %s", path, err)
+		}
+
+		items = append(items, cacheItem{state: &s, modTime: info.ModTime()})
+	}
+
+	return items, nil
+}
+
+// diffStrings returns the strings present only in a and only in b
+func diffStrings(a, b []string) (onlyA, onlyB []string) {
+	inA := map[string]bool{}
+	inB := map[string]bool{}
+	for _, str := range a {
+		inA[str] = true
+	}
+	for _, str := range b {
+		inB[str] = true
+	}
+	for _, str := range a {
+		if !inB[str] {
+			onlyA = append(onlyA, str)
+		}
+	}
+	for _, str := range b {
+		if !inA[str] {
+			onlyB = append(onlyB, str)
+		}
+	}
+	return
+}
+
+// envToMap turns the list of "KEY=value" strings into a map
+func envToMap(env []string) map[string]string {
+	result := map[string]string{}
+	for _, e := range env {
+		parts := strings.SplitN(e, "=", 2)
+		if len(parts) == 2 {
+			result[parts[0]] = parts[1]
+		} else {
+			result[parts[0]] = ""
+		}
+	}
+	return result
+}
+
+// countCommon returns the number of strings that are present in both lists
+func countCommon(a, b []string) (n int) {
+	set := map[string]bool{}
+	for _, str := range a {
+		set[str] = true
+	}
+	for _, str := range b {
+		if set[str] {
+			n++
+		}
+	}
+	return n
 }
 
 // Del deletes cache
 func (c *CacheFS) Del(s State) error {
 	log.Debugf("CACHE DELETE %s %s %q", s.ParentID, s.ImageID, s.Commits)
 
+	lock, err := lockCacheKey(c.root, s.ParentID, true)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
 	fileName := filepath.Join(c.root, s.ParentID, s.ImageID) + ".json"
 	return os.RemoveAll(fileName)
 }
+
+// lockCacheKey locks the entries stored under the given key, i.e. the parent
+// image ID; the readers share the lock, while a writer holds it exclusively
+func lockCacheKey(root, key string, exclusive bool) (*util.FileLock, error) {
+	return util.LockFile(filepath.Join(root, cacheLocksDir, key+".lock"), exclusive)
+}
@@ -0,0 +1,259 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/grammarly/rocker/src/util"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	// cacheArchiveDir is the directory of the cache entries within the archive
+	cacheArchiveDir = "cache/"
+
+	// cacheArchiveImages is the docker save tarball of the cached images within the archive
+	cacheArchiveImages = "images.tar"
+)
+
+// CacheArchiveStats describes what ExportCache or ImportCache has processed
+type CacheArchiveStats struct {
+	Entries int
+	Images  int
+
+	// Skipped are the entries that were left out, since their images are not found
+	Skipped []string
+}
+
+// ExportCache writes the .tar.gz archive of the cache entries stored in cacheDir
+// by CacheFS and the images they refer to, the entries of the images that do not
+// exist anymore are skipped
+func ExportCache(client Client, cacheDir string, w io.Writer) (stats CacheArchiveStats, err error) {
+	var (
+		gz      = gzip.NewWriter(w)
+		tw      = tar.NewWriter(gz)
+		now     = time.Now()
+		images  = []string{}
+		present = map[string]bool{}
+	)
+
+	matches, err := filepath.Glob(filepath.Join(cacheDir, "*", "*.json"))
+	if err != nil {
+		return stats, err
+	}
+
+	for _, path := range matches {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return stats, fmt.Errorf("Failed to read cache file %s content, error: %s", path, err)
+		}
+
+		s := State{}
+		if err := json.Unmarshal(data, &s); err != nil || s.ImageID == "" {
+			// not a cache entry, e.g. the index of the cache tags
+			continue
+		}
+
+		if _, ok := present[s.ImageID]; !ok {
+			img, err := client.InspectImage(s.ImageID)
+			if err != nil {
+				return stats, err
+			}
+			present[s.ImageID] = img != nil
+			if img != nil {
+				images = append(images, s.ImageID)
+			}
+		}
+		if !present[s.ImageID] {
+			stats.Skipped = append(stats.Skipped, path)
+			continue
+		}
+
+		rel, _ := filepath.Rel(cacheDir, path)
+		if err := writeTarFile(tw, cacheArchiveDir+filepath.ToSlash(rel), data, now); err != nil {
+			return stats, err
+		}
+		stats.Entries++
+	}
+
+	if len(images) > 0 {
+		// The tar header needs the size, so the images are saved to a file first
+		f, err := util.TempFile("rocker_cache_export_")
+		if err != nil {
+			return stats, err
+		}
+		defer util.RemoveTempFile(f.Name())
+		defer f.Close()
+
+		log.Infof("| Save %d images", len(images))
+
+		if err := client.SaveImages(images, f); err != nil {
+			return stats, fmt.Errorf("Failed to save cached images, error: %s", err)
+		}
+
+		info, err := f.Stat()
+		if err != nil {
+			return stats, err
+		}
+		if _, err := f.Seek(0, 0); err != nil {
+			return stats, err
+		}
+
+		hdr := &tar.Header{
+			Name:    cacheArchiveImages,
+			Mode:    0644,
+			Size:    info.Size(),
+			ModTime: now,
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return stats, err
+		}
+		if _, err := io.Copy(tw, f); err != nil {
+			return stats, err
+		}
+		stats.Images = len(images)
+	}
+
+	if err := tw.Close(); err != nil {
+		return stats, err
+	}
+	return stats, gz.Close()
+}
+
+// ImportCache restores the cache entries and the images from the archive made by
+// ExportCache; the entries whose images do not resolve after the import are removed
+func ImportCache(client Client, cacheDir string, r io.Reader) (stats CacheArchiveStats, err error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return stats, fmt.Errorf("Failed to read cache archive, error: %s", err)
+	}
+	defer gz.Close()
+
+	var (
+		tr      = tar.NewReader(gz)
+		entries = map[string]string{}
+	)
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return stats, fmt.Errorf("Failed to read cache archive, error: %s", err)
+		}
+
+		if hdr.Name == cacheArchiveImages {
+			log.Infof("| Load images")
+			if err := client.LoadImages(tr); err != nil {
+				return stats, fmt.Errorf("Failed to load cached images, error: %s", err)
+			}
+			continue
+		}
+
+		rel := strings.TrimPrefix(hdr.Name, cacheArchiveDir)
+		parts := strings.Split(rel, "/")
+		if rel == hdr.Name || len(parts) != 2 || !isCacheArchiveName(parts[0]) || !isCacheArchiveName(parts[1]) || !strings.HasSuffix(rel, ".json") {
+			return stats, fmt.Errorf("Unexpected file %s in cache archive", hdr.Name)
+		}
+
+		data, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return stats, err
+		}
+		s := State{}
+		if err := json.Unmarshal(data, &s); err != nil {
+			return stats, fmt.Errorf("Failed to parse cache file %s json, error: %s", hdr.Name, err)
+		}
+
+		fileName := filepath.Join(cacheDir, parts[0], parts[1])
+		if err := writeCacheFile(cacheDir, parts[0], fileName, data); err != nil {
+			return stats, err
+		}
+		entries[fileName] = s.ImageID
+	}
+
+	resolved := map[string]bool{}
+	for fileName, imageID := range entries {
+		if _, ok := resolved[imageID]; !ok {
+			img, err := client.InspectImage(imageID)
+			if err != nil {
+				return stats, err
+			}
+			resolved[imageID] = img != nil
+			if img != nil {
+				stats.Images++
+			}
+		}
+		if !resolved[imageID] {
+			log.Warnf("| Image %.12s of cache entry %s is not found after the import, remove the entry", imageID, fileName)
+			os.Remove(fileName)
+			stats.Skipped = append(stats.Skipped, fileName)
+			continue
+		}
+		stats.Entries++
+	}
+
+	return stats, nil
+}
+
+// isCacheArchiveName checks the path component of a cache entry does not escape the cache dir
+func isCacheArchiveName(name string) bool {
+	return name != "" && name != "." && name != ".." && !strings.ContainsAny(name, "\\/")
+}
+
+func writeTarFile(tw *tar.Writer, name string, data []byte, modTime time.Time) error {
+	hdr := &tar.Header{
+		Name:    name,
+		Mode:    0644,
+		Size:    int64(len(data)),
+		ModTime: modTime,
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err := tw.Write(data)
+	return err
+}
+
+// writeCacheFile writes the imported cache entry under the exclusive lock of its key
+func writeCacheFile(cacheDir, key, fileName string, data []byte) error {
+	lock, err := lockCacheKey(cacheDir, key, true)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
+	if err := util.MkdirAllOutput(filepath.Dir(fileName), 0755); err != nil {
+		return err
+	}
+	if err := util.WriteOutputFile(fileName, data, 0644); err != nil {
+		return fmt.Errorf("Failed to write cache file %s, error: %s", fileName, err)
+	}
+	return nil
+}
@@ -0,0 +1,114 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestCacheArchive(t *testing.T) {
+	srcDir := cacheTestTmpDir(t)
+	defer os.RemoveAll(srcDir)
+	dstDir := cacheTestTmpDir(t)
+	defer os.RemoveAll(dstDir)
+
+	cache := NewCacheFS(srcDir, Hash{})
+	cache.Put(State{ParentID: "123", ImageID: "456", Commits: []string{"RUN [\"make\"]"}})
+	cache.Put(State{ParentID: "456", ImageID: "789", Commits: []string{"RUN [\"make test\"]"}})
+	cache.Put(State{ParentID: "123", ImageID: "999", Commits: []string{"RUN [\"make clean\"]"}})
+
+	c := &MockClient{}
+
+	c.On("InspectImage", "456").Return(&docker.Image{ID: "456"}, nil)
+	c.On("InspectImage", "789").Return(&docker.Image{ID: "789"}, nil)
+	c.On("InspectImage", "999").Return((*docker.Image)(nil), nil)
+
+	c.On("SaveImages", []string{"456", "789"}, mock.Anything).Return(nil).Run(func(args mock.Arguments) {
+		args.Get(1).(io.Writer).Write([]byte("images"))
+	}).Once()
+
+	buf := &bytes.Buffer{}
+	stats, err := ExportCache(c, srcDir, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 2, stats.Entries)
+	assert.Equal(t, 2, stats.Images)
+	assert.Equal(t, []string{filepath.Join(srcDir, "123", "999.json")}, stats.Skipped)
+
+	c.On("LoadImages", mock.Anything).Return(nil).Run(func(args mock.Arguments) {
+		data, _ := ioutil.ReadAll(args.Get(0).(io.Reader))
+		assert.Equal(t, "images", string(data))
+	}).Once()
+
+	if stats, err = ImportCache(c, dstDir, buf); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 2, stats.Entries)
+	assert.Len(t, stats.Skipped, 0)
+
+	res, err := NewCacheFS(dstDir, Hash{}).Get(State{ImageID: "456", Commits: []string{"RUN [\"make test\"]"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "789", res.ImageID)
+
+	c.AssertExpectations(t)
+}
+
+func TestCacheArchive_Unresolved(t *testing.T) {
+	srcDir := cacheTestTmpDir(t)
+	defer os.RemoveAll(srcDir)
+	dstDir := cacheTestTmpDir(t)
+	defer os.RemoveAll(dstDir)
+
+	NewCacheFS(srcDir, Hash{}).Put(State{ParentID: "123", ImageID: "456"})
+
+	c := &MockClient{}
+	c.On("InspectImage", "456").Return(&docker.Image{ID: "456"}, nil).Once()
+	c.On("SaveImages", []string{"456"}, mock.Anything).Return(nil).Once()
+
+	buf := &bytes.Buffer{}
+	if _, err := ExportCache(c, srcDir, buf); err != nil {
+		t.Fatal(err)
+	}
+
+	// The image got a different id on the other host
+	c.On("LoadImages", mock.Anything).Return(nil).Once()
+	c.On("InspectImage", "456").Return((*docker.Image)(nil), nil).Once()
+
+	stats, err := ImportCache(c, dstDir, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 0, stats.Entries)
+	assert.Equal(t, []string{filepath.Join(dstDir, "123", "456.json")}, stats.Skipped)
+
+	_, err = os.Stat(filepath.Join(dstDir, "123", "456.json"))
+	assert.True(t, os.IsNotExist(err))
+
+	c.AssertExpectations(t)
+}
@@ -0,0 +1,84 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Reasons of cache misses counted by CacheStats
+const (
+	CacheMissNew     = "first build"
+	CacheMissChanged = "content change"
+	CacheMissBusted  = "previous step changed"
+	CacheMissReload  = "--reload-cache"
+	CacheMissRemoved = "cached image removed"
+	// CacheMissUnknown is the miss of a cache backend that cannot tell the reason
+	CacheMissUnknown = "not cached"
+)
+
+// CacheStats are the cache statistics of the build
+type CacheStats struct {
+	Steps       int            `json:"steps"`
+	Hits        int            `json:"hits"`
+	Misses      int            `json:"misses"`
+	Saved       time.Duration  `json:"saved"`
+	MissReasons map[string]int `json:"miss_reasons,omitempty"`
+}
+
+func (s *CacheStats) hit(saved time.Duration) {
+	s.Hits++
+	s.Saved += saved
+}
+
+func (s *CacheStats) miss(reason string) {
+	if s.MissReasons == nil {
+		s.MissReasons = map[string]int{}
+	}
+	s.Misses++
+	s.MissReasons[reason]++
+}
+
+// String returns the summary line, e.g.
+// 12 steps, 8 cache hits (saved ~3m0s), 2 misses (1 content change, 1 previous step changed)
+func (s CacheStats) String() string {
+	summary := fmt.Sprintf("%d steps, %d cache hits", s.Steps, s.Hits)
+	if s.Saved > 0 {
+		summary += fmt.Sprintf(" (saved ~%s)", s.Saved)
+	}
+	summary += fmt.Sprintf(", %d misses", s.Misses)
+
+	if len(s.MissReasons) == 0 {
+		return summary
+	}
+
+	keys := []string{}
+	for reason := range s.MissReasons {
+		keys = append(keys, reason)
+	}
+	sort.Strings(keys)
+
+	reasons := make([]string, len(keys))
+	for i, reason := range keys {
+		reasons[i] = fmt.Sprintf("%d %s", s.MissReasons[reason], reason)
+	}
+
+	return summary + " (" + strings.Join(reasons, ", ") + ")"
+}
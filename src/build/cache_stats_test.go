@@ -0,0 +1,126 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCacheStats_String(t *testing.T) {
+	s := CacheStats{Steps: 12}
+	assert.Equal(t, "12 steps, 0 cache hits, 0 misses", s.String())
+
+	s.hit(2 * time.Minute)
+	s.hit(time.Minute)
+	s.miss(CacheMissChanged)
+	s.miss(CacheMissBusted)
+	s.miss(CacheMissBusted)
+
+	assert.Equal(t, "12 steps, 2 cache hits (saved ~3m0s), 3 misses (1 content change, 2 previous step changed)", s.String())
+}
+
+func TestCacheStats_ProbeCache(t *testing.T) {
+	tmpDir := cacheTestTmpDir(t)
+	defer os.RemoveAll(tmpDir)
+
+	b, c := makeBuild(t, "FROM ubuntu", Config{ExplainCacheMiss: true})
+	b.cache = NewCacheFS(tmpDir, Hash{})
+
+	cached := State{
+		ParentID: "123",
+		ImageID:  "456",
+		Commits:  []string{"RUN a"},
+		Duration: 2 * time.Minute,
+	}
+	if err := b.cache.Put(cached); err != nil {
+		t.Fatal(err)
+	}
+
+	c.On("InspectImage", "456").Return(&docker.Image{ID: "456"}, nil).Once()
+
+	probe := func(s State) bool {
+		_, hit, err := b.probeCache(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return hit
+	}
+
+	assert.True(t, probe(State{ImageID: "123", Commits: []string{"RUN a"}}))
+	assert.False(t, probe(State{ImageID: "123", Commits: []string{"RUN b"}}))
+	assert.False(t, probe(State{ImageID: "789", Commits: []string{"RUN c"}}))
+	assert.False(t, probe(State{ImageID: "123", NoCache: StateNoCache{CacheBusted: true}}))
+
+	assert.Equal(t, CacheStats{
+		Hits:   1,
+		Misses: 3,
+		Saved:  2 * time.Minute,
+		MissReasons: map[string]int{
+			CacheMissChanged: 1,
+			CacheMissNew:     1,
+			CacheMissBusted:  1,
+		},
+	}, b.CacheStats)
+
+	// without --explain-cache-miss the misses are told apart by the states
+	// cached on top of the image only
+	b.cfg.ExplainCacheMiss = false
+	assert.False(t, probe(State{ImageID: "789", Commits: []string{"RUN d"}}))
+	assert.False(t, probe(State{ImageID: "123", Commits: []string{"RUN e"}}))
+	assert.Equal(t, 2, b.CacheStats.MissReasons[CacheMissNew])
+	assert.Equal(t, 2, b.CacheStats.MissReasons[CacheMissChanged])
+
+	c.AssertExpectations(t)
+}
+
+// parentOnlyCache is the cache backend that cannot find the nearest state
+type parentOnlyCache struct {
+	fs *CacheFS
+}
+
+func (c parentOnlyCache) Get(s State) (*State, error)            { return c.fs.Get(s) }
+func (c parentOnlyCache) Put(s State) error                      { return c.fs.Put(s) }
+func (c parentOnlyCache) Del(s State) error                      { return c.fs.Del(s) }
+func (c parentOnlyCache) HasParent(imageID string) (bool, error) { return c.fs.HasParent(imageID) }
+
+func TestCacheStats_ProbeCache_NoNearest(t *testing.T) {
+	tmpDir := cacheTestTmpDir(t)
+	defer os.RemoveAll(tmpDir)
+
+	b, _ := makeBuild(t, "FROM ubuntu", Config{ExplainCacheMiss: true})
+	b.cache = parentOnlyCache{NewCacheFS(tmpDir, Hash{})}
+
+	if err := b.cache.Put(State{ParentID: "123", ImageID: "456", Commits: []string{"RUN a"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, s := range []State{
+		{ImageID: "123", Commits: []string{"RUN b"}},
+		{ImageID: "789", Commits: []string{"RUN c"}},
+	} {
+		if _, hit, err := b.probeCache(s); err != nil || hit {
+			t.Fatalf("expected a miss, got hit %t, error %v", hit, err)
+		}
+	}
+
+	assert.Equal(t, map[string]int{CacheMissChanged: 1, CacheMissNew: 1}, b.CacheStats.MissReasons)
+}
@@ -0,0 +1,331 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/grammarly/rocker/src/imagename"
+	"github.com/grammarly/rocker/src/util"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// CacheTagPrefix is the prefix of the tags made by CacheTags
+const CacheTagPrefix = "sha256-"
+
+// Tag returns the deterministic image tag made of the cache key,
+// e.g. sha256-4f2a...
+func (k CacheKey) Tag() string {
+	data, _ := json.Marshal(k)
+	return fmt.Sprintf("%s%x", CacheTagPrefix, sha256.Sum256(data))
+}
+
+// CacheTagsOptions stores options of the tags based cache backend
+type CacheTagsOptions struct {
+	// Repo is the repository to tag intermediate images with, e.g. rocker/cache
+	Repo string
+
+	// From is the list of repositories to pull the cache tags from
+	// if they are not present locally
+	From []string
+
+	// Push makes the tags pushed to the registry of Repo
+	Push bool
+
+	// Inner is the cache backend that is consulted first, may be nil
+	Inner Cache
+
+	// IndexDir keeps the last use time of the tags, for GC
+	IndexDir string
+}
+
+// CacheTags implements the cache backend that stores intermediate images
+// under the tags derived from their cache keys, so the cache can be shared
+// between machines through a registry
+type CacheTags struct {
+	client Client
+	opts   CacheTagsOptions
+}
+
+// NewCacheTags creates a tags based cache backend
+func NewCacheTags(client Client, opts CacheTagsOptions) *CacheTags {
+	return &CacheTags{
+		client: client,
+		opts:   opts,
+	}
+}
+
+// Get fetches cache
+func (c *CacheTags) Get(s State) (res *State, err error) {
+	if c.opts.Inner != nil {
+		if res, err = c.opts.Inner.Get(s); err != nil || res != nil {
+			return res, err
+		}
+	}
+
+	if !isTaggableState(s) {
+		return nil, nil
+	}
+
+	tag := NewCacheKey(s).Tag()
+
+	for _, repo := range c.repos() {
+		name := repo + ":" + tag
+
+		img, err := c.client.InspectImage(name)
+		if err != nil {
+			return nil, err
+		}
+
+		if img == nil && c.isFrom(repo) {
+			if err := c.client.PullImage(name); err != nil {
+				log.Debugf("CACHE TAG %s not pulled, error: %s", name, err)
+				continue
+			}
+			if img, err = c.client.InspectImage(name); err != nil {
+				return nil, err
+			}
+		}
+
+		if img == nil {
+			continue
+		}
+
+		log.Debugf("CACHE TAG HIT %s %.12s", name, img.ID)
+		c.touch(tag)
+
+		res = &State{}
+		*res = s
+		res.ParentID = s.ImageID
+		res.ImageID = img.ID
+		res.ParentSize = s.Size
+		res.Size = img.VirtualSize
+		res.ProducedImage = true
+
+		return res, nil
+	}
+
+	return nil, nil
+}
+
+// Put stores cache
+func (c *CacheTags) Put(s State) error {
+	if c.opts.Inner != nil {
+		if err := c.opts.Inner.Put(s); err != nil {
+			return err
+		}
+	}
+
+	if c.opts.Repo == "" || !isTaggableState(s) {
+		return nil
+	}
+
+	// The state was committed on top of its ParentID
+	key := CacheKey{
+		ParentID: s.ParentID,
+		Commits:  s.Commits,
+		Env:      s.Config.Env,
+	}
+	name := c.opts.Repo + ":" + key.Tag()
+
+	if err := c.client.TagImage(s.ImageID, name); err != nil {
+		return fmt.Errorf("Failed to tag cache image %.12s, error: %s", s.ImageID, err)
+	}
+	c.touch(key.Tag())
+
+	if c.opts.Push {
+		if _, err := c.client.PushImage(name); err != nil {
+			// Failing to share the cache should not fail the build
+			log.Warnf("| Failed to push cache image %s, error: %s", name, err)
+		}
+	}
+
+	return nil
+}
+
+// Del deletes cache
+func (c *CacheTags) Del(s State) error {
+	if c.opts.Inner != nil {
+		if err := c.opts.Inner.Del(s); err != nil {
+			return err
+		}
+	}
+
+	if c.opts.Repo == "" {
+		return nil
+	}
+
+	key := CacheKey{
+		ParentID: s.ParentID,
+		Commits:  s.Commits,
+		Env:      s.Config.Env,
+	}
+
+	return c.untag(key.Tag())
+}
+
+// Nearest implements CacheNearestFinder using the inner cache
+func (c *CacheTags) Nearest(s State) (*State, error) {
+	if finder, ok := c.opts.Inner.(CacheNearestFinder); ok {
+		return finder.Nearest(s)
+	}
+	return nil, nil
+}
+
+// GC untags the cache images of Repo that were not used during maxAge;
+// the images that are not referenced anymore are removed by docker
+func (c *CacheTags) GC(maxAge time.Duration) (removed []string, err error) {
+	if c.opts.Repo == "" {
+		return nil, fmt.Errorf("Cache repository is not specified")
+	}
+
+	images, err := c.client.ListImages()
+	if err != nil {
+		return nil, err
+	}
+
+	repo := imagename.NewFromString(c.opts.Repo).CanonicalName()
+	deadline := time.Now().Add(-maxAge)
+
+	for _, image := range images {
+		tag := image.GetTag()
+		if image.CanonicalName() != repo || !strings.HasPrefix(tag, CacheTagPrefix) {
+			continue
+		}
+
+		lastUsed, err := c.lastUsed(image.String())
+		if err != nil {
+			return removed, err
+		}
+		if lastUsed.After(deadline) {
+			continue
+		}
+
+		if err := c.untag(tag); err != nil {
+			return removed, err
+		}
+		removed = append(removed, image.String())
+	}
+
+	return removed, nil
+}
+
+// lastUsed returns the time the cache tag was used last time, for
+// the tags that are not in the index, e.g. pulled or made on other
+// machine, it is the image creation time
+func (c *CacheTags) lastUsed(name string) (time.Time, error) {
+	tag := imagename.NewFromString(name).GetTag()
+
+	if c.opts.IndexDir != "" {
+		if info, err := os.Stat(filepath.Join(c.opts.IndexDir, tag)); err == nil {
+			return info.ModTime(), nil
+		}
+	}
+
+	img, err := c.client.InspectImage(name)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if img == nil {
+		return time.Time{}, nil
+	}
+	return img.Created, nil
+}
+
+func (c *CacheTags) untag(tag string) error {
+	name := c.opts.Repo + ":" + tag
+
+	img, err := c.client.InspectImage(name)
+	if err != nil {
+		return err
+	}
+	if img != nil {
+		if err := c.client.RemoveImage(name); err != nil {
+			return fmt.Errorf("Failed to remove cache tag %s, error: %s", name, err)
+		}
+	}
+
+	if c.opts.IndexDir != "" {
+		os.Remove(filepath.Join(c.opts.IndexDir, tag))
+	}
+
+	return nil
+}
+
+// touch marks the cache tag as used now
+func (c *CacheTags) touch(tag string) {
+	if c.opts.IndexDir == "" {
+		return
+	}
+
+	fileName := filepath.Join(c.opts.IndexDir, tag)
+	now := time.Now()
+
+	if err := os.Chtimes(fileName, now, now); err == nil {
+		return
+	}
+	if err := util.MkdirAllOutput(c.opts.IndexDir, 0755); err != nil {
+		log.Debugf("Failed to create cache tags index dir, error: %s", err)
+		return
+	}
+	f, err := util.CreateOutputFile(fileName)
+	if err != nil {
+		log.Debugf("Failed to create cache tags index file, error: %s", err)
+		return
+	}
+	f.Close()
+}
+
+// repos returns the repositories to look the cache tags up in
+func (c *CacheTags) repos() (repos []string) {
+	if c.opts.Repo != "" {
+		repos = append(repos, c.opts.Repo)
+	}
+	for _, repo := range c.opts.From {
+		if repo != c.opts.Repo {
+			repos = append(repos, repo)
+		}
+	}
+	return repos
+}
+
+func (c *CacheTags) isFrom(repo string) bool {
+	for _, r := range c.opts.From {
+		if r == repo {
+			return true
+		}
+	}
+	return false
+}
+
+// isTaggableState returns false for the states that cannot be restored
+// out of an image, e.g. EXPORT relies on a local exports container
+func isTaggableState(s State) bool {
+	for _, commit := range s.Commits {
+		if strings.HasPrefix(commit, "EXPORT ") {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,163 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/grammarly/rocker/src/imagename"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCacheKey_Tag(t *testing.T) {
+	key := CacheKey{ParentID: "123", Commits: []string{"RUN [\"make\"]"}}
+
+	assert.Regexp(t, "^sha256-[0-9a-f]{64}$", key.Tag())
+	assert.Equal(t, key.Tag(), CacheKey{ParentID: "123", Commits: []string{"RUN [\"make\"]"}}.Tag())
+	assert.NotEqual(t, key.Tag(), CacheKey{ParentID: "124", Commits: []string{"RUN [\"make\"]"}}.Tag())
+}
+
+func TestCacheTags_PutGet(t *testing.T) {
+	tmpDir := cacheTestTmpDir(t)
+	defer os.RemoveAll(tmpDir)
+
+	client := &MockClient{}
+	c := NewCacheTags(client, CacheTagsOptions{Repo: "rocker/cache", IndexDir: tmpDir})
+
+	s := State{ParentID: "123", ImageID: "456", Commits: []string{"RUN [\"make\"]"}}
+	tag := CacheKey{ParentID: "123", Commits: s.Commits}.Tag()
+
+	client.On("TagImage", "456", "rocker/cache:"+tag).Return(nil).Once()
+
+	if err := c.Put(s); err != nil {
+		t.Fatal(err)
+	}
+
+	client.On("InspectImage", "rocker/cache:"+tag).Return(&docker.Image{ID: "456", VirtualSize: 100}, nil).Once()
+
+	res, err := c.Get(State{ImageID: "123", Size: 40, Commits: s.Commits})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client.AssertExpectations(t)
+	assert.Equal(t, "456", res.ImageID)
+	assert.Equal(t, "123", res.ParentID)
+	assert.Equal(t, int64(100), res.Size)
+	assert.Equal(t, int64(40), res.ParentSize)
+	_, err = os.Stat(filepath.Join(tmpDir, tag))
+	assert.NoError(t, err)
+}
+
+func TestCacheTags_GetFrom(t *testing.T) {
+	client := &MockClient{}
+	c := NewCacheTags(client, CacheTagsOptions{From: []string{"registry.example.com/cache"}})
+
+	s := State{ImageID: "123", Commits: []string{"RUN [\"make\"]"}}
+	name := "registry.example.com/cache:" + NewCacheKey(s).Tag()
+
+	client.On("InspectImage", name).Return((*docker.Image)(nil), nil).Once()
+	client.On("PullImage", name).Return(nil).Once()
+	client.On("InspectImage", name).Return(&docker.Image{ID: "456"}, nil).Once()
+
+	res, err := c.Get(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client.AssertExpectations(t)
+	assert.Equal(t, "456", res.ImageID)
+}
+
+func TestCacheTags_GetMiss(t *testing.T) {
+	client := &MockClient{}
+	c := NewCacheTags(client, CacheTagsOptions{Repo: "rocker/cache", From: []string{"registry.example.com/cache"}})
+
+	s := State{ImageID: "123", Commits: []string{"RUN [\"make\"]"}}
+	tag := NewCacheKey(s).Tag()
+
+	client.On("InspectImage", "rocker/cache:"+tag).Return((*docker.Image)(nil), nil).Once()
+	client.On("InspectImage", "registry.example.com/cache:"+tag).Return((*docker.Image)(nil), nil).Once()
+	client.On("PullImage", "registry.example.com/cache:"+tag).Return(fmt.Errorf("not found")).Once()
+
+	res, err := c.Get(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client.AssertExpectations(t)
+	assert.Nil(t, res)
+
+	// EXPORT states are never looked up by tags
+	res, err = c.Get(State{ImageID: "123", Commits: []string{"EXPORT \"/app\" to /"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Nil(t, res)
+}
+
+func TestCacheTags_GC(t *testing.T) {
+	tmpDir := cacheTestTmpDir(t)
+	defer os.RemoveAll(tmpDir)
+
+	client := &MockClient{}
+	c := NewCacheTags(client, CacheTagsOptions{Repo: "rocker/cache", IndexDir: tmpDir})
+
+	var (
+		fresh = CacheTagPrefix + "aaa"
+		stale = CacheTagPrefix + "bbb"
+		old   = CacheTagPrefix + "ccc"
+	)
+
+	c.touch(fresh)
+	c.touch(stale)
+	past := time.Now().Add(-48 * time.Hour)
+	if err := os.Chtimes(filepath.Join(tmpDir, stale), past, past); err != nil {
+		t.Fatal(err)
+	}
+
+	client.On("ListImages").Return([]*imagename.ImageName{
+		imagename.NewFromString("rocker/cache:" + fresh),
+		imagename.NewFromString("rocker/cache:" + stale),
+		imagename.NewFromString("rocker/cache:" + old),
+		imagename.NewFromString("rocker/cache:latest"),
+		imagename.NewFromString("rocker/other:" + old),
+	}, nil).Once()
+
+	// not in the index, creation time is used
+	client.On("InspectImage", "rocker/cache:"+old).Return(&docker.Image{ID: "3", Created: past}, nil)
+	client.On("InspectImage", "rocker/cache:"+stale).Return(&docker.Image{ID: "2", Created: past}, nil).Once()
+	client.On("RemoveImage", "rocker/cache:"+stale).Return(nil).Once()
+	client.On("RemoveImage", "rocker/cache:"+old).Return(nil).Once()
+
+	removed, err := c.GC(24 * time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client.AssertExpectations(t)
+	assert.Equal(t, []string{"rocker/cache:" + stale, "rocker/cache:" + old}, removed)
+	_, err = os.Stat(filepath.Join(tmpDir, fresh))
+	assert.NoError(t, err)
+	_, err = os.Stat(filepath.Join(tmpDir, stale))
+	assert.True(t, os.IsNotExist(err))
+}
@@ -28,7 +28,7 @@ func TestCache_Basic(t *testing.T) {
 	tmpDir := cacheTestTmpDir(t)
 	defer os.RemoveAll(tmpDir)
 
-	c := NewCacheFS(tmpDir)
+	c := NewCacheFS(tmpDir, Hash{})
 
 	s := State{
 		ParentID: "123",
@@ -59,6 +59,63 @@ func TestCache_Basic(t *testing.T) {
 	assert.Nil(t, res2)
 }
 
+func TestCache_Nearest(t *testing.T) {
+	tmpDir := cacheTestTmpDir(t)
+	defer os.RemoveAll(tmpDir)
+
+	c := NewCacheFS(tmpDir, Hash{})
+
+	s1 := State{ParentID: "123", ImageID: "456", Commits: []string{"ENV FOO=bar", "LABEL a=b"}}
+	s1.Config.Env = []string{"FOO=bar"}
+	s2 := State{ParentID: "123", ImageID: "457", Commits: []string{"RUN [\"make\"]"}}
+	s3 := State{ParentID: "999", ImageID: "458", Commits: []string{"COPY tarsum.v1+sha256:1 to /"}}
+
+	for _, s := range []State{s1, s2, s3} {
+		if err := c.Put(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Same parent, most similar commits
+	probe := State{ImageID: "123", Commits: []string{"ENV FOO=baz", "LABEL a=b"}}
+	probe.Config.Env = []string{"FOO=baz"}
+
+	res, err := c.Nearest(probe)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "456", res.ImageID)
+	assert.Equal(t, []string{
+		"- ENV FOO=bar",
+		"+ ENV FOO=baz",
+		`env FOO changed: "bar" -> "baz"`,
+	}, ExplainCacheMiss(NewCacheKey(probe), res))
+
+	// Same commits, different parent
+	probe = State{ImageID: "777", Commits: []string{"COPY tarsum.v1+sha256:1 to /"}}
+
+	res, err = c.Nearest(probe)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "458", res.ImageID)
+	assert.Equal(t, []string{
+		"parent image differs: cached 999, current 777",
+	}, ExplainCacheMiss(NewCacheKey(probe), res))
+
+	// Nothing similar
+	probe = State{ImageID: "888", Commits: []string{"RUN [\"ls\"]"}}
+
+	res, err = c.Nearest(probe)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Nil(t, res)
+	assert.Equal(t, []string{
+		"no cached states found on top of image 888 and no same step cached on top of other images",
+	}, ExplainCacheMiss(NewCacheKey(probe), res))
+}
+
 func cacheTestTmpDir(t *testing.T) string {
 	tmpDir, err := ioutil.TempDir("", "rocker-cache-test")
 	if err != nil {
@@ -0,0 +1,161 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	gotemplate "text/template"
+	"time"
+
+	"github.com/grammarly/rocker/src/imagename"
+	"github.com/grammarly/rocker/src/template"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/wmark/semver"
+)
+
+// PublishChannel rewrites the tags of the TAG and PUSH targets, so that the tagging
+// convention is kept in one place instead of being templated in each Rockerfile
+type PublishChannel struct {
+	Name string `yaml:"-"`
+
+	// Tag is the template of the new tag, its data are .Name and .Tag of the target,
+	// .Timestamp of the build start, e.g. 20160102150405, and .Vars of the Rockerfile
+	Tag string `yaml:"tag"`
+
+	// Semver is the variable that should hold a semver version, e.g. Version
+	Semver string `yaml:"semver"`
+
+	tmpl *gotemplate.Template
+}
+
+// DefaultPublishChannels are used unless .rocker.yml configures the channels of the same name
+var DefaultPublishChannels = map[string]PublishChannel{
+	"snapshot": {Tag: "{{ .Tag }}-SNAPSHOT.{{ .Timestamp }}"},
+	"release":  {Tag: "{{ .Vars.Version }}", Semver: "Version"},
+}
+
+// publishTagRegexp is the format of docker tags
+var publishTagRegexp = regexp.MustCompile(`^[\w][\w.-]{0,127}$`)
+
+// publishTagData is the data of the tag template
+type publishTagData struct {
+	Name      string
+	Tag       string
+	Timestamp string
+	Vars      template.Vars
+}
+
+// GetPublishChannel returns the channel configured in .rocker.yml or the default one
+func GetPublishChannel(name string, configured map[string]PublishChannel) (*PublishChannel, error) {
+	ch, ok := configured[name]
+	if !ok {
+		if ch, ok = DefaultPublishChannels[name]; !ok {
+			return nil, fmt.Errorf("Unknown publish channel %q, available are: %s", name, strings.Join(publishChannelNames(configured), ", "))
+		}
+	}
+
+	ch.Name = name
+	if err := ch.compile(); err != nil {
+		return nil, err
+	}
+	return &ch, nil
+}
+
+func publishChannelNames(configured map[string]PublishChannel) (names []string) {
+	for name := range DefaultPublishChannels {
+		names = append(names, name)
+	}
+	for name := range configured {
+		if _, ok := DefaultPublishChannels[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (ch *PublishChannel) compile() (err error) {
+	if ch.Tag == "" {
+		return fmt.Errorf("Publish channel %s has no tag template", ch.Name)
+	}
+	if ch.tmpl, err = gotemplate.New(ch.Name).Option("missingkey=error").Parse(ch.Tag); err != nil {
+		return fmt.Errorf("Failed to parse tag template of publish channel %s, error: %s", ch.Name, err)
+	}
+	return nil
+}
+
+// Check verifies the variables the channel requires
+func (ch *PublishChannel) Check(vars template.Vars) error {
+	if ch.Semver == "" {
+		return nil
+	}
+	value, ok := vars[ch.Semver]
+	if !ok {
+		return fmt.Errorf("Publish channel %s requires variable %s with a semver version, e.g. -var %s=1.2.3", ch.Name, ch.Semver, ch.Semver)
+	}
+	version := fmt.Sprintf("%v", value)
+	if _, err := semver.NewVersion(strings.TrimPrefix(version, "v")); err != nil {
+		return fmt.Errorf("Publish channel %s requires variable %s to be a semver version, got %q", ch.Name, ch.Semver, version)
+	}
+	return nil
+}
+
+// Rewrite gives the image name with the tag made by the channel template
+func (ch *PublishChannel) Rewrite(name string, vars template.Vars, started time.Time) (string, error) {
+	img := imagename.NewFromString(name)
+	if img.TagIsDigest() {
+		return "", fmt.Errorf("Cannot apply publish channel %s to %s, it refers to a digest", ch.Name, name)
+	}
+
+	var buf bytes.Buffer
+	if err := ch.tmpl.Execute(&buf, publishTagData{
+		Name:      img.NameWithRegistry(),
+		Tag:       img.GetTag(),
+		Timestamp: started.UTC().Format("20060102150405"),
+		Vars:      vars,
+	}); err != nil {
+		return "", fmt.Errorf("Failed to make the tag of %s for publish channel %s, error: %s", name, ch.Name, err)
+	}
+
+	tag := buf.String()
+	if !publishTagRegexp.MatchString(tag) {
+		return "", fmt.Errorf("Publish channel %s made invalid tag %q of %s", ch.Name, tag, name)
+	}
+
+	img.SetTag(tag)
+	return img.String(), nil
+}
+
+// publishName applies the publish channel of the build to the TAG or PUSH target
+func (b *Build) publishName(name string) (string, error) {
+	if b.cfg.PublishChannel == nil {
+		return name, nil
+	}
+	rewritten, err := b.cfg.PublishChannel.Rewrite(name, b.rockerfile.Vars, b.started)
+	if err != nil {
+		return "", err
+	}
+	if rewritten != name {
+		log.Infof("| Publish channel %s: %s -> %s", b.cfg.PublishChannel.Name, name, rewritten)
+	}
+	return rewritten, nil
+}
@@ -0,0 +1,130 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"testing"
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/grammarly/rocker/src/template"
+	"github.com/stretchr/testify/assert"
+)
+
+var testPublishStarted = time.Date(2016, 1, 2, 15, 4, 5, 0, time.UTC)
+
+func TestPublishChannel_Snapshot(t *testing.T) {
+	ch, err := GetPublishChannel("snapshot", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	name, err := ch.Rewrite("registry.internal/app:1.2", template.Vars{}, testPublishStarted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "registry.internal/app:1.2-SNAPSHOT.20160102150405", name)
+
+	name, err = ch.Rewrite("registry.internal/app", template.Vars{}, testPublishStarted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "registry.internal/app:latest-SNAPSHOT.20160102150405", name)
+}
+
+func TestPublishChannel_Release(t *testing.T) {
+	ch, err := GetPublishChannel("release", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.EqualError(t, ch.Check(template.Vars{}), "Publish channel release requires variable Version with a semver version, e.g. -var Version=1.2.3")
+	assert.EqualError(t, ch.Check(template.Vars{"Version": "master"}), `Publish channel release requires variable Version to be a semver version, got "master"`)
+	assert.NoError(t, ch.Check(template.Vars{"Version": "v1.2.3"}))
+
+	name, err := ch.Rewrite("app:latest", template.Vars{"Version": "1.2.3"}, testPublishStarted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "app:1.2.3", name)
+}
+
+func TestPublishChannel_Configured(t *testing.T) {
+	configured := map[string]PublishChannel{
+		"release": {Tag: "{{ .Vars.Version }}-{{ .Vars.Build }}"},
+		"nightly": {Tag: "nightly-{{ .Timestamp }}"},
+	}
+
+	ch, err := GetPublishChannel("release", configured)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NoError(t, ch.Check(template.Vars{}))
+
+	_, err = ch.Rewrite("app", template.Vars{"Version": "1.2.3"}, testPublishStarted)
+	assert.Error(t, err, "missing var should fail")
+
+	ch, err = GetPublishChannel("nightly", configured)
+	if err != nil {
+		t.Fatal(err)
+	}
+	name, err := ch.Rewrite("s3.amazonaws.com/bucket/app:1", template.Vars{}, testPublishStarted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "s3.amazonaws.com/bucket/app:nightly-20160102150405", name)
+
+	_, err = GetPublishChannel("beta", configured)
+	assert.EqualError(t, err, `Unknown publish channel "beta", available are: nightly, release, snapshot`)
+}
+
+func TestPublishChannel_InvalidTag(t *testing.T) {
+	ch, err := GetPublishChannel("custom", map[string]PublishChannel{"custom": {Tag: "{{ .Tag }}/x"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ch.Rewrite("app:1", template.Vars{}, testPublishStarted)
+	assert.EqualError(t, err, `Publish channel custom made invalid tag "1/x" of app:1`)
+}
+
+func TestCommandPush_PublishChannel(t *testing.T) {
+	ch, err := GetPublishChannel("snapshot", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, c := makeBuild(t, "", Config{PublishChannel: ch})
+	cmd := NewCommand(ConfigCommand{
+		name: "push",
+		args: []string{"docker.io/grammarly/rocker:1.0"},
+	})
+
+	b.cfg.Push = true
+	b.state.ImageID = "123"
+	b.started = testPublishStarted
+
+	c.On("InspectImage", "123").Return(&docker.Image{ID: "123", Config: &docker.Config{}}, nil).Once()
+	c.On("TagImage", "123", "docker.io/grammarly/rocker:1.0-SNAPSHOT.20160102150405").Return(nil).Once()
+	c.On("PushImage", "docker.io/grammarly/rocker:1.0-SNAPSHOT.20160102150405").Return("sha256:fafa", nil).Once()
+
+	if _, err := cmd.Execute(b); err != nil {
+		t.Fatal(err)
+	}
+
+	c.AssertExpectations(t)
+	assert.Equal(t, "1.0-SNAPSHOT.20160102150405", b.Artifacts[0].Tag)
+}
@@ -20,14 +20,17 @@ import (
 	"bytes"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"os/signal"
 	"time"
 
+	"github.com/grammarly/rocker/src/deprecation"
 	"github.com/grammarly/rocker/src/dockerclient"
 	"github.com/grammarly/rocker/src/imagename"
 	"github.com/grammarly/rocker/src/storage/s3"
 	"github.com/grammarly/rocker/src/textformatter"
+	"github.com/grammarly/rocker/src/util"
 	"net/url"
 	"regexp"
 
@@ -50,15 +53,23 @@ type Client interface {
 	RemoveImage(imageID string) error
 	TagImage(imageID, imageName string) error
 	PushImage(imageName string) (digest string, err error)
+	PushArtifact(name string, artifact dockerclient.OCIArtifact) (digest string, err error)
 	EnsureImage(imageName string) error
+	ImportImage(imageName string, tarball io.Reader, changes []string) error
+	SaveImages(imageIDs []string, w io.Writer) error
+	LoadImages(r io.Reader) error
 	CreateContainer(state State) (id string, err error)
 	RunContainer(containerID string, attachStdin bool) error
+	RunContainerWithInput(containerID string, input io.Reader) error
 	CommitContainer(state *State) (img *docker.Image, err error)
 	RemoveContainer(containerID string) error
 	UploadToContainer(containerID string, stream io.Reader, path string) error
+	DownloadFromContainer(containerID string, path string, w io.Writer) error
 	EnsureContainer(containerName string, config *docker.Config, hostConfig *docker.HostConfig, purpose string) (containerID string, err error)
 	InspectContainer(containerName string) (*docker.Container, error)
+	ContainerChanges(containerID string) ([]docker.Change, error)
 	ResolveHostPath(path string) (resultPath string, err error)
+	FreeDiskSpace() (free int64, err error)
 }
 
 // DockerClientOptions stores options are used to create DockerClient object
@@ -72,6 +83,25 @@ type DockerClientOptions struct {
 	PushRetryCount           int
 	Host                     string
 	LogExactSizes            bool
+	Timeout                  time.Duration
+	CommitTimeout            time.Duration
+	Retries                  int
+	CommitNoPause            bool
+	CgroupParent             string
+
+	// PullTimeout limits an attempt to pull an image, PullRetries is the number
+	// of attempts after the failed one; LogPullProgress logs the progress of
+	// every layer as the structured entries instead of the progress bars
+	PullTimeout     time.Duration
+	PullRetries     int
+	LogPullProgress bool
+
+	// MaxStepLogBytes limits the output of a container that is logged,
+	// the rest is discarded; zero means no limit
+	MaxStepLogBytes int64
+
+	// TagCache caches the tag lists of the registries, optional
+	TagCache *TagCache
 }
 
 // DockerClient implements the client that works with a docker socket
@@ -86,6 +116,16 @@ type DockerClient struct {
 	isUnixSocket             bool
 	unixSockPath             string
 	useHumanSize             bool
+	timeout                  time.Duration
+	commitTimeout            time.Duration
+	retries                  int
+	commitNoPause            bool
+	cgroupParent             string
+	maxStepLogBytes          int64
+	pullTimeout              time.Duration
+	pullRetries              int
+	logPullProgress          bool
+	tagCache                 *TagCache
 }
 
 var (
@@ -118,81 +158,74 @@ func NewDockerClient(options DockerClientOptions) *DockerClient {
 		isUnixSocket:             isUnixSocket,
 		unixSockPath:             unixSockPath,
 		useHumanSize:             !options.LogExactSizes,
+		timeout:                  options.Timeout,
+		commitTimeout:            options.CommitTimeout,
+		retries:                  options.Retries,
+		commitNoPause:            options.CommitNoPause,
+		cgroupParent:             options.CgroupParent,
+		maxStepLogBytes:          options.MaxStepLogBytes,
+		pullTimeout:              options.PullTimeout,
+		pullRetries:              options.PullRetries,
+		logPullProgress:          options.LogPullProgress,
+		tagCache:                 options.TagCache,
 	}
 }
 
 // InspectImage inspects docker image
 // it does not give an error when image not found, but returns nil instead
 func (c *DockerClient) InspectImage(name string) (img *docker.Image, err error) {
+	res, err := c.withRetry("inspect", "image "+name, func() (interface{}, error) {
+		return c.client.InspectImage(name)
+	})
 	// We simply return nil in case image not found
-	if img, err = c.client.InspectImage(name); err == docker.ErrNoSuchImage {
+	if err == docker.ErrNoSuchImage {
 		return nil, nil
 	}
-	return img, err
+	if err != nil {
+		return nil, err
+	}
+	return res.(*docker.Image), nil
 }
 
 // PullImage pulls docker image
 func (c *DockerClient) PullImage(name string) error {
+	if err := util.CheckOffline("pull %s", name); err != nil {
+		return err
+	}
+
 	image := imagename.NewFromString(name)
 
 	// e.g. s3:bucket-name/image-name
 	if image.Storage == imagename.StorageS3 {
-		if isOld, warning := imagename.WarnIfOldS3ImageName(name); isOld {
-			c.log.Warn(warning)
+		if isOld, _ := imagename.WarnIfOldS3ImageName(name); isOld {
+			deprecation.Warn(deprecation.OldS3Name, name)
 		}
 
 		return c.s3storage.Pull(name)
 	}
 
-	var (
-		pipeReader, pipeWriter = io.Pipe()
-		fdOut, isTerminalOut   = term.GetFdInfo(c.log.Out)
-		out                    = c.log.Out
-		errch                  = make(chan error, 1)
-	)
-
-	if !isTerminalOut {
-		out = c.log.Writer()
-	}
-
-	opts := docker.PullImageOptions{
-		Repository:    image.NameWithRegistry(),
-		Registry:      image.Registry,
-		Tag:           image.GetTag(),
-		OutputStream:  pipeWriter,
-		RawJSONStream: true,
-	}
-
-	c.log.Infof("| Pull image %s", image)
-	c.log.Debugf("Pull image %s with options: %# v", image, opts)
-
-	go func() {
-		errch <- jsonmessage.DisplayJSONMessagesStream(pipeReader, out, fdOut, isTerminalOut)
-	}()
-
 	auth, err := dockerclient.GetAuthForRegistry(c.auth, image)
 	if err != nil {
 		return fmt.Errorf("Failed to authenticate registry %s, error: %s", image.Registry, err)
 	}
 
-	if err := c.client.PullImage(opts, auth); err != nil {
-		return err
-	}
+	c.log.Infof("| Pull image %s", image)
 
-	pipeWriter.Close()
-	return <-errch
+	return c.pullWithRetry(image, auth)
 }
 
 // ListImages lists all pulled images in the local docker registry
 func (c *DockerClient) ListImages() (images []*imagename.ImageName, err error) {
 
-	var dockerImages []docker.APIImages
-	if dockerImages, err = c.client.ListImages(docker.ListImagesOptions{}); err != nil {
-		return
+	res, err := c.withRetry("listing", "images", func() (interface{}, error) {
+		return c.client.ListImages(docker.ListImagesOptions{})
+	})
+	if err != nil {
+		return nil, err
 	}
 
 	images = []*imagename.ImageName{}
-	for _, image := range dockerImages {
+	for _, image := range res.([]docker.APIImages) {
 		for _, repoTag := range image.RepoTags {
 			images = append(images, imagename.NewFromString(repoTag))
 		}
@@ -203,11 +236,35 @@ func (c *DockerClient) ListImages() (images []*imagename.ImageName, err error) {
 
 // ListImageTags returns the list of images instances obtained from all tags existing in the registry
 func (c *DockerClient) ListImageTags(name string) (images []*imagename.ImageName, err error) {
+	if err = util.CheckOffline("list the tags of %s", name); err != nil {
+		return nil, err
+	}
 	img := imagename.NewFromString(name)
 	if img.Storage == imagename.StorageS3 {
 		return c.s3storage.ListTags(name)
 	}
-	return dockerclient.RegistryListTags(imagename.NewFromString(name), c.auth)
+	if c.tagCache == nil || img.IsECR() {
+		return dockerclient.RegistryListTags(img, c.auth)
+	}
+	tags, err := c.tagCache.Tags(img, func() ([]string, error) {
+		return dockerclient.RegistryTags(img, c.auth)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return dockerclient.MatchTags(img, tags), nil
+}
+
+// PushArtifact pushes the OCI artifact, e.g. a Helm chart, to the registry
+func (c *DockerClient) PushArtifact(name string, artifact dockerclient.OCIArtifact) (digest string, err error) {
+	if err = util.CheckOffline("push %s", name); err != nil {
+		return "", err
+	}
+	img := imagename.NewFromString(name)
+	if img.Storage == imagename.StorageS3 {
+		return "", fmt.Errorf("Cannot push artifact %s to S3, only registries are supported", name)
+	}
+	return dockerclient.RegistryPushArtifact(img, artifact, c.auth)
 }
 
 // RemoveImage removes docker image
@@ -218,7 +275,10 @@ func (c *DockerClient) RemoveImage(imageID string) error {
 		Force:   true,
 		NoPrune: false,
 	}
-	return c.client.RemoveImageExtended(imageID, opts)
+	_, err := withTimeout("removal", fmt.Sprintf("image %.12s", imageID), c.timeout, func() (interface{}, error) {
+		return nil, c.client.RemoveImageExtended(imageID, opts)
+	})
+	return err
 }
 
 // CreateContainer creates docker container
@@ -228,23 +288,31 @@ func (c *DockerClient) CreateContainer(s State) (string, error) {
 
 	// TODO: assign human readable name?
 
+	hostConfig := s.NoCache.HostConfig
+	if c.cgroupParent != "" {
+		hostConfig.CgroupParent = c.cgroupParent
+	}
+
 	opts := docker.CreateContainerOptions{
 		Config:     &s.Config,
-		HostConfig: &s.NoCache.HostConfig,
+		HostConfig: &hostConfig,
 	}
 
 	c.log.Debugf("Create container: %# v", pretty.Formatter(opts))
 
-	container, err := c.client.CreateContainer(opts)
-	if err != nil {
-		return "", err
-	}
-
 	imageStr := fmt.Sprintf("(image %.12s)", s.ImageID)
 	if s.ImageID == "" {
 		imageStr = "(from scratch)"
 	}
 
+	res, err := withTimeout("creation", "container "+imageStr, c.timeout, func() (interface{}, error) {
+		return c.client.CreateContainer(opts)
+	})
+	if err != nil {
+		return "", err
+	}
+	container := res.(*docker.Container)
+
 	c.log.Infof("| Created container %.12s %s", container.ID, imageStr)
 
 	return container.ID, nil
@@ -252,6 +320,16 @@ func (c *DockerClient) CreateContainer(s State) (string, error) {
 
 // RunContainer runs docker container and optionally attaches stdin
 func (c *DockerClient) RunContainer(containerID string, attachStdin bool) error {
+	return c.runContainer(containerID, attachStdin, nil)
+}
+
+// RunContainerWithInput runs docker container with the input given on its stdin,
+// the container should be created with OpenStdin and StdinOnce
+func (c *DockerClient) RunContainerWithInput(containerID string, input io.Reader) error {
+	return c.runContainer(containerID, false, input)
+}
+
+func (c *DockerClient) runContainer(containerID string, attachStdin bool, input io.Reader) error {
 
 	var (
 		success   = make(chan struct{})
@@ -264,26 +342,41 @@ func (c *DockerClient) RunContainer(containerID string, attachStdin bool) error
 		outLogger = &logrus.Logger{
 			Out:       c.log.Out,
 			Formatter: c.stdoutContainerFormatter,
+			Hooks:     c.log.Hooks,
 			Level:     c.log.Level,
 		}
 		errLogger = &logrus.Logger{
 			Out:       c.log.Out,
 			Formatter: c.stderrContainerFormatter,
+			Hooks:     c.log.Hooks,
 			Level:     c.log.Level,
 		}
 
+		// The fields are for the log sinks and the --json output, the text
+		// container formatters skip them
+		containerFields = logrus.Fields{"container": fmt.Sprintf("%.12s", containerID)}
+
+		// The stdout and the stderr share the limit
+		logLimit  = textformatter.NewLogLimit(c.maxStepLogBytes)
+		logMarker = fmt.Sprintf("[rocker: the output is truncated at %s, see --max-step-log-bytes]", units.BytesSize(float64(c.maxStepLogBytes)))
+
+		// The last lines of the output go to the error if the container fails
+		tail = newTailWriter(exitOutputLines)
+
 		in                 = os.Stdin
 		fdIn, isTerminalIn = term.GetFdInfo(in)
 	)
 
 	attachOpts := docker.AttachToContainerOptions{
-		Container:    containerID,
-		OutputStream: textformatter.LogWriter(outLogger),
-		ErrorStream:  textformatter.LogWriter(errLogger),
-		Stdout:       true,
-		Stderr:       true,
-		Stream:       true,
-		Success:      success,
+		Container: containerID,
+		OutputStream: io.MultiWriter(tail,
+			textformatter.LimitedEntryWriter(outLogger.WithFields(containerFields).WithField("stream", "stdout"), logLimit, logMarker)),
+		ErrorStream: io.MultiWriter(tail,
+			textformatter.LimitedEntryWriter(errLogger.WithFields(containerFields).WithField("stream", "stderr"), logLimit, logMarker)),
+		Stdout:  true,
+		Stderr:  true,
+		Stream:  true,
+		Success: success,
 	}
 
 	// Used by ATTACH
@@ -301,6 +394,12 @@ func (c *DockerClient) RunContainer(containerID string, attachStdin bool) error
 		attachOpts.RawTerminal = true
 	}
 
+	// The input is closed once it is read, so the container gets EOF
+	if input != nil {
+		attachOpts.InputStream = input
+		attachOpts.Stdin = true
+	}
+
 	// We want do debug the final attach options before setting raw term
 	c.log.Debugf("Attach to container with options: %# v", attachOpts)
 
@@ -361,7 +460,11 @@ func (c *DockerClient) RunContainer(containerID string, attachStdin bool) error
 		if err != nil {
 			errch <- err
 		} else if statusCode != 0 {
-			errch <- fmt.Errorf("Container %.12s exited with code %d", containerID, statusCode)
+			container, err := c.client.InspectContainer(containerID)
+			if err != nil {
+				c.log.Debugf("Failed to inspect the exited container %.12s, error: %s", containerID, err)
+			}
+			errch <- newContainerExitError(containerID, statusCode, container, tail.Lines())
 		}
 		errch <- nil
 		return
@@ -398,19 +501,45 @@ func (c *DockerClient) CommitContainer(s *State) (*docker.Image, error) {
 		Run:       &s.Config,
 	}
 
+	if len(s.NoCache.CommitLabels) > 0 {
+		config := s.Config
+		config.Labels = map[string]string{}
+		for k, v := range s.Config.Labels {
+			config.Labels[k] = v
+		}
+		for k, v := range s.NoCache.CommitLabels {
+			config.Labels[k] = v
+		}
+		commitOpts.Run = &config
+	}
+
 	c.log.Debugf("Commit container: %# v", pretty.Formatter(commitOpts))
 
-	image, err := c.client.CommitContainer(commitOpts)
+	started := time.Now()
+
+	res, err := withTimeout("commit", fmt.Sprintf("container %.12s", s.NoCache.ContainerID), c.commitTimeout, func() (interface{}, error) {
+		// The build containers have exited by the time they are committed,
+		// so there is no need to pause them, which the daemon does one at a time
+		if c.commitNoPause {
+			return dockerclient.CommitContainer(c.client, commitOpts, false)
+		}
+		return c.client.CommitContainer(commitOpts)
+	})
 	if err != nil {
 		return nil, err
 	}
+	image := res.(*docker.Image)
+	took := time.Since(started)
 
 	// Inspect the image to get the real size
 	c.log.Debugf("Inspect image %s", image.ID)
 
-	if image, err = c.client.InspectImage(image.ID); err != nil {
+	if res, err = c.withRetry("inspect", "image "+image.ID, func() (interface{}, error) {
+		return c.client.InspectImage(image.ID)
+	}); err != nil {
 		return nil, err
 	}
+	image = res.(*docker.Image)
 
 	s.ParentSize = s.Size
 	s.Size = image.VirtualSize
@@ -422,9 +551,11 @@ func (c *DockerClient) CommitContainer(s *State) (*docker.Image, error) {
 			units.HumanSize(float64(s.Size-s.ParentSize)),
 		)
 		fields["size"] = size
+		fields["commit"] = fmt.Sprintf("%.1fs", took.Seconds())
 	} else {
 		fields["size"] = s.Size
 		fields["delta"] = s.Size - s.ParentSize
+		fields["commit"] = took
 	}
 
 	c.log.WithFields(fields).Infof("| Result image is %.12s", image.ID)
@@ -442,7 +573,10 @@ func (c *DockerClient) RemoveContainer(containerID string) error {
 		RemoveVolumes: true,
 	}
 
-	return c.client.RemoveContainer(opts)
+	_, err := withTimeout("removal", fmt.Sprintf("container %.12s", containerID), c.timeout, func() (interface{}, error) {
+		return nil, c.client.RemoveContainer(opts)
+	})
+	return err
 }
 
 // UploadToContainer uploads files to a docker container
@@ -455,14 +589,32 @@ func (c *DockerClient) UploadToContainer(containerID string, stream io.Reader, p
 		NoOverwriteDirNonDir: false,
 	}
 
-	return c.client.UploadToContainer(containerID, opts)
+	_, err := withTimeout("upload", fmt.Sprintf("files to container %.12s", containerID), c.commitTimeout, func() (interface{}, error) {
+		return nil, c.client.UploadToContainer(containerID, opts)
+	})
+	return err
+}
+
+// DownloadFromContainer writes a tar archive of the path inside a docker container to w
+func (c *DockerClient) DownloadFromContainer(containerID string, path string, w io.Writer) error {
+	c.log.Debugf("Downloading %s from container %.12s", path, containerID)
+
+	opts := docker.DownloadFromContainerOptions{
+		OutputStream: w,
+		Path:         path,
+	}
+
+	_, err := withTimeout("download", fmt.Sprintf("%s from container %.12s", path, containerID), c.commitTimeout, func() (interface{}, error) {
+		return nil, c.client.DownloadFromContainer(containerID, opts)
+	})
+	return err
 }
 
 // TagImage adds tag to the image
 func (c *DockerClient) TagImage(imageID, imageName string) error {
 	img := imagename.NewFromString(imageName)
-	if isOld, warning := imagename.WarnIfOldS3ImageName(imageName); isOld {
-		c.log.Warn(warning)
+	if isOld, _ := imagename.WarnIfOldS3ImageName(imageName); isOld {
+		deprecation.Warn(deprecation.OldS3Name, imageName)
 	}
 
 	c.log.Infof("| Tag %.12s -> %s", imageID, img)
@@ -475,7 +627,60 @@ func (c *DockerClient) TagImage(imageID, imageName string) error {
 
 	c.log.Debugf("Tag image %s with options: %# v", imageID, opts)
 
-	return c.client.TagImage(imageID, opts)
+	_, err := c.withRetry("tagging", fmt.Sprintf("image %.12s", imageID), func() (interface{}, error) {
+		return nil, c.client.TagImage(imageID, opts)
+	})
+	return err
+}
+
+// ImportImage makes the image from the filesystem tarball,
+// changes are the Dockerfile instructions applied to the image config, e.g. CMD
+func (c *DockerClient) ImportImage(imageName string, tarball io.Reader, changes []string) error {
+	img := imagename.NewFromString(imageName)
+
+	c.log.Infof("| Import image %s", img)
+
+	opts := docker.ImportImageOptions{
+		Repository:   img.NameWithRegistry(),
+		Tag:          img.GetTag(),
+		Source:       "-",
+		InputStream:  tarball,
+		OutputStream: ioutil.Discard,
+	}
+
+	c.log.Debugf("Import image %s with options: %# v, changes: %q", img, opts, changes)
+
+	_, err := withTimeout("importing", fmt.Sprintf("image %s", img), c.commitTimeout, func() (interface{}, error) {
+		if len(changes) > 0 {
+			return nil, dockerclient.ImportImage(c.client, opts, changes)
+		}
+		return nil, c.client.ImportImage(opts)
+	})
+	return err
+}
+
+// SaveImages writes the images along with their parent layers
+// into the stream the way docker save does
+func (c *DockerClient) SaveImages(imageIDs []string, w io.Writer) error {
+	opts := docker.ExportImagesOptions{
+		Names:        imageIDs,
+		OutputStream: w,
+	}
+
+	c.log.Debugf("Save images with options: %# v", opts)
+
+	_, err := withTimeout("saving", fmt.Sprintf("%d images", len(imageIDs)), c.commitTimeout, func() (interface{}, error) {
+		return nil, c.client.ExportImages(opts)
+	})
+	return err
+}
+
+// LoadImages loads the images from the stream made by SaveImages or docker save
+func (c *DockerClient) LoadImages(r io.Reader) error {
+	_, err := withTimeout("loading", "images", c.commitTimeout, func() (interface{}, error) {
+		return nil, c.client.LoadImage(docker.LoadImageOptions{InputStream: r})
+	})
+	return err
 }
 
 // PushImage pushes the image, does retries if configured
@@ -503,12 +708,16 @@ func (c *DockerClient) PushImage(imageName string) (digest string, err error) {
 
 // pushImageInner pushes the image is the inner straightforward push without retries
 func (c *DockerClient) pushImageInner(imageName string) (digest string, err error) {
+	if err = util.CheckOffline("push %s", imageName); err != nil {
+		return "", err
+	}
+
 	img := imagename.NewFromString(imageName)
 
 	// Use direct S3 image pusher instead
 	if img.Storage == imagename.StorageS3 {
-		if isOld, warning := imagename.WarnIfOldS3ImageName(imageName); isOld {
-			c.log.Warn(warning)
+		if isOld, _ := imagename.WarnIfOldS3ImageName(imageName); isOld {
+			deprecation.Warn(deprecation.OldS3Name, imageName)
 		}
 		return c.s3storage.Push(imageName)
 	}
@@ -571,11 +780,38 @@ func (c *DockerClient) ResolveHostPath(path string) (resultPath string, err erro
 	return dockerclient.ResolveHostPath(path, c.client, c.isUnixSocket, c.unixSockPath)
 }
 
+// FreeDiskSpace returns the free space of the docker data dir in bytes, it is
+// taken from the storage driver status (devicemapper) or, if the daemon is
+// local, from the filesystem of its root dir; -1 is returned if it is unknown
+func (c *DockerClient) FreeDiskSpace() (free int64, err error) {
+	res, err := c.withRetry("info", "the daemon", func() (interface{}, error) {
+		return c.client.Info()
+	})
+	if err != nil {
+		return -1, err
+	}
+	info := res.(*docker.DockerInfo)
+
+	for _, status := range info.DriverStatus {
+		if status[0] == "Data Space Available" {
+			return units.FromHumanSize(status[1])
+		}
+	}
+
+	if c.isUnixSocket && info.DockerRootDir != "" {
+		if _, err := os.Stat(info.DockerRootDir); err == nil {
+			return diskFree(info.DockerRootDir)
+		}
+	}
+
+	return -1, nil
+}
+
 // EnsureImage checks if the image exists and pulls if not
 func (c *DockerClient) EnsureImage(imageName string) (err error) {
 
 	var img *docker.Image
-	if img, err = c.client.InspectImage(imageName); err != nil && err != docker.ErrNoSuchImage {
+	if img, err = c.InspectImage(imageName); err != nil {
 		return err
 	}
 	if img != nil {
@@ -590,7 +826,7 @@ func (c *DockerClient) EnsureImage(imageName string) (err error) {
 func (c *DockerClient) EnsureContainer(containerName string, config *docker.Config, hostConfig *docker.HostConfig, purpose string) (containerID string, err error) {
 
 	// Check if container exists
-	container, err := c.client.InspectContainer(containerName)
+	container, err := c.InspectContainer(containerName)
 
 	if _, ok := err.(*docker.NoSuchContainer); !ok && err != nil {
 		return "", err
@@ -607,6 +843,15 @@ func (c *DockerClient) EnsureContainer(containerName string, config *docker.Conf
 
 	c.log.Infof("| Create container: %s for %s", containerName, purpose)
 
+	if c.cgroupParent != "" {
+		hc := docker.HostConfig{}
+		if hostConfig != nil {
+			hc = *hostConfig
+		}
+		hc.CgroupParent = c.cgroupParent
+		hostConfig = &hc
+	}
+
 	opts := docker.CreateContainerOptions{
 		Name:       containerName,
 		Config:     config,
@@ -615,15 +860,35 @@ func (c *DockerClient) EnsureContainer(containerName string, config *docker.Conf
 
 	c.log.Debugf("Create container options %# v", opts)
 
-	container, err = c.client.CreateContainer(opts)
+	res, err := withTimeout("creation", "container "+containerName, c.timeout, func() (interface{}, error) {
+		return c.client.CreateContainer(opts)
+	})
 	if err != nil {
 		return "", fmt.Errorf("Failed to create container %s from image %s, error: %s", containerName, config.Image, err)
 	}
+	container = res.(*docker.Container)
 
 	return container.ID, err
 }
 
 // InspectContainer simply inspects the container by name or ID
 func (c *DockerClient) InspectContainer(containerName string) (container *docker.Container, err error) {
-	return c.client.InspectContainer(containerName)
+	res, err := c.withRetry("inspect", "container "+containerName, func() (interface{}, error) {
+		return c.client.InspectContainer(containerName)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res.(*docker.Container), nil
+}
+
+// ContainerChanges returns the filesystem changes made in the container
+func (c *DockerClient) ContainerChanges(containerID string) ([]docker.Change, error) {
+	res, err := c.withRetry("changes", fmt.Sprintf("container %.12s", containerID), func() (interface{}, error) {
+		return c.client.ContainerChanges(containerID)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res.([]docker.Change), nil
 }
@@ -0,0 +1,93 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+)
+
+// dockerRetryDelay is the pause before the next attempt of a failed call, it grows with every attempt
+var dockerRetryDelay = time.Second
+
+// DockerTimeoutError is returned when a docker daemon call does not finish in time
+type DockerTimeoutError struct {
+	Op      string
+	Subject string
+	Timeout time.Duration
+}
+
+// Error returns the error message
+func (e *DockerTimeoutError) Error() string {
+	return fmt.Sprintf("Docker daemon did not finish %s of %s in %s", e.Op, e.Subject, e.Timeout)
+}
+
+// withTimeout runs the daemon call with the timeout; go-dockerclient calls can not be
+// cancelled, so the call that timed out is left running in the background
+func withTimeout(op, subject string, timeout time.Duration, f func() (interface{}, error)) (interface{}, error) {
+	if timeout <= 0 {
+		return f()
+	}
+
+	type result struct {
+		value interface{}
+		err   error
+	}
+
+	resch := make(chan result, 1)
+	go func() {
+		value, err := f()
+		resch <- result{value, err}
+	}()
+
+	select {
+	case res := <-resch:
+		return res.value, res.err
+	case <-time.After(timeout):
+		return nil, &DockerTimeoutError{op, subject, timeout}
+	}
+}
+
+// withRetry runs the idempotent daemon call with the timeout and repeats it
+// if it timed out or the daemon failed to handle it
+func (c *DockerClient) withRetry(op, subject string, f func() (interface{}, error)) (value interface{}, err error) {
+	for attempt := 1; ; attempt++ {
+		if value, err = withTimeout(op, subject, c.timeout, f); err == nil || attempt > c.retries || !isTransientDockerError(err) {
+			return value, err
+		}
+
+		delay := time.Duration(attempt) * dockerRetryDelay
+		c.log.Warnf("| %s, retry in %s (%d/%d)", err, delay, attempt, c.retries)
+		time.Sleep(delay)
+	}
+}
+
+// isTransientDockerError returns true if the failed call may succeed when repeated
+func isTransientDockerError(err error) bool {
+	switch e := err.(type) {
+	case *DockerTimeoutError:
+		return true
+	case *docker.Error:
+		return e.Status >= 500
+	case net.Error:
+		return true
+	}
+	return false
+}
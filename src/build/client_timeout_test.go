@@ -0,0 +1,75 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/fsouza/go-dockerclient"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWithTimeout(t *testing.T) {
+	value, err := withTimeout("inspect", "image alpine", time.Second, func() (interface{}, error) {
+		return "ok", nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, "ok", value)
+
+	_, err = withTimeout("commit", "container 123", 10*time.Millisecond, func() (interface{}, error) {
+		time.Sleep(time.Second)
+		return nil, nil
+	})
+	assert.Equal(t, "Docker daemon did not finish commit of container 123 in 10ms", err.Error())
+}
+
+func TestWithRetry(t *testing.T) {
+	defer func(delay time.Duration) { dockerRetryDelay = delay }(dockerRetryDelay)
+	dockerRetryDelay = time.Millisecond
+
+	c := &DockerClient{log: logrus.StandardLogger(), timeout: time.Second, retries: 2}
+
+	calls := 0
+	value, err := c.withRetry("inspect", "image alpine", func() (interface{}, error) {
+		if calls++; calls < 3 {
+			return nil, &docker.Error{Status: 500, Message: "daemon is busy"}
+		}
+		return "ok", nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, "ok", value)
+	assert.Equal(t, 3, calls, "should retry the server errors")
+
+	calls = 0
+	_, err = c.withRetry("inspect", "image alpine", func() (interface{}, error) {
+		calls++
+		return nil, &docker.Error{Status: 500, Message: "daemon is busy"}
+	})
+	assert.Error(t, err)
+	assert.Equal(t, 3, calls, "should give up after the retries")
+
+	calls = 0
+	_, err = c.withRetry("inspect", "image alpine", func() (interface{}, error) {
+		calls++
+		return nil, errors.New("bad request")
+	})
+	assert.Error(t, err)
+	assert.Equal(t, 1, calls, "should not retry the other errors")
+}
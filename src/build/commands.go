@@ -17,8 +17,9 @@
 package build
 
 import (
+	"bytes"
+	"crypto/sha256"
 	"fmt"
-	"io/ioutil"
 	"os"
 	"path"
 	"path/filepath"
@@ -27,7 +28,7 @@ import (
 	"strings"
 	"time"
 
-	"github.com/go-yaml/yaml"
+	"github.com/grammarly/rocker/src/deprecation"
 	"github.com/grammarly/rocker/src/imagename"
 	"github.com/grammarly/rocker/src/shellparser"
 	"github.com/grammarly/rocker/src/util"
@@ -37,7 +38,6 @@ import (
 	"github.com/docker/docker/pkg/units"
 	runconfigopts "github.com/docker/docker/runconfig/opts"
 	"github.com/fsouza/go-dockerclient"
-	"github.com/kr/pretty"
 )
 
 // ConfigCommand configuration parameters for any command
@@ -48,6 +48,15 @@ type ConfigCommand struct {
 	flags     map[string]string
 	original  string
 	isOnbuild bool
+
+	// conditions are ONLY IF / SKIP IF decorators of the command
+	conditions []commandCondition
+
+	// runAs overrides the user of RUN, used by the generated steps
+	runAs string
+
+	// line is the line of the Rockerfile source, zero if unknown
+	line int
 }
 
 // Command interface describes and command that is executed by build
@@ -87,6 +96,10 @@ func NewCommand(cfg ConfigCommand) (cmd Command) {
 		cmd = &CommandEnv{CommandBase{cfg}}
 	case "label":
 		cmd = &CommandLabel{CommandBase{cfg}}
+	case "envfile":
+		cmd = &CommandEnvFile{CommandBase{cfg}}
+	case "labelfile":
+		cmd = &CommandLabelFile{CommandBase{cfg}}
 	case "workdir":
 		cmd = &CommandWorkdir{CommandBase{cfg}}
 	case "tag":
@@ -117,6 +130,18 @@ func NewCommand(cfg ConfigCommand) (cmd Command) {
 		cmd = &CommandImport{CommandBase{cfg}}
 	case "arg":
 		cmd = &CommandArg{CommandBase{cfg}}
+	case "test":
+		cmd = &CommandTest{CommandBase{cfg}}
+	case "cache":
+		cmd = &CommandCache{CommandBase{cfg}}
+	case "invalidate":
+		cmd = &CommandInvalidate{CommandBase{cfg}}
+	case "smoke":
+		cmd = &CommandSmoke{CommandBase{cfg}}
+	case "artifact":
+		cmd = &CommandArtifact{CommandBase{cfg}}
+	case "readvars":
+		cmd = &CommandReadVars{CommandBase{cfg}}
 	default:
 		panic(fmt.Sprintf("Unknown command: %s", cfg.name))
 	}
@@ -125,6 +150,10 @@ func NewCommand(cfg ConfigCommand) (cmd Command) {
 		cmd = &CommandOnbuildWrap{cmd}
 	}
 
+	if len(cfg.conditions) > 0 {
+		cmd = &CommandConditionWrap{cmd, cfg.conditions}
+	}
+
 	return
 }
 
@@ -139,6 +168,11 @@ func (c *CommandBase) String() string {
 	return c.cfg.original
 }
 
+// config returns the instruction config the command is made of
+func (c *CommandBase) config() ConfigCommand {
+	return c.cfg
+}
+
 // ShouldRun returns true if the command should be executed
 func (c *CommandBase) ShouldRun(b *Build) (bool, error) {
 	return true, nil
@@ -171,7 +205,13 @@ func (c *CommandFrom) Execute(b *Build) (s State, err error) {
 		return s, nil
 	}
 
-	if img, err = b.lookupImage(name); err != nil {
+	// Pull the image through the mirror of its registry, unless --no-mirror
+	if mirrored, ok := b.fromImageName(c.cfg); ok {
+		log.Infof("| Rewrite %s -> %s (registry mirror)", name, mirrored)
+		name = mirrored
+	}
+
+	if img, err = b.resolveFrom(name); err != nil {
 		return s, fmt.Errorf("FROM error: %s", err)
 	}
 
@@ -179,6 +219,25 @@ func (c *CommandFrom) Execute(b *Build) (s State, err error) {
 		return s, fmt.Errorf("FROM: image %s not found", name)
 	}
 
+	if c == b.overriddenFrom {
+		if err = b.checkFromOverride(img); err != nil {
+			return s, err
+		}
+	}
+
+	verdict, err := b.verifyBaseDigest(c.cfg.args[0], img)
+	if err != nil {
+		return s, err
+	}
+
+	b.From = append(b.From, FromImage{
+		Name:    c.cfg.args[0],
+		Image:   name,
+		ID:      img.ID,
+		Digests: img.RepoDigests,
+		Verdict: verdict,
+	})
+
 	// We want to say the size of the FROM image. Better to do it
 	// from the client, but don't know how to do it better,
 	// without duplicating InspectImage calls and making unnecessary functions
@@ -187,6 +246,11 @@ func (c *CommandFrom) Execute(b *Build) (s State, err error) {
 	s.ImageID = img.ID
 	s.Config = docker.Config{}
 
+	// CMD is set per FROM section, as in docker, since syntax 1.2
+	if b.syntaxAtLeast("1.2") {
+		s.NoCache.CmdSet = false
+	}
+
 	s.Size = img.VirtualSize
 
 	// As we don't know size of parent image for that of FROM command,
@@ -237,6 +301,8 @@ func (c *CommandMaintainer) Execute(b *Build) (State, error) {
 		return b.state, fmt.Errorf("MAINTAINER requires exactly one argument")
 	}
 
+	deprecation.Warn(deprecation.Maintainer, "MAINTAINER "+c.cfg.args[0])
+
 	// Don't see any sense of doing a commit here, as Docker does
 
 	return b.state, nil
@@ -246,6 +312,10 @@ func (c *CommandMaintainer) Execute(b *Build) (State, error) {
 type CommandCleanup struct {
 	final  bool
 	tagged bool
+
+	// cacheOnly ends a cache-only section, section is its AS name
+	cacheOnly bool
+	section   string
 }
 
 // String returns the human readable string representation of the command
@@ -262,15 +332,30 @@ func (c *CommandCleanup) ShouldRun(b *Build) (bool, error) {
 func (c *CommandCleanup) Execute(b *Build) (State, error) {
 	s := b.state
 
-	if b.cfg.NoGarbage && !c.tagged && s.ImageID != "" && s.ProducedImage {
-		if err := b.client.RemoveImage(s.ImageID); err != nil {
-			return s, err
+	// The image of a cache-only section stays an intermediate one, it is
+	// neither removed by --no-garbage nor reported as the result of the build
+	if c.cacheOnly {
+		name := "Cache-only section"
+		if c.section != "" {
+			name += " " + c.section
+		}
+		log.Infof("| %s is done, its image %.12s is left intermediate", name, s.ImageID)
+
+		s.ImageID = b.produced.ID
+		b.ProducedSize, b.VirtualSize = b.produced.ProducedSize, b.produced.VirtualSize
+	} else {
+		if b.cfg.NoGarbage && !c.tagged && s.ImageID != "" && s.ProducedImage {
+			if err := b.client.RemoveImage(s.ImageID); err != nil {
+				return s, err
+			}
 		}
+		b.produced = producedImage{s.ImageID, b.ProducedSize, b.VirtualSize}
 	}
 
-	// Cleanup state
+	// Cleanup state, the build args declared by ARG are scoped to the FROM section
 	dirtyState := s
 	s = NewState(b)
+	b.allowedBuildArgs = predefinedBuildArgs()
 
 	// Keep some stuff between froms
 	s.ExportsID = dirtyState.ExportsID
@@ -311,9 +396,6 @@ func (c *CommandCommit) Execute(b *Build) (s State, err error) {
 		return s, fmt.Errorf("Please provide a source image with `from` prior to commit")
 	}
 
-	// TODO: ?
-	// if len(commits) == 0 && s.NoCache.ContainerID == "" { log.Infof("| Skip")
-
 	// TODO: verify that we need to check cache in commit only for
 	//       a non-container actions
 
@@ -341,22 +423,64 @@ func (c *CommandCommit) Execute(b *Build) (s State, err error) {
 
 	defer func(id string) {
 		s.CleanCommits()
+		s.NoCache.CopyKey = ""
 		if err := b.client.RemoveContainer(id); err != nil {
 			log.Errorf("Failed to remove temporary container %.12s, error: %s", id, err)
 		}
 	}(s.NoCache.ContainerID)
 
+	skip, err := b.isNoopCommit(s)
+	if err != nil {
+		return s, err
+	}
+	if skip {
+		log.Infof("| Skip commit, the step changed neither the files nor the config of image %.12s", s.ImageID)
+
+		s.NoCache.ContainerID = ""
+
+		if b.cache != nil {
+			s.Duration = time.Since(b.missStarted)
+			// The state is cached on top of the image the step ran on, which is
+			// the image itself, the state keeps the parent of the image
+			cached := s
+			cached.ParentID = s.ImageID
+			if err := b.cache.Put(cached); err != nil {
+				return s, err
+			}
+		}
+		return s, nil
+	}
+
 	var img *docker.Image
-	if img, err = b.client.CommitContainer(&s); err != nil {
+	commitStarted := time.Now()
+	s.NoCache.CommitLabels = b.intermediateLabels()
+	if s.NoCache.Publish {
+		s.NoCache.CommitLabels[ImageLabelIntermediate] = ""
+	}
+	img, err = b.client.CommitContainer(&s)
+	s.NoCache.CommitLabels = nil
+	if err != nil {
 		return s, err
 	}
+	commitTook := time.Since(commitStarted)
+	b.stepCommit += commitTook
+	b.CommitDuration += commitTook
 
 	s.NoCache.ContainerID = ""
 	s.ParentID = s.ImageID
 	s.ImageID = img.ID
 	s.ProducedImage = true
 
+	if b.cfg.ConfigDiff {
+		if err := b.logConfigDiff(s.ParentID, &s.Config); err != nil {
+			return s, err
+		}
+	}
+
+	b.rememberCopy(s)
+
 	if b.cache != nil {
+		s.Duration = time.Since(b.missStarted)
 		if err := b.cache.Put(s); err != nil {
 			return s, err
 		}
@@ -382,26 +506,18 @@ func (c *CommandRun) Execute(b *Build) (s State, err error) {
 		return s, fmt.Errorf("Please provide a source image with `FROM` prior to run")
 	}
 
+	buildEnv := b.runBuildEnv(s)
+
 	cmd := handleJSONArgs(c.cfg.args, c.cfg.attrs)
 
-	if !c.cfg.attrs["json"] {
-		cmd = append([]string{"/bin/sh", "-c"}, cmd...)
+	if _, ok := c.cfg.flags["expand-env"]; ok {
+		if cmd, err = b.expandExecArgs(c.cfg, append(append([]string{}, s.Config.Env...), buildEnv...)); err != nil {
+			return s, err
+		}
 	}
 
-	buildEnv := []string{}
-	configEnv := runconfigopts.ConvertKVStringsToMap(s.Config.Env)
-	for key, val := range s.NoCache.BuildArgs {
-		if !b.allowedBuildArgs[key] {
-			// skip build-args that are not in allowed list, meaning they have
-			// not been defined by an "ARG" Dockerfile command yet.
-			// This is an error condition but only if there is no "ARG" in the entire
-			// Dockerfile, so we'll generate any necessary errors after we parsed
-			// the entire file (see 'leftoverArgs' processing in evaluator.go )
-			continue
-		}
-		if _, ok := configEnv[key]; !ok {
-			buildEnv = append(buildEnv, fmt.Sprintf("%s=%s", key, val))
-		}
+	if !c.cfg.attrs["json"] {
+		cmd = append(append([]string{}, b.shell()...), cmd...)
 	}
 
 	// derive the command to use for probeCache() and to commit in this container.
@@ -413,12 +529,37 @@ func (c *CommandRun) Execute(b *Build) (s State, err error) {
 	// that starts with "foo=abc" to be considered part of a build-time env var.
 	saveCmd := cmd
 	if len(buildEnv) > 0 {
-		sort.Strings(buildEnv)
 		tmpEnv := append([]string{fmt.Sprintf("|%d", len(buildEnv))}, buildEnv...)
 		saveCmd = append(tmpEnv, saveCmd...)
 	}
 
-	s.Commit("RUN %q", saveCmd)
+	// The args and vars in the args file are the part of the cache key as well
+	var argsData []byte
+	if _, ok := c.cfg.flags["vars"]; ok && !b.cfg.ArgsFileMount {
+		return s, fmt.Errorf("RUN --vars requires --args-file-mount")
+	}
+	if b.cfg.ArgsFileMount {
+		if argsData, err = b.argsFileData(s, splitFlagList(c.cfg.flags["vars"])); err != nil {
+			return s, err
+		}
+		saveCmd = append([]string{fmt.Sprintf("|args-file:%x", sha256.Sum256(argsData))}, saveCmd...)
+	}
+
+	// The sandbox settings change what the command may do, so they are the part
+	// of the cache key too
+	hostConfig, err := b.sandboxHostConfig(s.NoCache.HostConfig, "RUN", c.cfg.flags)
+	if err != nil {
+		return s, err
+	}
+	if key := sandboxCacheKey(hostConfig); key != "" {
+		saveCmd = append([]string{"|sandbox:" + key}, saveCmd...)
+	}
+
+	if c.cfg.runAs != "" {
+		s.Commit("RUN --user=%s %q", c.cfg.runAs, saveCmd)
+	} else {
+		s.Commit("RUN %q", saveCmd)
+	}
 
 	// Check cache
 	s, hit, err := b.probeCache(s)
@@ -433,15 +574,40 @@ func (c *CommandRun) Execute(b *Build) (s State, err error) {
 	origCmd := s.Config.Cmd
 	origEntrypoint := s.Config.Entrypoint
 	origEnv := s.Config.Env
+	origUser := s.Config.User
+	origHostConfig := s.NoCache.HostConfig
+	origLabels := s.Config.Labels
+	origOpenStdin, origStdinOnce := s.Config.OpenStdin, s.Config.StdinOnce
 	s.Config.Cmd = cmd
 	s.Config.Entrypoint = []string{}
-	s.Config.Env = append(s.Config.Env, buildEnv...)
+	s.Config.Labels = b.containerLabels(s.Config.Labels)
+	if b.cfg.ArgsFileMount {
+		// The command writes the args file given on stdin to the tmpfs first
+		s.Config.Cmd = argsFileCmd(cmd)
+		s.Config.OpenStdin, s.Config.StdinOnce = true, true
+		hostConfig.Tmpfs = argsFileTmpfs(hostConfig.Tmpfs)
+	} else {
+		s.Config.Env = append(s.Config.Env, buildEnv...)
+	}
+	if c.cfg.runAs != "" {
+		s.Config.User = c.cfg.runAs
+	}
+	s.NoCache.HostConfig = hostConfig
 
 	if s.NoCache.ContainerID, err = b.client.CreateContainer(s); err != nil {
 		return s, err
 	}
 
-	if err = b.client.RunContainer(s.NoCache.ContainerID, false); err != nil {
+	release := b.cfg.Scheduler.Acquire(c.String())
+	if b.cfg.ArgsFileMount {
+		err = b.client.RunContainerWithInput(s.NoCache.ContainerID, bytes.NewReader(argsData))
+	} else {
+		err = b.client.RunContainer(s.NoCache.ContainerID, false)
+	}
+	release()
+
+	if err != nil {
+		b.snapshotFailure(b.state, s.NoCache.ContainerID)
 		b.client.RemoveContainer(s.NoCache.ContainerID)
 		return s, err
 	}
@@ -450,10 +616,50 @@ func (c *CommandRun) Execute(b *Build) (s State, err error) {
 	s.Config.Cmd = origCmd
 	s.Config.Entrypoint = origEntrypoint
 	s.Config.Env = origEnv
+	s.Config.User = origUser
+	s.NoCache.HostConfig = origHostConfig
+	s.Config.OpenStdin, s.Config.StdinOnce = origOpenStdin, origStdinOnce
+	s.Config.Labels = origLabels
 
 	return s, nil
 }
 
+// runBuildEnv returns the sorted build args to be passed to RUN and TEST
+// containers, the ones overridden by ENV are skipped
+func (b *Build) runBuildEnv(s State) []string {
+	buildEnv := []string{}
+	for key, val := range b.runBuildArgs(s) {
+		buildEnv = append(buildEnv, fmt.Sprintf("%s=%s", key, val))
+	}
+	sort.Strings(buildEnv)
+	return buildEnv
+}
+
+// runBuildArgs returns the build args consumed by ARG that are not
+// overridden by ENV. These are the only build args that make the cache key
+// of a step, RUN's one, since the other steps never see the build args:
+// an arg passed but not declared by ARG in the FROM section before the step,
+// or overridden by ENV, does not change the key, the declared one does;
+// the steps that follow RUN depend on it through its image
+func (b *Build) runBuildArgs(s State) map[string]string {
+	args := map[string]string{}
+	configEnv := runconfigopts.ConvertKVStringsToMap(s.Config.Env)
+	for key, val := range s.NoCache.BuildArgs {
+		if !b.allowedBuildArgs[key] {
+			// skip build-args that are not in allowed list, meaning they have
+			// not been defined by an "ARG" Dockerfile command yet.
+			// This is an error condition but only if there is no "ARG" in the entire
+			// Dockerfile, so we'll generate any necessary errors after we parsed
+			// the entire file (see 'leftoverArgs' processing in evaluator.go )
+			continue
+		}
+		if _, ok := configEnv[key]; !ok {
+			args[key] = val
+		}
+	}
+	return args
+}
+
 // CommandAttach implements ATTACH
 type CommandAttach struct {
 	CommandBase
@@ -502,6 +708,10 @@ func (c *CommandAttach) Execute(b *Build) (s State, err error) {
 	s.Config.AttachStderr = true
 	s.Config.AttachStdout = true
 
+	if s, err = attachPorts(s, c.cfg.flags); err != nil {
+		return s, err
+	}
+
 	if s.NoCache.ContainerID, err = b.client.CreateContainer(s); err != nil {
 		return s, err
 	}
@@ -612,6 +822,92 @@ func (c *CommandLabel) Execute(b *Build) (s State, err error) {
 	return s, nil
 }
 
+// CommandEnvFile implements ENVFILE
+type CommandEnvFile struct {
+	CommandBase
+}
+
+// ReplaceEnv implements EnvReplacableCommand interface
+func (c *CommandEnvFile) ReplaceEnv(env []string) error {
+	return replaceEnv(c.cfg.args, env)
+}
+
+// Execute runs the command
+func (c *CommandEnvFile) Execute(b *Build) (s State, err error) {
+	s = b.state
+
+	if len(c.cfg.args) != 1 {
+		return s, fmt.Errorf("ENVFILE requires exactly one argument")
+	}
+
+	name := c.cfg.args[0]
+
+	entries, hash, err := readKeyValueContextFile(b, name)
+	if err != nil {
+		return s, err
+	}
+
+	env := []string{}
+	for _, kv := range entries {
+		if !envNameRegexp.MatchString(kv.key) {
+			return s, fmt.Errorf("ENVFILE %s has invalid variable name %q", name, kv.key)
+		}
+		env = append(env, kv.key+"="+kv.value)
+	}
+
+	s.Config.Env = replaceOrAppendEnvValues(s.Config.Env, env)
+
+	// Values are not listed in the commit, the file hash keeps the cache key precise
+	s.Commit("ENVFILE %s %s", name, hash)
+
+	log.Infof("| Set %d variables from %s", len(env), name)
+
+	return s, nil
+}
+
+// CommandLabelFile implements LABELFILE
+type CommandLabelFile struct {
+	CommandBase
+}
+
+// ReplaceEnv implements EnvReplacableCommand interface
+func (c *CommandLabelFile) ReplaceEnv(env []string) error {
+	return replaceEnv(c.cfg.args, env)
+}
+
+// Execute runs the command
+func (c *CommandLabelFile) Execute(b *Build) (s State, err error) {
+	s = b.state
+
+	if len(c.cfg.args) != 1 {
+		return s, fmt.Errorf("LABELFILE requires exactly one argument")
+	}
+
+	name := c.cfg.args[0]
+
+	entries, hash, err := readKeyValueContextFile(b, name)
+	if err != nil {
+		return s, err
+	}
+
+	if s.Config.Labels == nil {
+		s.Config.Labels = map[string]string{}
+	}
+
+	for _, kv := range entries {
+		if !labelKeyRegexp.MatchString(kv.key) {
+			return s, fmt.Errorf("LABELFILE %s has invalid label key %q", name, kv.key)
+		}
+		s.Config.Labels[kv.key] = kv.value
+	}
+
+	s.Commit("LABELFILE %s %s", name, hash)
+
+	log.Infof("| Set %d labels from %s", len(entries), name)
+
+	return s, nil
+}
+
 // CommandWorkdir implements WORKDIR
 type CommandWorkdir struct {
 	CommandBase
@@ -656,6 +952,12 @@ func (c *CommandCmd) Execute(b *Build) (s State, err error) {
 
 	cmd := handleJSONArgs(c.cfg.args, c.cfg.attrs)
 
+	if _, ok := c.cfg.flags["expand-env"]; ok {
+		if cmd, err = b.expandExecArgs(c.cfg, s.Config.Env); err != nil {
+			return s, err
+		}
+	}
+
 	if !c.cfg.attrs["json"] {
 		cmd = append([]string{"/bin/sh", "-c"}, cmd...)
 	}
@@ -694,13 +996,16 @@ func (c *CommandEntrypoint) Execute(b *Build) (s State, err error) {
 		s.Config.Entrypoint = []string{"/bin/sh", "-c", parsed[0]}
 	}
 
-	s.Commit(fmt.Sprintf("ENTRYPOINT %q", s.Config.Entrypoint))
-
-	// TODO: test this
-	// when setting the entrypoint if a CMD was not explicitly set then
-	// set the command to nil
-	if !s.NoCache.CmdSet {
-		s.Config.Cmd = nil
+	// Same as docker, setting the entrypoint resets the command unless CMD
+	// was explicitly set, e.g. the command of the base image is not kept;
+	// --preserve-cmd keeps the command in any case
+	if _, preserve := c.cfg.flags["preserve-cmd"]; preserve {
+		s.Commit("ENTRYPOINT %q --preserve-cmd", s.Config.Entrypoint)
+	} else {
+		s.Commit("ENTRYPOINT %q", s.Config.Entrypoint)
+		if !s.NoCache.CmdSet {
+			s.Config.Cmd = nil
+		}
 	}
 
 	return s, nil
@@ -805,13 +1110,26 @@ func (c *CommandUser) Execute(b *Build) (s State, err error) {
 
 	s = b.state
 
-	if len(c.cfg.args) != 1 {
-		return s, fmt.Errorf("USER requires exactly one argument")
+	spec, err := parseUserSpec(c.cfg)
+	if err != nil {
+		return s, err
+	}
+	if spec.create {
+		return s, fmt.Errorf("USER --create must be expanded by the plan")
 	}
 
-	s.Config.User = c.cfg.args[0]
+	s.Config.User = spec.String()
+
+	// Remember the numeric uid:gid so COPY --chown can use it without
+	// looking into the image
+	s.UserID = ""
+	if isNumeric(spec.user) && (spec.group == "" || isNumeric(spec.group)) {
+		if s.UserID, err = resolveUserID(b, s, s.Config.User); err != nil {
+			return s, err
+		}
+	}
 
-	s.Commit(fmt.Sprintf("USER %v", c.cfg.args))
+	s.Commit("USER %v", []string{s.Config.User})
 
 	return s, nil
 }
@@ -834,7 +1152,7 @@ func (c *CommandOnbuild) Execute(b *Build) (s State, err error) {
 	switch command {
 	case "ONBUILD":
 		return s, fmt.Errorf("Chaining ONBUILD via `ONBUILD ONBUILD` isn't allowed")
-	case "MAINTAINER", "FROM":
+	case "MAINTAINER", "FROM", "READVARS":
 		return s, fmt.Errorf("%s isn't allowed as an ONBUILD trigger", command)
 	}
 
@@ -861,7 +1179,25 @@ func (c *CommandTag) Execute(b *Build) (State, error) {
 		return b.state, fmt.Errorf("Cannot TAG on empty image")
 	}
 
-	if err := b.client.TagImage(b.state.ImageID, c.cfg.args[0]); err != nil {
+	name, err := b.publishName(c.cfg.args[0])
+	if err != nil {
+		return b.state, err
+	}
+
+	if err := b.recordRockerData(c.cfg); err != nil {
+		return b.state, err
+	}
+
+	if err := b.smokeBeforePublish("TAG", c.cfg.flags); err != nil {
+		return b.state, err
+	}
+
+	imageID, err := b.publishableImage()
+	if err != nil {
+		return b.state, err
+	}
+
+	if err := b.client.TagImage(imageID, name); err != nil {
 		return b.state, err
 	}
 
@@ -875,63 +1211,113 @@ type CommandPush struct {
 
 // Execute runs the command
 func (c *CommandPush) Execute(b *Build) (State, error) {
-	if len(c.cfg.args) != 1 {
-		return b.state, fmt.Errorf("PUSH requires exactly one argument")
+	if len(c.cfg.args) == 0 {
+		return b.state, fmt.Errorf("PUSH requires at least one argument")
 	}
 
 	if b.state.ImageID == "" {
 		return b.state, fmt.Errorf("Cannot PUSH empty image")
 	}
 
-	if err := b.client.TagImage(b.state.ImageID, c.cfg.args[0]); err != nil {
+	if b.cfg.Strict {
+		if !b.cfg.Push {
+			return b.state, fmt.Errorf("PUSH %s without --push flag (strict mode)", strings.Join(c.cfg.args, " "))
+		}
+		// non-strict builds are warned by the client when pushing
+		for _, arg := range c.cfg.args {
+			if isOld, warning := imagename.WarnIfOldS3ImageName(arg); isOld {
+				return b.state, b.warn("%s", warning)
+			}
+		}
+	}
+
+	names, err := b.pushNames(c.cfg.args)
+	if err != nil {
+		return b.state, err
+	}
+
+	if err := b.scanConfigForSecrets(b.state); err != nil {
+		return b.state, err
+	}
+
+	if err := b.recordRockerData(c.cfg); err != nil {
+		return b.state, err
+	}
+
+	if err := b.smokeBeforePublish("PUSH", c.cfg.flags); err != nil {
 		return b.state, err
 	}
 
-	image := imagename.NewFromString(c.cfg.args[0])
-	artifact := imagename.Artifact{
-		Name:      image,
-		Pushed:    b.cfg.Push,
-		Tag:       image.GetTag(),
-		ImageID:   b.state.ImageID,
-		BuildTime: time.Now(),
+	now := time.Now()
+	imageID, expires, err := b.expiringImage(c.cfg.flags, now)
+	if err != nil {
+		return b.state, err
+	}
+
+	artifacts := []imagename.Artifact{}
+	for _, name := range names {
+		if err := b.client.TagImage(imageID, name); err != nil {
+			return b.state, err
+		}
+
+		image := imagename.NewFromString(name)
+		artifacts = append(artifacts, imagename.Artifact{
+			Name:      image,
+			Pushed:    b.cfg.Push,
+			Tag:       image.GetTag(),
+			ImageID:   imageID,
+			BuildTime: now,
+			Expires:   expires,
+
+			Size:          b.state.Size,
+			Delta:         b.ProducedSize,
+			BuildDuration: time.Since(b.started),
+		})
 	}
 
 	// push image and add some lines to artifacts
 	if b.cfg.Push {
-		digest, err := b.client.PushImage(image.String())
-		if err != nil {
-			return b.state, err
+		for i := range artifacts {
+			digest, err := b.client.PushImage(artifacts[i].Name.String())
+			if err != nil {
+				return b.state, err
+			}
+			artifacts[i].SetDigest(digest)
 		}
-		artifact.SetDigest(digest)
 	} else {
 		log.Infof("| Don't push. Pass --push flag to actually push to the registry")
 	}
 
-	// Publish artifact files
-	if b.cfg.ArtifactsPath != "" {
-		if err := os.MkdirAll(b.cfg.ArtifactsPath, 0755); err != nil {
-			return b.state, fmt.Errorf("Failed to create directory %s for the artifacts, error: %s", b.cfg.ArtifactsPath, err)
-		}
-
-		filePath := filepath.Join(b.cfg.ArtifactsPath, artifact.GetFileName())
+	return b.state, b.saveArtifacts(artifacts...)
+}
 
-		artifacts := imagename.Artifacts{
-			RockerArtifacts: []imagename.Artifact{artifact},
+// pushNames returns the names PUSH tags and pushes the image to: the given
+// ones as rewritten by the publish channel, each followed by its names on
+// the push mirrors of its registry
+func (b *Build) pushNames(args []string) ([]string, error) {
+	names := []string{}
+	seen := map[string]bool{}
+	add := func(name string) {
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, name)
 		}
-		content, err := yaml.Marshal(artifacts)
+	}
+
+	for _, arg := range args {
+		name, err := b.publishName(arg)
 		if err != nil {
-			return b.state, err
+			return nil, err
 		}
+		add(name)
 
-		if err := ioutil.WriteFile(filePath, content, 0644); err != nil {
-			return b.state, fmt.Errorf("Failed to write artifact file %s, error: %s", filePath, err)
+		for _, mirror := range b.cfg.PushMirrors.Rewrite(imagename.NewFromString(name)) {
+			log.Infof("| Push mirror: %s -> %s", name, mirror)
+			add(mirror.String())
 		}
-
-		log.Infof("| Saved artifact file %s", filePath)
-		log.Debugf("Artifact properties: %# v", pretty.Formatter(artifact))
 	}
 
-	return b.state, nil
+	return names, nil
 }
 
 // CommandCopy implements COPY
@@ -946,10 +1332,13 @@ func (c *CommandCopy) ReplaceEnv(env []string) error {
 
 // Execute runs the command
 func (c *CommandCopy) Execute(b *Build) (State, error) {
+	if isCopyFromStdin(c.cfg) {
+		return copyFromStdin(b, c.cfg.args, "COPY", c.cfg.flags)
+	}
 	if len(c.cfg.args) < 2 {
 		return b.state, fmt.Errorf("COPY requires at least two arguments")
 	}
-	return copyFiles(b, c.cfg.args, "COPY")
+	return copyFiles(b, c.cfg.args, "COPY", c.cfg.flags)
 }
 
 // CommandAdd implements ADD
@@ -965,10 +1354,13 @@ func (c *CommandAdd) ReplaceEnv(env []string) error {
 
 // Execute runs the command
 func (c *CommandAdd) Execute(b *Build) (State, error) {
+	if isCopyFromStdin(c.cfg) {
+		return copyFromStdin(b, c.cfg.args, "ADD", c.cfg.flags)
+	}
 	if len(c.cfg.args) < 2 {
 		return b.state, fmt.Errorf("ADD requires at least two arguments")
 	}
-	return addFiles(b, c.cfg.args)
+	return addFiles(b, c.cfg.args, c.cfg.flags)
 }
 
 // CommandMount implements MOUNT
@@ -987,6 +1379,40 @@ func (c *CommandMount) Execute(b *Build) (s State, err error) {
 
 	commitIds := []string{}
 
+	// MOUNT --seed=dir /path fills the fresh volume of --no-reuse builds
+	seed := c.cfg.flags["seed"]
+	if seed != "" {
+		if len(c.cfg.args) != 1 || strings.Contains(c.cfg.args[0], ":") {
+			return s, fmt.Errorf("MOUNT --seed requires exactly one volume, e.g. MOUNT --seed=./vendor /src/vendor")
+		}
+		if !b.cfg.NoReuse {
+			log.Infof("| MOUNT --seed is applied only with --no-reuse, the volume %s is reused as is", c.cfg.args[0])
+		}
+	}
+
+	// MOUNT --tmpfs dest[:options], e.g. /build-tmp:size=2g; the options
+	// do not change what is built, so only the path goes to the cache key
+	if _, ok := c.cfg.flags["tmpfs"]; ok {
+		tmpfs := map[string]string{}
+		for dest, options := range s.NoCache.HostConfig.Tmpfs {
+			tmpfs[dest] = options
+		}
+		for _, arg := range c.cfg.args {
+			pair := strings.SplitN(arg, ":", 2)
+			if !path.IsAbs(pair[0]) {
+				return s, fmt.Errorf("Invalid tmpfs destination path: '%s', mount path must be absolute", pair[0])
+			}
+			tmpfs[pair[0]] = ""
+			if len(pair) == 2 {
+				tmpfs[pair[0]] = pair[1]
+			}
+			commitIds = append(commitIds, "tmpfs:"+pair[0])
+		}
+		s.NoCache.HostConfig.Tmpfs = tmpfs
+		s.Commit("MOUNT %q", commitIds)
+		return s, nil
+	}
+
 	for _, arg := range c.cfg.args {
 
 		switch strings.Contains(arg, ":") {
@@ -1007,6 +1433,12 @@ func (c *CommandMount) Execute(b *Build) (s State, err error) {
 				src = path.Join(b.cfg.ContextDir, src)
 			}
 
+			if _, err := os.Stat(src); os.IsNotExist(err) {
+				if err := b.warn("MOUNT host path %s does not exist, docker will create an empty directory", src); err != nil {
+					return s, err
+				}
+			}
+
 			if src, err = b.client.ResolveHostPath(src); err != nil {
 				return s, err
 			}
@@ -1023,6 +1455,34 @@ func (c *CommandMount) Execute(b *Build) (s State, err error) {
 			if !path.IsAbs(arg) {
 				return s, fmt.Errorf("Invalid volume destination path: '%s', mount path must be absolute..", arg)
 			}
+
+			// --no-reuse: the volume lives only through the build, the
+			// seed is a part of the cache key as the volume starts with it
+			if b.cfg.NoReuse {
+				c, err := b.getScopedVolumeContainer(arg, seed)
+				if err != nil {
+					return s, err
+				}
+
+				s.NoCache.HostConfig.Binds = append(s.NoCache.HostConfig.Binds,
+					mountsToBinds(c.Mounts, "")...)
+
+				commitID := "build:" + arg
+				if seed != "" {
+					dir, err := b.resolveSeed(seed)
+					if err != nil {
+						return s, err
+					}
+					digest, err := ContextDigest(dir, nil, b.cfg.Hash)
+					if err != nil {
+						return s, err
+					}
+					commitID += ":seed=" + digest
+				}
+				commitIds = append(commitIds, commitID)
+				continue
+			}
+
 			c, err := b.getVolumeContainer(arg)
 			if err != nil {
 				return s, err
@@ -1074,7 +1534,36 @@ func (c *CommandExport) Execute(b *Build) (s State, err error) {
 	// EXPORT /my/dir /stuff/ --> /EXPORT_VOLUME/stuff/my_dir
 	// EXPORT /my/dir/* / --> /EXPORT_VOLUME/stuff/my_dir
 
-	s.Commit("EXPORT %q to %s, prev_export_container_salt: %s", src, dest, b.prevExportContainerID)
+	excludes, err := exportExcludes(b, c.cfg.flags)
+	if err != nil {
+		return s, err
+	}
+
+	publish, hasPublish, err := exportPublishName(c.cfg.flags)
+	if err != nil {
+		return s, err
+	}
+	if hasPublish {
+		if len(src) != 1 {
+			return s, fmt.Errorf("EXPORT --publish requires exactly one source")
+		}
+		if len(excludes) > 0 {
+			return s, fmt.Errorf("EXPORT --publish does not support --exclude, publish the directory with the files it needs")
+		}
+		// The files are published whether the EXPORT is cached or not
+		defer func() {
+			if err == nil {
+				err = b.publishExport(b.state, publish, src[0])
+			}
+		}()
+	}
+
+	// The key of the EXPORT without excludes stays as it was
+	if len(excludes) > 0 {
+		s.Commit("EXPORT %q to %s excluding %q, prev_export_container_salt: %s", src, dest, excludes, b.prevExportContainerID)
+	} else {
+		s.Commit("EXPORT %q to %s, prev_export_container_salt: %s", src, dest, b.prevExportContainerID)
+	}
 
 	// build the command
 	cmdDestPath, err := util.ResolvePath(ExportsPath, dest)
@@ -1122,11 +1611,13 @@ func (c *CommandExport) Execute(b *Build) (s State, err error) {
 		cmd = append(cmd, "--verbose")
 	}
 
+	cmd = append(cmd, rsyncExcludeArgs(excludes)...)
 	cmd = append(cmd, src...)
 	cmd = append(cmd, cmdDestPath)
 
 	s.Config.Cmd = cmd
 	s.Config.Entrypoint = []string{}
+	s.Config.Labels = b.containerLabels(s.Config.Labels)
 
 	if exportsID, err = b.client.CreateContainer(s); err != nil {
 		return s, err
@@ -1152,6 +1643,10 @@ func (c *CommandImport) Execute(b *Build) (s State, err error) {
 	s = b.state
 	args := c.cfg.args
 
+	if from, ok := c.cfg.flags["from"]; ok {
+		return importArtifact(b, from, args, c.cfg.flags)
+	}
+
 	if len(args) == 0 {
 		return s, fmt.Errorf("IMPORT requires at least one argument")
 	}
@@ -1191,7 +1686,16 @@ func (c *CommandImport) Execute(b *Build) (s State, err error) {
 		src = append(src, argResolved)
 	}
 
-	s.Commit("IMPORT %q : %q %s", b.prevExportContainerID, src, dest)
+	excludes, err := exportExcludes(b, c.cfg.flags)
+	if err != nil {
+		return s, err
+	}
+
+	if len(excludes) > 0 {
+		s.Commit("IMPORT %q : %q %s excluding %q", b.prevExportContainerID, src, dest, excludes)
+	} else {
+		s.Commit("IMPORT %q : %q %s", b.prevExportContainerID, src, dest)
+	}
 
 	// Check cache
 	s, hit, err := b.probeCache(s)
@@ -1218,6 +1722,7 @@ func (c *CommandImport) Execute(b *Build) (s State, err error) {
 		cmd = append(cmd, "--verbose")
 	}
 
+	cmd = append(cmd, rsyncExcludeArgs(excludes)...)
 	cmd = append(cmd, src...)
 	cmd = append(cmd, dest)
 
@@ -1283,6 +1788,7 @@ func (c *CommandArg) Execute(b *Build) (s State, err error) {
 	}
 	// add the arg to allowed list of build-time args from this step on.
 	b.allowedBuildArgs[name] = true
+	b.consumedBuildArgs[name] = true
 
 	// If there is a default value associated with this arg then add it to the
 	// b.buildArgs if one is not already passed to the builder. The args passed
@@ -1293,6 +1799,10 @@ func (c *CommandArg) Execute(b *Build) (s State, err error) {
 
 	s.Commit("ARG %s", arg)
 
+	if err := b.recordBuildArg(&s, name); err != nil {
+		return s, err
+	}
+
 	return s, nil
 }
 
@@ -1324,8 +1834,73 @@ func (c *CommandOnbuildWrap) ReplaceEnv(env []string) error {
 	return nil
 }
 
+// CommandConditionWrap wraps the command having ONLY IF / SKIP IF decorators
+type CommandConditionWrap struct {
+	cmd        Command
+	conditions []commandCondition
+}
+
+// String returns the human readable string representation of the command
+func (c *CommandConditionWrap) String() string {
+	return c.cmd.String()
+}
+
+// ShouldRun returns true if all the conditions allow the command
+// and the command itself should be executed
+func (c *CommandConditionWrap) ShouldRun(b *Build) (bool, error) {
+	for _, cond := range c.conditions {
+		pass, err := cond.eval(b)
+		if err != nil {
+			return false, err
+		}
+		if !pass {
+			log.Infof("%s | skipped, %s", c.cmd, cond.original)
+			return false, nil
+		}
+	}
+	return c.cmd.ShouldRun(b)
+}
+
+// Execute runs the command
+func (c *CommandConditionWrap) Execute(b *Build) (State, error) {
+	return c.cmd.Execute(b)
+}
+
+// ReplaceEnv implements EnvReplacableCommand interface
+func (c *CommandConditionWrap) ReplaceEnv(env []string) error {
+	if command, ok := c.cmd.(EnvReplacableCommand); ok {
+		return command.ReplaceEnv(env)
+	}
+	return nil
+}
+
 ////////// Private stuff //////////
 
+// expandExecArgs substitutes the env references in the exec form arguments
+// of RUN --expand-env and CMD --expand-env the same way as of ENV or COPY;
+// the shell form needs no such flag, the shell expands it
+func (b *Build) expandExecArgs(cfg ConfigCommand, env []string) ([]string, error) {
+	name := strings.ToUpper(cfg.name)
+
+	if !cfg.attrs["json"] {
+		return nil, fmt.Errorf("%s --expand-env requires the exec form, e.g. %s --expand-env [\"./script\", \"$VERSION\"]", name, name)
+	}
+
+	for _, ref := range undefinedEnvRefs(cfg.args, env) {
+		if err := b.warn("%s references undefined variable $%s, it expands to an empty string", name, ref); err != nil {
+			return nil, err
+		}
+	}
+
+	// Keep the original args, the command may be executed again, e.g. with ONBUILD
+	args := append([]string{}, cfg.args...)
+	if err := replaceEnv(args, env); err != nil {
+		return nil, fmt.Errorf("Failed to expand env of %s, error: %s", name, err)
+	}
+
+	return args, nil
+}
+
 func replaceEnv(args []string, env []string) (err error) {
 
 	defaultEnv := []string{"PATH=" + DefaultPathEnv}
@@ -18,11 +18,18 @@ package build
 
 import (
 	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"reflect"
 	"testing"
+	"time"
 
 	"github.com/grammarly/rocker/src/imagename"
+	"github.com/grammarly/rocker/src/template"
 
+	"github.com/go-yaml/yaml"
 	"github.com/kr/pretty"
 	"github.com/stretchr/testify/mock"
 
@@ -58,6 +65,37 @@ func TestCommandFrom_Existing(t *testing.T) {
 	assert.Equal(t, "localhost", state.Config.Hostname)
 }
 
+func TestCommandFrom_RegistryMirror(t *testing.T) {
+	b, c := makeBuild(t, "", Config{
+		RegistryMirrors: imagename.Mirrors{"docker.io": "mirror.internal"},
+	})
+
+	c.On("InspectImage", "mirror.internal/library/debian:jessie").Return(&docker.Image{ID: "123"}, nil).Once()
+	c.On("InspectImage", "debian:jessie").Return(&docker.Image{ID: "456"}, nil).Once()
+
+	state, err := NewCommand(ConfigCommand{
+		name: "from",
+		args: []string{"debian:jessie"},
+	}).Execute(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "123", state.ImageID)
+
+	// --no-mirror is the escape hatch
+	state, err = NewCommand(ConfigCommand{
+		name:  "from",
+		args:  []string{"debian:jessie"},
+		flags: map[string]string{"no-mirror": ""},
+	}).Execute(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "456", state.ImageID)
+
+	c.AssertExpectations(t)
+}
+
 func TestCommandFrom_NotExisting(t *testing.T) {
 	b, c := makeBuild(t, "", Config{})
 	cmd := NewCommand(ConfigCommand{
@@ -109,6 +147,38 @@ func TestCommandRun_Simple(t *testing.T) {
 	assert.Equal(t, "456", state.NoCache.ContainerID)
 }
 
+func TestCommandRun_ContainerLabels(t *testing.T) {
+	b, c := makeBuild(t, "", Config{ID: "app"})
+	cmd := NewCommand(ConfigCommand{
+		name: "run",
+		args: []string{"whoami"},
+	})
+
+	b.step = 2
+	b.state.ImageID = "123"
+	b.state.Config.Labels = map[string]string{"maintainer": "me"}
+
+	c.On("CreateContainer", mock.AnythingOfType("State")).Return("456", nil).Run(func(args mock.Arguments) {
+		arg := args.Get(0).(State)
+		assert.Equal(t, map[string]string{
+			"maintainer":        "me",
+			"rocker.build.id":   "app",
+			"rocker.step":       "2",
+			"rocker.rockerfile": b.rockerfile.Name,
+		}, arg.Config.Labels)
+	}).Once()
+
+	c.On("RunContainer", "456", false).Return(nil).Once()
+
+	state, err := cmd.Execute(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.AssertExpectations(t)
+	assert.Equal(t, map[string]string{"maintainer": "me"}, state.Config.Labels, "should not label the image")
+}
+
 func TestCommandRun_ArgNoEnv(t *testing.T) {
 	b, c := makeBuild(t, "", Config{})
 	cmd := NewCommand(ConfigCommand{
@@ -169,6 +239,69 @@ func TestCommandRun_ArgWithEnv(t *testing.T) {
 	assert.Equal(t, []string{"foo=bar", "lopata=some_value"}, state.Config.Env)
 }
 
+func TestCommandRun_ExpandEnv(t *testing.T) {
+	b, c := makeBuild(t, "", Config{})
+	args := []string{"./script", "$VERSION", "${NAME}-${SUFFIX:-final}", "'$VERSION'", "\\$VERSION", "a b $http_proxy"}
+	cmd := NewCommand(ConfigCommand{
+		name:  "run",
+		args:  args,
+		attrs: map[string]bool{"json": true},
+		flags: map[string]string{"expand-env": ""},
+	})
+
+	b.state.Config.Env = []string{"VERSION=1.2", "NAME=app"}
+	b.state.ImageID = "123"
+	b.state.NoCache.BuildArgs = map[string]string{"http_proxy": "http://host:3128"}
+
+	expected := []string{"./script", "1.2", "app-final", "$VERSION", "$VERSION", "a b http://host:3128"}
+
+	c.On("CreateContainer", mock.AnythingOfType("State")).Return("456", nil).Run(func(args mock.Arguments) {
+		arg := args.Get(0).(State)
+		assert.Equal(t, expected, arg.Config.Cmd)
+	}).Once()
+
+	c.On("RunContainer", "456", false).Return(nil).Once()
+
+	state, err := cmd.Execute(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.AssertExpectations(t)
+	assert.Contains(t, state.GetCommits(), `"./script" "1.2" "app-final"`)
+	// The args are kept for the next execution
+	assert.Equal(t, "$VERSION", args[1])
+}
+
+func TestCommandRun_ExpandEnvShellForm(t *testing.T) {
+	b, _ := makeBuild(t, "", Config{})
+	cmd := NewCommand(ConfigCommand{
+		name:  "run",
+		args:  []string{"./script $VERSION"},
+		flags: map[string]string{"expand-env": ""},
+	})
+
+	b.state.ImageID = "123"
+
+	_, err := cmd.Execute(b)
+	assert.EqualError(t, err, `RUN --expand-env requires the exec form, e.g. RUN --expand-env ["./script", "$VERSION"]`)
+}
+
+func TestCommandRun_ExpandEnvStrict(t *testing.T) {
+	b, _ := makeBuild(t, "", Config{Strict: true})
+	cmd := NewCommand(ConfigCommand{
+		name:  "run",
+		args:  []string{"./script", "$VERSION"},
+		attrs: map[string]bool{"json": true},
+		flags: map[string]string{"expand-env": ""},
+	})
+
+	b.state.ImageID = "123"
+
+	_, err := cmd.Execute(b)
+	assert.Contains(t, err.Error(), "RUN references undefined variable $VERSION")
+}
+
 // =========== Testing COMMIT ===========
 
 func TestCommandCommit_Simple(t *testing.T) {
@@ -196,6 +329,28 @@ func TestCommandCommit_Simple(t *testing.T) {
 	assert.Equal(t, "", state.NoCache.ContainerID)
 }
 
+func TestCommandCommit_Duration(t *testing.T) {
+	b, c := makeBuild(t, "", Config{})
+	cmd := &CommandCommit{}
+
+	b.state.ImageID = "123"
+	b.state.NoCache.ContainerID = "456"
+	b.state.Commit("a")
+
+	c.On("CommitContainer", mock.AnythingOfType("State")).Return(&docker.Image{ID: "789"}, nil).Run(func(args mock.Arguments) {
+		time.Sleep(10 * time.Millisecond)
+	}).Once()
+	c.On("RemoveContainer", "456").Return(nil).Once()
+
+	if _, err := cmd.Execute(b); err != nil {
+		t.Fatal(err)
+	}
+
+	c.AssertExpectations(t)
+	assert.True(t, b.stepCommit >= 10*time.Millisecond, "should measure the commit of the step, got %s", b.stepCommit)
+	assert.Equal(t, b.stepCommit, b.CommitDuration)
+}
+
 func TestCommandCommit_NoContainer(t *testing.T) {
 	b, c := makeBuild(t, "", Config{})
 	cmd := &CommandCommit{}
@@ -423,6 +578,26 @@ func TestCommandCmd_Json(t *testing.T) {
 	assert.Equal(t, []string{"apt-get", "install"}, state.Config.Cmd)
 }
 
+func TestCommandCmd_ExpandEnv(t *testing.T) {
+	b, _ := makeBuild(t, "", Config{})
+	cmd := NewCommand(ConfigCommand{
+		name:  "cmd",
+		args:  []string{"/app/bin/$NAME", "--port=${PORT}", "$HOME"},
+		attrs: map[string]bool{"json": true},
+		flags: map[string]string{"expand-env": ""},
+	})
+
+	b.state.Config.Env = []string{"NAME=server", "PORT=8080", "HOME=/app"}
+
+	state, err := cmd.Execute(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, []string{"/app/bin/server", "--port=8080", "/app"}, state.Config.Cmd)
+	assert.Equal(t, `CMD ["/app/bin/server" "--port=8080" "/app"]`, state.GetCommits())
+}
+
 // =========== Testing ENTRYPOINT ===========
 
 func TestCommandEntrypoint_Simple(t *testing.T) {
@@ -473,6 +648,90 @@ func TestCommandEntrypoint_Remove(t *testing.T) {
 	assert.Equal(t, []string{}, state.Config.Entrypoint)
 }
 
+func TestCommandEntrypoint_ResetsCmd(t *testing.T) {
+	for _, cfg := range []ConfigCommand{
+		{name: "entrypoint", args: []string{"/app/server"}},
+		{name: "entrypoint", args: []string{"/app/server"}, attrs: map[string]bool{"json": true}},
+	} {
+		b, _ := makeBuild(t, "", Config{})
+
+		// the command of the base image
+		b.state.Config.Cmd = []string{"bash"}
+
+		state, err := NewCommand(cfg).Execute(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		assert.Nil(t, state.Config.Cmd, "json: %t", cfg.attrs["json"])
+	}
+}
+
+func TestCommandEntrypoint_KeepsExplicitCmd(t *testing.T) {
+	for _, attrs := range []map[string]bool{{}, {"json": true}} {
+		b, _ := makeBuild(t, "", Config{})
+
+		state, err := NewCommand(ConfigCommand{name: "cmd", args: []string{"--port=8080"}, attrs: map[string]bool{"json": true}}).Execute(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b.state = state
+
+		state, err = NewCommand(ConfigCommand{name: "entrypoint", args: []string{"/app/server"}, attrs: attrs}).Execute(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		assert.Equal(t, []string{"--port=8080"}, state.Config.Cmd, "json: %t", attrs["json"])
+	}
+}
+
+func TestCommandEntrypoint_PreserveCmd(t *testing.T) {
+	b, _ := makeBuild(t, "", Config{})
+	cmd := NewCommand(ConfigCommand{
+		name:  "entrypoint",
+		args:  []string{"/app/server"},
+		flags: map[string]string{"preserve-cmd": ""},
+	})
+
+	b.state.Config.Cmd = []string{"bash"}
+
+	state, err := cmd.Execute(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, []string{"bash"}, state.Config.Cmd)
+	assert.Equal(t, `ENTRYPOINT ["/bin/sh" "-c" "/app/server"] --preserve-cmd`, state.GetCommits())
+}
+
+func TestCommandEntrypoint_CmdOfEarlierFrom(t *testing.T) {
+	for syntax, cmdKept := range map[string]bool{"1.0": true, "1.2": false} {
+		b, c := makeBuild(t, "# rocker:syntax="+syntax+"\nFROM ubuntu", Config{})
+
+		c.On("InspectImage", "ubuntu:latest").Return(&docker.Image{
+			ID:     "123",
+			Config: &docker.Config{Cmd: []string{"bash"}},
+		}, nil).Once()
+
+		// CMD of the earlier FROM section
+		b.state.NoCache.CmdSet = true
+
+		state, err := NewCommand(ConfigCommand{name: "from", args: []string{"ubuntu"}}).Execute(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b.state = state
+
+		state, err = NewCommand(ConfigCommand{name: "entrypoint", args: []string{"/app/server"}}).Execute(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		assert.Equal(t, cmdKept, state.Config.Cmd != nil, "syntax %s", syntax)
+	}
+}
+
 // =========== Testing EXPOSE ===========
 
 func TestCommandExpose_Simple(t *testing.T) {
@@ -578,6 +837,34 @@ func TestCommandUser_Simple(t *testing.T) {
 	}
 
 	assert.Equal(t, "www", state.Config.User)
+	assert.Equal(t, "", state.UserID)
+}
+
+func TestCommandUser_Numeric(t *testing.T) {
+	b, _ := makeBuild(t, "", Config{})
+	cmd := NewCommand(ConfigCommand{
+		name: "user",
+		args: []string{"1000"},
+	})
+
+	state, err := cmd.Execute(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, "1000", state.Config.User)
+	assert.Equal(t, "1000:1000", state.UserID)
+}
+
+func TestCommandUser_Invalid(t *testing.T) {
+	b, _ := makeBuild(t, "", Config{})
+	cmd := NewCommand(ConfigCommand{
+		name: "user",
+		args: []string{"us@r"},
+	})
+
+	_, err := cmd.Execute(b)
+	assert.EqualError(t, err, "USER has invalid user name \"us@r\"")
 }
 
 // =========== Testing ONBUILD ===========
@@ -638,6 +925,7 @@ func TestCommandTag_Simple(t *testing.T) {
 
 	b.state.ImageID = "123"
 
+	c.On("InspectImage", "123").Return(&docker.Image{ID: "123", Config: &docker.Config{}}, nil).Once()
 	c.On("TagImage", "123", "docker.io/grammarly/rocker:1.0").Return(nil).Once()
 
 	_, err := cmd.Execute(b)
@@ -691,6 +979,7 @@ func TestCommandPush_Simple(t *testing.T) {
 	b.cfg.Push = true
 	b.state.ImageID = "123"
 
+	c.On("InspectImage", "123").Return(&docker.Image{ID: "123", Config: &docker.Config{}}, nil).Once()
 	c.On("TagImage", "123", "docker.io/grammarly/rocker:1.0").Return(nil).Once()
 	c.On("PushImage", "docker.io/grammarly/rocker:1.0").Return("sha256:fafa", nil).Once()
 
@@ -702,24 +991,94 @@ func TestCommandPush_Simple(t *testing.T) {
 	c.AssertExpectations(t)
 }
 
+func TestCommandPush_ArtifactSizes(t *testing.T) {
+	b, c := makeBuild(t, "", Config{})
+	cmd := NewCommand(ConfigCommand{
+		name: "push",
+		args: []string{"docker.io/grammarly/rocker:1.0"},
+	})
+
+	b.cfg.Push = true
+	b.state.ImageID = "123"
+	b.state.Size = 1000
+	b.ProducedSize = 200
+	b.started = time.Now().Add(-time.Minute)
+
+	c.On("InspectImage", "123").Return(&docker.Image{ID: "123", Config: &docker.Config{}}, nil).Once()
+	c.On("TagImage", "123", "docker.io/grammarly/rocker:1.0").Return(nil).Once()
+	c.On("PushImage", "docker.io/grammarly/rocker:1.0").Return("sha256:fafa", nil).Once()
+
+	if _, err := cmd.Execute(b); err != nil {
+		t.Fatal(err)
+	}
+
+	c.AssertExpectations(t)
+	assert.Len(t, b.Artifacts, 1)
+	assert.Equal(t, int64(1000), b.Artifacts[0].Size)
+	assert.Equal(t, int64(200), b.Artifacts[0].Delta)
+	assert.True(t, b.Artifacts[0].BuildDuration >= time.Minute)
+}
+
 func TestCommandPush_WrongArgsNumber(t *testing.T) {
 	b, _ := makeBuild(t, "", Config{})
 	cmd := NewCommand(ConfigCommand{
 		name: "push",
 		args: []string{},
 	})
-	cmd2 := NewCommand(ConfigCommand{
+
+	b.state.ImageID = "123"
+
+	_, err := cmd.Execute(b)
+	assert.EqualError(t, err, "PUSH requires at least one argument")
+}
+
+func TestCommandPush_MultipleRegistries(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "rocker-artifacts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	b, c := makeBuild(t, "", Config{})
+	cmd := NewCommand(ConfigCommand{
 		name: "push",
-		args: []string{"1", "2"},
+		args: []string{"quay.io/org/app:1", "hub.internal/org/app:1", "quay.io/org/app:1"},
 	})
 
+	b.cfg.Push = true
+	b.cfg.ArtifactsPath = tmpDir
+	b.cfg.PushMirrors = imagename.PushMirrors{"quay.io": {"backup.internal"}}
 	b.state.ImageID = "123"
 
-	_, err := cmd.Execute(b)
-	assert.EqualError(t, err, "PUSH requires exactly one argument")
+	c.On("InspectImage", "123").Return(&docker.Image{ID: "123", Config: &docker.Config{}}, nil).Once()
+	for i, name := range []string{"quay.io/org/app:1", "backup.internal/org/app:1", "hub.internal/org/app:1"} {
+		c.On("TagImage", "123", name).Return(nil).Once()
+		c.On("PushImage", name).Return(fmt.Sprintf("sha256:fafa%d", i), nil).Once()
+	}
 
-	_, err2 := cmd2.Execute(b)
-	assert.EqualError(t, err2, "PUSH requires exactly one argument")
+	if _, err := cmd.Execute(b); err != nil {
+		t.Fatal(err)
+	}
+
+	c.AssertExpectations(t)
+
+	files, err := ioutil.ReadDir(tmpDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Len(t, files, 1)
+
+	content, err := ioutil.ReadFile(filepath.Join(tmpDir, files[0].Name()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	artifacts := imagename.Artifacts{}
+	if err := yaml.Unmarshal(content, &artifacts); err != nil {
+		t.Fatal(err)
+	}
+	assert.Len(t, artifacts.RockerArtifacts, 3)
+	assert.Equal(t, "backup.internal/org/app@sha256:fafa1", artifacts.RockerArtifacts[1].Addressable)
+	assert.Equal(t, "sha256:fafa2", artifacts.RockerArtifacts[2].Digest)
 }
 
 func TestCommandPush_NoImage(t *testing.T) {
@@ -796,6 +1155,102 @@ func TestCommandMount_VolumeContainer(t *testing.T) {
 	assert.Equal(t, commitMsg, state.GetCommits())
 }
 
+func TestCommandMount_NoReuseSeed(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "rocker-seed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	if err := os.MkdirAll(filepath.Join(tmpDir, "vendor"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(tmpDir, "vendor", "lib.go"), []byte{}, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	b, c := makeBuild(t, "", Config{ContextDir: tmpDir, NoReuse: true})
+	cmd := NewCommand(ConfigCommand{
+		name:  "mount",
+		args:  []string{"/src/vendor"},
+		flags: map[string]string{"seed": "./vendor"},
+	})
+
+	containerName := b.scopedMountsContainerName("/src/vendor")
+	assert.NotEqual(t, b.mountsContainerName("/src/vendor"), containerName)
+
+	c.On("EnsureContainer", containerName, mock.AnythingOfType("*docker.Config"), mock.AnythingOfType("*docker.HostConfig"), "/src/vendor").Return("123", nil).Twice()
+	c.On("InspectContainer", containerName).Return(&docker.Container{
+		ID:     "123",
+		Mounts: []docker.Mount{{Source: "/volumedir", Destination: "/src/vendor", RW: true}},
+	}, nil).Twice()
+	c.On("UploadToContainer", "123", mock.Anything, "/").Return(nil).Run(func(args mock.Arguments) {
+		ioutil.ReadAll(args.Get(1).(io.Reader))
+	}).Once()
+
+	state, err := cmd.Execute(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	digest, err := ContextDigest(filepath.Join(tmpDir, "vendor"), nil, b.cfg.Hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []string{"/volumedir:/src/vendor:rw"}, state.NoCache.HostConfig.Binds)
+	assert.Equal(t, fmt.Sprintf(`MOUNT ["build:/src/vendor:seed=%s"]`, digest), state.GetCommits())
+
+	// The volume is seeded once per build
+	if _, err := cmd.Execute(b); err != nil {
+		t.Fatal(err)
+	}
+
+	c.On("RemoveContainer", containerName).Return(nil).Once()
+	b.removeScopedVolumes()
+
+	c.AssertExpectations(t)
+}
+
+func TestCommandMount_SeedWrongArgs(t *testing.T) {
+	b, _ := makeBuild(t, "", Config{NoReuse: true})
+	cmd := NewCommand(ConfigCommand{
+		name:  "mount",
+		args:  []string{"/a", "/b"},
+		flags: map[string]string{"seed": "./vendor"},
+	})
+
+	_, err := cmd.Execute(b)
+	assert.EqualError(t, err, "MOUNT --seed requires exactly one volume, e.g. MOUNT --seed=./vendor /src/vendor")
+}
+
+func TestCommandMount_Tmpfs(t *testing.T) {
+	b, _ := makeBuild(t, "", Config{})
+	b.state.NoCache.HostConfig.Tmpfs = map[string]string{"/run": ""}
+
+	cmd := NewCommand(ConfigCommand{
+		name:  "mount",
+		args:  []string{"/build-tmp:size=2g,mode=1777", "/scratch"},
+		flags: map[string]string{"tmpfs": ""},
+	})
+
+	state, err := cmd.Execute(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, map[string]string{"/run": "", "/build-tmp": "size=2g,mode=1777", "/scratch": ""}, state.NoCache.HostConfig.Tmpfs)
+	assert.Equal(t, map[string]string{"/run": ""}, b.state.NoCache.HostConfig.Tmpfs)
+	assert.Equal(t, `MOUNT ["tmpfs:/build-tmp" "tmpfs:/scratch"]`, state.GetCommits())
+
+	cmd = NewCommand(ConfigCommand{
+		name:  "mount",
+		args:  []string{"build-tmp"},
+		flags: map[string]string{"tmpfs": ""},
+	})
+	_, err = cmd.Execute(b)
+	assert.EqualError(t, err, "Invalid tmpfs destination path: 'build-tmp', mount path must be absolute")
+}
+
 // =========== Testing ARG ===========
 
 func TestCommandArg_Simple(t *testing.T) {
@@ -833,3 +1288,140 @@ func TestCommandArg_Allow(t *testing.T) {
 }
 
 // TODO: test Cleanup
+
+// =========== Testing ONLY IF / SKIP IF ===========
+
+func TestCommandCondition(t *testing.T) {
+	b, _ := makeBuild(t, "", Config{})
+	b.rockerfile.Vars = template.Vars{"Environment": "dev"}
+	b.state.Config.Env = []string{"DEBUG=1"}
+
+	tests := []struct {
+		skip     bool
+		expr     string
+		expected bool
+	}{
+		{false, `eq .Environment "dev"`, true},
+		{false, `eq .Environment "prod"`, false},
+		{false, `.State.Env.DEBUG`, true},
+		{true, `.State.Env.DEBUG`, false},
+		{true, `eq .State.Env.DEBUG "0"`, true},
+		{false, `and .State.Env.DEBUG (not .Missing)`, true},
+	}
+
+	for _, test := range tests {
+		cmd := NewCommand(ConfigCommand{
+			name:       "run",
+			args:       []string{"make"},
+			conditions: []commandCondition{{skip: test.skip, expr: test.expr}},
+		})
+
+		shouldRun, err := cmd.ShouldRun(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, test.expected, shouldRun, test.expr)
+		assert.Equal(t, "", cmd.String())
+	}
+
+	cmd := NewCommand(ConfigCommand{
+		name:       "run",
+		conditions: []commandCondition{{expr: `nope .X`, original: "ONLY IF nope .X"}},
+	})
+	_, err := cmd.ShouldRun(b)
+	assert.Contains(t, err.Error(), "Failed to evaluate ONLY IF nope .X")
+}
+
+// =========== Testing ENVFILE / LABELFILE ===========
+
+func TestCommandEnvFile(t *testing.T) {
+	dir := makeContextFiles(t, map[string]string{
+		"env.production": "NAME=app\nPORT=8080\n",
+		"bad.env":        "1NAME=app\n",
+	})
+
+	b, _ := makeBuild(t, "", Config{ContextDir: dir})
+	b.state.Config.Env = []string{"PORT=80", "DEBUG=1"}
+
+	cmd := NewCommand(ConfigCommand{name: "envfile", args: []string{"env.production"}})
+
+	state, err := cmd.Execute(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, []string{"PORT=8080", "DEBUG=1", "NAME=app"}, state.Config.Env)
+	assert.Regexp(t, "^ENVFILE env.production sha256:[0-9a-f]{64}$", state.GetCommits())
+
+	_, err = NewCommand(ConfigCommand{name: "envfile", args: []string{"bad.env"}}).Execute(b)
+	assert.Contains(t, err.Error(), `invalid variable name "1NAME"`)
+
+	_, err = NewCommand(ConfigCommand{name: "envfile", args: []string{"../env"}}).Execute(b)
+	assert.Contains(t, err.Error(), "outside of the build context")
+}
+
+func TestCommandLabelFile(t *testing.T) {
+	dir := makeContextFiles(t, map[string]string{
+		"labels.yml": "team: platform\ncom.example.version: 2\n",
+	})
+
+	b, _ := makeBuild(t, "", Config{ContextDir: dir})
+
+	cmd := NewCommand(ConfigCommand{name: "labelfile", args: []string{"labels.yml"}})
+
+	state, err := cmd.Execute(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, map[string]string{"team": "platform", "com.example.version": "2"}, state.Config.Labels)
+	assert.Regexp(t, "^LABELFILE labels.yml sha256:", state.GetCommits())
+}
+
+func makeContextFiles(t *testing.T, files map[string]string) string {
+	dir, err := ioutil.TempDir("", "rocker-context")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+// =========== Testing CLEANUP ===========
+
+func TestCommandCleanup_CacheOnly(t *testing.T) {
+	b, c := makeBuild(t, "", Config{NoGarbage: true})
+
+	b.state.ImageID = "app"
+	b.state.ProducedImage = true
+	b.ProducedSize, b.VirtualSize = 10, 100
+
+	c.On("RemoveImage", "app").Return(nil).Once()
+
+	state, err := (&CommandCleanup{}).Execute(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.state = state
+
+	// The cache-only section that follows
+	b.state.ImageID = "deps"
+	b.state.ProducedImage = true
+	b.ProducedSize, b.VirtualSize = 20, 200
+
+	state, err = (&CommandCleanup{final: true, cacheOnly: true, section: "deps"}).Execute(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.AssertExpectations(t)
+	assert.Equal(t, "app", state.ImageID)
+	assert.EqualValues(t, 10, b.ProducedSize)
+	assert.EqualValues(t, 100, b.VirtualSize)
+}
@@ -0,0 +1,122 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/grammarly/rocker/src/parser"
+	"github.com/grammarly/rocker/src/template"
+)
+
+// commandCondition is the ONLY IF / SKIP IF decorator of an instruction,
+// e.g.
+//
+//   ONLY IF eq .Environment "dev"
+//   RUN apt-get install -y vim
+//
+// The expression is evaluated right before the instruction using the
+// same template engine, vars and functions as the Rockerfile, plus the
+// current build state available as .State
+type commandCondition struct {
+	skip     bool
+	expr     string
+	original string
+}
+
+// isConditionNode returns true if the node is ONLY or SKIP decorator
+func isConditionNode(node *parser.Node) bool {
+	return node.Value == "only" || node.Value == "skip"
+}
+
+// parseCondition makes a condition out of ONLY IF / SKIP IF node
+func parseCondition(node *parser.Node) (cond commandCondition, err error) {
+	cond.skip = node.Value == "skip"
+	cond.original = node.Original
+
+	rest := ""
+	if node.Next != nil {
+		rest = node.Next.Value
+	}
+
+	fields := strings.SplitN(rest, " ", 2)
+	if len(fields) != 2 || strings.ToUpper(fields[0]) != "IF" || strings.TrimSpace(fields[1]) == "" {
+		return cond, fmt.Errorf("%s should be in the form of `%s IF <expression>`",
+			node.Original, strings.ToUpper(node.Value))
+	}
+
+	cond.expr = strings.TrimSpace(fields[1])
+
+	return cond, nil
+}
+
+// checkConditions validates the decorators: they should be well formed
+// and followed by an instruction they can be applied to
+func checkConditions(nodes []*parser.Node) error {
+	for i, node := range nodes {
+		if !isConditionNode(node) {
+			continue
+		}
+		if _, err := parseCondition(node); err != nil {
+			return err
+		}
+
+		next := i + 1
+		for next < len(nodes) && isConditionNode(nodes[next]) {
+			next++
+		}
+
+		if next == len(nodes) {
+			return fmt.Errorf("%s is not followed by any instruction", node.Original)
+		}
+		if nodes[next].Value == "from" {
+			return fmt.Errorf("%s can not be applied to FROM", node.Original)
+		}
+	}
+	return nil
+}
+
+// eval returns true if the command should run according to the condition
+func (cond commandCondition) eval(b *Build) (bool, error) {
+	var (
+		vars = template.Vars{}
+		funs = template.Funs{}
+	)
+	if b.rockerfile != nil {
+		vars = vars.Merge(b.rockerfile.Vars)
+		funs = b.rockerfile.Funs
+	}
+
+	vars["State"] = map[string]interface{}{
+		"ImageID":    b.state.ImageID,
+		"Env":        template.ParseKvPairs(b.state.Config.Env),
+		"Labels":     b.state.Config.Labels,
+		"User":       b.state.Config.User,
+		"WorkingDir": b.state.Config.WorkingDir,
+		"BuildArgs":  b.state.NoCache.BuildArgs,
+	}
+
+	src := fmt.Sprintf("{{ if %s }}true{{ end }}", cond.expr)
+
+	result, err := template.Process(cond.original, strings.NewReader(src), vars, funs)
+	if err != nil {
+		return false, fmt.Errorf("Failed to evaluate %s, error: %s", cond.original, err)
+	}
+
+	return (result.String() == "true") != cond.skip, nil
+}
@@ -0,0 +1,177 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/fatih/color"
+	"github.com/fsouza/go-dockerclient"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// ConfigDiff describes how the image config b differs from the config a, one
+// line per change, "+ " for the added values and "- " for the removed ones;
+// a changed value is removed and added. The intermediate labels are skipped.
+func ConfigDiff(a, b *docker.Config) (lines []string) {
+	if a == nil {
+		a = &docker.Config{}
+	}
+	if b == nil {
+		b = &docker.Config{}
+	}
+
+	add := func(prefix, format string, args ...interface{}) {
+		lines = append(lines, prefix+" "+fmt.Sprintf(format, args...))
+	}
+	value := func(name string, before, after string) {
+		if before == after {
+			return
+		}
+		if before != "" {
+			add("-", "%s %s", name, before)
+		}
+		if after != "" {
+			add("+", "%s %s", name, after)
+		}
+	}
+	pairs := func(name, sep string, before, after map[string]string) {
+		for _, k := range mergedKeys(before, after) {
+			v1, ok1 := before[k]
+			v2, ok2 := after[k]
+			if ok1 && ok2 && v1 == v2 {
+				continue
+			}
+			if ok1 {
+				add("-", "%s %s%s%s", name, k, sep, v1)
+			}
+			if ok2 {
+				add("+", "%s %s%s%s", name, k, sep, v2)
+			}
+		}
+	}
+
+	value("ENTRYPOINT", jsonList(a.Entrypoint), jsonList(b.Entrypoint))
+	value("CMD", jsonList(a.Cmd), jsonList(b.Cmd))
+	value("USER", a.User, b.User)
+	value("WORKDIR", a.WorkingDir, b.WorkingDir)
+	value("STOPSIGNAL", a.StopSignal, b.StopSignal)
+	pairs("ENV", "=", envMap(a.Env), envMap(b.Env))
+	pairs("LABEL", "=", withoutIntermediateLabels(a.Labels), withoutIntermediateLabels(b.Labels))
+	pairs("EXPOSE", "", portSet(a.ExposedPorts), portSet(b.ExposedPorts))
+	pairs("VOLUME", "", volumeSet(a.Volumes), volumeSet(b.Volumes))
+	pairs("ONBUILD", "", listSet(a.OnBuild), listSet(b.OnBuild))
+
+	return lines
+}
+
+// logConfigDiff logs the changes of the config made by the commit, colored
+// on a terminal, see Config.ConfigDiff
+func (b *Build) logConfigDiff(parentID string, config *docker.Config) error {
+	var parent *docker.Config
+	if parentID != "" {
+		img, err := b.client.InspectImage(parentID)
+		if err != nil {
+			return err
+		}
+		if img != nil {
+			parent = img.Config
+		}
+	}
+
+	lines := ConfigDiff(parent, config)
+	if len(lines) == 0 {
+		log.Infof("| Config is not changed")
+		return nil
+	}
+
+	var (
+		added   = color.New(color.FgGreen).SprintFunc()
+		removed = color.New(color.FgRed).SprintFunc()
+	)
+	for _, line := range lines {
+		if strings.HasPrefix(line, "+") {
+			line = added(line)
+		} else {
+			line = removed(line)
+		}
+		log.Infof("| %s", line)
+	}
+
+	return nil
+}
+
+func mergedKeys(a, b map[string]string) []string {
+	keys := []string{}
+	for k := range a {
+		keys = append(keys, k)
+	}
+	for k := range b {
+		if _, ok := a[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func jsonList(list []string) string {
+	if len(list) == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%q", list)
+}
+
+func envMap(env []string) map[string]string {
+	result := map[string]string{}
+	for _, e := range env {
+		pair := strings.SplitN(e, "=", 2)
+		if len(pair) == 2 {
+			result[pair[0]] = pair[1]
+		} else {
+			result[pair[0]] = ""
+		}
+	}
+	return result
+}
+
+func portSet(ports map[docker.Port]struct{}) map[string]string {
+	result := map[string]string{}
+	for p := range ports {
+		result[string(p)] = ""
+	}
+	return result
+}
+
+func volumeSet(volumes map[string]struct{}) map[string]string {
+	result := map[string]string{}
+	for v := range volumes {
+		result[v] = ""
+	}
+	return result
+}
+
+func listSet(list []string) map[string]string {
+	result := map[string]string{}
+	for _, item := range list {
+		result[item] = ""
+	}
+	return result
+}
@@ -0,0 +1,75 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"testing"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestConfigDiff(t *testing.T) {
+	a := &docker.Config{
+		Env:          []string{"PATH=/bin", "MODE=dev"},
+		Labels:       map[string]string{"team": "web", ImageLabelIntermediate: "true"},
+		Cmd:          []string{"/bin/sh"},
+		ExposedPorts: map[docker.Port]struct{}{"80/tcp": {}},
+	}
+	b := &docker.Config{
+		Env:          []string{"PATH=/bin", "MODE=prod", "DEBUG="},
+		Labels:       map[string]string{"team": "web", "version": "1"},
+		Cmd:          []string{"/app", "--serve"},
+		User:         "app",
+		ExposedPorts: map[docker.Port]struct{}{"8080/tcp": {}},
+	}
+
+	assert.Equal(t, []string{
+		`- CMD ["/bin/sh"]`,
+		`+ CMD ["/app" "--serve"]`,
+		`+ USER app`,
+		`+ ENV DEBUG=`,
+		`- ENV MODE=dev`,
+		`+ ENV MODE=prod`,
+		`+ LABEL version=1`,
+		`- EXPOSE 80/tcp`,
+		`+ EXPOSE 8080/tcp`,
+	}, ConfigDiff(a, b))
+
+	assert.Empty(t, ConfigDiff(a, a))
+	assert.Equal(t, []string{"+ WORKDIR /app"}, ConfigDiff(nil, &docker.Config{WorkingDir: "/app"}))
+}
+
+func TestCommandCommit_ConfigDiff(t *testing.T) {
+	b, c := makeBuild(t, "", Config{ConfigDiff: true})
+
+	b.state.ImageID = "123"
+	b.state.NoCache.ContainerID = "456"
+	b.state.Config.Env = []string{"A=1"}
+	b.state.Commit("ENV A=1")
+
+	c.On("CommitContainer", mock.AnythingOfType("State")).Return(&docker.Image{ID: "789"}, nil).Once()
+	c.On("RemoveContainer", "456").Return(nil).Once()
+	c.On("InspectImage", "123").Return(&docker.Image{ID: "123", Config: &docker.Config{}}, nil).Once()
+
+	if _, err := (&CommandCommit{}).Execute(b); err != nil {
+		t.Fatal(err)
+	}
+
+	c.AssertExpectations(t)
+}
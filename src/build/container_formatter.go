@@ -17,12 +17,15 @@
 package build
 
 import (
-	"bytes"
-	"fmt"
 	log "github.com/Sirupsen/logrus"
 	"runtime"
 )
 
+const (
+	colorRed   = "\x1b[31m"
+	colorReset = "\x1b[0m"
+)
+
 type containerFormatter struct {
 	isColored bool
 }
@@ -45,18 +48,21 @@ func NewMonochromeContainerFormatter() log.Formatter {
 	}
 }
 
+// Format writes the message alone; the messages are the lines of the container
+// output, up to 64k each, so the buffer is allocated of the exact size
 func (f *containerFormatter) Format(entry *log.Entry) ([]byte, error) {
-	buffer := &bytes.Buffer{}
-
 	isColorTerminal := isTerminal && (runtime.GOOS != "windows")
 	isColored := isColorTerminal && f.isColored
 
-	if isColored {
-		fmt.Fprintf(buffer, "\x1b[31m%s\x1b[0m", entry.Message)
-	} else {
-		fmt.Fprintf(buffer, "%s", entry.Message)
+	if !isColored {
+		buf := make([]byte, 0, len(entry.Message)+1)
+		buf = append(buf, entry.Message...)
+		return append(buf, '\n'), nil
 	}
 
-	buffer.WriteByte('\n')
-	return buffer.Bytes(), nil
+	buf := make([]byte, 0, len(entry.Message)+len(colorRed)+len(colorReset)+1)
+	buf = append(buf, colorRed...)
+	buf = append(buf, entry.Message...)
+	buf = append(buf, colorReset...)
+	return append(buf, '\n'), nil
 }
@@ -0,0 +1,150 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/docker/docker/pkg/archive"
+	"github.com/docker/docker/pkg/fileutils"
+)
+
+// ExtractContext unpacks the build context archive, compressed or not, to
+// the directory, leaving out the files matched by the .dockerignore of the
+// archive, except the keep ones, e.g. the Rockerfile; the patterns are
+// returned, since they apply to COPY and ADD as well
+func ExtractContext(fileName, dir string, keep ...string) (dockerignore []string, err error) {
+	if dockerignore, err = readArchiveDockerignore(fileName); err != nil {
+		return nil, err
+	}
+
+	patterns, patDirs, _, err := fileutils.CleanPatterns(dockerignore)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse .dockerignore of build context %s, error: %s", fileName, err)
+	}
+
+	kept := map[string]bool{".dockerignore": true}
+	for _, name := range keep {
+		kept[filepath.Clean(name)] = true
+	}
+
+	in, err := openArchive(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer in.Close()
+
+	pipeReader, pipeWriter := io.Pipe()
+
+	go func() {
+		var (
+			tr = tar.NewReader(in)
+			tw = tar.NewWriter(pipeWriter)
+		)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				pipeWriter.CloseWithError(err)
+				return
+			}
+
+			name := filepath.Clean(hdr.Name)
+			if !kept[name] && name != "." {
+				skip, err := fileutils.OptimizedMatches(name, patterns, patDirs)
+				if err != nil {
+					pipeWriter.CloseWithError(err)
+					return
+				}
+				if skip {
+					continue
+				}
+			}
+
+			if err := tw.WriteHeader(hdr); err != nil {
+				pipeWriter.CloseWithError(err)
+				return
+			}
+			if _, err := io.Copy(tw, tr); err != nil {
+				pipeWriter.CloseWithError(err)
+				return
+			}
+		}
+		pipeWriter.CloseWithError(tw.Close())
+	}()
+
+	if err := archive.UntarUncompressed(pipeReader, dir, &archive.TarOptions{NoLchown: true}); err != nil {
+		pipeReader.CloseWithError(err)
+		return nil, fmt.Errorf("Failed to extract build context %s, error: %s", fileName, err)
+	}
+
+	return dockerignore, nil
+}
+
+// readArchiveDockerignore reads the .dockerignore in the root of the archive, if any
+func readArchiveDockerignore(fileName string) ([]string, error) {
+	in, err := openArchive(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer in.Close()
+
+	tr := tar.NewReader(in)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return []string{}, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read build context %s, error: %s", fileName, err)
+		}
+		if filepath.Clean(hdr.Name) == ".dockerignore" {
+			return ReadDockerignore(tr)
+		}
+	}
+}
+
+// archiveReader is the decompressed archive that closes the file along with the stream
+type archiveReader struct {
+	io.ReadCloser
+	file *os.File
+}
+
+func (r archiveReader) Close() error {
+	r.ReadCloser.Close()
+	return r.file.Close()
+}
+
+// openArchive opens the archive and decompresses it, if needed
+func openArchive(fileName string) (io.ReadCloser, error) {
+	fd, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	stream, err := archive.DecompressStream(fd)
+	if err != nil {
+		fd.Close()
+		return nil, fmt.Errorf("Failed to decompress build context %s, error: %s", fileName, err)
+	}
+	return archiveReader{stream, fd}, nil
+}
@@ -0,0 +1,126 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/docker/docker/pkg/archive"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExtractContext(t *testing.T) {
+	src := makeContextFiles(t, map[string]string{
+		".dockerignore": "*.log\nlogs\nRockerfile\n!keep.log\n",
+		"Rockerfile":    "FROM alpine",
+		"main.go":       "package main",
+		"debug.log":     "debug",
+		"keep.log":      "keep",
+	})
+	if err := os.MkdirAll(filepath.Join(src, "logs"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(src, "logs", "app.txt"), []byte("app"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	fileName := writeTestContextArchive(t, src)
+
+	dest := cacheTestTmpDir(t)
+	defer os.RemoveAll(dest)
+
+	dockerignore, err := ExtractContext(fileName, dest, "Rockerfile")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, []string{"*.log", "logs", "Rockerfile", "!keep.log"}, dockerignore)
+
+	infos, err := ioutil.ReadDir(dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{}
+	for _, info := range infos {
+		names = append(names, info.Name())
+	}
+	sort.Strings(names)
+
+	assert.Equal(t, []string{".dockerignore", "Rockerfile", "keep.log", "main.go"}, names)
+}
+
+func TestExtractContext_NoDockerignore(t *testing.T) {
+	src := makeContextFiles(t, map[string]string{
+		"Rockerfile": "FROM alpine",
+	})
+
+	fileName := writeTestContextArchive(t, src)
+
+	dest := cacheTestTmpDir(t)
+	defer os.RemoveAll(dest)
+
+	dockerignore, err := ExtractContext(fileName, dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, []string{}, dockerignore)
+
+	content, err := ioutil.ReadFile(filepath.Join(dest, "Rockerfile"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "FROM alpine", string(content))
+}
+
+func TestExtractContext_NotArchive(t *testing.T) {
+	src := makeContextFiles(t, map[string]string{
+		"context.tar.gz": "not an archive",
+	})
+
+	dest := cacheTestTmpDir(t)
+	defer os.RemoveAll(dest)
+
+	_, err := ExtractContext(filepath.Join(src, "context.tar.gz"), dest)
+	assert.Error(t, err)
+}
+
+// writeTestContextArchive makes the .tar.gz of the directory
+func writeTestContextArchive(t *testing.T, dir string) string {
+	stream, err := archive.Tar(dir, archive.Gzip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+
+	f, err := ioutil.TempFile("", "rocker-context-archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	t.Cleanup(func() { os.Remove(f.Name()) })
+
+	if _, err := io.Copy(f, stream); err != nil {
+		t.Fatal(err)
+	}
+	return f.Name()
+}
@@ -0,0 +1,156 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/docker/docker/pkg/fileutils"
+	"github.com/docker/docker/pkg/units"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// contextSizeTop is how many of the largest entries are listed when the
+// context is too large
+const contextSizeTop = 10
+
+// ContextSizeEntry is a file or a directory of the build context along with
+// the size of the files it contributes to the context
+type ContextSizeEntry struct {
+	Path string
+	Size int64
+}
+
+// ContextSize sums the sizes of the files of the context directory that are
+// not excluded by the .dockerignore patterns, and returns up to top largest
+// entries; an entry within the one already listed is not listed again, so
+// the breakdown names the directories to add to .dockerignore
+func ContextSize(dir string, excludes []string, top int) (total int64, largest []ContextSizeEntry, err error) {
+	patterns, patDirs, exceptions, err := fileutils.CleanPatterns(excludes)
+	if err != nil {
+		return 0, nil, fmt.Errorf("Failed to parse .dockerignore of build context %s, error: %s", dir, err)
+	}
+
+	sizes := map[string]int64{}
+
+	err = filepath.Walk(dir, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, file)
+		if err != nil || rel == "." {
+			return err
+		}
+
+		skip, err := fileutils.OptimizedMatches(rel, patterns, patDirs)
+		if err != nil {
+			return err
+		}
+		if skip {
+			// The files of the excluded directory may be brought back by the "!" patterns
+			if info.IsDir() && !exceptions {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		total += info.Size()
+		for p := rel; p != "."; p = filepath.Dir(p) {
+			sizes[p] += info.Size()
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, nil, fmt.Errorf("Failed to compute the size of build context %s, error: %s", dir, err)
+	}
+
+	entries := make([]ContextSizeEntry, 0, len(sizes))
+	for p, size := range sizes {
+		entries = append(entries, ContextSizeEntry{p, size})
+	}
+	sort.Sort(contextSizeEntries(entries))
+
+	for _, e := range entries {
+		if len(largest) >= top {
+			break
+		}
+		nested := false
+		for _, l := range largest {
+			if strings.HasPrefix(e.Path, l.Path+string(filepath.Separator)) {
+				nested = true
+				break
+			}
+		}
+		if !nested {
+			largest = append(largest, e)
+		}
+	}
+
+	return total, largest, nil
+}
+
+// checkContextSize fails the build, or warns with Config.ContextSizeWarn,
+// if the context is larger than Config.MaxContextSize, listing the largest
+// entries of it
+func (b *Build) checkContextSize() error {
+	if b.cfg.MaxContextSize <= 0 {
+		return nil
+	}
+
+	total, largest, err := ContextSize(b.cfg.ContextDir, b.cfg.Dockerignore, contextSizeTop)
+	if err != nil {
+		return err
+	}
+	if total <= b.cfg.MaxContextSize {
+		log.Debugf("Build context is %s", units.HumanSize(float64(total)))
+		return nil
+	}
+
+	message := fmt.Sprintf("Build context %s is %s, more than %s allowed by --max-context-size; exclude the large files with .dockerignore",
+		b.cfg.ContextDir, units.HumanSize(float64(total)), units.HumanSize(float64(b.cfg.MaxContextSize)))
+
+	log.Warnf("The largest entries of the build context:")
+	for _, e := range largest {
+		log.Warnf("| %10s  %s", units.HumanSize(float64(e.Size)), e.Path)
+	}
+
+	if b.cfg.ContextSizeWarn {
+		log.Warn(message)
+		return nil
+	}
+	return fmt.Errorf("%s", message)
+}
+
+// contextSizeEntries sorts the entries by size, the largest first
+type contextSizeEntries []ContextSizeEntry
+
+func (e contextSizeEntries) Len() int      { return len(e) }
+func (e contextSizeEntries) Swap(i, j int) { e[i], e[j] = e[j], e[i] }
+func (e contextSizeEntries) Less(i, j int) bool {
+	if e[i].Size != e[j].Size {
+		return e[i].Size > e[j].Size
+	}
+	return e[i].Path < e[j].Path
+}
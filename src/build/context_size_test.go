@@ -0,0 +1,66 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestContextSize(t *testing.T) {
+	tmpDir := makeTmpDir(t, map[string]string{
+		"Rockerfile":                "FROM alpine",
+		"src/main.go":               strings.Repeat("a", 100),
+		"assets/video.mp4":          strings.Repeat("b", 1000),
+		"assets/img/logo.png":       strings.Repeat("c", 300),
+		"node_modules/lib/index.js": strings.Repeat("d", 5000),
+		"build/keep.txt":            strings.Repeat("e", 50),
+		"build/out.bin":             strings.Repeat("f", 2000),
+	})
+	defer os.RemoveAll(tmpDir)
+
+	total, largest, err := ContextSize(tmpDir, []string{"node_modules", "build/*", "!build/keep.txt"}, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, int64(11+100+1000+300+50), total)
+	assert.Equal(t, []ContextSizeEntry{
+		{"assets", 1300},
+		{"src", 100},
+		{"build", 50},
+	}, largest)
+}
+
+func TestCheckContextSize(t *testing.T) {
+	tmpDir := makeTmpDir(t, map[string]string{
+		"data.bin": strings.Repeat("a", 2000000),
+	})
+	defer os.RemoveAll(tmpDir)
+
+	b, _ := makeBuild(t, "", Config{ContextDir: tmpDir, MaxContextSize: 3000000})
+	assert.Nil(t, b.checkContextSize())
+
+	b, _ = makeBuild(t, "", Config{ContextDir: tmpDir, MaxContextSize: 1000000})
+	assert.EqualError(t, b.checkContextSize(), "Build context "+tmpDir+" is 2 MB, more than 1 MB allowed by --max-context-size; exclude the large files with .dockerignore")
+
+	b, _ = makeBuild(t, "", Config{ContextDir: tmpDir, MaxContextSize: 1000000, ContextSizeWarn: true})
+	assert.Nil(t, b.checkContextSize())
+}
@@ -50,7 +50,7 @@ type uploadFile struct {
 	size int64
 }
 
-func addFiles(b *Build, args []string) (s State, err error) {
+func addFiles(b *Build, args []string, flags map[string]string) (s State, err error) {
 
 	s = b.state
 
@@ -63,6 +63,16 @@ func addFiles(b *Build, args []string) (s State, err error) {
 		dest = filepath.FromSlash(args[len(args)-1]) // last one is always the dest
 	)
 
+	for _, arg := range src {
+		if !isImageSource(arg) {
+			continue
+		}
+		if len(src) > 1 {
+			return s, fmt.Errorf("ADD from another image supports exactly one source, got %d", len(src))
+		}
+		return addFromImage(b, arg, args[len(args)-1], flags)
+	}
+
 	// If destination is not a directory (no trailing slash)
 	hasTrailingSlash := strings.HasSuffix(dest, string(os.PathSeparator))
 	if !hasTrailingSlash && len(src) > 1 {
@@ -79,21 +89,33 @@ func addFiles(b *Build, args []string) (s State, err error) {
 
 	uf := b.urlFetcher
 
+	checksum, hasChecksum := flags["checksum"]
+	if hasChecksum && (len(src) != 1 || !isURL(src[0])) {
+		return s, fmt.Errorf("ADD --checksum requires exactly one URL source")
+	}
+
 	for _, arg := range args {
 		if !isURL(arg) {
 			continue
 		}
 
-		if _, err = uf.Get(arg); err != nil {
+		info, err := uf.Get(arg)
+		if err != nil {
 			return s, err
 		}
+
+		if hasChecksum {
+			if err := verifyChecksum(info.FileName, checksum); err != nil {
+				return s, fmt.Errorf("Failed to verify %s, error: %s", arg, err)
+			}
+		}
 	}
 
-	return copyFiles(b, args, "ADD")
+	return copyFiles(b, args, "ADD", flags)
 
 }
 
-func copyFiles(b *Build, args []string, cmdName string) (s State, err error) {
+func copyFiles(b *Build, args []string, cmdName string, flags map[string]string) (s State, err error) {
 
 	s = b.state
 
@@ -133,9 +155,19 @@ func copyFiles(b *Build, args []string, cmdName string) (s State, err error) {
 		return s, nil
 	}
 
+	chown, hasChown := flags["chown"]
+	if hasChown {
+		if chown, err = resolveChown(b, &s, chown); err != nil {
+			return s, err
+		}
+		if u.tar, err = chownTarStream(u.tar, chown); err != nil {
+			return s, err
+		}
+	}
+
 	log.Infof("| Calculating tarsum for %d files (%s total)", len(u.files), units.HumanSize(float64(u.size)))
 
-	if tarSum, err = tarsum.NewTarSum(u.tar, true, tarsum.Version1); err != nil {
+	if tarSum, err = newTarSum(u.tar, b.cfg.Hash); err != nil {
 		return s, err
 	}
 	if _, err = io.Copy(ioutil.Discard, tarSum); err != nil {
@@ -146,6 +178,9 @@ func copyFiles(b *Build, args []string, cmdName string) (s State, err error) {
 	// TODO: useful commit comment?
 
 	message := fmt.Sprintf("%s %s to %s", cmdName, tarSum.Sum(nil), dest)
+	if hasChown {
+		message = fmt.Sprintf("%s %s to %s chown %s", cmdName, tarSum.Sum(nil), dest, chown)
+	}
 	s.Commit(message)
 
 	// Check cache
@@ -156,6 +191,14 @@ func copyFiles(b *Build, args []string, cmdName string) (s State, err error) {
 	if hit {
 		return s, nil
 	}
+	if s, hit, err = b.probeCopies(s); err != nil || hit {
+		return s, err
+	}
+
+	// The cached layers were scanned when they were built
+	if err = b.scanFilesForSecrets(cmdName, u.files); err != nil {
+		return s, err
+	}
 
 	origCmd := s.Config.Cmd
 	s.Config.Cmd = []string{"/bin/sh", "-c", "#(nop) " + message}
@@ -172,6 +215,12 @@ func copyFiles(b *Build, args []string, cmdName string) (s State, err error) {
 		return s, err
 	}
 
+	if hasChown {
+		if u.tar, err = chownTarStream(u.tar, chown); err != nil {
+			return s, err
+		}
+	}
+
 	// Copy to "/" because we made the prefix inside the tar archive
 	// Do that because we are not able to reliably create directories inside the container
 	if err = b.client.UploadToContainer(s.NoCache.ContainerID, u.tar, "/"); err != nil {
@@ -181,6 +230,22 @@ func copyFiles(b *Build, args []string, cmdName string) (s State, err error) {
 	return s, nil
 }
 
+// resolveChown returns the numeric uid:gid for the --chown flag of COPY and ADD;
+// the empty value means the current USER
+func resolveChown(b *Build, s *State, chown string) (string, error) {
+	if chown != "" {
+		return resolveUserID(b, *s, chown)
+	}
+	if s.UserID == "" {
+		id, err := resolveUserID(b, *s, s.Config.User)
+		if err != nil {
+			return "", err
+		}
+		s.UserID = id
+	}
+	return s.UserID, nil
+}
+
 func makeTarStream(srcPath, dest, cmdName string, includes, excludes []string, urlFetcher URLFetcher) (u *upload, err error) {
 
 	u = &upload{
@@ -0,0 +1,224 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"path"
+	"path/filepath"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// imageSourcePrefix is the prefix of ADD sources taken from other images,
+// e.g. ADD image://jwilder/dockerize:v0.2.0:/usr/local/bin/dockerize /bin/
+const imageSourcePrefix = "image://"
+
+// isImageSource returns true if the ADD source refers to another image
+func isImageSource(src string) bool {
+	return strings.HasPrefix(src, imageSourcePrefix)
+}
+
+// parseImageSource splits image://name:tag:/path into the image name and the path;
+// the path is separated by the first ":/", which cannot occur in the image name,
+// since the registry port is followed by "/" only after digits
+func parseImageSource(src string) (image, srcPath string, err error) {
+	rest := strings.TrimPrefix(src, imageSourcePrefix)
+
+	i := strings.Index(rest, ":/")
+	if i <= 0 {
+		return "", "", fmt.Errorf("ADD source %s should be in the form image://<image>:<absolute path>", src)
+	}
+
+	image, srcPath = rest[:i], path.Clean(rest[i+1:])
+	if srcPath == "/" {
+		return "", "", fmt.Errorf("ADD source %s should not be the root of the image", src)
+	}
+
+	return image, srcPath, nil
+}
+
+// addFromImage extracts the path from another image through a temporary
+// container and uploads it to the container of the current state
+func addFromImage(b *Build, src, dest string, flags map[string]string) (s State, err error) {
+	s = b.state
+
+	imageName, srcPath, err := parseImageSource(src)
+	if err != nil {
+		return s, err
+	}
+
+	img, err := b.lookupImage(imageName)
+	if err != nil {
+		return s, fmt.Errorf("ADD error: %s", err)
+	}
+	if img == nil {
+		return s, fmt.Errorf("ADD: image %s not found", imageName)
+	}
+
+	if !filepath.IsAbs(dest) {
+		hasTrailingSlash := strings.HasSuffix(dest, "/")
+		dest = filepath.Join(s.Config.WorkingDir, dest)
+		if hasTrailingSlash {
+			dest += "/"
+		}
+	}
+
+	chown, hasChown := flags["chown"]
+	if hasChown {
+		if chown, err = resolveChown(b, &s, chown); err != nil {
+			return s, err
+		}
+	}
+
+	// The image ID is content addressable, so it is the cache key of the source
+	message := fmt.Sprintf("ADD %s%s@%s:%s to %s", imageSourcePrefix, imageName, img.ID, srcPath, dest)
+	if hasChown {
+		message += " chown " + chown
+	}
+	s.Commit("%s", message)
+
+	s, hit, err := b.probeCache(s)
+	if err != nil {
+		return s, err
+	}
+	if hit {
+		return s, nil
+	}
+
+	log.Infof("| Extract %s from image %s (%.12s)", srcPath, imageName, img.ID)
+
+	srcState := State{ImageID: img.ID}
+	srcState.Config.Cmd = []string{"/bin/sh", "-c", "#(nop) extract " + srcPath}
+	srcState.Config.Entrypoint = []string{}
+	srcState.Config.Labels = b.containerLabels(nil)
+
+	srcContainerID, err := b.client.CreateContainer(srcState)
+	if err != nil {
+		return s, err
+	}
+	defer b.client.RemoveContainer(srcContainerID)
+
+	origCmd := s.Config.Cmd
+	s.Config.Cmd = []string{"/bin/sh", "-c", "#(nop) " + message}
+
+	if s.NoCache.ContainerID, err = b.client.CreateContainer(s); err != nil {
+		return s, err
+	}
+
+	s.Config.Cmd = origCmd
+
+	pipeReader, pipeWriter := io.Pipe()
+	go func() {
+		pipeWriter.CloseWithError(b.client.DownloadFromContainer(srcContainerID, srcPath, pipeWriter))
+	}()
+
+	var stream io.ReadCloser = relocateTarStream(pipeReader, dest)
+	if hasChown {
+		if stream, err = chownTarStream(stream, chown); err != nil {
+			return s, err
+		}
+	}
+	defer stream.Close()
+
+	// Upload to "/" because the destination is the prefix inside the tar archive
+	if err = b.client.UploadToContainer(s.NoCache.ContainerID, stream, "/"); err != nil {
+		return s, err
+	}
+
+	return s, nil
+}
+
+// relocateTarStream moves the entries of the archive downloaded from a container,
+// which are rooted at the base name of the source path, to the destination,
+// following the COPY rules: the content of a directory goes into the destination,
+// a file goes into the destination directory if it ends with a slash,
+// otherwise it is saved with the destination name
+func relocateTarStream(in io.ReadCloser, dest string) io.ReadCloser {
+	var (
+		pipeReader, pipeWriter = io.Pipe()
+		destIsDir              = strings.HasSuffix(dest, "/")
+		destPath               = strings.TrimPrefix(path.Clean(dest), "/")
+	)
+
+	// relocate is applied to the names and to the targets of the hard links
+	// alike, either may be written as ./name, so the links keep pointing
+	// to the relocated files
+	relocate := func(name string, srcIsDir bool) string {
+		name = strings.TrimPrefix(path.Clean("/"+name), "/")
+		parts := strings.SplitN(name, "/", 2)
+		switch {
+		case len(parts) == 2:
+			return path.Join(destPath, parts[1])
+		case srcIsDir || !destIsDir:
+			return destPath
+		default:
+			return path.Join(destPath, parts[0])
+		}
+	}
+
+	go func() {
+		defer in.Close()
+
+		var (
+			tr       = tar.NewReader(in)
+			tw       = tar.NewWriter(pipeWriter)
+			srcIsDir = false
+			first    = true
+		)
+
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				pipeWriter.CloseWithError(err)
+				return
+			}
+
+			if first {
+				srcIsDir = hdr.Typeflag == tar.TypeDir
+				first = false
+			}
+
+			hdr.Name = relocate(hdr.Name, srcIsDir)
+			if hdr.Typeflag == tar.TypeDir {
+				hdr.Name += "/"
+			}
+			if hdr.Typeflag == tar.TypeLink {
+				hdr.Linkname = relocate(hdr.Linkname, srcIsDir)
+			}
+
+			if err := tw.WriteHeader(hdr); err != nil {
+				pipeWriter.CloseWithError(err)
+				return
+			}
+			if _, err := io.Copy(tw, tr); err != nil {
+				pipeWriter.CloseWithError(err)
+				return
+			}
+		}
+
+		pipeWriter.CloseWithError(tw.Close())
+	}()
+
+	return pipeReader
+}
@@ -0,0 +1,172 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestParseImageSource(t *testing.T) {
+	tests := []struct {
+		src, image, path, errMsg string
+	}{
+		{"image://jwilder/dockerize:v0.2.0:/usr/local/bin/dockerize", "jwilder/dockerize:v0.2.0", "/usr/local/bin/dockerize", ""},
+		{"image://localhost:5000/tools:/opt/tools/", "localhost:5000/tools", "/opt/tools", ""},
+		{"image://busybox:/bin", "busybox", "/bin", ""},
+		{"image://busybox", "", "", "ADD source image://busybox should be in the form image://<image>:<absolute path>"},
+		{"image://busybox:/", "", "", "ADD source image://busybox:/ should not be the root of the image"},
+	}
+
+	for _, test := range tests {
+		image, path, err := parseImageSource(test.src)
+		if test.errMsg != "" {
+			assert.EqualError(t, err, test.errMsg)
+			continue
+		}
+		if !assert.NoError(t, err) {
+			continue
+		}
+		assert.Equal(t, test.image, image)
+		assert.Equal(t, test.path, path)
+	}
+}
+
+func TestRelocateTarStream(t *testing.T) {
+	tests := []struct {
+		entries []string
+		dest    string
+		result  []string
+	}{
+		{[]string{"dockerize"}, "/usr/local/bin/", []string{"usr/local/bin/dockerize"}},
+		{[]string{"dockerize"}, "/bin/dz", []string{"bin/dz"}},
+		{[]string{"tools/", "tools/a", "tools/lib/", "tools/lib/b"}, "/opt/", []string{"opt/", "opt/a", "opt/lib/", "opt/lib/b"}},
+		{[]string{"tools/", "tools/a"}, "/opt/tools", []string{"opt/tools/", "opt/tools/a"}},
+	}
+
+	for _, test := range tests {
+		stream := relocateTarStream(ioutil.NopCloser(makeTestTar(t, test.entries)), test.dest)
+		assert.Equal(t, test.result, readTestTarNames(t, stream), "for %s", test.dest)
+	}
+}
+
+func TestRelocateTarStream_HardLinks(t *testing.T) {
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	for _, hdr := range []*tar.Header{
+		{Name: "tools/", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "tools/a", Typeflag: tar.TypeReg, Mode: 0755},
+		{Name: "tools/b", Typeflag: tar.TypeLink, Linkname: "tools/a"},
+		{Name: "./tools/c", Typeflag: tar.TypeLink, Linkname: "./tools/a"},
+	} {
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	tr := tar.NewReader(relocateTarStream(ioutil.NopCloser(buf), "/opt/"))
+	links := map[string]string{}
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Typeflag == tar.TypeLink {
+			links[hdr.Name] = hdr.Linkname
+		}
+	}
+
+	assert.Equal(t, map[string]string{"opt/b": "opt/a", "opt/c": "opt/a"}, links)
+}
+
+func TestCommandAdd_FromImage(t *testing.T) {
+	b, c := makeBuild(t, "", Config{})
+	b.state.ImageID = "123"
+
+	cmd := NewCommand(ConfigCommand{
+		name: "add",
+		args: []string{"image://jwilder/dockerize:v0.2.0:/usr/local/bin/dockerize", "/bin/"},
+	})
+
+	var uploaded []string
+
+	c.On("InspectImage", "jwilder/dockerize:v0.2.0").Return(&docker.Image{ID: "456"}, nil).Once()
+	c.On("CreateContainer", mock.MatchedBy(func(s State) bool { return s.ImageID == "456" })).Return("src", nil).Once()
+	c.On("CreateContainer", mock.MatchedBy(func(s State) bool { return s.ImageID == "123" })).Return("dst", nil).Once()
+	c.On("DownloadFromContainer", "src", "/usr/local/bin/dockerize", mock.Anything).Run(func(args mock.Arguments) {
+		io.Copy(args.Get(2).(io.Writer), makeTestTar(t, []string{"dockerize"}))
+	}).Return(nil).Once()
+	c.On("UploadToContainer", "dst", mock.Anything, "/").Run(func(args mock.Arguments) {
+		uploaded = readTestTarNames(t, args.Get(1).(io.Reader))
+	}).Return(nil).Once()
+	c.On("RemoveContainer", "src").Return(nil).Once()
+
+	state, err := cmd.Execute(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.AssertExpectations(t)
+	assert.Equal(t, []string{"bin/dockerize"}, uploaded)
+	assert.Equal(t, "dst", state.NoCache.ContainerID)
+	assert.Equal(t, "ADD image://jwilder/dockerize:v0.2.0@456:/usr/local/bin/dockerize to /bin/", state.GetCommits())
+}
+
+func makeTestTar(t *testing.T, entries []string) *bytes.Buffer {
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	for _, name := range entries {
+		hdr := &tar.Header{Name: name, Mode: 0755, Typeflag: tar.TypeReg}
+		if name[len(name)-1] == '/' {
+			hdr.Typeflag = tar.TypeDir
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf
+}
+
+func readTestTarNames(t *testing.T, in io.Reader) (names []string) {
+	tr := tar.NewReader(in)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return names
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, hdr.Name)
+	}
+}
@@ -0,0 +1,217 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// copyStdinFlag makes COPY and ADD take the files from the archive given to
+// rocker by --copy-stdin instead of the build context, e.g. COPY --from-stdin /app/bundle/
+const copyStdinFlag = "from-stdin"
+
+// isCopyFromStdin returns true if the instruction copies the --copy-stdin archive
+func isCopyFromStdin(cfg ConfigCommand) bool {
+	if cfg.name != "copy" && cfg.name != "add" {
+		return false
+	}
+	_, ok := cfg.flags[copyStdinFlag]
+	return ok
+}
+
+// checkCopyStdin fails the build before it starts if the Rockerfile copies
+// the archive that is not given
+func (b *Build) checkCopyStdin(plan Plan) error {
+	if b.cfg.CopyStdin != "" {
+		return nil
+	}
+	for _, command := range plan {
+		if cfg, ok := commandConfig(command); ok && isCopyFromStdin(cfg) {
+			return fmt.Errorf("%s requires the archive given with --copy-stdin, e.g. --copy-stdin 3 3<bundle.tar", cfg.original)
+		}
+	}
+	return nil
+}
+
+// copyFromStdin copies the content of the --copy-stdin archive to the destination
+// directory; the tarsum of the archive is the cache key of the step
+func copyFromStdin(b *Build, args []string, cmdName string, flags map[string]string) (s State, err error) {
+	s = b.state
+
+	if len(args) != 1 {
+		return s, fmt.Errorf("%s --%s requires exactly one argument, the destination directory", cmdName, copyStdinFlag)
+	}
+	if b.cfg.CopyStdin == "" {
+		return s, fmt.Errorf("%s --%s requires the archive given with --copy-stdin", cmdName, copyStdinFlag)
+	}
+
+	dest := filepath.FromSlash(args[0])
+	if !filepath.IsAbs(dest) {
+		dest = filepath.Join(s.Config.WorkingDir, dest)
+	}
+
+	if b.copyStdinSum == "" {
+		if b.copyStdinSum, err = archiveTarSum(b.cfg.CopyStdin, b.cfg.Hash); err != nil {
+			return s, err
+		}
+	}
+
+	chown, hasChown := flags["chown"]
+	if hasChown {
+		if chown, err = resolveChown(b, &s, chown); err != nil {
+			return s, err
+		}
+	}
+
+	message := fmt.Sprintf("%s stdin:%s to %s", cmdName, b.copyStdinSum, dest)
+	if hasChown {
+		message += " chown " + chown
+	}
+	s.Commit("%s", message)
+
+	s, hit, err := b.probeCache(s)
+	if err != nil {
+		return s, err
+	}
+	if hit {
+		return s, nil
+	}
+
+	log.Infof("| Copy the --copy-stdin archive to %s", dest)
+
+	origCmd := s.Config.Cmd
+	s.Config.Cmd = []string{"/bin/sh", "-c", "#(nop) " + message}
+
+	if s.NoCache.ContainerID, err = b.client.CreateContainer(s); err != nil {
+		return s, err
+	}
+
+	s.Config.Cmd = origCmd
+
+	fd, err := os.Open(b.cfg.CopyStdin)
+	if err != nil {
+		return s, fmt.Errorf("Failed to open the --copy-stdin archive, error: %s", err)
+	}
+
+	var stream = prefixTarStream(fd, dest)
+	if hasChown {
+		if stream, err = chownTarStream(stream, chown); err != nil {
+			return s, err
+		}
+	}
+	defer stream.Close()
+
+	// Upload to "/" because the destination is the prefix inside the tar archive
+	if err = b.client.UploadToContainer(s.NoCache.ContainerID, stream, "/"); err != nil {
+		return s, err
+	}
+
+	return s, nil
+}
+
+// archiveTarSum returns the tarsum of the archive file
+func archiveTarSum(fileName string, h Hash) (string, error) {
+	fd, err := os.Open(fileName)
+	if err != nil {
+		return "", fmt.Errorf("Failed to open the --copy-stdin archive, error: %s", err)
+	}
+	defer fd.Close()
+
+	tarSum, err := newTarSum(fd, h)
+	if err != nil {
+		return "", fmt.Errorf("Failed to read the --copy-stdin archive, error: %s", err)
+	}
+	if _, err = io.Copy(ioutil.Discard, tarSum); err != nil {
+		return "", fmt.Errorf("Failed to read the --copy-stdin archive, error: %s", err)
+	}
+
+	return tarSum.Sum(nil), nil
+}
+
+// prefixTarStream moves all entries of the archive into the destination directory,
+// the entries pointing outside of it are errors
+func prefixTarStream(in io.ReadCloser, dest string) io.ReadCloser {
+	var (
+		pipeReader, pipeWriter = io.Pipe()
+		destPath               = strings.TrimPrefix(path.Clean(filepath.ToSlash(dest)), "/")
+	)
+
+	prefix := func(name string) (string, error) {
+		for _, part := range strings.Split(name, "/") {
+			if part == ".." {
+				return "", fmt.Errorf("Entry %s of the --copy-stdin archive points outside of the destination", name)
+			}
+		}
+		return path.Join(destPath, name), nil
+	}
+
+	go func() {
+		defer in.Close()
+
+		var (
+			tr = tar.NewReader(in)
+			tw = tar.NewWriter(pipeWriter)
+		)
+
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				pipeWriter.CloseWithError(err)
+				return
+			}
+
+			if hdr.Name, err = prefix(hdr.Name); err != nil {
+				pipeWriter.CloseWithError(err)
+				return
+			}
+			if hdr.Typeflag == tar.TypeDir {
+				hdr.Name += "/"
+			}
+			if hdr.Typeflag == tar.TypeLink {
+				if hdr.Linkname, err = prefix(hdr.Linkname); err != nil {
+					pipeWriter.CloseWithError(err)
+					return
+				}
+			}
+
+			if err := tw.WriteHeader(hdr); err != nil {
+				pipeWriter.CloseWithError(err)
+				return
+			}
+			if _, err := io.Copy(tw, tr); err != nil {
+				pipeWriter.CloseWithError(err)
+				return
+			}
+		}
+
+		pipeWriter.CloseWithError(tw.Close())
+	}()
+
+	return pipeReader
+}
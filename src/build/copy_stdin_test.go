@@ -0,0 +1,102 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestPrefixTarStream(t *testing.T) {
+	stream := prefixTarStream(ioutil.NopCloser(makeTestTar(t, []string{"./", "./app.js", "lib/", "lib/a.js"})), "/app/bundle/")
+	assert.Equal(t, []string{"app/bundle/", "app/bundle/app.js", "app/bundle/lib/", "app/bundle/lib/a.js"}, readTestTarNames(t, stream))
+
+	stream = prefixTarStream(ioutil.NopCloser(makeTestTar(t, []string{"a.js", "../etc/passwd"})), "/app")
+	_, err := ioutil.ReadAll(stream)
+	assert.EqualError(t, err, "Entry ../etc/passwd of the --copy-stdin archive points outside of the destination")
+}
+
+func TestCheckCopyStdin(t *testing.T) {
+	b, _ := makeBuild(t, "FROM ubuntu\nCOPY --from-stdin /app/", Config{})
+	plan, err := NewPlan(b.rockerfile.Commands(), true, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.EqualError(t, b.checkCopyStdin(plan), "COPY --from-stdin /app/ requires the archive given with --copy-stdin, e.g. --copy-stdin 3 3<bundle.tar")
+
+	b.cfg.CopyStdin = "bundle.tar"
+	assert.Nil(t, b.checkCopyStdin(plan))
+}
+
+func TestCommandCopy_FromStdin(t *testing.T) {
+	tmpDir := cacheTestTmpDir(t)
+	defer os.RemoveAll(tmpDir)
+
+	archive := filepath.Join(tmpDir, "bundle.tar")
+	if err := ioutil.WriteFile(archive, makeTestTar(t, []string{"app.js", "lib/", "lib/a.js"}).Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	b, c := makeBuild(t, "", Config{CopyStdin: archive})
+	b.state.ImageID = "123"
+	b.state.Config.WorkingDir = "/app"
+
+	cmd := NewCommand(ConfigCommand{
+		name:  "copy",
+		args:  []string{"bundle/"},
+		flags: map[string]string{"from-stdin": ""},
+	})
+
+	var uploaded []string
+
+	c.On("CreateContainer", mock.AnythingOfType("State")).Return("dst", nil).Once()
+	c.On("UploadToContainer", "dst", mock.Anything, "/").Run(func(args mock.Arguments) {
+		uploaded = readTestTarNames(t, args.Get(1).(io.Reader))
+	}).Return(nil).Once()
+
+	state, err := cmd.Execute(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.AssertExpectations(t)
+	assert.Equal(t, []string{"app/bundle/app.js", "app/bundle/lib/", "app/bundle/lib/a.js"}, uploaded)
+	assert.True(t, strings.HasPrefix(state.GetCommits(), "COPY stdin:tarsum.v1+sha256:"), state.GetCommits())
+	assert.True(t, strings.HasSuffix(state.GetCommits(), " to /app/bundle"), state.GetCommits())
+}
+
+func TestCommandCopy_FromStdinArgs(t *testing.T) {
+	b, _ := makeBuild(t, "", Config{CopyStdin: "bundle.tar"})
+	b.state.ImageID = "123"
+
+	cmd := NewCommand(ConfigCommand{
+		name:  "copy",
+		args:  []string{"src", "/app/"},
+		flags: map[string]string{"from-stdin": ""},
+	})
+
+	_, err := cmd.Execute(b)
+	assert.EqualError(t, err, "COPY --from-stdin requires exactly one argument, the destination directory")
+}
@@ -0,0 +1,87 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"encoding/json"
+
+	"github.com/fatih/color"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// copyKey returns the key of the COPY or ADD step the images are remembered
+// by within the build: the same parent image, commits and env as of the cache
+// key, the commits have the tarsum of the files and the destination
+func copyKey(s State) string {
+	// The key has only strings, marshaling it cannot fail
+	data, _ := json.Marshal(NewCacheKey(s))
+	return string(data)
+}
+
+// probeCopies looks up the COPY or ADD step not found in the cache among the
+// ones made earlier in this build, see Config.DedupeCopy; on miss the key is
+// kept in the state for CommandCommit to remember the image it makes
+func (b *Build) probeCopies(s State) (State, bool, error) {
+	if !b.cfg.DedupeCopy {
+		return s, false, nil
+	}
+
+	key := copyKey(s)
+
+	s2, ok := b.copies[key]
+	if !ok {
+		s.NoCache.CopyKey = key
+		return s, false, nil
+	}
+
+	// The image may be gone, e.g. removed by --no-garbage after its FROM section
+	img, err := b.client.InspectImage(s2.ImageID)
+	if err != nil {
+		return s, false, err
+	}
+	if img == nil {
+		delete(b.copies, key)
+		s.NoCache.CopyKey = key
+		return s, false, nil
+	}
+
+	log.Info(color.New(color.FgGreen).SprintfFunc()("| Same files are copied earlier in this build, take image %.12s", s2.ImageID))
+
+	b.ProducedSize += s2.Size - s2.ParentSize
+	b.VirtualSize = s2.Size
+	b.stepCached = true
+
+	s2.NoCache = s.NoCache
+	s2.CleanCommits()
+
+	return s2, true, nil
+}
+
+// rememberCopy keeps the image committed by the COPY or ADD step
+// for the identical steps later in the build
+func (b *Build) rememberCopy(s State) {
+	if s.NoCache.CopyKey == "" {
+		return
+	}
+	if b.copies == nil {
+		b.copies = map[string]State{}
+	}
+	key := s.NoCache.CopyKey
+	s.NoCache = StateNoCache{}
+	b.copies[key] = s
+}
@@ -0,0 +1,125 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"testing"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestDedupeCopy_Hit(t *testing.T) {
+	b, c := makeBuild(t, "", Config{DedupeCopy: true})
+
+	s := b.state
+	s.ImageID = "123"
+	s.Commit("COPY tarsum to /app/")
+
+	state, hit, err := b.probeCopies(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.False(t, hit)
+	assert.Equal(t, copyKey(s), state.NoCache.CopyKey)
+
+	// COPY produced a container, commit it
+	state.NoCache.ContainerID = "456"
+	b.state = state
+
+	c.On("CommitContainer", mock.AnythingOfType("State")).Return(&docker.Image{ID: "789"}, nil).Once()
+	c.On("RemoveContainer", "456").Return(nil).Once()
+
+	if state, err = (&CommandCommit{}).Execute(b); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "789", state.ImageID)
+	assert.Equal(t, "", state.NoCache.CopyKey)
+	assert.Len(t, b.copies, 1)
+
+	// The same COPY on top of the same image in another stage
+	c.On("InspectImage", "789").Return(&docker.Image{ID: "789", Size: 10}, nil).Once()
+
+	state, hit, err = b.probeCopies(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.AssertExpectations(t)
+	assert.True(t, hit)
+	assert.Equal(t, "789", state.ImageID)
+	assert.Equal(t, "", state.GetCommits())
+}
+
+func TestDedupeCopy_OtherParent(t *testing.T) {
+	b, _ := makeBuild(t, "", Config{DedupeCopy: true})
+
+	s := b.state
+	s.ImageID = "123"
+	s.Commit("COPY tarsum to /app/")
+
+	b.rememberCopy(State{ImageID: "789", NoCache: StateNoCache{CopyKey: copyKey(s)}})
+
+	s.ImageID = "124"
+	state, hit, err := b.probeCopies(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.False(t, hit)
+	assert.Equal(t, "124", state.ImageID)
+}
+
+func TestDedupeCopy_Disabled(t *testing.T) {
+	b, _ := makeBuild(t, "", Config{})
+
+	s := b.state
+	s.ImageID = "123"
+	s.Commit("COPY tarsum to /app/")
+
+	state, hit, err := b.probeCopies(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.False(t, hit)
+	assert.Equal(t, "", state.NoCache.CopyKey)
+}
+
+func TestDedupeCopy_RemovedImage(t *testing.T) {
+	b, c := makeBuild(t, "", Config{DedupeCopy: true})
+
+	s := b.state
+	s.ImageID = "123"
+	s.Commit("COPY tarsum to /app/")
+
+	b.rememberCopy(State{ImageID: "789", NoCache: StateNoCache{CopyKey: copyKey(s)}})
+
+	c.On("InspectImage", "789").Return((*docker.Image)(nil), nil).Once()
+
+	state, hit, err := b.probeCopies(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.AssertExpectations(t)
+	assert.False(t, hit)
+	assert.Equal(t, "123", state.ImageID)
+	assert.Equal(t, copyKey(s), state.NoCache.CopyKey)
+	assert.Empty(t, b.copies)
+}
@@ -0,0 +1,114 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"crypto/md5"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+)
+
+// depCache describes where a package manager keeps its download cache
+type depCache struct {
+	// path is where the cache volume is mounted in the build containers
+	path string
+
+	// env is the variable that points the package manager to path,
+	// empty if path is the default location
+	env string
+}
+
+// depCaches are the package manager caches supported by CACHE
+var depCaches = map[string]depCache{
+	"npm":      {path: "/var/cache/rocker/npm", env: "npm_config_cache"},
+	"yarn":     {path: "/var/cache/rocker/yarn", env: "YARN_CACHE_FOLDER"},
+	"pip":      {path: "/var/cache/rocker/pip", env: "PIP_CACHE_DIR"},
+	"go-mod":   {path: "/var/cache/rocker/go-mod", env: "GOMODCACHE"},
+	"go-build": {path: "/var/cache/rocker/go-build", env: "GOCACHE"},
+	"maven":    {path: "/root/.m2/repository"},
+}
+
+// CommandCache implements CACHE
+type CommandCache struct {
+	CommandBase
+}
+
+// Execute runs the command
+func (c *CommandCache) Execute(b *Build) (s State, err error) {
+	s = b.state
+	args := c.cfg.args
+
+	if len(args) == 0 || len(args) > 2 {
+		return s, fmt.Errorf("CACHE requires the cache type and an optional project path, e.g. CACHE npm /app")
+	}
+
+	kind, project := args[0], ""
+	if len(args) == 2 {
+		if !path.IsAbs(args[1]) {
+			return s, fmt.Errorf("Invalid CACHE project path: '%s', it must be absolute", args[1])
+		}
+		project = path.Clean(args[1])
+	}
+
+	cache, ok := depCaches[kind]
+	if !ok {
+		return s, fmt.Errorf("Unknown CACHE type %s, supported types are: %s", kind, strings.Join(depCacheKinds(), ", "))
+	}
+
+	container, err := b.ensureVolumeContainer(b.depCacheContainerName(kind, project), cache.path)
+	if err != nil {
+		return s, err
+	}
+
+	if s.NoCache.HostConfig.Binds == nil {
+		s.NoCache.HostConfig.Binds = []string{}
+	}
+	s.NoCache.HostConfig.Binds = append(s.NoCache.HostConfig.Binds, mountsToBinds(container.Mounts, "")...)
+
+	// The variable is passed to the build containers like ARG,
+	// so it does not end up in the image config
+	if cache.env != "" {
+		if s.NoCache.BuildArgs == nil {
+			s.NoCache.BuildArgs = map[string]string{}
+		}
+		s.NoCache.BuildArgs[cache.env] = cache.path
+		b.allowedBuildArgs[cache.env] = true
+	}
+
+	s.Commit("CACHE %s %s:%s", kind, strings.TrimLeft(container.Name, "/"), cache.path)
+
+	return s, nil
+}
+
+// depCacheContainerName returns the name of the volume container of the
+// package manager cache; the caches are separate for every Rockerfile (or
+// --id) and the project path within it
+func (b *Build) depCacheContainerName(kind, project string) string {
+	cacheID := b.getIdentifier() + ":" + kind + ":" + project
+	return fmt.Sprintf("rocker_cache_%s_%.6x", kind, md5.Sum([]byte(cacheID)))
+}
+
+func depCacheKinds() []string {
+	kinds := []string{}
+	for kind := range depCaches {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	return kinds
+}
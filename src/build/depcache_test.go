@@ -0,0 +1,93 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestCommandCache_Npm(t *testing.T) {
+	b, c := makeBuild(t, "", Config{})
+	cmd := NewCommand(ConfigCommand{
+		name: "cache",
+		args: []string{"npm", "/app"},
+	})
+
+	containerName := b.depCacheContainerName("npm", "/app")
+
+	c.On("EnsureContainer", containerName, mock.AnythingOfType("*docker.Config"), mock.AnythingOfType("*docker.HostConfig"), "/var/cache/rocker/npm").Return("123", nil).Once()
+	c.On("InspectContainer", containerName).Return(&docker.Container{
+		Name: "/" + containerName,
+		Mounts: []docker.Mount{
+			{
+				Source:      "/volumedir",
+				Destination: "/var/cache/rocker/npm",
+				RW:          true,
+			},
+		},
+	}, nil)
+
+	state, err := cmd.Execute(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.AssertExpectations(t)
+	assert.Equal(t, []string{"/volumedir:/var/cache/rocker/npm:rw"}, state.NoCache.HostConfig.Binds)
+	assert.Equal(t, "/var/cache/rocker/npm", state.NoCache.BuildArgs["npm_config_cache"])
+	assert.True(t, b.allowedBuildArgs["npm_config_cache"])
+	assert.Empty(t, state.Config.Env)
+	assert.Equal(t, fmt.Sprintf("CACHE npm %s:/var/cache/rocker/npm", containerName), state.GetCommits())
+}
+
+func TestCommandCache_Unknown(t *testing.T) {
+	b, _ := makeBuild(t, "", Config{})
+	cmd := NewCommand(ConfigCommand{
+		name: "cache",
+		args: []string{"cargo"},
+	})
+
+	_, err := cmd.Execute(b)
+	assert.EqualError(t, err, "Unknown CACHE type cargo, supported types are: go-build, go-mod, maven, npm, pip, yarn")
+}
+
+func TestCommandCache_RelativeProject(t *testing.T) {
+	b, _ := makeBuild(t, "", Config{})
+	cmd := NewCommand(ConfigCommand{
+		name: "cache",
+		args: []string{"pip", "app"},
+	})
+
+	_, err := cmd.Execute(b)
+	assert.EqualError(t, err, "Invalid CACHE project path: 'app', it must be absolute")
+}
+
+func TestDepCacheContainerName(t *testing.T) {
+	b, _ := makeBuild(t, "", Config{})
+
+	assert.Regexp(t, "^rocker_cache_npm_[0-9a-f]{12}$", b.depCacheContainerName("npm", ""))
+	assert.NotEqual(t, b.depCacheContainerName("npm", "/app"), b.depCacheContainerName("npm", "/admin"))
+	assert.NotEqual(t, b.depCacheContainerName("npm", ""), b.depCacheContainerName("yarn", ""))
+
+	other, _ := makeBuild(t, "", Config{ID: "other-project"})
+	assert.NotEqual(t, b.depCacheContainerName("npm", ""), other.depCacheContainerName("npm", ""))
+}
@@ -0,0 +1,74 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"fmt"
+
+	"github.com/docker/docker/pkg/units"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// checkDiskSpace fails the build before the step if the docker host has less
+// free space than Config.MinFreeSpace, rather than letting a container die
+// with ENOSPC half way; the low-disk-space hook gets a chance to clean up first
+func (b *Build) checkDiskSpace(step int) error {
+	if b.cfg.MinFreeSpace <= 0 || b.diskSpaceUnknown {
+		return nil
+	}
+
+	free, err := b.client.FreeDiskSpace()
+	if err != nil {
+		return fmt.Errorf("Failed to check free disk space of the docker host, error: %s", err)
+	}
+	if free < 0 {
+		log.Warnf("| Cannot tell free disk space of the docker host, the check is disabled")
+		b.diskSpaceUnknown = true
+		return nil
+	}
+	if free >= b.cfg.MinFreeSpace {
+		return nil
+	}
+
+	if script, ok := b.cfg.Hooks[LowDiskSpaceHook]; ok {
+		log.Warnf("| Low disk space on the docker host: %s available, %s required",
+			units.HumanSize(float64(free)), units.HumanSize(float64(b.cfg.MinFreeSpace)))
+
+		env := []string{
+			"ROCKER_HOOK=" + LowDiskSpaceHook,
+			"ROCKER_BUILD_ID=" + b.cfg.ID,
+			"ROCKER_CONTEXT_DIR=" + b.cfg.ContextDir,
+			fmt.Sprintf("ROCKER_STEP=%d", step),
+			fmt.Sprintf("ROCKER_FREE_SPACE=%d", free),
+			fmt.Sprintf("ROCKER_MIN_FREE_SPACE=%d", b.cfg.MinFreeSpace),
+		}
+		if err := b.execHook(LowDiskSpaceHook, script, env); err != nil {
+			return err
+		}
+
+		if free, err = b.client.FreeDiskSpace(); err != nil {
+			return fmt.Errorf("Failed to check free disk space of the docker host, error: %s", err)
+		}
+		if free >= b.cfg.MinFreeSpace {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("Not enough free disk space on the docker host: %s available, %s required by --min-free-space; remove unused images and containers and restart the build",
+		units.HumanSize(float64(free)), units.HumanSize(float64(b.cfg.MinFreeSpace)))
+}
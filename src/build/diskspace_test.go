@@ -0,0 +1,77 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckDiskSpace_Disabled(t *testing.T) {
+	b, c := makeBuild(t, "", Config{})
+
+	assert.Nil(t, b.checkDiskSpace(1))
+	c.AssertExpectations(t)
+}
+
+func TestCheckDiskSpace_Enough(t *testing.T) {
+	b, c := makeBuild(t, "", Config{MinFreeSpace: 1000})
+
+	c.On("FreeDiskSpace").Return(int64(1000), nil).Once()
+
+	assert.Nil(t, b.checkDiskSpace(1))
+	c.AssertExpectations(t)
+}
+
+func TestCheckDiskSpace_Unknown(t *testing.T) {
+	b, c := makeBuild(t, "", Config{MinFreeSpace: 1000})
+
+	c.On("FreeDiskSpace").Return(int64(-1), nil).Once()
+
+	assert.Nil(t, b.checkDiskSpace(1))
+	// the check is not repeated once the free space is known to be unknown
+	assert.Nil(t, b.checkDiskSpace(2))
+	c.AssertExpectations(t)
+}
+
+func TestCheckDiskSpace_NotEnough(t *testing.T) {
+	b, c := makeBuild(t, "", Config{MinFreeSpace: 2000000})
+
+	c.On("FreeDiskSpace").Return(int64(1000000), nil).Once()
+
+	assert.EqualError(t, b.checkDiskSpace(1), "Not enough free disk space on the docker host: 1 MB available, 2 MB required by --min-free-space; remove unused images and containers and restart the build")
+	c.AssertExpectations(t)
+}
+
+func TestCheckDiskSpace_Hook(t *testing.T) {
+	b, c := makeBuild(t, "", Config{
+		MinFreeSpace: 2000,
+		Hooks:        Hooks{LowDiskSpaceHook: `test "$ROCKER_FREE_SPACE" = 1000 && test "$ROCKER_MIN_FREE_SPACE" = 2000`},
+	})
+
+	c.On("FreeDiskSpace").Return(int64(1000), nil).Once()
+	c.On("FreeDiskSpace").Return(int64(3000), nil).Once()
+
+	assert.Nil(t, b.checkDiskSpace(1))
+	c.AssertExpectations(t)
+}
+
+func TestHooks_ValidateLowDiskSpace(t *testing.T) {
+	assert.Nil(t, Hooks{LowDiskSpaceHook: "docker image prune -f"}.Validate())
+	assert.EqualError(t, Hooks{LowDiskSpaceHook: " "}.Validate(), "hook low-disk-space has empty command")
+}
@@ -0,0 +1,97 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package build
+
+import (
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// The values of the event field of the build and step records of the JSON logs
+const (
+	EventBuildStart = "build_start"
+	EventBuildEnd   = "build_end"
+	EventStepStart  = "step_start"
+	EventStepEnd    = "step_end"
+)
+
+// logBuildStart logs the record of the build start in the JSON mode;
+// rockerfile_hash identifies the Rockerfile the way it was rendered
+func (b *Build) logBuildStart() {
+	fields := log.Fields{
+		"event":   EventBuildStart,
+		"started": b.started.Format(time.RFC3339Nano),
+	}
+	if b.rockerfile != nil {
+		fields["rockerfile"] = b.rockerfile.Name
+		fields["rockerfile_hash"] = b.rockerfile.Hash()
+	}
+	log.WithFields(fields).Infof("Build started")
+}
+
+// logBuildEnd logs the record of the build end in the JSON mode, the duration
+// is in seconds by the monotonic clock, so it does not jump with the wall clock
+func (b *Build) logBuildEnd(err error) {
+	fields := log.Fields{
+		"event":    EventBuildEnd,
+		"started":  b.started.Format(time.RFC3339Nano),
+		"ended":    time.Now().Format(time.RFC3339Nano),
+		"duration": time.Since(b.started).Seconds(),
+		"image_id": b.state.ImageID,
+		"steps":    b.CacheStats.Steps,
+	}
+	if b.rockerfile != nil {
+		fields["rockerfile"] = b.rockerfile.Name
+		fields["rockerfile_hash"] = b.rockerfile.Hash()
+	}
+	if err != nil {
+		fields["error"] = err.Error()
+		log.WithFields(fields).Infof("Build failed")
+		return
+	}
+	log.WithFields(fields).Infof("Build finished")
+}
+
+// logStepEvent logs the record of the step start or end in the JSON mode
+func logStepEvent(e StepEvent) {
+	fields := log.Fields{
+		"event":   EventStepStart,
+		"step":    e.Step,
+		"command": e.Command,
+	}
+	if !e.Done {
+		log.WithFields(fields).Infof("Step %d started", e.Step)
+		return
+	}
+
+	fields["event"] = EventStepEnd
+	fields["duration"] = e.Duration.Seconds()
+	fields["cached"] = e.Cached
+	if e.ImageID != "" {
+		fields["image_id"] = e.ImageID
+	}
+	if e.CommitDuration > 0 {
+		fields["commit_duration"] = e.CommitDuration.Seconds()
+	}
+	if e.Error != "" {
+		fields["error"] = e.Error
+	}
+	if e.Exit != nil {
+		fields["exit"] = e.Exit
+	}
+	log.WithFields(fields).Infof("Step %d finished", e.Step)
+}
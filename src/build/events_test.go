@@ -0,0 +1,76 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package build
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/grammarly/rocker/src/textformatter"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBuild_Run_JSONEvents(t *testing.T) {
+	var buf bytes.Buffer
+	logger := log.StandardLogger()
+	defer func(formatter log.Formatter) {
+		logger.Formatter = formatter
+		log.SetOutput(os.Stdout)
+	}(logger.Formatter)
+	logger.Formatter = textformatter.NewJSONFormatter()
+	log.SetOutput(&buf)
+
+	b, _ := makeBuild(t, "FROM scratch", Config{LogJSON: true})
+	plan, err := NewPlan(b.rockerfile.Commands(), true, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.Run(plan); err != nil {
+		t.Fatal(err)
+	}
+
+	events := []map[string]interface{}{}
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		entry := map[string]interface{}{}
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("%s: %s", err, line)
+		}
+		assert.Contains(t, entry, "elapsed", line)
+		assert.Contains(t, entry, "time", line)
+		if _, ok := entry["event"]; ok {
+			events = append(events, entry)
+		}
+	}
+
+	// FROM and the implicit cleanup step
+	if assert.Len(t, events, 6) {
+		assert.Equal(t, EventBuildStart, events[0]["event"])
+		assert.Equal(t, b.rockerfile.Hash(), events[0]["rockerfile_hash"])
+		assert.Equal(t, EventStepStart, events[1]["event"])
+		assert.Equal(t, "FROM scratch", events[1]["command"])
+		assert.Equal(t, EventStepEnd, events[2]["event"])
+		assert.Contains(t, events[2], "duration")
+		assert.Equal(t, EventBuildEnd, events[5]["event"])
+		assert.Equal(t, b.rockerfile.Hash(), events[5]["rockerfile_hash"])
+		assert.NotContains(t, events[5], "error")
+	}
+}
@@ -0,0 +1,79 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/grammarly/rocker/src/util"
+)
+
+// exportExcludes returns the rsync patterns of EXPORT and IMPORT that
+// are not copied: the ones of --exclude, which is a comma separated list
+// and may be given several times, followed by the lines of the
+// --exclude-from file of the context
+func exportExcludes(b *Build, flags map[string]string) ([]string, error) {
+	excludes := splitFlagList(flags["exclude"])
+
+	fileName, ok := flags["exclude-from"]
+	if !ok {
+		return excludes, nil
+	}
+	if fileName == "" {
+		return nil, fmt.Errorf("--exclude-from requires a file name")
+	}
+
+	path, err := util.ResolvePath(b.cfg.ContextDir, filepath.ToSlash(fileName))
+	if err != nil {
+		return nil, fmt.Errorf("--exclude-from %s should be within the context", fileName)
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read --exclude-from file %s, error: %s", fileName, err)
+	}
+
+	return append(excludes, parseExcludeFile(data)...), nil
+}
+
+// parseExcludeFile returns the patterns of the exclude file, one per line;
+// the empty lines and the comments starting with # are skipped, as by rsync
+func parseExcludeFile(data []byte) (patterns []string) {
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		patterns = append(patterns, line)
+	}
+	return patterns
+}
+
+// rsyncExcludeArgs turns the patterns to the rsync arguments
+func rsyncExcludeArgs(excludes []string) []string {
+	args := make([]string, len(excludes))
+	for i, pattern := range excludes {
+		args[i] = "--exclude=" + pattern
+	}
+	return args
+}
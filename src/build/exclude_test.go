@@ -0,0 +1,88 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/grammarly/rocker/src/template"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestExportExcludes(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "rocker-exclude")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	content := "# objects\n*.o\n\n  tmp/  \n"
+	if err := ioutil.WriteFile(filepath.Join(tmpDir, ".exportignore"), []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	b, _ := makeBuild(t, "", Config{ContextDir: tmpDir})
+
+	excludes, err := exportExcludes(b, map[string]string{"exclude": "*.a,*.so", "exclude-from": ".exportignore"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []string{"*.a", "*.so", "*.o", "tmp/"}, excludes)
+	assert.Equal(t, []string{"--exclude=*.a", "--exclude=*.so"}, rsyncExcludeArgs(excludes[:2]))
+
+	_, err = exportExcludes(b, map[string]string{"exclude-from": "../.exportignore"})
+	assert.EqualError(t, err, "--exclude-from ../.exportignore should be within the context")
+
+	_, err = exportExcludes(b, map[string]string{"exclude-from": "missing"})
+	assert.Contains(t, err.Error(), "Failed to read --exclude-from file missing")
+}
+
+func TestCommandExport_Exclude(t *testing.T) {
+	r, err := NewRockerfile("test", strings.NewReader("FROM scratch\nEXPORT --exclude=*.o --exclude=*.a /src/ /\n"), template.Vars{}, template.Funs{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := r.Commands()[1]
+	assert.Equal(t, "*.o,*.a", cfg.flags["exclude"])
+
+	b, c := makeBuild(t, "", Config{})
+	b.state.ImageID = "123"
+
+	exports := &docker.Container{ID: "456", Mounts: []docker.Mount{{Source: "/exports", Destination: ExportsPath}}}
+	c.On("EnsureContainer", mock.Anything, mock.Anything, mock.Anything, "exports").Return("456", nil).Once()
+	c.On("InspectContainer", "456").Return(exports, nil).Once()
+	c.On("CreateContainer", mock.AnythingOfType("State")).Return("789", nil).Run(func(args mock.Arguments) {
+		state := args.Get(0).(State)
+		assert.Equal(t, []string{"/opt/rsync/bin/rsync", "-a", "--delete-during",
+			"--exclude=*.o", "--exclude=*.a", "/src/", ExportsPath + "/"}, state.Config.Cmd)
+		assert.Contains(t, state.GetCommits(), `EXPORT ["/src/"] to / excluding ["*.o" "*.a"]`)
+	}).Once()
+	c.On("RunContainer", "789", false).Return(nil).Once()
+	c.On("RemoveContainer", "789").Return(nil).Once()
+
+	if _, err := NewCommand(cfg).Execute(b); err != nil {
+		t.Fatal(err)
+	}
+	c.AssertExpectations(t)
+}
@@ -0,0 +1,191 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/fsouza/go-dockerclient"
+)
+
+// exitOutputLines is how many of the last lines of the container output
+// are kept for the ContainerExitError
+var exitOutputLines = 20
+
+// exitOutputLineBytes limits a kept line, the rest of it is dropped
+const exitOutputLineBytes = 1024
+
+// signalNames are the signals that usually end the build containers, the
+// exit code of a container killed by a signal is 128 + the signal number
+var signalNames = map[int]string{
+	1:  "SIGHUP",
+	2:  "SIGINT",
+	3:  "SIGQUIT",
+	4:  "SIGILL",
+	6:  "SIGABRT",
+	7:  "SIGBUS",
+	8:  "SIGFPE",
+	9:  "SIGKILL",
+	11: "SIGSEGV",
+	13: "SIGPIPE",
+	15: "SIGTERM",
+}
+
+// ContainerExit describes how the container of a step has exited, along
+// with the last lines of its output and the configs it was run with; the
+// values of the secret-looking env vars are masked
+type ContainerExit struct {
+	Container  string             `json:"container"`
+	ExitCode   int                `json:"exit_code"`
+	OOMKilled  bool               `json:"oom_killed,omitempty"`
+	Signal     string             `json:"signal,omitempty"`
+	State      *docker.State      `json:"state,omitempty"`
+	Output     []string           `json:"output,omitempty"`
+	Config     *docker.Config     `json:"config,omitempty"`
+	HostConfig *docker.HostConfig `json:"host_config,omitempty"`
+}
+
+// ContainerExitError is returned when the container of a step exits with
+// a non-zero code; Location is the Rockerfile line of the step, if known
+type ContainerExitError struct {
+	ContainerExit
+	Location string
+}
+
+// Error returns the error message, e.g.
+// Container 0a1b2c3d4e5f exited with code 137 (SIGKILL, out of memory)
+func (e *ContainerExitError) Error() string {
+	msg := fmt.Sprintf("Container %.12s exited with code %d", e.Container, e.ExitCode)
+
+	details := []string{}
+	if e.Signal != "" {
+		details = append(details, e.Signal)
+	}
+	if e.OOMKilled {
+		details = append(details, "out of memory")
+	}
+	if len(details) > 0 {
+		msg += " (" + strings.Join(details, ", ") + ")"
+	}
+
+	if e.Location != "" {
+		msg = e.Location + ": " + msg
+	}
+	return msg
+}
+
+// newContainerExitError describes the exited container by its inspect,
+// which may be nil if the container could not be inspected
+func newContainerExitError(containerID string, exitCode int, container *docker.Container, output []string) *ContainerExitError {
+	e := &ContainerExitError{ContainerExit: ContainerExit{
+		Container: containerID,
+		ExitCode:  exitCode,
+		Output:    output,
+	}}
+
+	if exitCode > 128 {
+		if name, ok := signalNames[exitCode-128]; ok {
+			e.Signal = name
+		} else {
+			e.Signal = fmt.Sprintf("signal %d", exitCode-128)
+		}
+	}
+
+	if container == nil {
+		return e
+	}
+
+	state := container.State
+	e.State = &state
+	e.OOMKilled = state.OOMKilled
+
+	if container.Config != nil {
+		config := *container.Config
+		config.Env = maskSecretEnv(config.Env)
+		e.Config = &config
+	}
+	e.HostConfig = container.HostConfig
+
+	return e
+}
+
+// maskSecretEnv masks the values of the env vars that look like secrets
+func maskSecretEnv(env []string) []string {
+	result := make([]string, len(env))
+	for i, kv := range env {
+		result[i] = kv
+		if pair := strings.SplitN(kv, "=", 2); len(pair) == 2 && IsSecretName(pair[0]) {
+			result[i] = pair[0] + "=****"
+		}
+	}
+	return result
+}
+
+// tailWriter keeps the last lines written to it, the stdout and the
+// stderr of a container may be written concurrently
+type tailWriter struct {
+	mu      sync.Mutex
+	max     int
+	lines   []string
+	partial []byte
+}
+
+func newTailWriter(max int) *tailWriter {
+	return &tailWriter{max: max}
+}
+
+// Write implements io.Writer
+func (w *tailWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for _, c := range p {
+		if c == '\n' {
+			w.add(string(w.partial))
+			w.partial = w.partial[:0]
+			continue
+		}
+		if len(w.partial) < exitOutputLineBytes {
+			w.partial = append(w.partial, c)
+		}
+	}
+	return len(p), nil
+}
+
+// Lines returns the kept lines, including the unfinished last one
+func (w *tailWriter) Lines() []string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	lines := append([]string{}, w.lines...)
+	if len(w.partial) > 0 {
+		lines = append(lines, string(w.partial))
+		if len(lines) > w.max {
+			lines = lines[1:]
+		}
+	}
+	return lines
+}
+
+func (w *tailWriter) add(line string) {
+	w.lines = append(w.lines, line)
+	if len(w.lines) > w.max {
+		w.lines = w.lines[1:]
+	}
+}
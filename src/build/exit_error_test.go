@@ -0,0 +1,74 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestContainerExitError_OOMKilled(t *testing.T) {
+	container := &docker.Container{
+		State: docker.State{ExitCode: 137, OOMKilled: true},
+		Config: &docker.Config{
+			Env: []string{"PATH=/bin", "NPM_TOKEN=abc", "BROKEN"},
+		},
+		HostConfig: &docker.HostConfig{Memory: 1024},
+	}
+
+	err := newContainerExitError("0123456789abcdef", 137, container, []string{"Killed"})
+	assert.EqualError(t, err, "Container 0123456789ab exited with code 137 (SIGKILL, out of memory)")
+	assert.True(t, err.OOMKilled)
+	assert.Equal(t, []string{"Killed"}, err.Output)
+	assert.Equal(t, []string{"PATH=/bin", "NPM_TOKEN=****", "BROKEN"}, err.Config.Env)
+	assert.Equal(t, "NPM_TOKEN=abc", container.Config.Env[1], "should not change the inspect")
+	assert.EqualValues(t, 1024, err.HostConfig.Memory)
+
+	err.Location = "Rockerfile:3"
+	assert.EqualError(t, err, "Rockerfile:3: Container 0123456789ab exited with code 137 (SIGKILL, out of memory)")
+}
+
+func TestContainerExitError_NoInspect(t *testing.T) {
+	assert.EqualError(t, newContainerExitError("456", 1, nil, nil), "Container 456 exited with code 1")
+	assert.EqualError(t, newContainerExitError("456", 159, nil, nil), "Container 456 exited with code 159 (signal 31)")
+}
+
+func TestBuild_StepError_ContainerExit(t *testing.T) {
+	b, _ := makeBuild(t, "FROM ubuntu\nRUN false", Config{})
+	command := &CommandRun{CommandBase{ConfigCommand{name: "run", line: 2}}}
+
+	err := b.stepError(command, newContainerExitError("456", 1, nil, nil))
+	exit, ok := err.(*ContainerExitError)
+	if !ok {
+		t.Fatalf("expected ContainerExitError, got %T", err)
+	}
+	assert.Equal(t, 1, exit.ExitCode)
+	assert.EqualError(t, err, fmt.Sprintf("%s:2: Container 456 exited with code 1", b.rockerfile.Name))
+}
+
+func TestTailWriter(t *testing.T) {
+	w := newTailWriter(2)
+	fmt.Fprint(w, "one\ntwo\nth")
+	fmt.Fprint(w, "ree\nfour")
+	assert.Equal(t, []string{"three", "four"}, w.Lines())
+
+	fmt.Fprint(w, "\n")
+	assert.Equal(t, []string{"three", "four"}, w.Lines())
+}
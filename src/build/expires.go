@@ -0,0 +1,104 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/grammarly/rocker/src/imagename"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// parseExpires parses the lifetime given by PUSH --expires; the days and the
+// weeks are allowed along with the units of time.ParseDuration, e.g. 30d or 2w
+func parseExpires(value string) (ttl time.Duration, err error) {
+	units := map[string]time.Duration{"d": 24 * time.Hour, "w": 7 * 24 * time.Hour}
+
+	if unit, ok := units[value[len(value)-1:]]; ok && len(value) > 1 {
+		n, err := strconv.Atoi(value[:len(value)-1])
+		if err != nil {
+			return 0, fmt.Errorf("PUSH --expires: invalid lifetime %q, e.g. 30d, 2w or 12h", value)
+		}
+		ttl = time.Duration(n) * unit
+	} else if ttl, err = time.ParseDuration(value); err != nil {
+		return 0, fmt.Errorf("PUSH --expires: invalid lifetime %q, e.g. 30d, 2w or 12h", value)
+	}
+
+	if ttl <= 0 {
+		return 0, fmt.Errorf("PUSH --expires: the lifetime must be positive, got %q", value)
+	}
+	return ttl, nil
+}
+
+// expiringImage makes the image to push: with --expires, the current image
+// with imagename.ExpiresLabel committed on top of it; without the flag, the
+// label inherited from the FROM image is set empty, since docker keeps the
+// labels of the parent image that are removed from the config, and the empty
+// one means the image never expires. Either commit clears the intermediate label, otherwise
+// the image is the publishableImage. The build goes on with the image it had,
+// so the label does not leak to the next PUSH
+func (b *Build) expiringImage(flags map[string]string, now time.Time) (imageID string, expires *time.Time, err error) {
+	value, hasExpires := flags["expires"]
+	labeled := b.state.Config.Labels[imagename.ExpiresLabel] != ""
+	if !hasExpires && !labeled {
+		imageID, err = b.publishableImage()
+		return imageID, nil, err
+	}
+
+	labels := map[string]string{}
+	for k, v := range b.state.Config.Labels {
+		labels[k] = v
+	}
+	labels[imagename.ExpiresLabel] = ""
+
+	if hasExpires {
+		if strings.TrimSpace(value) == "" {
+			return "", nil, fmt.Errorf("PUSH --expires requires the lifetime of the image, e.g. --expires=30d")
+		}
+		ttl, err := parseExpires(strings.TrimSpace(value))
+		if err != nil {
+			return "", nil, err
+		}
+		t := now.Add(ttl).UTC().Truncate(time.Second)
+		expires = &t
+		labels[imagename.ExpiresLabel] = t.Format(time.RFC3339)
+	}
+
+	saved := b.state
+	defer func() { b.state = saved }()
+
+	s := b.state
+	s.Config.Labels = labels
+	s.NoCache.Publish = true
+	if expires != nil {
+		log.Infof("| Expires at %s", labels[imagename.ExpiresLabel])
+		s.Commit("LABEL %s=%s", imagename.ExpiresLabel, labels[imagename.ExpiresLabel])
+	} else {
+		log.Infof("| Clear %s label of the base image", imagename.ExpiresLabel)
+		s.Commit("LABEL %s=", imagename.ExpiresLabel)
+	}
+
+	b.state = s
+	if s, err = (&CommandCommit{}).Execute(b); err != nil {
+		return "", nil, err
+	}
+	return s.ImageID, expires, nil
+}
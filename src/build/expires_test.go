@@ -0,0 +1,133 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"testing"
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/grammarly/rocker/src/imagename"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestParseExpires(t *testing.T) {
+	tests := map[string]time.Duration{
+		"30d": 30 * 24 * time.Hour,
+		"2w":  14 * 24 * time.Hour,
+		"12h": 12 * time.Hour,
+	}
+	for value, expected := range tests {
+		ttl, err := parseExpires(value)
+		assert.NoError(t, err, value)
+		assert.Equal(t, expected, ttl, value)
+	}
+
+	for _, value := range []string{"d", "xd", "soon", "0d", "-1h"} {
+		_, err := parseExpires(value)
+		assert.Error(t, err, value)
+	}
+}
+
+func TestCommandPush_Expires(t *testing.T) {
+	b, c := makeBuild(t, "FROM ubuntu\nPUSH --expires=30d app:branch\n", Config{})
+	b.state.ImageID = "123"
+	b.state.Config.Labels = map[string]string{"team": "web"}
+
+	var committed State
+	c.On("CreateContainer", mock.AnythingOfType("State")).Return("456", nil).Once()
+	c.On("CommitContainer", mock.AnythingOfType("State")).Run(func(args mock.Arguments) {
+		committed = args.Get(0).(State)
+	}).Return(&docker.Image{ID: "789"}, nil).Once()
+	c.On("RemoveContainer", "456").Return(nil).Once()
+	c.On("TagImage", "789", "app:branch").Return(nil).Once()
+
+	started := time.Now()
+	s, err := NewCommand(b.rockerfile.Commands()[1]).Execute(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.AssertExpectations(t)
+
+	// The build goes on with the image without the label
+	assert.Equal(t, "123", s.ImageID)
+	assert.Equal(t, map[string]string{"team": "web"}, s.Config.Labels)
+
+	expires, err := time.Parse(time.RFC3339, committed.Config.Labels[imagename.ExpiresLabel])
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.WithinDuration(t, started.Add(30*24*time.Hour), expires, 2*time.Second)
+	assert.Equal(t, "web", committed.Config.Labels["team"])
+
+	assert.Len(t, b.Artifacts, 1)
+	assert.Equal(t, "789", b.Artifacts[0].ImageID)
+	assert.Equal(t, expires, *b.Artifacts[0].Expires)
+}
+
+func TestCommandPush_RemoveInheritedExpires(t *testing.T) {
+	b, c := makeBuild(t, "FROM ubuntu\nPUSH app:1.0\n", Config{})
+	b.state.ImageID = "123"
+	b.state.Config.Labels = map[string]string{imagename.ExpiresLabel: "2026-11-14T10:00:00Z"}
+
+	var committed State
+	c.On("CreateContainer", mock.AnythingOfType("State")).Return("456", nil).Once()
+	c.On("CommitContainer", mock.AnythingOfType("State")).Run(func(args mock.Arguments) {
+		committed = args.Get(0).(State)
+	}).Return(&docker.Image{ID: "789"}, nil).Once()
+	c.On("RemoveContainer", "456").Return(nil).Once()
+	c.On("TagImage", "789", "app:1.0").Return(nil).Once()
+
+	if _, err := NewCommand(b.rockerfile.Commands()[1]).Execute(b); err != nil {
+		t.Fatal(err)
+	}
+	c.AssertExpectations(t)
+
+	// docker keeps the removed labels of the parent image, so it is set empty
+	assert.Equal(t, "", committed.Config.Labels[imagename.ExpiresLabel])
+	assert.Contains(t, committed.Config.Labels, imagename.ExpiresLabel)
+	assert.Nil(t, b.Artifacts[0].Expires)
+}
+
+func TestCommandPush_EmptyInheritedExpires(t *testing.T) {
+	b, c := makeBuild(t, "FROM ubuntu\nPUSH app:1.0\n", Config{})
+	b.state.ImageID = "123"
+	b.state.Config.Labels = map[string]string{imagename.ExpiresLabel: ""}
+
+	c.On("InspectImage", "123").Return(&docker.Image{ID: "123", Config: &docker.Config{}}, nil).Once()
+	c.On("TagImage", "123", "app:1.0").Return(nil).Once()
+
+	if _, err := NewCommand(b.rockerfile.Commands()[1]).Execute(b); err != nil {
+		t.Fatal(err)
+	}
+	c.AssertExpectations(t)
+	assert.Nil(t, b.Artifacts[0].Expires)
+}
+
+func TestCommandPush_NoExpires(t *testing.T) {
+	b, c := makeBuild(t, "FROM ubuntu\nPUSH app:1.0\n", Config{})
+	b.state.ImageID = "123"
+
+	c.On("InspectImage", "123").Return(&docker.Image{ID: "123", Config: &docker.Config{}}, nil).Once()
+	c.On("TagImage", "123", "app:1.0").Return(nil).Once()
+
+	if _, err := NewCommand(b.rockerfile.Commands()[1]).Execute(b); err != nil {
+		t.Fatal(err)
+	}
+	c.AssertExpectations(t)
+}
@@ -0,0 +1,63 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"fmt"
+
+	"github.com/grammarly/rocker/src/imagename"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// snapshotFailure commits the container of the failed step to the image
+// given by Config.SnapshotOnFailure, so the failure can be reproduced later
+// with docker run. The image has the config of the state before the step,
+// i.e. the last good state plus the files changed by the failed container.
+// The errors are only logged, they should not hide the error of the step.
+func (b *Build) snapshotFailure(s State, containerID string) {
+	if b.cfg.SnapshotOnFailure == "" || containerID == "" {
+		return
+	}
+
+	name := failureSnapshotName(b.cfg.SnapshotOnFailure, containerID)
+
+	s.NoCache.ContainerID = containerID
+	img, err := b.client.CommitContainer(&s)
+	if err != nil {
+		log.Errorf("| Failed to snapshot the failed container %.12s, error: %s", containerID, err)
+		return
+	}
+	if err := b.client.TagImage(img.ID, name); err != nil {
+		log.Errorf("| Failed to tag the failure snapshot %.12s as %s, error: %s", img.ID, name, err)
+		return
+	}
+
+	b.FailureSnapshot = name
+
+	log.Infof("| Saved the failed container as %s, inspect it with: docker run -ti --rm %s", name, name)
+}
+
+// failureSnapshotName returns the image name of the failure snapshot,
+// the name without a tag gets debug-<container id> one
+func failureSnapshotName(name, containerID string) string {
+	img := imagename.NewFromString(name)
+	if !img.HasTag() {
+		img.SetTag(fmt.Sprintf("debug-%.12s", containerID))
+	}
+	return img.String()
+}
@@ -0,0 +1,79 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestFailureSnapshotName(t *testing.T) {
+	assert.Equal(t, "repo/app:debug-123", failureSnapshotName("repo/app:debug-123", "456"))
+	assert.Equal(t, "repo/app:debug-4567890abcde", failureSnapshotName("repo/app", "4567890abcdef0123"))
+}
+
+func TestCommandRun_SnapshotOnFailure(t *testing.T) {
+	b, c := makeBuild(t, "", Config{SnapshotOnFailure: "repo/app:debug-1"})
+	cmd := NewCommand(ConfigCommand{
+		name: "run",
+		args: []string{"make"},
+	})
+
+	b.state.Config.Cmd = []string{"/bin/program"}
+	b.state.ImageID = "123"
+
+	c.On("CreateContainer", mock.AnythingOfType("State")).Return("456", nil).Once()
+	c.On("RunContainer", "456", false).Return(fmt.Errorf("exit code 2")).Once()
+	c.On("CommitContainer", mock.AnythingOfType("State")).Return(&docker.Image{ID: "789"}, nil).Run(func(args mock.Arguments) {
+		arg := args.Get(0).(State)
+		assert.Equal(t, "456", arg.NoCache.ContainerID)
+		assert.Equal(t, []string{"/bin/program"}, arg.Config.Cmd, "the snapshot should have the config before the step")
+	}).Once()
+	c.On("TagImage", "789", "repo/app:debug-1").Return(nil).Once()
+	c.On("RemoveContainer", "456").Return(nil).Once()
+
+	_, err := cmd.Execute(b)
+	assert.EqualError(t, err, "exit code 2")
+
+	c.AssertExpectations(t)
+	assert.Equal(t, "repo/app:debug-1", b.FailureSnapshot)
+}
+
+func TestCommandRun_SnapshotOnFailureError(t *testing.T) {
+	b, c := makeBuild(t, "", Config{SnapshotOnFailure: "repo/app"})
+	cmd := NewCommand(ConfigCommand{
+		name: "run",
+		args: []string{"make"},
+	})
+
+	b.state.ImageID = "123"
+
+	c.On("CreateContainer", mock.AnythingOfType("State")).Return("456", nil).Once()
+	c.On("RunContainer", "456", false).Return(fmt.Errorf("exit code 2")).Once()
+	c.On("CommitContainer", mock.AnythingOfType("State")).Return((*docker.Image)(nil), fmt.Errorf("no space left")).Once()
+	c.On("RemoveContainer", "456").Return(nil).Once()
+
+	_, err := cmd.Execute(b)
+	assert.EqualError(t, err, "exit code 2", "the error of the step should be returned")
+
+	c.AssertExpectations(t)
+	assert.Equal(t, "", b.FailureSnapshot)
+}
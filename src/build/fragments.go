@@ -0,0 +1,312 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/go-yaml/yaml"
+	"github.com/grammarly/rocker/src/git"
+	"github.com/grammarly/rocker/src/parser"
+	"github.com/grammarly/rocker/src/template"
+	"github.com/grammarly/rocker/src/util"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// maxFragmentDepth limits the nesting of USE instructions within fragments
+const maxFragmentDepth = 10
+
+// FragmentRef is the parsed argument of USE, e.g.
+// github.com/org/rocker-lib//golang@v1.2
+type FragmentRef struct {
+	Repo string
+	Path string
+	Ref  string
+}
+
+// ParseFragmentRef parses the USE argument; the repository is separated
+// from the fragment path within it by //, the optional git ref follows @
+func ParseFragmentRef(s string) (ref FragmentRef, err error) {
+	scheme, rest := "", s
+	if i := strings.Index(rest, "://"); i >= 0 {
+		scheme, rest = rest[:i+3], rest[i+3:]
+	}
+
+	i := strings.Index(rest, "//")
+	if i <= 0 {
+		return ref, fmt.Errorf("Invalid fragment %q, expected <repo>//<path>[@<ref>]", s)
+	}
+
+	ref.Repo = scheme + rest[:i]
+	ref.Path = rest[i+2:]
+
+	if j := strings.LastIndex(ref.Path, "@"); j >= 0 {
+		ref.Path, ref.Ref = ref.Path[:j], ref.Path[j+1:]
+	}
+
+	if ref.Path = strings.Trim(ref.Path, "/"); ref.Path == "" {
+		return ref, fmt.Errorf("Invalid fragment %q, the path within the repository is empty", s)
+	}
+	for _, part := range strings.Split(ref.Path, "/") {
+		if part == ".." {
+			return ref, fmt.Errorf("Invalid fragment %q, the path points outside of the repository", s)
+		}
+	}
+
+	return ref, nil
+}
+
+// String returns the fragment reference as it is written in USE
+func (ref FragmentRef) String() string {
+	s := ref.Repo + "//" + ref.Path
+	if ref.Ref != "" {
+		s += "@" + ref.Ref
+	}
+	return s
+}
+
+// URL returns the git url of the fragment repository
+func (ref FragmentRef) URL() string {
+	if strings.Contains(ref.Repo, "://") || strings.Contains(ref.Repo, "@") {
+		return ref.Repo
+	}
+	return "https://" + ref.Repo
+}
+
+// FragmentLoader fetches the content of the fragment and the commit it was taken
+// from; the fragment is taken at the pinned commit if it is not empty
+type FragmentLoader interface {
+	Load(ref FragmentRef, pinned string) (content []byte, commit string, err error)
+}
+
+// Fragments is the loader used for USE instructions, can be replaced in tests
+var Fragments FragmentLoader = gitFragments{}
+
+// gitFragments loads the fragments out of shallow clones of git repositories
+type gitFragments struct{}
+
+// Load implements FragmentLoader
+func (gitFragments) Load(ref FragmentRef, pinned string) (content []byte, commit string, err error) {
+	dir, err := ioutil.TempDir(util.TempDir(), "rocker_fragment_")
+	if err != nil {
+		return nil, "", fmt.Errorf("Failed to create temp dir, error: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	if pinned != "" {
+		log.Infof("| Fetch fragment %s at %.12s", ref, pinned)
+		err = git.CloneCommit(ref.URL(), pinned, dir)
+	} else {
+		log.Infof("| Fetch fragment %s", ref)
+		err = git.Clone(ref.URL(), ref.Ref, dir)
+	}
+	if err != nil {
+		return nil, "", fmt.Errorf("Failed to clone %s, error: %s", ref.URL(), err)
+	}
+
+	info, err := git.Info(dir)
+	if err != nil {
+		return nil, "", err
+	}
+
+	// The path is either the fragment file or a directory with the Rockerfile
+	fileName := filepath.Join(dir, filepath.FromSlash(ref.Path))
+	if rel, err := filepath.Rel(dir, fileName); err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return nil, "", fmt.Errorf("Fragment %s is outside of the repository", ref)
+	}
+	if fi, err := os.Stat(fileName); err == nil && fi.IsDir() {
+		fileName = filepath.Join(fileName, "Rockerfile")
+	}
+
+	if content, err = ioutil.ReadFile(fileName); err != nil {
+		return nil, "", fmt.Errorf("Failed to read fragment %s, error: %s", ref, err)
+	}
+
+	return content, info.Sha, nil
+}
+
+// FragmentLock pins the commits of the fragments used by the Rockerfile,
+// it is stored next to it as <Rockerfile>.lock
+type FragmentLock struct {
+	Fragments map[string]string `yaml:"fragments"`
+
+	fileName string
+	changed  bool
+}
+
+// readFragmentLock reads the lock file, a missing file is an empty lock
+func readFragmentLock(fileName string) (*FragmentLock, error) {
+	lock := &FragmentLock{
+		Fragments: map[string]string{},
+		fileName:  fileName,
+	}
+
+	data, err := ioutil.ReadFile(fileName)
+	if os.IsNotExist(err) {
+		return lock, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read %s, error: %s", fileName, err)
+	}
+
+	if err := yaml.Unmarshal(data, lock); err != nil {
+		return nil, fmt.Errorf("Failed to parse %s, error: %s", fileName, err)
+	}
+	if lock.Fragments == nil {
+		lock.Fragments = map[string]string{}
+	}
+
+	return lock, nil
+}
+
+// check pins the commit of the fragment, or verifies that the fragment was
+// taken at the pinned one
+func (lock *FragmentLock) check(ref FragmentRef, commit string) error {
+	pinned, ok := lock.Fragments[ref.String()]
+	if !ok {
+		lock.Fragments[ref.String()] = commit
+		lock.changed = true
+		return nil
+	}
+	if pinned != commit {
+		return fmt.Errorf("Fragment %s was taken at commit %.12s, but %s pins %.12s",
+			ref, commit, filepath.Base(lock.fileName), pinned)
+	}
+	return nil
+}
+
+// save writes the lock file if new fragments were pinned
+func (lock *FragmentLock) save() error {
+	if !lock.changed {
+		return nil
+	}
+
+	// Make the file stable for diffs
+	keys := []string{}
+	for key := range lock.Fragments {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	buf := bytes.NewBufferString("fragments:\n")
+	for _, key := range keys {
+		fmt.Fprintf(buf, "  %q: %s\n", key, lock.Fragments[key])
+	}
+
+	if err := ioutil.WriteFile(lock.fileName, buf.Bytes(), 0644); err != nil {
+		return fmt.Errorf("Failed to write %s, error: %s", lock.fileName, err)
+	}
+
+	log.Infof("Pinned the fragments in %s", lock.fileName)
+
+	return nil
+}
+
+// resolveFragments replaces USE instructions with the instructions of the
+// fragments, rendered with the vars of the Rockerfile
+func (r *Rockerfile) resolveFragments() error {
+	if !hasUseNodes(r.rootNode.Children) {
+		return nil
+	}
+
+	lock, err := readFragmentLock(r.Name + ".lock")
+	if err != nil {
+		return err
+	}
+
+	if r.rootNode.Children, err = r.inlineFragments(r.rootNode.Children, lock, 0); err != nil {
+		return err
+	}
+
+	return lock.save()
+}
+
+func (r *Rockerfile) inlineFragments(nodes []*parser.Node, lock *FragmentLock, depth int) ([]*parser.Node, error) {
+	result := []*parser.Node{}
+
+	for i, node := range nodes {
+		if node.Value != "use" {
+			result = append(result, node)
+			continue
+		}
+
+		if depth >= maxFragmentDepth {
+			return nil, fmt.Errorf("Too deep nesting of USE fragments at %s", node.Original)
+		}
+		if i > 0 && isConditionNode(nodes[i-1]) {
+			return nil, fmt.Errorf("%s can not be applied to USE", nodes[i-1].Original)
+		}
+		if node.Next == nil || node.Next.Value == "" {
+			return nil, fmt.Errorf("USE requires the fragment, e.g. USE github.com/org/rocker-lib//golang@v1.2")
+		}
+
+		ref, err := ParseFragmentRef(node.Next.Value)
+		if err != nil {
+			return nil, err
+		}
+
+		source, commit, err := Fragments.Load(ref, lock.Fragments[ref.String()])
+		if err != nil {
+			return nil, err
+		}
+		if err := lock.check(ref, commit); err != nil {
+			return nil, err
+		}
+
+		r.fragmentSources = append(r.fragmentSources, string(source))
+
+		content, err := template.Process(ref.String(), bytes.NewReader(source), r.Vars, r.Funs)
+		if err != nil {
+			return nil, err
+		}
+
+		root, err := parser.Parse(content)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to parse fragment %s, error: %s", ref, err)
+		}
+
+		// the lines of the fragment are not the lines of the Rockerfile
+		for _, child := range root.Children {
+			child.StartLine, child.EndLine = 0, 0
+		}
+
+		children, err := r.inlineFragments(root.Children, lock, depth+1)
+		if err != nil {
+			return nil, err
+		}
+
+		result = append(result, children...)
+	}
+
+	return result, nil
+}
+
+func hasUseNodes(nodes []*parser.Node) bool {
+	for _, node := range nodes {
+		if node.Value == "use" {
+			return true
+		}
+	}
+	return false
+}
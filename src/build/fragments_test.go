@@ -0,0 +1,194 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/grammarly/rocker/src/template"
+	"github.com/stretchr/testify/assert"
+)
+
+type testFragments struct {
+	files   map[string]string
+	commits map[string]string
+
+	// pinned are the fragments at the commits, by <ref>#<commit>
+	pinned map[string]string
+}
+
+func (f testFragments) Load(ref FragmentRef, pinned string) ([]byte, string, error) {
+	if pinned != "" {
+		if content, ok := f.pinned[ref.String()+"#"+pinned]; ok {
+			return []byte(content), pinned, nil
+		}
+	}
+	content, ok := f.files[ref.String()]
+	if !ok {
+		return nil, "", fmt.Errorf("fragment %s not found", ref)
+	}
+	commit := f.commits[ref.String()]
+	if commit == "" {
+		commit = "1111111111111111111111111111111111111111"
+	}
+	return []byte(content), commit, nil
+}
+
+func withTestFragments(f testFragments) func() {
+	orig := Fragments
+	Fragments = f
+	return func() { Fragments = orig }
+}
+
+func TestParseFragmentRef(t *testing.T) {
+	tests := []struct {
+		in       string
+		expected FragmentRef
+		url      string
+	}{
+		{"github.com/org/rocker-lib//golang@v1.2", FragmentRef{"github.com/org/rocker-lib", "golang", "v1.2"}, "https://github.com/org/rocker-lib"},
+		{"github.com/org/rocker-lib//lang/node/", FragmentRef{"github.com/org/rocker-lib", "lang/node", ""}, "https://github.com/org/rocker-lib"},
+		{"https://git.example.com/lib.git//go@master", FragmentRef{"https://git.example.com/lib.git", "go", "master"}, "https://git.example.com/lib.git"},
+		{"git@github.com:org/lib.git//go", FragmentRef{"git@github.com:org/lib.git", "go", ""}, "git@github.com:org/lib.git"},
+	}
+
+	for _, test := range tests {
+		ref, err := ParseFragmentRef(test.in)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, test.expected, ref, test.in)
+		assert.Equal(t, test.url, ref.URL(), test.in)
+	}
+
+	_, err := ParseFragmentRef("github.com/org/rocker-lib")
+	assert.Error(t, err)
+	_, err = ParseFragmentRef("github.com/org/rocker-lib//@v1")
+	assert.Error(t, err)
+	_, err = ParseFragmentRef("github.com/org/rocker-lib//../../../etc/passwd")
+	assert.EqualError(t, err, "Invalid fragment \"github.com/org/rocker-lib//../../../etc/passwd\", the path points outside of the repository")
+	_, err = ParseFragmentRef("github.com/org/rocker-lib//lang/../../x@v1")
+	assert.Error(t, err)
+
+	// the names starting with dots are within the repository
+	ref, err := ParseFragmentRef("github.com/org/rocker-lib//..golang")
+	assert.Nil(t, err)
+	assert.Equal(t, "..golang", ref.Path)
+}
+
+func TestRockerfileUse(t *testing.T) {
+	defer withTestFragments(testFragments{
+		files: map[string]string{
+			"github.com/org/lib//golang@v1.2": "RUN go get {{ .Pkg }}\nUSE github.com/org/lib//base@v1.0",
+			"github.com/org/lib//base@v1.0":   "ENV CGO_ENABLED=0",
+		},
+	})()
+
+	dir, err := ioutil.TempDir("", "rocker-fragments-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	name := filepath.Join(dir, "Rockerfile")
+	src := "FROM golang\nUSE github.com/org/lib//golang@v1.2\nRUN make"
+
+	r, err := NewRockerfile(name, strings.NewReader(src), template.Vars{"Pkg": "foo"}, template.Funs{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	originals := []string{}
+	for _, cfg := range r.Commands() {
+		originals = append(originals, cfg.original)
+	}
+	assert.Equal(t, []string{"FROM golang", "RUN go get foo", "ENV CGO_ENABLED=0", "RUN make"}, originals)
+	assert.Empty(t, r.UnusedVars([]string{"Pkg"}))
+
+	lock, err := readFragmentLock(name + ".lock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, map[string]string{
+		"github.com/org/lib//golang@v1.2": "1111111111111111111111111111111111111111",
+		"github.com/org/lib//base@v1.0":   "1111111111111111111111111111111111111111",
+	}, lock.Fragments)
+}
+
+func TestRockerfileUse_Pinned(t *testing.T) {
+	defer withTestFragments(testFragments{
+		files:   map[string]string{"github.com/org/lib//golang@v1": "RUN make new"},
+		commits: map[string]string{"github.com/org/lib//golang@v1": "2222222222222222222222222222222222222222"},
+		pinned:  map[string]string{"github.com/org/lib//golang@v1#1111111111111111111111111111111111111111": "RUN make old"},
+	})()
+
+	dir, err := ioutil.TempDir("", "rocker-fragments-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	name := filepath.Join(dir, "Rockerfile")
+	lock := "fragments:\n  \"github.com/org/lib//golang@v1\": 1111111111111111111111111111111111111111\n"
+	if err := ioutil.WriteFile(name+".lock", []byte(lock), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// the tag has moved, the fragment is taken at the pinned commit
+	r, err := NewRockerfile(name, strings.NewReader("FROM golang\nUSE github.com/org/lib//golang@v1"), template.Vars{}, template.Funs{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "RUN make old", r.Commands()[1].original)
+}
+
+func TestRockerfileUse_LockMismatch(t *testing.T) {
+	defer withTestFragments(testFragments{
+		files:   map[string]string{"github.com/org/lib//golang@v1.2": "RUN make"},
+		commits: map[string]string{"github.com/org/lib//golang@v1.2": "2222222222222222222222222222222222222222"},
+	})()
+
+	dir, err := ioutil.TempDir("", "rocker-fragments-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	name := filepath.Join(dir, "Rockerfile")
+	lock := "fragments:\n  \"github.com/org/lib//golang@v1.2\": 1111111111111111111111111111111111111111\n"
+	if err := ioutil.WriteFile(name+".lock", []byte(lock), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// the loader did not take the fragment at the pinned commit
+	_, err = NewRockerfile(name, strings.NewReader("FROM golang\nUSE github.com/org/lib//golang@v1.2"), template.Vars{}, template.Funs{})
+	assert.EqualError(t, err, "Fragment github.com/org/lib//golang@v1.2 was taken at commit 222222222222, but Rockerfile.lock pins 111111111111")
+}
+
+func TestRockerfileUse_Condition(t *testing.T) {
+	defer withTestFragments(testFragments{
+		files: map[string]string{"github.com/org/lib//golang@v1.2": "RUN make"},
+	})()
+
+	_, err := NewRockerfile("test", strings.NewReader("FROM golang\nONLY IF .Dev\nUSE github.com/org/lib//golang@v1.2"), template.Vars{}, template.Funs{})
+	assert.EqualError(t, err, "ONLY IF .Dev can not be applied to USE")
+}
@@ -0,0 +1,79 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/grammarly/rocker/src/imagename"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/fsouza/go-dockerclient"
+)
+
+// overrideFrom replaces the image of the first FROM with Config.FromOverride,
+// so that the Rockerfile is applied on top of an already built image;
+// the policy and the lint see the replaced image
+func (b *Build) overrideFrom(plan Plan) error {
+	for _, command := range plan {
+		from, ok := command.(*CommandFrom)
+		if !ok {
+			continue
+		}
+		if len(from.cfg.args) != 1 {
+			return fmt.Errorf("FROM requires one argument")
+		}
+
+		original := from.cfg.args[0]
+
+		from.cfg.args = []string{b.cfg.FromOverride}
+		from.cfg.original = strings.Replace(from.cfg.original, original, b.cfg.FromOverride, 1)
+
+		b.overriddenFrom = from
+		b.overriddenFromName = original
+
+		log.Infof("FROM %s is overridden by %s", original, b.cfg.FromOverride)
+		return nil
+	}
+
+	return fmt.Errorf("Cannot override FROM, the Rockerfile has no FROM instruction")
+}
+
+// checkFromOverride verifies that the image replacing the FROM one is of the same
+// platform; the check is skipped unless the replaced image is present locally
+func (b *Build) checkFromOverride(img *docker.Image) error {
+	if b.overriddenFromName == "" || b.overriddenFromName == "scratch" {
+		return nil
+	}
+
+	original, err := b.client.InspectImage(imagename.NewFromString(b.overriddenFromName).String())
+	if err != nil {
+		return err
+	}
+	if original == nil {
+		log.Debugf("| Cannot check the platform of the FROM override, %s is not present locally", b.overriddenFromName)
+		return nil
+	}
+
+	if original.Architecture != "" && img.Architecture != "" && original.Architecture != img.Architecture {
+		return fmt.Errorf("FROM override %s is built for %s, while %s it replaces is for %s",
+			b.cfg.FromOverride, img.Architecture, b.overriddenFromName, original.Architecture)
+	}
+
+	return nil
+}
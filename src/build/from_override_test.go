@@ -0,0 +1,96 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"testing"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFromOverride_Plan(t *testing.T) {
+	b, _ := makeBuild(t, "FROM ubuntu\nRUN make\nFROM alpine", Config{FromOverride: "app:1.2"})
+
+	plan, err := NewPlan(b.rockerfile.Commands(), true, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.overrideFrom(plan); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, "FROM app:1.2", plan[0].String())
+	assert.Equal(t, "ubuntu", b.overriddenFromName)
+
+	// the second FROM and the Rockerfile itself stay as is
+	froms := []string{}
+	for _, command := range plan {
+		if _, ok := command.(*CommandFrom); ok {
+			froms = append(froms, command.String())
+		}
+	}
+	assert.Equal(t, []string{"FROM app:1.2", "FROM alpine"}, froms)
+	assert.Equal(t, []string{"ubuntu"}, b.rockerfile.Commands()[0].args)
+}
+
+func TestFromOverride_NoFrom(t *testing.T) {
+	b, _ := makeBuild(t, "", Config{FromOverride: "app:1.2"})
+	assert.EqualError(t, b.overrideFrom(Plan{}), "Cannot override FROM, the Rockerfile has no FROM instruction")
+}
+
+func TestFromOverride_Platform(t *testing.T) {
+	b, c := makeBuild(t, "FROM ubuntu", Config{FromOverride: "app:1.2"})
+
+	plan, err := NewPlan(b.rockerfile.Commands(), true, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.overrideFrom(plan); err != nil {
+		t.Fatal(err)
+	}
+
+	c.On("InspectImage", "app:1.2").Return(&docker.Image{ID: "123", Architecture: "arm64"}, nil).Once()
+	c.On("InspectImage", "ubuntu:latest").Return(&docker.Image{ID: "456", Architecture: "amd64"}, nil).Once()
+
+	_, err = plan[0].Execute(b)
+	assert.EqualError(t, err, "FROM override app:1.2 is built for arm64, while ubuntu it replaces is for amd64")
+
+	c.AssertExpectations(t)
+}
+
+func TestFromOverride_PlatformUnknown(t *testing.T) {
+	b, c := makeBuild(t, "FROM ubuntu", Config{FromOverride: "app:1.2"})
+
+	plan, err := NewPlan(b.rockerfile.Commands(), true, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.overrideFrom(plan); err != nil {
+		t.Fatal(err)
+	}
+
+	c.On("InspectImage", "app:1.2").Return(&docker.Image{ID: "123", Architecture: "arm64"}, nil).Once()
+	c.On("InspectImage", "ubuntu:latest").Return((*docker.Image)(nil), nil).Once()
+
+	state, err := plan[0].Execute(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "123", state.ImageID)
+}
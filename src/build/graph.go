@@ -0,0 +1,344 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+
+	"github.com/grammarly/rocker/src/imagename"
+)
+
+// The formats of the plan graph
+const (
+	GraphFormatDot     = "dot"
+	GraphFormatMermaid = "mermaid"
+)
+
+// graphLabelMax is the length the instructions are cut to in the graph
+const graphLabelMax = 60
+
+// The kinds of the graph nodes, they are drawn with different shapes
+const (
+	graphStep   = "step"
+	graphCommit = "commit"
+	graphImage  = "image"
+	graphOutput = "output"
+	graphMount  = "mount"
+)
+
+// Graph is the plan of the build drawn as a DAG: the FROM sections with
+// their steps and the commits, which are the cache boundaries, the base
+// images, the images made by TAG and PUSH, the mounts, and the files
+// passed from EXPORT to IMPORT
+type Graph struct {
+	sections []*graphSection
+	nodes    []*graphNode
+	edges    []graphEdge
+}
+
+type graphSection struct {
+	id    string
+	label string
+	nodes []*graphNode
+}
+
+type graphNode struct {
+	id    string
+	label string
+	kind  string
+}
+
+type graphEdge struct {
+	from, to string
+	label    string
+	dashed   bool
+}
+
+// NewGraph makes the graph of the plan
+func NewGraph(plan Plan) *Graph {
+	var (
+		g       = &Graph{}
+		section *graphSection
+		prev    *graphNode
+		export  *graphNode
+		images  = map[string]*graphNode{}
+		mounts  = map[string]*graphNode{}
+		counts  = map[string]int{}
+	)
+
+	newID := func(prefix string) string {
+		counts[prefix]++
+		return fmt.Sprintf("%s%d", prefix, counts[prefix])
+	}
+
+	// image returns the node of the image, the same one for the base image
+	// of a section and the image tagged by another section
+	image := func(name, kind string) *graphNode {
+		key := imagename.NewFromString(name).String()
+		if node, ok := images[key]; ok {
+			return node
+		}
+		node := &graphNode{id: newID("image"), label: name, kind: kind}
+		images[key] = node
+		g.nodes = append(g.nodes, node)
+		return node
+	}
+
+	// artifact returns the node of the artifact published to the artifact store
+	artifact := func(name string) *graphNode {
+		label := artifactSourcePrefix + name
+		node, ok := mounts[label]
+		if !ok {
+			node = &graphNode{id: newID("artifact"), label: label, kind: graphMount}
+			mounts[label] = node
+			g.nodes = append(g.nodes, node)
+		}
+		return node
+	}
+
+	add := func(node *graphNode) {
+		if section == nil {
+			section = &graphSection{id: newID("section"), label: "(no FROM)"}
+			g.sections = append(g.sections, section)
+		}
+		section.nodes = append(section.nodes, node)
+		if prev != nil {
+			g.edges = append(g.edges, graphEdge{from: prev.id, to: node.id})
+		}
+		prev = node
+	}
+
+	for _, command := range plan {
+		if _, ok := command.(*CommandCommit); ok {
+			if prev != nil && prev.kind != graphCommit {
+				add(&graphNode{id: newID("commit"), label: "commit", kind: graphCommit})
+			}
+			continue
+		}
+
+		cfg, ok := commandConfig(command)
+		if !ok {
+			continue
+		}
+
+		node := &graphNode{id: newID("step"), label: graphLabel(cfg.original), kind: graphStep}
+
+		if cfg.name == "from" && !cfg.isOnbuild {
+			section = &graphSection{id: newID("section"), label: graphLabel(cfg.original)}
+			g.sections = append(g.sections, section)
+			prev = nil
+			add(node)
+			if len(cfg.args) == 1 && cfg.args[0] != "scratch" {
+				g.edges = append(g.edges, graphEdge{from: image(cfg.args[0], graphImage).id, to: node.id})
+			}
+			continue
+		}
+
+		add(node)
+
+		if cfg.isOnbuild {
+			continue
+		}
+
+		switch cfg.name {
+		case "tag", "push":
+			for _, name := range cfg.args {
+				out := image(name, graphOutput)
+				out.kind = graphOutput
+				g.edges = append(g.edges, graphEdge{from: node.id, to: out.id, label: cfg.name})
+			}
+
+		case "artifact":
+			if kind, _, ref, err := parseArtifactArgs(cfg); err == nil {
+				out := image(ref, graphOutput)
+				out.kind = graphOutput
+				g.edges = append(g.edges, graphEdge{from: node.id, to: out.id, label: kind})
+			}
+
+		case "mount":
+			for _, arg := range cfg.args {
+				label := "volume " + arg
+				if pair := strings.SplitN(arg, ":", 2); len(pair) == 2 {
+					label = "host " + pair[0]
+				}
+				mount, ok := mounts[label]
+				if !ok {
+					mount = &graphNode{id: newID("mount"), label: label, kind: graphMount}
+					mounts[label] = mount
+					g.nodes = append(g.nodes, mount)
+				}
+				g.edges = append(g.edges, graphEdge{from: mount.id, to: node.id, dashed: true})
+			}
+
+		case "export":
+			export = node
+			if name, ok, err := exportPublishName(cfg.flags); ok && err == nil {
+				g.edges = append(g.edges, graphEdge{from: node.id, to: artifact(name).id, label: "publish"})
+			}
+
+		case "import":
+			// IMPORT --from=artifact:<name> takes the files from the artifact store
+			if from, ok := cfg.flags["from"]; ok {
+				if strings.HasPrefix(from, artifactSourcePrefix) {
+					g.edges = append(g.edges, graphEdge{from: artifact(strings.TrimPrefix(from, artifactSourcePrefix)).id, to: node.id, dashed: true})
+				}
+				continue
+			}
+			// IMPORT takes the files from the latest EXPORT
+			if export != nil && len(cfg.args) > 0 {
+				src := cfg.args
+				if len(src) > 1 {
+					src = src[:len(src)-1]
+				}
+				g.edges = append(g.edges, graphEdge{from: export.id, to: node.id, label: strings.Join(src, " "), dashed: true})
+			}
+		}
+	}
+
+	return g
+}
+
+// Write renders the graph in the format, dot or mermaid
+func (g *Graph) Write(w io.Writer, format string) error {
+	switch format {
+	case GraphFormatDot:
+		return g.writeDot(w)
+	case GraphFormatMermaid:
+		return g.writeMermaid(w)
+	}
+	return fmt.Errorf("Unknown graph format %q, expected dot or mermaid", format)
+}
+
+// GraphFormat guesses the format of the graph by the file extension, dot by default
+func GraphFormat(fileName string) string {
+	switch strings.ToLower(filepath.Ext(fileName)) {
+	case ".mmd", ".mermaid":
+		return GraphFormatMermaid
+	}
+	return GraphFormatDot
+}
+
+func (g *Graph) writeDot(w io.Writer) error {
+	shapes := map[string]string{
+		graphStep:   "box",
+		graphCommit: "cylinder",
+		graphImage:  "box3d",
+		graphOutput: "box3d, style=bold",
+		graphMount:  "folder",
+	}
+	node := func(indent string, n *graphNode) string {
+		return fmt.Sprintf("%s%s [label=%s, shape=%s];\n", indent, n.id, dotQuote(n.label), shapes[n.kind])
+	}
+
+	var b bytes.Buffer
+	b.WriteString("digraph rockerfile {\n")
+	b.WriteString("  rankdir=TB;\n")
+	b.WriteString("  node [fontname=\"monospace\", fontsize=10];\n")
+
+	for _, n := range g.nodes {
+		b.WriteString(node("  ", n))
+	}
+	for _, s := range g.sections {
+		fmt.Fprintf(&b, "  subgraph cluster_%s {\n", s.id)
+		fmt.Fprintf(&b, "    label=%s;\n", dotQuote(s.label))
+		for _, n := range s.nodes {
+			b.WriteString(node("    ", n))
+		}
+		b.WriteString("  }\n")
+	}
+	for _, e := range g.edges {
+		attrs := []string{}
+		if e.label != "" {
+			attrs = append(attrs, "label="+dotQuote(e.label))
+		}
+		if e.dashed {
+			attrs = append(attrs, "style=dashed")
+		}
+		if len(attrs) > 0 {
+			fmt.Fprintf(&b, "  %s -> %s [%s];\n", e.from, e.to, strings.Join(attrs, ", "))
+		} else {
+			fmt.Fprintf(&b, "  %s -> %s;\n", e.from, e.to)
+		}
+	}
+	b.WriteString("}\n")
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func (g *Graph) writeMermaid(w io.Writer) error {
+	shapes := map[string][2]string{
+		graphStep:   {"[", "]"},
+		graphCommit: {"[(", ")]"},
+		graphImage:  {"[[", "]]"},
+		graphOutput: {"[[", "]]"},
+		graphMount:  {"[/", "/]"},
+	}
+	node := func(indent string, n *graphNode) string {
+		shape := shapes[n.kind]
+		return fmt.Sprintf("%s%s%s%s%s\n", indent, n.id, shape[0], mermaidQuote(n.label), shape[1])
+	}
+
+	var b bytes.Buffer
+	b.WriteString("flowchart TD\n")
+
+	for _, n := range g.nodes {
+		b.WriteString(node("  ", n))
+	}
+	for _, s := range g.sections {
+		fmt.Fprintf(&b, "  subgraph %s[%s]\n", s.id, mermaidQuote(s.label))
+		for _, n := range s.nodes {
+			b.WriteString(node("    ", n))
+		}
+		b.WriteString("  end\n")
+	}
+	for _, e := range g.edges {
+		arrow := "-->"
+		if e.dashed {
+			arrow = "-.->"
+		}
+		if e.label != "" {
+			fmt.Fprintf(&b, "  %s %s|%s| %s\n", e.from, arrow, mermaidQuote(e.label), e.to)
+		} else {
+			fmt.Fprintf(&b, "  %s %s %s\n", e.from, arrow, e.to)
+		}
+	}
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// graphLabel makes the label of the instruction, the long ones are cut
+func graphLabel(s string) string {
+	s = strings.Join(strings.Fields(s), " ")
+	if len(s) > graphLabelMax {
+		s = s[:graphLabelMax-3] + "..."
+	}
+	return s
+}
+
+func dotQuote(s string) string {
+	return "\"" + strings.NewReplacer("\\", "\\\\", "\"", "\\\"").Replace(s) + "\""
+}
+
+func mermaidQuote(s string) string {
+	return "\"" + strings.Replace(s, "\"", "#quot;", -1) + "\""
+}
@@ -0,0 +1,176 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/grammarly/rocker/src/template"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const graphTestRockerfile = `FROM golang:1.6
+MOUNT /go/pkg
+MOUNT .:/src
+RUN go build -o /app
+EXPORT /app
+TAG builder:1
+
+FROM alpine
+IMPORT app /bin/app
+PUSH grammarly/app:1
+`
+
+func TestGraph_Dot(t *testing.T) {
+	plan := makeGraphPlan(t)
+
+	var buf bytes.Buffer
+	if err := NewGraph(plan).Write(&buf, GraphFormatDot); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `digraph rockerfile {
+  rankdir=TB;
+  node [fontname="monospace", fontsize=10];
+  image1 [label="golang:1.6", shape=box3d];
+  mount1 [label="volume /go/pkg", shape=folder];
+  mount2 [label="host .", shape=folder];
+  image2 [label="builder:1", shape=box3d, style=bold];
+  image3 [label="alpine", shape=box3d];
+  image4 [label="grammarly/app:1", shape=box3d, style=bold];
+  subgraph cluster_section1 {
+    label="FROM golang:1.6";
+    step1 [label="FROM golang:1.6", shape=box];
+    step2 [label="MOUNT /go/pkg", shape=box];
+    step3 [label="MOUNT .:/src", shape=box];
+    commit1 [label="commit", shape=cylinder];
+    step4 [label="RUN go build -o /app", shape=box];
+    commit2 [label="commit", shape=cylinder];
+    step5 [label="EXPORT /app", shape=box];
+    commit3 [label="commit", shape=cylinder];
+    step6 [label="TAG builder:1", shape=box];
+  }
+  subgraph cluster_section2 {
+    label="FROM alpine";
+    step7 [label="FROM alpine", shape=box];
+    step8 [label="IMPORT app /bin/app", shape=box];
+    commit4 [label="commit", shape=cylinder];
+    step9 [label="PUSH grammarly/app:1", shape=box];
+  }
+  image1 -> step1;
+  step1 -> step2;
+  mount1 -> step2 [style=dashed];
+  step2 -> step3;
+  mount2 -> step3 [style=dashed];
+  step3 -> commit1;
+  commit1 -> step4;
+  step4 -> commit2;
+  commit2 -> step5;
+  step5 -> commit3;
+  commit3 -> step6;
+  step6 -> image2 [label="tag"];
+  image3 -> step7;
+  step7 -> step8;
+  step5 -> step8 [label="app", style=dashed];
+  step8 -> commit4;
+  commit4 -> step9;
+  step9 -> image4 [label="push"];
+}
+`
+	assert.Equal(t, expected, buf.String())
+}
+
+func TestGraph_Mermaid(t *testing.T) {
+	plan := makeGraphPlan(t)
+
+	var buf bytes.Buffer
+	if err := NewGraph(plan).Write(&buf, GraphFormatMermaid); err != nil {
+		t.Fatal(err)
+	}
+
+	out := buf.String()
+	assert.True(t, strings.HasPrefix(out, "flowchart TD\n"), out)
+	assert.Contains(t, out, "  subgraph section1[\"FROM golang:1.6\"]\n")
+	assert.Contains(t, out, "    commit1[(\"commit\")]\n")
+	assert.Contains(t, out, "  image1[[\"golang:1.6\"]]\n")
+	assert.Contains(t, out, "  mount2[/\"host .\"/]\n")
+	assert.Contains(t, out, "  mount1 -.-> step2\n")
+	assert.Contains(t, out, "  step5 -.->|\"app\"| step8\n")
+	assert.Contains(t, out, "  step9 -->|\"push\"| image4\n")
+}
+
+func TestGraph_FromTagged(t *testing.T) {
+	r, err := NewRockerfile("Rockerfile", strings.NewReader("FROM golang\nTAG builder:1\nFROM builder:1\nRUN \"say \\\"hi\\\"\"\n"), template.Vars{}, template.Funs{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	plan, err := NewPlan(r.Commands(), false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := NewGraph(plan).Write(&buf, GraphFormatDot); err != nil {
+		t.Fatal(err)
+	}
+
+	// the section built on top of the tagged image is connected to it
+	assert.Contains(t, buf.String(), "  step2 -> image2 [label=\"tag\"];\n  image2 -> step3;\n")
+	assert.Contains(t, buf.String(), `[label="RUN \"say \\\"hi\\\"\"", shape=box]`)
+}
+
+func TestGraph_PublishedArtifact(t *testing.T) {
+	r, err := NewRockerfile("Rockerfile", strings.NewReader("FROM node\nEXPORT --publish=dist /src/dist/\nFROM nginx\nIMPORT --from=artifact:dist /app\n"), template.Vars{}, template.Funs{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	plan, err := NewPlan(r.Commands(), false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := NewGraph(plan).Write(&buf, GraphFormatDot); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Contains(t, buf.String(), "  artifact1 [label=\"artifact:dist\", shape=folder];\n")
+	assert.Contains(t, buf.String(), "  step2 -> artifact1 [label=\"publish\"];\n")
+	assert.Contains(t, buf.String(), "  artifact1 -> step4 [style=dashed];\n")
+}
+
+func TestGraph_Format(t *testing.T) {
+	assert.Equal(t, GraphFormatDot, GraphFormat(""))
+	assert.Equal(t, GraphFormatDot, GraphFormat("graph.dot"))
+	assert.Equal(t, GraphFormatMermaid, GraphFormat("graph.mmd"))
+	assert.EqualError(t, NewGraph(Plan{}).Write(&bytes.Buffer{}, "svg"), "Unknown graph format \"svg\", expected dot or mermaid")
+}
+
+func makeGraphPlan(t *testing.T) Plan {
+	r, err := NewRockerfile("Rockerfile", strings.NewReader(graphTestRockerfile), template.Vars{}, template.Funs{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	plan, err := NewPlan(r.Commands(), false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return plan
+}
@@ -0,0 +1,92 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"fmt"
+	"hash"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/docker/docker/pkg/tarsum"
+)
+
+// DefaultHash is the name of the hashing algorithm used unless another one is chosen
+const DefaultHash = "sha256"
+
+// Hash is the hashing algorithm of the COPY/ADD tarsums, the cache entries
+// record its ID, so the entries made with another algorithm are not hit
+type Hash struct {
+	Name string
+	// Version is bumped whenever the way the data is fed into the hash changes
+	Version int
+	New     func() hash.Hash
+}
+
+// Hashes are the available hashing algorithms; sha512_256 is faster than
+// sha256 on the 64-bit CPUs that have no SHA extensions, while sha256 is
+// much faster on the ones that have, see BenchmarkHash
+var Hashes = map[string]Hash{
+	"sha256":     {Name: "sha256", Version: 1, New: sha256.New},
+	"sha512_256": {Name: "sha512_256", Version: 1, New: sha512.New512_256},
+}
+
+// GetHash returns the hashing algorithm by name, the empty name means DefaultHash
+func GetHash(name string) (Hash, error) {
+	if name == "" {
+		name = DefaultHash
+	}
+	// There is no blake3 implementation among the dependencies,
+	// sha512_256 is the faster choice on the CPUs without SHA extensions
+	if name == "blake3" {
+		return Hash{}, fmt.Errorf("The blake3 hashing algorithm is not supported, use sha512_256 for the faster hashing")
+	}
+	h, ok := Hashes[name]
+	if !ok {
+		names := []string{}
+		for n := range Hashes {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return Hash{}, fmt.Errorf("Unknown hashing algorithm %q, available are: %s", name, strings.Join(names, ", "))
+	}
+	return h, nil
+}
+
+// ID returns the versioned name of the algorithm, e.g. sha256.v1
+func (h Hash) ID() string {
+	h = h.orDefault()
+	return fmt.Sprintf("%s.v%d", h.Name, h.Version)
+}
+
+// orDefault returns DefaultHash for the zero Hash
+func (h Hash) orDefault() Hash {
+	if h.New == nil {
+		return Hashes[DefaultHash]
+	}
+	return h
+}
+
+// newTarSum makes the tarsum of the tar stream with the given hashing algorithm,
+// e.g. tarsum.v1+sha256:<hex>
+func newTarSum(r io.Reader, h Hash) (tarsum.TarSum, error) {
+	h = h.orDefault()
+	return tarsum.NewTarSumHash(r, true, tarsum.Version1, tarsum.NewTHash(h.Name, h.New))
+}
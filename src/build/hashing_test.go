@@ -0,0 +1,135 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/docker/docker/pkg/tarsum"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetHash(t *testing.T) {
+	h, err := GetHash("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "sha256.v1", h.ID())
+
+	h, err = GetHash("sha512_256")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "sha512_256.v1", h.ID())
+
+	_, err = GetHash("md5")
+	assert.EqualError(t, err, "Unknown hashing algorithm \"md5\", available are: sha256, sha512_256")
+
+	_, err = GetHash("blake3")
+	assert.EqualError(t, err, "The blake3 hashing algorithm is not supported, use sha512_256 for the faster hashing")
+
+	assert.Equal(t, "sha256.v1", Hash{}.ID())
+}
+
+func TestCache_Hash(t *testing.T) {
+	tmpDir := cacheTestTmpDir(t)
+	defer os.RemoveAll(tmpDir)
+
+	h, _ := GetHash("sha512_256")
+
+	if err := NewCacheFS(tmpDir, h).Put(State{ParentID: "123", ImageID: "456"}); err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := NewCacheFS(tmpDir, h).Get(State{ImageID: "123"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "456", res.ImageID)
+
+	// The entries made with another algorithm are not hit
+	res, err = NewCacheFS(tmpDir, Hash{}).Get(State{ImageID: "123"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Nil(t, res)
+}
+
+func TestCache_HashLegacyEntry(t *testing.T) {
+	tmpDir := cacheTestTmpDir(t)
+	defer os.RemoveAll(tmpDir)
+
+	// The entries of earlier rocker versions have no key recorded
+	data, _ := json.Marshal(State{ParentID: "123", ImageID: "456"})
+	if err := os.MkdirAll(filepath.Join(tmpDir, "123"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(tmpDir, "123", "456.json"), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := NewCacheFS(tmpDir, Hash{}).Get(State{ImageID: "123"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "456", res.ImageID)
+
+	h, _ := GetHash("sha512_256")
+	res, err = NewCacheFS(tmpDir, h).Get(State{ImageID: "123"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Nil(t, res)
+}
+
+func TestNewTarSum(t *testing.T) {
+	ts, err := newTarSum(&bytes.Buffer{}, Hash{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "sha256", ts.Hash().Name())
+	assert.Equal(t, tarsum.Version1, ts.Version())
+
+	h, _ := GetHash("sha512_256")
+	if ts, err = newTarSum(&bytes.Buffer{}, h); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "sha512_256", ts.Hash().Name())
+}
+
+// BenchmarkHash compares the hashing algorithms on a big chunk of data,
+// e.g. go test -run none -bench Hash ./src/build
+func BenchmarkHash(b *testing.B) {
+	data := bytes.Repeat([]byte("rocker"), 1<<20)
+
+	for _, name := range []string{"sha256", "sha512_256"} {
+		h, _ := GetHash(name)
+		b.Run(name, func(b *testing.B) {
+			b.SetBytes(int64(len(data)))
+			for i := 0; i < b.N; i++ {
+				hh := h.New()
+				hh.Write(data)
+				hh.Sum(nil)
+			}
+		})
+	}
+}
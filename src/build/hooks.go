@@ -0,0 +1,160 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// hookInstructions is the list of instructions that can have hooks
+const hookInstructions = "from maintainer run attach env label envfile labelfile workdir tag push copy add cmd entrypoint expose volume user onbuild mount export import arg test cache invalidate smoke artifact readvars"
+
+// LowDiskSpaceHook is the hook executed when the docker host runs out
+// of the free space required by Config.MinFreeSpace, e.g. to clean up
+const LowDiskSpaceHook = "low-disk-space"
+
+// Hooks maps the hook names to the shell commands executed around
+// the build steps; the name is pre- or post- followed by the lowercase
+// instruction, e.g. pre-run or post-push, or LowDiskSpaceHook
+type Hooks map[string]string
+
+// Validate checks the hook names, so a typo doesn't silently turn a policy off
+func (h Hooks) Validate() error {
+	names := []string{}
+	for name := range h {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if strings.TrimSpace(h[name]) == "" {
+			return fmt.Errorf("hook %s has empty command", name)
+		}
+		if name == LowDiskSpaceHook {
+			continue
+		}
+		parts := strings.SplitN(name, "-", 2)
+		if len(parts) != 2 || (parts[0] != "pre" && parts[0] != "post") {
+			return fmt.Errorf("hook %s should be named pre-<instruction> or post-<instruction>", name)
+		}
+		if !isHookInstruction(parts[1]) {
+			return fmt.Errorf("hook %s refers to unknown instruction %s", name, parts[1])
+		}
+	}
+
+	return nil
+}
+
+func isHookInstruction(name string) bool {
+	for _, instruction := range strings.Fields(hookInstructions) {
+		if name == instruction {
+			return true
+		}
+	}
+	return false
+}
+
+// runHook executes the hook of the given step if there is one configured;
+// the hook failure fails the build
+func (b *Build) runHook(when string, step int, command Command) error {
+	cfg, ok := commandConfig(command)
+	if !ok {
+		return nil
+	}
+
+	name := when + "-" + cfg.name
+	script, ok := b.cfg.Hooks[name]
+	if !ok {
+		return nil
+	}
+
+	return b.execHook(name, script, b.hookEnv(name, step, command, cfg))
+}
+
+// execHook runs the hook script in the context dir
+func (b *Build) execHook(name, script string, env []string) error {
+	log.Infof("| Run hook %s: %s", name, script)
+
+	out := log.StandardLogger().Writer()
+	defer out.Close()
+
+	cmd := exec.Command("/bin/sh", "-c", script)
+	cmd.Dir = b.cfg.ContextDir
+	cmd.Env = append(os.Environ(), env...)
+	cmd.Stdout = out
+	cmd.Stderr = out
+
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("Hook %s failed, error: %s", name, err)
+	}
+
+	return nil
+}
+
+// hookEnv returns the step context exported to the hook
+func (b *Build) hookEnv(name string, step int, command Command, cfg ConfigCommand) []string {
+	env := []string{
+		"ROCKER_HOOK=" + name,
+		"ROCKER_BUILD_ID=" + b.cfg.ID,
+		"ROCKER_CONTEXT_DIR=" + b.cfg.ContextDir,
+		fmt.Sprintf("ROCKER_STEP=%d", step),
+		"ROCKER_STEP_NAME=" + strings.ToUpper(cfg.name),
+		"ROCKER_STEP_COMMAND=" + command.String(),
+		"ROCKER_IMAGE_ID=" + b.state.ImageID,
+		"ROCKER_PARENT_ID=" + b.state.ParentID,
+	}
+
+	if (cfg.name == "tag" || cfg.name == "push") && len(cfg.args) > 0 {
+		tag := cfg.args[0]
+		if ch := b.cfg.PublishChannel; ch != nil {
+			if rewritten, err := ch.Rewrite(tag, b.rockerfile.Vars, b.started); err == nil {
+				tag = rewritten
+			}
+		}
+		env = append(env, "ROCKER_TAG="+tag)
+	}
+
+	// The digest is known only after the image is pushed
+	if cfg.name == "push" && strings.HasPrefix(name, "post-") && len(b.Artifacts) > 0 {
+		artifact := b.Artifacts[len(b.Artifacts)-1]
+		env = append(env, "ROCKER_DIGEST="+artifact.Digest)
+	}
+
+	return env
+}
+
+// commandConfig returns the instruction config of the command,
+// the commands made by the plan itself, e.g. commit, have none
+func commandConfig(command Command) (ConfigCommand, bool) {
+	switch c := command.(type) {
+	case *CommandOnbuildWrap:
+		return commandConfig(c.cmd)
+	case *CommandConditionWrap:
+		return commandConfig(c.cmd)
+	case interface {
+		config() ConfigCommand
+	}:
+		return c.config(), true
+	}
+	return ConfigCommand{}, false
+}
@@ -0,0 +1,81 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHooks_Validate(t *testing.T) {
+	assert.NoError(t, Hooks{"pre-from": "true", "post-copy": "true"}.Validate())
+	assert.EqualError(t, Hooks{"before-run": "true"}.Validate(), "hook before-run should be named pre-<instruction> or post-<instruction>")
+	assert.EqualError(t, Hooks{"pre-rn": "true"}.Validate(), "hook pre-rn refers to unknown instruction rn")
+	assert.EqualError(t, Hooks{"post-run": " "}.Validate(), "hook post-run has empty command")
+}
+
+func TestBuild_RunHooks(t *testing.T) {
+	tmpDir := makeContextFiles(t, map[string]string{})
+	defer os.RemoveAll(tmpDir)
+
+	b, _ := makeBuild(t, "", Config{
+		ContextDir: tmpDir,
+		Hooks: Hooks{
+			"pre-env":  "echo $ROCKER_HOOK $ROCKER_STEP $ROCKER_STEP_NAME >> hooks.log",
+			"post-env": "echo $ROCKER_HOOK \"$ROCKER_STEP_COMMAND\" >> hooks.log",
+		},
+	})
+
+	plan := Plan{
+		NewCommand(ConfigCommand{name: "env", args: []string{"type", "web"}, original: "ENV type=web"}),
+		NewCommand(ConfigCommand{name: "label", args: []string{"a", "b"}, original: "LABEL a=b"}),
+	}
+
+	if err := b.Run(plan); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(tmpDir, "hooks.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, []string{"pre-env 1 ENV", "post-env ENV type=web"}, strings.Split(strings.TrimSpace(string(data)), "\n"))
+}
+
+func TestBuild_RunHooksFail(t *testing.T) {
+	tmpDir := makeContextFiles(t, map[string]string{})
+	defer os.RemoveAll(tmpDir)
+
+	b, _ := makeBuild(t, "", Config{
+		ContextDir: tmpDir,
+		Hooks:      Hooks{"pre-env": "exit 3"},
+	})
+
+	plan := Plan{
+		NewCommand(ConfigCommand{name: "env", args: []string{"type", "web"}, original: "ENV type=web"}),
+	}
+
+	err := b.Run(plan)
+	assert.EqualError(t, err, "Hook pre-env failed, error: exit status 3")
+	assert.Len(t, b.GetState().Config.Env, 0)
+}
@@ -0,0 +1,89 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package build
+
+import (
+	"fmt"
+
+	"github.com/grammarly/rocker/src/imagename"
+)
+
+// checkImageNames fails the build before it starts if TAG, PUSH or ARTIFACT has
+// an invalid image name, e.g. the template rendered an empty tag or
+// an uppercase repository; otherwise it is rejected by the daemon or
+// the registry only when the build is over
+func (b *Build) checkImageNames(plan Plan) error {
+	for _, command := range plan {
+		cfg, ok := commandConfig(command)
+		if !ok || cfg.isOnbuild {
+			continue
+		}
+		names := publishedNames(cfg)
+		if cfg.name == "push" {
+			names = b.withPushMirrors(names)
+		}
+		for _, name := range names {
+			if err := b.checkImageName(name); err != nil {
+				return b.stepError(command, fmt.Errorf("%s: %s", cfg.original, err))
+			}
+		}
+	}
+	return nil
+}
+
+// publishedNames returns the image name of TAG, the names of PUSH and the destination of ARTIFACT
+func publishedNames(cfg ConfigCommand) []string {
+	switch cfg.name {
+	case "tag":
+		if len(cfg.args) == 1 {
+			return cfg.args
+		}
+	case "push":
+		return cfg.args
+	case "artifact":
+		if _, _, ref, err := parseArtifactArgs(cfg); err == nil {
+			return []string{ref}
+		}
+	}
+	return nil
+}
+
+// withPushMirrors returns the names of PUSH along with their names on the
+// push mirrors, which pushNames adds when the PUSH is executed
+func (b *Build) withPushMirrors(names []string) []string {
+	result := append([]string{}, names...)
+	for _, name := range names {
+		for _, mirror := range b.cfg.PushMirrors.Rewrite(imagename.NewFromString(name)) {
+			result = append(result, mirror.String())
+		}
+	}
+	return result
+}
+
+// checkImageName validates the name as given and as rewritten by the publish channel
+func (b *Build) checkImageName(name string) error {
+	if err := imagename.Validate(name); err != nil {
+		return err
+	}
+	if b.cfg.PublishChannel == nil {
+		return nil
+	}
+	rewritten, err := b.cfg.PublishChannel.Rewrite(name, b.rockerfile.Vars, b.started)
+	if err != nil {
+		return err
+	}
+	return imagename.Validate(rewritten)
+}
@@ -0,0 +1,57 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package build
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBuild_Run_InvalidImageName(t *testing.T) {
+	b, c := makeBuild(t, "FROM ubuntu\nRUN make\nTAG {{ \"Grammarly/app\" }}:1\n", Config{})
+	plan, err := NewPlan(b.rockerfile.Commands(), true, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// fails before any step, so the client is not called
+	err = b.Run(plan)
+	assert.EqualError(t, err, b.rockerfile.Name+":3: TAG Grammarly/app:1: repository name \"Grammarly/app\" of image \"Grammarly/app:1\" must be lowercase")
+	c.AssertExpectations(t)
+}
+
+func TestBuild_Run_InvalidImageNameEmptyTag(t *testing.T) {
+	b, _ := makeBuild(t, "FROM ubuntu\nPUSH app:{{ \"\" }}\n", Config{})
+	plan, err := NewPlan(b.rockerfile.Commands(), true, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = b.Run(plan)
+	assert.EqualError(t, err, b.rockerfile.Name+":2: PUSH app:: invalid tag \"\" of image \"app:\", the tag may contain letters, digits, _, . and - up to 128 characters and must not start with . or -")
+}
+
+func TestBuild_Run_InvalidArtifactName(t *testing.T) {
+	b, _ := makeBuild(t, "FROM ubuntu\nARTIFACT chart ./chart --push oci://registry.io/Charts/app:1\n", Config{})
+	plan, err := NewPlan(b.rockerfile.Commands(), true, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = b.Run(plan)
+	assert.EqualError(t, err, b.rockerfile.Name+":2: ARTIFACT chart ./chart --push oci://registry.io/Charts/app:1: repository name \"registry.io/Charts/app\" of image \"registry.io/Charts/app:1\" must be lowercase")
+}
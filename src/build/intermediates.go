@@ -0,0 +1,142 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	log "github.com/Sirupsen/logrus"
+	"github.com/fsouza/go-dockerclient"
+)
+
+// intermediateLabels are the labels of the images committed by the build;
+// the committed images inherit them, so the final images have them too.
+// Docker copies the labels of the committed container to the image, so the
+// ones identifying the RUN container only are cleared.
+func (b *Build) intermediateLabels() map[string]string {
+	return map[string]string{
+		ImageLabelIntermediate:   "true",
+		ContainerLabelBuildID:    b.getIdentifier(),
+		ContainerLabelStep:       "",
+		ContainerLabelRockerfile: "",
+	}
+}
+
+// publishableImage returns the image to TAG or PUSH: the images committed by
+// the build inherit the intermediate label, so the image that has it is
+// committed again with the label cleared, which is cached as any other step.
+// The build goes on with the image it had.
+func (b *Build) publishableImage() (string, error) {
+	img, err := b.client.InspectImage(b.state.ImageID)
+	if err != nil {
+		return "", err
+	}
+	if img == nil || img.Config == nil || img.Config.Labels[ImageLabelIntermediate] != "true" {
+		return b.state.ImageID, nil
+	}
+
+	saved := b.state
+	defer func() { b.state = saved }()
+
+	s := b.state
+	s.Commit("LABEL %s=", ImageLabelIntermediate)
+	s.NoCache.Publish = true
+
+	b.state = s
+	if s, err = (&CommandCommit{}).Execute(b); err != nil {
+		return "", err
+	}
+	return s.ImageID, nil
+}
+
+// withoutIntermediateLabels returns the labels without the ones given to the commits
+func withoutIntermediateLabels(labels map[string]string) map[string]string {
+	if _, ok := labels[ImageLabelIntermediate]; !ok {
+		return labels
+	}
+	result := map[string]string{}
+	for k, v := range labels {
+		switch k {
+		case ImageLabelIntermediate, ContainerLabelBuildID, ContainerLabelStep, ContainerLabelRockerfile:
+		default:
+			result[k] = v
+		}
+	}
+	return result
+}
+
+// ImageRemover lists and removes the images, it is implemented by *docker.Client
+type ImageRemover interface {
+	ListImages(opts docker.ListImagesOptions) ([]docker.APIImages, error)
+	RemoveImage(name string) error
+}
+
+// CleanIntermediates removes the untagged images committed by rocker, whichever
+// build made them; the images that still have children, e.g. the tagged ones,
+// or containers, are kept. It returns the ids of the removed images, or the ones
+// that would be removed with dryRun, and the number of the kept ones.
+func CleanIntermediates(client ImageRemover, dryRun bool) (removed []string, kept int, err error) {
+	images, err := client.ListImages(docker.ListImagesOptions{
+		All:     true,
+		Filters: map[string][]string{"label": {ImageLabelIntermediate + "=true"}},
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	candidates := []string{}
+	for _, img := range images {
+		if isUntagged(img) {
+			candidates = append(candidates, img.ID)
+		}
+	}
+
+	if dryRun {
+		return candidates, 0, nil
+	}
+
+	// The children go first, so their parents can be removed on the next pass
+	for len(candidates) > 0 {
+		left := []string{}
+		for _, id := range candidates {
+			if err := client.RemoveImage(id); err != nil {
+				log.Debugf("Keep image %.12s, error: %s", id, err)
+				left = append(left, id)
+				continue
+			}
+			removed = append(removed, id)
+		}
+		if len(left) == len(candidates) {
+			break
+		}
+		candidates = left
+	}
+
+	return removed, len(candidates), nil
+}
+
+func isUntagged(img docker.APIImages) bool {
+	for _, tag := range img.RepoTags {
+		if tag != "<none>:<none>" {
+			return false
+		}
+	}
+	for _, digest := range img.RepoDigests {
+		if digest != "<none>@<none>" {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,151 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestCommandCommit_IntermediateLabels(t *testing.T) {
+	b, c := makeBuild(t, "", Config{ID: "build-1"})
+	cmd := &CommandCommit{}
+
+	b.state.ImageID = "123"
+	b.state.NoCache.ContainerID = "456"
+	b.state.Config.Labels = map[string]string{"app": "web"}
+	b.state.Commit("a")
+
+	c.On("CommitContainer", mock.AnythingOfType("State")).Return(&docker.Image{ID: "789"}, nil).Run(func(args mock.Arguments) {
+		s := args.Get(0).(State)
+		assert.Equal(t, map[string]string{
+			ImageLabelIntermediate:   "true",
+			ContainerLabelBuildID:    "build-1",
+			ContainerLabelStep:       "",
+			ContainerLabelRockerfile: "",
+		}, s.NoCache.CommitLabels)
+	}).Once()
+	c.On("RemoveContainer", "456").Return(nil).Once()
+
+	state, err := cmd.Execute(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.AssertExpectations(t)
+	// the labels are not the part of the config and the cache key
+	assert.Equal(t, map[string]string{"app": "web"}, state.Config.Labels)
+	assert.Nil(t, state.NoCache.CommitLabels)
+}
+
+func TestCommandTag_ClearsIntermediateLabel(t *testing.T) {
+	b, c := makeBuild(t, "", Config{ID: "build-1"})
+	cmd := NewCommand(ConfigCommand{
+		name: "tag",
+		args: []string{"app:1"},
+	})
+
+	b.state.ImageID = "123"
+
+	c.On("InspectImage", "123").Return(&docker.Image{ID: "123", Config: &docker.Config{
+		Labels: map[string]string{ImageLabelIntermediate: "true"},
+	}}, nil).Once()
+	c.On("CreateContainer", mock.AnythingOfType("State")).Return("456", nil).Once()
+	c.On("CommitContainer", mock.AnythingOfType("State")).Return(&docker.Image{ID: "789"}, nil).Run(func(args mock.Arguments) {
+		s := args.Get(0).(State)
+		assert.Equal(t, "", s.NoCache.CommitLabels[ImageLabelIntermediate])
+		assert.Equal(t, "build-1", s.NoCache.CommitLabels[ContainerLabelBuildID])
+	}).Once()
+	c.On("RemoveContainer", "456").Return(nil).Once()
+	c.On("TagImage", "789", "app:1").Return(nil).Once()
+
+	state, err := cmd.Execute(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.AssertExpectations(t)
+	// the build goes on with the image it had
+	assert.Equal(t, "123", state.ImageID)
+	assert.Equal(t, "123", b.state.ImageID)
+}
+
+func TestSameImageConfig_IntermediateLabels(t *testing.T) {
+	img := &docker.Config{Labels: map[string]string{"app": "web", ImageLabelIntermediate: "true", ContainerLabelBuildID: "build-1"}}
+	assert.True(t, sameImageConfig(img, &docker.Config{Labels: map[string]string{"app": "web"}}))
+	assert.False(t, sameImageConfig(img, &docker.Config{Labels: map[string]string{"app": "api"}}))
+
+	img.Labels[ContainerLabelStep] = ""
+	img.Labels[ContainerLabelRockerfile] = ""
+	assert.True(t, sameImageConfig(img, &docker.Config{Labels: map[string]string{"app": "web"}}))
+}
+
+type fakeImageRemover struct {
+	images   []docker.APIImages
+	children map[string]string
+	removed  []string
+}
+
+func (f *fakeImageRemover) ListImages(opts docker.ListImagesOptions) ([]docker.APIImages, error) {
+	return f.images, nil
+}
+
+func (f *fakeImageRemover) RemoveImage(id string) error {
+	if child, ok := f.children[id]; ok {
+		return fmt.Errorf("conflict: image %s has dependent child image %s", id, child)
+	}
+	for parent, child := range f.children {
+		if child == id {
+			delete(f.children, parent)
+		}
+	}
+	f.removed = append(f.removed, id)
+	return nil
+}
+
+func TestCleanIntermediates(t *testing.T) {
+	newRemover := func() *fakeImageRemover {
+		return &fakeImageRemover{
+			images: []docker.APIImages{
+				{ID: "1", RepoTags: []string{"<none>:<none>"}},
+				{ID: "2", RepoTags: []string{"<none>:<none>"}},
+				{ID: "3"},
+				{ID: "4", RepoTags: []string{"app:1"}},
+				{ID: "5", RepoDigests: []string{"app@sha256:abc"}},
+			},
+			// 1 is the parent of 2, 3 is the parent of the tagged 4
+			children: map[string]string{"1": "2", "3": "4"},
+		}
+	}
+
+	f := newRemover()
+	removed, kept, err := CleanIntermediates(f, true)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"1", "2", "3"}, removed)
+	assert.Equal(t, 0, kept)
+	assert.Empty(t, f.removed)
+
+	f = newRemover()
+	removed, kept, err = CleanIntermediates(f, false)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"2", "1"}, removed)
+	assert.Equal(t, 1, kept)
+}
@@ -0,0 +1,61 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"fmt"
+	"strings"
+)
+
+// invalidateCommit is the prefix of the commits made by INVALIDATE
+const invalidateCommit = "INVALIDATE "
+
+// CommandInvalidate implements INVALIDATE; its key becomes the part of the
+// cache key of the next step, so a new key rebuilds the following steps
+// while the ones before INVALIDATE stay cached
+type CommandInvalidate struct {
+	CommandBase
+}
+
+// ReplaceEnv implements EnvReplacableCommand interface
+func (c *CommandInvalidate) ReplaceEnv(env []string) error {
+	return replaceEnv(c.cfg.args, env)
+}
+
+// Execute runs the command
+func (c *CommandInvalidate) Execute(b *Build) (s State, err error) {
+	s = b.state
+
+	if len(c.cfg.args) != 1 || strings.TrimSpace(c.cfg.args[0]) == "" {
+		return s, fmt.Errorf("INVALIDATE requires exactly one argument, the key")
+	}
+
+	s.Commit("%s%s", invalidateCommit, strings.TrimSpace(c.cfg.args[0]))
+
+	return s, nil
+}
+
+// hasInvalidate returns true if the pending commits of the state
+// include INVALIDATE
+func hasInvalidate(s State) bool {
+	for _, commit := range s.Commits {
+		if strings.HasPrefix(commit, invalidateCommit) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,112 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCommandInvalidate_Simple(t *testing.T) {
+	b, _ := makeBuild(t, "", Config{})
+	cmd := NewCommand(ConfigCommand{
+		name: "invalidate",
+		args: []string{"lock-3f2a"},
+	})
+
+	b.state.ImageID = "123"
+
+	state, err := cmd.Execute(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, "123", state.ImageID)
+	assert.Equal(t, []string{"INVALIDATE lock-3f2a"}, state.Commits)
+	assert.True(t, hasInvalidate(state))
+}
+
+func TestCommandInvalidate_ChangesCacheKey(t *testing.T) {
+	keys := []CacheKey{}
+	for _, key := range []string{"2016-01", "2016-02"} {
+		b, _ := makeBuild(t, "", Config{})
+		b.state.ImageID = "123"
+
+		state, err := NewCommand(ConfigCommand{name: "invalidate", args: []string{key}}).Execute(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		state.Commit("RUN make")
+
+		keys = append(keys, NewCacheKey(state))
+	}
+
+	assert.NotEqual(t, keys[0], keys[1])
+}
+
+func TestCommandInvalidate_NoArgs(t *testing.T) {
+	b, _ := makeBuild(t, "", Config{})
+	cmd := NewCommand(ConfigCommand{
+		name: "invalidate",
+		args: []string{" "},
+	})
+
+	_, err := cmd.Execute(b)
+	assert.EqualError(t, err, "INVALIDATE requires exactly one argument, the key")
+}
+
+func TestCommandInvalidate_NotNoopCommit(t *testing.T) {
+	b, _ := makeBuild(t, "", Config{SkipNoopCommits: true})
+
+	s := b.state
+	s.ImageID = "123"
+	s.NoCache.ContainerID = "456"
+	s.Commit("INVALIDATE lock-3f2a")
+
+	// the client is not even asked for the changes
+	skip, err := b.isNoopCommit(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.False(t, skip)
+}
+
+func TestPlan_Invalidate(t *testing.T) {
+	p := makePlan(t, `
+FROM ubuntu
+RUN apt-get update
+INVALIDATE lock-3f2a
+RUN npm install
+`)
+
+	expected := []Command{
+		&CommandFrom{},
+		&CommandRun{},
+		&CommandCommit{},
+		&CommandInvalidate{},
+		&CommandCommit{},
+		&CommandRun{},
+		&CommandCommit{},
+		&CommandCleanup{},
+	}
+
+	assert.Len(t, p, len(expected))
+	for i, c := range expected {
+		assert.IsType(t, c, p[i])
+	}
+}
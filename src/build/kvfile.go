@@ -0,0 +1,165 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/go-yaml/yaml"
+)
+
+var (
+	envNameRegexp  = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+	labelKeyRegexp = regexp.MustCompile(`^[^\s=]+$`)
+)
+
+// keyValue is a single entry of ENVFILE or LABELFILE
+type keyValue struct {
+	key   string
+	value string
+}
+
+// readKeyValueContextFile reads and parses the file of the build context,
+// returns its entries and the content hash
+func readKeyValueContextFile(b *Build, name string) ([]keyValue, string, error) {
+	filename := filepath.Join(b.cfg.ContextDir, name)
+
+	rel, err := filepath.Rel(b.cfg.ContextDir, filename)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return nil, "", fmt.Errorf("File %s is outside of the build context", name)
+	}
+
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, "", fmt.Errorf("Failed to read %s, error: %s", name, err)
+	}
+
+	entries, err := parseKeyValueFile(name, data)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return entries, fmt.Sprintf("sha256:%x", sha256.Sum256(data)), nil
+}
+
+// parseKeyValueFile parses the content of ENVFILE or LABELFILE, which is
+// either a YAML/JSON map (by the file extension) or KEY=VALUE lines; the
+// entries are returned in the order of the file
+func parseKeyValueFile(filename string, data []byte) (result []keyValue, err error) {
+	switch filepath.Ext(filename) {
+	case ".yml", ".yaml", ".json":
+		result, err = parseKeyValueYAML(data)
+	default:
+		result, err = parseKeyValueLines(data)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse %s, error: %s", filename, err)
+	}
+
+	seen := map[string]bool{}
+	for _, kv := range result {
+		if seen[kv.key] {
+			return nil, fmt.Errorf("Failed to parse %s, error: duplicate key %s", filename, kv.key)
+		}
+		seen[kv.key] = true
+	}
+
+	return result, nil
+}
+
+// parseKeyValueLines parses KEY=VALUE lines, the format of docker --env-file
+// with optional quoting of values and "export" prefix
+func parseKeyValueLines(data []byte) (result []keyValue, err error) {
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	lineNum := 0
+
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		line = strings.TrimSpace(strings.TrimPrefix(line, "export "))
+
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("line %d: expected KEY=VALUE, got %q", lineNum, line)
+		}
+
+		kv := keyValue{
+			key:   strings.TrimSpace(parts[0]),
+			value: strings.TrimSpace(parts[1]),
+		}
+
+		if kv.value, err = unquoteValue(kv.value); err != nil {
+			return nil, fmt.Errorf("line %d: %s", lineNum, err)
+		}
+
+		result = append(result, kv)
+	}
+
+	return result, scanner.Err()
+}
+
+// parseKeyValueYAML parses the flat YAML or JSON map
+func parseKeyValueYAML(data []byte) (result []keyValue, err error) {
+	var m yaml.MapSlice
+	if err := yaml.Unmarshal(data, &m); err != nil {
+		return nil, err
+	}
+
+	for _, item := range m {
+		kv := keyValue{key: fmt.Sprintf("%v", item.Key)}
+
+		switch value := item.Value.(type) {
+		case nil:
+		case string, bool, int, int64, uint64, float64:
+			kv.value = fmt.Sprintf("%v", value)
+		default:
+			return nil, fmt.Errorf("value of %s should be a scalar, got %T", kv.key, value)
+		}
+
+		result = append(result, kv)
+	}
+
+	return result, nil
+}
+
+// unquoteValue strips the matching single or double quotes of the value;
+// escape sequences are processed within double quotes only
+func unquoteValue(value string) (string, error) {
+	if len(value) < 2 {
+		return value, nil
+	}
+	switch {
+	case value[0] == '"' && value[len(value)-1] == '"':
+		return strconv.Unquote(value)
+	case value[0] == '\'' && value[len(value)-1] == '\'':
+		return value[1 : len(value)-1], nil
+	}
+	return value, nil
+}
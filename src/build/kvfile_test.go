@@ -0,0 +1,119 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseKeyValueFile_Lines(t *testing.T) {
+	content := `
+# comment
+NAME=app
+export PORT = 8080
+GREETING="hello \"world\""
+RAW='$HOME stays'
+EMPTY=
+`
+	entries, err := parseKeyValueFile("env.production", []byte(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, []keyValue{
+		{"NAME", "app"},
+		{"PORT", "8080"},
+		{"GREETING", `hello "world"`},
+		{"RAW", "$HOME stays"},
+		{"EMPTY", ""},
+	}, entries)
+}
+
+func TestParseKeyValueFile_YAML(t *testing.T) {
+	content := "team: platform\nversion: 1.2\npublic: true\nnone:\n"
+
+	entries, err := parseKeyValueFile("labels.yml", []byte(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, []keyValue{
+		{"team", "platform"},
+		{"version", "1.2"},
+		{"public", "true"},
+		{"none", ""},
+	}, entries)
+}
+
+func TestParseKeyValueFile_Invalid(t *testing.T) {
+	tests := map[string]string{
+		"env":        "A=1\nB\n",
+		"dup.env":    "A=1\nA=2\n",
+		"quote.env":  `A="unterminated \"`,
+		"nested.yml": "a:\n  b: c\n",
+	}
+
+	expected := map[string]string{
+		"env":        "line 2: expected KEY=VALUE",
+		"dup.env":    "duplicate key A",
+		"quote.env":  "line 1:",
+		"nested.yml": "value of a should be a scalar",
+	}
+
+	for name, content := range tests {
+		_, err := parseKeyValueFile(name, []byte(content))
+		if assert.Error(t, err, name) {
+			assert.Contains(t, err.Error(), expected[name], name)
+		}
+	}
+}
+
+func TestReadKeyValueContextFile_Outside(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "rocker-kvfile-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	contextDir := filepath.Join(tmpDir, "context")
+	if err := os.MkdirAll(contextDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"context/..env", "secret.env"} {
+		if err := ioutil.WriteFile(filepath.Join(tmpDir, name), []byte("A=1\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	b := &Build{cfg: Config{ContextDir: contextDir}}
+
+	// the file name starting with dots is within the context
+	entries, _, err := readKeyValueContextFile(b, "..env")
+	assert.Nil(t, err)
+	assert.Equal(t, []keyValue{{"A", "1"}}, entries)
+
+	_, _, err = readKeyValueContextFile(b, "../secret.env")
+	assert.EqualError(t, err, "File ../secret.env is outside of the build context")
+
+	_, _, err = readKeyValueContextFile(b, "sub/../../secret.env")
+	assert.EqualError(t, err, "File sub/../../secret.env is outside of the build context")
+}
@@ -0,0 +1,173 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var (
+	depInstallRegexp = regexp.MustCompile(`\b(npm (install|ci)|yarn install|pip3? install|bundle install|go mod download|composer install|mvn dependency:)`)
+	timestampRegexp  = regexp.MustCompile(`^((19|20)\d{2}-(0[1-9]|1[0-2])-(0[1-9]|[12]\d|3[01])([T ]\d{2}:\d{2}|$)|(\d{10})(\d{3})?$)`)
+	timestampEnvName = regexp.MustCompile(`(?i)(^|_)(BUILD_?DATE|BUILD_?TIME|TIMESTAMP)$`)
+)
+
+// Unix times from 2001-09-09 to 2049-12-31 are taken for timestamps, other
+// numbers of 10 or 13 digits are more likely to be ids or phone numbers
+const (
+	minTimestamp = 1000000000
+	maxTimestamp = 2524607999
+)
+
+// looksLikeTimestamp returns true if the value is a date, a date and
+// time, or a plausible unix time in seconds or milliseconds
+func looksLikeTimestamp(value string) bool {
+	m := timestampRegexp.FindStringSubmatch(value)
+	if m == nil {
+		return false
+	}
+	if m[6] == "" {
+		return true
+	}
+	seconds, err := strconv.ParseInt(m[6], 10, 64)
+	return err == nil && seconds >= minTimestamp && seconds <= maxTimestamp
+}
+
+// LintWarning is the finding of the Rockerfile analyzer
+type LintWarning struct {
+	Command string `json:"command"`
+	Message string `json:"message"`
+}
+
+// String returns the human readable representation of the warning
+func (w LintWarning) String() string {
+	return fmt.Sprintf("%s: %s", w.Command, w.Message)
+}
+
+// Lint looks for the instructions ordering that makes the cache ineffective,
+// e.g. COPY of the whole context before the dependencies installation
+func Lint(commands []ConfigCommand) (warnings []LintWarning) {
+	warn := func(cfg ConfigCommand, format string, args ...interface{}) {
+		warnings = append(warnings, LintWarning{
+			Command: cfg.original,
+			Message: fmt.Sprintf(format, args...),
+		})
+	}
+
+	for i, cfg := range commands {
+		if cfg.isOnbuild {
+			continue
+		}
+
+		switch cfg.name {
+		case "copy", "add":
+			if copiesWholeContext(cfg) {
+				if run, ok := nextRun(commands[i+1:], depInstallRegexp); ok {
+					warn(cfg, "the whole context is copied before `%s`, so any change re-installs the dependencies; copy the dependency manifests first and the rest after the installation", run.original)
+				}
+			}
+			if _, ok := cfg.flags["checksum"]; cfg.name == "add" && !ok && hasURLSource(cfg) {
+				warn(cfg, "the URL content may change without notice, pin it with ADD --checksum=sha256:<hex>")
+			}
+
+		case "env":
+			if _, ok := cfg.flags["no-cache-bust"]; ok {
+				continue
+			}
+			if name, ok := timestampEnv(cfg); ok {
+				if run, ok := nextRun(commands[i+1:], nil); ok {
+					warn(cfg, "%s looks like a timestamp and busts the cache of `%s` and the following steps on every build; use ENV --no-cache-bust", name, run.original)
+				}
+			}
+		}
+	}
+
+	return warnings
+}
+
+// lint reports the findings of Lint about the plan as warnings
+func (b *Build) lint(plan Plan) error {
+	commands := []ConfigCommand{}
+	for _, command := range plan {
+		if cfg, ok := commandConfig(command); ok {
+			commands = append(commands, cfg)
+		}
+	}
+
+	for _, w := range Lint(commands) {
+		if err := b.warn("%s", w); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// copiesWholeContext returns true if COPY or ADD has the context root as a source
+func copiesWholeContext(cfg ConfigCommand) bool {
+	if len(cfg.args) < 2 {
+		return false
+	}
+	for _, src := range cfg.args[:len(cfg.args)-1] {
+		if src = path.Clean(strings.TrimSuffix(src, "*")); src == "." || src == "/" {
+			return true
+		}
+	}
+	return false
+}
+
+func hasURLSource(cfg ConfigCommand) bool {
+	if len(cfg.args) < 2 {
+		return false
+	}
+	for _, src := range cfg.args[:len(cfg.args)-1] {
+		if isURL(src) {
+			return true
+		}
+	}
+	return false
+}
+
+// timestampEnv returns the name of the variable set by ENV that looks like a build timestamp
+func timestampEnv(cfg ConfigCommand) (string, bool) {
+	for j := 0; j+1 < len(cfg.args); j += 2 {
+		if timestampEnvName.MatchString(cfg.args[j]) || looksLikeTimestamp(cfg.args[j+1]) {
+			return cfg.args[j], true
+		}
+	}
+	return "", false
+}
+
+// nextRun finds the RUN within the current FROM section, matching the regexp if given
+func nextRun(commands []ConfigCommand, re *regexp.Regexp) (ConfigCommand, bool) {
+	for _, cfg := range commands {
+		if cfg.name == "from" {
+			break
+		}
+		if cfg.name != "run" || cfg.isOnbuild {
+			continue
+		}
+		if re == nil || re.MatchString(strings.Join(cfg.args, " ")) {
+			return cfg, true
+		}
+	}
+	return ConfigCommand{}, false
+}
@@ -0,0 +1,124 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/grammarly/rocker/src/template"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLint_WholeContextBeforeInstall(t *testing.T) {
+	warnings := lintSource(t, `
+FROM node
+COPY . /src
+RUN npm install
+`)
+
+	assert.Len(t, warnings, 1)
+	assert.Equal(t, "COPY . /src", warnings[0].Command)
+	assert.Contains(t, warnings[0].Message, "before `RUN npm install`")
+}
+
+func TestLint_ManifestsFirst(t *testing.T) {
+	assert.Empty(t, lintSource(t, `
+FROM node
+COPY package.json /src/
+RUN npm install
+COPY . /src
+RUN npm test
+`))
+}
+
+func TestLint_InstallInOtherSection(t *testing.T) {
+	assert.Empty(t, lintSource(t, `
+FROM node
+COPY . /src
+FROM node
+RUN npm install
+`))
+}
+
+func TestLint_TimestampEnv(t *testing.T) {
+	warnings := lintSource(t, `
+FROM ubuntu
+ENV VERSION=1.2 BUILT=2016-03-01T10:20:30Z
+ENV BUILD_DATE=today
+RUN make
+ENV --no-cache-bust BUILD_TIME=2016-03-01T10:20:30Z
+RUN make install
+`)
+
+	assert.Len(t, warnings, 2)
+	assert.Contains(t, warnings[0].Message, "BUILT looks like a timestamp")
+	assert.Contains(t, warnings[1].Message, "BUILD_DATE looks like a timestamp")
+}
+
+func TestLooksLikeTimestamp(t *testing.T) {
+	for _, value := range []string{"2016-03-01", "2016-03-01T10:20:30Z", "2016-03-01 10:20", "1456827630", "1456827630123"} {
+		assert.True(t, looksLikeTimestamp(value), value)
+	}
+	for _, value := range []string{"1.2", "2016-13-01", "2016-03-01-rc1", "0123456789", "9876543210", "12345678901", "4155550123"} {
+		assert.False(t, looksLikeTimestamp(value), value)
+	}
+}
+
+func TestLint_TimestampEnvAtTheEnd(t *testing.T) {
+	assert.Empty(t, lintSource(t, `
+FROM ubuntu
+RUN make
+ENV BUILD_DATE=1456827630
+`))
+}
+
+func TestLint_AddURL(t *testing.T) {
+	warnings := lintSource(t, `
+FROM ubuntu
+ADD https://example.com/app.tar.gz /tmp/
+ADD --checksum=sha256:abc https://example.com/lib.tar.gz /tmp/
+`)
+
+	assert.Len(t, warnings, 1)
+	assert.Equal(t, "ADD https://example.com/app.tar.gz /tmp/", warnings[0].Command)
+}
+
+func TestBuildLint_Strict(t *testing.T) {
+	b, _ := makeBuild(t, "", Config{Strict: true})
+
+	r, err := NewRockerfile("test", strings.NewReader("FROM node\nCOPY . /src\nRUN npm ci"), template.Vars{}, template.Funs{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	plan, err := NewPlan(r.Commands(), true, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = b.lint(plan)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "(strict mode)")
+}
+
+func lintSource(t *testing.T, source string) []LintWarning {
+	r, err := NewRockerfile("test", strings.NewReader(source), template.Vars{}, template.Funs{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return Lint(r.Commands())
+}
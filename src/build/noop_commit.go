@@ -0,0 +1,78 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"fmt"
+	"reflect"
+
+	"github.com/fsouza/go-dockerclient"
+)
+
+// isNoopCommit returns true if the container of the step changed neither the
+// files nor the config of the image, so the image can be reused as is;
+// the steps with INVALIDATE are always committed, so the key changes the
+// image the following steps are cached on top of, the images to publish too
+func (b *Build) isNoopCommit(s State) (bool, error) {
+	if !b.cfg.SkipNoopCommits || s.NoBaseImage || s.ImageID == "" || s.NoCache.ContainerID == "" || hasInvalidate(s) || s.NoCache.Publish {
+		return false, nil
+	}
+
+	changes, err := b.client.ContainerChanges(s.NoCache.ContainerID)
+	if err != nil {
+		return false, fmt.Errorf("Failed to get the changes of container %.12s, error: %s", s.NoCache.ContainerID, err)
+	}
+	if len(changes) > 0 {
+		return false, nil
+	}
+
+	img, err := b.client.InspectImage(s.ImageID)
+	if err != nil {
+		return false, err
+	}
+	if img == nil || img.Config == nil {
+		return false, nil
+	}
+
+	return sameImageConfig(img.Config, &s.Config), nil
+}
+
+// sameImageConfig compares the parts of the configs that are committed to the
+// image, the empty values are equal to the missing ones
+func sameImageConfig(a, b *docker.Config) bool {
+	return sameStrings(a.Cmd, b.Cmd) &&
+		sameStrings(a.Entrypoint, b.Entrypoint) &&
+		sameStrings(a.Env, b.Env) &&
+		sameStrings(a.OnBuild, b.OnBuild) &&
+		a.User == b.User &&
+		a.WorkingDir == b.WorkingDir &&
+		a.StopSignal == b.StopSignal &&
+		sameLabels(withoutIntermediateLabels(a.Labels), withoutIntermediateLabels(b.Labels)) &&
+		(len(a.ExposedPorts) == 0 && len(b.ExposedPorts) == 0 || reflect.DeepEqual(a.ExposedPorts, b.ExposedPorts)) &&
+		(len(a.Volumes) == 0 && len(b.Volumes) == 0 || reflect.DeepEqual(a.Volumes, b.Volumes))
+}
+
+func sameLabels(a, b map[string]string) bool {
+	return len(a) == 0 && len(b) == 0 || reflect.DeepEqual(a, b)
+}
+
+func sameStrings(a, b []string) bool {
+	if len(a) == 0 && len(b) == 0 {
+		return true
+	}
+	return reflect.DeepEqual(a, b)
+}
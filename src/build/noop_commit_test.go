@@ -0,0 +1,116 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"os"
+	"testing"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestSameImageConfig(t *testing.T) {
+	a := &docker.Config{Cmd: []string{"/bin/sh"}, Env: []string{"A=1"}, Labels: map[string]string{}}
+	b := &docker.Config{Cmd: []string{"/bin/sh"}, Env: []string{"A=1"}, Entrypoint: []string{}}
+
+	assert.True(t, sameImageConfig(a, b), "empty values should be equal to the missing ones")
+
+	b.Env = []string{"A=2"}
+	assert.False(t, sameImageConfig(a, b))
+
+	b.Env = a.Env
+	b.Labels = map[string]string{"version": "1"}
+	assert.False(t, sameImageConfig(a, b))
+
+	b.Labels = nil
+	b.WorkingDir = "/app"
+	assert.False(t, sameImageConfig(a, b))
+}
+
+func TestCommandCommit_SkipNoop(t *testing.T) {
+	tmpDir := cacheTestTmpDir(t)
+	defer os.RemoveAll(tmpDir)
+
+	b, c := makeBuild(t, "", Config{SkipNoopCommits: true})
+	b.cache = NewCacheFS(tmpDir, Hashes[DefaultHash])
+	cmd := &CommandCommit{}
+
+	b.state.ParentID = "100"
+	b.state.ImageID = "123"
+	b.state.Config.Cmd = []string{"/bin/sh"}
+	b.state.NoCache.ContainerID = "456"
+	b.state.Commit("RUN true")
+
+	c.On("ContainerChanges", "456").Return([]docker.Change{}, nil).Once()
+	c.On("InspectImage", "123").Return(&docker.Image{ID: "123", Config: &docker.Config{Cmd: []string{"/bin/sh"}}}, nil).Once()
+	c.On("RemoveContainer", "456").Return(nil).Once()
+
+	state, err := cmd.Execute(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.AssertExpectations(t)
+	assert.Equal(t, "123", state.ImageID)
+	assert.Equal(t, "100", state.ParentID, "should keep the parent of the image")
+	assert.Equal(t, "", state.NoCache.ContainerID)
+	assert.Equal(t, "", state.GetCommits())
+
+	// the next build hits the cache
+	probe := State{ParentID: "100", ImageID: "123"}
+	probe.Commit("RUN true")
+	cached, err := b.cache.Get(probe)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if assert.NotNil(t, cached) {
+		assert.Equal(t, "123", cached.ImageID)
+	}
+
+	c.On("InspectImage", "123").Return(&docker.Image{ID: "123"}, nil).Once()
+
+	hitState, hit, err := b.probeCache(probe)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, hit)
+	assert.Equal(t, "123", hitState.ImageID)
+	assert.Equal(t, "100", hitState.ParentID, "should keep the parent of the image")
+}
+
+func TestCommandCommit_SkipNoopChanged(t *testing.T) {
+	b, c := makeBuild(t, "", Config{SkipNoopCommits: true})
+	cmd := &CommandCommit{}
+
+	b.state.ImageID = "123"
+	b.state.NoCache.ContainerID = "456"
+	b.state.Commit("RUN touch /a")
+
+	c.On("ContainerChanges", "456").Return([]docker.Change{{Path: "/a", Kind: docker.ChangeAdd}}, nil).Once()
+	c.On("CommitContainer", mock.AnythingOfType("State")).Return(&docker.Image{ID: "789"}, nil).Once()
+	c.On("RemoveContainer", "456").Return(nil).Once()
+
+	state, err := cmd.Execute(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.AssertExpectations(t)
+	assert.Equal(t, "789", state.ImageID)
+}
@@ -0,0 +1,146 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/grammarly/rocker/src/imagename"
+	"github.com/grammarly/rocker/src/util"
+)
+
+// checkOffline fails the build before it starts, in offline mode, if any
+// of the steps needs network: a FROM or ADD image:// image that is not
+// present locally, a url that is not downloaded yet, or PUSH with --push;
+// all of them are listed, so the build can be made hermetic at once
+func (b *Build) checkOffline(plan Plan) error {
+	if !util.Offline() {
+		return nil
+	}
+
+	steps := []string{}
+
+	for _, command := range plan {
+		cfg, ok := commandConfig(command)
+		if !ok || cfg.isOnbuild {
+			continue
+		}
+		needs, err := b.networkNeeds(cfg)
+		if err != nil {
+			return err
+		}
+		if len(needs) == 0 {
+			continue
+		}
+		location := cfg.original
+		if cfg.line > 0 && b.rockerfile != nil {
+			location = fmt.Sprintf("%s:%d: %s", b.rockerfile.Name, cfg.line, cfg.original)
+		}
+		steps = append(steps, fmt.Sprintf("%s (%s)", location, strings.Join(needs, ", ")))
+	}
+
+	if len(steps) == 0 {
+		return nil
+	}
+
+	return fmt.Errorf("%d step(s) require network, which is not allowed in offline mode (--offline):\n  %s",
+		len(steps), strings.Join(steps, "\n  "))
+}
+
+// networkNeeds returns the network operations the instruction is going to do
+func (b *Build) networkNeeds(cfg ConfigCommand) (needs []string, err error) {
+	switch cfg.name {
+	case "from":
+		if len(cfg.args) != 1 || cfg.args[0] == "scratch" {
+			return nil, nil
+		}
+		name, _ := b.fromImageName(cfg)
+		return b.pullNeeds(name)
+
+	case "add", "copy":
+		if len(cfg.args) < 2 {
+			return nil, nil
+		}
+		for _, src := range cfg.args[:len(cfg.args)-1] {
+			var srcNeeds []string
+			switch {
+			case isURL(src):
+				if b.cfg.NoCache {
+					srcNeeds = []string{"download " + src}
+				} else if _, err := b.urlFetcher.GetInfo(src); err != nil {
+					srcNeeds = []string{"download " + src}
+				}
+			case cfg.name == "add" && isImageSource(src):
+				image, _, err := parseImageSource(src)
+				if err != nil {
+					return nil, err
+				}
+				if srcNeeds, err = b.pullNeeds(image); err != nil {
+					return nil, err
+				}
+			}
+			needs = append(needs, srcNeeds...)
+		}
+		return needs, nil
+
+	case "push":
+		if b.cfg.Push {
+			needs := []string{}
+			for _, name := range cfg.args {
+				needs = append(needs, "push "+name)
+			}
+			return needs, nil
+		}
+
+	case "artifact":
+		if _, _, ref, err := parseArtifactArgs(cfg); b.cfg.Push && err == nil {
+			return []string{"push " + ref}, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// pullNeeds checks if the image has to be pulled, like lookupImage does
+func (b *Build) pullNeeds(name string) ([]string, error) {
+	if b.cfg.Pull {
+		return []string{"pull " + name + " with --pull"}, nil
+	}
+
+	img := imagename.NewFromString(name)
+
+	if strings.Contains(img.Tag, "*") && !img.TagIsSha() {
+		local, err := b.client.ListImages()
+		if err != nil {
+			return nil, err
+		}
+		if img.ResolveVersion(local, true) != nil {
+			return nil, nil
+		}
+		return []string{"resolve " + name + " in the registry"}, nil
+	}
+
+	found, err := b.client.InspectImage(img.String())
+	if err != nil {
+		return nil, err
+	}
+	if found == nil {
+		return []string{"pull " + name}, nil
+	}
+	return nil, nil
+}
@@ -0,0 +1,62 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/grammarly/rocker/src/imagename"
+	"github.com/grammarly/rocker/src/util"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBuild_Run_Offline(t *testing.T) {
+	util.SetOffline(true)
+	defer util.SetOffline(false)
+
+	cacheDir, err := ioutil.TempDir("", "rocker-offline-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cacheDir)
+
+	b, c := makeBuild(t, "FROM ubuntu\n"+
+		"ADD image://tools:1:/bin/tool /bin/\n"+
+		"ADD https://example.com/app.tar.gz /\n"+
+		"FROM golang:1.*\n"+
+		"PUSH app:1\n", Config{Push: true, CacheDir: cacheDir})
+
+	plan, err := NewPlan(b.rockerfile.Commands(), true, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.On("InspectImage", "ubuntu:latest").Return((*docker.Image)(nil), nil).Once()
+	c.On("InspectImage", "tools:1").Return(&docker.Image{ID: "123"}, nil).Once()
+	c.On("ListImages").Return([]*imagename.ImageName{imagename.NewFromString("golang:1.6")}, nil).Once()
+
+	err = b.Run(plan)
+	assert.EqualError(t, err, "3 step(s) require network, which is not allowed in offline mode (--offline):\n"+
+		"  "+b.rockerfile.Name+":1: FROM ubuntu (pull ubuntu)\n"+
+		"  "+b.rockerfile.Name+":3: ADD https://example.com/app.tar.gz / (download https://example.com/app.tar.gz)\n"+
+		"  "+b.rockerfile.Name+":5: PUSH app:1 (push app:1)")
+	c.AssertExpectations(t)
+}
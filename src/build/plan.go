@@ -16,32 +16,59 @@
 
 package build
 
-import "strings"
+import (
+	"fmt"
+	"strings"
+)
 
 // Plan is the list of commands to be executed sequentially by a build process
 type Plan []Command
 
-// NewPlan makes a new plan out of the list of commands from a Rockerfile
-func NewPlan(commands []ConfigCommand, finalCleanup bool) (plan Plan, err error) {
+// NewPlan makes a new plan out of the list of commands from a Rockerfile;
+// with autoBatch the pending metadata changes, e.g. ENV or LABEL, are committed
+// along with the next RUN, COPY or ADD instead of a separate layer
+func NewPlan(commands []ConfigCommand, finalCleanup, autoBatch bool) (plan Plan, err error) {
 	plan = Plan{}
 
+	if commands, err = expandUserCreate(commands); err != nil {
+		return nil, err
+	}
+
+	commands = deferNoCacheBustEnv(commands)
+
+	if err = checkCacheOnly(commands); err != nil {
+		return nil, err
+	}
+
 	committed := true
 
+	// cacheOnly is the FROM of the current section if it is cache-only
+	var cacheOnly *ConfigCommand
+
 	commit := func() {
 		plan = append(plan, &CommandCommit{})
 		committed = true
 	}
 
 	cleanup := func(i int) {
-		plan = append(plan, &CommandCleanup{
+		c := &CommandCleanup{
 			final:  i == len(commands)-1,
 			tagged: strings.Contains("tag push from", commands[i].name),
-		})
+		}
+		if cacheOnly != nil {
+			c.cacheOnly, c.section = true, cacheOnly.flags["as"]
+		}
+		plan = append(plan, c)
 	}
 
-	alwaysCommitBefore := "run attach add copy tag push export import"
+	alwaysCommitBefore := "run attach test smoke add copy tag push export import readvars"
+	if autoBatch {
+		// The commits of the pending changes become the part of the cache
+		// key of the next step, so the cache stays correct
+		alwaysCommitBefore = "attach test smoke tag push export import readvars"
+	}
 	alwaysCommitAfter := "run attach add copy export import"
-	neverCommitAfter := "from maintainer tag push"
+	neverCommitAfter := "from maintainer tag push test smoke artifact readvars"
 
 	for i := 0; i < len(commands); i++ {
 		cfg := commands[i]
@@ -57,6 +84,10 @@ func NewPlan(commands []ConfigCommand, finalCleanup bool) (plan Plan, err error)
 			if i > 0 {
 				cleanup(i - 1)
 			}
+			cacheOnly = nil
+			if isCacheOnly(cfg) {
+				cacheOnly = &commands[i]
+			}
 		}
 
 		// Commit before commands that require state
@@ -90,3 +121,65 @@ func NewPlan(commands []ConfigCommand, finalCleanup bool) (plan Plan, err error)
 
 	return plan, err
 }
+
+// isCacheOnly tells if the FROM starts a cache-only section,
+// i.e. FROM <image> CACHEONLY or FROM --cache-only <image>
+func isCacheOnly(cfg ConfigCommand) bool {
+	_, ok := cfg.flags["cache-only"]
+	return cfg.name == "from" && ok
+}
+
+// checkCacheOnly fails if a cache-only section has the instructions that
+// make an image to keep, a cache-only section only warms the build cache
+func checkCacheOnly(commands []ConfigCommand) error {
+	cacheOnly := false
+	for _, cfg := range commands {
+		if cfg.name == "from" {
+			cacheOnly = isCacheOnly(cfg)
+			continue
+		}
+		if cacheOnly && !cfg.isOnbuild && strings.Contains("tag push artifact", cfg.name) {
+			return fmt.Errorf("%s is not allowed in a cache-only FROM section, its image is never kept: %s", strings.ToUpper(cfg.name), cfg.original)
+		}
+	}
+	return nil
+}
+
+// deferNoCacheBustEnv moves `ENV --no-cache-bust` instructions to the end of
+// their FROM section, right before the trailing TAG and PUSH instructions.
+// So metadata-only variables, e.g. BUILD_DATE, are applied to the final image
+// config and don't invalidate the cache of the steps that follow them.
+func deferNoCacheBustEnv(commands []ConfigCommand) []ConfigCommand {
+	result := []ConfigCommand{}
+
+	for start := 0; start < len(commands); {
+		end := start + 1
+		for end < len(commands) && commands[end].name != "from" {
+			end++
+		}
+
+		section := []ConfigCommand{}
+		deferred := []ConfigCommand{}
+
+		for _, cfg := range commands[start:end] {
+			if _, ok := cfg.flags["no-cache-bust"]; ok && cfg.name == "env" {
+				deferred = append(deferred, cfg)
+				continue
+			}
+			section = append(section, cfg)
+		}
+
+		tail := len(section)
+		for tail > 0 && strings.Contains("tag push", section[tail-1].name) {
+			tail--
+		}
+
+		result = append(result, section[:tail]...)
+		result = append(result, deferred...)
+		result = append(result, section[tail:]...)
+
+		start = end
+	}
+
+	return result
+}
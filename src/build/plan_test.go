@@ -268,6 +268,29 @@ TAG my-build
 	}
 }
 
+func TestPlan_TestNeverCommits(t *testing.T) {
+	p := makePlan(t, `
+FROM ubuntu
+ENV CI=1
+TEST ./run-tests.sh
+TAG my-build
+`)
+
+	expected := []Command{
+		&CommandFrom{},
+		&CommandEnv{},
+		&CommandCommit{},
+		&CommandTest{},
+		&CommandTag{},
+		&CommandCleanup{},
+	}
+
+	assert.Len(t, p, len(expected))
+	for i, c := range expected {
+		assert.IsType(t, c, p[i])
+	}
+}
+
 func TestPlan_Scratch(t *testing.T) {
 	p := makePlan(t, `
 FROM scratch
@@ -330,12 +353,162 @@ FROM alpine
 	assert.False(t, c.(*CommandCleanup).final)
 }
 
+func TestPlan_CleanupCacheOnly(t *testing.T) {
+	p := makePlan(t, `
+FROM node AS deps CACHEONLY
+RUN npm install
+FROM --cache-only alpine
+FROM ubuntu
+`)
+
+	// from, run, commit, cleanup, from, cleanup, from, cleanup
+	assert.Equal(t, &CommandCleanup{cacheOnly: true, section: "deps"}, p[3])
+	assert.Equal(t, &CommandCleanup{tagged: true, cacheOnly: true}, p[5])
+	assert.Equal(t, &CommandCleanup{tagged: true, final: true}, p[7])
+}
+
+func TestPlan_CacheOnlyTag(t *testing.T) {
+	b, _ := makeBuild(t, `
+FROM node CACHEONLY
+RUN npm install
+TAG deps
+`, Config{})
+
+	_, err := NewPlan(b.rockerfile.Commands(), true, false)
+	assert.EqualError(t, err, "TAG is not allowed in a cache-only FROM section, its image is never kept: TAG deps")
+}
+
+func TestPlan_UserCreate(t *testing.T) {
+	p := makePlan(t, `
+FROM ubuntu
+USER app:app --create
+RUN make
+`)
+
+	expected := []Command{
+		&CommandFrom{},
+		&CommandRun{},
+		&CommandCommit{},
+		&CommandUser{},
+		&CommandCommit{},
+		&CommandRun{},
+		&CommandCommit{},
+		&CommandCleanup{},
+	}
+
+	assert.Len(t, p, len(expected))
+	for i, c := range expected {
+		assert.IsType(t, c, p[i])
+	}
+}
+
+func TestPlan_EnvNoCacheBust(t *testing.T) {
+	b, _ := makeBuild(t, `
+FROM ubuntu
+ENV --no-cache-bust BUILD_DATE=today
+RUN make
+ENV PORT=80
+TAG my-build
+PUSH my-build:1
+FROM alpine
+ENV --no-cache-bust BUILD_DATE=today
+COPY . /
+`, Config{})
+
+	commands := deferNoCacheBustEnv(b.rockerfile.Commands())
+
+	originals := []string{}
+	for _, cfg := range commands {
+		originals = append(originals, cfg.original)
+	}
+
+	assert.Equal(t, []string{
+		"FROM ubuntu",
+		"RUN make",
+		"ENV PORT=80",
+		"ENV --no-cache-bust BUILD_DATE=today",
+		"TAG my-build",
+		"PUSH my-build:1",
+		"FROM alpine",
+		"COPY . /",
+		"ENV --no-cache-bust BUILD_DATE=today",
+	}, originals)
+
+	p, err := NewPlan(b.rockerfile.Commands(), true, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []Command{
+		&CommandFrom{},
+		&CommandRun{},
+		&CommandCommit{},
+		&CommandEnv{},
+		&CommandEnv{},
+		&CommandCommit{},
+		&CommandTag{},
+		&CommandPush{},
+		&CommandCleanup{},
+		&CommandFrom{},
+		&CommandCopy{},
+		&CommandCommit{},
+		&CommandEnv{},
+		&CommandCommit{},
+		&CommandCleanup{},
+	}
+
+	assert.Len(t, p, len(expected))
+	for i, c := range expected {
+		assert.IsType(t, c, p[i])
+	}
+}
+
+func TestPlan_AutoBatch(t *testing.T) {
+	b, _ := makeBuild(t, `
+FROM ubuntu
+ENV name=web
+WORKDIR /app
+RUN make
+EXPOSE 80
+LABEL version=1.2
+COPY . /app
+USER app
+TAG my-build
+`, Config{})
+
+	p, err := NewPlan(b.rockerfile.Commands(), true, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []Command{
+		&CommandFrom{},
+		&CommandEnv{},
+		&CommandWorkdir{},
+		&CommandRun{},
+		&CommandCommit{},
+		&CommandExpose{},
+		&CommandLabel{},
+		&CommandCopy{},
+		&CommandCommit{},
+		&CommandUser{},
+		&CommandCommit{},
+		&CommandTag{},
+		&CommandCleanup{},
+	}
+
+	assert.Len(t, p, len(expected))
+	for i, c := range expected {
+		assert.IsType(t, c, p[i])
+	}
+}
+
 // internal helpers
 
 func makePlan(t *testing.T, rockerfileContent string) Plan {
 	b, _ := makeBuild(t, rockerfileContent, Config{})
 
-	p, err := NewPlan(b.rockerfile.Commands(), true)
+	p, err := NewPlan(b.rockerfile.Commands(), true, false)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -0,0 +1,236 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path"
+	"strings"
+
+	"github.com/go-yaml/yaml"
+	"github.com/grammarly/rocker/src/imagename"
+)
+
+// Policy restricts the images the builds may be based on and push to;
+// a section that is not given does not restrict anything
+type Policy struct {
+	// From are the images allowed in FROM and ADD image://
+	From []PolicyRule `yaml:"from"`
+
+	// Push are the allowed PUSH destinations
+	Push []PolicyRule `yaml:"push"`
+
+	// BaseDigests verifies the digests the FROM images are resolved to
+	BaseDigests *BaseDigestPolicy `yaml:"base-digests"`
+
+	fileName string
+}
+
+// PolicyRule allows the images whose canonical name matches the pattern,
+// e.g. registry.internal/base/* or registry.internal/**
+type PolicyRule struct {
+	Image string `yaml:"image"`
+
+	// RequireDigest allows only the images pinned by digest, e.g. ubuntu@sha256:...
+	RequireDigest bool `yaml:"require-digest"`
+
+	pattern string
+}
+
+// PolicyViolation is the instruction that is not allowed by the policy
+type PolicyViolation struct {
+	Command string `json:"command"`
+	Message string `json:"message"`
+}
+
+// String returns the human readable representation of the violation
+func (v PolicyViolation) String() string {
+	return fmt.Sprintf("%s: %s", v.Command, v.Message)
+}
+
+// ReadPolicy reads the policy file and validates its patterns
+func ReadPolicy(fileName string) (*Policy, error) {
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read policy file %s, error: %s", fileName, err)
+	}
+
+	p := &Policy{fileName: fileName}
+	if err := yaml.Unmarshal(data, p); err != nil {
+		return nil, fmt.Errorf("Failed to parse policy file %s, error: %s", fileName, err)
+	}
+
+	for _, rules := range [][]PolicyRule{p.From, p.Push} {
+		for i := range rules {
+			if err := rules[i].compile(); err != nil {
+				return nil, fmt.Errorf("Invalid policy file %s, error: %s", fileName, err)
+			}
+		}
+	}
+
+	if p.BaseDigests != nil {
+		if err := p.BaseDigests.compile(); err != nil {
+			return nil, fmt.Errorf("Invalid policy file %s, error: %s", fileName, err)
+		}
+	}
+
+	return p, nil
+}
+
+// compile makes the pattern of the canonical names out of the rule image,
+// so ubuntu and docker.io/library/ubuntu are the same
+func (r *PolicyRule) compile() error {
+	if r.Image == "" {
+		return fmt.Errorf("rule image is empty")
+	}
+
+	image, recursive := r.Image, false
+	if strings.HasSuffix(image, "/**") {
+		image, recursive = strings.TrimSuffix(image, "/**")+"/*", true
+	}
+
+	img := imagename.NewFromString(image)
+	if img.HasTag() {
+		return fmt.Errorf("rule image %s should have no tag", r.Image)
+	}
+
+	r.pattern = img.CanonicalName()
+	if _, err := path.Match(r.pattern, ""); err != nil {
+		return fmt.Errorf("rule image %s is malformed, error: %s", r.Image, err)
+	}
+	if recursive {
+		r.pattern += "*"
+	}
+
+	return nil
+}
+
+// match returns true if the canonical image name matches the rule;
+// the pattern ending with ** matches the nested names too
+func (r PolicyRule) match(img *imagename.ImageName) bool {
+	name := img.CanonicalName()
+	if strings.HasSuffix(r.pattern, "/**") {
+		return strings.HasPrefix(name, strings.TrimSuffix(r.pattern, "**"))
+	}
+	ok, _ := path.Match(r.pattern, name)
+	return ok
+}
+
+// Check returns the instructions that are not allowed by the policy
+func (p *Policy) Check(commands []ConfigCommand) (violations []PolicyViolation) {
+	violate := func(cfg ConfigCommand, format string, args ...interface{}) {
+		violations = append(violations, PolicyViolation{
+			Command: cfg.original,
+			Message: fmt.Sprintf(format, args...),
+		})
+	}
+
+	for _, cfg := range commands {
+		if len(cfg.args) == 0 {
+			continue
+		}
+
+		switch cfg.name {
+		case "from":
+			if cfg.args[0] != "scratch" {
+				p.checkFrom(cfg, cfg.args[0], violate)
+			}
+
+		case "add":
+			for _, src := range cfg.args[:len(cfg.args)-1] {
+				if !isImageSource(src) {
+					continue
+				}
+				if image, _, err := parseImageSource(src); err == nil {
+					p.checkFrom(cfg, image, violate)
+				}
+			}
+
+		case "push":
+			if p.Push == nil {
+				continue
+			}
+			for _, name := range cfg.args {
+				img := imagename.NewFromString(name)
+				if _, ok := matchPolicy(p.Push, img); !ok {
+					violate(cfg, "%s is not an allowed push destination", img.CanonicalName())
+				}
+			}
+		}
+	}
+
+	return violations
+}
+
+func (p *Policy) checkFrom(cfg ConfigCommand, name string, violate func(ConfigCommand, string, ...interface{})) {
+	if p.From == nil {
+		return
+	}
+
+	img := imagename.NewFromString(name)
+
+	rule, ok := matchPolicy(p.From, img)
+	if !ok {
+		violate(cfg, "%s is not an allowed base image", img.CanonicalName())
+		return
+	}
+	if rule.RequireDigest && !img.TagIsDigest() {
+		violate(cfg, "%s should be pinned by digest, e.g. %s@sha256:<digest>", img.CanonicalName(), img.NameWithRegistry())
+	}
+}
+
+// matchPolicy returns the first rule matching the image
+func matchPolicy(rules []PolicyRule, img *imagename.ImageName) (PolicyRule, bool) {
+	for _, rule := range rules {
+		if rule.match(img) {
+			return rule, true
+		}
+	}
+	return PolicyRule{}, false
+}
+
+// checkPolicy fails the build before it starts if the plan violates the policy
+func (b *Build) checkPolicy(plan Plan) error {
+	if b.cfg.Policy == nil {
+		return nil
+	}
+
+	commands := []ConfigCommand{}
+	for _, command := range plan {
+		if cfg, ok := commandConfig(command); ok {
+			if cfg.name == "push" {
+				cfg.args = b.withPushMirrors(cfg.args)
+			}
+			commands = append(commands, cfg)
+		}
+	}
+
+	return b.cfg.Policy.Error(b.cfg.Policy.Check(commands))
+}
+
+// Error returns the error that reports all the violations, nil if there are none
+func (p *Policy) Error(violations []PolicyViolation) error {
+	if len(violations) == 0 {
+		return nil
+	}
+	lines := []string{}
+	for _, v := range violations {
+		lines = append(lines, "  "+v.String())
+	}
+	return fmt.Errorf("The Rockerfile violates policy %s:\n%s", p.fileName, strings.Join(lines, "\n"))
+}
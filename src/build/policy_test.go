@@ -0,0 +1,140 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/grammarly/rocker/src/imagename"
+	"github.com/grammarly/rocker/src/template"
+	"github.com/stretchr/testify/assert"
+)
+
+const testPolicy = `
+from:
+  - image: registry.internal/**
+  - image: ubuntu
+    require-digest: true
+push:
+  - image: registry.internal/apps/*
+`
+
+func TestPolicy_Allowed(t *testing.T) {
+	assert.Empty(t, checkPolicySource(t, testPolicy, `
+FROM registry.internal/base/java:8
+ADD image://registry.internal/tools:1:/bin/tool /bin/
+FROM ubuntu@sha256:2f0d1e2c7b8f43ad2a4b4e27f9e0b1c1f1a4f0b3e4c9f6f7d2f1e3c8b5a6d7e8
+FROM scratch
+PUSH registry.internal/apps/web:1
+`))
+}
+
+func TestPolicy_Violations(t *testing.T) {
+	violations := checkPolicySource(t, testPolicy, `
+FROM evil/base
+FROM ubuntu:16.04
+ADD image://alpine:3.4:/bin/sh /bin/
+PUSH registry.internal/other/web:1
+`)
+
+	assert.Len(t, violations, 4)
+	assert.Equal(t, "FROM evil/base", violations[0].Command)
+	assert.Contains(t, violations[0].Message, "docker.io/evil/base is not an allowed base image")
+	assert.Contains(t, violations[1].Message, "should be pinned by digest")
+	assert.Contains(t, violations[2].Message, "docker.io/library/alpine is not an allowed base image")
+	assert.Contains(t, violations[3].Message, "registry.internal/other/web is not an allowed push destination")
+}
+
+func TestPolicy_NoSectionNoRestriction(t *testing.T) {
+	assert.Empty(t, checkPolicySource(t, "push: [{image: registry.internal/*}]", `
+FROM anything/goes
+`))
+}
+
+func TestCheckPolicy_ForbiddenPushMirror(t *testing.T) {
+	p, err := readPolicySource(t, testPolicy)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, _ := makeBuild(t, "FROM registry.internal/base/java:8\nPUSH registry.internal/apps/web:1\n", Config{Policy: p})
+
+	plan, err := NewPlan(b.rockerfile.Commands(), true, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NoError(t, b.checkPolicy(plan))
+
+	b.cfg.PushMirrors = imagename.PushMirrors{"registry.internal": {"public.example.com"}}
+	err = b.checkPolicy(plan)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "PUSH registry.internal/apps/web:1: public.example.com/apps/web is not an allowed push destination")
+}
+
+func TestPolicy_Invalid(t *testing.T) {
+	for _, source := range []string{
+		"from: [{image: ''}]",
+		"from: [{image: 'ubuntu:16.04'}]",
+		"from: [{image: 'registry.internal/[a'}]",
+	} {
+		_, err := readPolicySource(t, source)
+		assert.Error(t, err, source)
+	}
+}
+
+func TestPolicy_Error(t *testing.T) {
+	p, err := readPolicySource(t, testPolicy)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Nil(t, p.Error(nil))
+
+	err = p.Error([]PolicyViolation{
+		{Command: "FROM a", Message: "no"},
+		{Command: "PUSH b", Message: "neither"},
+	})
+	assert.Contains(t, err.Error(), "violates policy")
+	assert.Contains(t, err.Error(), "\n  FROM a: no\n  PUSH b: neither")
+}
+
+func readPolicySource(t *testing.T, source string) (*Policy, error) {
+	tmpDir := cacheTestTmpDir(t)
+	defer os.RemoveAll(tmpDir)
+
+	fileName := filepath.Join(tmpDir, "policy.yml")
+	if err := ioutil.WriteFile(fileName, []byte(source), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return ReadPolicy(fileName)
+}
+
+func checkPolicySource(t *testing.T, policy, source string) []PolicyViolation {
+	p, err := readPolicySource(t, policy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := NewRockerfile("test", strings.NewReader(source), template.Vars{}, template.Funs{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p.Check(r.Commands())
+}
@@ -0,0 +1,142 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"sync"
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/grammarly/rocker/src/imagename"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// prefetchJobs is how many FROM images are resolved at the same time
+var prefetchJobs = 4
+
+// prefetchFrom starts resolving the FROM images of the plan concurrently,
+// so the registry requests and the pulls overlap with each other and with
+// the rest of the preparation; the returned function waits for them and
+// keeps the found images for CommandFrom. An image that failed to resolve
+// is not an error here, the FROM looks it up once again and reports it.
+func (b *Build) prefetchFrom(plan Plan) (wait func()) {
+	names := b.prefetchNames(plan)
+	if !b.cfg.Prefetch || len(names) == 0 {
+		return func() {}
+	}
+
+	type result struct {
+		name     string
+		img      *docker.Image
+		err      error
+		duration time.Duration
+	}
+
+	var (
+		results = make(chan result, len(names))
+		jobs    = make(chan struct{}, prefetchJobs)
+		wg      sync.WaitGroup
+	)
+
+	log.Infof("Resolving %d base image(s)", len(names))
+
+	for _, name := range names {
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			jobs <- struct{}{}
+			defer func() { <-jobs }()
+
+			started := time.Now()
+			img, err := b.lookupImage(name)
+			results <- result{name, img, err, time.Since(started)}
+		}(name)
+	}
+
+	return func() {
+		wg.Wait()
+		close(results)
+
+		b.prefetched = map[string]*docker.Image{}
+		for r := range results {
+			switch {
+			case r.err != nil:
+				log.Infof("| %s: %s", r.name, r.err)
+			case r.img == nil:
+				log.Infof("| %s: not found", r.name)
+			default:
+				log.Infof("| %s -> %.12s (%s)", r.name, r.img.ID, r.duration)
+				b.prefetched[r.name] = r.img
+			}
+		}
+	}
+}
+
+// prefetchNames returns the images the FROM instructions of the plan are
+// going to look up, except the ones that are made by the plan itself with
+// TAG or PUSH before the FROM, as their names resolve to the new images
+func (b *Build) prefetchNames(plan Plan) (names []string) {
+	var (
+		seen     = map[string]bool{}
+		produced = map[string]bool{}
+	)
+
+	for _, command := range plan {
+		cfg, ok := commandConfig(command)
+		if !ok || cfg.isOnbuild || len(cfg.args) == 0 {
+			continue
+		}
+		switch cfg.name {
+		case "tag", "push":
+			for _, name := range cfg.args {
+				produced[imagename.NewFromString(name).NameWithRegistry()] = true
+			}
+
+		case "from":
+			if cfg.args[0] == "scratch" || produced[imagename.NewFromString(cfg.args[0]).NameWithRegistry()] {
+				continue
+			}
+			if name, _ := b.fromImageName(cfg); !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+
+	return names
+}
+
+// resolveFrom returns the prefetched image, or looks it up
+func (b *Build) resolveFrom(name string) (*docker.Image, error) {
+	if img, ok := b.prefetched[name]; ok {
+		return img, nil
+	}
+	return b.lookupImage(name)
+}
+
+// fromImageName returns the image of the FROM instruction rewritten to the
+// mirror of its registry, unless --no-mirror; mirrored tells if it was
+func (b *Build) fromImageName(cfg ConfigCommand) (name string, mirrored bool) {
+	name = cfg.args[0]
+	if _, noMirror := cfg.flags["no-mirror"]; !noMirror && len(b.cfg.RegistryMirrors) > 0 {
+		if rewritten, ok := b.cfg.RegistryMirrors.Rewrite(imagename.NewFromString(name)); ok {
+			return rewritten.String(), true
+		}
+	}
+	return name, false
+}
@@ -0,0 +1,87 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPrefetchNames(t *testing.T) {
+	b, _ := makeBuild(t, "FROM ubuntu\n"+
+		"FROM golang:1.*\n"+
+		"TAG app:build\n"+
+		"FROM app:build\n"+
+		"FROM scratch\n"+
+		"FROM ubuntu\n", Config{})
+
+	plan, err := NewPlan(b.rockerfile.Commands(), true, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, []string{"ubuntu", "golang:1.*"}, b.prefetchNames(plan))
+}
+
+func TestPrefetchFrom(t *testing.T) {
+	b, c := makeBuild(t, "FROM ubuntu\nFROM missing\n", Config{Prefetch: true})
+
+	plan, err := NewPlan(b.rockerfile.Commands(), true, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.On("InspectImage", "ubuntu:latest").Return(&docker.Image{ID: "123"}, nil).Once()
+	c.On("InspectImage", "missing:latest").Return((*docker.Image)(nil), nil).Once()
+	c.On("PullImage", "missing:latest").Return(fmt.Errorf("not found")).Once()
+
+	b.prefetchFrom(plan)()
+
+	assert.Equal(t, map[string]*docker.Image{"ubuntu": {ID: "123"}}, b.prefetched)
+
+	// FROM takes the prefetched image without looking it up again
+	cmd := &CommandFrom{CommandBase{ConfigCommand{name: "from", args: []string{"ubuntu"}}}}
+	state, err := cmd.Execute(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.AssertExpectations(t)
+	assert.Equal(t, "123", state.ImageID)
+}
+
+func TestPrefetchFrom_Disabled(t *testing.T) {
+	b, _ := makeBuild(t, "FROM ubuntu\n", Config{})
+
+	plan, err := NewPlan(b.rockerfile.Commands(), true, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b.prefetchFrom(plan)()
+	assert.Nil(t, b.prefetched)
+}
+
+func TestPullLock(t *testing.T) {
+	b, _ := makeBuild(t, "", Config{})
+
+	assert.True(t, b.pullLock("ubuntu:latest") == b.pullLock("ubuntu:latest"))
+	assert.False(t, b.pullLock("ubuntu:latest") == b.pullLock("golang:1.7"))
+}
@@ -0,0 +1,123 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/go-yaml/yaml"
+	"github.com/grammarly/rocker/src/imagename"
+)
+
+// ProjectConfigFile is the name of the project configuration file
+// that is looked up in the build context directory
+const ProjectConfigFile = ".rocker.yml"
+
+// ProjectConfig is the per-project configuration read from .rocker.yml
+type ProjectConfig struct {
+	Hooks        Hooks              `yaml:"hooks"`
+	Mirrors      imagename.Mirrors  `yaml:"mirrors"`
+	HelperImages HelperImagesConfig `yaml:"helper-images"`
+
+	// MirrorPush maps the registries to the mirrors PUSH pushes to as well
+	MirrorPush imagename.PushMirrors `yaml:"mirror-push"`
+
+	// Channels are the publish channels selected by --publish-channel,
+	// they override the default ones of the same name
+	Channels map[string]PublishChannel `yaml:"channels"`
+
+	// Shell wraps the shell form of RUN and TEST, e.g. /bin/bash -euo pipefail -c
+	Shell string `yaml:"shell"`
+}
+
+// HelperImagesConfig overrides the images of MOUNT, CACHE and EXPORT/IMPORT containers
+type HelperImagesConfig struct {
+	Rsync   string `yaml:"rsync"`
+	Scratch string `yaml:"scratch"`
+}
+
+// Apply sets the configured helper images, the ones that are not configured are kept
+func (c HelperImagesConfig) Apply() {
+	if c.Rsync != "" {
+		RsyncImage = c.Rsync
+	}
+	if c.Scratch != "" {
+		MountVolumeImage = c.Scratch
+	}
+}
+
+// ReadProjectConfig reads .rocker.yml from the given directory,
+// the empty config is returned if there is no such file
+func ReadProjectConfig(dir string) (*ProjectConfig, error) {
+	cfg := &ProjectConfig{}
+	fileName := filepath.Join(dir, ProjectConfigFile)
+
+	data, err := ioutil.ReadFile(fileName)
+	if os.IsNotExist(err) {
+		return cfg, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read %s, error: %s", fileName, err)
+	}
+
+	if err := yaml.Unmarshal(data, cfg); err != nil {
+		return nil, fmt.Errorf("Failed to parse %s, error: %s", fileName, err)
+	}
+
+	if err := cfg.Hooks.Validate(); err != nil {
+		return nil, fmt.Errorf("Invalid %s, error: %s", fileName, err)
+	}
+
+	for registry, mirror := range cfg.Mirrors {
+		if registry == "" || mirror == "" {
+			return nil, fmt.Errorf("Invalid %s, error: mirror of registry %q is empty", fileName, registry)
+		}
+	}
+
+	for registry, mirrors := range cfg.MirrorPush {
+		for _, mirror := range mirrors {
+			if registry == "" || mirror == "" {
+				return nil, fmt.Errorf("Invalid %s, error: push mirror of registry %q is empty", fileName, registry)
+			}
+		}
+	}
+
+	for _, name := range []string{cfg.HelperImages.Rsync, cfg.HelperImages.Scratch} {
+		if name == "" {
+			continue
+		}
+		if err := ValidateHelperImage(name); err != nil {
+			return nil, fmt.Errorf("Invalid %s, error: %s", fileName, err)
+		}
+	}
+
+	if _, err := ParseShell(cfg.Shell); err != nil {
+		return nil, fmt.Errorf("Invalid %s, error: %s", fileName, err)
+	}
+
+	for name, ch := range cfg.Channels {
+		ch.Name = name
+		if err := ch.compile(); err != nil {
+			return nil, fmt.Errorf("Invalid %s, error: %s", fileName, err)
+		}
+	}
+
+	return cfg, nil
+}
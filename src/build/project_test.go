@@ -0,0 +1,110 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"os"
+	"testing"
+
+	"github.com/grammarly/rocker/src/imagename"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadProjectConfig(t *testing.T) {
+	tmpDir := makeContextFiles(t, map[string]string{
+		".rocker.yml": "hooks:\n  pre-run: ./scripts/audit.sh\n  post-push: ./scripts/notify.sh\nmirrors:\n  docker.io: mirror.internal\n",
+	})
+	defer os.RemoveAll(tmpDir)
+
+	cfg, err := ReadProjectConfig(tmpDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, Hooks{"pre-run": "./scripts/audit.sh", "post-push": "./scripts/notify.sh"}, cfg.Hooks)
+	assert.Equal(t, imagename.Mirrors{"docker.io": "mirror.internal"}, cfg.Mirrors)
+}
+
+func TestReadProjectConfig_NoFile(t *testing.T) {
+	tmpDir := makeContextFiles(t, map[string]string{})
+	defer os.RemoveAll(tmpDir)
+
+	cfg, err := ReadProjectConfig(tmpDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Len(t, cfg.Hooks, 0)
+}
+
+func TestReadProjectConfig_HelperImages(t *testing.T) {
+	tmpDir := makeContextFiles(t, map[string]string{
+		".rocker.yml": "helper-images:\n  rsync: registry.internal/tools/rsync:1\n",
+	})
+	defer os.RemoveAll(tmpDir)
+
+	cfg, err := ReadProjectConfig(tmpDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, HelperImagesConfig{Rsync: "registry.internal/tools/rsync:1"}, cfg.HelperImages)
+}
+
+func TestReadProjectConfig_InvalidHelperImage(t *testing.T) {
+	tmpDir := makeContextFiles(t, map[string]string{
+		".rocker.yml": "helper-images:\n  scratch: tools/scratch:1.*\n",
+	})
+	defer os.RemoveAll(tmpDir)
+
+	_, err := ReadProjectConfig(tmpDir)
+	assert.Contains(t, err.Error(), "Invalid helper image tools/scratch:1.*, the tag should be exact")
+}
+
+func TestReadProjectConfig_Channels(t *testing.T) {
+	tmpDir := makeContextFiles(t, map[string]string{
+		".rocker.yml": "channels:\n  release:\n    tag: \"{{ .Vars.Version }}\"\n    semver: Version\n",
+	})
+	defer os.RemoveAll(tmpDir)
+
+	cfg, err := ReadProjectConfig(tmpDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, "Version", cfg.Channels["release"].Semver)
+}
+
+func TestReadProjectConfig_InvalidChannel(t *testing.T) {
+	tmpDir := makeContextFiles(t, map[string]string{
+		".rocker.yml": "channels:\n  release:\n    tag: \"{{ .Vars.Version\"\n",
+	})
+	defer os.RemoveAll(tmpDir)
+
+	_, err := ReadProjectConfig(tmpDir)
+	assert.Error(t, err)
+}
+
+func TestReadProjectConfig_InvalidShell(t *testing.T) {
+	tmpDir := makeContextFiles(t, map[string]string{
+		".rocker.yml": "shell: '[\"/bin/bash\", '\n",
+	})
+	defer os.RemoveAll(tmpDir)
+
+	_, err := ReadProjectConfig(tmpDir)
+	assert.Error(t, err)
+}
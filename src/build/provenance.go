@@ -0,0 +1,318 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/pkg/fileutils"
+)
+
+// The types of the in-toto statement and of the SLSA provenance predicate
+const (
+	InTotoStatementType = "https://in-toto.io/Statement/v0.1"
+	SLSAPredicateType   = "https://slsa.dev/provenance/v0.2"
+	RockerBuildType     = "https://github.com/grammarly/rocker/Rockerfile@v1"
+	RockerBuilderID     = "https://github.com/grammarly/rocker"
+)
+
+// ProvenanceStatement is the in-toto statement of the SLSA provenance of
+// the build, see https://slsa.dev/provenance/v0.2
+type ProvenanceStatement struct {
+	Type          string              `json:"_type"`
+	Subject       []ProvenanceSubject `json:"subject"`
+	PredicateType string              `json:"predicateType"`
+	Predicate     ProvenancePredicate `json:"predicate"`
+}
+
+// ProvenanceSubject is an image produced by the build
+type ProvenanceSubject struct {
+	Name   string            `json:"name"`
+	Digest map[string]string `json:"digest"`
+}
+
+// ProvenancePredicate tells how the images were built and of what
+type ProvenancePredicate struct {
+	Builder     ProvenanceBuilder    `json:"builder"`
+	BuildType   string               `json:"buildType"`
+	Invocation  ProvenanceInvocation `json:"invocation"`
+	BuildConfig ProvenanceConfig     `json:"buildConfig"`
+	Metadata    ProvenanceMetadata   `json:"metadata"`
+	Materials   []ProvenanceMaterial `json:"materials"`
+}
+
+// ProvenanceBuilder identifies the rocker that made the build
+type ProvenanceBuilder struct {
+	ID      string `json:"id"`
+	Version string `json:"version,omitempty"`
+}
+
+// ProvenanceInvocation is the Rockerfile, the parameters and the environment of the build
+type ProvenanceInvocation struct {
+	ConfigSource ProvenanceMaterial `json:"configSource"`
+	Parameters   ProvenanceParams   `json:"parameters"`
+	Environment  ProvenanceHost     `json:"environment"`
+}
+
+// ProvenanceParams are the inputs of the build besides the Rockerfile and the context;
+// the values of the secret-looking build args are not recorded, only their names
+type ProvenanceParams struct {
+	BuildArgs  map[string]string `json:"build_args,omitempty"`
+	VarsDigest string            `json:"vars_digest"`
+}
+
+// ProvenanceHost describes the host the build ran on
+type ProvenanceHost struct {
+	Hostname string `json:"hostname"`
+	OS       string `json:"os"`
+	Arch     string `json:"arch"`
+}
+
+// ProvenanceConfig are the steps the build executed
+type ProvenanceConfig struct {
+	Steps []ProvenanceStep `json:"steps"`
+}
+
+// ProvenanceStep is an executed instruction, Digest is the hash of the rendered
+// instruction and Image is the image the build had after it
+type ProvenanceStep struct {
+	Command string `json:"command"`
+	Line    int    `json:"line,omitempty"`
+	Digest  string `json:"digest"`
+	Image   string `json:"image,omitempty"`
+	Cached  bool   `json:"cached,omitempty"`
+}
+
+// ProvenanceMetadata tells when the build ran
+type ProvenanceMetadata struct {
+	BuildStartedOn  time.Time `json:"buildStartedOn"`
+	BuildFinishedOn time.Time `json:"buildFinishedOn"`
+	Reproducible    bool      `json:"reproducible"`
+}
+
+// ProvenanceMaterial is an input of the build: the Rockerfile, a base image or the context
+type ProvenanceMaterial struct {
+	URI        string            `json:"uri"`
+	Digest     map[string]string `json:"digest"`
+	EntryPoint string            `json:"entryPoint,omitempty"`
+}
+
+// ContextDigest returns the hash of the build context after .dockerignore,
+// made of the paths, the modes and the contents of the files; the file times
+// are not the part of it, so a fresh checkout of the same revision has the
+// same digest, e.g. sha256:<hex>
+func ContextDigest(dir string, excludes []string, h Hash) (string, error) {
+	patterns, patDirs, exceptions, err := fileutils.CleanPatterns(excludes)
+	if err != nil {
+		return "", fmt.Errorf("Failed to parse .dockerignore of build context %s, error: %s", dir, err)
+	}
+
+	h = h.orDefault()
+	sum := h.New()
+
+	err = filepath.Walk(dir, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, file)
+		if err != nil || rel == "." {
+			return err
+		}
+
+		skip, err := fileutils.OptimizedMatches(rel, patterns, patDirs)
+		if err != nil {
+			return err
+		}
+		if skip {
+			if info.IsDir() && !exceptions {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		fmt.Fprintf(sum, "%s\x00%o\x00", filepath.ToSlash(rel), info.Mode())
+
+		switch {
+		case info.Mode()&os.ModeSymlink != 0:
+			target, err := os.Readlink(file)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(sum, "%s\x00", target)
+
+		case info.Mode().IsRegular():
+			fmt.Fprintf(sum, "%d\x00", info.Size())
+			fd, err := os.Open(file)
+			if err != nil {
+				return err
+			}
+			defer fd.Close()
+			if _, err := io.Copy(sum, fd); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return "", fmt.Errorf("Failed to compute the digest of build context %s, error: %s", dir, err)
+	}
+
+	return fmt.Sprintf("%s:%x", h.Name, sum.Sum(nil)), nil
+}
+
+// NewProvenanceStatement makes the SLSA provenance of the successful build;
+// contextDigest is the ContextDigest taken before the build, as MOUNTs may
+// change the context while building
+func NewProvenanceStatement(b *Build, builderVersion, contextDigest string) (*ProvenanceStatement, error) {
+	vars, err := json.Marshal(b.rockerfile.Vars.ToJSONMap())
+	if err != nil {
+		return nil, fmt.Errorf("Failed to marshal vars, error: %s", err)
+	}
+
+	hostname, _ := os.Hostname()
+
+	p := &ProvenanceStatement{
+		Type:          InTotoStatementType,
+		Subject:       provenanceSubjects(b),
+		PredicateType: SLSAPredicateType,
+		Predicate: ProvenancePredicate{
+			Builder:   ProvenanceBuilder{ID: RockerBuilderID, Version: builderVersion},
+			BuildType: RockerBuildType,
+			Invocation: ProvenanceInvocation{
+				ConfigSource: ProvenanceMaterial{
+					URI:        b.rockerfile.Name,
+					Digest:     digestSet(b.rockerfile.Hash()),
+					EntryPoint: b.rockerfile.Name,
+				},
+				Parameters: ProvenanceParams{
+					BuildArgs:  map[string]string{},
+					VarsDigest: fmt.Sprintf("sha256:%x", sha256.Sum256(vars)),
+				},
+				Environment: ProvenanceHost{
+					Hostname: hostname,
+					OS:       runtime.GOOS,
+					Arch:     runtime.GOARCH,
+				},
+			},
+			BuildConfig: ProvenanceConfig{Steps: b.executed},
+			Metadata: ProvenanceMetadata{
+				BuildStartedOn:  b.started.UTC(),
+				BuildFinishedOn: time.Now().UTC(),
+			},
+			Materials: []ProvenanceMaterial{},
+		},
+	}
+
+	for name, value := range b.cfg.BuildArgs {
+		if IsSecretName(name) {
+			value = ""
+		}
+		p.Predicate.Invocation.Parameters.BuildArgs[name] = value
+	}
+
+	for _, from := range b.From {
+		digest := from.ID
+		if len(from.Digests) > 0 {
+			digest = from.Digests[0][strings.LastIndex(from.Digests[0], "@")+1:]
+		}
+		p.Predicate.Materials = append(p.Predicate.Materials, ProvenanceMaterial{
+			URI:    "pkg:docker/" + from.Image,
+			Digest: digestSet(digest),
+		})
+	}
+
+	if contextDigest != "" {
+		p.Predicate.Materials = append(p.Predicate.Materials, ProvenanceMaterial{
+			URI:    "file://" + b.cfg.ContextDir,
+			Digest: digestSet(contextDigest),
+		})
+	}
+
+	return p, nil
+}
+
+// provenanceSubjects returns the images and the artifacts the build produced,
+// or the final image if nothing was pushed
+func provenanceSubjects(b *Build) []ProvenanceSubject {
+	subjects := []ProvenanceSubject{}
+
+	for _, a := range b.Artifacts {
+		digest := a.Digest
+		if digest == "" {
+			digest = a.ImageID
+		}
+		if digest == "" {
+			continue
+		}
+		subjects = append(subjects, ProvenanceSubject{Name: a.Name.String(), Digest: digestSet(digest)})
+	}
+
+	if len(subjects) == 0 && b.GetImageID() != "" {
+		subjects = append(subjects, ProvenanceSubject{Name: b.GetImageID(), Digest: digestSet(b.GetImageID())})
+	}
+
+	sort.Sort(subjectsByName(subjects))
+
+	return subjects
+}
+
+// recordStep adds the executed step to the provenance; the image of a
+// commit goes to the instruction it was made for
+func (b *Build) recordStep(command Command) {
+	if _, ok := command.(*CommandCommit); ok && len(b.executed) > 0 {
+		b.executed[len(b.executed)-1].Image = b.state.ImageID
+		return
+	}
+
+	cfg, ok := commandConfig(command)
+	if !ok {
+		return
+	}
+
+	b.executed = append(b.executed, ProvenanceStep{
+		Command: cfg.original,
+		Line:    cfg.line,
+		Digest:  fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(cfg.original))),
+		Image:   b.state.ImageID,
+		Cached:  b.stepCached,
+	})
+}
+
+// digestSet makes the in-toto digest of the "<algorithm>:<hex>" string
+func digestSet(digest string) map[string]string {
+	i := strings.LastIndex(digest, ":")
+	if i < 0 {
+		return map[string]string{"sha256": digest}
+	}
+	return map[string]string{digest[:i]: digest[i+1:]}
+}
+
+// subjectsByName sorts the subjects by name
+type subjectsByName []ProvenanceSubject
+
+func (s subjectsByName) Len() int           { return len(s) }
+func (s subjectsByName) Less(i, j int) bool { return s[i].Name < s[j].Name }
+func (s subjectsByName) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
@@ -0,0 +1,118 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/grammarly/rocker/src/imagename"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewProvenanceStatement(t *testing.T) {
+	b, _ := makeBuild(t, "FROM golang:1.7\nRUN make\nPUSH app:1\n", Config{
+		ContextDir: "/src",
+		BuildArgs:  map[string]string{"VERSION": "1.2", "NPM_TOKEN": "secret"},
+	})
+
+	commands := b.rockerfile.Commands()
+
+	b.From = []FromImage{{Name: "golang:1.7", Image: "golang:1.7", ID: "sha256:111", Digests: []string{"golang@sha256:222"}}}
+
+	b.state.ImageID = "sha256:111"
+	b.recordStep(&CommandFrom{CommandBase{commands[0]}})
+	b.recordStep(&CommandRun{CommandBase{commands[1]}})
+	b.stepCached = true
+	b.state.ImageID = "sha256:333"
+	b.recordStep(&CommandCommit{})
+	b.recordStep(&CommandCleanup{})
+
+	b.Artifacts = []imagename.Artifact{{Name: imagename.NewFromString("app:1"), Digest: "sha256:444", ImageID: "sha256:333"}}
+
+	p, err := NewProvenanceStatement(b, "1.3.0", "sha256:555")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, InTotoStatementType, p.Type)
+	assert.Equal(t, SLSAPredicateType, p.PredicateType)
+	assert.Equal(t, []ProvenanceSubject{{Name: "app:1", Digest: map[string]string{"sha256": "444"}}}, p.Subject)
+	assert.Equal(t, "1.3.0", p.Predicate.Builder.Version)
+	assert.Equal(t, map[string]string{"VERSION": "1.2", "NPM_TOKEN": ""}, p.Predicate.Invocation.Parameters.BuildArgs)
+	assert.Equal(t, []ProvenanceMaterial{
+		{URI: "pkg:docker/golang:1.7", Digest: map[string]string{"sha256": "222"}},
+		{URI: "file:///src", Digest: map[string]string{"sha256": "555"}},
+	}, p.Predicate.Materials)
+
+	steps := p.Predicate.BuildConfig.Steps
+	assert.Len(t, steps, 2)
+	assert.Equal(t, "FROM golang:1.7", steps[0].Command)
+	assert.Equal(t, "sha256:111", steps[0].Image)
+	assert.Equal(t, "RUN make", steps[1].Command)
+	assert.Equal(t, 2, steps[1].Line)
+	assert.Equal(t, "sha256:333", steps[1].Image)
+}
+
+func TestNewProvenanceStatement_NothingPushed(t *testing.T) {
+	b, _ := makeBuild(t, "FROM scratch\n", Config{})
+	b.state.ImageID = "sha256:111"
+
+	p, err := NewProvenanceStatement(b, "1.3.0", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, []ProvenanceSubject{{Name: "sha256:111", Digest: map[string]string{"sha256": "111"}}}, p.Subject)
+	assert.Empty(t, p.Predicate.Materials)
+}
+
+func TestContextDigest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rocker-provenance-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "main.go"), []byte("package main\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "debug.log"), []byte("log\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	digest, err := ContextDigest(dir, nil, Hash{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Contains(t, digest, "sha256:")
+
+	again, err := ContextDigest(dir, nil, Hash{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, digest, again)
+
+	filtered, err := ContextDigest(dir, []string{"*.log"}, Hash{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NotEqual(t, digest, filtered)
+}
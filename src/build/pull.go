@@ -0,0 +1,164 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/pkg/jsonmessage"
+	"github.com/docker/docker/pkg/term"
+	"github.com/fsouza/go-dockerclient"
+	"github.com/grammarly/rocker/src/imagename"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// pullProgressInterval is how often the progress of a downloading layer is logged
+var pullProgressInterval = 5 * time.Second
+
+// pullWithRetry pulls the image and repeats the pull if it failed on the
+// network or timed out; the daemon keeps the layers that were downloaded
+// completely, so the next attempt resumes with the rest of them
+func (c *DockerClient) pullWithRetry(image *imagename.ImageName, auth docker.AuthConfiguration) (err error) {
+	for attempt := 1; ; attempt++ {
+		if err = c.pullOnce(image, auth); err == nil || attempt > c.pullRetries || !isTransientPullError(err) {
+			return err
+		}
+
+		delay := time.Duration(attempt) * dockerRetryDelay
+		c.log.Warnf("| Pull of %s failed: %s, retry in %s (%d/%d)", image, err, delay, attempt, c.pullRetries)
+		time.Sleep(delay)
+	}
+}
+
+// pullOnce makes a single attempt to pull the image within the pull timeout
+func (c *DockerClient) pullOnce(image *imagename.ImageName, auth docker.AuthConfiguration) error {
+	var (
+		pipeReader, pipeWriter = io.Pipe()
+		errch                  = make(chan error, 1)
+	)
+
+	opts := docker.PullImageOptions{
+		Repository:    image.NameWithRegistry(),
+		Registry:      image.Registry,
+		Tag:           image.GetTag(),
+		OutputStream:  pipeWriter,
+		RawJSONStream: true,
+	}
+
+	c.log.Debugf("Pull image %s with options: %# v", image, opts)
+
+	go func() {
+		errch <- c.displayPullProgress(pipeReader, image)
+		// Keep draining the stream, so the pull is not blocked if the display has failed
+		io.Copy(ioutil.Discard, pipeReader)
+	}()
+
+	if _, err := withTimeout("pull", image.String(), c.pullTimeout, func() (interface{}, error) {
+		return nil, c.client.PullImage(opts, auth)
+	}); err != nil {
+		pipeWriter.CloseWithError(err)
+		return err
+	}
+
+	pipeWriter.Close()
+	return <-errch
+}
+
+// displayPullProgress shows the progress bars on a terminal, or logs the
+// progress of every layer as the structured entries with LogPullProgress
+func (c *DockerClient) displayPullProgress(r io.Reader, image *imagename.ImageName) error {
+	if !c.logPullProgress {
+		out := c.log.Out
+		fdOut, isTerminalOut := term.GetFdInfo(out)
+		if !isTerminalOut {
+			out = c.log.Writer()
+		}
+		return jsonmessage.DisplayJSONMessagesStream(r, out, fdOut, isTerminalOut)
+	}
+
+	type layerState struct {
+		status string
+		logged time.Time
+	}
+
+	var (
+		dec    = json.NewDecoder(r)
+		layers = map[string]layerState{}
+	)
+
+	for {
+		var m jsonmessage.JSONMessage
+		if err := dec.Decode(&m); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		if m.Error != nil {
+			return m.Error
+		}
+		if m.ErrorMessage != "" {
+			return &jsonmessage.JSONError{Message: m.ErrorMessage}
+		}
+
+		fields := logrus.Fields{"event": "pull_progress", "image": image.String()}
+		if m.ID == "" {
+			c.log.WithFields(fields).Infof("| %s", m.Status)
+			continue
+		}
+
+		fields["layer"] = m.ID
+		fields["status"] = m.Status
+		if m.Progress != nil && m.Progress.Total > 0 {
+			fields["current"] = m.Progress.Current
+			fields["total"] = m.Progress.Total
+		}
+
+		// The downloads report every chunk, they are logged once in a while
+		if prev, ok := layers[m.ID]; ok && prev.status == m.Status && time.Since(prev.logged) < pullProgressInterval {
+			continue
+		}
+		layers[m.ID] = layerState{m.Status, time.Now()}
+
+		c.log.WithFields(fields).Infof("| %s: %s", m.ID, m.Status)
+	}
+}
+
+// isTransientPullError returns true if the pull may succeed when repeated;
+// the errors of the registry, e.g. the image is not found or the access is
+// denied, come in the progress stream as well, so they are told by the message
+func isTransientPullError(err error) bool {
+	if isTransientDockerError(err) {
+		return true
+	}
+	if _, ok := err.(*jsonmessage.JSONError); !ok {
+		return false
+	}
+
+	message := strings.ToLower(err.Error())
+	for _, permanent := range []string{"not found", "unauthorized", "denied", "manifest unknown", "no such", "invalid"} {
+		if strings.Contains(message, permanent) {
+			return false
+		}
+	}
+	return true
+}
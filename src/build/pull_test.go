@@ -0,0 +1,93 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/docker/docker/pkg/jsonmessage"
+	"github.com/grammarly/rocker/src/imagename"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsTransientPullError(t *testing.T) {
+	assert.True(t, isTransientPullError(&DockerTimeoutError{"pull", "alpine:3.4", 0}))
+	assert.True(t, isTransientPullError(&net.OpError{Op: "read", Err: errors.New("connection reset by peer")}))
+	assert.True(t, isTransientPullError(&jsonmessage.JSONError{Message: "unexpected EOF"}))
+	assert.False(t, isTransientPullError(&jsonmessage.JSONError{Message: "Error: image library/nope not found"}))
+	assert.False(t, isTransientPullError(&jsonmessage.JSONError{Message: "unauthorized: authentication required"}))
+	assert.False(t, isTransientPullError(errors.New("some error")))
+}
+
+func TestDisplayPullProgress_Log(t *testing.T) {
+	var (
+		buf    bytes.Buffer
+		stream bytes.Buffer
+		logger = logrus.New()
+	)
+	logger.Out = &buf
+	logger.Formatter = &logrus.JSONFormatter{}
+
+	c := &DockerClient{log: logger, logPullProgress: true}
+	enc := json.NewEncoder(&stream)
+	for _, m := range []jsonmessage.JSONMessage{
+		{Status: "Pulling from library/alpine", ID: "3.4"},
+		{Status: "Downloading", ID: "a3ed95caeb02", Progress: &jsonmessage.JSONProgress{Current: 10, Total: 100}},
+		{Status: "Downloading", ID: "a3ed95caeb02", Progress: &jsonmessage.JSONProgress{Current: 50, Total: 100}},
+		{Status: "Pull complete", ID: "a3ed95caeb02"},
+		{Status: "Status: Downloaded newer image for alpine:3.4"},
+	} {
+		enc.Encode(m)
+	}
+
+	assert.Nil(t, c.displayPullProgress(&stream, imagename.NewFromString("alpine:3.4")))
+
+	entries := []map[string]interface{}{}
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		entry := map[string]interface{}{}
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, entry)
+	}
+
+	// The second "Downloading" is within the progress interval
+	assert.Len(t, entries, 4)
+	assert.Equal(t, "pull_progress", entries[1]["event"])
+	assert.Equal(t, "a3ed95caeb02", entries[1]["layer"])
+	assert.Equal(t, "Downloading", entries[1]["status"])
+	assert.Equal(t, float64(10), entries[1]["current"])
+	assert.Equal(t, float64(100), entries[1]["total"])
+	assert.Equal(t, "Pull complete", entries[2]["status"])
+	assert.Equal(t, "alpine:3.4", entries[3]["image"])
+}
+
+func TestDisplayPullProgress_Error(t *testing.T) {
+	var stream bytes.Buffer
+	json.NewEncoder(&stream).Encode(jsonmessage.JSONMessage{Error: &jsonmessage.JSONError{Message: "unexpected EOF"}})
+
+	c := &DockerClient{log: logrus.New(), logPullProgress: true}
+	err := c.displayPullProgress(&stream, imagename.NewFromString("alpine:3.4"))
+	assert.EqualError(t, err, "unexpected EOF")
+	assert.True(t, isTransientPullError(err))
+}
@@ -0,0 +1,134 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/go-yaml/yaml"
+	"github.com/grammarly/rocker/src/template"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// CommandReadVars implements READVARS; it reads the JSON or YAML file, e.g.
+// written by the RUN before it, out of the image, and the instructions after
+// it are rendered again with the read vars, see replan
+type CommandReadVars struct {
+	CommandBase
+}
+
+// Execute runs the command
+func (c *CommandReadVars) Execute(b *Build) (State, error) {
+	if len(c.cfg.args) != 1 || strings.TrimSpace(c.cfg.args[0]) == "" {
+		return b.state, fmt.Errorf("READVARS requires exactly one argument, the file of the image")
+	}
+	if b.state.ImageID == "" {
+		return b.state, fmt.Errorf("Cannot READVARS on empty image")
+	}
+
+	file := strings.TrimSpace(c.cfg.args[0])
+	if !path.IsAbs(file) {
+		file = path.Join("/", b.state.Config.WorkingDir, file)
+	}
+
+	files, err := readImageFiles(b, b.state, file)
+	if err != nil {
+		return b.state, fmt.Errorf("Failed to read %s of the image, error: %s", file, err)
+	}
+
+	// JSON is the subset of YAML, so both are parsed the same way
+	vars := template.Vars{}
+	if err := yaml.Unmarshal(files[file], &vars); err != nil {
+		return b.state, fmt.Errorf("Failed to parse %s, error: %s", file, err)
+	}
+
+	names := make([]string, 0, len(vars))
+	for k := range vars {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	log.Infof("| Read vars %s", strings.Join(names, ", "))
+
+	b.readVars = vars
+
+	return b.state, nil
+}
+
+// replan renders the Rockerfile again with the vars read by READVARS at step k
+// and replaces the rest of the plan with the instructions that follow that
+// READVARS in the new rendering; the steps done so far are kept as they are
+func (b *Build) replan(plan Plan, k int) (Plan, error) {
+	vars := template.Vars{}.Merge(b.rockerfile.Vars, b.readVars)
+	b.readVars = nil
+
+	rockerfile, err := NewRockerfile(b.rockerfile.Name, strings.NewReader(b.rockerfile.Source), vars, b.rockerfile.Funs)
+	if err != nil {
+		return plan, err
+	}
+
+	last, ok := plan[len(plan)-1].(*CommandCleanup)
+	newPlan, err := NewPlan(rockerfile.Commands(), ok && last.final, b.cfg.AutoBatch)
+	if err != nil {
+		return plan, err
+	}
+
+	// The same READVARS is found by its number, the instructions before it
+	// may render differently with the read vars
+	n := len(readVarsSteps(plan[:k+1]))
+	steps := readVarsSteps(newPlan)
+	if len(steps) < n {
+		return plan, fmt.Errorf("READVARS is not found in the Rockerfile rendered with the read vars, it should not depend on them")
+	}
+	tail := newPlan[steps[n-1]+1:]
+
+	if err := b.checkPolicy(tail); err != nil {
+		return plan, err
+	}
+	if err := b.checkImageNames(tail); err != nil {
+		return plan, err
+	}
+	if err := b.checkOffline(tail); err != nil {
+		return plan, err
+	}
+
+	b.rockerfile = rockerfile
+
+	return append(plan[:k+1:k+1], tail...), nil
+}
+
+// untilReadVars returns the plan up to the first READVARS; the instructions
+// after it may use the vars it reads, so they are checked by replan
+func untilReadVars(plan Plan) Plan {
+	if steps := readVarsSteps(plan); len(steps) > 0 {
+		return plan[:steps[0]]
+	}
+	return plan
+}
+
+// readVarsSteps returns the indexes of the READVARS instructions of the plan
+func readVarsSteps(plan Plan) (steps []int) {
+	for i, command := range plan {
+		if cfg, ok := commandConfig(command); ok && cfg.name == "readvars" && !cfg.isOnbuild {
+			steps = append(steps, i)
+		}
+	}
+	return steps
+}
@@ -0,0 +1,107 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"archive/tar"
+	"io"
+	"testing"
+
+	"github.com/grammarly/rocker/src/template"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestCommandReadVars(t *testing.T) {
+	b, c := makeBuild(t, "FROM ubuntu\nREADVARS out.json\n", Config{})
+	b.state.ImageID = "123"
+	b.state.Config.WorkingDir = "/app"
+
+	content := `{"Version": "1.2.3", "Features": ["a", "b"]}`
+
+	c.On("CreateContainer", mock.AnythingOfType("State")).Return("456", nil).Once()
+	c.On("RemoveContainer", "456").Return(nil).Once()
+	c.On("DownloadFromContainer", "456", "/app/out.json", mock.Anything).Run(func(args mock.Arguments) {
+		tw := tar.NewWriter(args.Get(2).(io.Writer))
+		tw.WriteHeader(&tar.Header{Name: "out.json", Mode: 0644, Size: int64(len(content))})
+		tw.Write([]byte(content))
+		tw.Close()
+	}).Return(nil).Once()
+
+	s, err := NewCommand(b.rockerfile.Commands()[1]).Execute(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.AssertExpectations(t)
+
+	assert.Equal(t, "123", s.ImageID)
+	assert.Equal(t, "1.2.3", b.readVars["Version"])
+	assert.Equal(t, []interface{}{"a", "b"}, b.readVars["Features"])
+}
+
+func TestBuild_Replan(t *testing.T) {
+	b, _ := makeBuild(t, `FROM ubuntu
+RUN make version > /out.json
+READVARS /out.json
+TAG app:{{ .Version }}
+{{ range .Features }}
+ENV FEATURE_{{ . }}=1
+{{ end }}
+`, Config{})
+
+	plan, err := NewPlan(b.rockerfile.Commands(), true, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The name rendered without the vars is not checked before the build
+	assert.NoError(t, b.checkImageNames(untilReadVars(plan)))
+	assert.Error(t, b.checkImageNames(plan))
+
+	k := readVarsSteps(plan)[0]
+	b.readVars = template.Vars{"Version": "1.2.3", "Features": []interface{}{"a", "b"}}
+
+	if plan, err = b.replan(plan, k); err != nil {
+		t.Fatal(err)
+	}
+
+	steps := []string{}
+	for _, command := range plan[k+1:] {
+		if cfg, ok := commandConfig(command); ok {
+			steps = append(steps, cfg.original)
+		}
+	}
+	assert.Equal(t, []string{"TAG app:1.2.3", "ENV FEATURE_a=1", "ENV FEATURE_b=1"}, steps)
+	assert.Equal(t, "1.2.3", b.rockerfile.Vars["Version"])
+	assert.Nil(t, b.readVars)
+
+	_, final := plan[len(plan)-1].(*CommandCleanup)
+	assert.True(t, final)
+}
+
+func TestBuild_Replan_InvalidName(t *testing.T) {
+	b, _ := makeBuild(t, "FROM ubuntu\nREADVARS /out.json\nTAG app:{{ .Version }}\n", Config{})
+
+	plan, err := NewPlan(b.rockerfile.Commands(), true, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b.readVars = template.Vars{"Version": "not valid"}
+	_, err = b.replan(plan, readVarsSteps(plan)[0])
+	assert.Error(t, err)
+}
@@ -0,0 +1,143 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/fatih/color"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// errNotCached is returned by probeCache on a miss while rerunning a step
+var errNotCached = fmt.Errorf("not cached")
+
+// rerunSkipped are the instructions that have effects beyond the build state,
+// they are not executed on the way to the step being rerun
+var rerunSkipped = map[string]bool{
+	"tag":      true,
+	"push":     true,
+	"artifact": true,
+	"attach":   true,
+	"test":     true,
+}
+
+// rerunStep restores the state before the given instruction out of the cache and
+// executes the instruction alone, so a misbehaving step deep in a long Rockerfile
+// can be debugged without rebuilding; every step before it must be cached.
+// With Attach, RUN is executed interactively the way ATTACH is.
+func (b *Build) rerunStep(plan Plan, step int) (err error) {
+	if b.cache == nil {
+		return fmt.Errorf("Cannot rerun step %d with no cache", step)
+	}
+
+	var (
+		original    = map[Command]bool{}
+		instruction = 0
+	)
+	for _, command := range plan {
+		if _, ok := commandConfig(command); ok {
+			original[command] = true
+		}
+	}
+	if step > len(original) {
+		return fmt.Errorf("Cannot rerun step %d, the Rockerfile has %d instructions", step, len(original))
+	}
+
+	b.rerunning = true
+	defer func() {
+		b.rerunning = false
+	}()
+
+	for k := 0; k < len(plan); k++ {
+		command := plan[k]
+		b.step = k + 1
+
+		cfg, _ := commandConfig(command)
+		if original[command] {
+			instruction++
+		}
+		target := original[command] && instruction == step
+
+		var doRun bool
+		if doRun, err = command.ShouldRun(b); err != nil {
+			return err
+		}
+		if !doRun && target {
+			return fmt.Errorf("Step %d %s is skipped by its condition", step, command)
+		}
+		if !doRun {
+			continue
+		}
+
+		if command, ok := command.(EnvReplacableCommand); ok {
+			command.ReplaceEnv(b.state.Config.Env)
+		}
+
+		if target {
+			return b.rerunTarget(command, cfg, step)
+		}
+
+		if rerunSkipped[cfg.name] {
+			log.Infof("%s | skipped on rerun", command)
+			continue
+		}
+
+		log.Infof("%s", command)
+
+		if b.state, err = command.Execute(b); err == errNotCached {
+			return fmt.Errorf("Step %d %s is not cached, run the build first", instruction, command)
+		}
+		if err != nil {
+			return err
+		}
+
+		if plan, _, err = b.injectOnbuild(plan, k); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// rerunTarget executes the step being rerun bypassing the cache, the container
+// of the step is removed instead of being committed
+func (b *Build) rerunTarget(command Command, cfg ConfigCommand, step int) (err error) {
+	b.rerunning = false
+	b.state.NoCache.CacheBusted = true
+
+	if b.cfg.Attach && cfg.name == "run" {
+		command = &CommandAttach{CommandBase{cfg}}
+	}
+
+	log.Infof("%s", color.New(color.FgWhite, color.Bold).SprintFunc()(command))
+
+	started := time.Now()
+
+	s, err := command.Execute(b)
+	if err != nil {
+		return err
+	}
+	if s.NoCache.ContainerID != "" {
+		b.client.RemoveContainer(s.NoCache.ContainerID)
+	}
+
+	log.Infof("| Step %d finished in %.1fs", step, time.Since(started).Seconds())
+	return nil
+}
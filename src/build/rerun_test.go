@@ -0,0 +1,76 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"os"
+	"testing"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func makeRerunBuild(t *testing.T, rockerfileContent string, step int) (*Build, *MockClient, Plan) {
+	b, c := makeBuild(t, rockerfileContent, Config{RerunStep: step})
+	b.cache = NewCacheFS(cacheTestTmpDir(t), Hash{})
+
+	plan, err := NewPlan(b.rockerfile.Commands(), true, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b, c, plan
+}
+
+func TestRerunStep(t *testing.T) {
+	b, c, plan := makeRerunBuild(t, "FROM scratch\nRUN make\nTAG app\nRUN make test\nRUN make install", 4)
+	defer os.RemoveAll(b.cache.(*CacheFS).root)
+
+	b.cache.Put(State{ImageID: "456", Commits: []string{`RUN ["/bin/sh" "-c" "make"]`}})
+
+	c.On("InspectImage", "456").Return(&docker.Image{ID: "456"}, nil).Once()
+
+	c.On("CreateContainer", mock.AnythingOfType("State")).Return("789", nil).Run(func(args mock.Arguments) {
+		arg := args.Get(0).(State)
+		assert.Equal(t, "456", arg.ImageID)
+		assert.Equal(t, []string{"/bin/sh", "-c", "make test"}, arg.Config.Cmd)
+	}).Once()
+	c.On("RunContainer", "789", false).Return(nil).Once()
+	c.On("RemoveContainer", "789").Return(nil).Once()
+
+	if err := b.Run(plan); err != nil {
+		t.Fatal(err)
+	}
+
+	c.AssertExpectations(t)
+}
+
+func TestRerunStep_NotCached(t *testing.T) {
+	b, _, plan := makeRerunBuild(t, "FROM scratch\nRUN make\nRUN make test", 3)
+	defer os.RemoveAll(b.cache.(*CacheFS).root)
+
+	err := b.Run(plan)
+	assert.EqualError(t, err, "Step 2 RUN make is not cached, run the build first")
+}
+
+func TestRerunStep_OutOfRange(t *testing.T) {
+	b, _, plan := makeRerunBuild(t, "FROM scratch\nRUN make", 3)
+	defer os.RemoveAll(b.cache.(*CacheFS).root)
+
+	err := b.Run(plan)
+	assert.EqualError(t, err, "Cannot rerun step 3, the Rockerfile has 2 instructions")
+}
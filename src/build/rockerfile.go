@@ -18,6 +18,7 @@ package build
 
 import (
 	"bytes"
+	"crypto/sha256"
 	"fmt"
 	"github.com/grammarly/rocker/src/parser"
 	"github.com/grammarly/rocker/src/template"
@@ -35,7 +36,16 @@ type Rockerfile struct {
 	Vars    template.Vars
 	Funs    template.Funs
 
+	// Syntax is the version from the `# rocker:syntax=` header
+	Syntax string
+
 	rootNode *parser.Node
+
+	// lines are the source lines of the lines of Content
+	lines []int
+
+	// fragmentSources are the sources of the fragments inlined by USE
+	fragmentSources []string
 }
 
 // NewRockerfileFromFile reads and parses Rockerfile from a file
@@ -68,7 +78,11 @@ func NewRockerfile(name string, in io.Reader, vars template.Vars, funs template.
 
 	r.Source = string(source)
 
-	if content, err = template.Process(name, bytes.NewReader(source), vars, funs); err != nil {
+	if r.Syntax, err = parseSyntaxHeader(r.Source); err != nil {
+		return nil, fmt.Errorf("Failed to parse Rockerfile %s, error: %s", name, err)
+	}
+
+	if content, r.lines, err = template.ProcessLines(name, bytes.NewReader(source), vars, funs); err != nil {
 		return nil, err
 	}
 
@@ -77,18 +91,82 @@ func NewRockerfile(name string, in io.Reader, vars template.Vars, funs template.
 	// TODO: update parser from Docker
 
 	if r.rootNode, err = parser.Parse(content); err != nil {
+		if lineErr, ok := err.(*parser.LineError); ok {
+			return nil, fmt.Errorf("Failed to parse Rockerfile %s:%d, error: %s", name, r.SourceLine(lineErr.Line), lineErr.Err)
+		}
 		return nil, err
 	}
 
+	if err = r.resolveFragments(); err != nil {
+		return nil, err
+	}
+
+	if err = checkConditions(r.rootNode.Children); err != nil {
+		return nil, fmt.Errorf("Failed to parse Rockerfile %s, error: %s", name, err)
+	}
+
 	return r, nil
 }
 
+// SourceLine returns the line of the Rockerfile source the line of the rendered
+// Content comes from, both starting from 1; zero is returned for unknown lines
+func (r *Rockerfile) SourceLine(line int) int {
+	if line < 1 || line > len(r.lines) {
+		return 0
+	}
+	return r.lines[line-1]
+}
+
+// Annotated returns the rendered Content with the source line numbers
+func (r *Rockerfile) Annotated() string {
+	var buf bytes.Buffer
+
+	for i, text := range strings.SplitAfter(r.Content, "\n") {
+		if text == "" {
+			continue
+		}
+		if line := r.SourceLine(i + 1); line > 0 {
+			fmt.Fprintf(&buf, "%4d | %s", line, text)
+		} else {
+			fmt.Fprintf(&buf, "   - | %s", text)
+		}
+	}
+
+	return buf.String()
+}
+
+// Hash returns the sha256 digest of the rendered Content, it identifies
+// the Rockerfile as it was built, with the vars applied
+func (r *Rockerfile) Hash() string {
+	return fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(r.Content)))
+}
+
 // Commands returns the list of command configurations from the Rockerfile
 func (r *Rockerfile) Commands() []ConfigCommand {
-	commands := []ConfigCommand{}
+	var (
+		commands   = []ConfigCommand{}
+		conditions = []commandCondition{}
+	)
 
 	for i := 0; i < len(r.rootNode.Children); i++ {
-		commands = append(commands, parseCommand(r.rootNode.Children[i], false))
+		node := r.rootNode.Children[i]
+
+		// ONLY IF / SKIP IF apply to the next instruction; checkConditions
+		// has already validated them
+		if isConditionNode(node) {
+			cond, _ := parseCondition(node)
+			conditions = append(conditions, cond)
+			continue
+		}
+
+		cfg := parseCommand(node, false)
+		cfg.line = r.SourceLine(node.StartLine)
+		if len(conditions) > 0 {
+			cfg.conditions = conditions
+			conditions = []commandCondition{}
+		}
+
+		commands = append(commands, cfg)
 	}
 
 	return commands
@@ -122,9 +200,50 @@ func parseCommand(node *parser.Node, isOnbuild bool) ConfigCommand {
 		cfg.args = append(cfg.args, n.Value)
 	}
 
+	if cfg.name == "from" {
+		parseFromArgs(&cfg)
+	}
+
 	return cfg
 }
 
+// parseFromArgs takes the section name and the CACHEONLY marker out of
+// FROM <image> [AS <name>] [CACHEONLY], they become the "as" and "cache-only"
+// flags, so FROM --cache-only <image> works the same; the args that do not
+// follow the form are left as they are, FROM reports them
+func parseFromArgs(cfg *ConfigCommand) {
+	if len(cfg.args) != 1 {
+		return
+	}
+
+	var (
+		fields = strings.Fields(cfg.args[0])
+		flags  = map[string]string{}
+	)
+
+	if len(fields) < 2 {
+		return
+	}
+
+	rest := fields[1:]
+	if len(rest) >= 2 && strings.EqualFold(rest[0], "as") {
+		flags["as"] = rest[1]
+		rest = rest[2:]
+	}
+	if len(rest) == 1 && strings.EqualFold(rest[0], "cacheonly") {
+		flags["cache-only"] = ""
+		rest = rest[1:]
+	}
+	if len(rest) > 0 {
+		return
+	}
+
+	cfg.args = fields[:1]
+	for k, v := range flags {
+		cfg.flags[k] = v
+	}
+}
+
 func parseOnbuildCommands(onBuildTriggers []string) ([]ConfigCommand, error) {
 	commands := []ConfigCommand{}
 
@@ -139,7 +258,7 @@ func parseOnbuildCommands(onBuildTriggers []string) ([]ConfigCommand, error) {
 			switch strings.ToUpper(n.Value) {
 			case "ONBUILD":
 				return commands, fmt.Errorf("Chaining ONBUILD via `ONBUILD ONBUILD` isn't allowed")
-			case "MAINTAINER", "FROM":
+			case "MAINTAINER", "FROM", "READVARS":
 				return commands, fmt.Errorf("%s isn't allowed as an ONBUILD trigger", n.Value)
 			}
 
@@ -150,6 +269,12 @@ func parseOnbuildCommands(onBuildTriggers []string) ([]ConfigCommand, error) {
 	return commands, nil
 }
 
+// listFlags are the instruction flags that may be given several times,
+// their values are joined with commas
+var listFlags = map[string]bool{
+	"exclude": true,
+}
+
 func parseFlags(flags []string) map[string]string {
 	result := make(map[string]string)
 	for _, flag := range flags {
@@ -162,6 +287,11 @@ func parseFlags(flags []string) map[string]string {
 			key = key[:index]
 		}
 
+		// A list flag may be given several times, e.g. --exclude
+		if prev, ok := result[key]; ok && listFlags[key] {
+			value = prev + "," + value
+		}
+
 		result[key] = value
 	}
 	return result
@@ -58,6 +58,23 @@ func TestRockerfileCommands(t *testing.T) {
 	assert.Equal(t, "ubuntu", commands[0].args[0])
 }
 
+func TestRockerfileCommands_FromCacheOnly(t *testing.T) {
+	src := "FROM node:6 AS deps CACHEONLY\nFROM node:6 cacheonly\nFROM node:6 AS deps\nFROM node:6 AS\n"
+	r, err := NewRockerfile("test", strings.NewReader(src), template.Vars{}, template.Funs{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	commands := r.Commands()
+	assert.Len(t, commands, 4)
+	assert.Equal(t, []string{"node:6"}, commands[0].args)
+	assert.Equal(t, map[string]string{"as": "deps", "cache-only": ""}, commands[0].flags)
+	assert.Equal(t, []string{"node:6"}, commands[1].args)
+	assert.Equal(t, map[string]string{"cache-only": ""}, commands[1].flags)
+	assert.Equal(t, map[string]string{"as": "deps"}, commands[2].flags)
+	assert.Equal(t, []string{"node:6 AS"}, commands[3].args)
+}
+
 func TestRockerfileParseOnbuildCommands(t *testing.T) {
 	triggers := []string{
 		"RUN make",
@@ -75,3 +92,101 @@ func TestRockerfileParseOnbuildCommands(t *testing.T) {
 	assert.Equal(t, "run", commands[1].name)
 	assert.Equal(t, []string{"make install"}, commands[1].args)
 }
+
+func TestRockerfileCommands_Conditions(t *testing.T) {
+	src := "FROM ubuntu\nONLY IF .Dev\nSKIP IF .Light\nRUN apt-get install vim\nRUN make"
+	r, err := NewRockerfile("test", strings.NewReader(src), template.Vars{}, template.Funs{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	commands := r.Commands()
+	assert.Len(t, commands, 3)
+	assert.Equal(t, "run", commands[1].name)
+	assert.Equal(t, []commandCondition{
+		{skip: false, expr: ".Dev", original: "ONLY IF .Dev"},
+		{skip: true, expr: ".Light", original: "SKIP IF .Light"},
+	}, commands[1].conditions)
+	assert.Len(t, commands[2].conditions, 0)
+}
+
+func TestRockerfileCommands_ConditionsInvalid(t *testing.T) {
+	tests := map[string]string{
+		"FROM ubuntu\nONLY .Dev\nRUN make":    "should be in the form of `ONLY IF <expression>`",
+		"FROM ubuntu\nSKIP IF\nRUN make":      "should be in the form of `SKIP IF <expression>`",
+		"FROM ubuntu\nRUN make\nONLY IF .Dev": "is not followed by any instruction",
+		"ONLY IF .Dev\nFROM ubuntu":           "can not be applied to FROM",
+	}
+
+	for src, expected := range tests {
+		_, err := NewRockerfile("test", strings.NewReader(src), template.Vars{}, template.Funs{})
+		if assert.Error(t, err, src) {
+			assert.Contains(t, err.Error(), expected, src)
+		}
+	}
+}
+
+func TestNewRockerfile_Syntax(t *testing.T) {
+	r, err := NewRockerfile("test", strings.NewReader("FROM ubuntu"), template.Vars{}, template.Funs{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, DefaultSyntaxVersion, r.Syntax)
+
+	src := "# Build the app\n\n# rocker:syntax=1.1\nFROM ubuntu"
+	r, err = NewRockerfile("test", strings.NewReader(src), template.Vars{}, template.Funs{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "1.1", r.Syntax)
+
+	// the header is only recognized before the first instruction
+	src = "FROM ubuntu\n# rocker:syntax=9.9"
+	r, err = NewRockerfile("test", strings.NewReader(src), template.Vars{}, template.Funs{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, DefaultSyntaxVersion, r.Syntax)
+}
+
+func TestNewRockerfile_SyntaxInvalid(t *testing.T) {
+	tests := map[string]string{
+		"# rocker:syntax=9.0\nFROM ubuntu": "newer than the latest supported 1.2, please upgrade rocker",
+		"# rocker:syntax=1.9\nFROM ubuntu": "newer than the latest supported 1.2, please upgrade rocker",
+		"# rocker:syntax=0.1\nFROM ubuntu": "syntax 0.1 is not supported, the supported versions are: 1.0, 1.1, 1.2",
+		"# rocker:syntax=one\nFROM ubuntu": "Invalid Rockerfile syntax version \"one\"",
+		"# rocker:syntax=\nFROM {{ .Foo }": "Invalid Rockerfile syntax version \"\"",
+	}
+
+	for src, msg := range tests {
+		_, err := NewRockerfile("test", strings.NewReader(src), template.Vars{}, template.Funs{})
+		if assert.Error(t, err, src) {
+			assert.Contains(t, err.Error(), msg, src)
+		}
+	}
+}
+
+func TestRockerfile_SourceLines(t *testing.T) {
+	src := "FROM ubuntu\n{{ range $i := seq 2 }}\nRUN echo {{ $i }}\n{{ end }}\n\nCMD [\"true\"]\n"
+	r, err := NewRockerfile("test", strings.NewReader(src), template.Vars{}, template.Funs{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lines := []int{}
+	for _, cmd := range r.Commands() {
+		lines = append(lines, cmd.line)
+	}
+	assert.Equal(t, []int{1, 3, 3, 6}, lines)
+
+	assert.Equal(t, "   1 | FROM ubuntu\n   2 | \n   3 | RUN echo 1\n   2 | \n   3 | RUN echo 2\n   4 | \n   5 | \n   6 | CMD [\"true\"]\n", r.Annotated())
+}
+
+func TestNewRockerfile_ParseErrorLine(t *testing.T) {
+	src := "FROM ubuntu\n{{ if true }}\nENV foo\n{{ end }}\n"
+	_, err := NewRockerfile("test", strings.NewReader(src), template.Vars{}, template.Funs{})
+	assert.Error(t, err)
+	if err != nil {
+		assert.Contains(t, err.Error(), "Failed to parse Rockerfile test:3, error: ENV must have two arguments")
+	}
+}
@@ -0,0 +1,128 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/fsouza/go-dockerclient"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Sandbox is the security settings of the RUN and TEST containers
+type Sandbox struct {
+	CapDrop     []string
+	CapAdd      []string
+	SecurityOpt []string
+	ReadOnly    bool
+
+	// DenyPrivileged makes `RUN --privileged` an error
+	DenyPrivileged bool
+}
+
+// sandboxHostConfig returns the host config of the RUN or TEST container with the
+// security settings, the flags of the instruction override the global ones, e.g.
+// RUN --cap-add=NET_ADMIN --read-only=false --security-opt=no-new-privileges
+func (b *Build) sandboxHostConfig(hostConfig docker.HostConfig, name string, flags map[string]string) (docker.HostConfig, error) {
+	sandbox := b.cfg.Sandbox
+
+	if v, ok := flags["cap-drop"]; ok {
+		sandbox.CapDrop = splitFlagList(v)
+	}
+	if v, ok := flags["cap-add"]; ok {
+		sandbox.CapAdd = splitFlagList(v)
+	}
+	if v, ok := flags["security-opt"]; ok {
+		sandbox.SecurityOpt = splitFlagList(v)
+	}
+	if v, ok := flags["read-only"]; ok {
+		readOnly, err := parseBoolFlag(v)
+		if err != nil {
+			return hostConfig, fmt.Errorf("%s --read-only expects true or false, got %q", name, v)
+		}
+		sandbox.ReadOnly = readOnly
+	}
+
+	if v, ok := flags["privileged"]; ok {
+		privileged, err := parseBoolFlag(v)
+		if err != nil {
+			return hostConfig, fmt.Errorf("%s --privileged expects true or false, got %q", name, v)
+		}
+		if privileged {
+			if sandbox.DenyPrivileged {
+				return hostConfig, fmt.Errorf("%s --privileged is denied by --deny-privileged", name)
+			}
+			log.Warnf("| %s --privileged: the container runs with all the capabilities and devices of the docker host", name)
+
+			// The privileged container gets everything anyway
+			hostConfig.Privileged = true
+			return hostConfig, nil
+		}
+	}
+
+	hostConfig.CapDrop = sandbox.CapDrop
+	hostConfig.CapAdd = sandbox.CapAdd
+	hostConfig.SecurityOpt = sandbox.SecurityOpt
+	hostConfig.ReadonlyRootfs = sandbox.ReadOnly
+
+	return hostConfig, nil
+}
+
+// sandboxCacheKey returns the sandbox settings of the host config to put into
+// the cache key of RUN, it is empty when there are none so that the keys of
+// the builds without the sandbox stay the same
+func sandboxCacheKey(hostConfig docker.HostConfig) string {
+	if hostConfig.Privileged {
+		return "privileged"
+	}
+
+	parts := []string{}
+	if len(hostConfig.CapDrop) > 0 {
+		parts = append(parts, "cap-drop="+strings.Join(hostConfig.CapDrop, ","))
+	}
+	if len(hostConfig.CapAdd) > 0 {
+		parts = append(parts, "cap-add="+strings.Join(hostConfig.CapAdd, ","))
+	}
+	if len(hostConfig.SecurityOpt) > 0 {
+		parts = append(parts, "security-opt="+strings.Join(hostConfig.SecurityOpt, ","))
+	}
+	if hostConfig.ReadonlyRootfs {
+		parts = append(parts, "read-only")
+	}
+	return strings.Join(parts, " ")
+}
+
+// splitFlagList splits the comma separated flag value, e.g. --cap-add=CHOWN,SETUID
+func splitFlagList(value string) (list []string) {
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// parseBoolFlag parses the value of a boolean flag, the flag without a value is true
+func parseBoolFlag(value string) (bool, error) {
+	if value == "" {
+		return true, nil
+	}
+	return strconv.ParseBool(value)
+}
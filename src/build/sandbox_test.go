@@ -0,0 +1,146 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"testing"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestCommandRun_Sandbox(t *testing.T) {
+	b, c := makeBuild(t, "", Config{
+		Sandbox: Sandbox{
+			CapDrop:     []string{"ALL"},
+			SecurityOpt: []string{"no-new-privileges"},
+			ReadOnly:    true,
+		},
+	})
+	cmd := NewCommand(ConfigCommand{
+		name:  "run",
+		args:  []string{"whoami"},
+		flags: map[string]string{"cap-add": "CHOWN,SETUID", "read-only": "false"},
+	})
+
+	b.state.ImageID = "123"
+	b.state.NoCache.HostConfig.Binds = []string{"/src:/src"}
+
+	c.On("CreateContainer", mock.AnythingOfType("State")).Return("456", nil).Run(func(args mock.Arguments) {
+		hostConfig := args.Get(0).(State).NoCache.HostConfig
+		assert.Equal(t, []string{"ALL"}, hostConfig.CapDrop)
+		assert.Equal(t, []string{"CHOWN", "SETUID"}, hostConfig.CapAdd)
+		assert.Equal(t, []string{"no-new-privileges"}, hostConfig.SecurityOpt)
+		assert.False(t, hostConfig.ReadonlyRootfs, "should be overridden by RUN --read-only=false")
+		assert.Equal(t, []string{"/src:/src"}, hostConfig.Binds)
+	}).Once()
+
+	c.On("RunContainer", "456", false).Return(nil).Once()
+
+	state, err := cmd.Execute(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.AssertExpectations(t)
+	assert.Nil(t, state.NoCache.HostConfig.CapDrop, "should restore the host config")
+	assert.Equal(t, []string{"/src:/src"}, state.NoCache.HostConfig.Binds)
+}
+
+func TestCommandRun_Privileged(t *testing.T) {
+	b, c := makeBuild(t, "", Config{
+		Sandbox: Sandbox{CapDrop: []string{"ALL"}, ReadOnly: true},
+	})
+	cmd := NewCommand(ConfigCommand{
+		name:  "run",
+		args:  []string{"mount -t tmpfs none /mnt"},
+		flags: map[string]string{"privileged": ""},
+	})
+
+	b.state.ImageID = "123"
+
+	c.On("CreateContainer", mock.AnythingOfType("State")).Return("456", nil).Run(func(args mock.Arguments) {
+		hostConfig := args.Get(0).(State).NoCache.HostConfig
+		assert.True(t, hostConfig.Privileged)
+		assert.Nil(t, hostConfig.CapDrop)
+		assert.False(t, hostConfig.ReadonlyRootfs)
+	}).Once()
+
+	c.On("RunContainer", "456", false).Return(nil).Once()
+
+	if _, err := cmd.Execute(b); err != nil {
+		t.Fatal(err)
+	}
+	c.AssertExpectations(t)
+}
+
+func TestCommandRun_PrivilegedDenied(t *testing.T) {
+	b, _ := makeBuild(t, "", Config{
+		Sandbox: Sandbox{DenyPrivileged: true},
+	})
+	cmd := NewCommand(ConfigCommand{
+		name:  "run",
+		args:  []string{"whoami"},
+		flags: map[string]string{"privileged": ""},
+	})
+
+	b.state.ImageID = "123"
+
+	_, err := cmd.Execute(b)
+	assert.EqualError(t, err, "RUN --privileged is denied by --deny-privileged")
+}
+
+func TestSandboxHostConfig_InvalidFlag(t *testing.T) {
+	b, _ := makeBuild(t, "", Config{})
+
+	_, err := b.sandboxHostConfig(b.state.NoCache.HostConfig, "TEST", map[string]string{"read-only": "maybe"})
+	assert.EqualError(t, err, `TEST --read-only expects true or false, got "maybe"`)
+}
+
+func TestCommandRun_SandboxCacheKey(t *testing.T) {
+	b, c := makeBuild(t, "", Config{
+		Sandbox: Sandbox{CapDrop: []string{"ALL"}},
+	})
+	cmd := NewCommand(ConfigCommand{
+		name:  "run",
+		args:  []string{"whoami"},
+		flags: map[string]string{"read-only": ""},
+	})
+
+	b.state.ImageID = "123"
+
+	c.On("CreateContainer", mock.AnythingOfType("State")).Return("456", nil).Once()
+	c.On("RunContainer", "456", false).Return(nil).Once()
+
+	state, err := cmd.Execute(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.AssertExpectations(t)
+	assert.Equal(t, `RUN ["|sandbox:cap-drop=ALL read-only" "/bin/sh" "-c" "whoami"]`, state.GetCommits())
+}
+
+func TestSandboxCacheKey(t *testing.T) {
+	assert.Equal(t, "", sandboxCacheKey(docker.HostConfig{Binds: []string{"/src:/src"}}))
+	assert.Equal(t, "privileged", sandboxCacheKey(docker.HostConfig{Privileged: true}))
+	assert.Equal(t, "cap-add=CHOWN,SETUID security-opt=no-new-privileges", sandboxCacheKey(docker.HostConfig{
+		CapAdd:      []string{"CHOWN", "SETUID"},
+		SecurityOpt: []string{"no-new-privileges"},
+	}))
+}
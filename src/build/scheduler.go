@@ -0,0 +1,135 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/pkg/units"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Scheduler limits the number of RUN containers running at the same time
+// across the builds sharing it, e.g. the parallel matrix builds. Every RUN
+// container reserves one CPU and the memory share of a CPU of the host;
+// the steps that do not fit wait until the running ones finish.
+type Scheduler struct {
+	// CPU is the number of CPUs the RUN containers may reserve
+	CPU int
+
+	// Memory is the memory in bytes the RUN containers may reserve
+	Memory int64
+
+	// RunMemory is the memory in bytes a single RUN container reserves
+	RunMemory int64
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	cpu     int
+	memory  int64
+	running int
+}
+
+// NewScheduler makes the scheduler for the host with the given CPUs and memory
+// reported by the daemon; maxCPU and maxMemory cap them if not zero
+func NewScheduler(hostCPU int, hostMemory int64, maxCPU int, maxMemory int64) (*Scheduler, error) {
+	if hostCPU < 1 {
+		return nil, fmt.Errorf("Failed to schedule the RUN containers, the docker host reported %d CPUs", hostCPU)
+	}
+	if maxCPU < 0 {
+		return nil, fmt.Errorf("--max-parallel-cpu should not be negative, got %d", maxCPU)
+	}
+	if maxMemory < 0 {
+		return nil, fmt.Errorf("--max-parallel-mem should not be negative, got %d", maxMemory)
+	}
+
+	s := &Scheduler{
+		CPU:       hostCPU,
+		Memory:    hostMemory,
+		RunMemory: hostMemory / int64(hostCPU),
+	}
+	if maxCPU > 0 && maxCPU < s.CPU {
+		s.CPU = maxCPU
+	}
+	if maxMemory > 0 && (s.Memory == 0 || maxMemory < s.Memory) {
+		s.Memory = maxMemory
+	}
+
+	return s, nil
+}
+
+// String returns the human readable capacity of the scheduler
+func (s *Scheduler) String() string {
+	return fmt.Sprintf("%d CPUs, %s of memory, %s per RUN",
+		s.CPU, units.HumanSize(float64(s.Memory)), units.HumanSize(float64(s.RunMemory)))
+}
+
+// Acquire blocks until there are resources for one more RUN container and
+// returns the function releasing them; a nil scheduler does not limit anything
+func (s *Scheduler) Acquire(name string) (release func()) {
+	if s == nil {
+		return func() {}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.cond == nil {
+		s.cond = sync.NewCond(&s.mu)
+	}
+
+	if !s.fits() {
+		log.Infof("| Waiting for the resources to run %s, %d RUN containers are running", name, s.running)
+		started := time.Now()
+		for !s.fits() {
+			s.cond.Wait()
+		}
+		log.Infof("| Waited %s for the resources", time.Since(started))
+	}
+
+	s.cpu++
+	s.memory += s.RunMemory
+	s.running++
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			s.mu.Lock()
+			s.cpu--
+			s.memory -= s.RunMemory
+			s.running--
+			s.mu.Unlock()
+			s.cond.Broadcast()
+		})
+	}
+}
+
+// fits returns true if one more RUN container fits into the capacity;
+// a container always fits if nothing is running to not deadlock the build
+// when a single one exceeds the capacity
+func (s *Scheduler) fits() bool {
+	if s.running == 0 {
+		return true
+	}
+	if s.cpu+1 > s.CPU {
+		return false
+	}
+	return s.Memory == 0 || s.memory+s.RunMemory <= s.Memory
+}
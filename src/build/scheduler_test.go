@@ -0,0 +1,125 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewScheduler(t *testing.T) {
+	s, err := NewScheduler(8, 16<<30, 0, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 8, s.CPU)
+	assert.Equal(t, int64(16<<30), s.Memory)
+	assert.Equal(t, int64(2<<30), s.RunMemory)
+
+	s, err = NewScheduler(8, 16<<30, 4, 2<<30)
+	assert.Nil(t, err)
+	assert.Equal(t, 4, s.CPU)
+	assert.Equal(t, int64(2<<30), s.Memory)
+
+	s, err = NewScheduler(2, 16<<30, 4, 32<<30)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, s.CPU)
+	assert.Equal(t, int64(16<<30), s.Memory)
+
+	_, err = NewScheduler(0, 16<<30, 0, 0)
+	assert.NotNil(t, err)
+
+	_, err = NewScheduler(8, 16<<30, -1, 0)
+	assert.NotNil(t, err)
+}
+
+func TestScheduler_Nil(t *testing.T) {
+	var s *Scheduler
+	s.Acquire("RUN true")()
+}
+
+func TestScheduler_LimitedByCPU(t *testing.T) {
+	s, err := NewScheduler(8, 16<<30, 2, 0)
+	assert.Nil(t, err)
+
+	assert.Equal(t, 2, maxRunning(s, 6))
+}
+
+func TestScheduler_LimitedByMemory(t *testing.T) {
+	// 2g per container, 3 of them fit into 6g
+	s, err := NewScheduler(8, 16<<30, 0, 6<<30)
+	assert.Nil(t, err)
+
+	assert.Equal(t, 3, maxRunning(s, 6))
+}
+
+func TestScheduler_AlwaysRunsOne(t *testing.T) {
+	s, err := NewScheduler(1, 16<<30, 0, 1<<30)
+	assert.Nil(t, err)
+
+	assert.Equal(t, 1, maxRunning(s, 3))
+}
+
+func TestScheduler_ReleaseTwice(t *testing.T) {
+	s, err := NewScheduler(1, 0, 0, 0)
+	assert.Nil(t, err)
+
+	release := s.Acquire("RUN true")
+	release()
+	release()
+
+	assert.Equal(t, 0, s.running)
+	assert.Equal(t, 0, s.cpu)
+}
+
+// maxRunning runs n fake RUN containers in parallel and returns the max
+// number of them running at the same time
+func maxRunning(s *Scheduler, n int) int {
+	var (
+		mu      sync.Mutex
+		running int
+		max     int
+		wg      sync.WaitGroup
+	)
+
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			release := s.Acquire("RUN true")
+			defer release()
+
+			mu.Lock()
+			running++
+			if running > max {
+				max = running
+			}
+			mu.Unlock()
+
+			time.Sleep(20 * time.Millisecond)
+
+			mu.Lock()
+			running--
+			mu.Unlock()
+		}()
+	}
+
+	wg.Wait()
+	return max
+}
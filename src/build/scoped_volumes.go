@@ -0,0 +1,120 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"crypto/md5"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/grammarly/rocker/src/util"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// scopedMountsContainerName returns the name of the volume container of
+// a MOUNT that lives only through this build, see Config.NoReuse
+func (b *Build) scopedMountsContainerName(path string) string {
+	mountID := fmt.Sprintf("%s:%s:%d:%d", b.getIdentifier(), path, os.Getpid(), b.started.UnixNano())
+	return fmt.Sprintf("rocker_scoped_%.6x", md5.Sum([]byte(mountID)))
+}
+
+// getScopedVolumeContainer makes the empty volume container for the path,
+// which is removed at the end of the build; the same path mounted again in
+// the build gets the same volume. The new volume is filled with the seed
+// directory of the context, if it is given
+func (b *Build) getScopedVolumeContainer(path, seed string) (c *docker.Container, err error) {
+	name := b.scopedMountsContainerName(path)
+	fresh := !b.scopedVolumes[name]
+
+	if c, err = b.ensureVolumeContainer(name, path); err != nil {
+		return nil, err
+	}
+
+	if b.scopedVolumes == nil {
+		b.scopedVolumes = map[string]bool{}
+	}
+	b.scopedVolumes[name] = true
+
+	if fresh && seed != "" {
+		if err = b.seedVolume(c.ID, path, seed); err != nil {
+			return nil, err
+		}
+	}
+
+	return c, nil
+}
+
+// resolveSeed returns the absolute path of the MOUNT --seed directory,
+// which should be within the context
+func (b *Build) resolveSeed(seed string) (string, error) {
+	dir, err := util.ResolvePath(b.cfg.ContextDir, filepath.ToSlash(seed))
+	if err != nil {
+		return "", fmt.Errorf("MOUNT --seed %s should be within the context, error: %s", seed, err)
+	}
+
+	info, err := os.Stat(dir)
+	if err != nil {
+		return "", fmt.Errorf("MOUNT --seed error: %s", err)
+	}
+	if !info.IsDir() {
+		return "", fmt.Errorf("MOUNT --seed %s should be a directory", seed)
+	}
+
+	return dir, nil
+}
+
+// seedVolume copies the files of the seed directory to the volume path;
+// .dockerignore is not applied, as to the host directories of MOUNT
+func (b *Build) seedVolume(containerID, path, seed string) error {
+	dir, err := b.resolveSeed(seed)
+	if err != nil {
+		return err
+	}
+
+	rel, err := filepath.Rel(b.cfg.ContextDir, dir)
+	if err != nil {
+		return err
+	}
+
+	u, err := makeTarStream(b.cfg.ContextDir, strings.TrimSuffix(path, "/")+"/", "MOUNT", []string{rel}, nil, nil)
+	if err != nil {
+		return err
+	}
+	if len(u.files) == 0 {
+		log.Infof("| Seed %s is empty", seed)
+		return nil
+	}
+
+	log.Infof("| Seed %s with %d files of %s", path, len(u.files), seed)
+
+	// The tar has the path prefix, the same way as of COPY
+	return b.client.UploadToContainer(containerID, u.tar, "/")
+}
+
+// removeScopedVolumes removes the volume containers made for this build
+func (b *Build) removeScopedVolumes() {
+	for name := range b.scopedVolumes {
+		if err := b.client.RemoveContainer(name); err != nil {
+			log.Warnf("Failed to remove the volume container %s, error: %s", name, err)
+		}
+	}
+	b.scopedVolumes = nil
+}
@@ -0,0 +1,140 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// maxSecretScanSize is how much of every file added by COPY or ADD is
+// scanned for secrets, the rest of the bigger files is skipped
+const maxSecretScanSize = 1024 * 1024
+
+// secretPattern describes a well-known kind of secret
+type secretPattern struct {
+	name   string
+	regexp *regexp.Regexp
+}
+
+// secretPatterns are the secrets the files added by COPY and ADD and the
+// ENV and LABEL values of the pushed images are scanned for
+var secretPatterns = []secretPattern{
+	{"AWS access key ID", regexp.MustCompile(`\b(AKIA|ASIA)[0-9A-Z]{16}\b`)},
+	{"AWS secret access key", regexp.MustCompile(`(?i)aws_?secret_?access_?key["']?\s*[:=]\s*["']?[A-Za-z0-9/+]{40}\b`)},
+	{"private key", regexp.MustCompile(`-----BEGIN ((RSA|DSA|EC|OPENSSH|PGP|ENCRYPTED) )?PRIVATE KEY( BLOCK)?-----`)},
+	{"npm token", regexp.MustCompile(`_authToken\s*=\s*[^\s$"'{]`)},
+	{"GitHub token", regexp.MustCompile(`\bgh[pousr]_[A-Za-z0-9]{36}\b`)},
+}
+
+// findSecrets returns the names of the secret patterns found in the data
+func findSecrets(data []byte) (found []string) {
+	for _, pattern := range secretPatterns {
+		if pattern.regexp.Match(data) {
+			found = append(found, pattern.name)
+		}
+	}
+	return found
+}
+
+// scanFilesForSecrets looks for the secrets in the files added by COPY or ADD
+func (b *Build) scanFilesForSecrets(cmdName string, files []*uploadFile) error {
+	findings := []string{}
+
+	for _, file := range files {
+		found, err := scanFileForSecrets(file.src)
+		if err != nil {
+			return err
+		}
+		if len(found) == 0 {
+			continue
+		}
+
+		name := file.src
+		if rel, err := filepath.Rel(b.cfg.ContextDir, file.src); err == nil && !strings.HasPrefix(rel, "..") {
+			name = rel
+		}
+		findings = append(findings, fmt.Sprintf("%s %s: %s", cmdName, name, strings.Join(found, ", ")))
+	}
+
+	return b.reportSecrets(cmdName, findings)
+}
+
+func scanFileForSecrets(fileName string) ([]string, error) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to open %s to scan for secrets, error: %s", fileName, err)
+	}
+	defer f.Close()
+
+	if info, err := f.Stat(); err != nil || !info.Mode().IsRegular() {
+		return nil, err
+	}
+
+	data, err := ioutil.ReadAll(io.LimitReader(f, maxSecretScanSize))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read %s to scan for secrets, error: %s", fileName, err)
+	}
+
+	return findSecrets(data), nil
+}
+
+// scanConfigForSecrets looks for the secrets in the ENV and LABEL values of
+// the image; unlike the build args, the names are not checked, since the
+// base images have variables like GPG_KEY that are not secrets
+func (b *Build) scanConfigForSecrets(s State) error {
+	findings := []string{}
+
+	for _, env := range s.Config.Env {
+		parts := strings.SplitN(env, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		if found := findSecrets([]byte(parts[1])); len(found) > 0 {
+			findings = append(findings, fmt.Sprintf("ENV %s: %s", parts[0], strings.Join(found, ", ")))
+		}
+	}
+
+	for name, value := range s.Config.Labels {
+		if found := findSecrets([]byte(value)); len(found) > 0 {
+			findings = append(findings, fmt.Sprintf("LABEL %s: %s", name, strings.Join(found, ", ")))
+		}
+	}
+
+	sort.Strings(findings)
+
+	return b.reportSecrets("The image config", findings)
+}
+
+// reportSecrets warns about the secrets found, or fails with --fail-on-secrets
+func (b *Build) reportSecrets(subject string, findings []string) error {
+	for _, finding := range findings {
+		log.Warnf("| Possible secret in %s", finding)
+	}
+	if len(findings) > 0 && b.cfg.FailOnSecrets {
+		return fmt.Errorf("%s contains possible secrets, see the warnings above (--fail-on-secrets)", subject)
+	}
+	return nil
+}
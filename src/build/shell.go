@@ -0,0 +1,56 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// DefaultShell wraps the shell form of RUN and TEST unless Config.Shell is set
+var DefaultShell = []string{"/bin/sh", "-c"}
+
+// ParseShell parses the shell set by --shell or .rocker.yml, either the words
+// separated by spaces, e.g. `/bin/bash -euo pipefail -c`, or a JSON array
+func ParseShell(value string) ([]string, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return nil, nil
+	}
+
+	shell := strings.Fields(value)
+	if strings.HasPrefix(value, "[") {
+		if err := json.Unmarshal([]byte(value), &shell); err != nil {
+			return nil, fmt.Errorf("Failed to parse shell %s, error: %s", value, err)
+		}
+	}
+
+	if len(shell) == 0 || shell[0] == "" {
+		return nil, fmt.Errorf("Shell %s is empty", value)
+	}
+
+	return shell, nil
+}
+
+// shell returns the command the shell form of RUN and TEST is wrapped into
+func (b *Build) shell() []string {
+	if len(b.cfg.Shell) > 0 {
+		return b.cfg.Shell
+	}
+	return DefaultShell
+}
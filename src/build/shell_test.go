@@ -0,0 +1,98 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestParseShell(t *testing.T) {
+	tests := []struct {
+		value  string
+		result []string
+		errMsg string
+	}{
+		{"", nil, ""},
+		{"/bin/bash -euo pipefail -c", []string{"/bin/bash", "-euo", "pipefail", "-c"}, ""},
+		{`["/bin/bash", "-c"]`, []string{"/bin/bash", "-c"}, ""},
+		{`[]`, nil, "Shell [] is empty"},
+		{`["/bin/bash"`, nil, "Failed to parse shell [\"/bin/bash\", error: unexpected end of JSON input"},
+	}
+
+	for _, test := range tests {
+		result, err := ParseShell(test.value)
+		if test.errMsg != "" {
+			assert.EqualError(t, err, test.errMsg)
+			continue
+		}
+		assert.NoError(t, err)
+		assert.Equal(t, test.result, result, "for %q", test.value)
+	}
+}
+
+func TestCommandRun_Shell(t *testing.T) {
+	b, c := makeBuild(t, "", Config{Shell: []string{"/bin/bash", "-euo", "pipefail", "-c"}})
+	cmd := NewCommand(ConfigCommand{
+		name: "run",
+		args: []string{"curl -s localhost | grep ok"},
+	})
+
+	b.state.ImageID = "123"
+
+	c.On("CreateContainer", mock.AnythingOfType("State")).Return("456", nil).Run(func(args mock.Arguments) {
+		arg := args.Get(0).(State)
+		assert.Equal(t, []string{"/bin/bash", "-euo", "pipefail", "-c", "curl -s localhost | grep ok"}, arg.Config.Cmd)
+	}).Once()
+
+	c.On("RunContainer", "456", false).Return(nil).Once()
+
+	state, err := cmd.Execute(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.AssertExpectations(t)
+	assert.Equal(t, `RUN ["/bin/bash" "-euo" "pipefail" "-c" "curl -s localhost | grep ok"]`, state.GetCommits())
+	assert.Equal(t, DefaultShell, []string{"/bin/sh", "-c"}, "should not modify the default shell")
+}
+
+func TestCommandRun_ShellJSONForm(t *testing.T) {
+	b, c := makeBuild(t, "", Config{Shell: []string{"/bin/bash", "-c"}})
+	cmd := NewCommand(ConfigCommand{
+		name:  "run",
+		args:  []string{"whoami"},
+		attrs: map[string]bool{"json": true},
+	})
+
+	b.state.ImageID = "123"
+
+	c.On("CreateContainer", mock.AnythingOfType("State")).Return("456", nil).Run(func(args mock.Arguments) {
+		arg := args.Get(0).(State)
+		assert.Equal(t, []string{"whoami"}, arg.Config.Cmd)
+	}).Once()
+
+	c.On("RunContainer", "456", false).Return(nil).Once()
+
+	if _, err := cmd.Execute(b); err != nil {
+		t.Fatal(err)
+	}
+
+	c.AssertExpectations(t)
+}
@@ -0,0 +1,130 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// DefaultSmokeTimeout is how long the smoke test container may run
+// unless --timeout (or --smoke-timeout of TAG and PUSH) is given
+const DefaultSmokeTimeout = time.Minute
+
+// CommandSmoke implements SMOKE
+type CommandSmoke struct {
+	CommandBase
+}
+
+// Execute runs the command
+func (c *CommandSmoke) Execute(b *Build) (s State, err error) {
+	s = b.state
+
+	if s.ImageID == "" {
+		return s, fmt.Errorf("Cannot SMOKE empty image")
+	}
+
+	cmd := handleJSONArgs(c.cfg.args, c.cfg.attrs)
+	if len(cmd) == 0 {
+		return s, fmt.Errorf("SMOKE requires a command to run")
+	}
+	if !c.cfg.attrs["json"] {
+		cmd = append(append([]string{}, b.shell()...), cmd...)
+	}
+
+	timeout, err := smokeTimeout("SMOKE --timeout", c.cfg.flags["timeout"])
+	if err != nil {
+		return s, err
+	}
+
+	return s, b.smokeTest(s, cmd, timeout)
+}
+
+// smokeBeforePublish runs the --smoke-cmd of TAG or PUSH, if given,
+// so the image is not tagged or pushed if it is broken
+func (b *Build) smokeBeforePublish(name string, flags map[string]string) error {
+	cmd, ok := flags["smoke-cmd"]
+	if !ok {
+		return nil
+	}
+	if cmd == "" {
+		return fmt.Errorf("%s --smoke-cmd requires a command to run", name)
+	}
+
+	timeout, err := smokeTimeout(name+" --smoke-timeout", flags["smoke-timeout"])
+	if err != nil {
+		return err
+	}
+
+	return b.smokeTest(b.state, append(append([]string{}, b.shell()...), cmd), timeout)
+}
+
+// smokeTest runs the command in a throwaway container of the image and fails
+// unless it exits with 0 in time; the container is made of the image config
+// only, it gets neither the build args nor the MOUNT volumes of the build
+func (b *Build) smokeTest(s State, cmd []string, timeout time.Duration) (err error) {
+	s.Config.Cmd = cmd
+	s.Config.Entrypoint = []string{}
+	s.Config.Labels = b.containerLabels(s.Config.Labels)
+
+	if s.NoCache.HostConfig, err = b.sandboxHostConfig(docker.HostConfig{}, "SMOKE", nil); err != nil {
+		return err
+	}
+
+	log.Infof("| Smoke test image %.12s with %q, timeout %s", s.ImageID, cmd, timeout)
+
+	containerID, err := b.client.CreateContainer(s)
+	if err != nil {
+		return err
+	}
+	// The removal kills the container if it is still running
+	defer b.client.RemoveContainer(containerID)
+
+	errch := make(chan error, 1)
+	go func() {
+		errch <- b.client.RunContainer(containerID, false)
+	}()
+
+	select {
+	case err = <-errch:
+		if err != nil {
+			return fmt.Errorf("Smoke test of image %.12s failed, error: %s", s.ImageID, err)
+		}
+	case <-time.After(timeout):
+		return fmt.Errorf("Smoke test of image %.12s did not finish in %s", s.ImageID, timeout)
+	}
+
+	log.Infof("| Smoke test passed")
+
+	return nil
+}
+
+// smokeTimeout parses the timeout flag, DefaultSmokeTimeout is used if it is empty
+func smokeTimeout(name, value string) (time.Duration, error) {
+	if value == "" {
+		return DefaultSmokeTimeout, nil
+	}
+	timeout, err := time.ParseDuration(value)
+	if err != nil || timeout <= 0 {
+		return 0, fmt.Errorf("%s expects a positive duration, e.g. 30s, got %q", name, value)
+	}
+	return timeout, nil
+}
@@ -0,0 +1,197 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestCommandSmoke_Simple(t *testing.T) {
+	b, c := makeBuild(t, "", Config{})
+	cmd := NewCommand(ConfigCommand{
+		name:  "smoke",
+		args:  []string{"/app/healthcheck", "--once"},
+		attrs: map[string]bool{"json": true},
+	})
+
+	b.state.ImageID = "123"
+	b.state.Config.Entrypoint = []string{"/app/server"}
+	b.state.NoCache.BuildArgs = map[string]string{"http_proxy": "http://host:3128"}
+
+	c.On("CreateContainer", mock.AnythingOfType("State")).Return("456", nil).Run(func(args mock.Arguments) {
+		arg := args.Get(0).(State)
+		assert.Equal(t, []string{"/app/healthcheck", "--once"}, arg.Config.Cmd)
+		assert.Equal(t, []string{}, arg.Config.Entrypoint)
+		assert.Empty(t, arg.Config.Env)
+	}).Once()
+	c.On("RunContainer", "456", false).Return(nil).Once()
+	c.On("RemoveContainer", "456").Return(nil).Once()
+
+	state, err := cmd.Execute(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.AssertExpectations(t)
+	assert.Equal(t, "123", state.ImageID)
+	assert.Equal(t, []string{"/app/server"}, state.Config.Entrypoint)
+	assert.Empty(t, state.Commits)
+}
+
+func TestCommandSmoke_Failed(t *testing.T) {
+	b, c := makeBuild(t, "", Config{})
+	cmd := NewCommand(ConfigCommand{
+		name: "smoke",
+		args: []string{"curl -f localhost"},
+	})
+
+	b.state.ImageID = "123"
+
+	c.On("CreateContainer", mock.AnythingOfType("State")).Return("456", nil).Run(func(args mock.Arguments) {
+		arg := args.Get(0).(State)
+		assert.Equal(t, []string{"/bin/sh", "-c", "curl -f localhost"}, arg.Config.Cmd)
+	}).Once()
+	c.On("RunContainer", "456", false).Return(fmt.Errorf("Container exited with code 7")).Once()
+	c.On("RemoveContainer", "456").Return(nil).Once()
+
+	_, err := cmd.Execute(b)
+	c.AssertExpectations(t)
+	assert.EqualError(t, err, "Smoke test of image 123 failed, error: Container exited with code 7")
+}
+
+func TestCommandSmoke_Timeout(t *testing.T) {
+	b, c := makeBuild(t, "", Config{})
+	cmd := NewCommand(ConfigCommand{
+		name:  "smoke",
+		args:  []string{"sleep 100"},
+		flags: map[string]string{"timeout": "10ms"},
+	})
+
+	b.state.ImageID = "123"
+
+	// The removal kills the running container
+	killed := make(chan struct{})
+
+	c.On("CreateContainer", mock.AnythingOfType("State")).Return("456", nil).Once()
+	c.On("RunContainer", "456", false).Return(fmt.Errorf("Container exited with code 137")).Run(func(args mock.Arguments) {
+		<-killed
+	}).Once()
+	c.On("RemoveContainer", "456").Return(nil).Run(func(args mock.Arguments) {
+		close(killed)
+	}).Once()
+
+	_, err := cmd.Execute(b)
+	c.AssertExpectations(t)
+	assert.EqualError(t, err, "Smoke test of image 123 did not finish in 10ms")
+}
+
+func TestCommandSmoke_NoImage(t *testing.T) {
+	b, _ := makeBuild(t, "", Config{})
+	cmd := NewCommand(ConfigCommand{
+		name: "smoke",
+		args: []string{"true"},
+	})
+
+	_, err := cmd.Execute(b)
+	assert.EqualError(t, err, "Cannot SMOKE empty image")
+}
+
+func TestCommandTag_SmokeCmdFailed(t *testing.T) {
+	b, c := makeBuild(t, "", Config{})
+	cmd := NewCommand(ConfigCommand{
+		name:  "tag",
+		args:  []string{"docker.io/grammarly/rocker:1.0"},
+		flags: map[string]string{"smoke-cmd": "/app/healthcheck --once"},
+	})
+
+	b.state.ImageID = "123"
+
+	c.On("CreateContainer", mock.AnythingOfType("State")).Return("456", nil).Run(func(args mock.Arguments) {
+		arg := args.Get(0).(State)
+		assert.Equal(t, []string{"/bin/sh", "-c", "/app/healthcheck --once"}, arg.Config.Cmd)
+	}).Once()
+	c.On("RunContainer", "456", false).Return(fmt.Errorf("Container exited with code 1")).Once()
+	c.On("RemoveContainer", "456").Return(nil).Once()
+
+	_, err := cmd.Execute(b)
+	c.AssertExpectations(t)
+	assert.EqualError(t, err, "Smoke test of image 123 failed, error: Container exited with code 1")
+}
+
+func TestCommandPush_SmokeCmd(t *testing.T) {
+	b, c := makeBuild(t, "", Config{})
+	cmd := NewCommand(ConfigCommand{
+		name:  "push",
+		args:  []string{"docker.io/grammarly/rocker:1.0"},
+		flags: map[string]string{"smoke-cmd": "/app/healthcheck", "smoke-timeout": "30s"},
+	})
+
+	b.state.ImageID = "123"
+
+	c.On("CreateContainer", mock.AnythingOfType("State")).Return("456", nil).Once()
+	c.On("RunContainer", "456", false).Return(nil).Once()
+	c.On("RemoveContainer", "456").Return(nil).Once()
+	c.On("InspectImage", "123").Return(&docker.Image{ID: "123", Config: &docker.Config{}}, nil).Once()
+	c.On("TagImage", "123", "docker.io/grammarly/rocker:1.0").Return(nil).Once()
+
+	_, err := cmd.Execute(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.AssertExpectations(t)
+}
+
+func TestSmokeTimeout(t *testing.T) {
+	timeout, err := smokeTimeout("SMOKE --timeout", "")
+	assert.NoError(t, err)
+	assert.Equal(t, DefaultSmokeTimeout, timeout)
+
+	_, err = smokeTimeout("SMOKE --timeout", "-1s")
+	assert.EqualError(t, err, `SMOKE --timeout expects a positive duration, e.g. 30s, got "-1s"`)
+
+	_, err = smokeTimeout("PUSH --smoke-timeout", "soon")
+	assert.EqualError(t, err, `PUSH --smoke-timeout expects a positive duration, e.g. 30s, got "soon"`)
+}
+
+func TestPlan_Smoke(t *testing.T) {
+	p := makePlan(t, `
+FROM ubuntu
+ENV PORT=80
+SMOKE ["/app/healthcheck", "--once"]
+PUSH repo/app
+`)
+
+	expected := []Command{
+		&CommandFrom{},
+		&CommandEnv{},
+		&CommandCommit{},
+		&CommandSmoke{},
+		&CommandPush{},
+		&CommandCleanup{},
+	}
+
+	assert.Len(t, p, len(expected))
+	for i, c := range expected {
+		assert.IsType(t, c, p[i])
+	}
+}
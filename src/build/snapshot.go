@@ -0,0 +1,201 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/docker/docker/pkg/archive"
+	"github.com/go-yaml/yaml"
+	"github.com/grammarly/rocker/src/imagename"
+	"github.com/grammarly/rocker/src/util"
+)
+
+// FromImage describes the base image resolved by a FROM instruction
+type FromImage struct {
+	Name    string   `json:"name"`
+	Image   string   `json:"image"`
+	ID      string   `json:"id"`
+	Digests []string `json:"digests,omitempty"`
+
+	// Verdict is the decision of the base digest policy, if the image is in its allowlist
+	Verdict *BaseDigestVerdict `json:"verdict,omitempty"`
+}
+
+// Provenance describes what the build was made of and what it produced
+type Provenance struct {
+	RockerVersion string               `json:"rocker_version"`
+	Created       time.Time            `json:"created"`
+	Rockerfile    string               `json:"rockerfile"`
+	ContextDir    string               `json:"context_dir"`
+	Dockerignore  []string             `json:"dockerignore,omitempty"`
+	BuildArgs     map[string]string    `json:"build_args,omitempty"`
+	From          []FromImage          `json:"from"`
+	ImageID       string               `json:"image_id,omitempty"`
+	Artifacts     []imagename.Artifact `json:"artifacts,omitempty"`
+	Error         string               `json:"error,omitempty"`
+
+	FailureSnapshot string `json:"failure_snapshot,omitempty"`
+}
+
+// ContextSnapshot is the archive of the filtered build context, the rendered
+// Rockerfile, the vars and the provenance of the build. The context is archived
+// before the build starts, since MOUNTs may change it while building.
+type ContextSnapshot struct {
+	fileName string
+	file     *os.File
+	gz       *gzip.Writer
+	tw       *tar.Writer
+	created  time.Time
+}
+
+// NewContextSnapshot creates the .tar.gz snapshot file and writes the context,
+// the rendered Rockerfile and the vars into it; Finish must be called after the build
+func NewContextSnapshot(fileName, contextDir string, dockerignore []string, rockerfile *Rockerfile) (s *ContextSnapshot, err error) {
+	s = &ContextSnapshot{
+		fileName: fileName,
+		created:  time.Now(),
+	}
+
+	if s.file, err = util.CreateOutputFile(fileName); err != nil {
+		return nil, fmt.Errorf("Failed to create context snapshot %s, error: %s", fileName, err)
+	}
+	s.gz = gzip.NewWriter(s.file)
+	s.tw = tar.NewWriter(s.gz)
+
+	defer func() {
+		if err != nil {
+			s.file.Close()
+			os.Remove(fileName)
+		}
+	}()
+
+	context, err := archive.TarWithOptions(contextDir, &archive.TarOptions{
+		ExcludePatterns: dockerignore,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Failed to make tar of %s, error: %s", contextDir, err)
+	}
+	defer context.Close()
+
+	if err = s.addTar("context/", context); err != nil {
+		return nil, fmt.Errorf("Failed to write context to snapshot %s, error: %s", fileName, err)
+	}
+
+	if err = s.addFile("Rockerfile", []byte(rockerfile.Content)); err != nil {
+		return nil, err
+	}
+
+	vars, err := yaml.Marshal(rockerfile.Vars)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to marshal vars, error: %s", err)
+	}
+	if err = s.addFile("vars.yml", vars); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// Finish writes provenance.json and closes the snapshot
+func (s *ContextSnapshot) Finish(p Provenance) error {
+	defer s.file.Close()
+
+	p.Created = s.created
+
+	data, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return fmt.Errorf("Failed to marshal provenance, error: %s", err)
+	}
+	if err := s.addFile("provenance.json", append(data, '\n')); err != nil {
+		return err
+	}
+
+	if err := s.tw.Close(); err != nil {
+		return fmt.Errorf("Failed to close context snapshot %s, error: %s", s.fileName, err)
+	}
+	if err := s.gz.Close(); err != nil {
+		return fmt.Errorf("Failed to close context snapshot %s, error: %s", s.fileName, err)
+	}
+
+	return nil
+}
+
+// NewProvenance makes the provenance of the build that has been run
+func NewProvenance(b *Build, buildErr error) Provenance {
+	p := Provenance{
+		Rockerfile:   b.rockerfile.Name,
+		ContextDir:   b.cfg.ContextDir,
+		Dockerignore: b.cfg.Dockerignore,
+		BuildArgs:    b.cfg.BuildArgs,
+		From:         b.From,
+		ImageID:      b.GetImageID(),
+		Artifacts:    b.Artifacts,
+
+		FailureSnapshot: b.FailureSnapshot,
+	}
+	if buildErr != nil {
+		p.Error = buildErr.Error()
+	}
+	return p
+}
+
+func (s *ContextSnapshot) addFile(name string, data []byte) error {
+	hdr := &tar.Header{
+		Name:    name,
+		Mode:    0644,
+		Size:    int64(len(data)),
+		ModTime: s.created,
+	}
+	if err := s.tw.WriteHeader(hdr); err != nil {
+		return fmt.Errorf("Failed to write %s to snapshot %s, error: %s", name, s.fileName, err)
+	}
+	if _, err := s.tw.Write(data); err != nil {
+		return fmt.Errorf("Failed to write %s to snapshot %s, error: %s", name, s.fileName, err)
+	}
+	return nil
+}
+
+// addTar copies the entries of the tar stream under the prefix
+func (s *ContextSnapshot) addTar(prefix string, in io.Reader) error {
+	tr := tar.NewReader(in)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		hdr.Name = prefix + hdr.Name
+		if hdr.Typeflag == tar.TypeLink {
+			hdr.Linkname = prefix + hdr.Linkname
+		}
+		if err := s.tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err := io.Copy(s.tw, tr); err != nil {
+			return err
+		}
+	}
+}
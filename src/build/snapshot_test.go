@@ -0,0 +1,120 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/grammarly/rocker/src/template"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestContextSnapshot(t *testing.T) {
+	tmpDir := makeContextFiles(t, map[string]string{
+		"Rockerfile": "FROM {{ .Base }}",
+		"app.js":     "1",
+		"util.js":    "2",
+		"secret.txt": "3",
+	})
+	defer os.RemoveAll(tmpDir)
+
+	rockerfile, err := NewRockerfile("Rockerfile", strings.NewReader("FROM {{ .Base }}"), template.Vars{"Base": "debian"}, template.Funs{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fileName := filepath.Join(tmpDir, "snapshot.tar.gz")
+
+	snapshot, err := NewContextSnapshot(fileName, tmpDir, []string{"secret.txt", "snapshot.tar.gz"}, rockerfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, c := makeBuild(t, "", Config{ContextDir: tmpDir})
+	c.On("InspectImage", "debian:latest").Return(&docker.Image{ID: "123", RepoDigests: []string{"debian@sha256:abc"}}, nil).Once()
+
+	if _, err := NewCommand(ConfigCommand{name: "from", args: []string{"debian"}}).Execute(b); err != nil {
+		t.Fatal(err)
+	}
+
+	p := NewProvenance(b, nil)
+	p.RockerVersion = "1.0.0"
+	if err := snapshot.Finish(p); err != nil {
+		t.Fatal(err)
+	}
+
+	files := readSnapshot(t, fileName)
+
+	names := []string{}
+	for name := range files {
+		names = append(names, name)
+	}
+	assert.Contains(t, names, "context/app.js")
+	assert.Contains(t, names, "context/util.js")
+	assert.NotContains(t, names, "context/secret.txt")
+
+	assert.Equal(t, "FROM debian", files["Rockerfile"])
+	assert.Equal(t, "Base: debian\n", files["vars.yml"])
+
+	provenance := Provenance{}
+	if err := json.Unmarshal([]byte(files["provenance.json"]), &provenance); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "1.0.0", provenance.RockerVersion)
+	assert.Equal(t, []FromImage{{Name: "debian", Image: "debian", ID: "123", Digests: []string{"debian@sha256:abc"}}}, provenance.From)
+}
+
+func readSnapshot(t *testing.T, fileName string) map[string]string {
+	f, err := os.Open(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files := map[string]string{}
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[hdr.Name] = string(data)
+	}
+
+	return files
+}
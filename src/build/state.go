@@ -20,6 +20,7 @@ import (
 	"fmt"
 	"sort"
 	"strings"
+	"time"
 
 	"github.com/fsouza/go-dockerclient"
 )
@@ -36,9 +37,19 @@ type State struct {
 	InjectCommands []string
 	Commits        []string
 
+	// UserID is the numeric uid:gid of the current USER, if known
+	UserID string `json:",omitempty"`
+
 	ParentSize int64
 	Size       int64
 
+	// CacheKey is set only for the states stored in the cache
+	CacheKey *CacheKey `json:",omitempty"`
+
+	// Duration is how long it took to make the state, it is stored
+	// in the cache to estimate the time saved by the cache hits
+	Duration time.Duration `json:",omitempty"`
+
 	NoCache StateNoCache
 }
 
@@ -50,13 +61,29 @@ type StateNoCache struct {
 	ContainerID  string
 	HostConfig   docker.HostConfig
 	BuildArgs    map[string]string
+
+	// CopyKey is the key of the COPY or ADD step to remember once
+	// it is committed, see Config.DedupeCopy
+	CopyKey string
+
+	// CommitLabels are added to the labels of the committed image only,
+	// they are not the part of the config and the cache key
+	CommitLabels map[string]string
+
+	// Publish marks the commit of the image to TAG or PUSH, which is
+	// not labeled as intermediate and is never skipped as a noop
+	Publish bool
 }
 
 // NewState makes a fresh state
 func NewState(b *Build) State {
 	s := State{}
 	s.NoCache.Dockerignore = b.cfg.Dockerignore
+	// Every FROM section gets the passed build args, ARG defaults are its own
 	s.NoCache.BuildArgs = map[string]string{}
+	for k, v := range b.cfg.BuildArgs {
+		s.NoCache.BuildArgs[k] = v
+	}
 	return s
 }
 
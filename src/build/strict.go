@@ -0,0 +1,94 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// warn logs the warning, or returns it as an error in the strict mode
+func (b *Build) warn(format string, args ...interface{}) error {
+	msg := fmt.Sprintf(format, args...)
+	if b.cfg.Strict {
+		return fmt.Errorf("%s (strict mode)", msg)
+	}
+	log.Warnf("| %s", msg)
+	return nil
+}
+
+var envRefRegexp = regexp.MustCompile(`(\\?)\$(\{)?([a-zA-Z_][a-zA-Z0-9_]*)(:[-+])?`)
+
+// undefinedEnvRefs returns the names of the variables referenced by the args
+// that are not defined by env, they silently expand to empty strings;
+// escaped references and the ones with ${VAR:-default} are not counted
+func undefinedEnvRefs(args []string, env []string) (names []string) {
+	defined := envToMap(replaceOrAppendEnvValues([]string{"PATH=" + DefaultPathEnv}, env))
+	seen := map[string]bool{}
+
+	for _, arg := range args {
+		for _, m := range envRefRegexp.FindAllStringSubmatch(arg, -1) {
+			escaped, braced, name, modifier := m[1] != "", m[2] != "", m[3], m[4]
+			if escaped || (braced && modifier != "") || seen[name] {
+				continue
+			}
+			if _, ok := defined[name]; !ok {
+				names = append(names, name)
+				seen[name] = true
+			}
+		}
+	}
+
+	return names
+}
+
+// UnusedVars returns the names of the vars that are not referenced
+// anywhere in the Rockerfile source
+func (r *Rockerfile) UnusedVars(names []string) (unused []string) {
+	for _, name := range names {
+		re := regexp.MustCompile(`\b` + regexp.QuoteMeta(name) + `\b`)
+		if !re.MatchString(strings.Join(append([]string{r.Source}, r.fragmentSources...), "\n")) {
+			unused = append(unused, name)
+		}
+	}
+	return unused
+}
+
+// checkEnvRefs warns about the references to undefined variables
+// in the args of the instructions that expand env; the ONLY IF / SKIP IF
+// wrapper replaces env of any command, so the wrapped one is looked at
+func (b *Build) checkEnvRefs(command Command) error {
+	if wrap, ok := command.(*CommandConditionWrap); ok {
+		command = wrap.cmd
+	}
+	if _, ok := command.(EnvReplacableCommand); !ok {
+		return nil
+	}
+	cfg, ok := commandConfig(command)
+	if !ok {
+		return nil
+	}
+	for _, name := range undefinedEnvRefs(cfg.args, b.state.Config.Env) {
+		if err := b.warn("%s references undefined variable $%s, it expands to an empty string", strings.ToUpper(cfg.name), name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
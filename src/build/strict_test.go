@@ -0,0 +1,83 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/grammarly/rocker/src/template"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStrict_UndefinedEnvRefs(t *testing.T) {
+	env := []string{"FOO=1", "EMPTY="}
+	args := []string{"$FOO", "${BAR}/bin", "$PATH:$EMPTY", `\$ESCAPED`, "${DEF:-x}", "$BAR$BAZ"}
+
+	assert.Equal(t, []string{"BAR", "BAZ"}, undefinedEnvRefs(args, env))
+	assert.Nil(t, undefinedEnvRefs([]string{"plain"}, nil))
+}
+
+func TestStrict_UnusedVars(t *testing.T) {
+	src := "FROM {{ .Base }}\nENV VERSION={{ index . \"Version\" }}"
+	r, err := NewRockerfile("test", strings.NewReader(src), template.Vars{"Base": "ubuntu", "Version": "1"}, template.Funs{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, []string{"Bas", "Unused"}, r.UnusedVars([]string{"Base", "Version", "Bas", "Unused"}))
+}
+
+func TestStrict_CheckEnvRefs(t *testing.T) {
+	cmd := NewCommand(ConfigCommand{
+		name: "env",
+		args: []string{"PATH", "$PATH:$HOME/bin"},
+	})
+
+	b, _ := makeBuild(t, "", Config{})
+	assert.Nil(t, b.checkEnvRefs(cmd))
+
+	b, _ = makeBuild(t, "", Config{Strict: true})
+	assert.EqualError(t, b.checkEnvRefs(cmd), "ENV references undefined variable $HOME, it expands to an empty string (strict mode)")
+
+	b.state.Config.Env = []string{"HOME=/root"}
+	assert.Nil(t, b.checkEnvRefs(cmd))
+}
+
+func TestStrict_CheckEnvRefsCondition(t *testing.T) {
+	b, _ := makeBuild(t, "", Config{Strict: true})
+
+	// the shell expands the env of RUN, it is not checked with a condition either
+	run := &CommandConditionWrap{cmd: NewCommand(ConfigCommand{name: "run", args: []string{"echo $HOME"}})}
+	assert.Nil(t, b.checkEnvRefs(run))
+
+	env := &CommandConditionWrap{cmd: NewCommand(ConfigCommand{name: "env", args: []string{"PATH", "$HOME/bin"}})}
+	assert.EqualError(t, b.checkEnvRefs(env), "ENV references undefined variable $HOME, it expands to an empty string (strict mode)")
+}
+
+func TestStrict_PushWithoutPushFlag(t *testing.T) {
+	b, _ := makeBuild(t, "", Config{Strict: true})
+	cmd := NewCommand(ConfigCommand{
+		name: "push",
+		args: []string{"docker.io/grammarly/rocker:1.0"},
+	})
+
+	b.state.ImageID = "123"
+
+	_, err := cmd.Execute(b)
+	assert.EqualError(t, err, "PUSH docker.io/grammarly/rocker:1.0 without --push flag (strict mode)")
+}
@@ -0,0 +1,103 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"bufio"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// SyntaxVersions are the Rockerfile syntax versions supported by this rocker,
+// the last one is the current; new versions are added when the semantics
+// of instructions change, so old Rockerfiles keep being built the old way;
+// since 1.2 CMD of an earlier FROM section does not keep ENTRYPOINT from resetting CMD
+var SyntaxVersions = []string{"1.0", "1.1", "1.2"}
+
+// DefaultSyntaxVersion is assumed for the Rockerfiles without a syntax header
+const DefaultSyntaxVersion = "1.0"
+
+var syntaxHeaderRegexp = regexp.MustCompile(`^#\s*rocker:syntax\s*=\s*(\S*)\s*$`)
+
+// parseSyntaxHeader looks for the `# rocker:syntax=1.1` header among the
+// comments at the top of the Rockerfile and validates the version
+func parseSyntaxHeader(source string) (version string, err error) {
+	scanner := bufio.NewScanner(strings.NewReader(source))
+
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		if !strings.HasPrefix(line, "#") {
+			break
+		}
+		if matches := syntaxHeaderRegexp.FindStringSubmatch(line); matches != nil {
+			return matches[1], checkSyntaxVersion(matches[1])
+		}
+	}
+
+	return DefaultSyntaxVersion, nil
+}
+
+func checkSyntaxVersion(version string) error {
+	v, err := parseSyntaxVersion(version)
+	if err != nil {
+		return err
+	}
+
+	for _, supported := range SyntaxVersions {
+		if version == supported {
+			return nil
+		}
+	}
+
+	current := SyntaxVersions[len(SyntaxVersions)-1]
+	latest, _ := parseSyntaxVersion(current)
+
+	if v[0] > latest[0] || (v[0] == latest[0] && v[1] > latest[1]) {
+		return fmt.Errorf("Rockerfile syntax %s is newer than the latest supported %s, please upgrade rocker: https://github.com/grammarly/rocker/releases", version, current)
+	}
+
+	return fmt.Errorf("Rockerfile syntax %s is not supported, the supported versions are: %s", version, strings.Join(SyntaxVersions, ", "))
+}
+
+// syntaxAtLeast returns true if the Rockerfile syntax version is min or newer
+func (b *Build) syntaxAtLeast(min string) bool {
+	v, err := parseSyntaxVersion(b.rockerfile.Syntax)
+	if err != nil {
+		return false
+	}
+	m, _ := parseSyntaxVersion(min)
+	return v[0] > m[0] || (v[0] == m[0] && v[1] >= m[1])
+}
+
+// parseSyntaxVersion parses the version of the form MAJOR.MINOR
+func parseSyntaxVersion(version string) (v [2]int, err error) {
+	parts := strings.Split(version, ".")
+	if len(parts) != 2 {
+		return v, fmt.Errorf("Invalid Rockerfile syntax version %q, expected the form of MAJOR.MINOR, e.g. %s", version, SyntaxVersions[len(SyntaxVersions)-1])
+	}
+	for i, part := range parts {
+		if v[i], err = strconv.Atoi(part); err != nil || v[i] < 0 {
+			return v, fmt.Errorf("Invalid Rockerfile syntax version %q, expected the form of MAJOR.MINOR, e.g. %s", version, SyntaxVersions[len(SyntaxVersions)-1])
+		}
+	}
+	return v, nil
+}
@@ -0,0 +1,149 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/grammarly/rocker/src/imagename"
+	"github.com/grammarly/rocker/src/util"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// TagCache keeps the tag lists of the registry repositories on disk for the
+// TTL, so the rocker processes sharing the cache dir, e.g. on a CI host, do
+// not list the same repository over and over. An entry is locked while it
+// is refreshed, the processes that need it meanwhile wait and take the new one.
+type TagCache struct {
+	dir string
+	ttl time.Duration
+
+	mu    sync.Mutex
+	stats TagCacheStats
+}
+
+// TagCacheStats counts the lookups of the tag lists by a TagCache
+type TagCacheStats struct {
+	Hits   int `json:"hits"`
+	Misses int `json:"misses"`
+}
+
+// String returns the human readable representation of the stats,
+// e.g. 3 hits, 1 misses (75% hit rate)
+func (s TagCacheStats) String() string {
+	summary := fmt.Sprintf("%d hits, %d misses", s.Hits, s.Misses)
+	if total := s.Hits + s.Misses; total > 0 {
+		summary += fmt.Sprintf(" (%d%% hit rate)", s.Hits*100/total)
+	}
+	return summary
+}
+
+// tagCacheEntry is the cached tag list of a repository
+type tagCacheEntry struct {
+	Repository string    `json:"repository"`
+	Fetched    time.Time `json:"fetched"`
+	Tags       []string  `json:"tags"`
+}
+
+// NewTagCache makes the cache of the tag lists in dir, which keeps them for ttl
+func NewTagCache(dir string, ttl time.Duration) *TagCache {
+	return &TagCache{dir: dir, ttl: ttl}
+}
+
+// Tags returns the tags of the image repository out of the cache, or lists
+// them with fetch and caches them if there are none younger than the TTL;
+// the failures of fetch are not cached
+func (c *TagCache) Tags(image *imagename.ImageName, fetch func() ([]string, error)) (tags []string, err error) {
+	var (
+		repository = image.CanonicalName()
+		id         = fmt.Sprintf("%x", sha256.Sum256([]byte(repository)))
+		fileName   = filepath.Join(c.dir, id+".json")
+	)
+
+	lock, err := util.LockFile(filepath.Join(c.dir, id+".lock"), true)
+	if err != nil {
+		return nil, err
+	}
+	defer lock.Unlock()
+
+	if entry, ok := c.read(fileName); ok && entry.Repository == repository && time.Since(entry.Fetched) < c.ttl {
+		log.Debugf("Take the tags of %s from the registry cache, listed %s ago", repository, time.Since(entry.Fetched))
+		c.count(true)
+		return entry.Tags, nil
+	}
+
+	c.count(false)
+
+	if tags, err = fetch(); err != nil {
+		return nil, err
+	}
+
+	data, err := json.Marshal(tagCacheEntry{Repository: repository, Fetched: time.Now(), Tags: tags})
+	if err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(fileName, data, 0644); err != nil {
+		log.Warnf("Failed to write the registry cache entry %s, error: %s", fileName, err)
+		return tags, nil
+	}
+	if err := util.ChownOutput(fileName); err != nil {
+		return nil, err
+	}
+
+	return tags, nil
+}
+
+// Stats returns the hits and misses of the lookups made with the cache
+func (c *TagCache) Stats() TagCacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.stats
+}
+
+func (c *TagCache) count(hit bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if hit {
+		c.stats.Hits++
+	} else {
+		c.stats.Misses++
+	}
+}
+
+// read reads the cache entry, a missing or broken one is not there
+func (c *TagCache) read(fileName string) (entry tagCacheEntry, ok bool) {
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Debugf("Failed to read the registry cache entry %s, error: %s", fileName, err)
+		}
+		return entry, false
+	}
+	if err := json.Unmarshal(data, &entry); err != nil {
+		log.Debugf("Ignore the broken registry cache entry %s, error: %s", fileName, err)
+		return entry, false
+	}
+	return entry, true
+}
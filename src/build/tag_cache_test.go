@@ -0,0 +1,92 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/grammarly/rocker/src/imagename"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTagCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rocker-tag-cache-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fetches := 0
+	fetch := func() ([]string, error) {
+		fetches++
+		return []string{"1.6", "1.7"}, nil
+	}
+
+	cache := NewTagCache(dir, time.Hour)
+
+	tags, err := cache.Tags(imagename.NewFromString("golang:1.*"), fetch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []string{"1.6", "1.7"}, tags)
+
+	// The entry is kept by repository and shared by another process
+	tags, err = NewTagCache(dir, time.Hour).Tags(imagename.NewFromString("docker.io/library/golang:1.6"), fetch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []string{"1.6", "1.7"}, tags)
+	assert.Equal(t, 1, fetches)
+
+	// Expired
+	if _, err = NewTagCache(dir, time.Nanosecond).Tags(imagename.NewFromString("golang:1.*"), fetch); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 2, fetches)
+
+	assert.Equal(t, TagCacheStats{Hits: 0, Misses: 1}, cache.Stats())
+	assert.Equal(t, "0 hits, 1 misses (0% hit rate)", cache.Stats().String())
+}
+
+func TestTagCache_FailureNotCached(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rocker-tag-cache-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cache := NewTagCache(dir, time.Hour)
+
+	_, err = cache.Tags(imagename.NewFromString("golang:1.*"), func() ([]string, error) {
+		return nil, fmt.Errorf("registry is down")
+	})
+	assert.EqualError(t, err, "registry is down")
+
+	tags, err := cache.Tags(imagename.NewFromString("golang:1.*"), func() ([]string, error) {
+		return []string{"1.7"}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []string{"1.7"}, tags)
+	assert.Equal(t, "0 hits, 2 misses (0% hit rate)", cache.Stats().String())
+}
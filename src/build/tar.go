@@ -116,3 +116,46 @@ func (ta *tarAppender) addTarFile(path, name string) error {
 
 	return nil
 }
+
+// chownTarStream rewrites the ownership of every entry of the tar stream
+// to the numeric uid:gid
+func chownTarStream(in io.ReadCloser, id string) (io.ReadCloser, error) {
+	uid, gid, err := parseChown(id)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse chown %s, error: %s", id, err)
+	}
+
+	pipeReader, pipeWriter := io.Pipe()
+
+	go func() {
+		defer in.Close()
+
+		tr := tar.NewReader(in)
+		tw := tar.NewWriter(pipeWriter)
+
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				pipeWriter.CloseWithError(err)
+				return
+			}
+			hdr.Uid, hdr.Gid = uid, gid
+			hdr.Uname, hdr.Gname = "", ""
+			if err := tw.WriteHeader(hdr); err != nil {
+				pipeWriter.CloseWithError(err)
+				return
+			}
+			if _, err := io.Copy(tw, tr); err != nil {
+				pipeWriter.CloseWithError(err)
+				return
+			}
+		}
+
+		pipeWriter.CloseWithError(tw.Close())
+	}()
+
+	return pipeReader, nil
+}
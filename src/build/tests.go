@@ -0,0 +1,138 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+
+	"github.com/docker/docker/pkg/archive"
+	"github.com/grammarly/rocker/src/util"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// TestReportsDir is the directory within --artifacts-path
+// the reports of TEST instructions are collected to
+const TestReportsDir = "test-reports"
+
+// CommandTest implements TEST
+type CommandTest struct {
+	CommandBase
+}
+
+// Execute runs the command
+func (c *CommandTest) Execute(b *Build) (s State, err error) {
+	s = b.state
+
+	if s.ImageID == "" && !s.NoBaseImage {
+		return s, fmt.Errorf("Please provide a source image with `FROM` prior to TEST")
+	}
+
+	cmd := handleJSONArgs(c.cfg.args, c.cfg.attrs)
+	if len(cmd) == 0 {
+		return s, fmt.Errorf("TEST requires a command to run")
+	}
+	if !c.cfg.attrs["json"] {
+		cmd = append(append([]string{}, b.shell()...), cmd...)
+	}
+
+	// The container is never committed, so tests leave nothing in the image
+	origState := s
+	defer func() {
+		s = origState
+	}()
+
+	s.Config.Cmd = cmd
+	s.Config.Entrypoint = []string{}
+	s.Config.Env = append(s.Config.Env, b.runBuildEnv(s)...)
+	s.Config.Labels = b.containerLabels(s.Config.Labels)
+
+	if s.NoCache.HostConfig, err = b.sandboxHostConfig(s.NoCache.HostConfig, "TEST", c.cfg.flags); err != nil {
+		return s, err
+	}
+
+	containerID, err := b.client.CreateContainer(s)
+	if err != nil {
+		return s, err
+	}
+	defer b.client.RemoveContainer(containerID)
+
+	testErr := b.client.RunContainer(containerID, false)
+
+	// Reports are collected from failed tests too, they are needed the most then
+	if reports := testReportPaths(c.cfg.flags); len(reports) > 0 {
+		if err := b.collectTestReports(containerID, reports); err != nil {
+			if testErr != nil {
+				log.Errorf("| %s", err)
+			} else {
+				return s, err
+			}
+		}
+	}
+
+	if testErr != nil {
+		b.snapshotFailure(origState, containerID)
+		return s, fmt.Errorf("TEST failed, error: %s", testErr)
+	}
+
+	log.Infof("| Tests passed")
+
+	return s, nil
+}
+
+// testReportPaths returns the container paths given by --report=path1,path2
+func testReportPaths(flags map[string]string) (paths []string) {
+	return splitFlagList(flags["report"])
+}
+
+// collectTestReports copies the report files or directories from the test
+// container to the test-reports directory within --artifacts-path
+func (b *Build) collectTestReports(containerID string, paths []string) error {
+	if b.cfg.ArtifactsPath == "" {
+		log.Infof("| Skip collecting test reports %s, --artifacts-path is not set", strings.Join(paths, ", "))
+		return nil
+	}
+
+	dest := filepath.Join(b.cfg.ArtifactsPath, TestReportsDir)
+	if err := util.MkdirAllOutput(dest, 0755); err != nil {
+		return fmt.Errorf("Failed to create test reports directory %s, error: %s", dest, err)
+	}
+
+	for _, path := range paths {
+		pipeReader, pipeWriter := io.Pipe()
+
+		go func() {
+			pipeWriter.CloseWithError(b.client.DownloadFromContainer(containerID, path, pipeWriter))
+		}()
+
+		err := archive.Untar(pipeReader, dest, &archive.TarOptions{NoLchown: true})
+		pipeReader.Close()
+		if err != nil {
+			return fmt.Errorf("Failed to collect test report %s, error: %s", path, err)
+		}
+		if err := util.ChownOutputTree(dest); err != nil {
+			return err
+		}
+
+		log.Infof("| Collected test report %s to %s", path, dest)
+	}
+
+	return nil
+}
@@ -0,0 +1,139 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestCommandTest_Simple(t *testing.T) {
+	b, c := makeBuild(t, "", Config{})
+	cmd := NewCommand(ConfigCommand{
+		name: "test",
+		args: []string{"./run-tests.sh"},
+	})
+
+	origCmd := []string{"/bin/program"}
+	b.state.Config.Cmd = origCmd
+	b.state.ImageID = "123"
+	b.state.NoCache.BuildArgs = map[string]string{"CI": "1"}
+	b.allowedBuildArgs["CI"] = true
+
+	c.On("CreateContainer", mock.AnythingOfType("State")).Return("456", nil).Run(func(args mock.Arguments) {
+		arg := args.Get(0).(State)
+		assert.Equal(t, []string{"/bin/sh", "-c", "./run-tests.sh"}, arg.Config.Cmd)
+		assert.Equal(t, []string{"CI=1"}, arg.Config.Env)
+	}).Once()
+
+	c.On("RunContainer", "456", false).Return(nil).Once()
+	c.On("RemoveContainer", "456").Return(nil).Once()
+
+	state, err := cmd.Execute(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.AssertExpectations(t)
+	assert.Equal(t, origCmd, state.Config.Cmd)
+	assert.Empty(t, state.Config.Env)
+	assert.Equal(t, "123", state.ImageID)
+	assert.Equal(t, "", state.NoCache.ContainerID)
+	assert.Equal(t, "", state.GetCommits())
+}
+
+func TestCommandTest_ContainerLabels(t *testing.T) {
+	b, c := makeBuild(t, "", Config{ID: "app"})
+	cmd := NewCommand(ConfigCommand{
+		name: "test",
+		args: []string{"./run-tests.sh"},
+	})
+
+	b.step = 3
+	b.state.ImageID = "123"
+	b.state.Config.Labels = map[string]string{"maintainer": "me"}
+
+	c.On("CreateContainer", mock.AnythingOfType("State")).Return("456", nil).Run(func(args mock.Arguments) {
+		arg := args.Get(0).(State)
+		assert.Equal(t, map[string]string{
+			"maintainer":        "me",
+			"rocker.build.id":   "app",
+			"rocker.step":       "3",
+			"rocker.rockerfile": b.rockerfile.Name,
+		}, arg.Config.Labels)
+	}).Once()
+
+	c.On("RunContainer", "456", false).Return(nil).Once()
+	c.On("RemoveContainer", "456").Return(nil).Once()
+
+	state, err := cmd.Execute(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.AssertExpectations(t)
+	assert.Equal(t, map[string]string{"maintainer": "me"}, state.Config.Labels, "should not label the image")
+}
+
+func TestCommandTest_FailedCollectsReports(t *testing.T) {
+	tmpDir := cacheTestTmpDir(t)
+	defer os.RemoveAll(tmpDir)
+
+	b, c := makeBuild(t, "", Config{ArtifactsPath: tmpDir})
+	cmd := NewCommand(ConfigCommand{
+		name:  "test",
+		args:  []string{"./run-tests.sh"},
+		flags: map[string]string{"report": "/app/reports"},
+	})
+
+	b.state.ImageID = "123"
+
+	c.On("CreateContainer", mock.AnythingOfType("State")).Return("456", nil).Once()
+	c.On("RunContainer", "456", false).Return(fmt.Errorf("Container 456 exited with code 1")).Once()
+	c.On("DownloadFromContainer", "456", "/app/reports", mock.Anything).Return(nil).Run(func(args mock.Arguments) {
+		tw := tar.NewWriter(args.Get(2).(io.Writer))
+		content := []byte("<testsuites/>")
+		tw.WriteHeader(&tar.Header{Name: "reports/junit.xml", Mode: 0644, Size: int64(len(content))})
+		tw.Write(content)
+		tw.Close()
+	}).Once()
+	c.On("RemoveContainer", "456").Return(nil).Once()
+
+	_, err := cmd.Execute(b)
+	assert.EqualError(t, err, "TEST failed, error: Container 456 exited with code 1")
+
+	c.AssertExpectations(t)
+
+	data, err := ioutil.ReadFile(filepath.Join(tmpDir, TestReportsDir, "reports", "junit.xml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "<testsuites/>", string(data))
+}
+
+func TestTestReportPaths(t *testing.T) {
+	assert.Nil(t, testReportPaths(map[string]string{}))
+	assert.Equal(t, []string{"/app/junit.xml", "/app/coverage"}, testReportPaths(map[string]string{"report": "/app/junit.xml, /app/coverage"}))
+}
@@ -26,6 +26,9 @@ import (
 	"net/url"
 	"os"
 	"path/filepath"
+	"strings"
+
+	"github.com/grammarly/rocker/src/util"
 
 	log "github.com/Sirupsen/logrus"
 )
@@ -73,6 +76,12 @@ func NewURLFetcherFS(base string, noCache bool, httpClient *http.Client) (cache
 
 // GetInfo retrieves stored URLInfo data
 func (uf *URLFetcherFS) GetInfo(url0 string) (info *URLInfo, err error) {
+	lock, err := uf.lock(url0, false)
+	if err != nil {
+		return nil, err
+	}
+	defer lock.Unlock()
+
 	info, ok, err := uf.getURLInfo(url0)
 	if err != nil {
 		return nil, err
@@ -87,11 +96,29 @@ func (uf *URLFetcherFS) GetInfo(url0 string) (info *URLInfo, err error) {
 
 // Get downloads url, stores file and metadata in cache
 func (uf *URLFetcherFS) Get(url0 string) (info *URLInfo, err error) {
+	// The lock is held through the download, so the concurrent builds
+	// fetching the same url wait for the file instead of racing on it
+	lock, err := uf.lock(url0, true)
+	if err != nil {
+		return nil, err
+	}
+	defer lock.Unlock()
+
 	info, ok, err := uf.getURLInfo(url0)
 	if err != nil {
 		return nil, err
 	}
 
+	// Offline, the file downloaded before is used as is, since the etag
+	// cannot be validated
+	if util.Offline() && ok && !uf.noCache {
+		log.Debugf("Using %s [%s] without validation (offline)", info.URL, info.FileName)
+		return info, nil
+	}
+	if err = util.CheckOffline("download %s", url0); err != nil {
+		return nil, err
+	}
+
 	if !uf.noCache && ok {
 
 		log.Debugf("Validating %s [%s]", info.URL, info.FileName)
@@ -153,12 +180,47 @@ func (uf *URLFetcherFS) makeURLInfo(u string) (info *URLInfo, err error) {
 	return info, nil
 }
 
+// lock locks the cached files of the url, it is a no-op for the invalid urls,
+// they fail later on anyway
+func (uf *URLFetcherFS) lock(u string, exclusive bool) (*util.FileLock, error) {
+	if !isURL(u) {
+		return nil, nil
+	}
+	id := uf.makeID(u)
+	return util.LockFile(filepath.Join(uf.cacheDir, id[:2], id+".lock"), exclusive)
+}
+
 func (uf *URLFetcherFS) makeID(u string) (id string) {
 	h := sha256.Sum256([]byte(u))
 	id = fmt.Sprintf("%x", h)
 	return id
 }
 
+// verifyChecksum checks the file against the checksum given as sha256:<hex>
+func verifyChecksum(fileName, checksum string) error {
+	parts := strings.SplitN(checksum, ":", 2)
+	if len(parts) != 2 || parts[0] != "sha256" || parts[1] == "" {
+		return fmt.Errorf("unsupported checksum %q, expected sha256:<hex>", checksum)
+	}
+
+	fd, err := os.Open(fileName)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, fd); err != nil {
+		return err
+	}
+
+	if actual := fmt.Sprintf("%x", h.Sum(nil)); actual != strings.ToLower(parts[1]) {
+		return fmt.Errorf("checksum mismatch, expected sha256:%s, got sha256:%s", parts[1], actual)
+	}
+
+	return nil
+}
+
 func isURL(u string) bool {
 	return (7 <= len(u) && u[:7] == "http://") ||
 		(8 <= len(u) && u[:8] == "https://")
@@ -211,11 +273,11 @@ func (info *URLInfo) download() (err error) {
 		return fmt.Errorf("Got non-2xx status for `%s`: %s", info.URL, response.Status)
 	}
 
-	if err = os.MkdirAll(filepath.Dir(info.FileName), 0755); err != nil {
+	if err = util.MkdirAllOutput(filepath.Dir(info.FileName), 0755); err != nil {
 		return err
 	}
 
-	f, err := os.Create(info.FileName)
+	f, err := util.CreateOutputFile(info.FileName)
 	if err != nil {
 		return err
 	}
@@ -265,14 +327,14 @@ func (info *URLInfo) load() (ok bool, err error) {
 func (info *URLInfo) store() (err error) {
 	fileName := info.getInfoFileName()
 
-	if err := os.MkdirAll(filepath.Dir(fileName), 0755); err != nil {
+	if err := util.MkdirAllOutput(filepath.Dir(fileName), 0755); err != nil {
 		return err
 	}
 	data, err := json.Marshal(info)
 	if err != nil {
 		return err
 	}
-	return ioutil.WriteFile(fileName, data, 0644)
+	return util.WriteOutputFile(fileName, data, 0644)
 }
 
 func (info *URLInfo) dump() (data string, err error) {
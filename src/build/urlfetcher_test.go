@@ -266,6 +266,27 @@ type testFetcher struct {
 	files   FM
 }
 
+func TestVerifyChecksum(t *testing.T) {
+	tf := makeTempFetcher(t, false)
+	defer tf.cleanup()
+
+	tf.files["/file1.txt"] = func(r *http.Request) respTuple {
+		return respTuple{200, HM{"Etag": "AAA"}, "content1"}
+	}
+
+	info, err := tf.fetcher.Get("http://someurl/file1.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// sha256 of "content1"
+	sum := "d0b425e00e15a0d36b9b361f02bab63563aed6cb4665083905386c55d5b679fa"
+
+	assert.NoError(t, verifyChecksum(info.FileName, "sha256:"+sum))
+	assert.EqualError(t, verifyChecksum(info.FileName, "sha256:abc"), "checksum mismatch, expected sha256:abc, got sha256:"+sum)
+	assert.EqualError(t, verifyChecksum(info.FileName, "md5:abc"), `unsupported checksum "md5:abc", expected sha256:<hex>`)
+}
+
 func makeTempFetcher(t *testing.T, noCache bool) *testFetcher {
 
 	tmpDir := makeTmpDir(t, map[string]string{})
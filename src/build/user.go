@@ -0,0 +1,308 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/grammarly/rocker/src/template"
+)
+
+var userNameRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_.-]*\$?$`)
+
+// userSpec is the parsed argument of USER, e.g. "app:app --create"
+type userSpec struct {
+	user   string
+	group  string
+	create bool
+}
+
+// String returns the user:group form of the spec
+func (u userSpec) String() string {
+	if u.group == "" {
+		return u.user
+	}
+	return u.user + ":" + u.group
+}
+
+// parseUserSpec parses and validates the USER argument; the --create
+// flag may be given either before or after the user
+func parseUserSpec(cfg ConfigCommand) (spec userSpec, err error) {
+	if len(cfg.args) != 1 {
+		return spec, fmt.Errorf("USER requires exactly one argument")
+	}
+
+	_, spec.create = cfg.flags["create"]
+
+	fields := strings.Fields(cfg.args[0])
+	for i := 1; i < len(fields); i++ {
+		if fields[i] != "--create" {
+			return spec, fmt.Errorf("USER got unexpected argument %q", fields[i])
+		}
+		spec.create = true
+	}
+	if len(fields) == 0 {
+		return spec, fmt.Errorf("USER requires exactly one argument")
+	}
+
+	parts := strings.SplitN(fields[0], ":", 2)
+	spec.user = parts[0]
+	if len(parts) == 2 {
+		spec.group = parts[1]
+	}
+
+	if err := validateUserPart("user", spec.user); err != nil {
+		return spec, err
+	}
+	if len(parts) == 2 {
+		if err := validateUserPart("group", spec.group); err != nil {
+			return spec, err
+		}
+	}
+
+	if spec.create {
+		if strings.Contains(fields[0], "$") {
+			return spec, fmt.Errorf("USER --create does not support variables, got %s", fields[0])
+		}
+		if isNumeric(spec.user) {
+			return spec, fmt.Errorf("USER --create requires the user name, got uid %s", spec.user)
+		}
+		if spec.group != "" && isNumeric(spec.group) {
+			return spec, fmt.Errorf("USER --create requires the group name, got gid %s", spec.group)
+		}
+	}
+
+	return spec, nil
+}
+
+// validateUserPart checks that the user or group is either a valid
+// name or a valid numeric id; the values with variables are checked
+// after the substitution
+func validateUserPart(kind, value string) error {
+	if value == "" {
+		return fmt.Errorf("USER has empty %s", kind)
+	}
+	if strings.Contains(value, "$") && !strings.HasSuffix(value, "$") {
+		return nil
+	}
+	if isNumeric(value) {
+		if _, err := strconv.ParseUint(value, 10, 31); err != nil {
+			return fmt.Errorf("USER has invalid numeric %s %s", kind, value)
+		}
+		return nil
+	}
+	if !userNameRegexp.MatchString(value) {
+		return fmt.Errorf("USER has invalid %s name %q", kind, value)
+	}
+	return nil
+}
+
+// userCreateScript returns the shell script that creates the user and
+// the group unless the user already exists; both the shadow-utils
+// (useradd) and busybox (adduser) flavors are supported
+func userCreateScript(spec userSpec) string {
+	group := spec.group
+	if group == "" {
+		group = spec.user
+	}
+	return fmt.Sprintf(
+		"id -u %[1]s >/dev/null 2>&1 || "+
+			"if command -v useradd >/dev/null 2>&1; then "+
+			"(getent group %[2]s >/dev/null 2>&1 || groupadd -r %[2]s) && useradd -r -m -g %[2]s %[1]s; "+
+			"elif command -v adduser >/dev/null 2>&1; then "+
+			"(getent group %[2]s >/dev/null 2>&1 || grep -q '^%[2]s:' /etc/group || addgroup -S %[2]s) && adduser -S -D -G %[2]s %[1]s; "+
+			"else echo 'Neither useradd nor adduser found, cannot create user %[1]s' >&2; exit 1; fi",
+		template.EscapeShellarg(spec.user), template.EscapeShellarg(group),
+	)
+}
+
+// expandUserCreate turns `USER name --create` into the RUN step creating
+// the user, executed as root, followed by the plain USER
+func expandUserCreate(commands []ConfigCommand) ([]ConfigCommand, error) {
+	result := []ConfigCommand{}
+
+	for _, cfg := range commands {
+		if cfg.name != "user" {
+			result = append(result, cfg)
+			continue
+		}
+
+		spec, err := parseUserSpec(cfg)
+		if err != nil {
+			return nil, err
+		}
+		if !spec.create {
+			result = append(result, cfg)
+			continue
+		}
+
+		script := userCreateScript(spec)
+
+		run := cfg
+		run.name = "run"
+		run.args = []string{script}
+		run.attrs = map[string]bool{}
+		run.flags = map[string]string{}
+		run.original = "RUN " + script
+		run.runAs = "root"
+
+		user := cfg
+		user.args = []string{spec.String()}
+		user.flags = map[string]string{}
+		user.conditions = cfg.conditions
+
+		result = append(result, run, user)
+	}
+
+	return result, nil
+}
+
+// resolveUserID returns the numeric uid:gid of the user spec, looking up
+// the names in /etc/passwd and /etc/group of the current image
+func resolveUserID(b *Build, s State, user string) (string, error) {
+	parts := strings.SplitN(user, ":", 2)
+	name, group := parts[0], ""
+	if len(parts) == 2 {
+		group = parts[1]
+	}
+
+	// No USER means root
+	if name == "" {
+		name = "0"
+	}
+
+	if isNumeric(name) && (group == "" || isNumeric(group)) {
+		if group == "" {
+			group = name
+		}
+		return name + ":" + group, nil
+	}
+
+	files, err := readImageFiles(b, s, "/etc/passwd", "/etc/group")
+	if err != nil {
+		return "", fmt.Errorf("Failed to resolve user %s, error: %s", user, err)
+	}
+
+	uid, gid := name, group
+
+	if !isNumeric(name) {
+		entry, ok := lookupColonFile(files["/etc/passwd"], name)
+		if !ok || len(entry) < 4 {
+			return "", fmt.Errorf("User %s not found in /etc/passwd of the image", name)
+		}
+		uid = entry[2]
+		if group == "" {
+			gid = entry[3]
+		}
+	} else if group == "" {
+		gid = name
+	}
+
+	if gid != "" && !isNumeric(gid) {
+		entry, ok := lookupColonFile(files["/etc/group"], gid)
+		if !ok || len(entry) < 3 {
+			return "", fmt.Errorf("Group %s not found in /etc/group of the image", gid)
+		}
+		gid = entry[2]
+	}
+
+	return uid + ":" + gid, nil
+}
+
+// readImageFiles reads the files from the current image through a
+// temporary container, that is never started
+func readImageFiles(b *Build, s State, paths ...string) (map[string][]byte, error) {
+	if s.ImageID == "" {
+		return nil, fmt.Errorf("no image to read %s from", strings.Join(paths, ", "))
+	}
+
+	s.Config.Cmd = []string{"/bin/sh", "-c", "#(nop) read " + strings.Join(paths, " ")}
+	s.Config.Entrypoint = []string{}
+	s.Config.Labels = b.containerLabels(s.Config.Labels)
+
+	containerID, err := b.client.CreateContainer(s)
+	if err != nil {
+		return nil, err
+	}
+	defer b.client.RemoveContainer(containerID)
+
+	result := map[string][]byte{}
+
+	for _, path := range paths {
+		var buf bytes.Buffer
+		if err := b.client.DownloadFromContainer(containerID, path, &buf); err != nil {
+			return nil, err
+		}
+
+		// The content comes as a tar archive of the single file
+		tr := tar.NewReader(&buf)
+		if _, err := tr.Next(); err != nil {
+			return nil, fmt.Errorf("Failed to read %s, error: %s", path, err)
+		}
+		if result[path], err = ioutil.ReadAll(tr); err != nil {
+			return nil, fmt.Errorf("Failed to read %s, error: %s", path, err)
+		}
+	}
+
+	return result, nil
+}
+
+// lookupColonFile finds the entry by name in passwd(5) or group(5) formatted content
+func lookupColonFile(data []byte, name string) ([]string, bool) {
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), ":")
+		if len(fields) > 0 && fields[0] == name {
+			return fields, true
+		}
+	}
+	return nil, false
+}
+
+// parseChown parses the numeric uid:gid
+func parseChown(id string) (uid, gid int, err error) {
+	parts := strings.SplitN(id, ":", 2)
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("expected uid:gid, got %s", id)
+	}
+	if uid, err = strconv.Atoi(parts[0]); err != nil {
+		return 0, 0, err
+	}
+	if gid, err = strconv.Atoi(parts[1]); err != nil {
+		return 0, 0, err
+	}
+	return uid, gid, nil
+}
+
+func isNumeric(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
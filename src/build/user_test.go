@@ -0,0 +1,152 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestParseUserSpec(t *testing.T) {
+	tests := []struct {
+		args   string
+		flags  map[string]string
+		spec   userSpec
+		errMsg string
+	}{
+		{"www", nil, userSpec{user: "www"}, ""},
+		{"app:app --create", nil, userSpec{user: "app", group: "app", create: true}, ""},
+		{"app", map[string]string{"create": ""}, userSpec{user: "app", create: true}, ""},
+		{"1000:1000", nil, userSpec{user: "1000", group: "1000"}, ""},
+		{"$APP_USER", nil, userSpec{user: "$APP_USER"}, ""},
+		{"1000 --create", nil, userSpec{}, "USER --create requires the user name, got uid 1000"},
+		{"app:1000 --create", nil, userSpec{}, "USER --create requires the group name, got gid 1000"},
+		{"$APP_USER --create", nil, userSpec{}, "USER --create does not support variables, got $APP_USER"},
+		{"app --force", nil, userSpec{}, "USER got unexpected argument \"--force\""},
+		{"app:", nil, userSpec{}, "USER has empty group"},
+		{"99999999999", nil, userSpec{}, "USER has invalid numeric user 99999999999"},
+		{"my user!", nil, userSpec{}, "USER got unexpected argument \"user!\""},
+		{"us@r", nil, userSpec{}, "USER has invalid user name \"us@r\""},
+	}
+
+	for _, test := range tests {
+		spec, err := parseUserSpec(ConfigCommand{name: "user", args: []string{test.args}, flags: test.flags})
+		if test.errMsg != "" {
+			assert.EqualError(t, err, test.errMsg, "for %q", test.args)
+			continue
+		}
+		if !assert.NoError(t, err, "for %q", test.args) {
+			continue
+		}
+		assert.Equal(t, test.spec, spec, "for %q", test.args)
+	}
+}
+
+func TestExpandUserCreate(t *testing.T) {
+	commands, err := expandUserCreate([]ConfigCommand{
+		{name: "from", args: []string{"alpine"}},
+		{name: "user", args: []string{"app --create"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Len(t, commands, 3)
+	assert.Equal(t, "run", commands[1].name)
+	assert.Equal(t, "root", commands[1].runAs)
+	assert.Contains(t, commands[1].args[0], "id -u app >/dev/null 2>&1 ||")
+	assert.Contains(t, commands[1].args[0], "useradd -r -m -g app app")
+	assert.Contains(t, commands[1].args[0], "adduser -S -D -G app app")
+	assert.Equal(t, "user", commands[2].name)
+	assert.Equal(t, []string{"app"}, commands[2].args)
+}
+
+func TestResolveUserID_Numeric(t *testing.T) {
+	b, _ := makeBuild(t, "", Config{})
+
+	id, err := resolveUserID(b, State{}, "1000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "1000:1000", id)
+
+	id, err = resolveUserID(b, State{}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "0:0", id)
+}
+
+func TestResolveUserID_Names(t *testing.T) {
+	b, c := makeBuild(t, "", Config{})
+	s := State{ImageID: "123"}
+
+	files := map[string]string{
+		"/etc/passwd": "root:x:0:0:root:/root:/bin/sh\napp:x:100:101:Linux User,,,:/home/app:/sbin/nologin\n",
+		"/etc/group":  "root:x:0:root\napp:x:101:app\nstaff:x:50:\n",
+	}
+
+	c.On("CreateContainer", mock.AnythingOfType("State")).Return("456", nil).Once()
+	c.On("RemoveContainer", "456").Return(nil).Once()
+	c.On("DownloadFromContainer", "456", mock.AnythingOfType("string"), mock.Anything).Run(func(args mock.Arguments) {
+		path := args.String(1)
+		tw := tar.NewWriter(args.Get(2).(io.Writer))
+		tw.WriteHeader(&tar.Header{Name: path[5:], Mode: 0644, Size: int64(len(files[path]))})
+		tw.Write([]byte(files[path]))
+		tw.Close()
+	}).Return(nil).Twice()
+
+	id, err := resolveUserID(b, s, "app:staff")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.AssertExpectations(t)
+	assert.Equal(t, "100:50", id)
+}
+
+func TestChownTarStream(t *testing.T) {
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	tw.WriteHeader(&tar.Header{Name: "app.js", Mode: 0644, Size: 1, Uid: 501, Uname: "me"})
+	tw.Write([]byte("1"))
+	tw.Close()
+
+	stream, err := chownTarStream(ioutil.NopCloser(buf), "100:101")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tr := tar.NewReader(stream)
+	hdr, err := tr.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := ioutil.ReadAll(tr)
+
+	assert.Equal(t, "app.js", hdr.Name)
+	assert.Equal(t, 100, hdr.Uid)
+	assert.Equal(t, 101, hdr.Gid)
+	assert.Equal(t, "", hdr.Uname)
+	assert.Equal(t, "1", string(data))
+}
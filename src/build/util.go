@@ -20,11 +20,45 @@ import (
 	"crypto/md5"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"strings"
 
+	"github.com/grammarly/rocker/src/imagename"
+	"github.com/grammarly/rocker/src/util"
+
 	"github.com/fsouza/go-dockerclient"
+	"github.com/go-yaml/yaml"
+)
+
+// The labels of the containers rocker creates, so the host monitoring and
+// the cleanup tools can attribute them to the build
+const (
+	ContainerLabelBuildID    = "rocker.build.id"
+	ContainerLabelStep       = "rocker.step"
+	ContainerLabelRockerfile = "rocker.rockerfile"
 )
 
+// ImageLabelIntermediate marks the images committed by rocker, along with
+// ContainerLabelBuildID, so the cleanup tools can find the intermediate ones,
+// see CleanIntermediates
+const ImageLabelIntermediate = "rocker.intermediate"
+
+// containerLabels returns the given labels along with the ones identifying the build;
+// docker copies the container labels to the committed image, so they are only
+// given to the containers that are not committed
+func (b *Build) containerLabels(labels map[string]string) map[string]string {
+	result := map[string]string{}
+	for k, v := range labels {
+		result[k] = v
+	}
+	result[ContainerLabelBuildID] = b.getIdentifier()
+	result[ContainerLabelStep] = fmt.Sprintf("%d", b.step)
+	result[ContainerLabelRockerfile] = b.rockerfile.Name
+	return result
+}
+
 // mountsContainerName returns the name of volume container that will be used for a particular MOUNT
 func (b *Build) mountsContainerName(path string) string {
 	// TODO: mounts are reused between different FROMs, is it ok?
@@ -108,3 +142,86 @@ func replaceOrAppendEnvValues(defaults, overrides []string) []string {
 
 	return defaults
 }
+
+// ReadArtifacts reads the artifacts file in the RockerArtifacts format
+func ReadArtifacts(fileName string) (imagename.Artifacts, error) {
+	artifacts := imagename.Artifacts{}
+
+	content, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return artifacts, fmt.Errorf("Failed to read artifact file %s, error: %s", fileName, err)
+	}
+	if err := yaml.Unmarshal(content, &artifacts); err != nil {
+		return artifacts, fmt.Errorf("Failed to parse artifact file %s, error: %s", fileName, err)
+	}
+
+	return artifacts, nil
+}
+
+// ArtifactFiles returns the artifact files, the directories are expanded
+// to the .yml and .yaml files within them
+func ArtifactFiles(paths []string) (files []string, err error) {
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			files = append(files, path)
+			continue
+		}
+		for _, pattern := range []string{"*.yml", "*.yaml"} {
+			matches, err := filepath.Glob(filepath.Join(path, pattern))
+			if err != nil {
+				return nil, err
+			}
+			files = append(files, matches...)
+		}
+	}
+	return files, nil
+}
+
+// WriteArtifact saves the artifact file to the directory, returns the file path
+func WriteArtifact(dir string, artifact imagename.Artifact) (string, error) {
+	filePaths, err := WriteArtifacts(dir, []imagename.Artifact{artifact})
+	if err != nil {
+		return "", err
+	}
+	return filePaths[0], nil
+}
+
+// WriteArtifacts saves the artifact files to the directory, returns the file paths;
+// the artifacts of the same file name, e.g. the image pushed to several
+// registries, are saved to the same file
+func WriteArtifacts(dir string, artifacts []imagename.Artifact) ([]string, error) {
+	if err := util.MkdirAllOutput(dir, 0755); err != nil {
+		return nil, fmt.Errorf("Failed to create directory %s for the artifacts, error: %s", dir, err)
+	}
+
+	files := []string{}
+	byFile := map[string][]imagename.Artifact{}
+	for _, artifact := range artifacts {
+		fileName := artifact.GetFileName()
+		if _, ok := byFile[fileName]; !ok {
+			files = append(files, fileName)
+		}
+		byFile[fileName] = append(byFile[fileName], artifact)
+	}
+
+	filePaths := []string{}
+	for _, fileName := range files {
+		filePath := filepath.Join(dir, fileName)
+
+		content, err := yaml.Marshal(imagename.Artifacts{RockerArtifacts: byFile[fileName]})
+		if err != nil {
+			return nil, err
+		}
+
+		if err := util.WriteOutputFile(filePath, content, 0644); err != nil {
+			return nil, fmt.Errorf("Failed to write artifact file %s, error: %s", filePath, err)
+		}
+		filePaths = append(filePaths, filePath)
+	}
+
+	return filePaths, nil
+}
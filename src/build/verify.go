@@ -0,0 +1,159 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// RockerDataLabel is the label keeping the vars and the step keys of the
+// Rockerfile the image was built of, see Config.RecordVars
+const RockerDataLabel = "rocker-data"
+
+// RockerData is the content of RockerDataLabel; the step keys chain the
+// rendered instructions from the start of the Rockerfile up to the TAG or
+// PUSH of the image, so `rocker verify` can tell if a Rockerfile revision
+// could have produced the image. TAG, PUSH and ARTIFACT do not change the
+// image, so they are not the steps, and the tagged and pushed images of the
+// same FROM have the same label
+type RockerData struct {
+	Rockerfile string                 `json:"rockerfile"`
+	Vars       map[string]interface{} `json:"vars,omitempty"`
+	SecretVars []string               `json:"secret_vars,omitempty"`
+	Steps      []string               `json:"steps"`
+}
+
+// stepKeys returns the chained keys of the instructions, every key depends
+// on the instruction and all the instructions before it
+func stepKeys(commands []ConfigCommand) []string {
+	var (
+		keys = []string{}
+		prev string
+	)
+	for _, cfg := range commands {
+		prev = fmt.Sprintf("%x", sha256.Sum256([]byte(prev+"\n"+cfg.original)))[:16]
+		keys = append(keys, prev)
+	}
+	return keys
+}
+
+// imageSteps returns the instructions that make the image, up to the given one
+func imageSteps(commands []ConfigCommand, upTo *ConfigCommand) []ConfigCommand {
+	result := []ConfigCommand{}
+	for _, c := range commands {
+		if upTo != nil && c.line == upTo.line && c.original == upTo.original {
+			break
+		}
+		if c.name != "tag" && c.name != "push" && c.name != "artifact" {
+			result = append(result, c)
+		}
+	}
+	return result
+}
+
+// newRockerData describes the build up to the instruction; the values of the
+// secret-looking vars are not recorded, only their names
+func (b *Build) newRockerData(cfg ConfigCommand) RockerData {
+	data := RockerData{
+		Rockerfile: b.rockerfile.Name,
+		Vars:       map[string]interface{}{},
+		Steps:      stepKeys(imageSteps(b.rockerfile.Commands(), &cfg)),
+	}
+	for name, value := range b.rockerfile.Vars.ToJSONMap() {
+		if IsSecretName(name) {
+			data.SecretVars = append(data.SecretVars, name)
+			continue
+		}
+		data.Vars[name] = value
+	}
+	sort.Strings(data.SecretVars)
+	return data
+}
+
+// recordRockerData commits the RockerDataLabel to the image before TAG or
+// PUSH; the commit is cached, so the same build produces the same image
+func (b *Build) recordRockerData(cfg ConfigCommand) error {
+	if !b.cfg.RecordVars {
+		return nil
+	}
+
+	data, err := json.Marshal(b.newRockerData(cfg))
+	if err != nil {
+		return fmt.Errorf("Failed to marshal %s label, error: %s", RockerDataLabel, err)
+	}
+	if b.state.Config.Labels[RockerDataLabel] == string(data) {
+		return nil
+	}
+
+	s := b.state
+	labels := map[string]string{}
+	for k, v := range s.Config.Labels {
+		labels[k] = v
+	}
+	labels[RockerDataLabel] = string(data)
+	s.Config.Labels = labels
+	s.Commit("LABEL %s=%s", RockerDataLabel, data)
+
+	log.Infof("| Record %s label", RockerDataLabel)
+
+	b.state = s
+	b.state, err = (&CommandCommit{}).Execute(b)
+	return err
+}
+
+// ParseRockerData reads RockerDataLabel of the image labels
+func ParseRockerData(labels map[string]string) (*RockerData, error) {
+	value, ok := labels[RockerDataLabel]
+	if !ok {
+		return nil, fmt.Errorf("the image has no %s label, build it with --record-vars", RockerDataLabel)
+	}
+	data := &RockerData{}
+	if err := json.Unmarshal([]byte(value), data); err != nil {
+		return nil, fmt.Errorf("Failed to parse %s label, error: %s", RockerDataLabel, err)
+	}
+	return data, nil
+}
+
+// VerifyRockerData compares the step keys of the Rockerfile, rendered with the
+// recorded vars, to the recorded ones and describes the first step that differs;
+// only the instructions are checked, not the files of the context
+func VerifyRockerData(r *Rockerfile, data *RockerData) error {
+	var (
+		commands = imageSteps(r.Commands(), nil)
+		keys     = stepKeys(commands)
+	)
+
+	if len(data.Steps) == 0 {
+		return fmt.Errorf("%s label has no steps", RockerDataLabel)
+	}
+
+	for i, key := range data.Steps {
+		if i >= len(keys) {
+			return fmt.Errorf("the image was built of %d steps, %s has only %d", len(data.Steps), r.Name, len(keys))
+		}
+		if key != keys[i] {
+			return fmt.Errorf("step %d differs from the one the image was built of, %s:%d %s", i+1, r.Name, commands[i].line, commands[i].original)
+		}
+	}
+
+	return nil
+}
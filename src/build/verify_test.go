@@ -0,0 +1,80 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/grammarly/rocker/src/template"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestCommandTag_RecordVars(t *testing.T) {
+	b, c := makeBuild(t, "FROM ubuntu\nRUN make\nTAG app:1\n", Config{RecordVars: true})
+	b.rockerfile.Vars = template.Vars{"mode": "prod", "NPM_TOKEN": "secret"}
+	b.state.ImageID = "123"
+
+	var committed State
+	c.On("CreateContainer", mock.AnythingOfType("State")).Return("456", nil).Once()
+	c.On("CommitContainer", mock.AnythingOfType("State")).Run(func(args mock.Arguments) {
+		committed = args.Get(0).(State)
+	}).Return(&docker.Image{ID: "789"}, nil).Once()
+	c.On("RemoveContainer", "456").Return(nil).Once()
+	c.On("InspectImage", "789").Return(&docker.Image{ID: "789", Config: &docker.Config{}}, nil).Once()
+	c.On("TagImage", "789", "app:1").Return(nil).Once()
+
+	commands := b.rockerfile.Commands()
+	if _, err := NewCommand(commands[2]).Execute(b); err != nil {
+		t.Fatal(err)
+	}
+	c.AssertExpectations(t)
+
+	data, err := ParseRockerData(committed.Config.Labels)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, map[string]interface{}{"mode": "prod"}, data.Vars)
+	assert.Equal(t, []string{"NPM_TOKEN"}, data.SecretVars)
+	assert.Len(t, data.Steps, 2)
+
+	// The same label is not committed again, e.g. by PUSH after TAG
+	assert.NoError(t, b.recordRockerData(commands[2]))
+}
+
+func TestVerifyRockerData(t *testing.T) {
+	b, _ := makeBuild(t, "FROM ubuntu\nRUN make\nTAG app:1\n", Config{})
+	data := b.newRockerData(b.rockerfile.Commands()[2])
+
+	verify := func(content string) error {
+		r, err := NewRockerfile("Rockerfile", strings.NewReader(content), template.Vars{}, template.Funs{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return VerifyRockerData(r, &data)
+	}
+
+	assert.NoError(t, verify("FROM ubuntu\nRUN make\nTAG app:1\n"))
+	assert.NoError(t, verify("FROM ubuntu\nRUN make\nPUSH app:1\nRUN make test\n"))
+	assert.EqualError(t, verify("FROM ubuntu\nRUN make all\nTAG app:1\n"), "step 2 differs from the one the image was built of, Rockerfile:2 RUN make all")
+	assert.EqualError(t, verify("FROM ubuntu\n"), "the image was built of 2 steps, Rockerfile has only 1")
+
+	_, err := ParseRockerData(map[string]string{})
+	assert.EqualError(t, err, "the image has no rocker-data label, build it with --record-vars")
+}
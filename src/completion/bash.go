@@ -0,0 +1,135 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package completion
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// genBash writes the bash completion script
+func genBash(spec Spec, w io.Writer) error {
+	var (
+		buf      bytes.Buffer
+		name     = spec.App.Name
+		fn       = "_" + strings.Replace(name, "-", "_", -1)
+		global   = getFlags(spec.App.Flags)
+		commands = getCommands(spec.App)
+	)
+
+	cmdNames := []string{}
+	for _, cmd := range commands {
+		cmdNames = append(cmdNames, cmd.names...)
+	}
+
+	fmt.Fprintf(&buf, "# bash completion for %s\n", name)
+	fmt.Fprintf(&buf, "# generated by `%s completion bash`, do not edit\n\n", name)
+
+	fmt.Fprintf(&buf, "%s_value() {\n", fn)
+	fmt.Fprintf(&buf, "    case \"$1\" in\n")
+	fmt.Fprintf(&buf, "    %s) COMPREPLY=( $(compgen -f -- \"$cur\") ) ;;\n", ValueFile)
+	fmt.Fprintf(&buf, "    %s) COMPREPLY=( $(compgen -d -- \"$cur\") ) ;;\n", ValueDir)
+	fmt.Fprintf(&buf, "    %s) COMPREPLY=( $(compgen -f -X '!*Rockerfile*' -- \"$cur\") $(compgen -d -- \"$cur\") ) ;;\n", ValueRockerfile)
+	fmt.Fprintf(&buf, "    %s) COMPREPLY=( $(compgen -W \"$(%s 2>/dev/null)\" -- \"$cur\") ) ;;\n", ValueImage, spec.ListImagesCmd)
+	fmt.Fprintf(&buf, "    *) COMPREPLY=() ;;\n")
+	fmt.Fprintf(&buf, "    esac\n")
+	fmt.Fprintf(&buf, "}\n\n")
+
+	fmt.Fprintf(&buf, "%s() {\n", fn)
+	fmt.Fprintf(&buf, "    local cur prev cmd i\n")
+	fmt.Fprintf(&buf, "    COMPREPLY=()\n")
+	fmt.Fprintf(&buf, "    cur=\"${COMP_WORDS[COMP_CWORD]}\"\n")
+	fmt.Fprintf(&buf, "    prev=\"${COMP_WORDS[COMP_CWORD-1]}\"\n")
+	fmt.Fprintf(&buf, "    cmd=\"\"\n\n")
+
+	// Find the sub-command skipping global flags and their values
+	fmt.Fprintf(&buf, "    for ((i=1; i < COMP_CWORD; i++)); do\n")
+	fmt.Fprintf(&buf, "        case \"${COMP_WORDS[i]}\" in\n")
+	if vf := valueFlags(global); len(vf) > 0 {
+		fmt.Fprintf(&buf, "        %s) ((i++)) ;;\n", strings.Join(vf, "|"))
+	}
+	fmt.Fprintf(&buf, "        -*) ;;\n")
+	fmt.Fprintf(&buf, "        *) cmd=\"${COMP_WORDS[i]}\"; break ;;\n")
+	fmt.Fprintf(&buf, "        esac\n")
+	fmt.Fprintf(&buf, "    done\n\n")
+
+	fmt.Fprintf(&buf, "    case \"$cmd\" in\n")
+
+	writeBashCase(&buf, fn, `""`, global, spec.FlagValues, "", strings.Join(cmdNames, " "))
+
+	for _, cmd := range commands {
+		writeBashCase(&buf, fn, strings.Join(cmd.names, "|"), cmd.flags, spec.FlagValues, spec.ArgValues[cmd.names[0]], "")
+	}
+
+	fmt.Fprintf(&buf, "    esac\n")
+	fmt.Fprintf(&buf, "}\n\n")
+
+	fmt.Fprintf(&buf, "complete -F %s %s\n", fn, name)
+
+	_, err := buf.WriteTo(w)
+	return err
+}
+
+// writeBashCase writes the completion branch for a single (sub)command
+func writeBashCase(buf *bytes.Buffer, fn, pattern string, flags []flagSpec, flagValues map[string]string, argValue, words string) {
+	fmt.Fprintf(buf, "    %s)\n", pattern)
+
+	// Complete values of the flags that take them
+	if vf := valueFlags(flags); len(vf) > 0 {
+		fmt.Fprintf(buf, "        case \"$prev\" in\n")
+		for _, f := range flags {
+			if !f.takesValue {
+				continue
+			}
+			fmt.Fprintf(buf, "        %s) %s_value %s; return ;;\n", strings.Join(f.switches(), "|"), fn, stringOr(flagValues[f.name()], "none"))
+		}
+		fmt.Fprintf(buf, "        esac\n")
+	}
+
+	fmt.Fprintf(buf, "        if [[ \"$cur\" == -* ]]; then\n")
+	fmt.Fprintf(buf, "            COMPREPLY=( $(compgen -W \"%s\" -- \"$cur\") )\n", strings.Join(allSwitches(flags), " "))
+	if words != "" {
+		fmt.Fprintf(buf, "        else\n")
+		fmt.Fprintf(buf, "            COMPREPLY=( $(compgen -W \"%s\" -- \"$cur\") )\n", words)
+	} else if argValue != ValueNone {
+		fmt.Fprintf(buf, "        else\n")
+		fmt.Fprintf(buf, "            %s_value %s\n", fn, argValue)
+	}
+	fmt.Fprintf(buf, "        fi\n")
+	fmt.Fprintf(buf, "        ;;\n")
+}
+
+// genZsh writes the zsh completion script; it reuses the bash one
+// through bashcompinit, the same way codegangsta/cli autocomplete does
+func genZsh(spec Spec, w io.Writer) error {
+	fmt.Fprintf(w, "# zsh completion for %s\n", spec.App.Name)
+	fmt.Fprintf(w, "# generated by `%s completion zsh`, do not edit\n\n", spec.App.Name)
+	fmt.Fprintf(w, "autoload -U +X compinit && compinit\n")
+	fmt.Fprintf(w, "autoload -U +X bashcompinit && bashcompinit\n\n")
+	return genBash(spec, w)
+}
+
+func stringOr(args ...string) string {
+	for _, str := range args {
+		if str != "" {
+			return str
+		}
+	}
+	return ""
+}
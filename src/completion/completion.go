@@ -0,0 +1,205 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package completion generates shell completion scripts out of the
+// codegangsta/cli application definition, so the completion does not
+// need to be maintained by hand when commands or flags change.
+package completion
+
+import (
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/codegangsta/cli"
+)
+
+// Kinds of values that can be suggested for flags and positional arguments
+const (
+	ValueNone       = ""
+	ValueFile       = "file"
+	ValueDir        = "dir"
+	ValueRockerfile = "rockerfile"
+	ValueImage      = "image"
+)
+
+// Spec describes the application to generate completion for
+type Spec struct {
+	App *cli.App
+
+	// FlagValues maps flag name (the first one of the flag names)
+	// to the kind of values suggested for the flag
+	FlagValues map[string]string
+
+	// ArgValues maps command name to the kind of values
+	// suggested for its positional arguments
+	ArgValues map[string]string
+
+	// ListImagesCmd is the shell command that prints local image names,
+	// one per line; used for ValueImage completion
+	ListImagesCmd string
+}
+
+// Shells is the list of supported shells
+var Shells = []string{"bash", "zsh", "fish"}
+
+// Generate writes the completion script for the given shell to w
+func Generate(spec Spec, shell string, w io.Writer) error {
+	switch shell {
+	case "bash":
+		return genBash(spec, w)
+	case "zsh":
+		return genZsh(spec, w)
+	case "fish":
+		return genFish(spec, w)
+	}
+	return fmt.Errorf("Unsupported shell %q, supported are: %s", shell, strings.Join(Shells, ", "))
+}
+
+// flagSpec is the normalized description of a cli.Flag
+type flagSpec struct {
+	names      []string
+	usage      string
+	takesValue bool
+}
+
+// name returns the primary name of the flag
+func (f flagSpec) name() string {
+	return f.names[0]
+}
+
+// switches returns the list of flag names prefixed with dashes
+func (f flagSpec) switches() []string {
+	result := make([]string, len(f.names))
+	for i, name := range f.names {
+		result[i] = dashed(name)
+	}
+	return result
+}
+
+// commandSpec is the normalized description of a cli.Command
+type commandSpec struct {
+	names []string
+	usage string
+	flags []flagSpec
+}
+
+// getFlags turns the list of cli.Flag into the list of flagSpec;
+// cli.Flag does not expose name and usage, so we read them via reflection
+func getFlags(flags []cli.Flag) []flagSpec {
+	var (
+		result  = []flagSpec{}
+		hasHelp = false
+	)
+	for _, f := range flags {
+		v := reflect.Indirect(reflect.ValueOf(f))
+		if v.Kind() != reflect.Struct {
+			continue
+		}
+
+		spec := flagSpec{}
+
+		if name := v.FieldByName("Name"); name.IsValid() {
+			for _, n := range strings.Split(name.String(), ",") {
+				if n = strings.TrimSpace(n); n != "" {
+					spec.names = append(spec.names, n)
+				}
+			}
+		}
+		if len(spec.names) == 0 {
+			continue
+		}
+
+		if spec.name() == "help" {
+			hasHelp = true
+		}
+
+		if usage := v.FieldByName("Usage"); usage.IsValid() {
+			spec.usage = usage.String()
+		}
+
+		switch f.(type) {
+		case cli.BoolFlag, cli.BoolTFlag, *cli.BoolFlag, *cli.BoolTFlag:
+			spec.takesValue = false
+		default:
+			spec.takesValue = true
+		}
+
+		result = append(result, spec)
+	}
+
+	// cli adds the help flag only when the app is run
+	if !hasHelp {
+		result = append(result, flagSpec{names: []string{"help", "h"}, usage: "show help"})
+	}
+
+	return result
+}
+
+// getCommands returns the list of commands of the application
+func getCommands(app *cli.App) []commandSpec {
+	result := []commandSpec{}
+	for _, cmd := range app.Commands {
+		names := append([]string{cmd.Name}, cmd.Aliases...)
+		if cmd.ShortName != "" {
+			names = append(names, cmd.ShortName)
+		}
+		result = append(result, commandSpec{
+			names: names,
+			usage: cmd.Usage,
+			flags: getFlags(cmd.Flags),
+		})
+	}
+	return result
+}
+
+// dashed prefixes the flag name with one or two dashes, the way cli prints it
+func dashed(name string) string {
+	if len(name) == 1 {
+		return "-" + name
+	}
+	return "--" + name
+}
+
+// valueFlags returns the switches of all flags that take a value, sorted
+func valueFlags(flags []flagSpec) []string {
+	result := []string{}
+	for _, f := range flags {
+		if f.takesValue {
+			result = append(result, f.switches()...)
+		}
+	}
+	sort.Strings(result)
+	return result
+}
+
+// allSwitches returns the switches of all the given flags, sorted
+func allSwitches(flags []flagSpec) []string {
+	result := []string{}
+	for _, f := range flags {
+		result = append(result, f.switches()...)
+	}
+	sort.Strings(result)
+	return result
+}
+
+// quoteDescription makes the usage string safe to be put into single quotes
+func quoteDescription(s string) string {
+	s = strings.SplitN(s, "\n", 2)[0]
+	return strings.Replace(s, "'", `'\''`, -1)
+}
@@ -0,0 +1,97 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package completion
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/codegangsta/cli"
+	"github.com/stretchr/testify/assert"
+)
+
+func makeSpec() Spec {
+	app := cli.NewApp()
+	app.Name = "rocker"
+	app.Flags = []cli.Flag{
+		cli.BoolFlag{Name: "verbose, vv, D", Usage: "Be verbose"},
+		cli.StringFlag{Name: "host, H", Usage: "Daemon socket(s) to connect to"},
+	}
+	app.Commands = []cli.Command{
+		{
+			Name:  "build",
+			Usage: "launches a build",
+			Flags: []cli.Flag{
+				cli.StringFlag{Name: "file, f", Usage: "rocker build file to execute"},
+				cli.BoolFlag{Name: "no-cache", Usage: "supresses cache"},
+			},
+		},
+		{
+			Name:  "pull",
+			Usage: "launches a pull of image",
+		},
+	}
+
+	return Spec{
+		App:           app,
+		FlagValues:    map[string]string{"file": ValueRockerfile},
+		ArgValues:     map[string]string{"pull": ValueImage},
+		ListImagesCmd: "rocker completion --list-images",
+	}
+}
+
+func TestCompletion_Bash(t *testing.T) {
+	buf := &bytes.Buffer{}
+	if err := Generate(makeSpec(), "bash", buf); err != nil {
+		t.Fatal(err)
+	}
+	script := buf.String()
+
+	assert.Contains(t, script, `COMPREPLY=( $(compgen -W "build pull" -- "$cur") )`)
+	assert.Contains(t, script, `--host|-H) ((i++)) ;;`)
+	assert.Contains(t, script, `--file|-f) _rocker_value rockerfile; return ;;`)
+	assert.Contains(t, script, `"--file --help --no-cache -f -h"`)
+	assert.Contains(t, script, "_rocker_value image\n")
+	assert.Contains(t, script, "complete -F _rocker rocker\n")
+}
+
+func TestCompletion_Zsh(t *testing.T) {
+	buf := &bytes.Buffer{}
+	if err := Generate(makeSpec(), "zsh", buf); err != nil {
+		t.Fatal(err)
+	}
+	assert.Contains(t, buf.String(), "bashcompinit\n")
+	assert.Contains(t, buf.String(), "complete -F _rocker rocker\n")
+}
+
+func TestCompletion_Fish(t *testing.T) {
+	buf := &bytes.Buffer{}
+	if err := Generate(makeSpec(), "fish", buf); err != nil {
+		t.Fatal(err)
+	}
+	script := buf.String()
+
+	assert.Contains(t, script, "complete -c rocker -n 'not __fish_seen_subcommand_from build pull' -a 'build' -d 'launches a build'\n")
+	assert.Contains(t, script, "-l verbose -l vv -s D -d 'Be verbose'\n")
+	assert.Contains(t, script, "complete -c rocker -n '__fish_seen_subcommand_from build' -l file -s f -r -a '(__rocker_rockerfiles)'")
+	assert.Contains(t, script, "complete -c rocker -n '__fish_seen_subcommand_from pull' -a '(rocker completion --list-images 2>/dev/null)'\n")
+}
+
+func TestCompletion_UnsupportedShell(t *testing.T) {
+	err := Generate(makeSpec(), "tcsh", &bytes.Buffer{})
+	assert.EqualError(t, err, `Unsupported shell "tcsh", supported are: bash, zsh, fish`)
+}
@@ -0,0 +1,113 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package completion
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// genFish writes the fish completion script
+func genFish(spec Spec, w io.Writer) error {
+	var (
+		buf      bytes.Buffer
+		name     = spec.App.Name
+		fn       = "__" + strings.Replace(name, "-", "_", -1)
+		commands = getCommands(spec.App)
+	)
+
+	cmdNames := []string{}
+	for _, cmd := range commands {
+		cmdNames = append(cmdNames, cmd.names...)
+	}
+
+	fmt.Fprintf(&buf, "# fish completion for %s\n", name)
+	fmt.Fprintf(&buf, "# generated by `%s completion fish`, do not edit\n\n", name)
+
+	fmt.Fprintf(&buf, "function %s_rockerfiles\n", fn)
+	fmt.Fprintf(&buf, "    __fish_complete_directories (commandline -ct)\n")
+	fmt.Fprintf(&buf, "    for f in (commandline -ct)*Rockerfile*\n")
+	fmt.Fprintf(&buf, "        test -f $f; and echo $f\n")
+	fmt.Fprintf(&buf, "    end\n")
+	fmt.Fprintf(&buf, "end\n\n")
+
+	fmt.Fprintf(&buf, "complete -c %s -f\n\n", name)
+
+	noCommand := fmt.Sprintf("not __fish_seen_subcommand_from %s", strings.Join(cmdNames, " "))
+
+	for _, f := range getFlags(spec.App.Flags) {
+		writeFishFlag(&buf, spec, fn, noCommand, f)
+	}
+	fmt.Fprintf(&buf, "\n")
+
+	for _, cmd := range commands {
+		fmt.Fprintf(&buf, "complete -c %s -n '%s' -a '%s' -d '%s'\n", name, noCommand, cmd.names[0], quoteDescription(cmd.usage))
+	}
+
+	for _, cmd := range commands {
+		fmt.Fprintf(&buf, "\n")
+
+		cond := fmt.Sprintf("__fish_seen_subcommand_from %s", strings.Join(cmd.names, " "))
+
+		for _, f := range cmd.flags {
+			writeFishFlag(&buf, spec, fn, cond, f)
+		}
+
+		if args := fishValues(spec, fn, spec.ArgValues[cmd.names[0]]); args != "" {
+			fmt.Fprintf(&buf, "complete -c %s -n '%s' %s\n", name, cond, args)
+		}
+	}
+
+	_, err := buf.WriteTo(w)
+	return err
+}
+
+// writeFishFlag writes the completion line for a single flag
+func writeFishFlag(buf *bytes.Buffer, spec Spec, fn, cond string, f flagSpec) {
+	fmt.Fprintf(buf, "complete -c %s -n '%s'", spec.App.Name, cond)
+	for _, n := range f.names {
+		if len(n) == 1 {
+			fmt.Fprintf(buf, " -s %s", n)
+		} else {
+			fmt.Fprintf(buf, " -l %s", n)
+		}
+	}
+	if f.takesValue {
+		fmt.Fprintf(buf, " -r")
+		if values := fishValues(spec, fn, spec.FlagValues[f.name()]); values != "" {
+			fmt.Fprintf(buf, " %s", values)
+		}
+	}
+	fmt.Fprintf(buf, " -d '%s'\n", quoteDescription(f.usage))
+}
+
+// fishValues returns the completion arguments suggesting the given kind of values
+func fishValues(spec Spec, fn, kind string) string {
+	switch kind {
+	case ValueFile:
+		return "-F"
+	case ValueDir:
+		return "-a '(__fish_complete_directories (commandline -ct))'"
+	case ValueRockerfile:
+		return fmt.Sprintf("-a '(%s_rockerfiles)'", fn)
+	case ValueImage:
+		return fmt.Sprintf("-a '(%s 2>/dev/null)'", spec.ListImagesCmd)
+	}
+	return ""
+}
@@ -0,0 +1,152 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+// Package deprecation collects the deprecation and migration warnings of
+// a run, so that they are summarized at its end instead of being lost in
+// the build output
+package deprecation
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// docsURL is where the notices are explained along with the migration steps,
+// under the headings named by their IDs
+const docsURL = "https://github.com/grammarly/rocker/blob/master/README.old.md"
+
+// Notice describes a deprecated feature or a behavior that is going to change
+type Notice struct {
+	// ID is a stable identifier of the notice, e.g. to search the docs for
+	ID string
+
+	// Message tells what is deprecated and what to use instead
+	Message string
+}
+
+// Link returns the docs url of the notice
+func (n Notice) Link() string {
+	return docsURL + "#" + n.ID
+}
+
+// The notices known to rocker
+var (
+	OldS3Name = Notice{
+		ID:      "old-s3-name",
+		Message: "the s3:<bucket>/<image> image names are not supported by docker 1.10+ and will be removed, use s3.amazonaws.com/<bucket>/<image>",
+	}
+	ImplicitContextDir = Notice{
+		ID:      "implicit-context-dir",
+		Message: "the context directory defaults to the directory of the Rockerfile, it will default to the current directory; pass it as the last argument",
+	}
+	AuthFlag = Notice{
+		ID:      "auth-flag",
+		Message: "--auth user:password exposes the password to the other users of the host, use docker login or --docker-config",
+	}
+	Maintainer = Notice{
+		ID:      "maintainer",
+		Message: "MAINTAINER is deprecated by docker, use LABEL maintainer=<name>",
+	}
+)
+
+// Warning is a notice along with the subjects it was raised for,
+// e.g. the image names or the instructions
+type Warning struct {
+	Notice
+	Subjects []string
+}
+
+var warnings = struct {
+	sync.Mutex
+	byID  map[string]*Warning
+	order []string
+}{
+	byID: map[string]*Warning{},
+}
+
+// Warn records the notice raised for the subject, and logs it
+// the first time it is raised for the subject
+func Warn(n Notice, subject string) {
+	warnings.Lock()
+	defer warnings.Unlock()
+
+	w, ok := warnings.byID[n.ID]
+	if !ok {
+		w = &Warning{Notice: n}
+		warnings.byID[n.ID] = w
+		warnings.order = append(warnings.order, n.ID)
+	}
+	for _, s := range w.Subjects {
+		if s == subject {
+			return
+		}
+	}
+	w.Subjects = append(w.Subjects, subject)
+
+	log.Warnf("DEPRECATED %s: %s [%s]", subject, n.Message, n.ID)
+}
+
+// Warnings returns the warnings recorded so far in the order they were first raised
+func Warnings() []Warning {
+	warnings.Lock()
+	defer warnings.Unlock()
+
+	result := make([]Warning, 0, len(warnings.order))
+	for _, id := range warnings.order {
+		w := *warnings.byID[id]
+		w.Subjects = append([]string{}, w.Subjects...)
+		sort.Strings(w.Subjects)
+		result = append(result, w)
+	}
+	return result
+}
+
+// Reset forgets the recorded warnings
+func Reset() {
+	warnings.Lock()
+	defer warnings.Unlock()
+
+	warnings.byID = map[string]*Warning{}
+	warnings.order = nil
+}
+
+// Summary returns the lines of the consolidated report of the recorded
+// warnings, it is empty if there are none
+func Summary() (lines []string) {
+	all := Warnings()
+	if len(all) == 0 {
+		return nil
+	}
+
+	lines = append(lines, fmt.Sprintf("%d deprecation warning(s):", len(all)))
+	for _, w := range all {
+		lines = append(lines, fmt.Sprintf("  [%s] %s", w.ID, w.Message))
+		for _, s := range w.Subjects {
+			lines = append(lines, "    "+s)
+		}
+		lines = append(lines, "    see "+w.Link())
+	}
+	return lines
+}
+
+// PrintSummary logs the summary of the recorded warnings
+func PrintSummary() {
+	for _, line := range Summary() {
+		log.Warn(line)
+	}
+}
@@ -0,0 +1,52 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package deprecation
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWarn(t *testing.T) {
+	Reset()
+	defer Reset()
+
+	assert.Empty(t, Warnings())
+	assert.Empty(t, Summary())
+
+	Warn(OldS3Name, "s3:bucket/b")
+	Warn(Maintainer, "MAINTAINER me")
+	Warn(OldS3Name, "s3:bucket/a")
+	Warn(OldS3Name, "s3:bucket/b")
+
+	warnings := Warnings()
+	assert.Len(t, warnings, 2)
+	assert.Equal(t, "old-s3-name", warnings[0].ID)
+	assert.Equal(t, []string{"s3:bucket/a", "s3:bucket/b"}, warnings[0].Subjects)
+	assert.Equal(t, "maintainer", warnings[1].ID)
+
+	assert.Equal(t, []string{
+		"2 deprecation warning(s):",
+		"  [old-s3-name] " + OldS3Name.Message,
+		"    s3:bucket/a",
+		"    s3:bucket/b",
+		"    see https://github.com/grammarly/rocker/blob/master/README.old.md#old-s3-name",
+		"  [maintainer] " + Maintainer.Message,
+		"    MAINTAINER me",
+		"    see https://github.com/grammarly/rocker/blob/master/README.old.md#maintainer",
+	}, Summary())
+}
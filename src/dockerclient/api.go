@@ -0,0 +1,168 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package dockerclient
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/fsouza/go-dockerclient"
+)
+
+// CommitContainer commits the container like the client does, pause false
+// tells the daemon not to pause the container while committing it, which
+// the vendored client has no option for
+func CommitContainer(client *docker.Client, opts docker.CommitContainerOptions, pause bool) (*docker.Image, error) {
+	query := url.Values{}
+	query.Set("container", opts.Container)
+	query.Set("pause", fmt.Sprintf("%t", pause))
+	for key, value := range map[string]string{
+		"repo":    opts.Repository,
+		"tag":     opts.Tag,
+		"comment": opts.Message,
+		"author":  opts.Author,
+	} {
+		if value != "" {
+			query.Set(key, value)
+		}
+	}
+
+	var body io.Reader
+	if opts.Run != nil {
+		data, err := json.Marshal(opts.Run)
+		if err != nil {
+			return nil, err
+		}
+		body = bytes.NewReader(data)
+	}
+
+	resp, err := daemonRequest(client, "POST", "/commit", query, "application/json", body)
+	if err != nil {
+		if e, ok := err.(*docker.Error); ok && e.Status == http.StatusNotFound {
+			return nil, &docker.NoSuchContainer{ID: opts.Container}
+		}
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var image docker.Image
+	if err := json.NewDecoder(resp.Body).Decode(&image); err != nil {
+		return nil, err
+	}
+	return &image, nil
+}
+
+// ImportImage imports the image from the filesystem tarball like the client
+// does, changes are the Dockerfile instructions applied to the image config,
+// e.g. CMD, which the vendored client has no option for
+func ImportImage(client *docker.Client, opts docker.ImportImageOptions, changes []string) error {
+	if opts.Repository == "" {
+		return docker.ErrNoSuchImage
+	}
+
+	query := url.Values{}
+	query.Set("fromSrc", "-")
+	query.Set("repo", opts.Repository)
+	if opts.Tag != "" {
+		query.Set("tag", opts.Tag)
+	}
+	for _, change := range changes {
+		query.Add("changes", change)
+	}
+
+	resp, err := daemonRequest(client, "POST", "/images/create", query, "application/x-tar", opts.InputStream)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// The daemon reports the failures in the progress stream
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		var message struct {
+			Error string `json:"error"`
+		}
+		if err := decoder.Decode(&message); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if message.Error != "" {
+			return fmt.Errorf("Failed to import image %s, error: %s", opts.Repository, message.Error)
+		}
+	}
+}
+
+// daemonRequest makes the request to the API of the daemon the client is
+// connected to, over the unix socket or the client's own HTTP transport;
+// the responses of 400 and above are returned as *docker.Error
+func daemonRequest(client *docker.Client, method, path string, query url.Values, contentType string, body io.Reader) (*http.Response, error) {
+	endpoint := client.Endpoint()
+	if !strings.Contains(endpoint, "://") {
+		endpoint = "tcp://" + endpoint
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid docker endpoint %s, error: %s", client.Endpoint(), err)
+	}
+
+	httpClient := client.HTTPClient
+	switch {
+	case u.Scheme == "unix":
+		// The transport is made for the request, so its connection is not
+		// kept alive, otherwise every request would leave an idle socket open
+		socket := u.Path
+		httpClient = &http.Client{Transport: &http.Transport{
+			Dial:              func(_, _ string) (net.Conn, error) { return net.Dial("unix", socket) },
+			DisableKeepAlives: true,
+		}}
+		u = &url.URL{Scheme: "http", Host: "unix.sock"}
+	case client.TLSConfig != nil:
+		u.Scheme = "https"
+	default:
+		u.Scheme = "http"
+	}
+
+	u.Path = path
+	u.RawQuery = query.Encode()
+
+	req, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 400 {
+		defer resp.Body.Close()
+		message, _ := ioutil.ReadAll(resp.Body)
+		return nil, &docker.Error{Status: resp.StatusCode, Message: string(message)}
+	}
+	return resp, nil
+}
@@ -0,0 +1,186 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package dockerclient
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCommitContainer_NoPause(t *testing.T) {
+	var (
+		query  map[string][]string
+		config docker.Config
+	)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "POST", r.Method)
+		assert.Equal(t, "/commit", r.URL.Path)
+		query = r.URL.Query()
+		if err := json.NewDecoder(r.Body).Decode(&config); err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(`{"Id": "sha256:123"}`))
+	}))
+	defer server.Close()
+
+	client, err := docker.NewClient(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	image, err := CommitContainer(client, docker.CommitContainerOptions{
+		Container: "456",
+		Run:       &docker.Config{Cmd: []string{"/bin/app"}},
+	}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, "sha256:123", image.ID)
+	assert.Equal(t, map[string][]string{"container": {"456"}, "pause": {"false"}}, query)
+	assert.Equal(t, []string{"/bin/app"}, config.Cmd)
+}
+
+func TestCommitContainer_UnixSocketClosed(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "rocker-api-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	socket := filepath.Join(tmpDir, "docker.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var open int32
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"Id": "sha256:123"}`))
+	}))
+	server.Listener = listener
+	server.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		switch state {
+		case http.StateNew:
+			atomic.AddInt32(&open, 1)
+		case http.StateClosed, http.StateHijacked:
+			atomic.AddInt32(&open, -1)
+		}
+	}
+	server.Start()
+	defer server.Close()
+
+	client, err := docker.NewClient("unix://" + socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		if _, err := CommitContainer(client, docker.CommitContainerOptions{Container: "456"}, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the connections are not left idle
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadInt32(&open) > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, int32(0), atomic.LoadInt32(&open))
+}
+
+func TestCommitContainer_NoSuchContainer(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "no such container", http.StatusNotFound)
+	}))
+	defer server.Close()
+
+	client, err := docker.NewClient(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = CommitContainer(client, docker.CommitContainerOptions{Container: "456"}, false)
+	assert.IsType(t, &docker.NoSuchContainer{}, err)
+}
+
+func TestImportImage_Changes(t *testing.T) {
+	var (
+		query map[string][]string
+		body  []byte
+	)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "POST", r.Method)
+		assert.Equal(t, "/images/create", r.URL.Path)
+		query = r.URL.Query()
+		body, _ = ioutil.ReadAll(r.Body)
+		w.Write([]byte(`{"status": "sha256:123"}`))
+	}))
+	defer server.Close()
+
+	client, err := docker.NewClient(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ImportImage(client, docker.ImportImageOptions{
+		Repository:  "rocker-rsync",
+		Tag:         "1.0",
+		Source:      "-",
+		InputStream: strings.NewReader("tarball"),
+	}, []string{`CMD ["rsync"]`, "WORKDIR /"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, map[string][]string{
+		"fromSrc": {"-"},
+		"repo":    {"rocker-rsync"},
+		"tag":     {"1.0"},
+		"changes": {`CMD ["rsync"]`, "WORKDIR /"},
+	}, query)
+	assert.Equal(t, "tarball", string(body))
+}
+
+func TestImportImage_Error(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"status": "Importing"}{"error": "invalid tar header"}`))
+	}))
+	defer server.Close()
+
+	client, err := docker.NewClient(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ImportImage(client, docker.ImportImageOptions{Repository: "rocker-rsync", InputStream: strings.NewReader("")}, nil)
+	assert.EqualError(t, err, "Failed to import image rocker-rsync, error: invalid tar header")
+}
@@ -19,10 +19,13 @@ package dockerclient
 import (
 	"encoding/base64"
 	"fmt"
+	"os"
+	"path/filepath"
 	"strings"
 	"sync"
 
 	"github.com/grammarly/rocker/src/imagename"
+	"github.com/grammarly/rocker/src/util"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/aws/aws-sdk-go/aws"
@@ -37,12 +40,127 @@ type ecrAuthCache struct {
 	mu     sync.Mutex
 }
 
+// authSources remembers where the credentials of each registry key come from,
+// so that the source can be reported once per registry in debug logs
+type authSources struct {
+	sources  map[string]string
+	reported map[string]bool
+	mu       sync.Mutex
+}
+
 var (
 	_ecrAuthCache = ecrAuthCache{
 		tokens: map[string]docker.AuthConfiguration{},
 	}
+
+	_authSources = authSources{
+		sources:  map[string]string{},
+		reported: map[string]bool{},
+	}
 )
 
+// SetAuthSource records the source of the credentials of the registry key,
+// e.g. the config file they are read from
+func SetAuthSource(key, source string) {
+	_authSources.mu.Lock()
+	defer _authSources.mu.Unlock()
+	_authSources.sources[key] = source
+}
+
+// AuthSource returns the source of the credentials of the registry key
+func AuthSource(key string) string {
+	_authSources.mu.Lock()
+	defer _authSources.mu.Unlock()
+	if source, ok := _authSources.sources[key]; ok {
+		return source
+	}
+	return "unknown"
+}
+
+// reportAuth logs the credentials used for the registry, with the password masked
+func reportAuth(registry, source string, auth docker.AuthConfiguration) {
+	_authSources.mu.Lock()
+	defer _authSources.mu.Unlock()
+	if _authSources.reported[registry] {
+		return
+	}
+	_authSources.reported[registry] = true
+	log.Debugf("Using credentials for %s from %s: username=%s password=%s", registry, source, auth.Username, maskSecret(auth.Password))
+}
+
+// AuthConfigFiles returns the docker config files to read the credentials from: the given
+// files or directories with config.json, or the first existing of the default ones, which
+// are $DOCKER_CONFIG/config.json, ~/.docker/config.json and ~/.dockercfg
+func AuthConfigFiles(paths []string) (files []string, err error) {
+	if len(paths) == 0 {
+		for _, path := range defaultAuthConfigFiles() {
+			if _, err := os.Stat(path); err == nil {
+				return []string{path}, nil
+			}
+		}
+		return nil, nil
+	}
+
+	for _, path := range paths {
+		if path, err = util.MakeAbsolute(path); err != nil {
+			return nil, err
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read docker config %s, error: %s", path, err)
+		}
+		if info.IsDir() {
+			path = filepath.Join(path, "config.json")
+		}
+		files = append(files, path)
+	}
+
+	return files, nil
+}
+
+func defaultAuthConfigFiles() (files []string) {
+	if dir := os.Getenv("DOCKER_CONFIG"); dir != "" {
+		files = append(files, filepath.Join(dir, "config.json"))
+	}
+	if home, err := util.MakeAbsolute("~"); err == nil {
+		files = append(files, filepath.Join(home, ".docker", "config.json"), filepath.Join(home, ".dockercfg"))
+	}
+	return files
+}
+
+// LoadAuth reads the credentials of the docker config files given by AuthConfigFiles
+// and merges them; the later files override the registries of the earlier ones,
+// so that the personal config can be given after the team-shared one
+func LoadAuth(paths []string) (*docker.AuthConfigurations, error) {
+	files, err := AuthConfigFiles(paths)
+	if err != nil {
+		return nil, err
+	}
+
+	auth := &docker.AuthConfigurations{Configs: map[string]docker.AuthConfiguration{}}
+
+	for _, file := range files {
+		cfg, err := docker.NewAuthConfigurationsFromFile(file)
+		if err != nil && len(paths) == 0 {
+			// The default config may have no credentials at all, e.g. only credsStore
+			log.Debugf("No credentials are read from docker config %s, error: %s", file, err)
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read docker config %s, error: %s", file, err)
+		}
+		for key, registryAuth := range cfg.Configs {
+			if _, ok := auth.Configs[key]; ok {
+				log.Debugf("Credentials for %s from %s override the ones from %s", key, file, AuthSource(key))
+			}
+			auth.Configs[key] = registryAuth
+			SetAuthSource(key, file)
+		}
+	}
+
+	return auth, nil
+}
+
 // GetAuthForRegistry extracts desired docker.AuthConfiguration object from the
 // list of docker.AuthConfigurations by registry hostname
 func GetAuthForRegistry(auth *docker.AuthConfigurations, image *imagename.ImageName) (result docker.AuthConfiguration, err error) {
@@ -58,6 +176,7 @@ func GetAuthForRegistry(auth *docker.AuthConfigurations, image *imagename.ImageN
 		if awsRegAuth, err := GetECRAuth(registry, image.GetECRRegion()); err != nil && err != credentials.ErrNoValidProvidersFoundInChain {
 			return result, err
 		} else if awsRegAuth.Username != "" {
+			reportAuth(registry, "ECR authorization token", awsRegAuth)
 			return awsRegAuth, nil
 		}
 	}
@@ -66,21 +185,18 @@ func GetAuthForRegistry(auth *docker.AuthConfigurations, image *imagename.ImageN
 		return
 	}
 
-	if result, ok := auth.Configs[registry]; ok {
-		return result, nil
-	}
-	if result, ok := auth.Configs["https://"+registry]; ok {
-		return result, nil
-	}
-	if result, ok := auth.Configs["https://"+registry+"/v1/"]; ok {
-		return result, nil
-	}
-	// not sure /v2/ is needed, but just in case
-	if result, ok := auth.Configs["https://"+registry+"/v2/"]; ok {
-		return result, nil
-	}
-	if result, ok := auth.Configs["*"]; ok {
-		return result, nil
+	for _, key := range []string{
+		registry,
+		"https://" + registry,
+		"https://" + registry + "/v1/",
+		// not sure /v2/ is needed, but just in case
+		"https://" + registry + "/v2/",
+		"*",
+	} {
+		if result, ok := auth.Configs[key]; ok {
+			reportAuth(registry, AuthSource(key), result)
+			return result, nil
+		}
 	}
 	return
 }
@@ -94,6 +210,10 @@ func GetECRAuth(registry, region string) (result docker.AuthConfiguration, err e
 		return token, nil
 	}
 
+	if err = util.CheckOffline("get the ECR token of %s", registry); err != nil {
+		return
+	}
+
 	defer func() {
 		_ecrAuthCache.tokens[registry] = result
 	}()
@@ -0,0 +1,117 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package dockerclient
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/grammarly/rocker/src/imagename"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadAuth_Merge(t *testing.T) {
+	tmpDir := authTestTmpDir(t)
+	defer os.RemoveAll(tmpDir)
+
+	team := writeAuthConfig(t, filepath.Join(tmpDir, "team.json"), map[string]string{
+		"registry.internal": "ci:team",
+		"quay.io":           "ci:quay",
+	})
+	personal := writeAuthConfig(t, filepath.Join(tmpDir, "personal", "config.json"), map[string]string{
+		"registry.internal": "me:mine",
+	})
+
+	auth, err := LoadAuth([]string{team, filepath.Dir(personal)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, "me", auth.Configs["registry.internal"].Username)
+	assert.Equal(t, "mine", auth.Configs["registry.internal"].Password)
+	assert.Equal(t, "ci", auth.Configs["quay.io"].Username)
+	assert.Equal(t, personal, AuthSource("registry.internal"))
+	assert.Equal(t, team, AuthSource("quay.io"))
+
+	result, err := GetAuthForRegistry(auth, imagename.NewFromString("quay.io/org/app:1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "quay", result.Password)
+}
+
+func TestLoadAuth_Missing(t *testing.T) {
+	_, err := LoadAuth([]string{"/does/not/exist.json"})
+	assert.Error(t, err)
+}
+
+func TestAuthConfigFiles_Default(t *testing.T) {
+	tmpDir := authTestTmpDir(t)
+	defer os.RemoveAll(tmpDir)
+
+	defer os.Setenv("DOCKER_CONFIG", os.Getenv("DOCKER_CONFIG"))
+	defer os.Setenv("HOME", os.Getenv("HOME"))
+
+	os.Setenv("HOME", filepath.Join(tmpDir, "home"))
+	os.Setenv("DOCKER_CONFIG", filepath.Join(tmpDir, "docker"))
+
+	files, err := AuthConfigFiles(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Empty(t, files)
+
+	home := writeAuthConfig(t, filepath.Join(tmpDir, "home", ".docker", "config.json"), map[string]string{})
+	files, _ = AuthConfigFiles(nil)
+	assert.Equal(t, []string{home}, files)
+
+	dockerConfig := writeAuthConfig(t, filepath.Join(tmpDir, "docker", "config.json"), map[string]string{})
+	files, _ = AuthConfigFiles(nil)
+	assert.Equal(t, []string{dockerConfig}, files)
+}
+
+func authTestTmpDir(t *testing.T) string {
+	tmpDir, err := ioutil.TempDir("", "rocker-auth-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tmpDir
+}
+
+func writeAuthConfig(t *testing.T, fileName string, auths map[string]string) string {
+	if err := os.MkdirAll(filepath.Dir(fileName), 0755); err != nil {
+		t.Fatal(err)
+	}
+	data := `{"auths":{`
+	i := 0
+	for registry, userPass := range auths {
+		if i > 0 {
+			data += ","
+		}
+		data += fmt.Sprintf("%q:{%q:%q}", registry, "auth", base64.StdEncoding.EncodeToString([]byte(userPass)))
+		i++
+	}
+	data += "}}"
+	if err := ioutil.WriteFile(fileName, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return fileName
+}
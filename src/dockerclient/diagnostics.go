@@ -0,0 +1,140 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package dockerclient
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/grammarly/rocker/src/util"
+
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/docker/docker/pkg/units"
+	"github.com/fsouza/go-dockerclient"
+)
+
+// printDiagnostics prints the build environment details that are usually
+// needed to investigate a problem: daemon platform, storage, free disk space,
+// credentials available and presence of the helper images
+func printDiagnostics(client *docker.Client, config *Config, cacheDir string, helperImages []string) error {
+	info, err := client.Info()
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("\nBuild environment diagnostics:\n\n")
+
+	fmt.Printf("Docker OS: %s (%s)\n", info.OperatingSystem, info.OSType)
+	fmt.Printf("Docker Arch: %s\n", info.Architecture)
+	fmt.Printf("Docker Kernel: %s\n", info.KernelVersion)
+	fmt.Printf("Docker Storage driver: %s\n", info.Driver)
+	fmt.Printf("Docker Root dir: %s\n", info.DockerRootDir)
+
+	// Free space of the docker root can be measured only if the daemon is local
+	if isLocalHost(config.Host) {
+		fmt.Printf("Docker Root free space: %s\n", diskFreeString(info.DockerRootDir))
+	} else {
+		fmt.Printf("Docker Root free space: unknown (remote daemon)\n")
+	}
+
+	if cacheDir, err = util.MakeAbsolute(cacheDir); err != nil {
+		return err
+	}
+	fmt.Printf("Cache dir: %s\n", cacheDir)
+	fmt.Printf("Cache dir free space: %s\n", diskFreeString(cacheDir))
+
+	fmt.Printf("\nAuth configs:\n")
+	auth, err := LoadAuth(config.AuthFiles)
+	if err != nil {
+		fmt.Printf("  failed to read (%s)\n", err)
+	} else if len(auth.Configs) == 0 {
+		fmt.Printf("  none found\n")
+	} else {
+		registries := []string{}
+		for registry := range auth.Configs {
+			registries = append(registries, registry)
+		}
+		sort.Strings(registries)
+
+		for _, registry := range registries {
+			cfg := auth.Configs[registry]
+			fmt.Printf("  %s: username=%s password=%s (%s)\n", registry, cfg.Username, maskSecret(cfg.Password), AuthSource(registry))
+		}
+	}
+
+	fmt.Printf("\nS3 credentials: ")
+	creds, err := session.New().Config.Credentials.Get()
+	if err != nil {
+		fmt.Printf("not available (%s)\n", err)
+	} else {
+		fmt.Printf("available, access key %s\n", maskSecret(creds.AccessKeyID))
+	}
+
+	fmt.Printf("\nHelper images:\n")
+	for _, name := range helperImages {
+		img, err := client.InspectImage(name)
+		switch {
+		case err == docker.ErrNoSuchImage:
+			fmt.Printf("  %s: missing (will be pulled on demand)\n", name)
+		case err != nil:
+			fmt.Printf("  %s: failed to inspect, error: %s\n", name, err)
+		default:
+			fmt.Printf("  %s: present (%.12s)\n", name, img.ID)
+		}
+	}
+
+	return nil
+}
+
+// diskFreeString returns the human readable free space of the filesystem
+// holding the given path, or the reason why it cannot be determined
+func diskFreeString(path string) string {
+	// Walk up to the first existing directory, e.g. cache dir may not be created yet
+	for {
+		if _, err := os.Stat(path); err == nil || path == "/" || path == "." {
+			break
+		}
+		path = filepath.Dir(path)
+	}
+
+	free, err := diskFree(path)
+	if err != nil {
+		return fmt.Sprintf("unknown (%s)", err)
+	}
+	return units.HumanSize(float64(free))
+}
+
+// isLocalHost returns true if the docker host is reachable via the unix socket,
+// which means that the daemon filesystem is the same as ours
+func isLocalHost(host string) bool {
+	u, err := url.Parse(host)
+	return err == nil && u.Scheme == "unix"
+}
+
+// maskSecret hides all but the last few characters of a secret
+func maskSecret(secret string) string {
+	if secret == "" {
+		return "<empty>"
+	}
+	if len(secret) <= 8 {
+		return "****"
+	}
+	return "****" + secret[len(secret)-4:]
+}
@@ -0,0 +1,34 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package dockerclient
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDiagnostics_MaskSecret(t *testing.T) {
+	assert.Equal(t, "<empty>", maskSecret(""))
+	assert.Equal(t, "****", maskSecret("short"))
+	assert.Equal(t, "****cdef", maskSecret("AKIA0123456789abcdef"))
+}
+
+func TestDiagnostics_IsLocalHost(t *testing.T) {
+	assert.True(t, isLocalHost("unix:///var/run/docker.sock"))
+	assert.False(t, isLocalHost("tcp://192.168.99.100:2376"))
+}
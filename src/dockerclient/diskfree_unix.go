@@ -0,0 +1,15 @@
+// +build !windows
+
+package dockerclient
+
+import "syscall"
+
+// diskFree returns the amount of bytes available to a non-root user
+// on the filesystem holding the given path
+func diskFree(path string) (uint64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return 0, err
+	}
+	return uint64(stat.Bavail) * uint64(stat.Bsize), nil
+}
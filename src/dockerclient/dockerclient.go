@@ -24,6 +24,7 @@ import (
 	"log"
 	"os"
 	"reflect"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -45,6 +46,20 @@ type Config struct {
 	Tlscacert string
 	Tlscert   string
 	Tlskey    string
+
+	// Timeout limits a single daemon call, CommitTimeout is for commits and file transfers,
+	// Retries is the number of retries of the idempotent calls that failed or timed out
+	Timeout       time.Duration
+	CommitTimeout time.Duration
+	Retries       int
+
+	// PullTimeout limits a single attempt of an image pull, PullRetries is
+	// the number of attempts after the failed or timed out one
+	PullTimeout time.Duration
+	PullRetries int
+
+	// AuthFiles are the docker config files or directories to read the registry credentials from
+	AuthFiles []string
 }
 
 // NewConfig returns new config with resolved options from current ENV
@@ -81,6 +96,12 @@ func NewConfigFromCli(c *cli.Context) *Config {
 		config.Tlscert = globalCliString(c, "tlscert")
 		config.Tlskey = globalCliString(c, "tlskey")
 	}
+	config.Timeout = c.GlobalDuration("docker-timeout")
+	config.CommitTimeout = c.GlobalDuration("docker-commit-timeout")
+	config.Retries = c.GlobalInt("docker-retries")
+	config.PullTimeout = c.GlobalDuration("pull-timeout")
+	config.PullRetries = c.GlobalInt("pull-retries")
+	config.AuthFiles = c.GlobalStringSlice("docker-config")
 	return config
 }
 
@@ -150,26 +171,69 @@ func GlobalCliParams() []cli.Flag {
 			Value: "~/.docker/key.pem",
 			Usage: "Path to TLS key file",
 		},
+		cli.DurationFlag{
+			Name:   "docker-timeout",
+			Value:  5 * time.Minute,
+			Usage:  "Timeout of a single docker daemon call, 0 to disable",
+			EnvVar: "ROCKER_DOCKER_TIMEOUT",
+		},
+		cli.DurationFlag{
+			Name:   "docker-commit-timeout",
+			Value:  30 * time.Minute,
+			Usage:  "Timeout of container commits and file transfers to and from containers, 0 to disable",
+			EnvVar: "ROCKER_DOCKER_COMMIT_TIMEOUT",
+		},
+		cli.IntFlag{
+			Name:   "docker-retries",
+			Value:  2,
+			Usage:  "Number of retries of the idempotent docker daemon calls that failed or timed out",
+			EnvVar: "ROCKER_DOCKER_RETRIES",
+		},
+		cli.DurationFlag{
+			Name:   "pull-timeout",
+			Usage:  "Timeout of a single attempt to pull an image, e.g. 30m; 0 to disable",
+			EnvVar: "ROCKER_PULL_TIMEOUT",
+		},
+		cli.IntFlag{
+			Name:   "pull-retries",
+			Value:  3,
+			Usage:  "Number of retries of the image pulls that failed on the network or timed out, the downloaded layers are kept between the attempts",
+			EnvVar: "ROCKER_PULL_RETRIES",
+		},
+		cli.StringSliceFlag{
+			Name:  "docker-config",
+			Value: &cli.StringSlice{},
+			Usage: "docker config file or directory to read the registry credentials from, the later ones override the earlier; defaults to $DOCKER_CONFIG or ~/.docker",
+		},
 	}
 }
 
 // InfoCommandSpec returns specifications of the info comment for codegangsta/cli
-func InfoCommandSpec() cli.Command {
+// helperImages returns the images the tool relies on, their presence is reported by diagnostics;
+// it is called when the command runs, so the image names may depend on the global flags
+func InfoCommandSpec(helperImages func() []string) cli.Command {
 	return cli.Command{
-		Name:   "info",
-		Usage:  "show docker info (check connectivity, versions, etc.)",
-		Action: infoCommand,
+		Name:  "info",
+		Usage: "show docker info (check connectivity, versions, build environment diagnostics, etc.)",
+		Action: func(c *cli.Context) {
+			infoCommand(c, helperImages())
+		},
 		Flags: []cli.Flag{
 			cli.BoolFlag{
 				Name:  "all, a",
 				Usage: "show advanced info",
 			},
+			cli.StringFlag{
+				Name:  "cache-dir",
+				Value: "~/.rocker_cache",
+				Usage: "Set the directory where the cache is stored, to check the free space",
+			},
 		},
 	}
 }
 
 // infoCommand implements 'info' command that prints docker info (check connectivity, versions, etc.)
-func infoCommand(c *cli.Context) {
+func infoCommand(c *cli.Context, helperImages []string) {
 	config := NewConfigFromCli(c)
 
 	fmt.Printf("Docker host: %s\n", config.Host)
@@ -185,15 +249,17 @@ func infoCommand(c *cli.Context) {
 		log.Fatal(err)
 	}
 
-	// TODO: golang randomizes maps every time, so the output is not consistent
-	//       find out a way to sort it correctly
-
 	version, err := dockerClient.Version()
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	for _, kv := range *version {
+	// Version is a list of "key=value" pairs decoded from a map,
+	// sort it to have a consistent output
+	versionKV := []string(*version)
+	sort.Strings(versionKV)
+
+	for _, kv := range versionKV {
 		parts := strings.SplitN(kv, "=", 2)
 		fmt.Printf("Docker %s: %s\n", parts[0], parts[1])
 	}
@@ -213,6 +279,10 @@ func infoCommand(c *cli.Context) {
 			fmt.Printf("%s: %v\n", typeOfInfo.Field(i).Name, f.Interface())
 		}
 	}
+
+	if err := printDiagnostics(dockerClient, config, c.String("cache-dir"), helperImages); err != nil {
+		log.Fatal(err)
+	}
 }
 
 // globalCliString fixes string arguments enclosed with double quotes
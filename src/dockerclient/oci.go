@@ -0,0 +1,261 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package dockerclient
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/grammarly/rocker/src/imagename"
+	"github.com/grammarly/rocker/src/util"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// OCIManifestMediaType is the media type of the manifests of pushed OCI artifacts
+const OCIManifestMediaType = "application/vnd.oci.image.manifest.v1+json"
+
+// OCIBlob is the config or a layer of an OCI artifact
+type OCIBlob struct {
+	MediaType   string
+	Data        []byte
+	Annotations map[string]string
+}
+
+// OCIArtifact is a non-image artifact, e.g. a Helm chart, that is stored
+// in the registry as an OCI image manifest with its own media types
+type OCIArtifact struct {
+	ArtifactType string
+	Config       OCIBlob
+	Layers       []OCIBlob
+	Annotations  map[string]string
+}
+
+type ociDescriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+type ociManifest struct {
+	SchemaVersion int               `json:"schemaVersion"`
+	MediaType     string            `json:"mediaType"`
+	ArtifactType  string            `json:"artifactType,omitempty"`
+	Config        ociDescriptor     `json:"config"`
+	Layers        []ociDescriptor   `json:"layers"`
+	Annotations   map[string]string `json:"annotations,omitempty"`
+}
+
+// Manifest returns the OCI image manifest that refers to the blobs of the artifact
+func (a OCIArtifact) Manifest() ([]byte, error) {
+	manifest := ociManifest{
+		SchemaVersion: 2,
+		MediaType:     OCIManifestMediaType,
+		ArtifactType:  a.ArtifactType,
+		Config:        a.Config.descriptor(),
+		Layers:        []ociDescriptor{},
+		Annotations:   a.Annotations,
+	}
+	for _, layer := range a.Layers {
+		manifest.Layers = append(manifest.Layers, layer.descriptor())
+	}
+	return json.Marshal(manifest)
+}
+
+func (b OCIBlob) descriptor() ociDescriptor {
+	return ociDescriptor{
+		MediaType:   b.MediaType,
+		Digest:      blobDigest(b.Data),
+		Size:        int64(len(b.Data)),
+		Annotations: b.Annotations,
+	}
+}
+
+func blobDigest(data []byte) string {
+	return fmt.Sprintf("sha256:%x", sha256.Sum256(data))
+}
+
+// RegistryPushArtifact uploads the blobs of the artifact that are not in the
+// repository yet and puts its manifest under the tag of the image name,
+// it returns the digest of the manifest
+func RegistryPushArtifact(image *imagename.ImageName, artifact OCIArtifact, auth *docker.AuthConfigurations) (digest string, err error) {
+	if !image.HasTag() {
+		return "", fmt.Errorf("Cannot push artifact %s without a tag", image)
+	}
+
+	regAuth, err := GetAuthForRegistry(auth, image)
+	if err != nil {
+		return "", fmt.Errorf("Failed to get auth token for registry: %s, make sure you are properly logged in using `docker login` or have AWS credentials set in case of using ECR", image)
+	}
+
+	var (
+		s    = &registrySession{auth: regAuth}
+		repo = repositoryURI(image)
+	)
+
+	for _, blob := range append([]OCIBlob{artifact.Config}, artifact.Layers...) {
+		if err := s.pushBlob(repo, blob.Data); err != nil {
+			return "", fmt.Errorf("Failed to push artifact %s, error: %s", image, err)
+		}
+	}
+
+	manifest, err := artifact.Manifest()
+	if err != nil {
+		return "", err
+	}
+
+	header, err := s.do("PUT", repo+"/manifests/"+image.GetTag(), OCIManifestMediaType, manifest, http.StatusCreated)
+	if err != nil {
+		return "", fmt.Errorf("Failed to push artifact %s, error: %s", image, err)
+	}
+
+	if digest = header.Get("Docker-Content-Digest"); digest == "" {
+		digest = blobDigest(manifest)
+	}
+
+	return digest, nil
+}
+
+// registrySession makes the write requests to the registry, authenticating
+// on demand; the bearer token is requested again for every 401, because
+// the token for pulling is not enough to push
+type registrySession struct {
+	auth  docker.AuthConfiguration
+	token string
+	basic bool
+}
+
+// pushBlob uploads the blob in a single request unless the repository has it already
+func (s *registrySession) pushBlob(repo string, data []byte) error {
+	digest := blobDigest(data)
+
+	if _, err := s.do("HEAD", repo+"/blobs/"+digest, "", nil, http.StatusOK); err == nil {
+		log.Debugf("Blob %s already exists in %s", digest, repo)
+		return nil
+	} else if e, ok := err.(*registryStatusError); !ok || e.code != http.StatusNotFound {
+		return err
+	}
+
+	header, err := s.do("POST", repo+"/blobs/uploads/", "", nil, http.StatusAccepted)
+	if err != nil {
+		return err
+	}
+
+	location, err := uploadLocation(repo, header.Get("Location"), digest)
+	if err != nil {
+		return err
+	}
+
+	log.Debugf("Upload blob %s (%d bytes) to %s", digest, len(data), repo)
+
+	_, err = s.do("PUT", location, "application/octet-stream", data, http.StatusCreated)
+	return err
+}
+
+// uploadLocation resolves the upload url given by the registry, which may be relative,
+// and adds the digest of the blob to it
+func uploadLocation(repo, location, digest string) (string, error) {
+	if location == "" {
+		return "", fmt.Errorf("Registry did not return the upload location for %s", repo)
+	}
+
+	base, err := url.Parse(repo)
+	if err != nil {
+		return "", err
+	}
+	uri, err := base.Parse(location)
+	if err != nil {
+		return "", fmt.Errorf("Invalid upload location %q, error: %s", location, err)
+	}
+
+	q := uri.Query()
+	q.Set("digest", digest)
+	uri.RawQuery = q.Encode()
+
+	return uri.String(), nil
+}
+
+// do executes the request and fails unless the response has the expected status,
+// it returns the response headers
+func (s *registrySession) do(method, uri, contentType string, body []byte, expected int) (header http.Header, err error) {
+	if err = util.CheckOffline("request %s", uri); err != nil {
+		return nil, err
+	}
+
+	var (
+		client  = &http.Client{}
+		authTry bool
+		res     *http.Response
+	)
+
+	for {
+		req, err := http.NewRequest(method, uri, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		if contentType != "" {
+			req.Header.Set("Content-Type", contentType)
+		}
+		if s.token != "" {
+			req.Header.Set("Authorization", "Bearer "+s.token)
+		} else if s.basic {
+			req.SetBasicAuth(s.auth.Username, s.auth.Password)
+		}
+
+		if res, err = client.Do(req); err != nil {
+			return nil, fmt.Errorf("Request to %s failed with %s", uri, err)
+		}
+		defer res.Body.Close()
+
+		challenge := res.Header.Get("Www-Authenticate")
+		log.Debugf("Got HTTP %d for %s %s; tried auth: %t", res.StatusCode, method, uri, authTry)
+
+		if res.StatusCode != http.StatusUnauthorized || authTry {
+			break
+		}
+		authTry = true
+
+		if b := parseBearer(challenge); b != nil {
+			if s.token, err = getAuthToken(b, s.auth); err != nil {
+				return nil, fmt.Errorf("Failed to authenticate to registry %s, error: %s", uri, err)
+			}
+			continue
+		}
+		if strings.HasPrefix(challenge, "Basic ") && s.auth.Username != "" {
+			s.basic = true
+			continue
+		}
+		break
+	}
+
+	if res.StatusCode != expected {
+		if message, _ := ioutil.ReadAll(res.Body); len(message) > 0 {
+			log.Debugf("Response of %s %s: %s", method, uri, message)
+		}
+		return nil, &registryStatusError{method, uri, res.StatusCode}
+	}
+
+	return res.Header, nil
+}
@@ -0,0 +1,63 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package dockerclient
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOCIArtifactManifest(t *testing.T) {
+	a := OCIArtifact{
+		ArtifactType: "application/x-test",
+		Config:       OCIBlob{MediaType: "application/vnd.oci.empty.v1+json", Data: []byte("{}")},
+		Layers:       []OCIBlob{{MediaType: "application/x-test", Data: []byte("hello")}},
+	}
+
+	data, err := a.Manifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	manifest := ociManifest{}
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, OCIManifestMediaType, manifest.MediaType)
+	assert.Equal(t, "application/x-test", manifest.ArtifactType)
+	assert.Equal(t, "sha256:44136fa355b3678a1146ad16f7e8649e94fb4fc21fe77e8310c060f61caaff8a", manifest.Config.Digest)
+	assert.Equal(t, int64(2), manifest.Config.Size)
+	assert.Equal(t, "sha256:2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824", manifest.Layers[0].Digest)
+}
+
+func TestUploadLocation(t *testing.T) {
+	const digest = "sha256:2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"
+
+	location, err := uploadLocation("https://registry.io/v2/charts/app", "/v2/charts/app/blobs/uploads/123?state=abc", digest)
+	assert.NoError(t, err)
+	assert.Equal(t, "https://registry.io/v2/charts/app/blobs/uploads/123?digest=sha256%3A2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824&state=abc", location)
+
+	location, err = uploadLocation("https://registry.io/v2/app", "https://storage.io/upload/1", digest)
+	assert.NoError(t, err)
+	assert.Contains(t, location, "https://storage.io/upload/1?digest=")
+
+	_, err = uploadLocation("https://registry.io/v2/app", "", digest)
+	assert.EqualError(t, err, "Registry did not return the upload location for https://registry.io/v2/app")
+}
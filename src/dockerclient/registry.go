@@ -26,6 +26,7 @@ import (
 
 	"github.com/fsouza/go-dockerclient"
 	"github.com/grammarly/rocker/src/imagename"
+	"github.com/grammarly/rocker/src/util"
 
 	log "github.com/Sirupsen/logrus"
 )
@@ -43,20 +44,14 @@ type bearer struct {
 
 // RegistryListTags returns the list of images instances obtained from all tags existing in the registry
 func RegistryListTags(image *imagename.ImageName, auth *docker.AuthConfigurations) (images []*imagename.ImageName, err error) {
-	var (
-		name     = image.Name
-		registry = image.Registry
-	)
-
-	regAuth, err := GetAuthForRegistry(auth, image)
-	if err != nil {
-		return nil, fmt.Errorf("Failed to get auth token for registry: %s, make sure you are properly logged in using `docker login` or have AWS credentials set in case of using ECR", image)
-	}
-
 	// XXX: AWS ECR Registry API v2 does not support listing tags
 	// wo we just return a single image tag if it exists and no wildcards used
 	if image.IsECR() {
-		log.Debugf("ECR detected %s", registry)
+		regAuth, err := GetAuthForRegistry(auth, image)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to get auth token for registry: %s, make sure you are properly logged in using `docker login` or have AWS credentials set in case of using ECR", image)
+		}
+		log.Debugf("ECR detected %s", image.Registry)
 		if !image.IsStrict() {
 			return nil, fmt.Errorf("Amazon ECR does not support tags listing, therefore image wildcards are not supported, sorry: %s", image)
 		}
@@ -66,7 +61,28 @@ func RegistryListTags(image *imagename.ImageName, auth *docker.AuthConfiguration
 			log.Debugf("ECR image %s found in the registry", image)
 			images = append(images, image)
 		}
-		return
+		return images, nil
+	}
+
+	tags, err := RegistryTags(image, auth)
+	if err != nil {
+		return nil, err
+	}
+
+	return MatchTags(image, tags), nil
+}
+
+// RegistryTags returns all tags of the image repository in the registry,
+// it does not work for ECR, which cannot list the tags
+func RegistryTags(image *imagename.ImageName, auth *docker.AuthConfigurations) ([]string, error) {
+	var (
+		name     = image.Name
+		registry = image.Registry
+	)
+
+	regAuth, err := GetAuthForRegistry(auth, image)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get auth token for registry: %s, make sure you are properly logged in using `docker login` or have AWS credentials set in case of using ECR", image)
 	}
 
 	if registry == "" {
@@ -89,18 +105,124 @@ func RegistryListTags(image *imagename.ImageName, auth *docker.AuthConfiguration
 
 	log.Debugf("Got %d tags from the remote registry for image %s", len(tg.Tags), image)
 
-	for _, t := range tg.Tags {
+	return tg.Tags, nil
+}
+
+// MatchTags returns the images of the repository with the tags that match
+// the tag or the version range of the image
+func MatchTags(image *imagename.ImageName, tags []string) (images []*imagename.ImageName) {
+	for _, t := range tags {
 		candidate := imagename.New(image.NameWithRegistry(), t)
 		if image.Contains(candidate) || image.Tag == candidate.Tag {
 			images = append(images, candidate)
 		}
 	}
+	return images
+}
+
+// RegistryImageExists checks that the image is present in the registry,
+// ref is either a tag or a digest of the image
+func RegistryImageExists(image *imagename.ImageName, ref string, auth *docker.AuthConfigurations) (bool, error) {
+	regAuth, err := GetAuthForRegistry(auth, image)
+	if err != nil {
+		return false, fmt.Errorf("Failed to get auth token for registry: %s, make sure you are properly logged in using `docker login` or have AWS credentials set in case of using ECR", image)
+	}
+
+	if image.IsECR() {
+		img := *image
+		img.Tag = ref
+		return ecrImageExists(&img, regAuth)
+	}
+
+	manifest := map[string]interface{}{}
+
+	_, err = registryRequest(manifestURI(image, ref), manifestMediaTypes, regAuth, &manifest)
+	if e, ok := err.(*registryStatusError); ok && e.code == http.StatusNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// RegistryImageDigest returns the digest of the manifest the image tag currently points to
+func RegistryImageDigest(image *imagename.ImageName, auth *docker.AuthConfigurations) (digest string, err error) {
+	regAuth, err := GetAuthForRegistry(auth, image)
+	if err != nil {
+		return "", fmt.Errorf("Failed to get auth token for registry: %s, make sure you are properly logged in using `docker login` or have AWS credentials set in case of using ECR", image)
+	}
+
+	var header http.Header
+
+	if image.IsECR() {
+		header, err = ecrManifest(image, regAuth)
+	} else {
+		manifest := map[string]interface{}{}
+		header, err = registryRequest(manifestURI(image, image.GetTag()), manifestMediaTypes, regAuth, &manifest)
+	}
+	if err != nil {
+		return "", fmt.Errorf("Failed to get manifest of %s, error: %s", image, err)
+	}
+
+	if digest = header.Get("Docker-Content-Digest"); digest == "" {
+		return "", fmt.Errorf("Registry did not return the digest of %s", image)
+	}
+
+	return digest, nil
+}
+
+// manifestURI returns the url of the image manifest for a given reference
+func manifestURI(image *imagename.ImageName, ref string) string {
+	return fmt.Sprintf("%s/manifests/%s", repositoryURI(image), ref)
+}
+
+// repositoryURI returns the base url of the image repository in the registry API
+func repositoryURI(image *imagename.ImageName) string {
+	var (
+		registry = image.Registry
+		name     = image.Name
+	)
+	if registry == "" {
+		registry = "registry-1.docker.io"
+		if !strings.Contains(name, "/") {
+			name = "library/" + name
+		}
+	}
+	return fmt.Sprintf("https://%s/v2/%s", registry, name)
+}
+
+// manifestMediaTypes are accepted when getting manifests, so the registry
+// does not convert them to the schema 1, which has a different digest
+var manifestMediaTypes = strings.Join([]string{
+	"application/vnd.docker.distribution.manifest.v2+json",
+	"application/vnd.docker.distribution.manifest.list.v2+json",
+	"application/vnd.docker.distribution.manifest.v1+prettyjws",
+	OCIManifestMediaType,
+}, ", ")
+
+// registryStatusError is returned for unexpected HTTP responses of the registry
+type registryStatusError struct {
+	method string
+	uri    string
+	code   int
+}
 
-	return
+func (e *registryStatusError) Error() string {
+	// TODO: maybe more descriptive error
+	return fmt.Sprintf("%s %s status code %d", e.method, e.uri, e.code)
 }
 
 // registryGet executes HTTP get to a given registry
 func registryGet(uri string, auth docker.AuthConfiguration, obj interface{}) (err error) {
+	_, err = registryRequest(uri, "", auth, obj)
+	return err
+}
+
+// registryRequest executes HTTP get to a given registry with the optional Accept header,
+// it returns the response headers
+func registryRequest(uri, accept string, auth docker.AuthConfiguration, obj interface{}) (header http.Header, err error) {
 	var (
 		client = &http.Client{}
 		req    *http.Request
@@ -108,9 +230,16 @@ func registryGet(uri string, auth docker.AuthConfiguration, obj interface{}) (er
 		body   []byte
 	)
 
+	if err = util.CheckOffline("request %s", uri); err != nil {
+		return
+	}
+
 	if req, err = http.NewRequest("GET", uri, nil); err != nil {
 		return
 	}
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
 
 	var (
 		b       *bearer
@@ -119,7 +248,7 @@ func registryGet(uri string, auth docker.AuthConfiguration, obj interface{}) (er
 
 	for {
 		if res, err = client.Do(req); err != nil {
-			return fmt.Errorf("Request to %s failed with %s\n", uri, err)
+			return nil, fmt.Errorf("Request to %s failed with %s\n", uri, err)
 		}
 		defer res.Body.Close()
 
@@ -129,7 +258,7 @@ func registryGet(uri string, auth docker.AuthConfiguration, obj interface{}) (er
 		if res.StatusCode == 401 && !authTry && b != nil {
 			token, err := getAuthToken(b, auth)
 			if err != nil {
-				return fmt.Errorf("Failed to authenticate to registry %s, error: %s", uri, err)
+				return nil, fmt.Errorf("Failed to authenticate to registry %s, error: %s", uri, err)
 			}
 
 			req.Header.Add("Authorization", "Bearer "+token)
@@ -142,20 +271,19 @@ func registryGet(uri string, auth docker.AuthConfiguration, obj interface{}) (er
 	}
 
 	if res.StatusCode != 200 {
-		// TODO: maybe more descriptive error
-		return fmt.Errorf("GET %s status code %d", uri, res.StatusCode)
+		return nil, &registryStatusError{"GET", uri, res.StatusCode}
 	}
 
 	if body, err = ioutil.ReadAll(res.Body); err != nil {
-		return fmt.Errorf("Response from %s cannot be read due to error %s\n", uri, err)
+		return nil, fmt.Errorf("Response from %s cannot be read due to error %s\n", uri, err)
 	}
 
 	if err = json.Unmarshal(body, obj); err != nil {
-		return fmt.Errorf("Response from %s cannot be unmarshalled due to error %s, response: %s\n",
+		return nil, fmt.Errorf("Response from %s cannot be unmarshalled due to error %s, response: %s\n",
 			uri, err, string(body))
 	}
 
-	return
+	return res.Header, nil
 }
 
 func getAuthToken(b *bearer, auth docker.AuthConfiguration) (token string, err error) {
@@ -216,6 +344,19 @@ func getAuthToken(b *bearer, auth docker.AuthConfiguration) (token string, err e
 }
 
 func ecrImageExists(image *imagename.ImageName, auth docker.AuthConfiguration) (exists bool, err error) {
+	_, err = ecrManifest(image, auth)
+	if e, ok := err.(*registryStatusError); ok && e.code == http.StatusNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// ecrManifest requests the image manifest from ECR and returns the response headers
+func ecrManifest(image *imagename.ImageName, auth docker.AuthConfiguration) (header http.Header, err error) {
 	var (
 		req    *http.Request
 		res    *http.Response
@@ -224,31 +365,31 @@ func ecrImageExists(image *imagename.ImageName, auth docker.AuthConfiguration) (
 
 	uri := fmt.Sprintf("https://%s/v2/%s/manifests/%s", image.Registry, image.Name, image.Tag)
 
+	if err = util.CheckOffline("request %s", uri); err != nil {
+		return nil, err
+	}
+
 	if req, err = http.NewRequest("GET", uri, nil); err != nil {
-		return false, err
+		return nil, err
 	}
 
 	req.SetBasicAuth(auth.Username, auth.Password)
+	req.Header.Set("Accept", manifestMediaTypes)
 
 	log.Debugf("Request ECR image %s with basic auth %s:****", uri, auth.Username)
 
 	if res, err = client.Do(req); err != nil {
-		return false, fmt.Errorf("Failed to authenticate by realm url %s, error %s", uri, err)
+		return nil, fmt.Errorf("Failed to authenticate by realm url %s, error %s", uri, err)
 	}
 	defer res.Body.Close()
 
 	log.Debugf("Got status %d", res.StatusCode)
 
-	if res.StatusCode == 404 {
-		return false, nil
-	}
-
 	if res.StatusCode != 200 {
-		// TODO: maybe more descriptive error
-		return false, fmt.Errorf("GET %s status code %d", uri, res.StatusCode)
+		return nil, &registryStatusError{"GET", uri, res.StatusCode}
 	}
 
-	return true, nil
+	return res.Header, nil
 }
 
 func parseBearer(hdr string) *bearer {
@@ -0,0 +1,52 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package git
+
+// Clone makes a shallow clone of the repository url to the dir;
+// ref is either a branch or a tag name, the default branch is used if empty
+func Clone(url, ref, dir string) error {
+	args := []string{"clone", "--depth", "1", "--recursive"}
+	if ref != "" {
+		args = append(args, "--branch", ref)
+	}
+	args = append(args, "--", url, dir)
+
+	_, err := doGitCmd("", args)
+	return err
+}
+
+// CloneCommit makes a clone of the repository url at the commit to the dir;
+// the commit alone is fetched if the server allows it, otherwise all the
+// branches and tags are, so the commit is found after they have moved
+func CloneCommit(url, commit, dir string) error {
+	if _, err := doGitCmd("", []string{"init", "--quiet", dir}); err != nil {
+		return err
+	}
+
+	if _, err := doGitCmd(dir, []string{"fetch", "--depth", "1", "--", url, commit}); err != nil {
+		if _, err := doGitCmd(dir, []string{"fetch", "--tags", "--", url, "+refs/heads/*:refs/remotes/origin/*"}); err != nil {
+			return err
+		}
+	}
+
+	if _, err := doGitCmd(dir, []string{"checkout", "--quiet", commit}); err != nil {
+		return err
+	}
+
+	_, err := doGitCmd(dir, []string{"submodule", "update", "--init", "--recursive"})
+	return err
+}
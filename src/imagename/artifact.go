@@ -18,14 +18,24 @@ package imagename
 
 import (
 	"fmt"
+	"regexp"
+	"sort"
 	"strings"
 
 	"time"
 )
 
+// ExpiresLabel is the label of the images pushed with PUSH --expires, the
+// time in RFC 3339 after which the image may be removed by the registry GC
+const ExpiresLabel = "rocker.expires"
+
 // Artifact represents the artifact that is the result of image build
 // It holds information about the pushed image and may be saved as a file
 type Artifact struct {
+	// Type is empty for images, otherwise it is the kind of the OCI artifact
+	// made by ARTIFACT, e.g. "chart"; such artifacts have no ImageID
+	Type string `yaml:"Type,omitempty"`
+
 	Name        *ImageName `yaml:"Name"`
 	Pushed      bool       `yaml:"Pushed"`
 	Tag         string     `yaml:"Tag"`
@@ -33,6 +43,17 @@ type Artifact struct {
 	ImageID     string     `yaml:"ImageID"`
 	Addressable string     `yaml:"Addressable"`
 	BuildTime   time.Time  `yaml:"BuildTime"`
+
+	// Size is the virtual size of the image, Delta is the size added on top
+	// of its FROM image, both in bytes
+	Size  int64 `yaml:"Size,omitempty"`
+	Delta int64 `yaml:"Delta,omitempty"`
+
+	// BuildDuration is the time since the build start until the image was ready
+	BuildDuration time.Duration `yaml:"BuildDuration,omitempty"`
+
+	// Expires is the value of ExpiresLabel, nil if the image never expires
+	Expires *time.Time `yaml:"Expires,omitempty"`
 }
 
 // Artifacts is a collection of Artifact entities
@@ -43,6 +64,9 @@ type Artifacts struct {
 // GetFileName constructs the base file name out of the image info
 func (a *Artifact) GetFileName() string {
 	imageName := strings.Replace(a.Name.Name, "/", "_", -1)
+	if a.Type != "" {
+		return fmt.Sprintf("%s_%s_%s.yml", imageName, a.Name.GetTag(), a.Type)
+	}
 	return fmt.Sprintf("%s_%s.yml", imageName, a.Name.GetTag())
 }
 
@@ -72,3 +96,74 @@ func (a *Artifacts) Less(i, j int) bool {
 func (a *Artifacts) Swap(i, j int) {
 	a.RockerArtifacts[i], a.RockerArtifacts[j] = a.RockerArtifacts[j], a.RockerArtifacts[i]
 }
+
+var artifactDigestRegexp = regexp.MustCompile(`^sha256[:-][0-9a-f]{64}$`)
+
+// Validate checks that the artifact is consistent, e.g. a pushed image has a digest
+func (a Artifact) Validate() error {
+	if a.Name == nil || a.Name.Name == "" {
+		return fmt.Errorf("image name is missing")
+	}
+	if a.Tag != a.Name.GetTag() {
+		return fmt.Errorf("tag %q does not match the image name %s", a.Tag, a.Name)
+	}
+	if a.ImageID == "" && a.Type == "" {
+		return fmt.Errorf("image id is missing")
+	}
+	if a.Digest == "" {
+		if a.Pushed {
+			return fmt.Errorf("the image is pushed but has no digest")
+		}
+		return nil
+	}
+	if !artifactDigestRegexp.MatchString(a.Digest) {
+		return fmt.Errorf("invalid digest %q", a.Digest)
+	}
+
+	expected := a
+	expected.SetDigest(a.Digest)
+	if a.Addressable != expected.Addressable {
+		return fmt.Errorf("addressable name %q does not match the digest, expected %q", a.Addressable, expected.Addressable)
+	}
+
+	return nil
+}
+
+// MergeArtifacts combines the lists of artifacts; the same image, i.e. the
+// same name and digest, is kept once, the latest built one
+func MergeArtifacts(lists ...[]Artifact) []Artifact {
+	var (
+		result = []Artifact{}
+		index  = map[string]int{}
+	)
+
+	for _, list := range lists {
+		for _, a := range list {
+			key := a.Type + ":" + a.Name.String() + "@" + a.Digest
+			if i, ok := index[key]; ok {
+				if a.BuildTime.After(result[i].BuildTime) {
+					result[i] = a
+				}
+				continue
+			}
+			index[key] = len(result)
+			result = append(result, a)
+		}
+	}
+
+	sort.Sort(artifactsByName(result))
+
+	return result
+}
+
+// artifactsByName sorts the artifacts by the image name, then by the build time
+type artifactsByName []Artifact
+
+func (a artifactsByName) Len() int      { return len(a) }
+func (a artifactsByName) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a artifactsByName) Less(i, j int) bool {
+	if a[i].Name.String() != a[j].Name.String() {
+		return a[i].Name.String() < a[j].Name.String()
+	}
+	return a[i].BuildTime.Before(a[j].BuildTime)
+}
@@ -0,0 +1,102 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package imagename
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testDigest = "sha256:" + "fafa0000000000000000000000000000000000000000000000000000000000fa"
+
+func makeTestArtifact(name, digest string, buildTime time.Time) Artifact {
+	img := NewFromString(name)
+	a := Artifact{
+		Name:      img,
+		Pushed:    digest != "",
+		Tag:       img.GetTag(),
+		ImageID:   "sha256:123",
+		BuildTime: buildTime,
+	}
+	if digest != "" {
+		a.SetDigest(digest)
+	}
+	return a
+}
+
+func TestArtifactValidate(t *testing.T) {
+	now := time.Now()
+
+	assert.NoError(t, makeTestArtifact("grammarly/rocker:1", testDigest, now).Validate())
+	assert.NoError(t, makeTestArtifact("grammarly/rocker:1", "", now).Validate())
+
+	a := makeTestArtifact("grammarly/rocker:1", testDigest, now)
+	a.Tag = "2"
+	assert.EqualError(t, a.Validate(), `tag "2" does not match the image name grammarly/rocker:1`)
+
+	a = makeTestArtifact("grammarly/rocker:1", testDigest, now)
+	a.Digest = "sha256:xyz"
+	assert.EqualError(t, a.Validate(), `invalid digest "sha256:xyz"`)
+
+	a = makeTestArtifact("grammarly/rocker:1", testDigest, now)
+	a.Addressable = "grammarly/other@" + testDigest
+	assert.Contains(t, a.Validate().Error(), "does not match the digest")
+
+	a = makeTestArtifact("grammarly/rocker:1", "", now)
+	a.Pushed = true
+	assert.EqualError(t, a.Validate(), "the image is pushed but has no digest")
+
+	a = makeTestArtifact("grammarly/rocker:1", "", now)
+	a.ImageID = ""
+	assert.EqualError(t, a.Validate(), "image id is missing")
+
+	// OCI artifacts are not images
+	a.Type = "chart"
+	assert.NoError(t, a.Validate())
+	assert.Equal(t, "grammarly_rocker_1_chart.yml", a.GetFileName())
+
+	assert.EqualError(t, Artifact{}.Validate(), "image name is missing")
+}
+
+func TestMergeArtifacts(t *testing.T) {
+	var (
+		t1 = time.Date(2016, 3, 1, 10, 0, 0, 0, time.UTC)
+		t2 = t1.Add(time.Hour)
+	)
+
+	merged := MergeArtifacts(
+		[]Artifact{
+			makeTestArtifact("grammarly/web:1", testDigest, t1),
+			makeTestArtifact("grammarly/api:1", testDigest, t1),
+		},
+		[]Artifact{
+			makeTestArtifact("grammarly/web:1", testDigest, t2),
+			makeTestArtifact("grammarly/web:1", strings.Replace(testDigest, "fafa", "baba", 1), t1),
+		},
+	)
+
+	assert.Len(t, merged, 3)
+	assert.Equal(t, "grammarly/api:1", merged[0].Name.String())
+	assert.Equal(t, "grammarly/web:1", merged[1].Name.String())
+	assert.Equal(t, "grammarly/web:1", merged[2].Name.String())
+	assert.Equal(t, t1, merged[1].BuildTime)
+	assert.Equal(t, t2, merged[2].BuildTime)
+	assert.Equal(t, testDigest, merged[2].Digest)
+}
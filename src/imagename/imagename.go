@@ -262,9 +262,45 @@ func (img ImageName) TagAsVersion() (ver *semver.Version) {
 	return
 }
 
-// IsSameKind returns true if current image and the given one are same but may have different versions (tags)
+// IsSameKind returns true if current image and the given one are same but may have different versions (tags);
+// the names are compared in the canonical form, so ubuntu and docker.io/library/ubuntu are the same kind
 func (img ImageName) IsSameKind(b ImageName) bool {
-	return img.Registry == b.Registry && img.Name == b.Name
+	return img.CanonicalName() == b.CanonicalName()
+}
+
+// CanonicalName returns the fully qualified registry/name of the image, e.g.
+// ubuntu, docker.io/ubuntu and index.docker.io/library/ubuntu are all docker.io/library/ubuntu
+func (img ImageName) CanonicalName() string {
+	if img.Storage == StorageS3 {
+		return img.NameWithRegistry()
+	}
+
+	registry, name := canonicalRegistry(img.Registry), img.Name
+
+	// Official images live in the library namespace of Docker Hub
+	if registry == DefaultRegistry && !strings.Contains(name, "/") {
+		name = "library/" + name
+	}
+
+	return registry + "/" + name
+}
+
+// Canonical returns the fully qualified name of the image with the tag,
+// e.g. docker.io/library/ubuntu:latest for ubuntu
+func (img ImageName) Canonical() string {
+	if img.TagIsDigest() {
+		return img.CanonicalName() + "@" + img.GetTag()
+	}
+	return img.CanonicalName() + ":" + img.GetTag()
+}
+
+// canonicalRegistry returns DefaultRegistry for all the names of Docker Hub
+func canonicalRegistry(registry string) string {
+	switch registry {
+	case "", "index.docker.io", "registry-1.docker.io":
+		return DefaultRegistry
+	}
+	return registry
 }
 
 // NameWithRegistry returns the [registry/]name of the current image name
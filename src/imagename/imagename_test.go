@@ -460,6 +460,46 @@ func TestImageIsSameKind(t *testing.T) {
 	assert.False(t, NewFromString("rocker-build").IsSameKind(*NewFromString("quay.io/grammarly/rocker-build")))
 }
 
+func TestImageIsSameKind_DockerHub(t *testing.T) {
+	assert.True(t, NewFromString("ubuntu").IsSameKind(*NewFromString("docker.io/library/ubuntu:latest")))
+	assert.True(t, NewFromString("ubuntu").IsSameKind(*NewFromString("library/ubuntu")))
+	assert.True(t, NewFromString("ubuntu").IsSameKind(*NewFromString("index.docker.io/ubuntu")))
+	assert.True(t, NewFromString("grammarly/rocker").IsSameKind(*NewFromString("docker.io/grammarly/rocker:1.0")))
+
+	assert.False(t, NewFromString("ubuntu").IsSameKind(*NewFromString("quay.io/library/ubuntu")))
+	assert.False(t, NewFromString("s3.amazonaws.com/bucket/ubuntu").IsSameKind(*NewFromString("ubuntu")))
+}
+
+func TestImageCanonical(t *testing.T) {
+	tests := map[string]string{
+		"ubuntu":                         "docker.io/library/ubuntu:latest",
+		"docker.io/library/ubuntu:14.04": "docker.io/library/ubuntu:14.04",
+		"registry-1.docker.io/grammarly/rocker:1": "docker.io/grammarly/rocker:1",
+		"quay.io/coreos/etcd:v2":                  "quay.io/coreos/etcd:v2",
+		"localhost:5000/app":                      "localhost:5000/app:latest",
+		"s3.amazonaws.com/bucket/app:1":           "s3.amazonaws.com/bucket/app:1",
+		"golang@sha256:ead434cd278824865d6e3b67e5d4579ded02eb2e8367fc165efa21138b225f11": "docker.io/library/golang@sha256:ead434cd278824865d6e3b67e5d4579ded02eb2e8367fc165efa21138b225f11",
+	}
+
+	for name, canonical := range tests {
+		assert.Equal(t, canonical, NewFromString(name).Canonical(), name)
+	}
+
+	// the name as written is kept for display
+	assert.Equal(t, "docker.io/library/ubuntu:latest", NewFromString("docker.io/library/ubuntu").String())
+	assert.Equal(t, "ubuntu:latest", NewFromString("ubuntu").String())
+}
+
+func TestImageResolveVersion_DockerHub(t *testing.T) {
+	img := NewFromString("docker.io/library/golang:1.5.*")
+	list := []*ImageName{
+		NewFromString("golang:1.5.1"),
+		NewFromString("golang:1.5.2"),
+		NewFromString("golang:1.6.0"),
+	}
+	assert.Equal(t, "golang:1.5.2", img.ResolveVersion(list, false).String())
+}
+
 func TestTagsGetOld(t *testing.T) {
 	tags := Tags{
 		Items: []*Tag{
@@ -0,0 +1,124 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package imagename
+
+import (
+	"fmt"
+	"strings"
+)
+
+// DefaultRegistry is the registry of the images that have no registry in the name
+const DefaultRegistry = "docker.io"
+
+// Mirrors maps the registries to the mirrors the images are pulled through,
+// e.g. docker.io -> mirror.internal; the mirror may have a path prefix,
+// e.g. quay.io -> mirror.internal/quay
+type Mirrors map[string]string
+
+// ParseMirrors parses the list of registry=mirror pairs
+func ParseMirrors(pairs []string) (Mirrors, error) {
+	mirrors := Mirrors{}
+	for _, pair := range pairs {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("Invalid registry mirror %q, expected registry=mirror", pair)
+		}
+		mirrors[parts[0]] = strings.TrimSuffix(parts[1], "/")
+	}
+	return mirrors, nil
+}
+
+// Merge returns the new mirrors map made of both, the ones given in the argument win
+func (m Mirrors) Merge(other Mirrors) Mirrors {
+	result := Mirrors{}
+	for registry, mirror := range m {
+		result[registry] = mirror
+	}
+	for registry, mirror := range other {
+		result[registry] = mirror
+	}
+	return result
+}
+
+// Rewrite returns the name of the image on the mirror of its registry;
+// the second value is false if there is no mirror for the image
+func (m Mirrors) Rewrite(img *ImageName) (*ImageName, bool) {
+	if img.Storage == StorageS3 {
+		return img, false
+	}
+
+	mirror, ok := m[canonicalRegistry(img.Registry)]
+	if !ok {
+		return img, false
+	}
+
+	// The canonical name has the library namespace for official images
+	name := strings.SplitN(img.CanonicalName(), "/", 2)[1]
+
+	parts := strings.SplitN(mirror, "/", 2)
+	if len(parts) == 2 {
+		name = parts[1] + "/" + name
+	}
+
+	result := *img
+	result.Registry = parts[0]
+	result.Name = name
+
+	return &result, true
+}
+
+// PushMirrors maps the registries to the other registries that every image
+// pushed to them is pushed to as well, e.g. quay.io -> hub.internal
+type PushMirrors map[string][]string
+
+// ParsePushMirrors parses the list of registry=mirror pairs, a registry
+// may be given several times to push to several mirrors
+func ParsePushMirrors(pairs []string) (PushMirrors, error) {
+	mirrors := PushMirrors{}
+	for _, pair := range pairs {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("Invalid push mirror %q, expected registry=mirror", pair)
+		}
+		mirrors[parts[0]] = append(mirrors[parts[0]], strings.TrimSuffix(parts[1], "/"))
+	}
+	return mirrors, nil
+}
+
+// Merge returns the new mirrors map made of both, the mirrors of a registry
+// given in the argument replace the ones of the same registry
+func (m PushMirrors) Merge(other PushMirrors) PushMirrors {
+	result := PushMirrors{}
+	for registry, mirrors := range m {
+		result[registry] = mirrors
+	}
+	for registry, mirrors := range other {
+		result[registry] = mirrors
+	}
+	return result
+}
+
+// Rewrite returns the names of the image on the mirrors of its registry
+func (m PushMirrors) Rewrite(img *ImageName) []*ImageName {
+	result := []*ImageName{}
+	for _, mirror := range m[canonicalRegistry(img.Registry)] {
+		if rewritten, ok := (Mirrors{canonicalRegistry(img.Registry): mirror}).Rewrite(img); ok {
+			result = append(result, rewritten)
+		}
+	}
+	return result
+}
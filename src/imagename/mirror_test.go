@@ -0,0 +1,83 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package imagename
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMirrors_Rewrite(t *testing.T) {
+	mirrors := Mirrors{
+		"docker.io": "mirror.internal",
+		"quay.io":   "mirror.internal/quay",
+	}
+
+	tests := []struct {
+		image     string
+		result    string
+		rewritten bool
+	}{
+		{"ubuntu", "mirror.internal/library/ubuntu:latest", true},
+		{"ubuntu:16.04", "mirror.internal/library/ubuntu:16.04", true},
+		{"grammarly/rsync-static:1", "mirror.internal/grammarly/rsync-static:1", true},
+		{"docker.io/library/debian:jessie", "mirror.internal/library/debian:jessie", true},
+		{"quay.io/coreos/etcd:v3.0.0", "mirror.internal/quay/coreos/etcd:v3.0.0", true},
+		{"golang@sha256:ead434cd278824865d6e3b67e5d4579ded02eb2e8367fc165efa21138b225f11", "mirror.internal/library/golang@sha256:ead434cd278824865d6e3b67e5d4579ded02eb2e8367fc165efa21138b225f11", true},
+		{"gcr.io/google_containers/pause:2.0", "gcr.io/google_containers/pause:2.0", false},
+		{"s3.amazonaws.com/bucket/app:1", "s3.amazonaws.com/bucket/app:1", false},
+	}
+
+	for _, test := range tests {
+		img, ok := mirrors.Rewrite(NewFromString(test.image))
+		assert.Equal(t, test.result, img.String(), "for %s", test.image)
+		assert.Equal(t, test.rewritten, ok, "for %s", test.image)
+	}
+}
+
+func TestParseMirrors(t *testing.T) {
+	mirrors, err := ParseMirrors([]string{"docker.io=mirror.internal/", "quay.io=mirror.internal/quay"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, Mirrors{"docker.io": "mirror.internal", "quay.io": "mirror.internal/quay"}, mirrors)
+
+	_, err = ParseMirrors([]string{"docker.io"})
+	assert.EqualError(t, err, "Invalid registry mirror \"docker.io\", expected registry=mirror")
+
+	merged := Mirrors{"docker.io": "a", "quay.io": "b"}.Merge(Mirrors{"docker.io": "c"})
+	assert.Equal(t, Mirrors{"docker.io": "c", "quay.io": "b"}, merged)
+}
+
+func TestPushMirrors(t *testing.T) {
+	mirrors, err := ParsePushMirrors([]string{"quay.io=hub.internal/", "quay.io=backup.internal/quay"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, PushMirrors{"quay.io": {"hub.internal", "backup.internal/quay"}}, mirrors)
+
+	names := []string{}
+	for _, img := range mirrors.Rewrite(NewFromString("quay.io/org/app:1")) {
+		names = append(names, img.String())
+	}
+	assert.Equal(t, []string{"hub.internal/org/app:1", "backup.internal/quay/org/app:1"}, names)
+	assert.Empty(t, mirrors.Rewrite(NewFromString("org/app:1")))
+
+	_, err = ParsePushMirrors([]string{"quay.io="})
+	assert.EqualError(t, err, "Invalid push mirror \"quay.io=\", expected registry=mirror")
+}
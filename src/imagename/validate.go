@@ -0,0 +1,105 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package imagename
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// The naming rules of the docker registry, see the reference grammar of
+// github.com/docker/distribution
+var (
+	hostRegexp      = regexp.MustCompile(`^(?:[a-zA-Z0-9]|[a-zA-Z0-9][a-zA-Z0-9-]*[a-zA-Z0-9])(?:\.(?:[a-zA-Z0-9]|[a-zA-Z0-9][a-zA-Z0-9-]*[a-zA-Z0-9]))*(?::[0-9]+)?$`)
+	componentRegexp = regexp.MustCompile(`^[a-z0-9]+(?:(?:[._]|__|[-]*)[a-z0-9]+)*$`)
+	tagRegexp       = regexp.MustCompile(`^[\w][\w.-]{0,127}$`)
+	digestRegexp    = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9]*(?:[-_+.][A-Za-z][A-Za-z0-9]*)*:[0-9a-fA-F]{32,}$`)
+)
+
+// maxNameLength is the limit of the repository name, including the registry
+const maxNameLength = 255
+
+// Validate checks the image reference, e.g. rendered by the template of
+// TAG or PUSH, against the naming rules of the registry, so an invalid name
+// is reported before the build rather than by the registry at the end of it
+func Validate(image string) error {
+	if strings.TrimSpace(image) == "" {
+		return fmt.Errorf("empty image name")
+	}
+	if strings.IndexFunc(image, isSpace) >= 0 {
+		return fmt.Errorf("image name %q contains whitespace", image)
+	}
+
+	name := image
+	reference := ""
+	if n := strings.Index(name, "@"); n >= 0 {
+		name, reference = name[:n], name[n+1:]
+		if !digestRegexp.MatchString(reference) {
+			return fmt.Errorf("invalid digest %q of image %q", reference, image)
+		}
+	} else if n := strings.LastIndex(name, ":"); n >= 0 && !strings.Contains(name[n+1:], "/") {
+		name, reference = name[:n], name[n+1:]
+		if !tagRegexp.MatchString(reference) {
+			return fmt.Errorf("invalid tag %q of image %q, the tag may contain letters, digits, _, . and - up to 128 characters and must not start with . or -", reference, image)
+		}
+	}
+
+	if len(name) > maxNameLength {
+		return fmt.Errorf("image name %q is longer than %d characters", name, maxNameLength)
+	}
+
+	path := name
+	for _, prefix := range []string{s3Prefix, s3OldPrefix} {
+		if strings.HasPrefix(path, prefix) {
+			path = strings.TrimPrefix(path, prefix)
+			if strings.Index(path, "/") <= 0 {
+				return fmt.Errorf("image name %q requires the bucket, e.g. %sbucket/image", image, s3Prefix)
+			}
+			break
+		}
+	}
+
+	components := strings.Split(path, "/")
+	if len(components) > 1 {
+		first := components[0]
+		if strings.ContainsAny(first, ".:") || first == "localhost" {
+			if !hostRegexp.MatchString(first) {
+				return fmt.Errorf("invalid registry %q of image %q", first, image)
+			}
+			components = components[1:]
+		}
+	}
+
+	for _, component := range components {
+		if component == "" {
+			return fmt.Errorf("image name %q has an empty path component", image)
+		}
+		if componentRegexp.MatchString(component) {
+			continue
+		}
+		if componentRegexp.MatchString(strings.ToLower(component)) {
+			return fmt.Errorf("repository name %q of image %q must be lowercase", name, image)
+		}
+		return fmt.Errorf("invalid repository name %q of image %q, the path components may contain lowercase letters, digits and the separators (., _, __, -)", name, image)
+	}
+
+	return nil
+}
+
+func isSpace(r rune) bool {
+	return r == ' ' || r == '\t' || r == '\n' || r == '\r'
+}
@@ -0,0 +1,59 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package imagename
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		image string
+		err   string
+	}{
+		{"app", ""},
+		{"grammarly/rocker:1.2.3", ""},
+		{"localhost:5000/app:latest", ""},
+		{"quay.io/coreos/etcd:v3.0.0", ""},
+		{"s3.amazonaws.com/my-bucket/app:1", ""},
+		{"s3:my-bucket/app:1", ""},
+		{"app@sha256:bc8813ea7b3603864987522f02a76101c17ad122e1c46d790efc0fca78ca7bfb", ""},
+		{"app_name/my__app:1", ""},
+		{"", "empty image name"},
+		{" ", "empty image name"},
+		{"app:1 2", "contains whitespace"},
+		{"app::1", "invalid repository name \"app:\""},
+		{"app:", "invalid tag \"\""},
+		{"app:.1", "invalid tag \".1\""},
+		{"Grammarly/App:1", "must be lowercase"},
+		{"grammarly//app", "empty path component"},
+		{"grammarly/app-:1", "invalid repository name"},
+		{"my_registry.io/app", "invalid registry \"my_registry.io\""},
+		{"app@sha256:123", "invalid digest"},
+		{"s3.amazonaws.com/app", "requires the bucket"},
+	}
+
+	for _, test := range tests {
+		err := Validate(test.image)
+		if test.err == "" {
+			assert.NoError(t, err, test.image)
+		} else if assert.Error(t, err, test.image) {
+			assert.Contains(t, err.Error(), test.err, test.image)
+		}
+	}
+}
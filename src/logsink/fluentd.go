@@ -0,0 +1,105 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package logsink
+
+import (
+	"encoding/json"
+	"net"
+	"time"
+
+	"github.com/grammarly/rocker/src/textformatter"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// DefaultFluentdTag is the tag of the fluentd events unless Options.FluentdTag is given
+const DefaultFluentdTag = "rocker"
+
+// fluentdDialTimeout limits connecting to fluentd
+var fluentdDialTimeout = 5 * time.Second
+
+// fluentdSink sends the entries to the fluentd forward input as the
+// [tag, time, record] JSON messages, which in_forward accepts along with
+// MessagePack; the connection is reopened once if a write fails
+type fluentdSink struct {
+	addr string
+	tag  string
+	conn net.Conn
+}
+
+func newFluentdSink(addr, tag string) (*fluentdSink, error) {
+	if tag == "" {
+		tag = DefaultFluentdTag
+	}
+	s := &fluentdSink{addr: addr, tag: tag}
+	if err := s.connect(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *fluentdSink) connect() (err error) {
+	s.conn, err = net.DialTimeout("tcp", s.addr, fluentdDialTimeout)
+	return err
+}
+
+func (s *fluentdSink) write(entry *logrus.Entry) error {
+	data, err := json.Marshal([]interface{}{s.tag, entry.Time.Unix(), fluentdRecord(entry)})
+	if err != nil {
+		return err
+	}
+
+	if s.conn != nil {
+		if _, err = s.conn.Write(data); err == nil {
+			return nil
+		}
+		s.conn.Close()
+	}
+
+	if err = s.connect(); err != nil {
+		s.conn = nil
+		return err
+	}
+	_, err = s.conn.Write(data)
+	return err
+}
+
+func (s *fluentdSink) close() error {
+	if s.conn == nil {
+		return nil
+	}
+	return s.conn.Close()
+}
+
+// fluentdRecord makes the record of the entry; like logrus.JSONFormatter
+// does, the errors are turned into strings, since they encode to {}
+func fluentdRecord(entry *logrus.Entry) map[string]interface{} {
+	record := map[string]interface{}{}
+	for k, v := range entry.Data {
+		if err, ok := v.(error); ok {
+			v = err.Error()
+		}
+		record[k] = v
+	}
+	record["level"] = entry.Level.String()
+	record["message"] = entry.Message
+	record["time"] = entry.Time.Format(time.RFC3339Nano)
+	if _, ok := record["elapsed"]; !ok {
+		record["elapsed"] = textformatter.Elapsed().Seconds()
+	}
+	return record
+}
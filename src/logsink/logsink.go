@@ -0,0 +1,188 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package logsink sends the logs of rocker, including the output of the
+// build containers, to the destinations other than stdout: a file, syslog
+// or fluentd
+package logsink
+
+import (
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/grammarly/rocker/src/build"
+	"github.com/grammarly/rocker/src/textformatter"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// Options are the sinks to send the logs to
+type Options struct {
+	// File is the file the logs are appended to
+	File string
+
+	// JSON writes the file as JSON lines rather than the plain text
+	JSON bool
+
+	// Syslog sends the logs to the local syslog daemon
+	Syslog bool
+
+	// Fluentd is the host:port of the fluentd forward input
+	Fluentd string
+
+	// FluentdTag is the tag of the fluentd events, DefaultFluentdTag if empty
+	FluentdTag string
+}
+
+// sink is a single log destination
+type sink interface {
+	write(entry *logrus.Entry) error
+	close() error
+}
+
+// Sinks is the logrus hook sending the log entries to the sinks; while a
+// build step is running the entries get its step and command fields
+type Sinks struct {
+	mu      sync.Mutex
+	sinks   []sink
+	step    int
+	command string
+}
+
+// New opens the sinks given by the options, nil is returned if there are none
+func New(opts Options) (s *Sinks, err error) {
+	s = &Sinks{}
+
+	if opts.File != "" {
+		var formatter logrus.Formatter = &textformatter.TextFormatter{DisableColors: true, FullTimestamp: true}
+		if opts.JSON {
+			formatter = textformatter.NewJSONFormatter()
+		}
+		f, err := os.OpenFile(opts.File, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to open log file %s, error: %s", opts.File, err)
+		}
+		s.sinks = append(s.sinks, &fileSink{f, formatter})
+	}
+
+	if opts.Syslog {
+		sink, err := newSyslogSink()
+		if err != nil {
+			s.Close()
+			return nil, fmt.Errorf("Failed to connect to syslog, error: %s", err)
+		}
+		s.sinks = append(s.sinks, sink)
+	}
+
+	if opts.Fluentd != "" {
+		sink, err := newFluentdSink(opts.Fluentd, opts.FluentdTag)
+		if err != nil {
+			s.Close()
+			return nil, fmt.Errorf("Failed to connect to fluentd %s, error: %s", opts.Fluentd, err)
+		}
+		s.sinks = append(s.sinks, sink)
+	}
+
+	if len(s.sinks) == 0 {
+		return nil, nil
+	}
+	return s, nil
+}
+
+// Levels implements logrus.Hook
+func (s *Sinks) Levels() []logrus.Level {
+	return []logrus.Level{
+		logrus.PanicLevel,
+		logrus.FatalLevel,
+		logrus.ErrorLevel,
+		logrus.WarnLevel,
+		logrus.InfoLevel,
+		logrus.DebugLevel,
+	}
+}
+
+// Fire implements logrus.Hook, it writes the entry to all the sinks;
+// a failed sink does not stop the others
+func (s *Sinks) Fire(entry *logrus.Entry) (err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.step > 0 {
+		data := logrus.Fields{"step": s.step, "command": s.command}
+		for k, v := range entry.Data {
+			data[k] = v
+		}
+		entry = &logrus.Entry{
+			Logger:  entry.Logger,
+			Data:    data,
+			Time:    entry.Time,
+			Level:   entry.Level,
+			Message: entry.Message,
+		}
+	}
+
+	for _, sink := range s.sinks {
+		if sinkErr := sink.write(entry); sinkErr != nil {
+			err = sinkErr
+		}
+	}
+	return err
+}
+
+// OnStep keeps track of the running build step, see build.Config.OnStep
+func (s *Sinks) OnStep(e build.StepEvent) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if e.Done {
+		s.step, s.command = 0, ""
+	} else {
+		s.step, s.command = e.Step, e.Command
+	}
+}
+
+// Close closes all the sinks
+func (s *Sinks) Close() (err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, sink := range s.sinks {
+		if closeErr := sink.close(); closeErr != nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// fileSink appends the formatted entries to a file
+type fileSink struct {
+	f         *os.File
+	formatter logrus.Formatter
+}
+
+func (s *fileSink) write(entry *logrus.Entry) error {
+	data, err := s.formatter.Format(entry)
+	if err != nil {
+		return err
+	}
+	_, err = s.f.Write(data)
+	return err
+}
+
+func (s *fileSink) close() error {
+	return s.f.Close()
+}
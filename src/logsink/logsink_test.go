@@ -0,0 +1,182 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package logsink
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/grammarly/rocker/src/build"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func makeTestLogger(sinks *Sinks) *logrus.Logger {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+	logger.Hooks.Add(sinks)
+	return logger
+}
+
+func TestNew_None(t *testing.T) {
+	sinks, err := New(Options{})
+	assert.NoError(t, err)
+	assert.Nil(t, sinks)
+}
+
+func TestFileSink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rocker-logsink")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fileName := filepath.Join(dir, "build.log")
+
+	sinks, err := New(Options{File: fileName})
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := makeTestLogger(sinks)
+
+	logger.Info("| Created container")
+	sinks.OnStep(build.StepEvent{Step: 2, Command: "RUN make"})
+	logger.WithField("stream", "stdout").Info("make: Nothing to be done")
+	sinks.OnStep(build.StepEvent{Step: 2, Command: "RUN make", Done: true})
+	logger.Info("Done")
+
+	if err := sinks.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Contains(t, string(data), "| Created container")
+	assert.Regexp(t, `make: Nothing to be done\s+command=RUN make step=2 stream=stdout`, string(data))
+	assert.NotContains(t, string(data), "\x1b[")
+	assert.Regexp(t, `Done\s*\n$`, string(data))
+}
+
+func TestFileSink_JSON(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rocker-logsink")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fileName := filepath.Join(dir, "build.log")
+
+	sinks, err := New(Options{File: fileName, JSON: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := makeTestLogger(sinks)
+
+	sinks.OnStep(build.StepEvent{Step: 3, Command: "TEST make test"})
+	logger.WithField("container", "0123456789ab").Warn("FAIL")
+	sinks.Close()
+
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	line := map[string]interface{}{}
+	if err := json.Unmarshal(data, &line); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, "FAIL", line["msg"])
+	assert.Equal(t, "warning", line["level"])
+	assert.Equal(t, "0123456789ab", line["container"])
+	assert.Equal(t, "TEST make test", line["command"])
+	assert.EqualValues(t, 3, line["step"])
+}
+
+func TestFluentdSink(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	messages := make(chan []interface{}, 2)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		decoder := json.NewDecoder(bufio.NewReader(conn))
+		for {
+			message := []interface{}{}
+			if err := decoder.Decode(&message); err != nil {
+				close(messages)
+				return
+			}
+			messages <- message
+		}
+	}()
+
+	sinks, err := New(Options{Fluentd: ln.Addr().String(), FluentdTag: "ci.rocker"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := makeTestLogger(sinks)
+
+	sinks.OnStep(build.StepEvent{Step: 1, Command: "FROM ubuntu"})
+	logger.WithField("error", fmt.Errorf("not found")).Error("Pull failed")
+	sinks.Close()
+
+	message := <-messages
+	if !assert.Len(t, message, 3) {
+		return
+	}
+
+	assert.Equal(t, "ci.rocker", message[0])
+	assert.IsType(t, float64(0), message[1])
+
+	record := message[2].(map[string]interface{})
+	assert.Equal(t, "Pull failed", record["message"])
+	assert.Equal(t, "error", record["level"])
+	assert.Equal(t, "not found", record["error"])
+	assert.Equal(t, "FROM ubuntu", record["command"])
+	assert.EqualValues(t, 1, record["step"])
+}
+
+func TestFluentdSink_NotListening(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	_, err = New(Options{Fluentd: addr})
+	assert.Error(t, err)
+}
@@ -0,0 +1,77 @@
+// +build !windows
+
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package logsink
+
+import (
+	"fmt"
+	"log/syslog"
+	"sort"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// syslogSink sends the entries to the local syslog daemon, the fields
+// follow the message as key=value pairs
+type syslogSink struct {
+	w *syslog.Writer
+}
+
+func newSyslogSink() (sink, error) {
+	w, err := syslog.New(syslog.LOG_INFO|syslog.LOG_USER, "rocker")
+	if err != nil {
+		return nil, err
+	}
+	return &syslogSink{w}, nil
+}
+
+func (s *syslogSink) write(entry *logrus.Entry) error {
+	line := syslogLine(entry)
+
+	switch entry.Level {
+	case logrus.PanicLevel, logrus.FatalLevel:
+		return s.w.Crit(line)
+	case logrus.ErrorLevel:
+		return s.w.Err(line)
+	case logrus.WarnLevel:
+		return s.w.Warning(line)
+	case logrus.DebugLevel:
+		return s.w.Debug(line)
+	default:
+		return s.w.Info(line)
+	}
+}
+
+func (s *syslogSink) close() error {
+	return s.w.Close()
+}
+
+func syslogLine(entry *logrus.Entry) string {
+	keys := []string{}
+	for k := range entry.Data {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	parts := []string{entry.Message}
+	for _, k := range keys {
+		parts = append(parts, fmt.Sprintf("%s=%q", k, fmt.Sprint(entry.Data[k])))
+	}
+	return strings.Join(parts, " ")
+}
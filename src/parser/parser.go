@@ -32,6 +32,19 @@ type Node struct {
 	Attributes map[string]bool // special attributes for this node
 	Original   string          // original line used before parsing
 	Flags      []string        // only top Node should have this set
+	StartLine  int             // the line in the original dockerfile where the node begins
+	EndLine    int             // the line in the original dockerfile where the node ends
+}
+
+// LineError is the parse error of the instruction that starts at the line
+type LineError struct {
+	Line int
+	Err  error
+}
+
+// Error returns the message of the underlying error
+func (e *LineError) Error() string {
+	return e.Err.Error()
 }
 
 var (
@@ -75,6 +88,19 @@ func init() {
 		"require": parseMaybeJSONToList,
 		"include": parseString,
 		"attach":  parseMaybeJSON,
+		"test":    parseMaybeJSON,
+		"smoke":   parseMaybeJSON,
+		"cache":   parseStringsWhitespaceDelimited,
+		"use":     parseString,
+		"only":    parseString,
+		"skip":    parseString,
+
+		"invalidate": parseString,
+		"artifact":   parseStringsWhitespaceDelimited,
+		"readvars":   parseString,
+
+		"envfile":   parseString,
+		"labelfile": parseString,
 		"var": func(cmd string) (*Node, map[string]bool, error) {
 			return parseNameVal(cmd, "VAR")
 		},
@@ -118,16 +144,21 @@ func parseLine(line string) (string, *Node, error) {
 func Parse(rwc io.Reader) (*Node, error) {
 	root := &Node{}
 	scanner := bufio.NewScanner(rwc)
+	currentLine := 0
 
 	for scanner.Scan() {
+		currentLine++
+		startLine := currentLine
+
 		scannedLine := strings.TrimLeftFunc(scanner.Text(), unicode.IsSpace)
 		line, child, err := parseLine(scannedLine)
 		if err != nil {
-			return nil, err
+			return nil, &LineError{startLine, err}
 		}
 
 		if line != "" && child == nil {
 			for scanner.Scan() {
+				currentLine++
 				newline := scanner.Text()
 
 				if stripComments(strings.TrimSpace(newline)) == "" {
@@ -136,7 +167,7 @@ func Parse(rwc io.Reader) (*Node, error) {
 
 				line, child, err = parseLine(line + newline)
 				if err != nil {
-					return nil, err
+					return nil, &LineError{startLine, err}
 				}
 
 				if child != nil {
@@ -146,12 +177,14 @@ func Parse(rwc io.Reader) (*Node, error) {
 			if child == nil && line != "" {
 				line, child, err = parseLine(line)
 				if err != nil {
-					return nil, err
+					return nil, &LineError{startLine, err}
 				}
 			}
 		}
 
 		if child != nil {
+			child.StartLine = startLine
+			child.EndLine = currentLine
 			root.Children = append(root.Children, child)
 		}
 	}
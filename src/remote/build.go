@@ -0,0 +1,129 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package remote
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+
+	"github.com/grammarly/rocker/src/build"
+	"github.com/grammarly/rocker/src/server"
+	"github.com/grammarly/rocker/src/template"
+
+	"github.com/docker/docker/pkg/archive"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Config describes the build to run on the remote builder
+type Config struct {
+	Builder       string
+	ContextDir    string
+	Dockerignore  []string
+	Request       server.BuildRequest
+	OutStream     io.Writer
+	ArtifactsPath string
+}
+
+// Build uploads the context, runs the build on the builder and streams its
+// output to OutStream; an interrupt cancels the remote build
+func Build(cfg Config) (job server.JobInfo, err error) {
+	conn, err := Dial(cfg.Builder)
+	if err != nil {
+		return job, err
+	}
+
+	client := NewClient(conn)
+	defer client.Close()
+
+	client.OnEvent = func(e server.WatchEvent) {
+		if e.Log != "" {
+			io.WriteString(cfg.OutStream, e.Log)
+		}
+	}
+
+	context, err := archive.TarWithOptions(cfg.ContextDir, &archive.TarOptions{
+		Compression:     archive.Gzip,
+		ExcludePatterns: cfg.Dockerignore,
+	})
+	if err != nil {
+		return job, fmt.Errorf("Failed to make tar of %s, error: %s", cfg.ContextDir, err)
+	}
+	defer context.Close()
+
+	log.Infof("Upload build context %s to %s", cfg.ContextDir, cfg.Builder)
+
+	uploadID, err := client.Upload(context)
+	if err != nil {
+		return job, err
+	}
+
+	if job, err = client.Submit(cfg.Request, uploadID); err != nil {
+		return job, err
+	}
+
+	log.Infof("Submitted build %s", job.ID)
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	defer func() {
+		signal.Stop(interrupt)
+		close(interrupt)
+	}()
+
+	// The goroutine takes its own copy of the ID, the job is overwritten by Watch
+	jobID := job.ID
+
+	go func() {
+		if _, ok := <-interrupt; ok {
+			log.Warnf("Interrupted, cancel build %s", jobID)
+			if _, err := client.Cancel(jobID); err != nil {
+				log.Errorf("Failed to cancel build %s, error: %s", jobID, err)
+			}
+		}
+	}()
+
+	if job, err = client.Watch(jobID, true); err != nil {
+		return job, err
+	}
+
+	if job.Status != server.StatusSucceeded {
+		if job.FailureSnapshot != "" {
+			log.Infof("The failed container is saved as %s on the builder", job.FailureSnapshot)
+		}
+		return job, fmt.Errorf("Remote build %s %s: %s", job.ID, job.Status, job.Error)
+	}
+
+	if cfg.ArtifactsPath != "" {
+		filePaths, err := build.WriteArtifacts(cfg.ArtifactsPath, job.Artifacts)
+		if err != nil {
+			return job, err
+		}
+		for _, filePath := range filePaths {
+			log.Infof("| Saved artifact file %s", filePath)
+		}
+	}
+
+	return job, nil
+}
+
+// RequestVars converts template vars to be sent to the builder
+func RequestVars(vars template.Vars) map[string]interface{} {
+	return vars.ToJSONMap()
+}
@@ -0,0 +1,216 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package remote runs builds on a remote builder, which is `rocker serve`
+// reachable either over a socket or through `kubectl exec` in a pod. The build
+// context is uploaded to the builder and the build output is streamed back,
+// so there is no need for a local docker daemon.
+package remote
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/grammarly/rocker/src/server"
+)
+
+// ChunkSize is the size of the context chunks sent to the builder
+var ChunkSize = 1024 * 1024
+
+// Client is the JSON-RPC client of the rocker build server
+type Client struct {
+	conn io.ReadWriteCloser
+
+	wmu sync.Mutex
+	enc *json.Encoder
+
+	mu      sync.Mutex
+	seq     int
+	pending map[int]chan response
+	err     error
+
+	// OnEvent is called for every Build.Event notification, should be set
+	// before any calls are made
+	OnEvent func(server.WatchEvent)
+}
+
+// response is either the response to a call or a notification
+type response struct {
+	ID     *int             `json:"id"`
+	Method string           `json:"method"`
+	Params json.RawMessage  `json:"params"`
+	Result json.RawMessage  `json:"result"`
+	Error  *server.RPCError `json:"error"`
+}
+
+// NewClient makes the client talking over the connection
+func NewClient(conn io.ReadWriteCloser) *Client {
+	c := &Client{
+		conn:    conn,
+		enc:     json.NewEncoder(conn),
+		pending: map[int]chan response{},
+	}
+	go c.read()
+	return c
+}
+
+// Close closes the connection
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+// Call calls the method and waits for the result; it is safe
+// to make calls from multiple goroutines
+func (c *Client) Call(method string, params, result interface{}) error {
+	c.mu.Lock()
+	if c.err != nil {
+		c.mu.Unlock()
+		return c.err
+	}
+	c.seq++
+	id := c.seq
+	wait := make(chan response, 1)
+	c.pending[id] = wait
+	c.mu.Unlock()
+
+	c.wmu.Lock()
+	err := c.enc.Encode(map[string]interface{}{
+		"jsonrpc": "2.0",
+		"id":      id,
+		"method":  method,
+		"params":  params,
+	})
+	c.wmu.Unlock()
+
+	if err != nil {
+		c.mu.Lock()
+		delete(c.pending, id)
+		c.mu.Unlock()
+		return fmt.Errorf("Failed to send %s to the builder, error: %s", method, err)
+	}
+
+	resp, ok := <-wait
+	if !ok {
+		return c.err
+	}
+	if resp.Error != nil {
+		return fmt.Errorf("%s", resp.Error.Message)
+	}
+	if result != nil && len(resp.Result) > 0 {
+		if err := json.Unmarshal(resp.Result, result); err != nil {
+			return fmt.Errorf("Failed to parse %s result, error: %s", method, err)
+		}
+	}
+	return nil
+}
+
+// Upload sends the build context tar stream to the builder, returns the upload id
+func (c *Client) Upload(r io.Reader) (string, error) {
+	var upload struct {
+		ID string `json:"upload"`
+	}
+	if err := c.Call("Context.Create", nil, &upload); err != nil {
+		return "", err
+	}
+
+	buf := make([]byte, ChunkSize)
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			params := map[string]interface{}{"upload": upload.ID, "data": buf[:n]}
+			if err := c.Call("Context.Write", params, nil); err != nil {
+				return "", err
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return "", fmt.Errorf("Failed to read build context, error: %s", err)
+		}
+	}
+
+	return upload.ID, nil
+}
+
+// Submit queues the build with the uploaded context
+func (c *Client) Submit(req server.BuildRequest, uploadID string) (job server.JobInfo, err error) {
+	params := map[string]interface{}{"request": req, "upload": uploadID}
+	err = c.Call("Build.Submit", params, &job)
+	return job, err
+}
+
+// Watch waits until the build is finished, passing its events to OnEvent
+func (c *Client) Watch(id string, logs bool) (job server.JobInfo, err error) {
+	params := map[string]interface{}{"id": id, "logs": logs}
+	err = c.Call("Build.Watch", params, &job)
+	return job, err
+}
+
+// Cancel cancels the build
+func (c *Client) Cancel(id string) (job server.JobInfo, err error) {
+	err = c.Call("Build.Cancel", map[string]string{"id": id}, &job)
+	return job, err
+}
+
+// read dispatches the responses and notifications until the connection is closed
+func (c *Client) read() {
+	dec := json.NewDecoder(c.conn)
+
+	for {
+		resp := response{}
+		if err := dec.Decode(&resp); err != nil {
+			if err == io.EOF {
+				err = fmt.Errorf("Connection to the builder is closed")
+			}
+			c.fail(err)
+			return
+		}
+
+		if resp.ID == nil {
+			if resp.Method == "Build.Event" && c.OnEvent != nil {
+				event := server.WatchEvent{}
+				if err := json.Unmarshal(resp.Params, &event); err == nil {
+					c.OnEvent(event)
+				}
+			}
+			continue
+		}
+
+		c.mu.Lock()
+		wait, ok := c.pending[*resp.ID]
+		delete(c.pending, *resp.ID)
+		c.mu.Unlock()
+
+		if ok {
+			wait <- resp
+		}
+	}
+}
+
+// fail makes all the pending and further calls fail with err
+func (c *Client) fail(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.err = err
+	for id, wait := range c.pending {
+		close(wait)
+		delete(c.pending, id)
+	}
+}
@@ -0,0 +1,155 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package remote
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+var (
+	// Kubectl is the kubectl binary used for k8s:// builders
+	Kubectl = "kubectl"
+
+	// ServeCommand is the command that runs the build server within the builder pod
+	ServeCommand = []string{"rocker", "serve", "--listen", "stdio://"}
+)
+
+// Dial connects to the builder, which is one of:
+//
+//	tcp://host:port, unix:///path/to.sock - `rocker serve` listening there
+//	k8s://namespace/selector - the first running pod matching the label
+//	    selector, `rocker serve` is started there through `kubectl exec`;
+//	    ?container=NAME&context=KUBECONTEXT are optional
+func Dial(builder string) (io.ReadWriteCloser, error) {
+	u, err := url.Parse(builder)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse builder %s, error: %s", builder, err)
+	}
+
+	switch u.Scheme {
+	case "tcp":
+		return net.Dial("tcp", u.Host)
+	case "unix":
+		return net.Dial("unix", u.Path)
+	case "k8s":
+		return dialK8s(u)
+	}
+
+	return nil, fmt.Errorf("Unsupported builder %s, should be either tcp://, unix:// or k8s://", builder)
+}
+
+// dialK8s finds the builder pod and runs the build server there
+func dialK8s(u *url.URL) (io.ReadWriteCloser, error) {
+	if u.Host == "" || strings.Trim(u.Path, "/") == "" {
+		return nil, fmt.Errorf("k8s builder should be specified as k8s://namespace/selector, got %s", u)
+	}
+
+	var out bytes.Buffer
+
+	cmd := exec.Command(Kubectl, k8sFindPodArgs(u)...)
+	cmd.Stdout = &out
+	cmd.Stderr = os.Stderr
+
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("Failed to find builder pod for %s, error: %s", u, err)
+	}
+
+	pods := strings.Fields(out.String())
+	if len(pods) == 0 {
+		return nil, fmt.Errorf("No running builder pods found for %s", u)
+	}
+
+	log.Infof("Using builder pod %s/%s", u.Host, pods[0])
+
+	return startCmd(exec.Command(Kubectl, k8sExecArgs(u, pods[0])...))
+}
+
+// k8sFindPodArgs returns kubectl args listing the running pods of the builder
+func k8sFindPodArgs(u *url.URL) []string {
+	args := k8sGlobalArgs(u)
+	return append(args,
+		"get", "pods",
+		"--selector", strings.Trim(u.Path, "/"),
+		"--field-selector", "status.phase=Running",
+		"--output", "jsonpath={.items[*].metadata.name}",
+	)
+}
+
+// k8sExecArgs returns kubectl args starting the build server in the pod
+func k8sExecArgs(u *url.URL, pod string) []string {
+	args := append(k8sGlobalArgs(u), "exec", "-i", pod)
+	if container := u.Query().Get("container"); container != "" {
+		args = append(args, "--container", container)
+	}
+	return append(append(args, "--"), ServeCommand...)
+}
+
+// k8sGlobalArgs returns kubectl args selecting the namespace and context
+func k8sGlobalArgs(u *url.URL) []string {
+	args := []string{"--namespace", u.Host}
+	if context := u.Query().Get("context"); context != "" {
+		args = append(args, "--context", context)
+	}
+	return args
+}
+
+// cmdConn is the connection over the stdin and stdout of a process
+type cmdConn struct {
+	cmd *exec.Cmd
+	io.Reader
+	io.WriteCloser
+}
+
+// startCmd starts the process and returns the connection to it
+func startCmd(cmd *exec.Cmd) (io.ReadWriteCloser, error) {
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	// The build output comes over the connection, the server log is needed only for debugging
+	if log.StandardLogger().Level >= log.DebugLevel {
+		cmd.Stderr = os.Stderr
+	}
+
+	log.Debugf("Run %s", strings.Join(cmd.Args, " "))
+
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("Failed to run %s, error: %s", cmd.Path, err)
+	}
+
+	return &cmdConn{cmd: cmd, Reader: stdout, WriteCloser: stdin}, nil
+}
+
+// Close closes stdin, so the server exits, and waits for the process
+func (c *cmdConn) Close() error {
+	c.WriteCloser.Close()
+	return c.cmd.Wait()
+}
@@ -0,0 +1,143 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package remote
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"net/url"
+	"testing"
+
+	"github.com/grammarly/rocker/src/server"
+	"github.com/grammarly/rocker/src/template"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestK8sArgs(t *testing.T) {
+	u, err := url.Parse("k8s://builders/app=rocker,tier=ci?container=rocker&context=prod")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, []string{
+		"--namespace", "builders", "--context", "prod",
+		"get", "pods",
+		"--selector", "app=rocker,tier=ci",
+		"--field-selector", "status.phase=Running",
+		"--output", "jsonpath={.items[*].metadata.name}",
+	}, k8sFindPodArgs(u))
+
+	assert.Equal(t, []string{
+		"--namespace", "builders", "--context", "prod",
+		"exec", "-i", "rocker-0", "--container", "rocker",
+		"--", "rocker", "serve", "--listen", "stdio://",
+	}, k8sExecArgs(u, "rocker-0"))
+}
+
+func TestDial_Invalid(t *testing.T) {
+	_, err := Dial("k8s://builders")
+	assert.Contains(t, err.Error(), "k8s://namespace/selector")
+
+	_, err = Dial("http://localhost")
+	assert.Contains(t, err.Error(), "Unsupported builder")
+}
+
+func TestRequestVars(t *testing.T) {
+	vars := template.Vars{
+		"Name": "app",
+		"Env":  map[interface{}]interface{}{"port": 80, "hosts": []interface{}{map[interface{}]interface{}{"a": 1}}},
+	}
+
+	data, err := json.Marshal(RequestVars(vars))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, `{"Env":{"hosts":[{"a":1}],"port":80},"Name":"app"}`, string(data))
+}
+
+func TestClient_UploadAndWatch(t *testing.T) {
+	defer func(size int) { ChunkSize = size }(ChunkSize)
+	ChunkSize = 4
+
+	clientConn, serverConn := net.Pipe()
+
+	var uploaded bytes.Buffer
+
+	// Fake builder answering the calls the way `rocker serve` does
+	go func() {
+		dec := json.NewDecoder(serverConn)
+		enc := json.NewEncoder(serverConn)
+		for {
+			var req struct {
+				ID     int `json:"id"`
+				Method string
+				Params struct {
+					Data []byte `json:"data"`
+					ID   string `json:"id"`
+				}
+			}
+			if err := dec.Decode(&req); err != nil {
+				return
+			}
+
+			var result interface{} = struct{}{}
+
+			switch req.Method {
+			case "Context.Create":
+				result = map[string]string{"upload": "u1"}
+			case "Context.Write":
+				uploaded.Write(req.Params.Data)
+			case "Build.Watch":
+				enc.Encode(map[string]interface{}{
+					"jsonrpc": "2.0",
+					"method":  "Build.Event",
+					"params":  server.WatchEvent{ID: req.Params.ID, Log: "Step 1\n"},
+				})
+				result = server.JobInfo{ID: req.Params.ID, Status: server.StatusSucceeded}
+			}
+
+			enc.Encode(map[string]interface{}{"jsonrpc": "2.0", "id": req.ID, "result": result})
+		}
+	}()
+
+	c := NewClient(clientConn)
+	defer c.Close()
+
+	var output bytes.Buffer
+	c.OnEvent = func(e server.WatchEvent) { output.WriteString(e.Log) }
+
+	id, err := c.Upload(bytes.NewBufferString("0123456789"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "u1", id)
+	assert.Equal(t, "0123456789", uploaded.String())
+
+	job, err := c.Watch("b1", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, server.StatusSucceeded, job.Status)
+	assert.Equal(t, "Step 1\n", output.String())
+
+	serverConn.Close()
+
+	_, err = c.Cancel("b1")
+	assert.Error(t, err)
+}
@@ -0,0 +1,302 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package selfupdate implements updating of the rocker binary from the
+// published releases. Releases are listed in the GitHub releases API format;
+// every binary tarball is accompanied by a ".sha256" file that is verified
+// before the current executable is replaced.
+package selfupdate
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	// ChannelStable includes only final releases
+	ChannelStable = "stable"
+
+	// ChannelEdge includes pre-releases as well
+	ChannelEdge = "edge"
+)
+
+var (
+	// DefaultURL is the releases list of the rocker GitHub repository
+	DefaultURL = "https://api.github.com/repos/grammarly/rocker/releases"
+
+	// BinaryName is the name of the binary within release tarballs
+	BinaryName = "rocker"
+)
+
+// Release is a release entity of the GitHub releases API
+type Release struct {
+	TagName    string  `json:"tag_name"`
+	Prerelease bool    `json:"prerelease"`
+	Draft      bool    `json:"draft"`
+	Assets     []Asset `json:"assets"`
+}
+
+// Asset is a file attached to a Release
+type Asset struct {
+	Name string `json:"name"`
+	URL  string `json:"browser_download_url"`
+}
+
+// Config specifies where to look for updates and what to replace
+type Config struct {
+	URL            string
+	Channel        string
+	CurrentVersion string
+	Executable     string
+	Force          bool
+	Client         *http.Client
+}
+
+// Updater checks for the new releases and replaces the executable
+type Updater struct {
+	cfg Config
+}
+
+// New makes a new Updater, filling in the defaults of the config
+func New(cfg Config) (*Updater, error) {
+	if cfg.URL == "" {
+		cfg.URL = DefaultURL
+	}
+	if cfg.Channel == "" {
+		cfg.Channel = ChannelStable
+	}
+	if cfg.Channel != ChannelStable && cfg.Channel != ChannelEdge {
+		return nil, fmt.Errorf("Unknown update channel %q, should be either %s or %s", cfg.Channel, ChannelStable, ChannelEdge)
+	}
+	if cfg.Client == nil {
+		cfg.Client = http.DefaultClient
+	}
+	if cfg.Executable == "" {
+		exe, err := os.Executable()
+		if err != nil {
+			return nil, fmt.Errorf("Failed to find the current executable, error: %s", err)
+		}
+		if cfg.Executable, err = filepath.EvalSymlinks(exe); err != nil {
+			return nil, fmt.Errorf("Failed to resolve the current executable %s, error: %s", exe, err)
+		}
+	}
+	return &Updater{cfg: cfg}, nil
+}
+
+// AssetName returns the name of the release tarball for the current platform
+func AssetName(version string) string {
+	return fmt.Sprintf("%s-%s-%s_%s.tar.gz", BinaryName, version, runtime.GOOS, runtime.GOARCH)
+}
+
+// Latest returns the most recent release of the configured channel
+func (u *Updater) Latest() (*Release, error) {
+	body, err := u.get(u.cfg.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	releases := []Release{}
+	if err := json.Unmarshal(body, &releases); err != nil {
+		return nil, fmt.Errorf("Failed to parse releases list from %s, error: %s", u.cfg.URL, err)
+	}
+
+	// Releases are listed starting from the newest one
+	for _, r := range releases {
+		if r.Draft || (r.Prerelease && u.cfg.Channel != ChannelEdge) {
+			continue
+		}
+		return &r, nil
+	}
+
+	return nil, fmt.Errorf("No releases found in the %s channel at %s", u.cfg.Channel, u.cfg.URL)
+}
+
+// Update installs the latest release of the configured channel in place
+// of the current executable; returns the installed version or an empty
+// string if the current version is the latest one
+func (u *Updater) Update() (version string, err error) {
+	release, err := u.Latest()
+	if err != nil {
+		return "", err
+	}
+
+	if release.TagName == u.cfg.CurrentVersion && !u.cfg.Force {
+		log.Infof("Already up to date, version %s (%s channel)", release.TagName, u.cfg.Channel)
+		return "", nil
+	}
+
+	var (
+		name     = AssetName(release.TagName)
+		tarball  = release.findAsset(name)
+		checksum = release.findAsset(name + ".sha256")
+	)
+
+	if tarball == nil {
+		return "", fmt.Errorf("Release %s has no binary %s for the current platform", release.TagName, name)
+	}
+	if checksum == nil {
+		return "", fmt.Errorf("Release %s has no checksum %s.sha256, refuse to update", release.TagName, name)
+	}
+
+	log.Infof("Download %s", tarball.URL)
+
+	data, err := u.get(tarball.URL)
+	if err != nil {
+		return "", err
+	}
+
+	sumData, err := u.get(checksum.URL)
+	if err != nil {
+		return "", err
+	}
+
+	if err := verifyChecksum(data, sumData); err != nil {
+		return "", fmt.Errorf("Failed to verify %s, error: %s", name, err)
+	}
+
+	log.Infof("| Checksum verified")
+
+	binary, err := extractBinary(data)
+	if err != nil {
+		return "", fmt.Errorf("Failed to extract %s from %s, error: %s", BinaryName, name, err)
+	}
+
+	if err := replaceExecutable(u.cfg.Executable, binary); err != nil {
+		return "", err
+	}
+
+	log.Infof("| Replaced %s", u.cfg.Executable)
+
+	return release.TagName, nil
+}
+
+// get fetches the content of the url
+func (u *Updater) get(url string) ([]byte, error) {
+	resp, err := u.cfg.Client.Get(url)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to fetch %s, error: %s", url, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Failed to fetch %s, status: %s", url, resp.Status)
+	}
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read %s, error: %s", url, err)
+	}
+
+	return data, nil
+}
+
+// findAsset returns the asset of the release by name
+func (r *Release) findAsset(name string) *Asset {
+	for i := range r.Assets {
+		if r.Assets[i].Name == name {
+			return &r.Assets[i]
+		}
+	}
+	return nil
+}
+
+// verifyChecksum checks data against the "sha256sum" formatted checksum
+func verifyChecksum(data, sumData []byte) error {
+	fields := strings.Fields(string(sumData))
+	if len(fields) == 0 {
+		return fmt.Errorf("empty checksum file")
+	}
+
+	expected := strings.ToLower(fields[0])
+	sum := sha256.Sum256(data)
+	actual := hex.EncodeToString(sum[:])
+
+	if expected != actual {
+		return fmt.Errorf("sha256 mismatch, expected %s, got %s", expected, actual)
+	}
+	return nil
+}
+
+// extractBinary finds the binary within the gzipped tarball
+func extractBinary(data []byte) ([]byte, error) {
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer gz.Close()
+
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if hdr.Typeflag == tar.TypeReg && filepath.Base(hdr.Name) == BinaryName {
+			return ioutil.ReadAll(tr)
+		}
+	}
+
+	return nil, fmt.Errorf("binary not found in the archive")
+}
+
+// replaceExecutable writes the binary next to the executable and then
+// renames it over, so the replacement is atomic
+func replaceExecutable(executable string, binary []byte) error {
+	info, err := os.Stat(executable)
+	if err != nil {
+		return err
+	}
+
+	tmpf, err := ioutil.TempFile(filepath.Dir(executable), "."+filepath.Base(executable)+"_update_")
+	if err != nil {
+		return fmt.Errorf("Failed to create temporary file next to %s, error: %s", executable, err)
+	}
+	defer os.Remove(tmpf.Name())
+
+	if _, err := tmpf.Write(binary); err != nil {
+		tmpf.Close()
+		return fmt.Errorf("Failed to write %s, error: %s", tmpf.Name(), err)
+	}
+	if err := tmpf.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmpf.Name(), info.Mode()|0111); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmpf.Name(), executable); err != nil {
+		return fmt.Errorf("Failed to replace %s, error: %s", executable, err)
+	}
+
+	return nil
+}
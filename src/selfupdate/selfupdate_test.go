@@ -0,0 +1,199 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package selfupdate
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func makeTarball(t *testing.T, content string) []byte {
+	buf := &bytes.Buffer{}
+	gz := gzip.NewWriter(buf)
+	tw := tar.NewWriter(gz)
+	if err := tw.WriteHeader(&tar.Header{Name: BinaryName, Mode: 0755, Size: int64(len(content)), Typeflag: tar.TypeReg}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tw.Write([]byte(content)); err != nil {
+		t.Fatal(err)
+	}
+	tw.Close()
+	gz.Close()
+	return buf.Bytes()
+}
+
+// makeServer serves two releases: the stable 1.0.0 and the pre-release 1.1.0-rc1
+func makeServer(t *testing.T, checksum func(data []byte) string) *httptest.Server {
+	files := map[string][]byte{}
+
+	mux := http.NewServeMux()
+	server := httptest.NewServer(mux)
+
+	releases := []Release{}
+	for _, r := range []struct {
+		version    string
+		prerelease bool
+	}{{"1.1.0-rc1", true}, {"1.0.0", false}} {
+		name := AssetName(r.version)
+		data := makeTarball(t, "binary "+r.version)
+		files["/"+name] = data
+		files["/"+name+".sha256"] = []byte(checksum(data) + "  " + name + "\n")
+
+		releases = append(releases, Release{
+			TagName:    r.version,
+			Prerelease: r.prerelease,
+			Assets: []Asset{
+				{Name: name, URL: server.URL + "/" + name},
+				{Name: name + ".sha256", URL: server.URL + "/" + name + ".sha256"},
+			},
+		})
+	}
+
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/releases" {
+			json.NewEncoder(w).Encode(releases)
+			return
+		}
+		if data, ok := files[r.URL.Path]; ok {
+			w.Write(data)
+			return
+		}
+		http.NotFound(w, r)
+	})
+
+	return server
+}
+
+func sha256sum(data []byte) string {
+	return fmt.Sprintf("%x", sha256.Sum256(data))
+}
+
+func makeExecutable(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "rocker-selfupdate-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	exe := filepath.Join(dir, "rocker")
+	if err := ioutil.WriteFile(exe, []byte("old binary"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return exe
+}
+
+func TestSelfUpdate_Stable(t *testing.T) {
+	server := makeServer(t, sha256sum)
+	defer server.Close()
+
+	exe := makeExecutable(t)
+	defer os.RemoveAll(filepath.Dir(exe))
+
+	u, err := New(Config{URL: server.URL + "/releases", CurrentVersion: "0.9.0", Executable: exe})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	version, err := u.Update()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, "1.0.0", version)
+
+	content, _ := ioutil.ReadFile(exe)
+	assert.Equal(t, "binary 1.0.0", string(content))
+}
+
+func TestSelfUpdate_Edge(t *testing.T) {
+	server := makeServer(t, sha256sum)
+	defer server.Close()
+
+	exe := makeExecutable(t)
+	defer os.RemoveAll(filepath.Dir(exe))
+
+	u, err := New(Config{URL: server.URL + "/releases", Channel: ChannelEdge, CurrentVersion: "1.0.0", Executable: exe})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	version, err := u.Update()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, "1.1.0-rc1", version)
+}
+
+func TestSelfUpdate_UpToDate(t *testing.T) {
+	server := makeServer(t, sha256sum)
+	defer server.Close()
+
+	exe := makeExecutable(t)
+	defer os.RemoveAll(filepath.Dir(exe))
+
+	u, err := New(Config{URL: server.URL + "/releases", CurrentVersion: "1.0.0", Executable: exe})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	version, err := u.Update()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, "", version)
+
+	content, _ := ioutil.ReadFile(exe)
+	assert.Equal(t, "old binary", string(content))
+}
+
+func TestSelfUpdate_ChecksumMismatch(t *testing.T) {
+	server := makeServer(t, func(data []byte) string {
+		return sha256sum([]byte("something else"))
+	})
+	defer server.Close()
+
+	exe := makeExecutable(t)
+	defer os.RemoveAll(filepath.Dir(exe))
+
+	u, err := New(Config{URL: server.URL + "/releases", CurrentVersion: "0.9.0", Executable: exe})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = u.Update()
+	assert.Contains(t, err.Error(), "sha256 mismatch")
+
+	content, _ := ioutil.ReadFile(exe)
+	assert.Equal(t, "old binary", string(content))
+}
+
+func TestSelfUpdate_UnknownChannel(t *testing.T) {
+	_, err := New(Config{Channel: "nightly", Executable: "/bin/rocker"})
+	assert.EqualError(t, err, `Unknown update channel "nightly", should be either stable or edge`)
+}
@@ -0,0 +1,243 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/docker/docker/pkg/archive"
+	"github.com/gorilla/mux"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Handler returns the HTTP API of the server:
+//
+//   POST   /builds             submit a build, the body is the context tarball
+//                              unless ?git=URL is given
+//   GET    /builds             list builds
+//   GET    /builds/{id}        get build status
+//   GET    /builds/{id}/logs   stream build output until it is finished
+//   DELETE /builds/{id}        cancel build
+//
+// Build options are passed as query parameters: file, var, build-arg (the
+// last two can be repeated, KEY=VALUE), git, ref, push, no-cache, pull, auto-batch,
+// strict, record-build-args, record-build-arg-value (can be repeated).
+func (s *Server) Handler() http.Handler {
+	r := mux.NewRouter()
+	r.HandleFunc("/builds", s.handleSubmit).Methods("POST")
+	r.HandleFunc("/builds", s.handleList).Methods("GET")
+	r.HandleFunc("/builds/{id}", s.handleGet).Methods("GET")
+	r.HandleFunc("/builds/{id}/logs", s.handleLogs).Methods("GET")
+	r.HandleFunc("/builds/{id}", s.handleCancel).Methods("DELETE")
+	return r
+}
+
+// ListenAndServe starts the worker and serves the HTTP API on addr
+func (s *Server) ListenAndServe(addr string) error {
+	s.Start()
+	log.Infof("Listening on %s", addr)
+	return http.ListenAndServe(addr, s.Handler())
+}
+
+func (s *Server) handleSubmit(w http.ResponseWriter, r *http.Request) {
+	req, err := parseBuildRequest(r)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := validateRequest(req); err != nil {
+		httpError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	dir, err := s.NewContextDir()
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if req.GitURL == "" {
+		if err := archive.Untar(r.Body, dir, &archive.TarOptions{NoLchown: true}); err != nil {
+			os.RemoveAll(dir)
+			httpError(w, http.StatusBadRequest, fmt.Errorf("Failed to extract build context, error: %s", err))
+			return
+		}
+	}
+
+	job, err := s.Submit(req, dir)
+	if err != nil {
+		os.RemoveAll(dir)
+		httpError(w, http.StatusServiceUnavailable, err)
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, job)
+}
+
+func (s *Server) handleList(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.List())
+}
+
+func (s *Server) handleGet(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	job, ok := s.Get(id)
+	if !ok {
+		httpError(w, http.StatusNotFound, fmt.Errorf("Build %s not found", id))
+		return
+	}
+	writeJSON(w, http.StatusOK, job)
+}
+
+func (s *Server) handleCancel(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	if _, ok := s.Get(id); !ok {
+		httpError(w, http.StatusNotFound, fmt.Errorf("Build %s not found", id))
+		return
+	}
+	job, err := s.Cancel(id)
+	if err != nil {
+		httpError(w, http.StatusConflict, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, job)
+}
+
+func (s *Server) handleLogs(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	jobLog, ok := s.logs(id)
+	if !ok {
+		httpError(w, http.StatusNotFound, fmt.Errorf("Build %s not found", id))
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+
+	flusher, _ := w.(http.Flusher)
+	offset := 0
+
+	for {
+		data, _, wait, closed := jobLog.since(offset, -1)
+		if len(data) > 0 {
+			if _, err := w.Write(data); err != nil {
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+			offset += len(data)
+		}
+		if closed {
+			return
+		}
+		select {
+		case <-wait:
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// parseBuildRequest reads the build options from the query parameters
+func parseBuildRequest(r *http.Request) (req BuildRequest, err error) {
+	q := r.URL.Query()
+
+	req = BuildRequest{
+		File:   q.Get("file"),
+		GitURL: q.Get("git"),
+		GitRef: q.Get("ref"),
+
+		SnapshotOnFailure: q.Get("snapshot-on-failure"),
+	}
+	if req.File == "" {
+		req.File = "Rockerfile"
+	}
+
+	vars, err := parseKeyValues(q["var"])
+	if err != nil {
+		return req, err
+	}
+	for k, v := range vars {
+		if req.Vars == nil {
+			req.Vars = map[string]interface{}{}
+		}
+		req.Vars[k] = v
+	}
+	if req.BuildArgs, err = parseKeyValues(q["build-arg"]); err != nil {
+		return req, err
+	}
+	req.RecordBuildArgValues = q["record-build-arg-value"]
+
+	flags := map[string]*bool{
+		"push":       &req.Push,
+		"no-cache":   &req.NoCache,
+		"pull":       &req.Pull,
+		"auto-batch": &req.AutoBatch,
+		"strict":     &req.Strict,
+
+		"record-build-args": &req.RecordBuildArgs,
+		"record-vars":       &req.RecordVars,
+		"skip-noop-commits": &req.SkipNoopCommits,
+		"dedupe-copy":       &req.DedupeCopy,
+		"no-reuse":          &req.NoReuse,
+		"args-file-mount":   &req.ArgsFileMount,
+		"fail-on-secrets":   &req.FailOnSecrets,
+	}
+	for name, dest := range flags {
+		if v := q.Get(name); v != "" {
+			if *dest, err = strconv.ParseBool(v); err != nil {
+				return req, fmt.Errorf("Wrong value of %s parameter: %q", name, v)
+			}
+		}
+	}
+
+	return req, nil
+}
+
+// parseKeyValues turns the list of KEY=VALUE strings into a map
+func parseKeyValues(pairs []string) (map[string]string, error) {
+	if len(pairs) == 0 {
+		return nil, nil
+	}
+	result := map[string]string{}
+	for _, pair := range pairs {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, fmt.Errorf("Wrong KEY=VALUE pair: %q", pair)
+		}
+		result[kv[0]] = kv[1]
+	}
+	return result, nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Errorf("Failed to write response, error: %s", err)
+	}
+}
+
+func httpError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
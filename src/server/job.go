@@ -0,0 +1,240 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/grammarly/rocker/src/build"
+	"github.com/grammarly/rocker/src/imagename"
+	"github.com/grammarly/rocker/src/template"
+)
+
+// Status is the state of a build job
+type Status string
+
+// Build job statuses
+const (
+	StatusQueued    Status = "queued"
+	StatusRunning   Status = "running"
+	StatusSucceeded Status = "succeeded"
+	StatusFailed    Status = "failed"
+	StatusCancelled Status = "cancelled"
+)
+
+// Done returns true if the job has finished one way or another
+func (s Status) Done() bool {
+	return s == StatusSucceeded || s == StatusFailed || s == StatusCancelled
+}
+
+// BuildRequest describes the build submitted to the server;
+// the context is either uploaded as a tarball or cloned from GitURL
+type BuildRequest struct {
+	File string `json:"file"`
+
+	// Source is the Rockerfile content, if given File is used only as its name
+	Source string `json:"source,omitempty"`
+
+	Vars      map[string]interface{} `json:"vars,omitempty"`
+	BuildArgs map[string]string      `json:"build_args,omitempty"`
+	GitURL    string                 `json:"git_url,omitempty"`
+	GitRef    string                 `json:"git_ref,omitempty"`
+	Push      bool                   `json:"push"`
+	NoCache   bool                   `json:"no_cache"`
+	Pull      bool                   `json:"pull"`
+	AutoBatch bool                   `json:"auto_batch"`
+	Strict    bool                   `json:"strict"`
+
+	SkipNoopCommits   bool   `json:"skip_noop_commits"`
+	DedupeCopy        bool   `json:"dedupe_copy"`
+	NoReuse           bool   `json:"no_reuse"`
+	ArgsFileMount     bool   `json:"args_file_mount"`
+	FailOnSecrets     bool   `json:"fail_on_secrets"`
+	SnapshotOnFailure string `json:"snapshot_on_failure,omitempty"`
+
+	RecordBuildArgs      bool     `json:"record_build_args"`
+	RecordBuildArgValues []string `json:"record_build_arg_values,omitempty"`
+	RecordVars           bool     `json:"record_vars"`
+}
+
+// templateVars returns the request vars for the Rockerfile template;
+// RockerArtifacts lose their type on the wire, so they are restored here
+func (r BuildRequest) templateVars() (template.Vars, error) {
+	vars := template.Vars{}.Merge(r.Vars)
+
+	if raw, ok := vars["RockerArtifacts"]; ok {
+		data, err := json.Marshal(raw)
+		if err != nil {
+			return nil, err
+		}
+		artifacts := []imagename.Artifact{}
+		if err := json.Unmarshal(data, &artifacts); err != nil {
+			return nil, fmt.Errorf("Failed to parse RockerArtifacts var, error: %s", err)
+		}
+		vars["RockerArtifacts"] = artifacts
+	}
+
+	return vars, nil
+}
+
+// JobInfo is the snapshot of the job state returned by the API
+type JobInfo struct {
+	ID        string               `json:"id"`
+	Status    Status               `json:"status"`
+	Request   BuildRequest         `json:"request"`
+	Created   time.Time            `json:"created"`
+	Started   *time.Time           `json:"started,omitempty"`
+	Finished  *time.Time           `json:"finished,omitempty"`
+	Error     string               `json:"error,omitempty"`
+	ImageID   string               `json:"image_id,omitempty"`
+	Artifacts []imagename.Artifact `json:"artifacts,omitempty"`
+	Cache     *build.CacheStats    `json:"cache,omitempty"`
+
+	CommitDuration time.Duration `json:"commit_duration,omitempty"`
+
+	// FailureSnapshot is the image the failed container was committed to
+	FailureSnapshot string `json:"failure_snapshot,omitempty"`
+}
+
+// Job is a single build submitted to the server; all the fields except
+// log are guarded by the server mutex
+type Job struct {
+	JobInfo
+
+	dir       string
+	cancelled bool
+	log       *jobLog
+	builder   *build.Build
+}
+
+// newJob makes a queued job for the request
+func newJob(req BuildRequest, dir string) *Job {
+	return &Job{
+		JobInfo: JobInfo{
+			ID:      newJobID(),
+			Status:  StatusQueued,
+			Request: req,
+			Created: time.Now(),
+		},
+		dir: dir,
+		log: newJobLog(),
+	}
+}
+
+// newJobID generates a random job id
+func newJobID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// Event is the build progress event: either a step start and finish or
+// the job status change
+type Event struct {
+	Time   time.Time        `json:"time"`
+	Step   *build.StepEvent `json:"step,omitempty"`
+	Status Status           `json:"status,omitempty"`
+
+	// offset is the log length at the moment of the event,
+	// so the events can be interleaved with the log output
+	offset int
+}
+
+// jobLog is the in-memory build output and events that can be followed
+// by multiple readers while they are written
+type jobLog struct {
+	mu     sync.Mutex
+	buf    bytes.Buffer
+	events []Event
+	closed bool
+	notify chan struct{}
+}
+
+func newJobLog() *jobLog {
+	return &jobLog{notify: make(chan struct{})}
+}
+
+// Write appends data to the log and wakes up the followers
+func (l *jobLog) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.closed {
+		return len(p), nil
+	}
+
+	n, err := l.buf.Write(p)
+	l.wakeup()
+	return n, err
+}
+
+// Event appends the event and wakes up the followers
+func (l *jobLog) Event(e Event) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.closed {
+		return
+	}
+
+	e.Time = time.Now()
+	e.offset = l.buf.Len()
+	l.events = append(l.events, e)
+	l.wakeup()
+}
+
+// wakeup notifies the followers about the new data, should be called under lock
+func (l *jobLog) wakeup() {
+	close(l.notify)
+	l.notify = make(chan struct{})
+}
+
+// Close marks the log as complete
+func (l *jobLog) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if !l.closed {
+		l.closed = true
+		close(l.notify)
+	}
+	return nil
+}
+
+// since returns the log content starting from offset and the events
+// starting from index n (none if n is negative), the channel that is closed on the next write
+// and whether the log is complete
+func (l *jobLog) since(offset, n int) (data []byte, events []Event, wait <-chan struct{}, closed bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if offset < l.buf.Len() {
+		data = append([]byte{}, l.buf.Bytes()[offset:]...)
+	}
+	if n >= 0 && n < len(l.events) {
+		events = append([]Event{}, l.events[n:]...)
+	}
+	return data, events, l.notify, l.closed
+}
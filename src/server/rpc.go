@@ -0,0 +1,500 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"sync"
+
+	"github.com/docker/docker/pkg/archive"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// The RPC interface is JSON-RPC 2.0 over a stream connection (tcp or unix
+// socket), one JSON object per message. Methods:
+//
+//	Context.Create {}                              -> {"upload": ID}
+//	Context.Write  {"upload": ID, "data": BASE64}  -> {}
+//	Build.Submit   {"request": BuildRequest, "upload": ID} -> JobInfo
+//	Build.Get      {"id": ID}                      -> JobInfo
+//	Build.List     {}                              -> [JobInfo]
+//	Build.Cancel   {"id": ID}                      -> JobInfo
+//	Build.Watch    {"id": ID, "logs": true}        -> JobInfo, when finished
+//
+// The build context is uploaded as a tar stream, optionally compressed,
+// split into chunks of any size and sent with Context.Write in order.
+// While Build.Watch is running, the server sends "Build.Event" notifications
+// with WatchEvent params: step and status events and, if requested, the
+// build output. Requests of a connection are handled in the order they are
+// received, so the chunks may be sent without waiting for the responses;
+// only Build.Watch and Build.Cancel are handled concurrently, so the build
+// can be cancelled over the same connection it is watched from.
+
+// JSON-RPC error codes
+const (
+	RPCParseError     = -32700
+	RPCInvalidRequest = -32600
+	RPCMethodNotFound = -32601
+	RPCInvalidParams  = -32602
+	RPCServerError    = -32000
+)
+
+// RPCError is the JSON-RPC error object
+type RPCError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *RPCError) Error() string {
+	return fmt.Sprintf("%s (code %d)", e.Message, e.Code)
+}
+
+// WatchEvent is the params of the Build.Event notification; either Log
+// or Event is set
+type WatchEvent struct {
+	ID    string `json:"id"`
+	Log   string `json:"log,omitempty"`
+	Event *Event `json:"event,omitempty"`
+}
+
+type rpcRequest struct {
+	JSONRPC string           `json:"jsonrpc"`
+	ID      *json.RawMessage `json:"id,omitempty"`
+	Method  string           `json:"method"`
+	Params  json.RawMessage  `json:"params,omitempty"`
+}
+
+type rpcResponse struct {
+	JSONRPC string           `json:"jsonrpc"`
+	ID      *json.RawMessage `json:"id"`
+	Result  interface{}      `json:"result,omitempty"`
+	Error   *RPCError        `json:"error,omitempty"`
+}
+
+type rpcNotification struct {
+	JSONRPC string      `json:"jsonrpc"`
+	Method  string      `json:"method"`
+	Params  interface{} `json:"params"`
+}
+
+// ListenAndServeRPC starts the worker and serves the RPC interface on addr,
+// which is either tcp://host:port or unix:///path/to.sock; stdio:// serves
+// the single connection on stdin and stdout and returns when it is closed,
+// which is how remote builders are driven through `kubectl exec`
+func (s *Server) ListenAndServeRPC(addr string) error {
+	u, err := url.Parse(addr)
+	if err != nil {
+		return fmt.Errorf("Failed to parse listen address %s, error: %s", addr, err)
+	}
+
+	var l net.Listener
+
+	switch u.Scheme {
+	case "tcp":
+		l, err = net.Listen("tcp", u.Host)
+	case "unix":
+		os.Remove(u.Path)
+		l, err = net.Listen("unix", u.Path)
+	case "stdio":
+		s.Start()
+		newRPCConn(s, stdioConn{}).serve()
+		return nil
+	default:
+		return fmt.Errorf("Unsupported listen address %s, should be either tcp://, unix:// or stdio://", addr)
+	}
+	if err != nil {
+		return err
+	}
+
+	s.Start()
+	log.Infof("Listening on %s", addr)
+
+	return s.ServeRPC(l)
+}
+
+// ServeRPC accepts connections on the listener and serves the RPC interface
+func (s *Server) ServeRPC(l net.Listener) error {
+	defer l.Close()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go newRPCConn(s, conn).serve()
+	}
+}
+
+// stdioConn is the connection over the process stdin and stdout
+type stdioConn struct{}
+
+func (stdioConn) Read(p []byte) (int, error)  { return os.Stdin.Read(p) }
+func (stdioConn) Write(p []byte) (int, error) { return os.Stdout.Write(p) }
+func (stdioConn) Close() error {
+	os.Stdin.Close()
+	return os.Stdout.Close()
+}
+
+// rpcConn is a single client connection
+type rpcConn struct {
+	s      *Server
+	conn   io.ReadWriteCloser
+	closed chan struct{}
+
+	wmu sync.Mutex
+	enc *json.Encoder
+
+	umu     sync.Mutex
+	uploads map[string]*upload
+}
+
+func newRPCConn(s *Server, conn io.ReadWriteCloser) *rpcConn {
+	return &rpcConn{
+		s:       s,
+		conn:    conn,
+		closed:  make(chan struct{}),
+		enc:     json.NewEncoder(conn),
+		uploads: map[string]*upload{},
+	}
+}
+
+// serve reads requests until the connection is closed
+func (c *rpcConn) serve() {
+	defer c.close()
+
+	// The requests are handled one by one in the order they came, except
+	// Build.Watch and Build.Cancel; the next requests are read meanwhile
+	ordered := make(chan rpcRequest, 64)
+	defer close(ordered)
+	go func() {
+		for req := range ordered {
+			c.handle(req)
+		}
+	}()
+
+	dec := json.NewDecoder(c.conn)
+	for {
+		req := rpcRequest{}
+		if err := dec.Decode(&req); err != nil {
+			if err != io.EOF {
+				c.send(rpcResponse{Error: &RPCError{RPCParseError, err.Error()}})
+			}
+			return
+		}
+		if req.Method == "Build.Watch" || req.Method == "Build.Cancel" {
+			go c.handle(req)
+		} else {
+			ordered <- req
+		}
+	}
+}
+
+// close aborts the unfinished uploads and closes the connection
+func (c *rpcConn) close() {
+	close(c.closed)
+	c.conn.Close()
+
+	c.umu.Lock()
+	defer c.umu.Unlock()
+
+	for id, u := range c.uploads {
+		u.abort()
+		delete(c.uploads, id)
+	}
+}
+
+// send writes the message to the connection
+func (c *rpcConn) send(msg interface{}) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	switch m := msg.(type) {
+	case rpcResponse:
+		m.JSONRPC = "2.0"
+		msg = m
+	case rpcNotification:
+		m.JSONRPC = "2.0"
+		msg = m
+	}
+	return c.enc.Encode(msg)
+}
+
+// handle calls the method and sends the response, unless it is a notification
+func (c *rpcConn) handle(req rpcRequest) {
+	result, err := c.call(req)
+	if req.ID == nil {
+		return
+	}
+
+	resp := rpcResponse{ID: req.ID, Result: result}
+	if err != nil {
+		rpcErr, ok := err.(*RPCError)
+		if !ok {
+			rpcErr = &RPCError{RPCServerError, err.Error()}
+		}
+		resp.Result, resp.Error = nil, rpcErr
+	} else if result == nil {
+		resp.Result = struct{}{}
+	}
+
+	if err := c.send(resp); err != nil {
+		log.Debugf("Failed to send RPC response, error: %s", err)
+	}
+}
+
+// call dispatches the request to the method
+func (c *rpcConn) call(req rpcRequest) (interface{}, error) {
+	var params struct {
+		ID      string       `json:"id"`
+		Upload  string       `json:"upload"`
+		Data    []byte       `json:"data"`
+		Request BuildRequest `json:"request"`
+		Logs    bool         `json:"logs"`
+	}
+	if len(req.Params) > 0 {
+		if err := json.Unmarshal(req.Params, &params); err != nil {
+			return nil, &RPCError{RPCInvalidParams, err.Error()}
+		}
+	}
+
+	switch req.Method {
+	case "Context.Create":
+		return c.createUpload()
+
+	case "Context.Write":
+		u, err := c.getUpload(params.Upload)
+		if err != nil {
+			return nil, err
+		}
+		return nil, u.write(params.Data)
+
+	case "Build.Submit":
+		return c.submit(params.Request, params.Upload)
+
+	case "Build.Get":
+		job, ok := c.s.Get(params.ID)
+		if !ok {
+			return nil, fmt.Errorf("Build %s not found", params.ID)
+		}
+		return job, nil
+
+	case "Build.List":
+		return c.s.List(), nil
+
+	case "Build.Cancel":
+		return c.s.Cancel(params.ID)
+
+	case "Build.Watch":
+		return c.watch(params.ID, params.Logs)
+
+	case "":
+		return nil, &RPCError{RPCInvalidRequest, "method is not specified"}
+	}
+
+	return nil, &RPCError{RPCMethodNotFound, fmt.Sprintf("Unknown method %s", req.Method)}
+}
+
+// submit queues the build with the context from the finished upload,
+// or cloned from git if there is no upload
+func (c *rpcConn) submit(req BuildRequest, uploadID string) (JobInfo, error) {
+	if err := validateRequest(req); err != nil {
+		return JobInfo{}, &RPCError{RPCInvalidParams, err.Error()}
+	}
+
+	var dir string
+
+	if uploadID != "" {
+		u, err := c.getUpload(uploadID)
+		if err != nil {
+			return JobInfo{}, err
+		}
+
+		c.umu.Lock()
+		delete(c.uploads, uploadID)
+		c.umu.Unlock()
+
+		if err := u.finish(); err != nil {
+			os.RemoveAll(u.dir)
+			return JobInfo{}, fmt.Errorf("Failed to extract build context, error: %s", err)
+		}
+		dir = u.dir
+
+	} else if req.GitURL == "" {
+		return JobInfo{}, &RPCError{RPCInvalidParams, "Either upload or git_url should be specified"}
+
+	} else {
+		var err error
+		if dir, err = c.s.NewContextDir(); err != nil {
+			return JobInfo{}, err
+		}
+	}
+
+	job, err := c.s.Submit(req, dir)
+	if err != nil {
+		os.RemoveAll(dir)
+		return JobInfo{}, err
+	}
+	return job, nil
+}
+
+// watch sends the job events, and the log if requested, until the job is finished
+func (c *rpcConn) watch(id string, logs bool) (interface{}, error) {
+	jobLog, ok := c.s.logs(id)
+	if !ok {
+		return nil, fmt.Errorf("Build %s not found", id)
+	}
+
+	var (
+		offset int
+		n      int
+	)
+
+	sendLog := func(data []byte) error {
+		offset += len(data)
+		if !logs || len(data) == 0 {
+			return nil
+		}
+		return c.send(rpcNotification{Method: "Build.Event", Params: WatchEvent{ID: id, Log: string(data)}})
+	}
+
+	for {
+		data, events, wait, closed := jobLog.since(offset, n)
+
+		for i := range events {
+			// Send the output that precedes the event
+			head := events[i].offset - offset
+			if head > len(data) {
+				head = len(data)
+			}
+			if head > 0 {
+				if err := sendLog(data[:head]); err != nil {
+					return nil, err
+				}
+				data = data[head:]
+			}
+			if err := c.send(rpcNotification{Method: "Build.Event", Params: WatchEvent{ID: id, Event: &events[i]}}); err != nil {
+				return nil, err
+			}
+			n++
+		}
+
+		if err := sendLog(data); err != nil {
+			return nil, err
+		}
+
+		if closed {
+			job, _ := c.s.Get(id)
+			return job, nil
+		}
+
+		select {
+		case <-wait:
+		case <-c.closed:
+			return nil, fmt.Errorf("Connection closed")
+		}
+	}
+}
+
+// createUpload starts extracting the new build context
+func (c *rpcConn) createUpload() (interface{}, error) {
+	dir, err := c.s.NewContextDir()
+	if err != nil {
+		return nil, err
+	}
+
+	u := newUpload(dir)
+
+	c.umu.Lock()
+	c.uploads[u.id] = u
+	c.umu.Unlock()
+
+	return map[string]string{"upload": u.id}, nil
+}
+
+// getUpload returns the upload of the connection by id
+func (c *rpcConn) getUpload(id string) (*upload, error) {
+	c.umu.Lock()
+	defer c.umu.Unlock()
+
+	u, ok := c.uploads[id]
+	if !ok {
+		return nil, &RPCError{RPCInvalidParams, fmt.Sprintf("Upload %s not found", id)}
+	}
+	return u, nil
+}
+
+// upload is the build context being received in chunks; the chunks are
+// piped to the tar extraction as they come
+type upload struct {
+	id   string
+	dir  string
+	mu   sync.Mutex
+	w    *io.PipeWriter
+	done chan error
+}
+
+func newUpload(dir string) *upload {
+	r, w := io.Pipe()
+	u := &upload{
+		id:   newJobID(),
+		dir:  dir,
+		w:    w,
+		done: make(chan error, 1),
+	}
+	go func() {
+		err := archive.Untar(r, dir, &archive.TarOptions{NoLchown: true})
+		// Unblock the writer in case the extraction stopped early
+		r.CloseWithError(fmt.Errorf("extraction stopped"))
+		u.done <- err
+	}()
+	return u
+}
+
+// write passes the chunk to the extraction
+func (u *upload) write(data []byte) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if _, err := u.w.Write(data); err != nil {
+		return fmt.Errorf("Failed to write to upload %s, error: %s", u.id, err)
+	}
+	return nil
+}
+
+// finish closes the stream and waits until the extraction is done
+func (u *upload) finish() error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	u.w.Close()
+	return <-u.done
+}
+
+// abort stops the extraction and removes the context
+func (u *upload) abort() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	u.w.CloseWithError(fmt.Errorf("upload aborted"))
+	<-u.done
+	os.RemoveAll(u.dir)
+}
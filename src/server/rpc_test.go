@@ -0,0 +1,229 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/grammarly/rocker/src/build"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRPC_UploadSubmitWatch(t *testing.T) {
+	s, ts := makeServer(t)
+	ts.Close()
+
+	s.run = func(job *Job) error {
+		content, err := ioutil.ReadFile(filepath.Join(job.dir, job.Request.File))
+		if err != nil {
+			return err
+		}
+		job.log.Event(Event{Step: &build.StepEvent{Step: 1, Command: string(content)}})
+		fmt.Fprintf(job.log, "step output\n")
+		return nil
+	}
+	s.Start()
+
+	c := makeRPCClient(t, s)
+
+	upload := map[string]string{}
+	c.call(t, "Context.Create", nil, &upload)
+
+	tarball := makeTar(t, map[string]string{"Rockerfile": "FROM scratch"}).Bytes()
+	half := len(tarball) / 2
+
+	c.call(t, "Context.Write", map[string]interface{}{"upload": upload["upload"], "data": tarball[:half]}, nil)
+	c.call(t, "Context.Write", map[string]interface{}{"upload": upload["upload"], "data": tarball[half:]}, nil)
+
+	job := JobInfo{}
+	c.call(t, "Build.Submit", map[string]interface{}{
+		"upload":  upload["upload"],
+		"request": BuildRequest{File: "Rockerfile"},
+	}, &job)
+
+	assert.Equal(t, StatusQueued, job.Status)
+
+	events := []WatchEvent{}
+	c.onEvent = func(e WatchEvent) { events = append(events, e) }
+	c.call(t, "Build.Watch", map[string]interface{}{"id": job.ID, "logs": true}, &job)
+
+	assert.Equal(t, StatusSucceeded, job.Status)
+
+	// Log chunks may be merged, so check the order of events and the whole output
+	var (
+		order  []string
+		output string
+	)
+	for _, e := range events {
+		switch {
+		case e.Event != nil && e.Event.Step != nil:
+			order = append(order, "step:"+e.Event.Step.Command)
+		case e.Event != nil:
+			order = append(order, "status:"+string(e.Event.Status))
+		default:
+			order = append(order, "log")
+			output += e.Log
+		}
+	}
+
+	assert.Equal(t, []string{"status:running", "log", "step:FROM scratch", "log", "status:succeeded"}, order)
+	assert.Contains(t, output, "step output\nBuild succeeded\n")
+}
+
+func TestRPC_PipelinedWrites(t *testing.T) {
+	s, ts := makeServer(t)
+	ts.Close()
+
+	s.run = func(job *Job) error {
+		content, err := ioutil.ReadFile(filepath.Join(job.dir, job.Request.File))
+		if err != nil {
+			return err
+		}
+		job.log.Event(Event{Step: &build.StepEvent{Step: 1, Command: string(content)}})
+		return nil
+	}
+	s.Start()
+
+	c := makeRPCClient(t, s)
+
+	upload := map[string]string{}
+	c.call(t, "Context.Create", nil, &upload)
+
+	content := strings.Repeat("RUN echo 0123456789\n", 500)
+	tarball := makeTar(t, map[string]string{"Rockerfile": content}).Bytes()
+
+	// The small chunks are all sent before any response is read
+	const chunkSize = 16
+	chunks := (len(tarball) + chunkSize - 1) / chunkSize
+	go func() {
+		for i := 0; i < len(tarball); i += chunkSize {
+			end := i + chunkSize
+			if end > len(tarball) {
+				end = len(tarball)
+			}
+			c.send(t, "Context.Write", map[string]interface{}{"upload": upload["upload"], "data": tarball[i:end]})
+		}
+	}()
+	for i := 0; i < chunks; i++ {
+		if err := c.receive(t, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	job := JobInfo{}
+	c.call(t, "Build.Submit", map[string]interface{}{
+		"upload":  upload["upload"],
+		"request": BuildRequest{File: "Rockerfile"},
+	}, &job)
+
+	var step string
+	c.onEvent = func(e WatchEvent) {
+		if e.Event != nil && e.Event.Step != nil {
+			step = e.Event.Step.Command
+		}
+	}
+	c.call(t, "Build.Watch", map[string]interface{}{"id": job.ID}, &job)
+
+	assert.Equal(t, StatusSucceeded, job.Status)
+	assert.Equal(t, content, step)
+}
+
+func TestRPC_Errors(t *testing.T) {
+	s, ts := makeServer(t)
+	ts.Close()
+
+	c := makeRPCClient(t, s)
+
+	err := c.call(t, "Build.Nope", nil, nil)
+	assert.Equal(t, RPCMethodNotFound, err.Code)
+
+	err = c.call(t, "Build.Submit", map[string]interface{}{"request": BuildRequest{File: "/etc/Rockerfile"}}, nil)
+	assert.Equal(t, RPCInvalidParams, err.Code)
+
+	err = c.call(t, "Context.Write", map[string]interface{}{"upload": "nope", "data": []byte("x")}, nil)
+	assert.Equal(t, RPCInvalidParams, err.Code)
+
+	err = c.call(t, "Build.Cancel", map[string]interface{}{"id": "nope"}, nil)
+	assert.Equal(t, RPCServerError, err.Code)
+}
+
+// rpcClient is the minimal synchronous JSON-RPC client for tests
+type rpcClient struct {
+	enc     *json.Encoder
+	dec     *json.Decoder
+	seq     int
+	onEvent func(WatchEvent)
+}
+
+func makeRPCClient(t *testing.T, s *Server) *rpcClient {
+	client, server := net.Pipe()
+	go newRPCConn(s, server).serve()
+	t.Cleanup(func() { client.Close() })
+
+	return &rpcClient{enc: json.NewEncoder(client), dec: json.NewDecoder(client)}
+}
+
+func (c *rpcClient) call(t *testing.T, method string, params, result interface{}) *RPCError {
+	c.send(t, method, params)
+	return c.receive(t, result)
+}
+
+// send sends the request without waiting for the response
+func (c *rpcClient) send(t *testing.T, method string, params interface{}) {
+	c.seq++
+	if err := c.enc.Encode(map[string]interface{}{"jsonrpc": "2.0", "id": c.seq, "method": method, "params": params}); err != nil {
+		t.Error(err)
+	}
+}
+
+// receive reads the notifications until the response comes
+func (c *rpcClient) receive(t *testing.T, result interface{}) *RPCError {
+	for {
+		var msg struct {
+			ID     *int             `json:"id"`
+			Method string           `json:"method"`
+			Params WatchEvent       `json:"params"`
+			Result *json.RawMessage `json:"result"`
+			Error  *RPCError        `json:"error"`
+		}
+		if err := c.dec.Decode(&msg); err != nil {
+			t.Fatal(err)
+		}
+		if msg.ID == nil {
+			if c.onEvent != nil && msg.Method == "Build.Event" {
+				c.onEvent(msg.Params)
+			}
+			continue
+		}
+		if msg.Error != nil {
+			return msg.Error
+		}
+		if result != nil {
+			if err := json.Unmarshal(*msg.Result, result); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return nil
+	}
+}
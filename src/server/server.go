@@ -0,0 +1,477 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package server implements the build queue server: builds are submitted
+// over HTTP either as a context tarball or a git repository URL, and are
+// run one by one using the same build library as `rocker build`.
+package server
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/grammarly/rocker/src/build"
+	"github.com/grammarly/rocker/src/git"
+	"github.com/grammarly/rocker/src/template"
+	"github.com/grammarly/rocker/src/util"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Config is the configuration of the build server
+type Config struct {
+	// WorkDir is where build contexts are extracted or cloned to
+	WorkDir string
+
+	// CacheDir is the rocker cache shared by all builds
+	CacheDir string
+
+	// ClientOptions is the template of docker client options; the log
+	// and container formatters are replaced for every job
+	ClientOptions build.DockerClientOptions
+
+	// QueueSize is the number of builds that can wait in the queue
+	QueueSize int
+
+	// History is the number of finished builds kept in memory
+	History int
+
+	// MinFreeSpace is the free disk space the builds require
+	// on the docker host before every step
+	MinFreeSpace int64
+
+	// Sandbox is the security settings of RUN and TEST containers of all builds
+	Sandbox build.Sandbox
+
+	// Hash is the hashing algorithm of the COPY/ADD tarsums of all builds
+	Hash build.Hash
+
+	// Policy restricts the FROM images and the PUSH destinations of all builds, optional
+	Policy *build.Policy
+}
+
+// Server holds the build queue and runs the builds
+type Server struct {
+	cfg   Config
+	queue chan *Job
+
+	mu    sync.Mutex
+	jobs  map[string]*Job
+	order []*Job
+
+	// current is guarded by its own mutex since the log hook
+	// fires while s.mu may be held
+	currentMu sync.Mutex
+	current   *Job
+
+	// run executes the job, can be replaced in tests
+	run func(job *Job) error
+}
+
+// New makes a new Server, filling in the defaults of the config
+func New(cfg Config) (*Server, error) {
+	if cfg.QueueSize <= 0 {
+		cfg.QueueSize = 100
+	}
+	if cfg.History <= 0 {
+		cfg.History = 100
+	}
+	if cfg.WorkDir == "" {
+		cfg.WorkDir = util.TempDir()
+	}
+	if err := os.MkdirAll(cfg.WorkDir, 0755); err != nil {
+		return nil, fmt.Errorf("Failed to create work dir %s, error: %s", cfg.WorkDir, err)
+	}
+
+	s := &Server{
+		cfg:   cfg,
+		queue: make(chan *Job, cfg.QueueSize),
+		jobs:  map[string]*Job{},
+	}
+	s.run = s.runBuild
+
+	return s, nil
+}
+
+// Start runs the worker that takes builds from the queue. Builds are run one at
+// a time since build steps log through the standard logger, which is captured
+// into the log of the current job.
+func (s *Server) Start() {
+	log.AddHook(&logHook{s})
+	go s.worker()
+}
+
+// Submit puts the build to the queue; dir is the extracted build context
+// or the empty directory to clone the git repository to
+func (s *Server) Submit(req BuildRequest, dir string) (JobInfo, error) {
+	if err := validateRequest(req); err != nil {
+		return JobInfo{}, err
+	}
+
+	job := newJob(req, dir)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	select {
+	case s.queue <- job:
+	default:
+		return JobInfo{}, fmt.Errorf("Build queue is full (%d builds)", s.cfg.QueueSize)
+	}
+
+	s.jobs[job.ID] = job
+	s.order = append(s.order, job)
+
+	log.Infof("Queued build %s", job.ID)
+
+	return job.JobInfo, nil
+}
+
+// Get returns the state of the job
+func (s *Server) Get(id string) (JobInfo, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	job, ok := s.jobs[id]
+	if !ok {
+		return JobInfo{}, false
+	}
+	return job.JobInfo, true
+}
+
+// List returns the state of all known jobs, the newest first
+func (s *Server) List() []JobInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	result := make([]JobInfo, 0, len(s.order))
+	for i := len(s.order) - 1; i >= 0; i-- {
+		result = append(result, s.order[i].JobInfo)
+	}
+	return result
+}
+
+// Cancel cancels the queued job or stops the running one before its next step
+func (s *Server) Cancel(id string) (JobInfo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	job, ok := s.jobs[id]
+	if !ok {
+		return JobInfo{}, fmt.Errorf("Build %s not found", id)
+	}
+
+	switch {
+	case job.Status.Done():
+		return job.JobInfo, fmt.Errorf("Build %s is already %s", id, job.Status)
+
+	case job.Status == StatusQueued:
+		// The worker skips it when it comes out of the queue
+		job.Status = StatusCancelled
+		job.Finished = timePtr(time.Now())
+		job.log.Event(Event{Status: StatusCancelled})
+		job.log.Close()
+		os.RemoveAll(job.dir)
+
+	default:
+		job.cancelled = true
+		if job.builder != nil {
+			job.builder.Cancel()
+		}
+	}
+
+	log.Infof("Cancel build %s", id)
+
+	return job.JobInfo, nil
+}
+
+// setCurrent sets the job the standard logger output is captured to
+func (s *Server) setCurrent(job *Job) {
+	s.currentMu.Lock()
+	s.current = job
+	s.currentMu.Unlock()
+}
+
+// logs returns the log of the job
+func (s *Server) logs(id string) (*jobLog, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	job, ok := s.jobs[id]
+	if !ok {
+		return nil, false
+	}
+	return job.log, true
+}
+
+// worker runs the queued jobs one by one
+func (s *Server) worker() {
+	for job := range s.queue {
+		s.mu.Lock()
+		if job.Status != StatusQueued {
+			s.mu.Unlock()
+			continue
+		}
+		job.Status = StatusRunning
+		job.Started = timePtr(time.Now())
+		job.log.Event(Event{Status: StatusRunning})
+		s.mu.Unlock()
+
+		s.setCurrent(job)
+
+		log.Infof("Start build %s", job.ID)
+
+		err := s.run(job)
+
+		s.setCurrent(nil)
+		s.finish(job, err)
+	}
+}
+
+// finish records the result of the job and cleans up its context
+func (s *Server) finish(job *Job, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch {
+	case job.cancelled:
+		job.Status = StatusCancelled
+	case err != nil:
+		job.Status = StatusFailed
+		job.Error = err.Error()
+	default:
+		job.Status = StatusSucceeded
+	}
+
+	// The builds run one at a time, so all the temp files are of this job
+	util.CleanupTempFiles()
+
+	if job.builder != nil {
+		job.ImageID = job.builder.GetImageID()
+		job.Artifacts = job.builder.Artifacts
+		job.Cache = &job.builder.CacheStats
+		job.CommitDuration = job.builder.CommitDuration
+		job.FailureSnapshot = job.builder.FailureSnapshot
+		job.builder = nil
+	}
+
+	if err != nil {
+		fmt.Fprintf(job.log, "Build %s: %s\n", job.Status, err)
+	} else {
+		fmt.Fprintf(job.log, "Build %s\n", job.Status)
+	}
+
+	job.Finished = timePtr(time.Now())
+	job.log.Event(Event{Status: job.Status})
+	job.log.Close()
+
+	if err := os.RemoveAll(job.dir); err != nil {
+		log.Errorf("Failed to remove build context %s, error: %s", job.dir, err)
+	}
+
+	log.Infof("Build %s %s", job.ID, job.Status)
+
+	s.prune()
+}
+
+// prune forgets the oldest finished jobs exceeding the history size
+func (s *Server) prune() {
+	finished := 0
+	for _, job := range s.order {
+		if job.Status.Done() {
+			finished++
+		}
+	}
+
+	order := s.order[:0]
+	for _, job := range s.order {
+		if finished > s.cfg.History && job.Status.Done() {
+			delete(s.jobs, job.ID)
+			finished--
+			continue
+		}
+		order = append(order, job)
+	}
+	s.order = order
+}
+
+// runBuild makes the build of the job using the rocker build library
+func (s *Server) runBuild(job *Job) error {
+	req := job.Request
+
+	if req.GitURL != "" {
+		fmt.Fprintf(job.log, "Clone %s %s\n", req.GitURL, req.GitRef)
+		if err := git.Clone(req.GitURL, req.GitRef, job.dir); err != nil {
+			return fmt.Errorf("Failed to clone %s, error: %s", req.GitURL, err)
+		}
+	}
+
+	var (
+		rockerfile     *build.Rockerfile
+		rockerfileName = filepath.Join(job.dir, req.File)
+	)
+
+	vars, err := req.templateVars()
+	if err != nil {
+		return err
+	}
+
+	// tags may have moved since the previous job
+	template.ResetDigestCache()
+
+	if req.Source != "" {
+		rockerfile, err = build.NewRockerfile(rockerfileName, strings.NewReader(req.Source), vars, template.Funs{})
+	} else {
+		rockerfile, err = build.NewRockerfileFromFile(rockerfileName, vars, template.Funs{})
+	}
+	if err != nil {
+		return err
+	}
+
+	dockerignore := []string{}
+
+	dockerignoreFilename := filepath.Join(job.dir, ".dockerignore")
+	if _, err := os.Stat(dockerignoreFilename); err == nil {
+		if dockerignore, err = build.ReadDockerignoreFile(dockerignoreFilename); err != nil {
+			return err
+		}
+	}
+
+	// Docker client output, e.g. the output of RUN containers, goes to the job log
+	jobLogger := log.New()
+	jobLogger.Out = job.log
+	jobLogger.Level = log.StandardLogger().Level
+	jobLogger.Formatter = &log.TextFormatter{DisableColors: true}
+
+	options := s.cfg.ClientOptions
+	options.Log = jobLogger
+	options.StdoutContainerFormatter = build.NewMonochromeContainerFormatter()
+	options.StderrContainerFormatter = build.NewMonochromeContainerFormatter()
+
+	var cache build.Cache
+	if !req.NoCache {
+		cache = build.NewCacheFS(s.cfg.CacheDir, s.cfg.Hash)
+	}
+
+	builder := build.New(build.NewDockerClient(options), rockerfile, cache, build.Config{
+		OutStream:    job.log,
+		ContextDir:   job.dir,
+		Dockerignore: dockerignore,
+		Pull:         req.Pull,
+		NoCache:      req.NoCache,
+		Push:         req.Push,
+		CacheDir:     s.cfg.CacheDir,
+		BuildArgs:    req.BuildArgs,
+		AutoBatch:    req.AutoBatch,
+		Strict:       req.Strict,
+		MinFreeSpace: s.cfg.MinFreeSpace,
+		Sandbox:      s.cfg.Sandbox,
+		Hash:         s.cfg.Hash,
+		Policy:       s.cfg.Policy,
+		Prefetch:     true,
+
+		SkipNoopCommits:      req.SkipNoopCommits,
+		DedupeCopy:           req.DedupeCopy,
+		NoReuse:              req.NoReuse,
+		ArgsFileMount:        req.ArgsFileMount,
+		FailOnSecrets:        req.FailOnSecrets,
+		SnapshotOnFailure:    req.SnapshotOnFailure,
+		RecordBuildArgs:      req.RecordBuildArgs || len(req.RecordBuildArgValues) > 0,
+		RecordBuildArgValues: req.RecordBuildArgValues,
+		RecordVars:           req.RecordVars,
+		OnStep: func(e build.StepEvent) {
+			job.log.Event(Event{Step: &e})
+		},
+	})
+
+	plan, err := build.NewPlan(rockerfile.Commands(), true, req.AutoBatch)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	job.builder = builder
+	cancelled := job.cancelled
+	s.mu.Unlock()
+
+	if cancelled {
+		return build.ErrCancelled
+	}
+
+	return builder.Run(plan)
+}
+
+// NewContextDir makes the empty directory for the build context within the work dir
+func (s *Server) NewContextDir() (string, error) {
+	dir, err := ioutil.TempDir(s.cfg.WorkDir, "rocker_build_")
+	if err != nil {
+		return "", fmt.Errorf("Failed to create build context dir, error: %s", err)
+	}
+	return dir, nil
+}
+
+// validateRequest checks that the request is safe to build
+func validateRequest(req BuildRequest) error {
+	if req.File == "" {
+		return fmt.Errorf("Rockerfile name is not specified")
+	}
+	if filepath.IsAbs(req.File) || strings.HasPrefix(filepath.Clean(req.File), "..") {
+		return fmt.Errorf("Rockerfile %s should be within the build context", req.File)
+	}
+	return nil
+}
+
+// logHook copies the standard logger output, e.g. build steps, to the current job log
+type logHook struct {
+	s *Server
+}
+
+func (h *logHook) Levels() []log.Level {
+	return []log.Level{
+		log.PanicLevel,
+		log.FatalLevel,
+		log.ErrorLevel,
+		log.WarnLevel,
+		log.InfoLevel,
+		log.DebugLevel,
+	}
+}
+
+func (h *logHook) Fire(entry *log.Entry) error {
+	h.s.currentMu.Lock()
+	job := h.s.current
+	h.s.currentMu.Unlock()
+
+	if job == nil {
+		return nil
+	}
+
+	line, err := (&log.TextFormatter{DisableColors: true}).Format(entry)
+	if err != nil {
+		return err
+	}
+	_, err = job.log.Write(line)
+	return err
+}
+
+func timePtr(t time.Time) *time.Time {
+	return &t
+}
@@ -0,0 +1,193 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServer_SubmitTarball(t *testing.T) {
+	s, ts := makeServer(t)
+	defer ts.Close()
+
+	var contextFiles []string
+	s.run = func(job *Job) error {
+		files, _ := filepath.Glob(filepath.Join(job.dir, "*"))
+		for _, f := range files {
+			contextFiles = append(contextFiles, filepath.Base(f))
+		}
+		fmt.Fprintf(job.log, "hello from %s\n", job.Request.Vars["NAME"])
+		return nil
+	}
+	s.Start()
+
+	body := makeTar(t, map[string]string{"Rockerfile": "FROM scratch", "app.js": "1"})
+
+	resp, err := http.Post(ts.URL+"/builds?var=NAME=world&push=true", "application/x-tar", body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	job := JobInfo{}
+	decode(t, resp, http.StatusCreated, &job)
+
+	assert.Equal(t, "Rockerfile", job.Request.File)
+	assert.True(t, job.Request.Push)
+
+	resp, err = http.Get(ts.URL + "/builds/" + job.ID + "/logs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	logs, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	assert.Contains(t, string(logs), "hello from world\n")
+	assert.Contains(t, string(logs), "Build succeeded\n")
+	assert.Equal(t, []string{"Rockerfile", "app.js"}, contextFiles)
+
+	resp, err = http.Get(ts.URL + "/builds/" + job.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decode(t, resp, http.StatusOK, &job)
+
+	assert.Equal(t, StatusSucceeded, job.Status)
+	assert.NotNil(t, job.Finished)
+}
+
+func TestServer_CancelQueued(t *testing.T) {
+	s, ts := makeServer(t)
+	defer ts.Close()
+
+	release := make(chan struct{})
+	s.run = func(job *Job) error {
+		<-release
+		return fmt.Errorf("boom")
+	}
+	s.Start()
+	defer close(release)
+
+	first, err := s.Submit(BuildRequest{File: "Rockerfile"}, mustContextDir(t, s))
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := s.Submit(BuildRequest{File: "Rockerfile"}, mustContextDir(t, s))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, _ := http.NewRequest("DELETE", ts.URL+"/builds/"+second.ID, nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	job := JobInfo{}
+	decode(t, resp, http.StatusOK, &job)
+
+	assert.Equal(t, StatusCancelled, job.Status)
+
+	list := []JobInfo{}
+	resp, err = http.Get(ts.URL + "/builds")
+	if err != nil {
+		t.Fatal(err)
+	}
+	decode(t, resp, http.StatusOK, &list)
+
+	assert.Len(t, list, 2)
+	assert.Equal(t, second.ID, list[0].ID)
+	assert.Equal(t, first.ID, list[1].ID)
+}
+
+func TestServer_SubmitInvalid(t *testing.T) {
+	_, ts := makeServer(t)
+	defer ts.Close()
+
+	resp, err := http.Post(ts.URL+"/builds?file=../Rockerfile", "application/x-tar", &bytes.Buffer{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	resp.Body.Close()
+
+	resp, err = http.Get(ts.URL + "/builds/nope")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	resp.Body.Close()
+}
+
+func makeServer(t *testing.T) (*Server, *httptest.Server) {
+	dir, err := ioutil.TempDir("", "rocker-server-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := New(Config{WorkDir: dir, CacheDir: filepath.Join(dir, "cache")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(s.Handler())
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return s, ts
+}
+
+func mustContextDir(t *testing.T, s *Server) string {
+	dir, err := s.NewContextDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func makeTar(t *testing.T, files map[string]string) *bytes.Buffer {
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	for name, content := range files {
+		hdr := &tar.Header{Name: name, Mode: 0644, Size: int64(len(content)), ModTime: time.Now()}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf
+}
+
+func decode(t *testing.T, resp *http.Response, status int, v interface{}) {
+	defer resp.Body.Close()
+	if !assert.Equal(t, status, resp.StatusCode) {
+		t.FailNow()
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,162 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package s3
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/grammarly/rocker/src/util"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/docker/docker/pkg/units"
+)
+
+// The compressions of the image tarballs, Push stores the one used in the
+// Compression metadata of the object, so Pull decompresses it transparently
+const (
+	CompressionNone = "none"
+	CompressionGzip = "gzip"
+	CompressionZstd = "zstd"
+)
+
+// zstdBinary is the zstd cli the zstd tarballs are compressed and decompressed with
+var zstdBinary = "zstd"
+
+// compressionContentTypes are the content types of the compressed tarballs
+var compressionContentTypes = map[string]string{
+	CompressionGzip: "application/gzip",
+	CompressionZstd: "application/zstd",
+}
+
+// ParseCompression validates the compression of the pushed tarballs, empty means none
+func ParseCompression(compression string) (string, error) {
+	switch compression {
+	case "", CompressionNone:
+		return CompressionNone, nil
+	case CompressionGzip:
+		return compression, nil
+	case CompressionZstd:
+		if _, err := exec.LookPath(zstdBinary); err != nil {
+			return "", fmt.Errorf("S3 compression zstd requires the %s binary in PATH, error: %s", zstdBinary, err)
+		}
+		return compression, nil
+	}
+	return "", fmt.Errorf("Unknown S3 compression %q, expected zstd, gzip or none", compression)
+}
+
+// compress compresses the tarball to be uploaded and logs the sizes
+func (s *StorageS3) compress(fileName string) (string, error) {
+	compressed, err := compressFile(fileName, s.Compression)
+	if err != nil {
+		return "", fmt.Errorf("Failed to compress the image tarball with %s, error: %s", s.Compression, err)
+	}
+	if before, after := fileSize(fileName), fileSize(compressed); before > 0 {
+		log.Infof("| Compressed with %s: %s -> %s (%.0f%%)", s.Compression,
+			units.HumanSize(float64(before)), units.HumanSize(float64(after)), float64(after)*100/float64(before))
+	}
+	return compressed, nil
+}
+
+func fileSize(fileName string) int64 {
+	if fi, err := os.Stat(fileName); err == nil {
+		return fi.Size()
+	}
+	return 0
+}
+
+// compressFile compresses the file to a new temp file, the caller removes it
+func compressFile(fileName, compression string) (result string, err error) {
+	in, err := os.Open(fileName)
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+
+	out, err := util.TempFile(TempFilePrefix)
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		out.Close()
+		if err != nil {
+			util.RemoveTempFile(out.Name())
+		}
+	}()
+
+	switch compression {
+	case CompressionGzip:
+		gz := gzip.NewWriter(out)
+		if _, err = io.Copy(gz, in); err != nil {
+			return "", err
+		}
+		if err = gz.Close(); err != nil {
+			return "", err
+		}
+	case CompressionZstd:
+		if err = runZstd(in, out, "-q", "-c", "-T0"); err != nil {
+			return "", err
+		}
+	default:
+		return "", fmt.Errorf("Unknown S3 compression %q", compression)
+	}
+
+	return out.Name(), nil
+}
+
+// decompressFile decompresses the file to the beginning of the given one
+func decompressFile(fileName, compression string, out *os.File) error {
+	in, err := os.Open(fileName)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	switch compression {
+	case CompressionGzip:
+		gz, err := gzip.NewReader(in)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		_, err = io.Copy(out, gz)
+		return err
+	case CompressionZstd:
+		return runZstd(in, out, "-q", "-d", "-c")
+	}
+	return fmt.Errorf("Unknown S3 compression %q of the tarball, upgrade rocker", compression)
+}
+
+// runZstd runs the zstd cli on the streams
+func runZstd(in io.Reader, out io.Writer, args ...string) error {
+	var stderr bytes.Buffer
+
+	cmd := exec.Command(zstdBinary, args...)
+	cmd.Stdin = in
+	cmd.Stdout = out
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("Failed to run %s %s, error: %s %s", zstdBinary, strings.Join(args, " "), err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package s3
+
+import (
+	"io/ioutil"
+	"os/exec"
+	"strings"
+	"testing"
+
+	"github.com/grammarly/rocker/src/util"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseCompression(t *testing.T) {
+	for _, value := range []string{"", "none"} {
+		compression, err := ParseCompression(value)
+		assert.NoError(t, err)
+		assert.Equal(t, CompressionNone, compression)
+	}
+
+	compression, err := ParseCompression("gzip")
+	assert.NoError(t, err)
+	assert.Equal(t, CompressionGzip, compression)
+
+	_, err = ParseCompression("bzip2")
+	assert.EqualError(t, err, "Unknown S3 compression \"bzip2\", expected zstd, gzip or none")
+}
+
+func TestCompressFile(t *testing.T) {
+	compressions := []string{CompressionGzip}
+	if _, err := exec.LookPath(zstdBinary); err == nil {
+		compressions = append(compressions, CompressionZstd)
+	} else {
+		t.Logf("Skip zstd, no %s binary in PATH", zstdBinary)
+	}
+
+	content := strings.Repeat("image layer content\n", 1000)
+
+	src, err := util.TempFile(TempFilePrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer util.RemoveTempFile(src.Name())
+	if _, err := src.WriteString(content); err != nil {
+		t.Fatal(err)
+	}
+	src.Close()
+
+	for _, compression := range compressions {
+		compressed, err := compressFile(src.Name(), compression)
+		if err != nil {
+			t.Fatalf("%s: %s", compression, err)
+		}
+		defer util.RemoveTempFile(compressed)
+
+		assert.True(t, fileSize(compressed) < int64(len(content)), compression)
+
+		out, err := util.TempFile(TempFilePrefix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer util.RemoveTempFile(out.Name())
+
+		if err := decompressFile(compressed, compression, out); err != nil {
+			t.Fatalf("%s: %s", compression, err)
+		}
+		out.Close()
+
+		data, err := ioutil.ReadFile(out.Name())
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, content, string(data), compression)
+	}
+}
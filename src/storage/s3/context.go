@@ -0,0 +1,160 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package s3
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/docker/docker/pkg/units"
+	"github.com/grammarly/rocker/src/util"
+)
+
+const (
+	// contextURLPrefix is the prefix of the build contexts stored on S3
+	contextURLPrefix = "s3://"
+
+	// contextsDir is the directory within the cache root the context archives are kept in
+	contextsDir = "_contexts"
+)
+
+// IsContextURL returns true if the build context is the archive on S3, s3://<bucket>/<key>
+func IsContextURL(context string) bool {
+	return strings.HasPrefix(context, contextURLPrefix)
+}
+
+// parseContextURL splits s3://<bucket>/<key> into the bucket and the key
+func parseContextURL(url string) (bucket, key string, err error) {
+	parts := strings.SplitN(strings.TrimPrefix(url, contextURLPrefix), "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" || strings.HasSuffix(parts[1], "/") {
+		return "", "", fmt.Errorf("Invalid S3 build context %s, expected %s<bucket>/<key>", url, contextURLPrefix)
+	}
+	return parts[0], parts[1], nil
+}
+
+// FetchContext downloads the build context archive from S3 to the cache dir
+// and gives the file and its sha256:<hex> digest. The digest is checked against
+// the expected one, if given, and the sha256 metadata of the object, if it has
+// one. The archives are cached by their ETag, so the context that has not
+// changed since the last build is not downloaded again.
+func (s *StorageS3) FetchContext(url, expected string) (fileName, digest string, err error) {
+	bucket, key, err := parseContextURL(url)
+	if err != nil {
+		return "", "", err
+	}
+
+	head, err := s.s3.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return "", "", fmt.Errorf("Failed to read build context %s, error: %s", url, err)
+	}
+
+	cacheKey := fmt.Sprintf("context-%x", sha256.Sum256([]byte(bucket+"/"+key+"@"+aws.StringValue(head.ETag))))
+	fileName = filepath.Join(s.cacheRoot, contextsDir, cacheKey)
+
+	if digest, err = s.CacheGet(cacheKey); err != nil {
+		return "", "", err
+	}
+	if _, err := os.Stat(fileName); err != nil {
+		digest = ""
+	}
+
+	if digest != "" {
+		log.Infof("| Using the cached build context %s", url)
+	} else if digest, err = s.downloadContext(url, bucket, key, fileName); err != nil {
+		return "", "", err
+	} else if err := s.CachePut(cacheKey, digest); err != nil {
+		return "", "", fmt.Errorf("Failed to save digest cache, error: %s", err)
+	}
+
+	for _, want := range []string{expected, metadataValue(head.Metadata, "Sha256")} {
+		if want == "" {
+			continue
+		}
+		if !strings.HasPrefix(want, "sha256:") {
+			want = "sha256:" + want
+		}
+		if want != digest {
+			return "", "", fmt.Errorf("The digest of build context %s is %s, expected %s", url, digest, want)
+		}
+	}
+
+	return fileName, digest, nil
+}
+
+// downloadContext downloads the archive to the file and gives its digest; the file
+// appears only when the download is complete, so a partial one is never reused
+func (s *StorageS3) downloadContext(url, bucket, key, fileName string) (digest string, err error) {
+	if err := util.MkdirAllOutput(filepath.Dir(fileName), 0755); err != nil {
+		return "", err
+	}
+
+	tmpf, err := ioutil.TempFile(filepath.Dir(fileName), ".download-")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmpf.Name())
+	defer tmpf.Close()
+
+	downloader := s3manager.NewDownloaderWithClient(s.s3, func(d *s3manager.Downloader) {
+		d.PartSize = 64 * 1024 * 1024 // 64MB per part
+	})
+
+	log.Infof("| Download build context %s", url)
+
+	var size int64
+	if err := s.retryer.Outer(func() (err error) {
+		size, err = downloader.Download(tmpf, &s3.GetObjectInput{
+			Bucket: aws.String(bucket),
+			Key:    aws.String(key),
+		})
+		return err
+	}); err != nil {
+		return "", fmt.Errorf("Failed to download build context %s, error: %s", url, err)
+	}
+
+	if _, err := tmpf.Seek(0, 0); err != nil {
+		return "", err
+	}
+	hash := sha256.New()
+	if _, err := io.Copy(hash, tmpf); err != nil {
+		return "", fmt.Errorf("Failed to read build context %s, error: %s", url, err)
+	}
+	digest = fmt.Sprintf("sha256:%x", hash.Sum(nil))
+
+	if err := util.ChownOutput(tmpf.Name()); err != nil {
+		return "", err
+	}
+	if err := os.Rename(tmpf.Name(), fileName); err != nil {
+		return "", err
+	}
+
+	log.Infof("| Downloaded build context %s (%s), %s", url, units.HumanSize(float64(size)), digest)
+
+	return digest, nil
+}
@@ -0,0 +1,91 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package s3
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseContextURL(t *testing.T) {
+	bucket, key, err := parseContextURL("s3://bucket/app/context.tar.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "bucket", bucket)
+	assert.Equal(t, "app/context.tar.gz", key)
+
+	for _, url := range []string{"s3://", "s3://bucket", "s3://bucket/", "s3:///key", "s3://bucket/dir/"} {
+		_, _, err := parseContextURL(url)
+		assert.Error(t, err, url)
+	}
+
+	assert.True(t, IsContextURL("s3://bucket/context.tar.gz"))
+	assert.False(t, IsContextURL("s3.amazonaws.com/bucket/image:1"))
+	assert.False(t, IsContextURL("./context"))
+}
+
+func TestFetchContext(t *testing.T) {
+	bucket := newFakeBucket()
+	srv := httptest.NewServer(bucket)
+	defer srv.Close()
+
+	cacheRoot, err := ioutil.TempDir("", "rocker-s3-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cacheRoot)
+
+	storage := newTestStorage(srv.URL)
+	storage.cacheRoot = cacheRoot
+
+	// sha256 of "context"
+	const digest = "sha256:ea7792a26f405e2ae9c6f49ca93bbe6076ceac0a1fc53d83426c7d7f2d9377e4"
+
+	bucket.objects["app/context.tar"] = []byte("context")
+
+	fileName, actual, err := storage.FetchContext("s3://bucket/app/context.tar", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, digest, actual)
+
+	content, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "context", string(content))
+
+	// The object with the same ETag is taken from the cache
+	bucket.objects["app/context.tar"] = []byte("changed")
+
+	_, actual, err = storage.FetchContext("s3://bucket/app/context.tar", digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, digest, actual)
+
+	_, _, err = storage.FetchContext("s3://bucket/app/context.tar", "sha256:123")
+	assert.EqualError(t, err, "The digest of build context s3://bucket/app/context.tar is "+digest+", expected sha256:123")
+
+	_, _, err = storage.FetchContext("s3://bucket/app/missing.tar", "")
+	assert.Error(t, err)
+}
@@ -0,0 +1,327 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package s3
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/grammarly/rocker/src/util"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/docker/docker/pkg/units"
+)
+
+const (
+	// layersDir is the directory in the bucket root with the layers shared by all images
+	layersDir = "_layers"
+	layerExt  = ".layer"
+
+	// layerFile is the name of the layer tarballs in the image tarball made by docker save,
+	// the layered image tarball has the layerRefExt files with the layer object keys instead
+	layerFile   = "layer.tar"
+	layerRefExt = ".ref"
+
+	// layoutLayers is the Layout metadata of the image tarballs pushed with the layers separately
+	layoutLayers = "layers"
+)
+
+// PushStats are the sizes of the layers pushed by the storage
+type PushStats struct {
+	Uploaded int64
+	Reused   int64
+}
+
+// String returns the human readable representation of the stats
+func (s PushStats) String() string {
+	return fmt.Sprintf("uploaded %s of layers, reused %s already in the bucket",
+		units.HumanSize(float64(s.Uploaded)), units.HumanSize(float64(s.Reused)))
+}
+
+// Add sums up the stats
+func (s PushStats) Add(other PushStats) PushStats {
+	return PushStats{Uploaded: s.Uploaded + other.Uploaded, Reused: s.Reused + other.Reused}
+}
+
+// pushStats accumulates the stats of all pushes made by the storage
+type pushStats struct {
+	mu    sync.Mutex
+	stats PushStats
+}
+
+func (p *pushStats) add(stats PushStats) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.stats = p.stats.Add(stats)
+}
+
+// PushStats returns the sizes of the layers uploaded and reused
+// by all the pushes made with Layers
+func (s *StorageS3) PushStats() PushStats {
+	s.stats.mu.Lock()
+	defer s.stats.mu.Unlock()
+	return s.stats.stats
+}
+
+// pushLayers uploads the layers of the image tarball the bucket does not have yet
+// and makes the tarball with the references to the layer objects in place of the layers
+func (s *StorageS3) pushLayers(bucket, fileName string) (skeleton string, stats PushStats, err error) {
+	in, err := os.Open(fileName)
+	if err != nil {
+		return "", stats, err
+	}
+	defer in.Close()
+
+	out, err := util.TempFile(TempFilePrefix)
+	if err != nil {
+		return "", stats, err
+	}
+	defer out.Close()
+
+	defer func() {
+		if err != nil {
+			util.RemoveTempFile(out.Name())
+		}
+	}()
+
+	var (
+		tr = tar.NewReader(in)
+		tw = tar.NewWriter(out)
+	)
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", stats, fmt.Errorf("Failed to read tar content, error: %s", err)
+		}
+
+		if !isLayerFile(hdr.Name) {
+			if err := tw.WriteHeader(hdr); err != nil {
+				return "", stats, err
+			}
+			if _, err := io.Copy(tw, tr); err != nil {
+				return "", stats, err
+			}
+			continue
+		}
+
+		key, uploaded, err := s.pushLayer(bucket, tr)
+		if err != nil {
+			return "", stats, err
+		}
+		if uploaded {
+			stats.Uploaded += hdr.Size
+		} else {
+			stats.Reused += hdr.Size
+		}
+
+		// The reference keeps the header of the layer, so that it is restored as is
+		ref := *hdr
+		ref.Name, ref.Size = hdr.Name+layerRefExt, int64(len(key))
+		if err := tw.WriteHeader(&ref); err != nil {
+			return "", stats, err
+		}
+		if _, err := tw.Write([]byte(key)); err != nil {
+			return "", stats, err
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return "", stats, err
+	}
+
+	s.stats.add(stats)
+
+	return out.Name(), stats, nil
+}
+
+// pushLayer buffers the layer to find out its digest and uploads it
+// unless the bucket already has it; gives the key of the layer object
+func (s *StorageS3) pushLayer(bucket string, layer io.Reader) (key string, uploaded bool, err error) {
+	tmpf, err := util.TempFile(TempFilePrefix)
+	if err != nil {
+		return "", false, err
+	}
+	defer util.RemoveTempFile(tmpf.Name())
+	defer tmpf.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(tmpf, hash), layer); err != nil {
+		return "", false, fmt.Errorf("Failed to buffer layer, error: %s", err)
+	}
+
+	key = layerKey(fmt.Sprintf("%s%x", digestPrefix, hash.Sum(nil)))
+
+	_, headErr := s.s3.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if headErr == nil {
+		log.Debugf("| Layer s3.amazonaws.com/%s/%s already exists", bucket, key)
+		return key, false, nil
+	}
+	if e, ok := headErr.(awserr.RequestFailure); !ok || e.StatusCode() != 404 {
+		return "", false, headErr
+	}
+
+	log.Infof("| Uploading layer to s3.amazonaws.com/%s/%s", bucket, key)
+
+	uploader := s3manager.NewUploaderWithClient(s.s3, func(u *s3manager.Uploader) {
+		u.PartSize = 64 * 1024 * 1024 // 64MB per part
+	})
+
+	if err := s.retryer.Outer(func() error {
+		if _, err := tmpf.Seek(0, 0); err != nil {
+			return err
+		}
+		_, err := uploader.Upload(&s3manager.UploadInput{
+			Bucket:      aws.String(bucket),
+			Key:         aws.String(key),
+			ContentType: aws.String("application/x-tar"),
+			Body:        tmpf,
+		})
+		return err
+	}); err != nil {
+		return "", false, fmt.Errorf("Failed to upload layer to S3, error: %s", err)
+	}
+
+	return key, true, nil
+}
+
+// pullLayers makes the image tarball out of the tarball pushed with the layers separately,
+// downloading the layers its references point to
+func (s *StorageS3) pullLayers(bucket, skeleton string, out *os.File) error {
+	in, err := os.Open(skeleton)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	var (
+		tr = tar.NewReader(in)
+		tw = tar.NewWriter(out)
+
+		downloader = s3manager.NewDownloaderWithClient(s.s3, func(d *s3manager.Downloader) {
+			d.PartSize = 64 * 1024 * 1024 // 64MB per part
+		})
+	)
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("Failed to read tar content, error: %s", err)
+		}
+
+		if !isLayerRef(hdr.Name) {
+			if err := tw.WriteHeader(hdr); err != nil {
+				return err
+			}
+			if _, err := io.Copy(tw, tr); err != nil {
+				return err
+			}
+			continue
+		}
+
+		data := make([]byte, hdr.Size)
+		if _, err := io.ReadFull(tr, data); err != nil {
+			return fmt.Errorf("Failed to read layer reference %s, error: %s", hdr.Name, err)
+		}
+		key := string(data)
+		if !isLayerKey(key) {
+			return fmt.Errorf("Invalid layer reference %s: %q", hdr.Name, key)
+		}
+
+		if err := s.pullLayer(downloader, bucket, key, hdr, tw); err != nil {
+			return err
+		}
+	}
+
+	return tw.Close()
+}
+
+// pullLayer downloads the layer object and writes it to the image tarball
+// with the header of the reference
+func (s *StorageS3) pullLayer(downloader *s3manager.Downloader, bucket, key string, ref *tar.Header, tw *tar.Writer) error {
+	tmpf, err := util.TempFile(TempFilePrefix)
+	if err != nil {
+		return err
+	}
+	defer util.RemoveTempFile(tmpf.Name())
+	defer tmpf.Close()
+
+	log.Infof("| Download layer s3.amazonaws.com/%s/%s", bucket, key)
+
+	if err := s.retryer.Outer(func() error {
+		if err := tmpf.Truncate(0); err != nil {
+			return err
+		}
+		_, err := downloader.Download(tmpf, &s3.GetObjectInput{
+			Bucket: aws.String(bucket),
+			Key:    aws.String(key),
+		})
+		return err
+	}); err != nil {
+		return fmt.Errorf("Failed to download layer from S3, error: %s", err)
+	}
+
+	info, err := tmpf.Stat()
+	if err != nil {
+		return err
+	}
+	if _, err := tmpf.Seek(0, 0); err != nil {
+		return err
+	}
+
+	hdr := *ref
+	hdr.Name, hdr.Size = strings.TrimSuffix(ref.Name, layerRefExt), info.Size()
+	if err := tw.WriteHeader(&hdr); err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, tmpf)
+	return err
+}
+
+func layerKey(digest string) string {
+	return layersDir + "/" + digest + layerExt
+}
+
+func isLayerKey(key string) bool {
+	return strings.HasPrefix(key, layersDir+"/"+digestPrefix) && strings.HasSuffix(key, layerExt) && !strings.Contains(key, "..")
+}
+
+func isLayerFile(name string) bool {
+	return name == layerFile || strings.HasSuffix(name, "/"+layerFile)
+}
+
+func isLayerRef(name string) bool {
+	return isLayerFile(strings.TrimSuffix(name, layerRefExt)) && strings.HasSuffix(name, layerRefExt)
+}
@@ -0,0 +1,185 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package s3
+
+import (
+	"archive/tar"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLayers_PushPull(t *testing.T) {
+	bucket := newFakeBucket()
+	srv := httptest.NewServer(bucket)
+	defer srv.Close()
+
+	storage := newTestStorage(srv.URL)
+
+	base := writeTestTar(t, []testTarFile{
+		{"base/json", "{}"},
+		{"base/layer.tar", "base layer"},
+	})
+	defer os.Remove(base)
+
+	app := writeTestTar(t, []testTarFile{
+		{"base/json", "{}"},
+		{"base/layer.tar", "base layer"},
+		{"app/json", `{"parent":"base"}`},
+		{"app/layer.tar", "app layer"},
+		{"repositories", `{"app":{"1":"app"}}`},
+	})
+	defer os.Remove(app)
+
+	skeleton, stats, err := storage.pushLayers("bucket", base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Remove(skeleton)
+	assert.Equal(t, PushStats{Uploaded: 10}, stats)
+
+	skeleton, stats, err = storage.pushLayers("bucket", app)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(skeleton)
+	assert.Equal(t, PushStats{Uploaded: 9, Reused: 10}, stats)
+	assert.Equal(t, PushStats{Uploaded: 19, Reused: 10}, storage.PushStats())
+	assert.Len(t, bucket.objects, 2)
+
+	out, err := ioutil.TempFile("", "rocker-s3-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(out.Name())
+	defer out.Close()
+
+	if err := storage.pullLayers("bucket", skeleton, out); err != nil {
+		t.Fatal(err)
+	}
+
+	expected, err := tarDigest(app)
+	if err != nil {
+		t.Fatal(err)
+	}
+	actual, err := tarDigest(out.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, expected, actual)
+}
+
+func TestLayers_Names(t *testing.T) {
+	assert.True(t, isLayerFile("abc/layer.tar"))
+	assert.False(t, isLayerFile("abc/json"))
+	assert.True(t, isLayerRef("abc/layer.tar.ref"))
+	assert.False(t, isLayerRef("abc/layer.tar"))
+	assert.True(t, isLayerKey(layerKey("sha256-abc")))
+	assert.False(t, isLayerKey("app/1.tar"))
+	assert.False(t, isLayerKey("_layers/sha256-../../app/1.layer"))
+}
+
+type testTarFile struct{ name, content string }
+
+func writeTestTar(t *testing.T, files []testTarFile) string {
+	f, err := ioutil.TempFile("", "rocker-s3-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	tw := tar.NewWriter(f)
+	for _, file := range files {
+		if err := tw.WriteHeader(&tar.Header{Name: file.name, Mode: 0644, Size: int64(len(file.content))}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(file.content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return f.Name()
+}
+
+func newTestStorage(endpoint string) *StorageS3 {
+	cfg := &aws.Config{
+		Region:           aws.String("us-east-1"),
+		Endpoint:         aws.String(endpoint),
+		S3ForcePathStyle: aws.Bool(true),
+		Credentials:      credentials.NewStaticCredentials("id", "secret", ""),
+	}
+	return &StorageS3{
+		s3:      s3.New(session.New(), cfg),
+		retryer: NewRetryer(1, 1),
+	}
+}
+
+// fakeBucket serves HEAD, GET and PUT of the whole objects, which is enough for the small files
+type fakeBucket struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+}
+
+func newFakeBucket() *fakeBucket {
+	return &fakeBucket{objects: map[string][]byte{}}
+}
+
+func (b *fakeBucket) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	key := strings.TrimPrefix(r.URL.Path, "/bucket/")
+
+	switch r.Method {
+	case "PUT":
+		data, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			w.WriteHeader(500)
+			return
+		}
+		b.objects[key] = data
+	case "HEAD", "GET":
+		data, ok := b.objects[key]
+		if !ok {
+			w.WriteHeader(404)
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		if r.Header.Get("Range") != "" {
+			w.Header().Set("Content-Range", "bytes 0-"+strconv.Itoa(len(data)-1)+"/"+strconv.Itoa(len(data)))
+			w.WriteHeader(206)
+		}
+		if r.Method == "GET" {
+			w.Write(data)
+		}
+	default:
+		w.WriteHeader(405)
+	}
+}
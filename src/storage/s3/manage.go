@@ -0,0 +1,240 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package s3
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/grammarly/rocker/src/imagename"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+const (
+	s3Prefix    = "s3.amazonaws.com/"
+	s3OldPrefix = "s3:"
+
+	digestPrefix = "sha256-"
+	tarExt       = ".tar"
+)
+
+// Object describes an image tarball stored on S3, either a tag alias
+// or a content addressable copy named by the digest
+type Object struct {
+	Name     string
+	Tag      string
+	Digest   string
+	ImageID  string
+	Size     int64
+	Uploaded time.Time
+}
+
+// IsDigest returns true for the content addressable copies
+func (o Object) IsDigest() bool {
+	return strings.HasPrefix(o.Tag, digestPrefix)
+}
+
+// ParseLocation splits s3.amazonaws.com/<bucket>[/<prefix>] into the bucket and the prefix
+func ParseLocation(location string) (bucket, prefix string, err error) {
+	var trimmed string
+
+	switch {
+	case strings.HasPrefix(location, s3Prefix):
+		trimmed = strings.TrimPrefix(location, s3Prefix)
+	case strings.HasPrefix(location, s3OldPrefix):
+		trimmed = strings.TrimPrefix(location, s3OldPrefix)
+	default:
+		return "", "", fmt.Errorf("Invalid S3 location %s, expected %s<bucket>[/<prefix>]", location, s3Prefix)
+	}
+
+	parts := strings.SplitN(trimmed, "/", 2)
+	if parts[0] == "" {
+		return "", "", fmt.Errorf("Invalid S3 location %s, missing bucket name", location)
+	}
+	if len(parts) == 2 {
+		prefix = parts[1]
+	}
+
+	return parts[0], prefix, nil
+}
+
+// List returns the image tarballs stored in the bucket under the prefix,
+// sorted by name and tag; the content addressable copies are included only
+// if all is true. The digests of the tag aliases are read from the metadata.
+func (s *StorageS3) List(bucket, prefix string, all bool) (objects []Object, err error) {
+	params := &s3.ListObjectsInput{
+		Bucket: aws.String(bucket),
+		Prefix: aws.String(prefix),
+	}
+
+	err = s.s3.ListObjectsPages(params, func(page *s3.ListObjectsOutput, lastPage bool) bool {
+		for _, obj := range page.Contents {
+			o, ok := objectFromKey(bucket, *obj.Key)
+			if !ok || (o.IsDigest() && !all) {
+				continue
+			}
+			o.Size = *obj.Size
+			o.Uploaded = *obj.LastModified
+			objects = append(objects, o)
+		}
+		return true
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Failed to list objects of S3 bucket %s, error: %s", bucket, err)
+	}
+
+	for i := range objects {
+		if err := s.readMetadata(bucket, &objects[i]); err != nil {
+			return nil, err
+		}
+	}
+
+	sort.Sort(objectsByName(objects))
+
+	return objects, nil
+}
+
+// Delete removes the image tag from S3, and the content addressable copy
+// it refers to if no other tags of the image refer to it; a digest can be
+// removed only if it is not referenced by the tags
+func (s *StorageS3) Delete(imageName string) (removed []string, err error) {
+	img := imagename.NewFromString(imageName)
+
+	if img.Storage != imagename.StorageS3 {
+		return nil, fmt.Errorf("Can only delete images with s3 storage specified, got: %s", img)
+	}
+	if !img.HasTag() {
+		return nil, fmt.Errorf("Image tag should be specified to delete the image, got: %s", img)
+	}
+
+	name := s3Prefix + img.Registry + "/" + img.Name
+	objects, err := s.List(img.Registry, img.Name+"/", true)
+	if err != nil {
+		return nil, err
+	}
+
+	var target *Object
+	for i := range objects {
+		if objects[i].Name == name && objects[i].Tag == img.Tag {
+			target = &objects[i]
+		}
+	}
+	if target == nil {
+		return nil, fmt.Errorf("Image %s not found on S3", img)
+	}
+
+	digest := target.Digest
+	referenced := []string{}
+
+	for _, o := range objects {
+		if o.Name == name && !o.IsDigest() && o.Tag != img.Tag && o.Digest == digest {
+			referenced = append(referenced, o.Tag)
+		}
+	}
+
+	if target.IsDigest() && len(referenced) > 0 {
+		return nil, fmt.Errorf("Image %s is referenced by the tags: %s, delete them first", img, strings.Join(referenced, ", "))
+	}
+
+	if err := s.deleteObject(img.Registry, img.Name, img.Tag); err != nil {
+		return removed, err
+	}
+	removed = append(removed, name+":"+img.Tag)
+
+	if target.IsDigest() || digest == "" || len(referenced) > 0 {
+		return removed, nil
+	}
+
+	for _, o := range objects {
+		if o.Name == name && o.Tag == digest {
+			if err := s.deleteObject(img.Registry, img.Name, digest); err != nil {
+				return removed, err
+			}
+			removed = append(removed, name+":"+digest)
+		}
+	}
+
+	return removed, nil
+}
+
+// deleteObject removes the image tarball and its manifest, if any
+func (s *StorageS3) deleteObject(bucket, name, tag string) error {
+	for _, key := range []string{name + "/" + tag + tarExt, manifestKey(name, tag)} {
+		if _, err := s.s3.DeleteObject(&s3.DeleteObjectInput{
+			Bucket: aws.String(bucket),
+			Key:    aws.String(key),
+		}); err != nil {
+			return fmt.Errorf("Failed to delete object %s from S3 bucket %s, error: %s", key, bucket, err)
+		}
+	}
+	return nil
+}
+
+// readMetadata fills in the digest and the image id of the object
+// from the metadata stored by Push
+func (s *StorageS3) readMetadata(bucket string, o *Object) error {
+	if o.IsDigest() {
+		o.Digest = o.Tag
+	}
+
+	key := strings.TrimPrefix(o.Name, s3Prefix+bucket+"/") + "/" + o.Tag + tarExt
+
+	resp, err := s.s3.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return fmt.Errorf("Failed to read metadata of object %s from S3 bucket %s, error: %s", key, bucket, err)
+	}
+
+	if v, ok := resp.Metadata["Digest"]; ok && v != nil {
+		o.Digest = *v
+	}
+	if v, ok := resp.Metadata["Imageid"]; ok && v != nil {
+		o.ImageID = *v
+	}
+
+	return nil
+}
+
+// objectFromKey parses the key of the form <image>/<tag>.tar
+func objectFromKey(bucket, key string) (o Object, ok bool) {
+	i := strings.LastIndex(key, "/")
+	if i <= 0 || !strings.HasSuffix(key, tarExt) {
+		return o, false
+	}
+
+	o.Name = s3Prefix + bucket + "/" + key[:i]
+	o.Tag = strings.TrimSuffix(key[i+1:], tarExt)
+
+	return o, o.Tag != ""
+}
+
+type objectsByName []Object
+
+func (a objectsByName) Len() int      { return len(a) }
+func (a objectsByName) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a objectsByName) Less(i, j int) bool {
+	if a[i].Name != a[j].Name {
+		return a[i].Name < a[j].Name
+	}
+	return a[i].Tag < a[j].Tag
+}
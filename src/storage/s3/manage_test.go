@@ -0,0 +1,66 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package s3
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseLocation(t *testing.T) {
+	tests := []struct {
+		location, bucket, prefix string
+	}{
+		{"s3.amazonaws.com/bucket", "bucket", ""},
+		{"s3.amazonaws.com/bucket/", "bucket", ""},
+		{"s3.amazonaws.com/bucket/images/app", "bucket", "images/app"},
+		{"s3:bucket/app", "bucket", "app"},
+	}
+
+	for _, test := range tests {
+		bucket, prefix, err := ParseLocation(test.location)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, test.bucket, bucket, test.location)
+		assert.Equal(t, test.prefix, prefix, test.location)
+	}
+
+	_, _, err := ParseLocation("bucket/app")
+	assert.EqualError(t, err, "Invalid S3 location bucket/app, expected s3.amazonaws.com/<bucket>[/<prefix>]")
+
+	_, _, err = ParseLocation("s3.amazonaws.com/")
+	assert.EqualError(t, err, "Invalid S3 location s3.amazonaws.com/, missing bucket name")
+}
+
+func TestObjectFromKey(t *testing.T) {
+	o, ok := objectFromKey("bucket", "images/app/1.2.tar")
+	assert.True(t, ok)
+	assert.Equal(t, "s3.amazonaws.com/bucket/images/app", o.Name)
+	assert.Equal(t, "1.2", o.Tag)
+	assert.False(t, o.IsDigest())
+
+	o, ok = objectFromKey("bucket", "app/sha256-fafa.tar")
+	assert.True(t, ok)
+	assert.True(t, o.IsDigest())
+
+	for _, key := range []string{"app.tar", "app/readme.txt", "app/.tar"} {
+		_, ok := objectFromKey("bucket", key)
+		assert.False(t, ok, key)
+	}
+}
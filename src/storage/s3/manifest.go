@@ -0,0 +1,209 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package s3
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+const (
+	// manifestExt is the extension of the OCI manifests stored next to the image tarballs
+	manifestExt = ".manifest.json"
+
+	// dockerManifest is the file describing the image in the tarballs made by docker save 1.10+
+	dockerManifest = "manifest.json"
+
+	// The media types of the OCI image spec
+	ociManifestMediaType = "application/vnd.oci.image.manifest.v1+json"
+	ociConfigMediaType   = "application/vnd.oci.image.config.v1+json"
+	ociLayerMediaType    = "application/vnd.oci.image.layer.v1.tar"
+
+	// The annotations of the manifests
+	annotationCreated     = "org.opencontainers.image.created"
+	annotationImageID     = "com.grammarly.rocker.image-id"
+	annotationDigest      = "com.grammarly.rocker.digest"
+	annotationTarball     = "com.grammarly.rocker.tarball"
+	annotationLayout      = "com.grammarly.rocker.layout"
+	annotationLayerKey    = "com.grammarly.rocker.layer-key"
+	annotationCompression = "com.grammarly.rocker.compression"
+)
+
+// Descriptor is the OCI content descriptor of the image config or a layer
+type Descriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// Manifest is the OCI image manifest of the image tarball stored on S3, it lets
+// other tools read the config and the layer digests without loading the image
+// into a daemon. The layers pushed separately are annotated with their keys.
+type Manifest struct {
+	SchemaVersion int               `json:"schemaVersion"`
+	MediaType     string            `json:"mediaType"`
+	Config        Descriptor        `json:"config"`
+	Layers        []Descriptor      `json:"layers"`
+	Annotations   map[string]string `json:"annotations,omitempty"`
+}
+
+// imageManifest makes the OCI manifest of the image tarball made by MakeTar;
+// the tarballs of docker older than 1.10 have no manifest.json to make it of
+func imageManifest(fileName string, annotations map[string]string, layers bool) (*Manifest, error) {
+	fd, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+
+	var (
+		tr          = tar.NewReader(fd)
+		descriptors = map[string]Descriptor{}
+		manifest    []byte
+	)
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read tar content, error: %s", err)
+		}
+		if !hdr.FileInfo().Mode().IsRegular() {
+			continue
+		}
+
+		if hdr.Name == dockerManifest {
+			if manifest, err = ioutil.ReadAll(tr); err != nil {
+				return nil, fmt.Errorf("Failed to read tar content, error: %s", err)
+			}
+			continue
+		}
+
+		hash := sha256.New()
+		size, err := io.Copy(hash, tr)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read tar content, error: %s", err)
+		}
+		descriptors[hdr.Name] = Descriptor{Digest: fmt.Sprintf("sha256:%x", hash.Sum(nil)), Size: size}
+	}
+
+	if manifest == nil {
+		return nil, fmt.Errorf("The image tarball has no %s, it is made by docker older than 1.10", dockerManifest)
+	}
+
+	images := []struct {
+		Config string
+		Layers []string
+	}{}
+	if err := json.Unmarshal(manifest, &images); err != nil {
+		return nil, fmt.Errorf("Failed to parse %s of the image tarball, error: %s", dockerManifest, err)
+	}
+	if len(images) != 1 {
+		return nil, fmt.Errorf("Expected one image in %s of the image tarball, got %d", dockerManifest, len(images))
+	}
+
+	config, ok := descriptors[images[0].Config]
+	if !ok {
+		return nil, fmt.Errorf("The image tarball has no config %s", images[0].Config)
+	}
+	config.MediaType = ociConfigMediaType
+
+	m := &Manifest{
+		SchemaVersion: 2,
+		MediaType:     ociManifestMediaType,
+		Config:        config,
+		Layers:        []Descriptor{},
+		Annotations:   annotations,
+	}
+
+	for _, name := range images[0].Layers {
+		layer, ok := descriptors[name]
+		if !ok {
+			return nil, fmt.Errorf("The image tarball has no layer %s", name)
+		}
+		layer.MediaType = ociLayerMediaType
+		if layers {
+			layer.Annotations = map[string]string{
+				annotationLayerKey: layerKey(digestPrefix + strings.TrimPrefix(layer.Digest, "sha256:")),
+			}
+		}
+		m.Layers = append(m.Layers, layer)
+	}
+
+	return m, nil
+}
+
+// pushManifest uploads the manifest to the key
+func (s *StorageS3) pushManifest(bucket, key string, m *Manifest) error {
+	body, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	log.Infof("| Uploading manifest to s3.amazonaws.com/%s/%s", bucket, key)
+
+	if err := s.retryer.Outer(func() error {
+		_, err := s.s3.PutObject(&s3.PutObjectInput{
+			Bucket:      aws.String(bucket),
+			Key:         aws.String(key),
+			ContentType: aws.String(ociManifestMediaType),
+			Body:        bytes.NewReader(body),
+		})
+		return err
+	}); err != nil {
+		return fmt.Errorf("Failed to upload manifest to S3, error: %s", err)
+	}
+
+	return nil
+}
+
+// copyManifest makes the tag alias of the manifest; the images pushed
+// by the older rocker versions have no manifest, they are skipped
+func (s *StorageS3) copyManifest(bucket, from, to string) error {
+	_, err := s.s3.CopyObject(&s3.CopyObjectInput{
+		Bucket:     aws.String(bucket),
+		CopySource: aws.String(bucket + "/" + from),
+		Key:        aws.String(to),
+	})
+	if e, ok := err.(awserr.RequestFailure); ok && e.StatusCode() == 404 {
+		log.Debugf("| No manifest s3.amazonaws.com/%s/%s to alias", bucket, from)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("Failed to PUT object to S3, error: %s", err)
+	}
+	return nil
+}
+
+func manifestKey(name, tag string) string {
+	return name + "/" + tag + manifestExt
+}
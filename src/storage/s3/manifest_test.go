@@ -0,0 +1,111 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package s3
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestImageManifest(t *testing.T) {
+	fileName := writeTestTar(t, []testTarFile{
+		{"base/json", "{}"},
+		{"base/layer.tar", "base layer"},
+		{"app/json", `{"parent":"base"}`},
+		{"app/layer.tar", "app layer"},
+		{"cfg.json", `{"architecture":"amd64"}`},
+		{"manifest.json", `[{"Config":"cfg.json","RepoTags":["app:1"],"Layers":["base/layer.tar","app/layer.tar"]}]`},
+		{"repositories", `{"app":{"1":"app"}}`},
+	})
+	defer os.Remove(fileName)
+
+	m, err := imageManifest(fileName, map[string]string{annotationImageID: "123"}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, 2, m.SchemaVersion)
+	assert.Equal(t, ociManifestMediaType, m.MediaType)
+	assert.Equal(t, "123", m.Annotations[annotationImageID])
+
+	assert.Equal(t, ociConfigMediaType, m.Config.MediaType)
+	assert.Equal(t, "sha256:7a822ccae77597a100cf9fc3c978900e078ba56fd821da9860739c68232ea417", m.Config.Digest)
+	assert.EqualValues(t, 24, m.Config.Size)
+
+	if assert.Len(t, m.Layers, 2) {
+		assert.Equal(t, ociLayerMediaType, m.Layers[0].MediaType)
+		assert.EqualValues(t, 10, m.Layers[0].Size)
+		assert.EqualValues(t, 9, m.Layers[1].Size)
+		assert.Equal(t, "sha256:bf1f86c98c9625a38922cbd7f57b12cabe5817a82d950a83f072a744d2c1db66", m.Layers[1].Digest)
+		assert.Equal(t, "_layers/sha256-bf1f86c98c9625a38922cbd7f57b12cabe5817a82d950a83f072a744d2c1db66.layer", m.Layers[1].Annotations[annotationLayerKey])
+	}
+}
+
+func TestImageManifest_NoDockerManifest(t *testing.T) {
+	fileName := writeTestTar(t, []testTarFile{
+		{"base/json", "{}"},
+		{"base/layer.tar", "base layer"},
+	})
+	defer os.Remove(fileName)
+
+	_, err := imageManifest(fileName, nil, false)
+	assert.EqualError(t, err, "The image tarball has no manifest.json, it is made by docker older than 1.10")
+}
+
+func TestImageManifest_MissingLayer(t *testing.T) {
+	fileName := writeTestTar(t, []testTarFile{
+		{"cfg.json", "{}"},
+		{"manifest.json", `[{"Config":"cfg.json","Layers":["base/layer.tar"]}]`},
+	})
+	defer os.Remove(fileName)
+
+	_, err := imageManifest(fileName, nil, false)
+	assert.EqualError(t, err, "The image tarball has no layer base/layer.tar")
+}
+
+func TestPushManifest(t *testing.T) {
+	bucket := newFakeBucket()
+	srv := httptest.NewServer(bucket)
+	defer srv.Close()
+
+	storage := newTestStorage(srv.URL)
+
+	m := &Manifest{
+		SchemaVersion: 2,
+		MediaType:     ociManifestMediaType,
+		Config:        Descriptor{MediaType: ociConfigMediaType, Digest: "sha256:abc", Size: 2},
+		Layers:        []Descriptor{},
+	}
+	if err := storage.pushManifest("bucket", manifestKey("app", "sha256-123"), m); err != nil {
+		t.Fatal(err)
+	}
+
+	data, ok := bucket.objects["app/sha256-123.manifest.json"]
+	if !assert.True(t, ok, "manifest should be uploaded") {
+		return
+	}
+
+	stored := Manifest{}
+	if err := json.Unmarshal(data, &stored); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, *m, stored)
+}
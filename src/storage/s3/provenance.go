@@ -0,0 +1,62 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package s3
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/grammarly/rocker/src/imagename"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	provenanceExt       = ".provenance.json"
+	provenanceMediaType = "application/vnd.in-toto+json"
+)
+
+// PushProvenance uploads the provenance document of the image next to it,
+// as <name>/<tag>.provenance.json
+func (s *StorageS3) PushProvenance(imageName string, data []byte) error {
+	img := imagename.NewFromString(imageName)
+
+	if img.Storage != imagename.StorageS3 {
+		return fmt.Errorf("Can only push provenance of images with s3 storage specified, got: %s", img)
+	}
+
+	key := img.Name + "/" + img.Tag + provenanceExt
+
+	log.Infof("| Uploading provenance to s3.amazonaws.com/%s/%s", img.Registry, key)
+
+	if err := s.retryer.Outer(func() error {
+		_, err := s.s3.PutObject(&s3.PutObjectInput{
+			Bucket:      aws.String(img.Registry),
+			Key:         aws.String(key),
+			ContentType: aws.String(provenanceMediaType),
+			Body:        bytes.NewReader(data),
+		})
+		return err
+	}); err != nil {
+		return fmt.Errorf("Failed to upload provenance to S3, error: %s", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,148 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package s3
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/grammarly/rocker/src/imagename"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/fsouza/go-dockerclient"
+)
+
+// pullHelperSocket is the docker socket on the daemon host the pull helper loads the image through
+const pullHelperSocket = "/var/run/docker.sock"
+
+// pullHelperScript streams the tarball from S3 to the daemon, so that it never touches
+// the client machine; the helper image should have sh, the aws cli and curl
+const pullHelperScript = `set -e
+aws s3 cp "$ROCKER_S3_URL" - | curl -sSf --unix-socket ` + pullHelperSocket + ` -T - -X POST -H "Content-Type: application/x-tar" http://localhost/images/load >/dev/null`
+
+// pullHelperEnv are the AWS settings passed to the pull helper if they are set on the client,
+// otherwise the helper relies on the instance profile of the daemon host
+var pullHelperEnv = []string{
+	"AWS_ACCESS_KEY_ID",
+	"AWS_SECRET_ACCESS_KEY",
+	"AWS_SESSION_TOKEN",
+	"AWS_DEFAULT_REGION",
+	"AWS_REGION",
+}
+
+// pullRemote loads the image tarball by the helper container run on the daemon host
+// and tags the image it contains, which is known from the metadata stored by Push
+func (s *StorageS3) pullRemote(img *imagename.ImageName, imageID string) error {
+	if err := s.ensureImage(s.PullHelper); err != nil {
+		return err
+	}
+
+	opts := pullHelperOptions(s.PullHelper, img, os.Environ())
+
+	container, err := s.client.CreateContainer(opts)
+	if err != nil {
+		return fmt.Errorf("Failed to create S3 pull helper container, error: %s", err)
+	}
+	defer func() {
+		if err := s.client.RemoveContainer(docker.RemoveContainerOptions{ID: container.ID, Force: true, RemoveVolumes: true}); err != nil {
+			log.Errorf("Failed to remove S3 pull helper container %.12s, error: %s", container.ID, err)
+		}
+	}()
+
+	log.Infof("| Import %s/%s.tar on the docker host with %s", img.NameWithRegistry(), img.Tag, s.PullHelper)
+
+	if err := s.client.StartContainer(container.ID, opts.HostConfig); err != nil {
+		return fmt.Errorf("Failed to start S3 pull helper container, error: %s", err)
+	}
+
+	exitCode, err := s.client.WaitContainer(container.ID)
+	if err != nil {
+		return fmt.Errorf("Failed to wait for S3 pull helper container, error: %s", err)
+	}
+	if exitCode != 0 {
+		var stderr bytes.Buffer
+		s.client.Logs(docker.LogsOptions{
+			Container:    container.ID,
+			OutputStream: ioutil.Discard,
+			ErrorStream:  &stderr,
+			Stderr:       true,
+		})
+		return fmt.Errorf("S3 pull helper failed with exit code %d: %s", exitCode, strings.TrimSpace(stderr.String()))
+	}
+
+	if _, err := s.client.InspectImage(imageID); err != nil {
+		return fmt.Errorf("Image %.12s is not found after the S3 pull helper loaded %s, error: %s", imageID, img, err)
+	}
+
+	return s.client.TagImage(imageID, docker.TagImageOptions{
+		Repo:  img.NameWithRegistry(),
+		Tag:   img.GetTag(),
+		Force: true,
+	})
+}
+
+// ensureImage pulls the image from its registry if the daemon does not have it
+func (s *StorageS3) ensureImage(name string) error {
+	if _, err := s.client.InspectImage(name); err == nil {
+		return nil
+	} else if err != docker.ErrNoSuchImage {
+		return err
+	}
+
+	img := imagename.NewFromString(name)
+
+	log.Infof("| Pull S3 pull helper image %s", img)
+
+	if err := s.client.PullImage(docker.PullImageOptions{
+		Repository:   img.NameWithRegistry(),
+		Tag:          img.GetTag(),
+		OutputStream: ioutil.Discard,
+	}, docker.AuthConfiguration{}); err != nil {
+		return fmt.Errorf("Failed to pull S3 pull helper image %s, error: %s", img, err)
+	}
+	return nil
+}
+
+// pullHelperOptions makes the helper container downloading the tarball of the image
+func pullHelperOptions(helper string, img *imagename.ImageName, environ []string) docker.CreateContainerOptions {
+	env := []string{fmt.Sprintf("ROCKER_S3_URL=s3://%s/%s/%s%s", img.Registry, img.Name, img.Tag, tarExt)}
+	for _, kv := range environ {
+		for _, name := range pullHelperEnv {
+			if strings.HasPrefix(kv, name+"=") {
+				env = append(env, kv)
+			}
+		}
+	}
+
+	hostConfig := &docker.HostConfig{
+		Binds: []string{pullHelperSocket + ":" + pullHelperSocket},
+	}
+
+	return docker.CreateContainerOptions{
+		Config: &docker.Config{
+			Image:      helper,
+			Entrypoint: []string{"/bin/sh", "-c"},
+			Cmd:        []string{pullHelperScript},
+			Env:        env,
+			Labels:     map[string]string{"rocker-s3-pull-helper": img.String()},
+		},
+		HostConfig: hostConfig,
+	}
+}
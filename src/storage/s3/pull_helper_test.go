@@ -0,0 +1,45 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package s3
+
+import (
+	"testing"
+
+	"github.com/grammarly/rocker/src/imagename"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPullHelperOptions(t *testing.T) {
+	img := imagename.NewFromString("s3.amazonaws.com/bucket/app:1.2")
+
+	opts := pullHelperOptions("amazon/aws-cli", img, []string{
+		"HOME=/root",
+		"AWS_ACCESS_KEY_ID=key",
+		"AWS_SECRET_ACCESS_KEY=secret",
+		"AWS_REGIONS=not-this-one",
+	})
+
+	assert.Equal(t, "amazon/aws-cli", opts.Config.Image)
+	assert.Equal(t, []string{"/bin/sh", "-c"}, opts.Config.Entrypoint)
+	assert.Equal(t, []string{pullHelperScript}, opts.Config.Cmd)
+	assert.Equal(t, []string{
+		"ROCKER_S3_URL=s3://bucket/app/1.2.tar",
+		"AWS_ACCESS_KEY_ID=key",
+		"AWS_SECRET_ACCESS_KEY=secret",
+	}, opts.Config.Env)
+	assert.Equal(t, []string{"/var/run/docker.sock:/var/run/docker.sock"}, opts.HostConfig.Binds)
+}
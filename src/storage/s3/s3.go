@@ -22,15 +22,19 @@ import (
 	"encoding/json"
 	"fmt"
 	"github.com/grammarly/rocker/src/imagename"
+	"github.com/grammarly/rocker/src/util"
 	"io"
 	"io/ioutil"
+	"net/url"
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
@@ -40,6 +44,12 @@ import (
 
 const (
 	cacheDir = "_digests"
+
+	// TempFilePrefix is the prefix of the temporary files with image tarballs
+	TempFilePrefix = "rocker_image_"
+
+	// expiresObjectTag is the object tag of the images pushed with PUSH --expires
+	expiresObjectTag = "rocker-expires"
 )
 
 // Repositories is a struct that serializes to a "repositories" file
@@ -54,6 +64,19 @@ type StorageS3 struct {
 	cacheRoot string
 	s3        *s3.S3
 	retryer   *Retryer
+	stats     pushStats
+
+	// Layers makes Push upload the image layers as separate objects shared by all
+	// the images in the bucket, so that the layers the bucket has are not uploaded again
+	Layers bool
+
+	// PullHelper is the image with the aws cli and curl that Pull runs on the docker host
+	// to load the tarball from S3 directly into the daemon, optional
+	PullHelper string
+
+	// Compression is the compression of the pushed tarballs, zstd, gzip or none (empty);
+	// the tarballs are decompressed on pull by the Compression metadata of the object
+	Compression string
 }
 
 // New makes an instance of StorageS3 storage driver
@@ -71,14 +94,24 @@ func New(client *docker.Client, cacheRoot string) *StorageS3 {
 		cfg.LogLevel = aws.LogLevel(aws.LogDebugWithRequestErrors)
 	}
 
+	svc := s3.New(session.New(), cfg)
+	svc.Handlers.Validate.PushBack(checkOffline)
+
 	return &StorageS3{
 		client:    client,
 		cacheRoot: cacheRoot,
-		s3:        s3.New(session.New(), cfg),
+		s3:        svc,
 		retryer:   retryer,
 	}
 }
 
+// checkOffline fails the S3 requests before they are sent in offline mode
+func checkOffline(r *request.Request) {
+	if err := util.CheckOffline("request S3 %s", r.Operation.Name); err != nil {
+		r.Error = err
+	}
+}
+
 // Push pushes image tarball directly to S3
 func (s *StorageS3) Push(imageName string) (digest string, err error) {
 	img := imagename.NewFromString(imageName)
@@ -104,7 +137,7 @@ func (s *StorageS3) Push(imageName string) (digest string, err error) {
 
 	defer func() {
 		if tmpf != "" {
-			os.Remove(tmpf)
+			util.RemoveTempFile(tmpf)
 		}
 	}()
 
@@ -149,7 +182,57 @@ func (s *StorageS3) Push(imageName string) (digest string, err error) {
 			u.PartSize = 64 * 1024 * 1024 // 64MB per part
 		})
 
-		fd, err := os.Open(tmpf)
+		metadata := map[string]*string{
+			"Tag":     aws.String(img.Tag),
+			"ImageID": aws.String(image.ID),
+			"Digest":  aws.String(digest),
+		}
+
+		// The manifest is made of the whole tarball, before the layers are taken out of it
+		manifest, err := imageManifest(tmpf, map[string]string{
+			annotationCreated: image.Created.UTC().Format(time.RFC3339),
+			annotationImageID: image.ID,
+			annotationDigest:  digest,
+			annotationTarball: imgPathDigest,
+		}, s.Layers)
+		if err != nil {
+			log.Warnf("| Skip the OCI manifest of the image, error: %s", err)
+		}
+
+		body := tmpf
+		if s.Layers {
+			skeleton, stats, err := s.pushLayers(img.Registry, tmpf)
+			if err != nil {
+				return "", err
+			}
+			defer util.RemoveTempFile(skeleton)
+
+			log.Infof("| Layers: %s", stats)
+
+			body = skeleton
+			metadata["Layout"] = aws.String(layoutLayers)
+			if manifest != nil {
+				manifest.Annotations[annotationLayout] = layoutLayers
+			}
+		}
+
+		contentType := "application/x-tar"
+		if s.Compression != "" && s.Compression != CompressionNone {
+			compressed, err := s.compress(body)
+			if err != nil {
+				return "", err
+			}
+			defer util.RemoveTempFile(compressed)
+
+			body = compressed
+			contentType = compressionContentTypes[s.Compression]
+			metadata["Compression"] = aws.String(s.Compression)
+			if manifest != nil {
+				manifest.Annotations[annotationCompression] = s.Compression
+			}
+		}
+
+		fd, err := os.Open(body)
 		if err != nil {
 			return "", err
 		}
@@ -160,13 +243,9 @@ func (s *StorageS3) Push(imageName string) (digest string, err error) {
 		uploadParams := &s3manager.UploadInput{
 			Bucket:      aws.String(img.Registry),
 			Key:         aws.String(imgPathDigest),
-			ContentType: aws.String("application/x-tar"),
+			ContentType: aws.String(contentType),
 			Body:        fd,
-			Metadata: map[string]*string{
-				"Tag":     aws.String(img.Tag),
-				"ImageID": aws.String(image.ID),
-				"Digest":  aws.String(digest),
-			},
+			Metadata:    metadata,
 		}
 
 		if err := s.retryer.Outer(func() error {
@@ -175,6 +254,12 @@ func (s *StorageS3) Push(imageName string) (digest string, err error) {
 		}); err != nil {
 			return "", fmt.Errorf("Failed to upload object to S3, error: %s", err)
 		}
+
+		if manifest != nil {
+			if err := s.pushManifest(img.Registry, manifestKey(img.Name, digest), manifest); err != nil {
+				return "", err
+			}
+		}
 	}
 
 	// Make a content addressable copy of an image file
@@ -186,10 +271,24 @@ func (s *StorageS3) Push(imageName string) (digest string, err error) {
 
 	log.Infof("| Make alias s3.amazonaws.com/%s/%s", img.Registry, imgPathTag)
 
-	if _, err = s.s3.CopyObject(copyParams); err != nil {
+	// The alias of the expiring image is tagged, so the lifecycle rules of the
+	// bucket can remove it; the content addressable copy may be shared with
+	// the images that never expire
+	req, _ := s.s3.CopyObjectRequest(copyParams)
+	if image.Config != nil && image.Config.Labels[imagename.ExpiresLabel] != "" {
+		tagging := url.Values{expiresObjectTag: {image.Config.Labels[imagename.ExpiresLabel]}}
+		req.HTTPRequest.Header.Set("X-Amz-Tagging", tagging.Encode())
+		req.HTTPRequest.Header.Set("X-Amz-Tagging-Directive", "REPLACE")
+	}
+
+	if err = req.Send(); err != nil {
 		return "", fmt.Errorf("Failed to PUT object to S3, error: %s", err)
 	}
 
+	if err := s.copyManifest(img.Registry, manifestKey(img.Name, digest), manifestKey(img.Name, img.Tag)); err != nil {
+		return "", err
+	}
+
 	return digest, nil
 }
 
@@ -205,12 +304,37 @@ func (s *StorageS3) Pull(name string) error {
 		return fmt.Errorf("Cannot pull image from S3, missing bucket name, got: %s", img)
 	}
 
-	// TODO: here we use tmp file, but we can stream from S3 directly to Docker
-	tmpf, err := ioutil.TempFile("", "rocker_image_")
+	head, err := s.headImage(img)
 	if err != nil {
 		return err
 	}
-	defer os.Remove(tmpf.Name())
+	expected := digestFromMetadata(img, head.Metadata)
+	layered := metadataValue(head.Metadata, "Layout") == layoutLayers
+	compression := metadataValue(head.Metadata, "Compression")
+	if compression == CompressionNone {
+		compression = ""
+	}
+
+	if s.PullHelper != "" {
+		imageID := metadataValue(head.Metadata, "ImageID")
+		switch {
+		case layered:
+			log.Warnf("| %s is pushed with the layers separately, which the S3 pull helper does not support, pull it locally", img)
+		case imageID == "":
+			log.Warnf("| No image id is stored for %s, which the S3 pull helper needs, pull it locally", img)
+		case compression == CompressionZstd:
+			log.Warnf("| %s is compressed with zstd, which the S3 pull helper does not support, pull it locally", img)
+		default:
+			log.Warnf("| The S3 pull helper does not verify the digest of %s", img)
+			return s.pullRemote(img, imageID)
+		}
+	}
+
+	tmpf, err := util.TempFile(TempFilePrefix)
+	if err != nil {
+		return err
+	}
+	defer util.RemoveTempFile(tmpf.Name())
 
 	var (
 		// Create a downloader with the s3 client and custom options
@@ -226,13 +350,90 @@ func (s *StorageS3) Pull(name string) error {
 		}
 	)
 
-	log.Infof("| Import %s/%s.tar to %s", img.NameWithRegistry(), img.Tag, tmpf.Name())
+	// The images pushed with the layers separately are downloaded
+	// as the references to the layers and put together here
+	var skeleton *os.File
+	if layered {
+		if skeleton, err = util.TempFile(TempFilePrefix); err != nil {
+			return err
+		}
+		defer util.RemoveTempFile(skeleton.Name())
+	}
+
+	// The compressed tarballs are downloaded aside and decompressed
+	var compressed *os.File
+	if compression != "" {
+		if compressed, err = util.TempFile(TempFilePrefix); err != nil {
+			return err
+		}
+		defer util.RemoveTempFile(compressed.Name())
+	}
 
-	if err := s.retryer.Outer(func() error {
-		_, err := downloader.Download(tmpf, downloadParams)
-		return err
-	}); err != nil {
-		return fmt.Errorf("Failed to download object from S3, error: %s", err)
+	// The tarball that does not match the digest is downloaded once again,
+	// in case it was corrupted on the way
+	for attempt := 1; ; attempt++ {
+		log.Infof("| Import %s/%s.tar to %s", img.NameWithRegistry(), img.Tag, tmpf.Name())
+
+		dst := tmpf
+		if skeleton != nil {
+			dst = skeleton
+		}
+
+		download := dst
+		if compressed != nil {
+			download = compressed
+		}
+
+		if err := s.retryer.Outer(func() error {
+			_, err := downloader.Download(download, downloadParams)
+			return err
+		}); err != nil {
+			return fmt.Errorf("Failed to download object from S3, error: %s", err)
+		}
+
+		if compressed != nil {
+			if err := decompressFile(compressed.Name(), compression, dst); err != nil {
+				return fmt.Errorf("Failed to decompress image %s with %s, error: %s", img, compression, err)
+			}
+		}
+
+		if skeleton != nil {
+			if err := s.pullLayers(img.Registry, skeleton.Name(), tmpf); err != nil {
+				return fmt.Errorf("Failed to assemble image %s from its layers, error: %s", img, err)
+			}
+		}
+
+		if expected == "" {
+			log.Warnf("| No digest is stored for %s, skip integrity check", img)
+			break
+		}
+
+		actual, err := tarDigest(tmpf.Name())
+		if err != nil {
+			return err
+		}
+		if actual == expected {
+			log.Infof("| Verified digest %s", actual)
+			break
+		}
+
+		mismatch := &DigestMismatchError{Image: img.String(), Expected: expected, Actual: actual}
+		if attempt == 2 {
+			return mismatch
+		}
+		log.Warnf("| %s, download again", mismatch)
+
+		for _, f := range []*os.File{tmpf, skeleton, compressed} {
+			if f == nil {
+				continue
+			}
+			if err := f.Truncate(0); err != nil {
+				return err
+			}
+			if _, err := f.Seek(0, 0); err != nil {
+				return err
+			}
+		}
 	}
 
 	fd, err := os.Open(tmpf.Name())
@@ -345,6 +546,110 @@ func (s *StorageS3) Pull(name string) error {
 	return nil
 }
 
+// DigestMismatchError is returned by Pull if the downloaded tarball
+// does not match the digest stored when the image was pushed
+type DigestMismatchError struct {
+	Image    string
+	Expected string
+	Actual   string
+}
+
+func (e *DigestMismatchError) Error() string {
+	return fmt.Sprintf("Image %s is corrupted, digest mismatch: expected %s, got %s", e.Image, e.Expected, e.Actual)
+}
+
+// Digest returns the digest of the image the tag currently points to
+func (s *StorageS3) Digest(img *imagename.ImageName) (string, error) {
+	digest, err := s.storedDigest(img)
+	if err != nil {
+		return "", err
+	}
+	if digest == "" {
+		return "", fmt.Errorf("No digest is stored for image %s", img)
+	}
+	return digest, nil
+}
+
+// storedDigest returns the digest of the image stored in the object metadata by Push,
+// the content addressable copies are named by their digest
+func (s *StorageS3) storedDigest(img *imagename.ImageName) (string, error) {
+	resp, err := s.headImage(img)
+	if err != nil {
+		return "", err
+	}
+	return digestFromMetadata(img, resp.Metadata), nil
+}
+
+// headImage reads the metadata of the image tarball
+func (s *StorageS3) headImage(img *imagename.ImageName) (*s3.HeadObjectOutput, error) {
+	resp, err := s.s3.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(img.Registry),
+		Key:    aws.String(img.Name + "/" + img.Tag + ".tar"),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read metadata of image %s from S3, error: %s", img, err)
+	}
+	return resp, nil
+}
+
+func digestFromMetadata(img *imagename.ImageName, metadata map[string]*string) string {
+	if v := metadataValue(metadata, "Digest"); v != "" {
+		return v
+	}
+	if strings.HasPrefix(img.Tag, digestPrefix) {
+		return img.Tag
+	}
+	return ""
+}
+
+// metadataValue returns the metadata value by key; the SDK returns the keys
+// canonicalized like the HTTP headers, e.g. ImageID as Imageid,
+// so they are compared case-insensitively
+func metadataValue(metadata map[string]*string, key string) string {
+	if v, ok := metadata[key]; ok && v != nil {
+		return *v
+	}
+	for k, v := range metadata {
+		if strings.EqualFold(k, key) && v != nil {
+			return *v
+		}
+	}
+	return ""
+}
+
+// tarDigest calculates the digest of the image tarball the same way
+// MakeTar does, i.e. of the content of all the files but "repositories"
+func tarDigest(fileName string) (string, error) {
+	fd, err := os.Open(fileName)
+	if err != nil {
+		return "", err
+	}
+	defer fd.Close()
+
+	var (
+		tr   = tar.NewReader(fd)
+		hash = sha256.New()
+	)
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", fmt.Errorf("Failed to read tar content, error: %s", err)
+		}
+		if hdr.Name == "repositories" {
+			continue
+		}
+		if _, err := io.Copy(hash, tr); err != nil {
+			return "", fmt.Errorf("Failed to read tar content, error: %s", err)
+		}
+	}
+
+	return fmt.Sprintf("%s%x", digestPrefix, hash.Sum(nil)), nil
+}
+
 // MakeTar makes a tar out of docker image and gives a temporary file and a digest
 func (s *StorageS3) MakeTar(imageName string) (tmpfile string, digest string, err error) {
 	img := imagename.NewFromString(imageName)
@@ -354,7 +659,7 @@ func (s *StorageS3) MakeTar(imageName string) (tmpfile string, digest string, er
 		return "", "", err
 	}
 
-	tmpf, err := ioutil.TempFile("", "rocker_image_")
+	tmpf, err := util.TempFile(TempFilePrefix)
 	if err != nil {
 		return "", "", err
 	}
@@ -362,7 +667,7 @@ func (s *StorageS3) MakeTar(imageName string) (tmpfile string, digest string, er
 
 	var (
 		cleanup = func() {
-			os.Remove(tmpf.Name())
+			util.RemoveTempFile(tmpf.Name())
 		}
 
 		humanSize = units.HumanSize(float64(image.VirtualSize))
@@ -414,7 +719,7 @@ func (s *StorageS3) MakeTar(imageName string) (tmpfile string, digest string, er
 	}
 
 	// Write "repositories" file
-	digest = fmt.Sprintf("sha256-%x", hash.Sum(nil))
+	digest = fmt.Sprintf("%s%x", digestPrefix, hash.Sum(nil))
 
 	reposBody, err := json.Marshal(Repositories{
 		img.NameWithRegistry(): {
@@ -455,6 +760,7 @@ func (s *StorageS3) MakeTar(imageName string) (tmpfile string, digest string, er
 
 	// Cache digest by image ID
 	if err := s.CachePut(image.ID, digest); err != nil {
+		cleanup()
 		return "", "", fmt.Errorf("Failed to save digest cache, error: %s", err)
 	}
 
@@ -477,6 +783,11 @@ func (s *StorageS3) ListTags(imageName string) (images []*imagename.ImageName, e
 	}
 
 	for _, s3Obj := range resp.Contents {
+		// Skip the manifests and the other files stored next to the tarballs
+		if !strings.HasSuffix(*s3Obj.Key, tarExt) {
+			continue
+		}
+
 		split := strings.Split(*s3Obj.Key, "/")
 		if len(split) < 2 {
 			continue
@@ -519,9 +830,9 @@ func (s *StorageS3) CacheGet(imageID string) (digest string, err error) {
 func (s *StorageS3) CachePut(imageID, digest string) error {
 	fileName := filepath.Join(s.cacheRoot, cacheDir, imageID)
 
-	if err := os.MkdirAll(filepath.Dir(fileName), 0755); err != nil {
+	if err := util.MkdirAllOutput(filepath.Dir(fileName), 0755); err != nil {
 		return err
 	}
 
-	return ioutil.WriteFile(fileName, []byte(digest), 0644)
+	return util.WriteOutputFile(fileName, []byte(digest), 0644)
 }
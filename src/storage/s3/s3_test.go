@@ -0,0 +1,82 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package s3
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTarDigest(t *testing.T) {
+	f, err := ioutil.TempFile("", "rocker-s3-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+
+	tw := tar.NewWriter(f)
+	for _, file := range []struct{ name, content string }{
+		{"layer/json", "{}"},
+		{"repositories", `{"app":{"1":"123"}}`},
+		{"layer/layer.tar", "data"},
+	} {
+		if err := tw.WriteHeader(&tar.Header{Name: file.name, Mode: 0644, Size: int64(len(file.content))}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(file.content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	digest, err := tarDigest(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// "repositories" is rewritten on pull, so it is not a part of the digest
+	assert.Equal(t, fmt.Sprintf("sha256-%x", sha256.Sum256([]byte("{}data"))), digest)
+}
+
+func TestDigestMismatchError(t *testing.T) {
+	err := &DigestMismatchError{Image: "s3.amazonaws.com/bucket/app:1", Expected: "sha256-aa", Actual: "sha256-bb"}
+	assert.EqualError(t, err, "Image s3.amazonaws.com/bucket/app:1 is corrupted, digest mismatch: expected sha256-aa, got sha256-bb")
+}
+
+func TestMetadataValue(t *testing.T) {
+	// The keys as the SDK returns them from HeadObject
+	metadata := map[string]*string{
+		"Digest":      aws.String("sha256-aa"),
+		"Imageid":     aws.String("sha256:123"),
+		"Compression": aws.String("gzip"),
+	}
+
+	assert.Equal(t, "sha256-aa", metadataValue(metadata, "Digest"))
+	assert.Equal(t, "sha256:123", metadataValue(metadata, "ImageID"))
+	assert.Equal(t, "gzip", metadataValue(metadata, "Compression"))
+	assert.Equal(t, "", metadataValue(metadata, "Layout"))
+}
@@ -0,0 +1,153 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package template
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+	"text/template/parse"
+)
+
+// The rendered text carries the invisible markers of the source lines, they are
+// placed at the start and after every newline of the template text and stripped
+// after rendering
+const (
+	lineMarkerStart = '\x1e'
+	lineMarkerEnd   = '\x1f'
+)
+
+// markLines puts the line markers into the text of all templates of tmpl
+func markLines(tmpl *template.Template, source string) {
+	for _, t := range tmpl.Templates() {
+		if t.Tree != nil && t.Tree.Root != nil {
+			markNode(t.Tree.Root, source)
+		}
+	}
+}
+
+func markNode(node parse.Node, source string) {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return
+		}
+		for _, child := range n.Nodes {
+			markNode(child, source)
+		}
+	case *parse.IfNode:
+		markNode(n.List, source)
+		markNode(n.ElseList, source)
+	case *parse.RangeNode:
+		markNode(n.List, source)
+		markNode(n.ElseList, source)
+	case *parse.WithNode:
+		markNode(n.List, source)
+		markNode(n.ElseList, source)
+	case *parse.TextNode:
+		pos := int(n.Pos)
+		if pos > len(source) {
+			pos = len(source)
+		}
+		line := 1 + strings.Count(source[:pos], "\n")
+
+		// the text may start a line in a range loop, so it is marked too
+		var text bytes.Buffer
+		fmt.Fprintf(&text, "%c%d%c", lineMarkerStart, line, lineMarkerEnd)
+		for _, c := range n.Text {
+			text.WriteByte(c)
+			if c == '\n' {
+				line++
+				fmt.Fprintf(&text, "%c%d%c", lineMarkerStart, line, lineMarkerEnd)
+			}
+		}
+		n.Text = text.Bytes()
+	}
+}
+
+// stripLines removes the line markers from the rendered text and returns
+// the source line of every rendered line
+func stripLines(rendered []byte) ([]byte, []int) {
+	var (
+		result    = make([]byte, 0, len(rendered))
+		lines     = []int{}
+		current   = 1
+		lineStart = true
+	)
+
+	for i := 0; i < len(rendered); i++ {
+		if rendered[i] == lineMarkerStart {
+			if end := bytes.IndexByte(rendered[i:], lineMarkerEnd); end > 0 {
+				if n, err := strconv.Atoi(string(rendered[i+1 : i+end])); err == nil {
+					current = n
+					i += end
+					continue
+				}
+			}
+		}
+		if lineStart {
+			lines = append(lines, current)
+			lineStart = false
+		}
+		result = append(result, rendered[i])
+		if rendered[i] == '\n' {
+			lineStart = true
+		}
+	}
+
+	return result, lines
+}
+
+// sourceExcerpt returns the line of the source the text/template error points
+// at, with a caret under the column if the error has one
+func sourceExcerpt(name, source string, err error) string {
+	re := regexp.MustCompile(regexp.QuoteMeta(name) + `:(\d+)(?::(\d+))?:`)
+
+	matches := re.FindStringSubmatch(err.Error())
+	if matches == nil {
+		return ""
+	}
+
+	lines := strings.Split(source, "\n")
+	line, _ := strconv.Atoi(matches[1])
+	if line < 1 || line > len(lines) {
+		return ""
+	}
+
+	text := strings.TrimRight(lines[line-1], "\r")
+	prefix := fmt.Sprintf("%4d | ", line)
+	excerpt := "\n" + prefix + text
+
+	if matches[2] != "" {
+		col, _ := strconv.Atoi(matches[2])
+		if col <= len(text) {
+			// keep the tabs so the caret lines up with the source
+			padding := strings.Map(func(r rune) rune {
+				if r == '\t' {
+					return r
+				}
+				return ' '
+			}, text[:col])
+			excerpt += "\n" + strings.Repeat(" ", len(prefix)-2) + "| " + padding + "^"
+		}
+	}
+
+	return excerpt
+}
@@ -0,0 +1,121 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package template
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/go-yaml/yaml"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Matrix describes the set of variable values to build a Rockerfile with;
+// every key maps to the list of values, the builds are made for every
+// combination of them, e.g.
+//
+//   jdk: [8, 11]
+//   distro: [debian, alpine]
+//
+// expands into four builds.
+type Matrix map[string][]interface{}
+
+// MatrixFromFile reads the matrix from either JSON or YAML file;
+// scalar values are treated as the single value lists
+func MatrixFromFile(filename string) (m Matrix, err error) {
+	log.Debugf("Load vars matrix from file %s", filename)
+
+	if filename, err = resolveFileName(filename); err != nil {
+		return nil, err
+	}
+
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	raw := map[string]interface{}{}
+
+	switch filepath.Ext(filename) {
+	case ".json":
+		err = json.Unmarshal(data, &raw)
+	default:
+		err = yaml.Unmarshal(data, &raw)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse vars matrix file %s, error: %s", filename, err)
+	}
+
+	m = Matrix{}
+	for k, v := range raw {
+		if list, ok := v.([]interface{}); ok {
+			if len(list) == 0 {
+				return nil, fmt.Errorf("Vars matrix %s has no values for %s", filename, k)
+			}
+			m[k] = list
+		} else {
+			m[k] = []interface{}{v}
+		}
+	}
+
+	return m, nil
+}
+
+// Expand returns the list of Vars for every combination of the matrix values;
+// the order is stable: keys are sorted and values go in the order of the file
+func (m Matrix) Expand() []Vars {
+	keys := []string{}
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	result := []Vars{Vars{}}
+
+	for _, k := range keys {
+		next := []Vars{}
+		for _, vars := range result {
+			for _, v := range m[k] {
+				combination := Vars{}
+				for k2, v2 := range vars {
+					combination[k2] = v2
+				}
+				combination[k] = v
+				next = append(next, combination)
+			}
+		}
+		result = next
+	}
+
+	return result
+}
+
+// MatrixLabel returns the human readable label of the matrix combination,
+// e.g. "distro=alpine jdk=8"
+func MatrixLabel(vars Vars) string {
+	pairs := []string{}
+	for k, v := range vars {
+		pairs = append(pairs, fmt.Sprintf("%s=%v", k, v))
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, " ")
+}
@@ -0,0 +1,60 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package template
+
+import (
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMatrix_FromFileAndExpand(t *testing.T) {
+	tempDir, rm := tplMkFiles(t, map[string]string{
+		"/matrix.yml": "jdk: [8, 11]\ndistro: [debian, alpine]\nowner: platform\n",
+	})
+	defer rm()
+
+	m, err := MatrixFromFile(path.Join(tempDir, "matrix.yml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	variants := m.Expand()
+
+	labels := []string{}
+	for _, vars := range variants {
+		labels = append(labels, MatrixLabel(vars))
+	}
+
+	assert.Equal(t, []string{
+		"distro=debian jdk=8 owner=platform",
+		"distro=debian jdk=11 owner=platform",
+		"distro=alpine jdk=8 owner=platform",
+		"distro=alpine jdk=11 owner=platform",
+	}, labels)
+}
+
+func TestMatrix_EmptyValues(t *testing.T) {
+	tempDir, rm := tplMkFiles(t, map[string]string{
+		"/matrix.json": `{"jdk": []}`,
+	})
+	defer rm()
+
+	_, err := MatrixFromFile(path.Join(tempDir, "matrix.json"))
+	assert.Contains(t, err.Error(), "has no values for jdk")
+}
@@ -28,6 +28,7 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"text/template"
 
 	"github.com/go-yaml/yaml"
@@ -39,15 +40,43 @@ import (
 // Funs is the list of additional helpers that may be given to the template
 type Funs map[string]interface{}
 
+// DigestResolver looks up the digest of the manifest the image tag points to,
+// it is used by the `digest` helper and is nil unless the caller sets it
+var DigestResolver func(image *imagename.ImageName) (string, error)
+
+// VarPrompt asks the user for the value of a missing variable of the `required`
+// helper, secret values should not be echoed; it is nil unless the caller sets
+// it, and then the missing variables are errors
+var VarPrompt func(name string, secret bool) (string, error)
+
+var (
+	digestCache   = map[string]string{}
+	digestCacheMu sync.Mutex
+)
+
+// ResetDigestCache forgets the digests resolved so far, so the next lookups go to the registry
+func ResetDigestCache() {
+	digestCacheMu.Lock()
+	defer digestCacheMu.Unlock()
+	digestCache = map[string]string{}
+}
+
 // Process renders config through the template processor.
 // vars and additional functions are acceptable.
 func Process(name string, reader io.Reader, vars Vars, funs Funs) (*bytes.Buffer, error) {
+	buf, _, err := ProcessLines(name, reader, vars, funs)
+	return buf, err
+}
+
+// ProcessLines renders the template like Process and also returns the line
+// of the source every rendered line comes from, starting from 1
+func ProcessLines(name string, reader io.Reader, vars Vars, funs Funs) (*bytes.Buffer, []int, error) {
 
 	var buf bytes.Buffer
 	// read template
 	data, err := ioutil.ReadAll(reader)
 	if err != nil {
-		return nil, fmt.Errorf("Error reading template %s, error: %s", name, err)
+		return nil, nil, fmt.Errorf("Error reading template %s, error: %s", name, err)
 	}
 
 	// Copy the vars struct because we don't want to modify the original struct
@@ -66,6 +95,9 @@ func Process(name string, reader io.Reader, vars Vars, funs Funs) (*bytes.Buffer
 		"shell":  EscapeShellarg,
 		"yaml":   yamlFn,
 		"image":  makeImageHelper(vars), // `image` helper needs to make a closure on Vars
+		"digest": makeDigestHelper(vars),
+
+		"required": makeRequiredHelper(vars),
 
 		// strings functions
 		"compare":      strings.Compare,
@@ -103,14 +135,18 @@ func Process(name string, reader io.Reader, vars Vars, funs Funs) (*bytes.Buffer
 
 	tmpl, err := template.New(name).Funcs(funcMap).Parse(string(data))
 	if err != nil {
-		return nil, fmt.Errorf("Error parsing template %s, error: %s", name, err)
+		return nil, nil, fmt.Errorf("Error parsing template %s, error: %s%s", name, err, sourceExcerpt(name, string(data), err))
 	}
 
+	markLines(tmpl, string(data))
+
 	if err := tmpl.Execute(&buf, vars); err != nil {
-		return nil, fmt.Errorf("Error executing template %s, error: %s", name, err)
+		return nil, nil, fmt.Errorf("Error executing template %s, error: %s%s", name, err, sourceExcerpt(name, string(data), err))
 	}
 
-	return &buf, nil
+	rendered, lines := stripLines(buf.Bytes())
+
+	return bytes.NewBuffer(rendered), lines, nil
 }
 
 // seq produces a sequence slice of a given length. See README.md for more info.
@@ -308,6 +344,91 @@ func makeImageHelper(vars Vars) func(string, ...string) (string, error) {
 	}
 }
 
+func makeDigestHelper(vars Vars) func(string) (string, error) {
+	artifacts, ok := vars["RockerArtifacts"].([]imagename.Artifact)
+	if !ok {
+		artifacts = []imagename.Artifact{}
+	}
+
+	return func(img string) (string, error) {
+		image := imagename.NewFromString(img)
+
+		if image.TagIsDigest() {
+			return image.GetTag(), nil
+		}
+		if !image.IsStrict() {
+			return "", fmt.Errorf("digest helper expects an exact image tag, got %s", img)
+		}
+
+		for _, a := range artifacts {
+			if a.Digest == "" || !image.IsSameKind(*a.Name) || image.GetTag() != a.Name.GetTag() {
+				continue
+			}
+			log.Infof("Apply artifact digest %s for image %s", a.Digest, image)
+			return a.Digest, nil
+		}
+
+		if shouldMatch, ok := vars["DemandArtifacts"].(bool); ok && shouldMatch {
+			return "", fmt.Errorf("Cannot find suitable artifact for image %s", image)
+		}
+
+		digestCacheMu.Lock()
+		defer digestCacheMu.Unlock()
+
+		if digest, ok := digestCache[image.String()]; ok {
+			return digest, nil
+		}
+
+		if DigestResolver == nil {
+			return "", fmt.Errorf("Cannot resolve the digest of image %s, registry lookups are not available", image)
+		}
+
+		digest, err := DigestResolver(image)
+		if err != nil {
+			return "", err
+		}
+
+		log.Infof("Resolved image %s to digest %s", image, digest)
+		digestCache[image.String()] = digest
+
+		return digest, nil
+	}
+}
+
+func makeRequiredHelper(vars Vars) func(string, ...string) (interface{}, error) {
+	return func(name string, opts ...string) (interface{}, error) {
+		secret := false
+		for _, opt := range opts {
+			if opt != "secret" {
+				return nil, fmt.Errorf("required helper got unknown option %q of variable %s, expected \"secret\"", opt, name)
+			}
+			secret = true
+		}
+
+		// false or 0 are the given values, only the absent or empty ones are missing
+		if value, ok := vars[name]; ok && value != nil && value != "" {
+			return value, nil
+		}
+
+		if VarPrompt == nil {
+			return nil, fmt.Errorf("Variable %s is required, pass it with -var %s=...", name, name)
+		}
+
+		value, err := VarPrompt(name, secret)
+		if err != nil {
+			return nil, err
+		}
+		if value == "" {
+			return nil, fmt.Errorf("Variable %s is required, got an empty value", name)
+		}
+
+		// the rest of the template sees the entered value too
+		vars[name] = value
+
+		return value, nil
+	}
+}
+
 func interfaceToInt(v interface{}) (int, error) {
 	switch v.(type) {
 	case int:
@@ -120,10 +120,41 @@ func TestProcess_AssertSuccess(t *testing.T) {
 func TestProcess_AssertFail(t *testing.T) {
 	tpl := "{{ assert .Version }}lololo"
 	_, err := Process("test", strings.NewReader(tpl), configTemplateVars, map[string]interface{}{})
-	errStr := "Error executing template test, error: template: test:1:3: executing \"test\" at <assert .Version>: error calling assert: Assertion failed"
+	errStr := "Error executing template test, error: template: test:1:3: executing \"test\" at <assert .Version>: error calling assert: Assertion failed\n" +
+		"   1 | {{ assert .Version }}lololo\n" +
+		"     |    ^"
 	assert.Equal(t, errStr, err.Error())
 }
 
+func TestProcessLines(t *testing.T) {
+	tpl := "FROM alpine\n{{ range $i := seq 2 }}RUN echo {{ $i }}\n{{ end }}\n{{ .mykey }}\nCMD [\"true\"]\n"
+	result, lines, err := ProcessLines("test", strings.NewReader(tpl), configTemplateVars, Funs{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, "FROM alpine\nRUN echo 1\nRUN echo 2\n\nmyval\nCMD [\"true\"]\n", result.String())
+	assert.Equal(t, []int{1, 2, 2, 3, 4, 5}, lines)
+}
+
+func TestProcess_ErrorExcerpt(t *testing.T) {
+	tpl := "FROM alpine\n\tRUN {{ .data.foo | unknown }}\n"
+	err := processTemplateReturnError(t, tpl)
+	assert.Error(t, err)
+	if err != nil {
+		assert.Contains(t, err.Error(), "test:2: function \"unknown\" not defined\n   2 | \tRUN {{ .data.foo | unknown }}")
+	}
+
+	tpl = "FROM alpine\n\tRUN {{ assert .missing }}\n"
+	err = processTemplateReturnError(t, tpl)
+	assert.Error(t, err)
+	if err != nil {
+		assert.Contains(t, err.Error(), "test:2:8: executing \"test\" at <assert .missing>: error calling assert: Assertion failed\n"+
+			"   2 | \tRUN {{ assert .missing }}\n"+
+			"     | \t       ^")
+	}
+}
+
 func TestProcess_Json(t *testing.T) {
 	assert.Equal(t, "key: {\"foo\":\"bar\"}", processTemplate(t, "key: {{ .data | json }}"))
 }
@@ -213,6 +244,117 @@ func TestProcess_Image_Advanced(t *testing.T) {
 	}
 }
 
+func TestProcess_Digest(t *testing.T) {
+	lookups := 0
+	DigestResolver = func(image *imagename.ImageName) (string, error) {
+		lookups++
+		if image.String() == "quay.io/org/base:1.2" {
+			return "sha256:b1a5e0", nil
+		}
+		return "", fmt.Errorf("not found %s", image)
+	}
+	defer func() {
+		DigestResolver = nil
+		ResetDigestCache()
+	}()
+
+	tests := []struct {
+		tpl     string
+		result  string
+		message string
+	}{
+		{"{{ digest `golang:1.5` }}", "sha256:ead434", "should take digest from artifacts"},
+		{"{{ digest `debian@sha256:afa` }}", "sha256:afa", "should return digest as is"},
+		{"{{ digest `quay.io/org/base:1.2` }}", "sha256:b1a5e0", "should resolve tag in the registry"},
+		{"{{ digest `quay.io/org/base:1.2` }}", "sha256:b1a5e0", "should resolve tag from cache"},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.result, processTemplate(t, test.tpl), test.message)
+	}
+
+	assert.Equal(t, 1, lookups, "should look up the registry only once")
+
+	err := processTemplateReturnError(t, "{{ digest `golang:1.*` }}")
+	assert.Error(t, err, "should not accept version ranges")
+
+	err = processTemplateReturnError(t, "{{ digest `quay.io/org/missing:1.0` }}")
+	assert.Error(t, err, "should return resolver errors")
+}
+
+func TestProcess_Digest_DemandArtifacts(t *testing.T) {
+	DigestResolver = func(image *imagename.ImageName) (string, error) {
+		t.Fatalf("should not look up %s when artifacts are demanded", image)
+		return "", nil
+	}
+	configTemplateVars["DemandArtifacts"] = true
+	defer func() {
+		configTemplateVars["DemandArtifacts"] = false
+		DigestResolver = nil
+	}()
+
+	assert.Equal(t, "sha256:fafe14", processTemplate(t, "{{ digest `data:master` }}"))
+
+	err := processTemplateReturnError(t, "{{ digest `quay.io/org/base:1.2` }}")
+	assert.Error(t, err)
+	if err != nil {
+		assert.Contains(t, err.Error(), "Cannot find suitable artifact for image quay.io/org/base:1.2")
+	}
+}
+
+func TestProcess_Required(t *testing.T) {
+	assert.Equal(t, "myval", processTemplate(t, "{{ required `mykey` }}"))
+
+	err := processTemplateReturnError(t, "{{ required `Version` }}")
+	assert.Error(t, err)
+	if err != nil {
+		assert.Contains(t, err.Error(), "Variable Version is required, pass it with -var Version=...")
+	}
+
+	err = processTemplateReturnError(t, "{{ required `mykey` `hidden` }}")
+	assert.Error(t, err, "should not accept unknown options")
+}
+
+func TestProcess_Required_FalseValues(t *testing.T) {
+	vars := Vars{"Debug": false, "Flag": "false", "Count": 0, "Empty": ""}
+
+	result, err := Process("test", strings.NewReader("{{ required `Debug` }} {{ required `Flag` }} {{ required `Count` }}"), vars, map[string]interface{}{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "false false 0", result.String())
+
+	_, err = Process("test", strings.NewReader("{{ required `Empty` }}"), vars, map[string]interface{}{})
+	assert.Error(t, err)
+	if err != nil {
+		assert.Contains(t, err.Error(), "Variable Empty is required, pass it with -var Empty=...")
+	}
+}
+
+func TestProcess_Required_Prompt(t *testing.T) {
+	prompted := map[string]bool{}
+	VarPrompt = func(name string, secret bool) (string, error) {
+		prompted[name] = secret
+		if name == "Empty" {
+			return "", nil
+		}
+		return "entered-" + name, nil
+	}
+	defer func() {
+		VarPrompt = nil
+	}()
+
+	tpl := "{{ required `mykey` }} {{ required `Version` }} {{ required `Token` `secret` }} {{ .Version }}"
+	assert.Equal(t, "myval entered-Version entered-Token entered-Version", processTemplate(t, tpl))
+	assert.Equal(t, map[string]bool{"Version": false, "Token": true}, prompted)
+
+	_, ok := configTemplateVars["Version"]
+	assert.False(t, ok, "should not modify the given vars")
+
+	err := processTemplateReturnError(t, "{{ required `Empty` }}")
+	assert.Error(t, err, "should not accept empty values")
+}
+
 func processTemplate(t *testing.T, tpl string) string {
 	result, err := Process("test", strings.NewReader(tpl), configTemplateVars, map[string]interface{}{})
 	if err != nil {
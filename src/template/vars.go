@@ -80,6 +80,35 @@ func (vars Vars) ToMapOfInterface() map[string]interface{} {
 	return result
 }
 
+// ToJSONMap converts Vars to the map that can be encoded to JSON; maps
+// decoded from YAML files have interface{} keys that JSON does not support
+func (vars Vars) ToJSONMap() map[string]interface{} {
+	result := map[string]interface{}{}
+	for k, v := range vars {
+		result[k] = jsonValue(v)
+	}
+	return result
+}
+
+// jsonValue recursively replaces the maps with interface{} keys by the maps with string keys
+func jsonValue(v interface{}) interface{} {
+	switch value := v.(type) {
+	case map[interface{}]interface{}:
+		result := map[string]interface{}{}
+		for k, v := range value {
+			result[fmt.Sprintf("%v", k)] = jsonValue(v)
+		}
+		return result
+	case []interface{}:
+		result := make([]interface{}, len(value))
+		for i, v := range value {
+			result[i] = jsonValue(v)
+		}
+		return result
+	}
+	return v
+}
+
 // MarshalJSON serialize Vars to JSON
 func (vars Vars) MarshalJSON() ([]byte, error) {
 	return json.Marshal(vars.ToStrings())
@@ -151,6 +180,33 @@ func VarsFromStrings(pairs []string) (vars Vars, err error) {
 	return vars, nil
 }
 
+// VarsFromEnv imports the environment variables, given like "KEY=value",
+// whose names start with the prefix; the prefix is stripped from the names
+func VarsFromEnv(prefix string, environ []string) Vars {
+	vars := Vars{}
+	for _, pair := range environ {
+		if !strings.HasPrefix(pair, prefix) || !strings.Contains(pair, "=") {
+			continue
+		}
+		kv := strings.SplitN(strings.TrimPrefix(pair, prefix), "=", 2)
+		if kv[0] == "" {
+			continue
+		}
+		vars[kv[0]] = kv[1]
+	}
+
+	if len(vars) > 0 {
+		names := make([]string, 0, len(vars))
+		for k := range vars {
+			names = append(names, k)
+		}
+		sort.Strings(names)
+		log.Debugf("Import vars from the environment with prefix %s: %s", prefix, strings.Join(names, ", "))
+	}
+
+	return vars
+}
+
 // VarsFromFile reads variables from either JSON or YAML file
 func VarsFromFile(filename string) (vars Vars, err error) {
 	log.Debugf("Load vars from file %s", filename)
@@ -317,3 +317,14 @@ func tplMkFiles(t *testing.T, files map[string]string) (string, func()) {
 		os.RemoveAll(tempDir)
 	}
 }
+
+func TestVarsFromEnv(t *testing.T) {
+	vars := VarsFromEnv("ROCKER_VAR_", []string{
+		"ROCKER_VAR_Version=1.2",
+		"ROCKER_VAR_Query=a=b",
+		"ROCKER_VAR_=empty",
+		"PATH=/bin",
+		"ROCKER_VARIABLE=no",
+	})
+	assert.Equal(t, Vars{"Version": "1.2", "Query": "a=b"}, vars)
+}
@@ -0,0 +1,261 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+// Package harness helps to write the integration tests of Rockerfiles and of
+// the custom commands: it builds the Rockerfiles with the rocker binary against
+// a real docker daemon, inspects the resulting images and removes everything
+// the builds created once the test is done.
+//
+//	func TestApp(t *testing.T) {
+//		h := harness.New(t)
+//		defer h.Cleanup()
+//
+//		h.WithTempRockerfile("FROM alpine\nCOPY app.conf /etc/", map[string]string{
+//			"app.conf": "debug: true",
+//		}, func(dir string) {
+//			image := h.Build(dir)
+//			h.AssertFileInImage(image, "/etc/app.conf", "debug: true")
+//		})
+//	}
+package harness
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/grammarly/rocker/src/build"
+	"github.com/grammarly/rocker/src/test"
+)
+
+// Harness runs the rocker builds of a test and keeps track of
+// the images and the containers they create
+type Harness struct {
+	// Rocker is the rocker binary, ROCKER_BINARY or rocker in PATH by default
+	Rocker string
+
+	// Docker is the docker cli binary, docker in PATH by default
+	Docker string
+
+	// ID identifies the builds of the harness, it is passed to rocker as --id
+	ID string
+
+	// BuildArgs are added to every rocker build command line
+	BuildArgs []string
+
+	t      testing.TB
+	images []string
+	builds int
+}
+
+// New returns the harness for the test; the test is skipped if either
+// rocker or docker cannot be found, or the docker daemon does not respond
+func New(t testing.TB) *Harness {
+	h := &Harness{
+		Rocker: os.Getenv("ROCKER_BINARY"),
+		Docker: "docker",
+		ID:     fmt.Sprintf("rocker-harness-%d", time.Now().UnixNano()),
+		t:      t,
+	}
+	if h.Rocker == "" {
+		h.Rocker = "rocker"
+	}
+
+	for _, bin := range []*string{&h.Rocker, &h.Docker} {
+		path, err := exec.LookPath(*bin)
+		if err != nil {
+			t.Skipf("%s is not found, skip the integration test", *bin)
+		}
+		*bin = path
+	}
+
+	if _, err := h.run(h.Docker, "version"); err != nil {
+		t.Skipf("docker daemon is not available, skip the integration test: %s", err)
+	}
+
+	return h
+}
+
+// WithTempRockerfile makes a temporary context dir with the Rockerfile and the
+// files, which are given by their relative paths, and calls fn with the dir;
+// the dir is removed after fn returns
+func (h *Harness) WithTempRockerfile(rockerfile string, files map[string]string, fn func(dir string)) {
+	dir, err := ioutil.TempDir("", "rocker-harness-")
+	if err != nil {
+		h.t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	all := map[string]string{"Rockerfile": rockerfile}
+	for name, content := range files {
+		all[name] = content
+	}
+	if err := test.MakeFiles(dir, all); err != nil {
+		h.t.Fatal(err)
+	}
+
+	fn(dir)
+}
+
+// Build builds the Rockerfile in the dir, with dir as the context, and returns
+// the ID of the resulting image; the test fails if the build does. The args
+// are passed to rocker build, e.g. --var, they must not include --id.
+func (h *Harness) Build(dir string, args ...string) (imageID string) {
+	imageID, err := h.TryBuild(dir, args...)
+	if err != nil {
+		h.t.Fatal(err)
+	}
+	return imageID
+}
+
+// TryBuild is Build that returns the error instead of failing the test,
+// e.g. to check the build fails; the output is in the error
+func (h *Harness) TryBuild(dir string, args ...string) (imageID string, err error) {
+	source, err := ioutil.ReadFile(filepath.Join(dir, "Rockerfile"))
+	if err != nil {
+		return "", err
+	}
+
+	// The final image is tagged, so it can be inspected and removed afterwards;
+	// the copy is kept out of the context, so the build does not see it
+	h.builds++
+	tag := fmt.Sprintf("%s:%d", h.ID, h.builds)
+	h.images = append(h.images, tag)
+
+	tmpDir, err := ioutil.TempDir("", "rocker-harness-rockerfile-")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	rockerfile := filepath.Join(tmpDir, "Rockerfile")
+	if err := ioutil.WriteFile(rockerfile, []byte(fmt.Sprintf("%s\nTAG %s\n", source, tag)), 0644); err != nil {
+		return "", err
+	}
+
+	cmd := []string{"--colors=false", "build", "-f", rockerfile, "--id", h.ID}
+	cmd = append(cmd, h.BuildArgs...)
+	cmd = append(cmd, args...)
+	cmd = append(cmd, dir)
+
+	if _, err := h.run(h.Rocker, cmd...); err != nil {
+		return "", fmt.Errorf("rocker build of %s failed: %s", dir, err)
+	}
+
+	if imageID, err = h.run(h.Docker, "inspect", "--format", "{{.Id}}", tag); err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(imageID), nil
+}
+
+// Run runs the command in a container of the image and returns its stdout;
+// the test fails if the command does
+func (h *Harness) Run(image string, cmd ...string) string {
+	out, err := h.run(h.Docker, append([]string{"run", "--rm", "--label", build.ContainerLabelBuildID + "=" + h.ID, image}, cmd...)...)
+	if err != nil {
+		h.t.Fatal(err)
+	}
+	return out
+}
+
+// BuildAndRun builds the Rockerfile in the dir and runs the command in
+// the resulting image, it returns the image ID and the command stdout
+func (h *Harness) BuildAndRun(dir string, cmd []string, args ...string) (imageID, output string) {
+	imageID = h.Build(dir, args...)
+	return imageID, h.Run(imageID, cmd...)
+}
+
+// AssertFileInImage checks the file exists in the image and, unless content
+// is empty, that it has the content; it returns false and marks the test
+// failed otherwise
+func (h *Harness) AssertFileInImage(image, path, content string) bool {
+	out, err := h.run(h.Docker, "run", "--rm", "--label", build.ContainerLabelBuildID+"="+h.ID, "--entrypoint", "cat", image, path)
+	if err != nil {
+		h.t.Errorf("File %s is not found in image %s: %s", path, image, err)
+		return false
+	}
+	if content != "" && out != content {
+		h.t.Errorf("File %s in image %s has unexpected content:\n%s\nexpected:\n%s", path, image, out, content)
+		return false
+	}
+	return true
+}
+
+// Track makes Cleanup remove the image as well, e.g. the one made by
+// a custom command the harness does not know about
+func (h *Harness) Track(images ...string) {
+	h.images = append(h.images, images...)
+}
+
+// Cleanup removes the containers, along with their volumes, that the builds
+// created, they are found by the build ID label; then it removes the final
+// images and the images committed by the builds, e.g. the ones of TAG, which
+// are found by the label as well. The errors are logged, but do not fail the test.
+func (h *Harness) Cleanup() {
+	label := "label=" + build.ContainerLabelBuildID + "=" + h.ID
+
+	out, err := h.run(h.Docker, "ps", "-aq", "--filter", label)
+	if err != nil {
+		h.t.Logf("Failed to list the containers of %s: %s", h.ID, err)
+	} else if ids := strings.Fields(out); len(ids) > 0 {
+		if _, err := h.run(h.Docker, append([]string{"rm", "-fv"}, ids...)...); err != nil {
+			h.t.Logf("Failed to remove the containers of %s: %s", h.ID, err)
+		}
+	}
+
+	for i := len(h.images) - 1; i >= 0; i-- {
+		if _, err := h.run(h.Docker, "rmi", "-f", h.images[i]); err != nil {
+			h.t.Logf("Failed to remove image %s: %s", h.images[i], err)
+		}
+	}
+	h.images = nil
+
+	// The images are listed the newest first, so the children go before their parents;
+	// the ones that had only the removed tags may be gone already
+	out, err = h.run(h.Docker, "images", "-aq", "--no-trunc", "--filter", label)
+	if err != nil {
+		h.t.Logf("Failed to list the images of %s: %s", h.ID, err)
+		return
+	}
+	seen := map[string]bool{}
+	for _, id := range strings.Fields(out) {
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		if _, err := h.run(h.Docker, "rmi", "-f", id); err != nil {
+			h.t.Logf("Failed to remove image %s: %s", id, err)
+		}
+	}
+}
+
+func (h *Harness) run(name string, args ...string) (string, error) {
+	var stdout, stderr bytes.Buffer
+
+	cmd := exec.Command(name, args...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		return stdout.String(), fmt.Errorf("%s %s: %s\n%s%s", filepath.Base(name), strings.Join(args, " "), err, stdout.String(), stderr.String())
+	}
+	return stdout.String(), nil
+}
@@ -0,0 +1,121 @@
+// +build !windows
+
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package harness
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeDocker logs its args and answers the commands the harness runs
+const fakeDocker = `#!/bin/sh
+echo "docker $*" >> "$HARNESS_LOG"
+case "$1" in
+  inspect) echo "sha256:0123456789ab" ;;
+  ps) echo "c1"; echo "c2" ;;
+  images) echo "sha256:2"; echo "sha256:1"; echo "sha256:2" ;;
+  run) echo "hello" ;;
+esac
+`
+
+// fakeRocker logs its args and the Rockerfile it builds
+const fakeRocker = `#!/bin/sh
+echo "rocker $*" >> "$HARNESS_LOG"
+cat "$4" >> "$HARNESS_LOG"
+`
+
+func makeFakes(t *testing.T) (dir string) {
+	dir, err := ioutil.TempDir("", "rocker-harness-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range map[string]string{"docker": fakeDocker, "rocker": fakeRocker} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestHarness(t *testing.T) {
+	dir := makeFakes(t)
+	defer os.RemoveAll(dir)
+
+	logFile := filepath.Join(dir, "log")
+	defer os.Setenv("PATH", os.Getenv("PATH"))
+	defer os.Unsetenv("HARNESS_LOG")
+	os.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	os.Setenv("HARNESS_LOG", logFile)
+
+	h := New(t)
+	assert.Equal(t, filepath.Join(dir, "rocker"), h.Rocker)
+	assert.Equal(t, filepath.Join(dir, "docker"), h.Docker)
+
+	var contextDir string
+	h.WithTempRockerfile("FROM alpine\nTAG app:1.0", map[string]string{"etc/app.conf": "x"}, func(dir string) {
+		contextDir = dir
+
+		data, err := ioutil.ReadFile(filepath.Join(dir, "etc", "app.conf"))
+		assert.NoError(t, err)
+		assert.Equal(t, "x", string(data))
+
+		image, out := h.BuildAndRun(dir, []string{"echo", "hello"}, "--var", "A=1")
+		assert.Equal(t, "sha256:0123456789ab", image)
+		assert.Equal(t, "hello\n", out)
+
+		assert.True(t, h.AssertFileInImage(image, "/etc/motd", "hello\n"))
+	})
+
+	_, err := os.Stat(contextDir)
+	assert.True(t, os.IsNotExist(err), "the context dir is removed")
+
+	h.Cleanup()
+
+	data, err := ioutil.ReadFile(logFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	log := strings.Split(strings.TrimSpace(string(data)), "\n")
+
+	rockerfile := strings.Fields(log[1])[4]
+	assert.NotEqual(t, contextDir, filepath.Dir(rockerfile), "the Rockerfile is written out of the context")
+	_, err = os.Stat(rockerfile)
+	assert.True(t, os.IsNotExist(err), "the Rockerfile is removed")
+
+	assert.Equal(t, []string{
+		"docker version",
+		"rocker --colors=false build -f " + rockerfile + " --id " + h.ID + " --var A=1 " + contextDir,
+		"FROM alpine",
+		"TAG app:1.0",
+		"TAG " + h.ID + ":1",
+		"docker inspect --format {{.Id}} " + h.ID + ":1",
+		"docker run --rm --label rocker.build.id=" + h.ID + " sha256:0123456789ab echo hello",
+		"docker run --rm --label rocker.build.id=" + h.ID + " --entrypoint cat sha256:0123456789ab /etc/motd",
+		"docker ps -aq --filter label=rocker.build.id=" + h.ID,
+		"docker rm -fv c1 c2",
+		"docker rmi -f " + h.ID + ":1",
+		"docker images -aq --no-trunc --filter label=rocker.build.id=" + h.ID,
+		"docker rmi -f sha256:2",
+		"docker rmi -f sha256:1",
+	}, log)
+}
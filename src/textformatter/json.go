@@ -0,0 +1,58 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package textformatter
+
+import (
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// JSONTimestampFormat is the format of the time of the JSON log entries
+const JSONTimestampFormat = time.RFC3339Nano
+
+// JSONFormatter is logrus.JSONFormatter that gives every entry the RFC3339
+// time with nanoseconds and the elapsed field: the seconds since rocker has
+// started, measured with the monotonic clock, so the durations computed of
+// it are not affected by the wall clock adjustments, e.g. by NTP
+type JSONFormatter struct {
+	log.JSONFormatter
+}
+
+// NewJSONFormatter returns the JSON formatter of the rocker logs
+func NewJSONFormatter() *JSONFormatter {
+	return &JSONFormatter{log.JSONFormatter{TimestampFormat: JSONTimestampFormat}}
+}
+
+// Format implements logrus.Formatter
+func (f *JSONFormatter) Format(entry *log.Entry) ([]byte, error) {
+	data := make(log.Fields, len(entry.Data)+1)
+	for k, v := range entry.Data {
+		data[k] = v
+	}
+	if _, ok := data["elapsed"]; !ok {
+		data["elapsed"] = Elapsed().Seconds()
+	}
+
+	e := *entry
+	e.Data = data
+	return f.JSONFormatter.Format(&e)
+}
+
+// Elapsed returns the time since rocker has started by the monotonic clock
+func Elapsed() time.Duration {
+	return time.Since(baseTimestamp)
+}
@@ -1,6 +1,6 @@
 // The MIT License (MIT)
 // Copyright (c) 2014 Simon Eskildsen
-// NOTE: modified to support tokens longer than 64k
+// NOTE: modified to support tokens longer than 64k and to limit the output
 
 package textformatter
 
@@ -8,25 +8,79 @@ import (
 	"bufio"
 	"io"
 	"runtime"
+	"sync/atomic"
 
 	"github.com/Sirupsen/logrus"
 )
 
+// maxLineSize is the size of the line buffer, the longer lines are logged in parts
+const maxLineSize = 1024 * 64
+
+// LogLimit is the budget of the log bytes shared by the writers of a step,
+// e.g. of the stdout and the stderr of a container
+type LogLimit struct {
+	max       int64
+	used      int64
+	truncated int32
+}
+
+// NewLogLimit returns the limit of max bytes, nil means no limit
+func NewLogLimit(max int64) *LogLimit {
+	if max <= 0 {
+		return nil
+	}
+	return &LogLimit{max: max}
+}
+
+// Max returns the number of bytes allowed
+func (l *LogLimit) Max() int64 {
+	return l.max
+}
+
+// take spends n bytes of the budget, it returns false if there are not enough;
+// the bytes are not given back, so once a line does not fit, the shorter lines
+// after it do not fit either and the log is not continued after the marker
+func (l *LogLimit) take(n int) bool {
+	if l == nil {
+		return true
+	}
+	return atomic.AddInt64(&l.used, int64(n)) <= l.max
+}
+
+// truncate returns true for the first writer that has run out of the budget
+func (l *LogLimit) truncate() bool {
+	return atomic.CompareAndSwapInt32(&l.truncated, 0, 1)
+}
+
 // LogWriter makes a pipe writer to write to the logrus logger
 func LogWriter(logger *logrus.Logger) *io.PipeWriter {
+	return EntryWriter(logrus.NewEntry(logger))
+}
+
+// EntryWriter makes a pipe writer to write to the logrus logger
+// with the fields of the entry
+func EntryWriter(entry *logrus.Entry) *io.PipeWriter {
+	return LimitedEntryWriter(entry, nil, "")
+}
+
+// LimitedEntryWriter makes a pipe writer to write to the logrus logger with
+// the fields of the entry until the limit is spent; then the marker is logged
+// once, by one of the writers sharing the limit, and the rest is discarded.
+// A write blocks until its lines are logged, so a chatty writer is slowed
+// down to the speed of the logger instead of being buffered in memory.
+func LimitedEntryWriter(entry *logrus.Entry, limit *LogLimit, marker string) *io.PipeWriter {
 	reader, writer := io.Pipe()
 
-	go logWriterScanner(logger, reader)
+	go logWriterScanner(entry, reader, limit, marker)
 	runtime.SetFinalizer(writer, writerFinalizer)
 
 	return writer
 }
 
-func logWriterScanner(logger *logrus.Logger, reader *io.PipeReader) {
+func logWriterScanner(entry *logrus.Entry, reader *io.PipeReader, limit *LogLimit, marker string) {
 	defer reader.Close()
 
-	// 64k max per line
-	buf := bufio.NewReaderSize(reader, 1024*64)
+	buf := bufio.NewReaderSize(reader, maxLineSize)
 
 	for {
 		line, _, err := buf.ReadLine()
@@ -34,10 +88,17 @@ func logWriterScanner(logger *logrus.Logger, reader *io.PipeReader) {
 			if err == io.EOF {
 				break
 			}
-			logger.Errorf("Error while reading from Writer: %s", err)
+			entry.Errorf("Error while reading from Writer: %s", err)
 			return
 		}
-		logger.Print(string(line))
+		// The discarded lines are still read, so the writer is not blocked
+		if !limit.take(len(line) + 1) {
+			if limit.truncate() && marker != "" {
+				entry.Print(marker)
+			}
+			continue
+		}
+		entry.Print(string(line))
 	}
 }
 
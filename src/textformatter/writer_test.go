@@ -0,0 +1,96 @@
+// The MIT License (MIT)
+// Copyright (c) 2014 Simon Eskildsen
+
+package textformatter
+
+import (
+	"bytes"
+	"io"
+	"sync"
+	"testing"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+type messageFormatter struct{}
+
+func (messageFormatter) Format(entry *logrus.Entry) ([]byte, error) {
+	return []byte(entry.Message + "\n"), nil
+}
+
+func TestLimitedEntryWriter(t *testing.T) {
+	var (
+		out    bytes.Buffer
+		logger = &logrus.Logger{Out: &out, Formatter: messageFormatter{}, Level: logrus.InfoLevel}
+		limit  = NewLogLimit(12)
+	)
+
+	reader, writer := io.Pipe()
+	done := make(chan struct{})
+	go func() {
+		logWriterScanner(logrus.NewEntry(logger), reader, limit, "[truncated]")
+		close(done)
+	}()
+
+	writer.Write([]byte("hello\nworld\n"))
+	writer.Write([]byte("more\nand more\n"))
+	writer.Close()
+	<-done
+
+	assert.Equal(t, "hello\nworld\n[truncated]\n", out.String())
+}
+
+func TestLimitedEntryWriter_ShortLinesAfterTruncated(t *testing.T) {
+	var (
+		out    bytes.Buffer
+		logger = &logrus.Logger{Out: &out, Formatter: messageFormatter{}, Level: logrus.InfoLevel}
+		limit  = NewLogLimit(20)
+	)
+
+	reader, writer := io.Pipe()
+	done := make(chan struct{})
+	go func() {
+		logWriterScanner(logrus.NewEntry(logger), reader, limit, "[truncated]")
+		close(done)
+	}()
+
+	writer.Write([]byte("hello\n"))
+	writer.Write([]byte("a line that does not fit\n"))
+	writer.Write([]byte("ok\nshort\n"))
+	writer.Close()
+	<-done
+
+	assert.Equal(t, "hello\n[truncated]\n", out.String())
+}
+
+func TestLogLimitShared(t *testing.T) {
+	var (
+		limit = NewLogLimit(1000)
+		wg    sync.WaitGroup
+		taken int64
+		mu    sync.Mutex
+	)
+
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				if limit.take(3) {
+					mu.Lock()
+					taken += 3
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, int64(999), taken)
+	assert.True(t, limit.truncate())
+	assert.False(t, limit.truncate())
+
+	assert.Nil(t, NewLogLimit(0))
+	assert.True(t, (*LogLimit)(nil).take(1<<20))
+}
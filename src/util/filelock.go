@@ -0,0 +1,108 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package util
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// DefaultLockTimeout is how long LockFile waits for a lock held by another
+// process before it gives up, unless changed by SetLockTimeout
+const DefaultLockTimeout = 5 * time.Minute
+
+// lockRetryInterval is how often a busy lock is retried
+var lockRetryInterval = 100 * time.Millisecond
+
+var lockTimeout = struct {
+	sync.Mutex
+	d time.Duration
+}{
+	d: DefaultLockTimeout,
+}
+
+// SetLockTimeout sets how long LockFile waits for a busy lock,
+// zero means it fails immediately
+func SetLockTimeout(d time.Duration) {
+	lockTimeout.Lock()
+	defer lockTimeout.Unlock()
+	lockTimeout.d = d
+}
+
+// LockTimeout returns how long LockFile waits for a busy lock
+func LockTimeout() time.Duration {
+	lockTimeout.Lock()
+	defer lockTimeout.Unlock()
+	return lockTimeout.d
+}
+
+// FileLock is an advisory lock held on a file, it coordinates the rocker
+// processes sharing the same directory, e.g. the cache dir
+type FileLock struct {
+	f *os.File
+}
+
+// LockFile takes a lock on the file at path, creating it and its directory
+// if needed. Shared locks may be held by many processes at once, an exclusive
+// lock by a single one. It waits up to LockTimeout for the lock to be released.
+func LockFile(path string, exclusive bool) (*FileLock, error) {
+	if err := MkdirAllOutput(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := ChownOutput(path); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	deadline := time.Now().Add(LockTimeout())
+
+	for {
+		ok, err := tryLock(f, exclusive)
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("Failed to lock %s, error: %s", path, err)
+		}
+		if ok {
+			return &FileLock{f: f}, nil
+		}
+		if !time.Now().Before(deadline) {
+			f.Close()
+			return nil, fmt.Errorf("Timed out waiting for the lock %s, it is held by another rocker process; see --cache-lock-timeout", path)
+		}
+		time.Sleep(lockRetryInterval)
+	}
+}
+
+// Unlock releases the lock
+func (l *FileLock) Unlock() error {
+	if l == nil || l.f == nil {
+		return nil
+	}
+	err := unlock(l.f)
+	if err2 := l.f.Close(); err == nil {
+		err = err2
+	}
+	l.f = nil
+	return err
+}
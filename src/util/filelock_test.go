@@ -0,0 +1,75 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package util
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLockFile(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("file locks are not supported on windows")
+	}
+
+	dir, err := ioutil.TempDir("", "rocker-filelock-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer SetLockTimeout(DefaultLockTimeout)
+
+	SetLockTimeout(300 * time.Millisecond)
+
+	path := filepath.Join(dir, "locks", "key.lock")
+
+	shared1, err := LockFile(path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	shared2, err := LockFile(path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = LockFile(path, true)
+	assert.Contains(t, err.Error(), "Timed out waiting for the lock")
+
+	assert.NoError(t, shared1.Unlock())
+
+	// the exclusive lock is taken as soon as the last shared lock is released
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		shared2.Unlock()
+	}()
+
+	exclusive, err := LockFile(path, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = LockFile(path, false)
+	assert.Contains(t, err.Error(), "Timed out waiting for the lock")
+
+	assert.NoError(t, exclusive.Unlock())
+	assert.NoError(t, exclusive.Unlock(), "unlocking twice is a no-op")
+}
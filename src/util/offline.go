@@ -0,0 +1,47 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package util
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+var offline int32
+
+// SetOffline forbids, or allows again, the network operations of rocker,
+// e.g. pulls, registry requests, url downloads and S3
+func SetOffline(value bool) {
+	var v int32
+	if value {
+		v = 1
+	}
+	atomic.StoreInt32(&offline, v)
+}
+
+// Offline returns true if the network operations are forbidden
+func Offline() bool {
+	return atomic.LoadInt32(&offline) != 0
+}
+
+// CheckOffline returns the error if the network operations are forbidden,
+// the operation is described by the arguments, e.g. "pull %s", name
+func CheckOffline(format string, args ...interface{}) error {
+	if !Offline() {
+		return nil
+	}
+	return fmt.Errorf("Cannot %s in offline mode (--offline)", fmt.Sprintf(format, args...))
+}
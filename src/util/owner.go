@@ -0,0 +1,159 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package util
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Owner is the uid and gid the files written by rocker are given,
+// see SetOutputOwner; -1 keeps the gid unchanged
+type Owner struct {
+	UID int
+	GID int
+}
+
+// String returns the owner in uid:gid format
+func (o Owner) String() string {
+	if o.GID < 0 {
+		return strconv.Itoa(o.UID)
+	}
+	return fmt.Sprintf("%d:%d", o.UID, o.GID)
+}
+
+// ParseOwner parses the owner given as uid:gid or uid, the ids must be numeric
+// since the user may not exist where rocker runs
+func ParseOwner(s string) (*Owner, error) {
+	if runtime.GOOS == "windows" {
+		return nil, fmt.Errorf("Changing the owner of the output files is not supported on windows")
+	}
+
+	parts := strings.SplitN(s, ":", 2)
+	uid, err := strconv.Atoi(parts[0])
+	if err != nil || uid < 0 {
+		return nil, fmt.Errorf("Invalid owner %q, expected numeric uid:gid", s)
+	}
+
+	o := &Owner{UID: uid, GID: -1}
+	if len(parts) == 2 {
+		if o.GID, err = strconv.Atoi(parts[1]); err != nil || o.GID < 0 {
+			return nil, fmt.Errorf("Invalid owner %q, expected numeric uid:gid", s)
+		}
+	}
+	return o, nil
+}
+
+var outputOwner = struct {
+	sync.Mutex
+	owner *Owner
+}{}
+
+// SetOutputOwner sets the owner of the files and the directories rocker
+// writes to the cache dir and the artifacts path, nil leaves them to the
+// user rocker runs as
+func SetOutputOwner(o *Owner) {
+	outputOwner.Lock()
+	defer outputOwner.Unlock()
+	outputOwner.owner = o
+}
+
+// OutputOwner returns the owner set by SetOutputOwner, or nil
+func OutputOwner() *Owner {
+	outputOwner.Lock()
+	defer outputOwner.Unlock()
+	return outputOwner.owner
+}
+
+// ChownOutput gives the file or the directory to the output owner,
+// it is a no-op if the owner is not set
+func ChownOutput(path string) error {
+	o := OutputOwner()
+	if o == nil {
+		return nil
+	}
+	if err := os.Lchown(path, o.UID, o.GID); err != nil {
+		return fmt.Errorf("Failed to change the owner of %s to %s, error: %s", path, o, err)
+	}
+	return nil
+}
+
+// ChownOutputTree gives the directory and all of its content to the output owner
+func ChownOutputTree(root string) error {
+	if OutputOwner() == nil {
+		return nil
+	}
+	return filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		return ChownOutput(path)
+	})
+}
+
+// MkdirAllOutput is os.MkdirAll that gives the directories
+// it creates to the output owner
+func MkdirAllOutput(path string, perm os.FileMode) error {
+	// Find the directories that are missing, so the existing ones are left alone
+	var missing []string
+	for dir := filepath.Clean(path); ; dir = filepath.Dir(dir) {
+		if _, err := os.Stat(dir); err == nil || !os.IsNotExist(err) {
+			break
+		}
+		missing = append(missing, dir)
+		if dir == filepath.Dir(dir) {
+			break
+		}
+	}
+
+	if err := os.MkdirAll(path, perm); err != nil {
+		return err
+	}
+
+	for i := len(missing) - 1; i >= 0; i-- {
+		if err := ChownOutput(missing[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WriteOutputFile is ioutil.WriteFile that gives the file to the output owner
+func WriteOutputFile(fileName string, data []byte, perm os.FileMode) error {
+	if err := ioutil.WriteFile(fileName, data, perm); err != nil {
+		return err
+	}
+	return ChownOutput(fileName)
+}
+
+// CreateOutputFile is os.Create that gives the file to the output owner
+func CreateOutputFile(fileName string) (*os.File, error) {
+	f, err := os.Create(fileName)
+	if err != nil {
+		return nil, err
+	}
+	if err := ChownOutput(fileName); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
@@ -0,0 +1,80 @@
+// +build !windows
+
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package util
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseOwner(t *testing.T) {
+	o, err := ParseOwner("1000:1001")
+	assert.NoError(t, err)
+	assert.Equal(t, &Owner{UID: 1000, GID: 1001}, o)
+	assert.Equal(t, "1000:1001", o.String())
+
+	o, err = ParseOwner("1000")
+	assert.NoError(t, err)
+	assert.Equal(t, &Owner{UID: 1000, GID: -1}, o)
+	assert.Equal(t, "1000", o.String())
+
+	for _, s := range []string{"", "jenkins:jenkins", "1000:", "-1:0", "1000:x"} {
+		_, err := ParseOwner(s)
+		assert.Error(t, err, s)
+	}
+}
+
+func TestMkdirAllOutput(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rocker-owner-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer SetOutputOwner(nil)
+
+	// Without root only the own uid and gid can be given
+	SetOutputOwner(&Owner{UID: os.Getuid(), GID: os.Getgid()})
+
+	path := filepath.Join(dir, "a", "b")
+	if err := MkdirAllOutput(path, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteOutputFile(filepath.Join(path, "c.yml"), []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, p := range []string{filepath.Join(dir, "a"), path, filepath.Join(path, "c.yml")} {
+		info, err := os.Stat(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		st := info.Sys().(*syscall.Stat_t)
+		assert.EqualValues(t, os.Getuid(), st.Uid, p)
+		assert.EqualValues(t, os.Getgid(), st.Gid, p)
+	}
+
+	assert.NoError(t, ChownOutputTree(dir))
+
+	SetOutputOwner(nil)
+	assert.NoError(t, ChownOutput(filepath.Join(dir, "missing")), "no-op without the owner")
+}
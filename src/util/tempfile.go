@@ -0,0 +1,145 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package util
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tempFiles keeps the temporary files made by TempFile,
+// so they can be removed even if their owner fails to
+var tempFiles = struct {
+	sync.Mutex
+	dir   string
+	names map[string]bool
+}{
+	names: map[string]bool{},
+}
+
+// SetTempDir sets the directory where TempFile makes the files, it is
+// created if it does not exist; empty dir means the system temp dir
+func SetTempDir(dir string) error {
+	if dir != "" {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return fmt.Errorf("Failed to create temp dir %s, error: %s", dir, err)
+		}
+	}
+
+	tempFiles.Lock()
+	defer tempFiles.Unlock()
+
+	tempFiles.dir = dir
+	return nil
+}
+
+// TempDir returns the directory for the temporary files
+func TempDir() string {
+	tempFiles.Lock()
+	defer tempFiles.Unlock()
+
+	if tempFiles.dir == "" {
+		return os.TempDir()
+	}
+	return tempFiles.dir
+}
+
+// TempFile creates a new temporary file in TempDir and remembers it
+// until it is removed by RemoveTempFile or CleanupTempFiles
+func TempFile(prefix string) (*os.File, error) {
+	f, err := ioutil.TempFile(TempDir(), prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	tempFiles.Lock()
+	tempFiles.names[f.Name()] = true
+	tempFiles.Unlock()
+
+	return f, nil
+}
+
+// MkTempDir creates a new temporary directory in TempDir and remembers it
+// the same way as TempFile; it is removed along with its content
+func MkTempDir(prefix string) (string, error) {
+	name, err := ioutil.TempDir(TempDir(), prefix)
+	if err != nil {
+		return "", err
+	}
+
+	tempFiles.Lock()
+	tempFiles.names[name] = true
+	tempFiles.Unlock()
+
+	return name, nil
+}
+
+// RemoveTempFile removes the file or the directory made by TempFile or MkTempDir
+func RemoveTempFile(name string) error {
+	tempFiles.Lock()
+	delete(tempFiles.names, name)
+	tempFiles.Unlock()
+
+	if err := os.RemoveAll(name); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// CleanupTempFiles removes all the files and the directories made by TempFile
+// and MkTempDir that are still there
+func CleanupTempFiles() {
+	tempFiles.Lock()
+	names := tempFiles.names
+	tempFiles.names = map[string]bool{}
+	tempFiles.Unlock()
+
+	for name := range names {
+		os.RemoveAll(name)
+	}
+}
+
+// SweepTempFiles removes the files with the given prefix in TempDir that are
+// older than maxAge, i.e. the ones left by the processes that were killed
+func SweepTempFiles(prefix string, maxAge time.Duration) (removed []string, err error) {
+	dir := TempDir()
+
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	deadline := time.Now().Add(-maxAge)
+
+	for _, info := range infos {
+		if info.IsDir() || !strings.HasPrefix(info.Name(), prefix) || info.ModTime().After(deadline) {
+			continue
+		}
+		name := filepath.Join(dir, info.Name())
+		if err := os.Remove(name); err != nil && !os.IsNotExist(err) {
+			return removed, err
+		}
+		removed = append(removed, name)
+	}
+
+	return removed, nil
+}
@@ -0,0 +1,128 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package util
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTempFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rocker-tempfile-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer SetTempDir("")
+
+	if err := SetTempDir(filepath.Join(dir, "tmp")); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, filepath.Join(dir, "tmp"), TempDir())
+
+	f1, err := TempFile("rocker_test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f1.Close()
+	f2, err := TempFile("rocker_test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f2.Close()
+
+	assert.Equal(t, filepath.Join(dir, "tmp"), filepath.Dir(f1.Name()))
+
+	assert.Nil(t, RemoveTempFile(f1.Name()))
+	_, err = os.Stat(f1.Name())
+	assert.True(t, os.IsNotExist(err), "removed temp file should not exist")
+
+	CleanupTempFiles()
+	_, err = os.Stat(f2.Name())
+	assert.True(t, os.IsNotExist(err), "temp file should be removed by cleanup")
+}
+
+func TestMkTempDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rocker-tempfile-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer SetTempDir("")
+
+	if err := SetTempDir(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	tmpDir, err := MkTempDir("rocker_test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, dir, filepath.Dir(tmpDir))
+
+	if err := ioutil.WriteFile(filepath.Join(tmpDir, "file"), []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	CleanupTempFiles()
+	_, err = os.Stat(tmpDir)
+	assert.True(t, os.IsNotExist(err), "temp dir should be removed by cleanup along with its content")
+}
+
+func TestSweepTempFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rocker-tempfile-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer SetTempDir("")
+
+	if err := SetTempDir(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	old := time.Now().Add(-48 * time.Hour)
+	for _, name := range []string{"rocker_image_old", "rocker_image_new", "other_old"} {
+		fileName := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(fileName, []byte{}, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if name != "rocker_image_new" {
+			if err := os.Chtimes(fileName, old, old); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	removed, err := SweepTempFiles("rocker_image_", 24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, []string{filepath.Join(dir, "rocker_image_old")}, removed)
+
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Len(t, infos, 2)
+}
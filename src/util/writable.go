@@ -0,0 +1,80 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package util
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// CheckWritableDir returns an error if the files can not be written to the
+// directory; the directory that does not exist yet is checked by its
+// nearest existing parent, where it is going to be created
+func CheckWritableDir(dir string) error {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+
+	for {
+		info, err := os.Stat(dir)
+		if err == nil {
+			if !info.IsDir() {
+				return fmt.Errorf("%s is not a directory", dir)
+			}
+			f, err := ioutil.TempFile(dir, ".rocker-write-check")
+			if err != nil {
+				return err
+			}
+			f.Close()
+			return os.Remove(f.Name())
+		}
+		if !os.IsNotExist(err) {
+			return err
+		}
+
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return err
+		}
+		dir = parent
+	}
+}
+
+// CheckWritableFile returns an error if the file can not be written,
+// the file that does not exist yet is checked by its directory
+func CheckWritableFile(fileName string) error {
+	info, err := os.Stat(fileName)
+	if os.IsNotExist(err) {
+		return CheckWritableDir(filepath.Dir(fileName))
+	}
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return fmt.Errorf("%s is a directory", fileName)
+	}
+
+	// Opening for writing does not truncate the file
+	f, err := os.OpenFile(fileName, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,66 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package util
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckWritable(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rocker-writable-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "file")
+	if err := ioutil.WriteFile(file, []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Nil(t, CheckWritableDir(dir))
+	assert.Nil(t, CheckWritableDir(filepath.Join(dir, "a", "b")))
+	assert.Nil(t, CheckWritableFile(file))
+	assert.Nil(t, CheckWritableFile(filepath.Join(dir, "a", "file")))
+
+	assert.EqualError(t, CheckWritableDir(file), file+" is not a directory")
+	assert.EqualError(t, CheckWritableDir(filepath.Join(file, "a")), "stat "+file+"/a: not a directory")
+	assert.EqualError(t, CheckWritableFile(dir), dir+" is a directory")
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Len(t, files, 1, "should leave nothing behind")
+
+	content, _ := ioutil.ReadFile(file)
+	assert.Equal(t, "data", string(content), "should not truncate the file")
+
+	if os.Getuid() == 0 {
+		t.Skip("root can write to the read-only directories")
+	}
+	readonly := filepath.Join(dir, "readonly")
+	if err := os.Mkdir(readonly, 0555); err != nil {
+		t.Fatal(err)
+	}
+	assert.Error(t, CheckWritableDir(filepath.Join(readonly, "artifacts")))
+}